@@ -0,0 +1,247 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	ctx "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike"
+	"github.com/omec-project/n3iwf/ike/handler"
+	"github.com/omec-project/n3iwf/ike/message"
+	ikeservice "github.com/omec-project/n3iwf/ike/service"
+	"github.com/omec-project/n3iwf/logger"
+	"github.com/omec-project/n3iwf/util"
+)
+
+const (
+	shutdownTimeout = 2 * time.Second
+	// Of the liveness checks requested through POST /ike-sa/{localSpi}/dpd
+	defaultLivenessCheckTimeout = 5 * time.Second
+	maxLivenessCheckTimeout     = time.Minute
+)
+
+var (
+	adminServer *http.Server
+	// Closed to stop the refresh of the child SA traffic counters
+	trafficStop chan struct{}
+)
+
+// Run starts the local admin HTTP endpoint used to inspect live IKE and child SAs.
+// It is a no-op when no admin address is configured
+func Run(n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) error {
+	if n3iwfCtx.AdminBindAddress == "" {
+		logger.AdminLog.Infoln("admin endpoint disabled")
+		return nil
+	}
+
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx.Background(), "tcp", n3iwfCtx.AdminBindAddress)
+	if err != nil {
+		logger.AdminLog.Errorf("failed to listen on admin address: %+v", err)
+		return err
+	}
+
+	adminServer = &http.Server{
+		Handler:           NewHandler(n3iwfCtx),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	logger.AdminLog.Infof("admin endpoint listening on %s", listener.Addr())
+
+	trafficStop = make(chan struct{})
+	if n3iwfCtx.TrafficStatsInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer util.RecoverWithLog(logger.AdminLog)
+			defer wg.Done()
+			refreshTraffic(n3iwfCtx, trafficStop)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer util.RecoverWithLog(logger.AdminLog)
+		defer wg.Done()
+		if err := adminServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.AdminLog.Errorf("admin endpoint stopped: %+v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop shuts the admin endpoint down
+func Stop(n3iwfCtx *context.N3IWFContext) {
+	if adminServer == nil {
+		return
+	}
+	logger.AdminLog.Infoln("closing admin endpoint")
+	close(trafficStop)
+	shutdownCtx, cancel := ctx.WithTimeout(ctx.Background(), shutdownTimeout)
+	defer cancel()
+	if err := adminServer.Shutdown(shutdownCtx); err != nil {
+		logger.AdminLog.Errorf("error stopping admin endpoint: %+v", err)
+	}
+}
+
+// refreshTraffic reads the child SA traffic counters every TrafficStatsInterval
+// until stop is closed
+func refreshTraffic(n3iwfCtx *context.N3IWFContext, stop <-chan struct{}) {
+	ticker := time.NewTicker(n3iwfCtx.TrafficStatsInterval)
+	defer ticker.Stop()
+	for {
+		n3iwfCtx.RefreshTraffic()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// NewHandler returns the admin HTTP routes:
+//
+//	GET /ike-sa                                     list all IKE SAs
+//	GET /ike-sa/{localSpi}/child-sa                 list the child SAs of an IKE SA (SPI in hex)
+//	DELETE /ike-sa/{localSpi}/child-sa/{inboundSpi} ask the UE to delete a child SA (SPIs in hex)
+//	POST /ike-sa/{localSpi}/dpd                     check that the UE answers a DPD request, within ?timeout= (5s)
+//	GET /stats                                      protection and exchange failure counters
+//	GET /stats/ike-sa-establishment                 IKE SA establishment latency by auth outcome
+//	GET /stats/child-sa-traffic                     bytes and packets of the child SAs by UE
+//	GET /healthz                                    state of the services, 503 when one is down
+func NewHandler(n3iwfCtx *context.N3IWFContext) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		components, healthy := n3iwfCtx.Health.Status()
+		status, code := "ok", http.StatusOK
+		if !healthy {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, healthResponse{Status: status, Components: components})
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]uint64{
+			"ikeSaInitRateLimited":  n3iwfCtx.IKESAInitLimiter.Dropped(),
+			"ikeSaInitShed":         n3iwfCtx.IkeServer.IKESAInitShed(),
+			"initialUeQueued":       uint64(n3iwfCtx.InitialUEPacer.Queued()),
+			"initialUeRejected":     n3iwfCtx.InitialUEPacer.Rejected(),
+			"ikeHandlerPanics":      ike.PanicsRecovered(),
+			"ikeSaInitFailures":     handler.ExchangeFailures(message.IKE_SA_INIT),
+			"ikeAuthFailures":       handler.ExchangeFailures(message.IKE_AUTH),
+			"createChildSaFailures": handler.ExchangeFailures(message.CREATE_CHILD_SA),
+			"informationalFailures": handler.ExchangeFailures(message.INFORMATIONAL),
+			"ikeCaptureDropped":     n3iwfCtx.IKECapture.Dropped(),
+			"ikeSendDropped":        n3iwfCtx.IkeServer.SendDropped(),
+			"ikeSaCount":            uint64(n3iwfCtx.IKESACount()),
+			"ikeSaCapRejected":      n3iwfCtx.IKESACapRejections(),
+		})
+	})
+	mux.HandleFunc("GET /stats/ike-sa-establishment", func(w http.ResponseWriter, r *http.Request) {
+		histograms := make(map[string]handler.LatencyHistogram)
+		for _, outcome := range handler.EstablishmentOutcomes {
+			histograms[outcome] = handler.EstablishmentLatency(outcome)
+		}
+		writeJSON(w, http.StatusOK, histograms)
+	})
+	mux.HandleFunc("GET /stats/child-sa-traffic", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n3iwfCtx.Traffic())
+	})
+	mux.HandleFunc("GET /ike-sa", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n3iwfCtx.ListIKESecurityAssociations())
+	})
+	mux.HandleFunc("GET /ike-sa/{localSpi}/child-sa", func(w http.ResponseWriter, r *http.Request) {
+		localSPI, err := strconv.ParseUint(r.PathValue("localSpi"), 16, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid SPI"})
+			return
+		}
+		childSAs, err := n3iwfCtx.ListChildSAs(localSPI)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, childSAs)
+	})
+	mux.HandleFunc("DELETE /ike-sa/{localSpi}/child-sa/{inboundSpi}", func(w http.ResponseWriter, r *http.Request) {
+		localSPI, err := strconv.ParseUint(r.PathValue("localSpi"), 16, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid SPI"})
+			return
+		}
+		inboundSPI, err := strconv.ParseUint(r.PathValue("inboundSpi"), 16, 32)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid SPI"})
+			return
+		}
+		childSAs, err := n3iwfCtx.ListChildSAs(localSPI)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		if !slices.ContainsFunc(childSAs, func(childSA context.ChildSASummary) bool {
+			return childSA.InboundSPI == fmt.Sprintf("%08x", inboundSPI)
+		}) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "child SA not found"})
+			return
+		}
+		// The UE is asked from the IKE event loop, the child SA is deleted once it answers
+		evt := context.NewDeleteChildSABySPIEvt(localSPI, []uint32{uint32(inboundSPI)})
+		if !n3iwfCtx.IkeServer.SendEvent(evt) {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "IKE server stopped"})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]bool{"deleteRequested": true})
+	})
+	mux.HandleFunc("POST /ike-sa/{localSpi}/dpd", func(w http.ResponseWriter, r *http.Request) {
+		localSPI, err := strconv.ParseUint(r.PathValue("localSpi"), 16, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid SPI"})
+			return
+		}
+		timeout := defaultLivenessCheckTimeout
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 || timeout > maxLivenessCheckTimeout {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid timeout"})
+				return
+			}
+		}
+		if _, ok := n3iwfCtx.IKESALoad(localSPI); !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "IKE SA not found"})
+			return
+		}
+		err = ikeservice.CheckLiveness(r.Context(), n3iwfCtx, localSPI, timeout)
+		switch {
+		case err == nil:
+			writeJSON(w, http.StatusOK, map[string]bool{"alive": true})
+		case errors.Is(err, context.ErrDPDTimeout):
+			writeJSON(w, http.StatusOK, map[string]bool{"alive": false})
+		default:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+	})
+	return mux
+}
+
+// healthResponse is the body of GET /healthz
+type healthResponse struct {
+	Status     string          `json:"status"`
+	Components map[string]bool `json:"components"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.AdminLog.Errorf("encode admin response failed: %+v", err)
+	}
+}
@@ -0,0 +1,281 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"encoding/json"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/handler"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestAdminHandler(t *testing.T) {
+	n3iwfCtx := &context.N3IWFContext{}
+	ikeUe := &context.N3IWFIkeUe{
+		N3iwfCtx:     n3iwfCtx,
+		IPSecInnerIP: net.ParseIP("10.0.0.5"),
+		N3IWFChildSecurityAssociation: map[uint32]*context.ChildSecurityAssociation{
+			0x10: {
+				InboundSPI:         0x10,
+				OutboundSPI:        0x20,
+				SelectedIPProtocol: message.IPProtocolTCP,
+				EnableEncapsulate:  true,
+			},
+		},
+	}
+	ikeSA := &context.IKESecurityAssociation{
+		LocalSPI:    0xabc,
+		RemoteSPI:   0xdef,
+		UeBehindNAT: true,
+		IkeUE:       ikeUe,
+		InitiatorID: &message.IdentificationInitiator{IDType: message.ID_FQDN, IDData: []byte("ue.example.org")},
+		IKEConnection: &context.UDPSocketInfo{
+			UEAddr: &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 4500},
+		},
+	}
+	n3iwfCtx.IkeSA.Store(ikeSA.LocalSPI, ikeSA)
+	handler := NewHandler(n3iwfCtx)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ike-sa", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status mismatch. got = %d, want = %d", rec.Code, http.StatusOK)
+	}
+	var ikeSAs []context.IKESASummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &ikeSAs); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(ikeSAs) != 1 || ikeSAs[0].LocalSPI != "0000000000000abc" || !ikeSAs[0].UeBehindNAT ||
+		ikeSAs[0].PeerAddress != "192.168.1.2:4500" || ikeSAs[0].InnerIPAddress != "10.0.0.5" ||
+		ikeSAs[0].ChildSACount != 1 {
+		t.Errorf("Unexpected IKE SA list: %+v", ikeSAs)
+	}
+	// The identity of the UE is hashed, as in the logs
+	if len(ikeSAs) == 1 && ikeSAs[0].UEIdentity != "5fcf12e2bdcbe2b7" {
+		t.Errorf("UE identity mismatch. got = %s, want = 5fcf12e2bdcbe2b7", ikeSAs[0].UEIdentity)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ike-sa/abc/child-sa", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status mismatch. got = %d, want = %d", rec.Code, http.StatusOK)
+	}
+	var childSAs []context.ChildSASummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &childSAs); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(childSAs) != 1 || childSAs[0].InboundSPI != "00000010" || childSAs[0].OutboundSPI != "00000020" ||
+		childSAs[0].IPProtocol != message.IPProtocolTCP || !childSAs[0].EnableEncapsulate {
+		t.Errorf("Unexpected child SA list: %+v", childSAs)
+	}
+
+	for path, expStatus := range map[string]int{
+		"/ike-sa/123/child-sa": http.StatusNotFound,
+		"/ike-sa/xyz/child-sa": http.StatusBadRequest,
+	} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != expStatus {
+			t.Errorf("%s: status mismatch. got = %d, want = %d", path, rec.Code, expStatus)
+		}
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	limiter := context.NewInitRateLimiter(1, 1)
+	ueIP := net.ParseIP("192.168.1.2")
+	limiter.Allow(ueIP)
+	limiter.Allow(ueIP)
+	handler := NewHandler(&context.N3IWFContext{IKESAInitLimiter: limiter})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status mismatch. got = %d, want = %d", rec.Code, http.StatusOK)
+	}
+	var stats map[string]uint64
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if stats["ikeSaInitRateLimited"] != 1 {
+		t.Errorf("rate limited count mismatch. got = %d, want = 1", stats["ikeSaInitRateLimited"])
+	}
+	for _, key := range []string{"ikeSaInitFailures", "ikeAuthFailures", "createChildSaFailures", "informationalFailures",
+		"ikeSaCount", "ikeSaCapRejected"} {
+		if _, ok := stats[key]; !ok {
+			t.Errorf("%s missing from stats", key)
+		}
+	}
+}
+
+func TestAdminEstablishmentLatency(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewHandler(&context.N3IWFContext{}).ServeHTTP(rec,
+		httptest.NewRequest(http.MethodGet, "/stats/ike-sa-establishment", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status mismatch. got = %d, want = %d", rec.Code, http.StatusOK)
+	}
+	var histograms map[string]handler.LatencyHistogram
+	if err := json.Unmarshal(rec.Body.Bytes(), &histograms); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	for _, outcome := range handler.EstablishmentOutcomes {
+		histogram, ok := histograms[outcome]
+		if !ok {
+			t.Errorf("%s missing from establishment latency", outcome)
+			continue
+		}
+		if last := histogram.Buckets[len(histogram.Buckets)-1]; last.LE != "+Inf" {
+			t.Errorf("%s: last bucket mismatch. got = %s, want = +Inf", outcome, last.LE)
+		}
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	testcases := []struct {
+		description string
+		components  map[string]bool
+		expStatus   int
+	}{
+		{
+			description: "all services up",
+			components: map[string]bool{
+				context.HealthXFRM:             true,
+				context.HealthIKEEventLoop:     true,
+				context.HealthIKEListener(500): true,
+			},
+			expStatus: http.StatusOK,
+		},
+		{
+			description: "IKE listener exited",
+			components: map[string]bool{
+				context.HealthXFRM:              true,
+				context.HealthIKEListener(500):  true,
+				context.HealthIKEListener(4500): false,
+			},
+			expStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx := &context.N3IWFContext{}
+			for component, up := range tc.components {
+				n3iwfCtx.Health.Set(component, up)
+			}
+			rec := httptest.NewRecorder()
+			NewHandler(n3iwfCtx).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != tc.expStatus {
+				t.Fatalf("status mismatch. got = %d, want = %d", rec.Code, tc.expStatus)
+			}
+			var health healthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if !maps.Equal(health.Components, tc.components) {
+				t.Errorf("components mismatch. got = %v, want = %v", health.Components, tc.components)
+			}
+		})
+	}
+}
+
+func TestAdminChildSATraffic(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewHandler(&context.N3IWFContext{}).ServeHTTP(rec,
+		httptest.NewRequest(http.MethodGet, "/stats/child-sa-traffic", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status mismatch. got = %d, want = %d", rec.Code, http.StatusOK)
+	}
+	var snapshot context.TrafficSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &snapshot); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if snapshot.UEs == nil || len(snapshot.UEs) != 0 {
+		t.Errorf("UEs mismatch. got = %v, want = empty", snapshot.UEs)
+	}
+}
+
+func TestAdminLivenessCheck(t *testing.T) {
+	n3iwfCtx := &context.N3IWFContext{}
+	ikeSA := &context.IKESecurityAssociation{LocalSPI: 0xabc}
+	n3iwfCtx.IkeSA.Store(ikeSA.LocalSPI, ikeSA)
+	handler := NewHandler(n3iwfCtx)
+
+	testcases := []struct {
+		description string
+		target      string
+		expStatus   int
+	}{
+		{description: "invalid SPI", target: "/ike-sa/xyz/dpd", expStatus: http.StatusBadRequest},
+		{description: "invalid timeout", target: "/ike-sa/abc/dpd?timeout=soon", expStatus: http.StatusBadRequest},
+		{description: "timeout too long", target: "/ike-sa/abc/dpd?timeout=1h", expStatus: http.StatusBadRequest},
+		{description: "unknown IKE SA", target: "/ike-sa/def/dpd", expStatus: http.StatusNotFound},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.target, nil))
+			if rec.Code != tc.expStatus {
+				t.Errorf("status mismatch. got = %d, want = %d", rec.Code, tc.expStatus)
+			}
+		})
+	}
+}
+
+func TestAdminDeleteChildSA(t *testing.T) {
+	n3iwfCtx := &context.N3IWFContext{
+		IkeServer: &context.IkeServer{RcvEventCh: make(chan context.IkeEvt, 1), Done: make(chan struct{})},
+	}
+	ikeUe := &context.N3IWFIkeUe{
+		N3iwfCtx: n3iwfCtx,
+		N3IWFChildSecurityAssociation: map[uint32]*context.ChildSecurityAssociation{
+			0x10: {InboundSPI: 0x10, OutboundSPI: 0x20},
+		},
+	}
+	ikeSA := &context.IKESecurityAssociation{LocalSPI: 0xabc, IkeUE: ikeUe}
+	n3iwfCtx.IkeSA.Store(ikeSA.LocalSPI, ikeSA)
+	handler := NewHandler(n3iwfCtx)
+
+	testcases := []struct {
+		description string
+		target      string
+		expStatus   int
+	}{
+		{description: "invalid SPI", target: "/ike-sa/abc/child-sa/xyz", expStatus: http.StatusBadRequest},
+		{description: "unknown IKE SA", target: "/ike-sa/def/child-sa/10", expStatus: http.StatusNotFound},
+		{description: "unknown child SA", target: "/ike-sa/abc/child-sa/20", expStatus: http.StatusNotFound},
+		{description: "delete requested", target: "/ike-sa/abc/child-sa/10", expStatus: http.StatusAccepted},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, tc.target, nil))
+			if rec.Code != tc.expStatus {
+				t.Fatalf("status mismatch. got = %d, want = %d", rec.Code, tc.expStatus)
+			}
+			select {
+			case evt := <-n3iwfCtx.IkeServer.RcvEventCh:
+				deleteEvt, ok := evt.(*context.DeleteChildSABySPIEvt)
+				if tc.expStatus != http.StatusAccepted || !ok || deleteEvt.LocalSPI != 0xabc ||
+					!slices.Equal(deleteEvt.InboundSPIs, []uint32{0x10}) {
+					t.Errorf("Unexpected IKE event: %+v", evt)
+				}
+			default:
+				if tc.expStatus == http.StatusAccepted {
+					t.Errorf("DeleteChildSABySPI event not sent")
+				}
+			}
+		})
+	}
+}
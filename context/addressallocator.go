@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// AddressAllocator assigns the inner IP addresses of the UEs in place of the
+// Subnet pool, e.g. from an external IPAM or RADIUS server applying per user
+// policies. The addresses must be routed to the N3IWF, only Subnet is routed
+// through its XFRM interface. The UE is identified by the content of its IDi
+// payload, see IKESecurityAssociation.UEIdentity, the N3IWF does not learn
+// its SUPI. It is called from the IKE event loop, Release must not block
+type AddressAllocator interface {
+	// Allocate returns the inner IPv4 address of the UE with its netmask, and
+	// the DNS servers of the UE, the configured ones if nil. It is given up
+	// once ctx is done, the address returned afterwards is released
+	Allocate(ctx context.Context, ueIdentity string) (ip net.IP, netmask net.IPMask, dns []net.IP, err error)
+	// Release returns an address given by Allocate
+	Release(ueIdentity string, ip net.IP)
+}
+
+// Time the IKE event loop waits for the AddressAllocator, replaced in tests
+var addressAllocationTimeout = 2 * time.Second
+
+type addressAllocation struct {
+	ip      net.IP
+	netmask net.IPMask
+	dns     []net.IP
+	err     error
+}
+
+// AllocateUEInnerAddress leases the inner IP address of ikeUe, from the
+// AddressAllocator if set, from Subnet otherwise, and records its netmask and
+// DNS servers on ikeUe. The AddressAllocator is waited for at most
+// addressAllocationTimeout
+func (n3iwfCtx *N3IWFContext) AllocateUEInnerAddress(ikeUe *N3IWFIkeUe) (net.IP, error) {
+	if n3iwfCtx.AddressAllocator == nil {
+		ip, err := n3iwfCtx.NewInternalUEIPAddr(ikeUe)
+		if err != nil {
+			return nil, err
+		}
+		ikeUe.InnerNetmask = n3iwfCtx.Subnet.Mask
+		ikeUe.InnerDNSServers = nil
+		return ip, nil
+	}
+
+	ueIdentity := ikeUe.N3IWFIKESecurityAssociation.UEIdentity()
+	allocator := n3iwfCtx.AddressAllocator
+	ctx, cancel := context.WithTimeout(context.Background(), addressAllocationTimeout)
+	defer cancel()
+	result := make(chan addressAllocation, 1)
+	go func() {
+		ip, netmask, dns, err := allocator.Allocate(ctx, ueIdentity)
+		result <- addressAllocation{ip: ip, netmask: netmask, dns: dns, err: err}
+	}()
+	var allocation addressAllocation
+	select {
+	case allocation = <-result:
+	case <-ctx.Done():
+		// The address of a late answer is leased to nobody
+		go func() {
+			if late := <-result; late.err == nil && late.ip != nil {
+				allocator.Release(ueIdentity, late.ip)
+			}
+		}()
+		return nil, fmt.Errorf("AllocateUEInnerAddress: %w", ctx.Err())
+	}
+	ip, netmask, dns, err := allocation.ip, allocation.netmask, allocation.dns, allocation.err
+	if err != nil {
+		return nil, fmt.Errorf("AllocateUEInnerAddress: %w", err)
+	}
+	if ip.To4() == nil || len(netmask) != net.IPv4len {
+		n3iwfCtx.AddressAllocator.Release(ueIdentity, ip)
+		return nil, fmt.Errorf("AllocateUEInnerAddress: %s/%s is not an IPv4 address", ip, netmask)
+	}
+	ip = ip.To4()
+	// Also the lookup of the UE by inner address of the user plane
+	if _, loaded := n3iwfCtx.AllocatedUeIpAddress.LoadOrStore(ip.String(), ikeUe); loaded {
+		n3iwfCtx.AddressAllocator.Release(ueIdentity, ip)
+		return nil, fmt.Errorf("AllocateUEInnerAddress: %s is leased to another UE", ip)
+	}
+	ikeUe.InnerNetmask = netmask
+	ikeUe.InnerDNSServers = dns
+	return ip, nil
+}
+
+// ReleaseUEInnerAddress releases the lease of ipAddr if it is held by ikeUe,
+// returning the address to the AddressAllocator if set
+func (n3iwfCtx *N3IWFContext) ReleaseUEInnerAddress(ikeUe *N3IWFIkeUe, ipAddr net.IP) {
+	if !n3iwfCtx.ReleaseInternalUEIPAddr(ikeUe, ipAddr) || n3iwfCtx.AddressAllocator == nil {
+		return
+	}
+	n3iwfCtx.AddressAllocator.Release(ikeUe.N3IWFIKESecurityAssociation.UEIdentity(), ipAddr)
+}
+
+// UEDNSServers returns the DNS servers sent to ikeUe
+func (n3iwfCtx *N3IWFContext) UEDNSServers(ikeUe *N3IWFIkeUe) []net.IP {
+	if ikeUe != nil && ikeUe.InnerDNSServers != nil {
+		return ikeUe.InnerDNSServers
+	}
+	return n3iwfCtx.DNSServers
+}
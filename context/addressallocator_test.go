@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+type fakeAddressAllocator struct {
+	ip       net.IP
+	netmask  net.IPMask
+	dns      []net.IP
+	err      error
+	delay    chan struct{} // Answers once closed, if set
+	released chan string
+}
+
+func (a *fakeAddressAllocator) Allocate(ctx context.Context, ueIdentity string) (net.IP, net.IPMask, []net.IP, error) {
+	if a.delay != nil {
+		<-a.delay
+	}
+	return a.ip, a.netmask, a.dns, a.err
+}
+
+func (a *fakeAddressAllocator) Release(ueIdentity string, ip net.IP) {
+	a.released <- ueIdentity + "/" + ip.String()
+}
+
+// releasedAddresses returns the addresses released so far
+func (a *fakeAddressAllocator) releasedAddresses() []string {
+	var released []string
+	for {
+		select {
+		case lease := <-a.released:
+			released = append(released, lease)
+		default:
+			return released
+		}
+	}
+}
+
+func newAllocatorTestIkeUe() *N3IWFIkeUe {
+	ikeSA := &IKESecurityAssociation{
+		InitiatorID: &message.IdentificationInitiator{IDData: []byte("imsi-208930000000001")},
+	}
+	ikeUe := &N3IWFIkeUe{N3IWFIKESecurityAssociation: ikeSA}
+	ikeSA.IkeUE = ikeUe
+	return ikeUe
+}
+
+func TestAllocateUEInnerAddress(t *testing.T) {
+	dns := []net.IP{net.ParseIP("192.0.2.53")}
+	mask := net.CIDRMask(16, 32)
+
+	testcases := []struct {
+		description  string
+		allocator    *fakeAddressAllocator
+		otherLease   bool
+		expectedErr  bool
+		expectedDNS  []net.IP
+		expectedFree []string
+	}{
+		{
+			description: "external address",
+			allocator:   &fakeAddressAllocator{ip: net.ParseIP("172.16.0.9"), netmask: mask, dns: dns},
+			expectedDNS: dns,
+		},
+		{
+			description: "external address with the configured DNS servers",
+			allocator:   &fakeAddressAllocator{ip: net.ParseIP("172.16.0.9"), netmask: mask},
+			expectedDNS: []net.IP{net.ParseIP("8.8.8.8")},
+		},
+		{
+			description: "allocator failure",
+			allocator:   &fakeAddressAllocator{err: errors.New("IPAM unreachable")},
+			expectedErr: true,
+		},
+		{
+			description:  "IPv6 address",
+			allocator:    &fakeAddressAllocator{ip: net.ParseIP("2001:db8::9"), netmask: mask},
+			expectedErr:  true,
+			expectedFree: []string{"imsi-208930000000001/2001:db8::9"},
+		},
+		{
+			description:  "address leased to another UE",
+			allocator:    &fakeAddressAllocator{ip: net.ParseIP("172.16.0.9"), netmask: mask},
+			otherLease:   true,
+			expectedErr:  true,
+			expectedFree: []string{"imsi-208930000000001/172.16.0.9"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			tc.allocator.released = make(chan string, 2)
+			n3iwfCtx := &N3IWFContext{AddressAllocator: tc.allocator, DNSServers: []net.IP{net.ParseIP("8.8.8.8")}}
+			if tc.otherLease {
+				n3iwfCtx.AllocatedUeIpAddress.Store("172.16.0.9", new(N3IWFIkeUe))
+			}
+			ikeUe := newAllocatorTestIkeUe()
+			ip, err := n3iwfCtx.AllocateUEInnerAddress(ikeUe)
+			released := tc.allocator.releasedAddresses()
+			if len(released) != len(tc.expectedFree) || (len(tc.expectedFree) > 0 && released[0] != tc.expectedFree[0]) {
+				t.Errorf("released mismatch. got = %v, want = %v", released, tc.expectedFree)
+			}
+			if tc.expectedErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !ip.Equal(tc.allocator.ip) || ikeUe.InnerNetmask.String() != mask.String() {
+				t.Errorf("address mismatch. got = %s/%s, want = %s/%s", ip, ikeUe.InnerNetmask, tc.allocator.ip, mask)
+			}
+			if got := n3iwfCtx.UEDNSServers(ikeUe); len(got) != 1 || !got[0].Equal(tc.expectedDNS[0]) {
+				t.Errorf("DNS mismatch. got = %v, want = %v", got, tc.expectedDNS)
+			}
+
+			n3iwfCtx.ReleaseUEInnerAddress(ikeUe, ip)
+			if _, ok := n3iwfCtx.AllocatedUEIPAddressLoad(ip.String()); ok {
+				t.Errorf("lease of IP %s not released", ip)
+			}
+			if released := tc.allocator.releasedAddresses(); len(released) != 1 ||
+				released[0] != "imsi-208930000000001/172.16.0.9" {
+				t.Errorf("released mismatch. got = %v", released)
+			}
+		})
+	}
+}
+
+func TestAllocateUEInnerAddressTimeout(t *testing.T) {
+	timeout := addressAllocationTimeout
+	defer func() { addressAllocationTimeout = timeout }()
+	addressAllocationTimeout = 10 * time.Millisecond
+
+	allocator := &fakeAddressAllocator{
+		ip:       net.ParseIP("172.16.0.9"),
+		netmask:  net.CIDRMask(16, 32),
+		delay:    make(chan struct{}),
+		released: make(chan string, 1),
+	}
+	n3iwfCtx := &N3IWFContext{AddressAllocator: allocator}
+	ikeUe := newAllocatorTestIkeUe()
+	if _, err := n3iwfCtx.AllocateUEInnerAddress(ikeUe); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error mismatch. got = %v, want = %v", err, context.DeadlineExceeded)
+	}
+
+	// The address of the late answer is given back
+	close(allocator.delay)
+	select {
+	case lease := <-allocator.released:
+		if lease != "imsi-208930000000001/172.16.0.9" {
+			t.Errorf("released mismatch. got = %s", lease)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("late address not released")
+	}
+	if _, ok := n3iwfCtx.AllocatedUEIPAddressLoad("172.16.0.9"); ok {
+		t.Error("late address leased")
+	}
+}
+
+func TestAllocateUEInnerAddressFromSubnet(t *testing.T) {
+	n3iwfCtx := newIPPoolTestContext(t, "10.0.0.0/24", "10.0.0.1")
+	ikeUe := newAllocatorTestIkeUe()
+	ip, err := n3iwfCtx.AllocateUEInnerAddress(ikeUe)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !n3iwfCtx.Subnet.Contains(ip) || ikeUe.InnerNetmask.String() != n3iwfCtx.Subnet.Mask.String() {
+		t.Errorf("address mismatch. got = %s/%s, want in %s", ip, ikeUe.InnerNetmask, n3iwfCtx.Subnet)
+	}
+	n3iwfCtx.ReleaseUEInnerAddress(ikeUe, ip)
+	if _, ok := n3iwfCtx.AllocatedUEIPAddressLoad(ip.String()); ok {
+		t.Errorf("lease of IP %s not released", ip)
+	}
+}
@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omec-project/n3iwf/logger"
+)
+
+// AuditAction tells whether an audited SA was established or torn down
+type AuditAction uint8
+
+const (
+	AuditEstablish AuditAction = iota
+	AuditTeardown
+)
+
+func (a AuditAction) String() string {
+	if a == AuditTeardown {
+		return "teardown"
+	}
+	return "establish"
+}
+
+func (a AuditAction) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// AuditReason is the reason code of an audit record
+type AuditReason uint8
+
+const (
+	AuditAuthSuccess AuditReason = iota + 1 // EAP-5G authentication succeeded
+	AuditAuthFailure                        // EAP-5G authentication failed or never completed
+	AuditDPDTimeout                         // The UE no longer answers dead peer detection or another request
+	AuditDelete                             // Deleted by the UE, the AMF or the N3IWF
+	AuditRekey                              // Child SA replacing a rekeyed one
+	AuditPDUSession                         // Child SA of a PDU session
+)
+
+func (r AuditReason) String() string {
+	switch r {
+	case AuditAuthSuccess:
+		return "auth-success"
+	case AuditAuthFailure:
+		return "auth-failure"
+	case AuditDPDTimeout:
+		return "dpd-timeout"
+	case AuditDelete:
+		return "delete"
+	case AuditRekey:
+		return "rekey"
+	case AuditPDUSession:
+		return "pdu-session"
+	default:
+		return strconv.Itoa(int(r))
+	}
+}
+
+func (r AuditReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// AuditRecord is the establishment or the teardown of an IKE SA or, when
+// ChildSPI is set, of one of its child SAs
+type AuditRecord struct {
+	Time       time.Time   `json:"time"`
+	Action     AuditAction `json:"action"`
+	Reason     AuditReason `json:"reason"`
+	IKESPI     string      `json:"ikeSpi"`             // Local SPI of the IKE SA
+	ChildSPI   string      `json:"childSpi,omitempty"` // Inbound SPI of the child SA
+	UEIdentity string      `json:"ueIdentity,omitempty"`
+	OuterIP    net.IP      `json:"outerIp,omitempty"`
+	InnerIP    net.IP      `json:"innerIp,omitempty"`
+}
+
+// AuditSink receives the audit records of the SAs, whatever the log level. It
+// is called with the IKE SA locked and must not block
+type AuditSink interface {
+	Audit(record *AuditRecord)
+}
+
+func newAuditRecord(ikeSA *IKESecurityAssociation, action AuditAction, reason AuditReason) *AuditRecord {
+	record := &AuditRecord{
+		Time:       time.Now(),
+		Action:     action,
+		Reason:     reason,
+		IKESPI:     fmt.Sprintf("%016x", ikeSA.LocalSPI),
+		UEIdentity: ikeSA.UEIdentity(),
+	}
+	if ikeSA.IKEConnection != nil && ikeSA.IKEConnection.UEAddr != nil {
+		record.OuterIP = ikeSA.IKEConnection.UEAddr.IP
+	}
+	if ikeSA.IkeUE != nil {
+		record.InnerIP = ikeSA.IkeUE.IPSecInnerIP
+	}
+	return record
+}
+
+// AuditIKESA passes the establishment or the teardown of ikeSA to the
+// configured audit sink, if any
+func (n3iwfCtx *N3IWFContext) AuditIKESA(ikeSA *IKESecurityAssociation, action AuditAction, reason AuditReason) {
+	if n3iwfCtx.AuditSink == nil || ikeSA == nil {
+		return
+	}
+	n3iwfCtx.AuditSink.Audit(newAuditRecord(ikeSA, action, reason))
+}
+
+// AuditChildSA passes the establishment or the teardown of childSA, a child
+// SA of ikeSA, to the configured audit sink, if any
+func (n3iwfCtx *N3IWFContext) AuditChildSA(ikeSA *IKESecurityAssociation, childSA *ChildSecurityAssociation,
+	action AuditAction, reason AuditReason,
+) {
+	if n3iwfCtx.AuditSink == nil || ikeSA == nil || childSA == nil {
+		return
+	}
+	record := newAuditRecord(ikeSA, action, reason)
+	record.ChildSPI = fmt.Sprintf("%08x", childSA.InboundSPI)
+	n3iwfCtx.AuditSink.Audit(record)
+}
+
+// AuditIKESATeardown audits the teardown of ikeSA and of its child SAs, for
+// the TeardownReason of the SA if set, for reason otherwise
+func (n3iwfCtx *N3IWFContext) AuditIKESATeardown(ikeSA *IKESecurityAssociation, reason AuditReason) {
+	if n3iwfCtx.AuditSink == nil || ikeSA == nil {
+		return
+	}
+	if ikeSA.TeardownReason != 0 {
+		reason = ikeSA.TeardownReason
+	}
+	if ikeSA.IkeUE != nil {
+		for _, childSA := range ikeSA.IkeUE.N3IWFChildSecurityAssociation {
+			n3iwfCtx.AuditChildSA(ikeSA, childSA, AuditTeardown, reason)
+		}
+	}
+	n3iwfCtx.AuditIKESA(ikeSA, AuditTeardown, reason)
+}
+
+// FileAuditSink appends the audit records to a file, one JSON object per line,
+// so they can be shipped to a SIEM apart from the logs
+type FileAuditSink struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewFileAuditSink opens the file at path for appending, creating it if needed
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("NewFileAuditSink: %w", err)
+	}
+	return &FileAuditSink{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (s *FileAuditSink) Audit(record *AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.encoder.Encode(record); err != nil {
+		logger.CtxLog.Errorf("write audit record: %v", err)
+	}
+}
+
+// Close closes the file of the sink
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+type recordingAuditSink struct {
+	records []*AuditRecord
+}
+
+func (r *recordingAuditSink) Audit(record *AuditRecord) {
+	r.records = append(r.records, record)
+}
+
+func newAuditedIKESA() *IKESecurityAssociation {
+	ikeSA := &IKESecurityAssociation{
+		LocalSPI:    0x1234,
+		InitiatorID: &message.IdentificationInitiator{IDData: []byte("imsi-208930000000001")},
+	}
+	ikeSA.IkeUE = &N3IWFIkeUe{
+		N3IWFIKESecurityAssociation: ikeSA,
+		IKEConnection: &UDPSocketInfo{
+			UEAddr: &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 4500},
+		},
+		IPSecInnerIP: net.ParseIP("10.0.0.2"),
+		N3IWFChildSecurityAssociation: map[uint32]*ChildSecurityAssociation{
+			0xabcd: {InboundSPI: 0xabcd},
+		},
+	}
+	ikeSA.IKEConnection = ikeSA.IkeUE.IKEConnection
+	return ikeSA
+}
+
+func TestAuditIKESATeardown(t *testing.T) {
+	testcases := []struct {
+		description    string
+		teardownReason AuditReason
+		expReason      AuditReason
+	}{
+		{
+			description: "reason of the teardown",
+			expReason:   AuditDelete,
+		},
+		{
+			description:    "reason set on the SA",
+			teardownReason: AuditDPDTimeout,
+			expReason:      AuditDPDTimeout,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeSA := newAuditedIKESA()
+			ikeSA.TeardownReason = tc.teardownReason
+
+			n3iwfCtx := &N3IWFContext{}
+			// No sink configured
+			n3iwfCtx.AuditIKESATeardown(ikeSA, AuditDelete)
+
+			sink := &recordingAuditSink{}
+			n3iwfCtx.AuditSink = sink
+			n3iwfCtx.AuditIKESATeardown(ikeSA, AuditDelete)
+			if len(sink.records) != 2 {
+				t.Fatalf("record count mismatch. got = %d, want = 2", len(sink.records))
+			}
+			if sink.records[0].ChildSPI != "0000abcd" || sink.records[1].ChildSPI != "" {
+				t.Errorf("child SPI mismatch. got = %q/%q, want = 0000abcd/", sink.records[0].ChildSPI,
+					sink.records[1].ChildSPI)
+			}
+			for _, record := range sink.records {
+				if record.Action != AuditTeardown || record.Reason != tc.expReason {
+					t.Errorf("action mismatch. got = %v/%v, want = teardown/%v", record.Action, record.Reason,
+						tc.expReason)
+				}
+				if record.IKESPI != "0000000000001234" || record.UEIdentity != "imsi-208930000000001" {
+					t.Errorf("SA mismatch. got = %s/%s", record.IKESPI, record.UEIdentity)
+				}
+				if !record.OuterIP.Equal(net.ParseIP("192.168.1.10")) || !record.InnerIP.Equal(net.ParseIP("10.0.0.2")) {
+					t.Errorf("address mismatch. got = %s/%s, want = 192.168.1.10/10.0.0.2", record.OuterIP,
+						record.InnerIP)
+				}
+			}
+		})
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	n3iwfCtx := &N3IWFContext{AuditSink: sink}
+	n3iwfCtx.AuditIKESA(newAuditedIKESA(), AuditEstablish, AuditAuthSuccess)
+	if err = sink.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var record map[string]any
+	if err = json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for key, want := range map[string]string{
+		"action":     "establish",
+		"reason":     "auth-success",
+		"ikeSpi":     "0000000000001234",
+		"ueIdentity": "imsi-208930000000001",
+		"outerIp":    "192.168.1.10",
+		"innerIp":    "10.0.0.2",
+	} {
+		if record[key] != want {
+			t.Errorf("%s mismatch. got = %v, want = %v", key, record[key], want)
+		}
+	}
+	if _, ok := record["childSpi"]; ok {
+		t.Errorf("unexpected childSpi in IKE SA record: %s", data)
+	}
+}
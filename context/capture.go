@@ -0,0 +1,249 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omec-project/n3iwf/logger"
+)
+
+const (
+	// Datagrams waiting to be written before new ones are dropped
+	captureQueueLen = 1024
+	// Max delay before captured datagrams reach the file
+	captureFlushInterval = time.Second
+
+	pcapMagic        = 0xa1b2c3d4
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 65535
+	// LINKTYPE_RAW, records start with the IPv4 or IPv6 header
+	pcapLinkTypeRaw = 101
+
+	captureTTL      = 64
+	captureProtoUDP = 17
+	udpHeaderLen    = 8
+)
+
+// IKECapture writes the raw IKE datagrams exchanged with UEs, with their outer
+// UDP/IP addresses, to a pcap file readable by Wireshark. Datagrams are
+// queued and written by a goroutine, so capturing never blocks the IKE send
+// and receive paths; they are dropped while the queue is full. A nil capture
+// does not capture anything
+type IKECapture struct {
+	queue   chan capturedDatagram
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Uint64
+	err     error
+}
+
+type capturedDatagram struct {
+	timestamp time.Time
+	src, dst  *net.UDPAddr
+	payload   []byte
+}
+
+// NewIKECapture creates the pcap file at path, truncating an existing one,
+// and starts writing captured datagrams to it
+func NewIKECapture(path string) (*IKECapture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("NewIKECapture: %w", err)
+	}
+	w := bufio.NewWriter(file)
+	if err = writePcapHeader(w); err != nil {
+		return nil, errors.Join(fmt.Errorf("NewIKECapture: %w", err), file.Close())
+	}
+	c := &IKECapture{
+		queue: make(chan capturedDatagram, captureQueueLen),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go c.run(w, file)
+	return c, nil
+}
+
+// Capture queues datagram, the UDP payload of an IKE message received or sent
+// by the N3IWF on localAddr. The datagram is copied
+func (c *IKECapture) Capture(direction TraceDirection, localAddr, remoteAddr *net.UDPAddr, datagram []byte) {
+	if c == nil {
+		return
+	}
+	select {
+	case <-c.stop:
+		return
+	default:
+	}
+	d := capturedDatagram{
+		timestamp: time.Now(),
+		src:       remoteAddr,
+		dst:       localAddr,
+		payload:   append([]byte(nil), datagram...),
+	}
+	if direction == TraceOutbound {
+		d.src, d.dst = localAddr, remoteAddr
+	}
+	select {
+	case c.queue <- d:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of datagrams dropped because the queue was full
+func (c *IKECapture) Dropped() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.dropped.Load()
+}
+
+// Close writes the queued datagrams and closes the file. Later captures are ignored
+func (c *IKECapture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.once.Do(func() { close(c.stop) })
+	<-c.done
+	return c.err
+}
+
+func (c *IKECapture) run(w *bufio.Writer, file *os.File) {
+	defer close(c.done)
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+
+	write := func(d capturedDatagram) {
+		if err := writePcapRecord(w, d); err != nil {
+			logger.IKELog.Warnf("IKE capture: %v", err)
+		}
+	}
+	for {
+		select {
+		case d := <-c.queue:
+			write(d)
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				logger.IKELog.Warnf("IKE capture: %v", err)
+			}
+		case <-c.stop:
+			// Only this goroutine receives, the queue cannot be emptied meanwhile
+			for len(c.queue) > 0 {
+				write(<-c.queue)
+			}
+			c.err = errors.Join(w.Flush(), file.Close())
+			return
+		}
+	}
+}
+
+// writePcapHeader writes the pcap global header, in little endian
+func writePcapHeader(w io.Writer) error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(header[6:8], pcapVersionMinor)
+	// Time zone and timestamp accuracy are left to 0
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkTypeRaw)
+	_, err := w.Write(header)
+	return err
+}
+
+// writePcapRecord writes d as an IP packet carrying a UDP datagram
+func writePcapRecord(w io.Writer, d capturedDatagram) error {
+	packet, err := buildUDPPacket(d.src, d.dst, d.payload)
+	if err != nil {
+		return err
+	}
+	capLen := min(len(packet), pcapSnapLen)
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(d.timestamp.Unix()))           // #nosec G115
+	binary.LittleEndian.PutUint32(header[4:8], uint32(d.timestamp.Nanosecond()/1e3)) // #nosec G115
+	binary.LittleEndian.PutUint32(header[8:12], uint32(capLen))                      // #nosec G115
+	binary.LittleEndian.PutUint32(header[12:16], uint32(len(packet)))                // #nosec G115
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(packet[:capLen])
+	return err
+}
+
+// buildUDPPacket prepends the UDP and IPv4 or IPv6 headers from src to dst to payload
+func buildUDPPacket(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	if src == nil || dst == nil {
+		return nil, errors.New("buildUDPPacket: missing address")
+	}
+	udpLen := udpHeaderLen + len(payload)
+	if udpLen > 0xffff {
+		return nil, fmt.Errorf("buildUDPPacket: datagram too large: %d bytes", len(payload))
+	}
+	udp := make([]byte, udpLen)
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port)) // #nosec G115
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port)) // #nosec G115
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))   // #nosec G115
+	copy(udp[udpHeaderLen:], payload)
+
+	var packet, pseudoHeader []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		packet = make([]byte, 20, 20+udpLen)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:4], uint16(20+udpLen)) // #nosec G115
+		packet[8] = captureTTL
+		packet[9] = captureProtoUDP
+		copy(packet[12:16], src4)
+		copy(packet[16:20], dst4)
+		binary.BigEndian.PutUint16(packet[10:12], internetChecksum(packet))
+		pseudoHeader = append(append([]byte{}, src4...), dst4...)
+		pseudoHeader = append(pseudoHeader, 0, captureProtoUDP, udp[4], udp[5])
+	} else {
+		src16, dst16 := src.IP.To16(), dst.IP.To16()
+		if src16 == nil || dst16 == nil {
+			return nil, fmt.Errorf("buildUDPPacket: invalid addresses %s and %s", src.IP, dst.IP)
+		}
+		packet = make([]byte, 40, 40+udpLen)
+		packet[0] = 6 << 4
+		binary.BigEndian.PutUint16(packet[4:6], uint16(udpLen)) // #nosec G115
+		packet[6] = captureProtoUDP
+		packet[7] = captureTTL
+		copy(packet[8:24], src16)
+		copy(packet[24:40], dst16)
+		pseudoHeader = append(append([]byte{}, src16...), dst16...)
+		pseudoHeader = append(pseudoHeader, 0, 0, udp[4], udp[5], 0, 0, 0, captureProtoUDP)
+	}
+	udpChecksum := internetChecksum(append(pseudoHeader, udp...))
+	if udpChecksum == 0 {
+		udpChecksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], udpChecksum)
+	return append(packet, udp...), nil
+}
+
+// internetChecksum computes the checksum of RFC 1071
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIKECapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ike.pcap")
+	capture, err := NewIKECapture(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		description string
+		direction   TraceDirection
+		localAddr   *net.UDPAddr
+		remoteAddr  *net.UDPAddr
+		datagram    []byte
+		expVersion  byte
+		expSrcPort  uint16
+	}{
+		{
+			description: "inbound IPv4",
+			direction:   TraceInbound,
+			localAddr:   &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 500},
+			remoteAddr:  &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 500},
+			datagram:    bytes.Repeat([]byte{0x21}, 29),
+			expVersion:  4,
+			expSrcPort:  500,
+		},
+		{
+			description: "outbound IPv6 with NAT-T",
+			direction:   TraceOutbound,
+			localAddr:   &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4500},
+			remoteAddr:  &net.UDPAddr{IP: net.ParseIP("2001:db8::10"), Port: 31000},
+			datagram:    append(make([]byte, 4), bytes.Repeat([]byte{0x2e}, 28)...),
+			expVersion:  6,
+			expSrcPort:  4500,
+		},
+	}
+	for _, tc := range testcases {
+		capture.Capture(tc.direction, tc.localAddr, tc.remoteAddr, tc.datagram)
+	}
+	if err = capture.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Ignored once closed
+	capture.Capture(TraceInbound, testcases[0].localAddr, testcases[0].remoteAddr, testcases[0].datagram)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(data) < 24 || binary.LittleEndian.Uint32(data[0:4]) != pcapMagic ||
+		binary.LittleEndian.Uint32(data[20:24]) != pcapLinkTypeRaw {
+		t.Fatalf("invalid pcap global header: %x", data[:min(len(data), 24)])
+	}
+	records := data[24:]
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if len(records) < 16 {
+				t.Fatalf("missing pcap record")
+			}
+			capLen := binary.LittleEndian.Uint32(records[8:12])
+			packet := records[16 : 16+capLen]
+			records = records[16+capLen:]
+
+			if version := packet[0] >> 4; version != tc.expVersion {
+				t.Fatalf("IP version mismatch. got = %d, want = %d", version, tc.expVersion)
+			}
+			var udp, pseudoHeader []byte
+			if tc.expVersion == 4 {
+				if internetChecksum(packet[:20]) != 0 {
+					t.Errorf("invalid IPv4 header checksum")
+				}
+				udp = packet[20:]
+				pseudoHeader = append(append([]byte{}, packet[12:20]...), 0, captureProtoUDP, udp[4], udp[5])
+			} else {
+				udp = packet[40:]
+				pseudoHeader = append(append([]byte{}, packet[8:40]...), 0, 0, udp[4], udp[5], 0, 0, 0, captureProtoUDP)
+			}
+			if internetChecksum(append(pseudoHeader, udp...)) != 0 {
+				t.Errorf("invalid UDP checksum")
+			}
+			if srcPort := binary.BigEndian.Uint16(udp[0:2]); srcPort != tc.expSrcPort {
+				t.Errorf("source port mismatch. got = %d, want = %d", srcPort, tc.expSrcPort)
+			}
+			if !bytes.Equal(udp[udpHeaderLen:], tc.datagram) {
+				t.Errorf("datagram mismatch. got = %x, want = %x", udp[udpHeaderLen:], tc.datagram)
+			}
+		})
+	}
+	if len(records) != 0 {
+		t.Errorf("Unexpected trailing records: %d bytes", len(records))
+	}
+}
+
+func TestNilIKECapture(t *testing.T) {
+	var capture *IKECapture
+	capture.Capture(TraceInbound, &net.UDPAddr{}, &net.UDPAddr{}, []byte{0x01})
+	if capture.Dropped() != 0 {
+		t.Errorf("Unexpected dropped datagrams")
+	}
+	if err := capture.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -7,15 +7,18 @@ package context
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto"
+	"encoding/binary"
 	"fmt"
 	"math"
-	"math/big"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ishidawataru/sctp"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/ike/security/encr"
 	"github.com/omec-project/n3iwf/logger"
 	"github.com/omec-project/ngap/v2/ngapType"
 	"github.com/omec-project/util/idgenerator"
@@ -26,6 +29,25 @@ import (
 // Global N3IWF context instance
 var n3iwfContext N3IWFContext
 
+// IPsecMode selects how the child SAs are bound to the user plane
+type IPsecMode uint8
+
+const (
+	// States and policies bound to XFRM interfaces by if_id, an interface for
+	// each additional PDU session of a UE
+	IPsecModeInterface IPsecMode = iota
+	// Classic policy based IPsec without XFRM interface, the additional PDU
+	// sessions of a UE told apart by firewall mark
+	IPsecModePolicy
+)
+
+func (mode IPsecMode) String() string {
+	if mode == IPsecModePolicy {
+		return "policy"
+	}
+	return "xfrmi"
+}
+
 // N3IWFContext holds all state and configuration for the N3IWF node
 // Pools use sync.Map for concurrent access
 // Comments added for clarity
@@ -43,6 +65,7 @@ type N3IWFContext struct {
 	AmfReInitAvailableList sync.Map // map[string]bool, SCTPAddr as key
 	IkeSA                  sync.Map // map[uint64]*IKESecurityAssociation, SPI as key
 	ChildSA                sync.Map // map[uint32]*ChildSecurityAssociation, inboundSPI as key
+	outboundChildSA        sync.Map // map[outboundSAID]*ChildSecurityAssociation, see IndexOutboundSPI
 	GtpConnectionUPF       sync.Map // map[string]*gtpv1.UPlaneConn, UPF address as key
 	AllocatedUeIpAddress   sync.Map // map[string]*N3IWFIkeUe, IPAddr as key
 	AllocatedUeTeid        sync.Map // map[uint32]*RanUe, TEID as key
@@ -54,28 +77,57 @@ type N3IWFContext struct {
 	// N3IWF FQDN
 	Fqdn string
 
+	// Identity sent in IDr and covered by the responder AUTH
+	ResponderIDType uint8
+	ResponderIDData []byte
+
+	// Additional identities, presented to UEs naming them in IDr
+	ResponderIdentities []*ResponderIdentity
+
 	// Security data
 	CertificateAuthority []byte
 	N3iwfCertificate     []byte
-	N3iwfPrivateKey      *rsa.PrivateKey
+	N3iwfPrivateKey      crypto.Signer
 
 	// UEIPAddressRange
 	Subnet *net.IPNet
 
+	// Binding of the child SAs to the user plane, XFRM interfaces or firewall marks
+	IPsecMode IPsecMode
+
 	// XFRM interface
 	XfrmInterfaceId     uint32
 	XfrmIfaces          sync.Map // map[uint32]*netlink.Link, XfrmInterfaceId as key
 	XfrmInterfaceName   string
 	XfrmParentIfaceName string
+	// MTU of the XFRM interfaces, kernel default when 0
+	XfrmIfaceMTU int
+	// Lower the MSS option of user plane TCP SYNs so that the segments fit
+	// in the XFRM interfaces once GRE encapsulated
+	ClampTCPMSS bool
+
+	// Select the first supported transform of each type of a UE proposal
+	// instead of the strongest one
+	ProposalPeerOrder bool
 
-	// Every UE's first UP IPsec will use default XFRM interface, additoinal UP IPsec will offset its XFRM id
-	XfrmIfaceIdOffsetForUP uint32
+	// Transforms accepted in the IKE SA proposals of UEs, on top of those the
+	// N3IWF implements, and in their child SA proposals
+	IKETransformPolicy TransformPolicy
+	ESPTransformPolicy TransformPolicy
+
+	// ESP cipher proposed in N3IWF initiated child SAs, that of the IKE SA if nil
+	ChildSAEncryption encr.ENCRKType
+
+	// Every UE's first UP IPsec will use default XFRM interface, additional UP IPsec get their own XFRM
+	// interface ID, or firewall mark in policy mode, from this range
+	XfrmIfaceIds *XfrmIfaceIds
 
 	// N3IWF local address
 	IkeBindAddress      string
 	IpSecGatewayAddress string
 	GtpBindAddress      string
 	TcpPort             uint16
+	AdminBindAddress    string
 	GreConn             *ipv4.PacketConn
 	GtpuConn            *gtpv1.UPlaneConn
 
@@ -84,12 +136,153 @@ type N3IWFContext struct {
 
 	NgapServer *NgapServer
 	IkeServer  *IkeServer
+
+	// Maximum time to wait for room in the NGAP event channel
+	NgapEventTimeout time.Duration
+
+	// Lifetime of an IKE SA not bound to a UE context, never reaped when 0. The
+	// configuration gives 60s for 0
+	HalfOpenSATimeout time.Duration
+	// Time allowed to each EAP-5G round, from the UE or from the AMF, and to
+	// the UE to ask for its CP child SA after a childless IKE_AUTH, before the
+	// SA is torn down, not limited when 0. The configuration gives 30s for 0
+	EAPRoundTimeout time.Duration
+
+	// Interval of the NAT-T keepalives sent to UEs with UDP encapsulated child
+	// SAs, disabled when 0
+	NATKeepaliveInterval time.Duration
+
+	// Largest IKE message accepted from UEs, without the non-ESP marker,
+	// message.IKE_MAX_MESSAGE_LEN when 0
+	IKEMaxMessageSize int
+
+	// Largest data of the 5G-NAS messages sent to the UE, beyond which they
+	// are fragmented over several EAP-5G requests. Never fragmented when 0
+	EAP5GFragmentSize int
+
+	// DSCP of the IKE and NAS packets, and of the user plane packets, sent to
+	// the UEs. Unmarked when 0
+	ControlPlaneDSCP uint8
+	UserPlaneDSCP    uint8
+
+	// Interval at which the admin endpoint refreshes the child SA traffic
+	// counters, see RefreshTraffic
+	TrafficStatsInterval time.Duration
+	traffic              atomic.Pointer[TrafficSnapshot]
+
+	// Retransmission of the CREATE_CHILD_SA requests of PDU sessions, the
+	// interval doubling after each one
+	ChildSARetransmitInterval time.Duration
+	ChildSAMaxRetransmissions int
+
+	// Periods a DPD request waits for its answer, beyond the first, before the
+	// UE is deemed down
+	DPDMaxRetryTimes int32
+
+	// IKE SA redirection (RFC 5685), disabled when RedirectSelector is nil
+	RedirectThreshold int
+	RedirectSelector  RedirectSelector
+
+	// Maximum number of IKE SAs, unlimited if 0, see AdmitIKESA
+	MaxIKESAs        int
+	ikeSAs           atomic.Int64 // Stored in IkeSA, see IKESACount
+	ikeSACapRejected atomic.Uint64
+
+	// Maximum number of IKE_SA_INIT requests waiting for the IKE event loop,
+	// the excess being dropped, unbounded if 0, see IkeServer.AdmitIKESAInit
+	MaxPendingIKESAInits int
+
+	// Diffie-Hellman group chosen in the IKE_SA_INIT proposals when the one
+	// of the KE payload of the UE is not acceptable, the strongest if 0
+	PreferredDHGroup uint16
+
+	// Per source IP IKE_SA_INIT rate limit, unlimited when nil
+	IKESAInitLimiter *InitRateLimiter
+
+	// IKE_SA_INIT cookies (RFC 7296 section 2.6), demanded once CookieThreshold
+	// IKE SAs are half-open. Disabled when CookieSecrets is nil
+	CookieSecrets   *CookieSecrets
+	CookieThreshold int64
+	halfOpenSAs     atomic.Int64
+
+	// Paces InitialUEMessages towards the AMFs, unpaced when nil
+	InitialUEPacer *InitialUEPacer
+
+	// Pacing of the datagrams sent on each IKE socket, sent directly when
+	// IKESendRate is 0
+	IKESendRate      float64
+	IKESendBurst     int
+	IKESendQueueSize int
+
+	// UE certificate revocation checking, disabled when nil
+	RevocationChecker *security.RevocationChecker
+
+	// Negotiate MOBIKE (RFC 4555) with UEs announcing MOBIKE_SUPPORTED
+	EnableMOBIKE bool
+
+	// Vendor ID payload identifying the N3IWF in IKE_SA_INIT responses, not
+	// sent when empty
+	VendorID []byte
+
+	// Narrow the CP child SA to TCP traffic to and from the NAS TCP port,
+	// instead of any TCP traffic
+	CPChildSANASPortOnly bool
+
+	// Accept USE_TRANSPORT_MODE from UEs, child SAs are tunnel mode only when false
+	AllowTransportMode bool
+
+	// Refuse the child SA rekeys of UEs without a fresh Diffie-Hellman exchange
+	ChildSAPFSRequired bool
+
+	// Follow the outer address changes of UEs behind a NAT without MOBIKE only
+	// once they echo a COOKIE2 sent to the new address
+	ReturnRoutabilityCheck bool
+
+	// ESP anti-replay window in packets of new child SAs, replay protection is
+	// disabled when 0
+	ESPReplayWindow uint32
+
+	// Lifetime of new child SAs, rekeyed by the N3IWF once a soft limit is
+	// reached, unlimited when zero
+	ChildSALifetime ChildSALifetime
+
+	// Receives every decrypted inbound and outbound IKE message, disabled when nil
+	IKETracer IKETracer
+
+	// Writes the raw IKE datagrams to a pcap file, disabled when nil
+	IKECapture *IKECapture
+
+	// IKE messages of each IKE SA kept to be logged in full when an exchange
+	// of the SA fails, disabled when 0
+	IKETranscriptSize int
+
+	// Receives the establishments and teardowns of the SAs, disabled when nil
+	AuditSink AuditSink
+
+	// State of the services, reported by the admin health endpoint
+	Health Health
+
+	// Answer an ESP Delete of unknown SPIs only with an empty ESP Delete payload
+	// instead of an empty INFORMATIONAL response
+	EmptyChildSADeleteResponse bool
+
+	// Assigns the inner IP addresses of the UEs, from Subnet when nil
+	AddressAllocator AddressAllocator
+
+	// Extra IKE_AUTH CFG_REPLY attributes
+	DNSServers         []net.IP
+	AlwaysSendDNS      bool
+	SplitTunnelSubnets []*net.IPNet
+	NBNSServers        []net.IP
+	DHCPServers        []net.IP
+	ApplicationVersion string
 }
 
 func init() {
 	// Initialize ID generators
 	n3iwfContext.RanUuNgapIdGenerator = idgenerator.NewGenerator(0, math.MaxInt64)
 	n3iwfContext.TeidGenerator = idgenerator.NewGenerator(1, math.MaxUint32)
+	n3iwfContext.ESPTransformPolicy.Allow = DefaultESPTransforms()
 }
 
 // N3IWFSelf returns the singleton N3IWF context
@@ -97,6 +290,16 @@ func N3IWFSelf() *N3IWFContext {
 	return &n3iwfContext
 }
 
+// SendNgapEvent queues an event for NGAP without blocking the caller longer
+// than NgapEventTimeout. It is not retried, as the caller is the IKE event
+// loop: the exchange fails and is handled again on the UE retransmission
+func (n3iwfCtx *N3IWFContext) SendNgapEvent(evt NgapEvt) error {
+	if err := n3iwfCtx.NgapServer.SendEvent(evt, n3iwfCtx.NgapEventTimeout); err != nil {
+		return fmt.Errorf("SendNgapEvent: event type %d: %w", evt.Type(), err)
+	}
+	return nil
+}
+
 // NewN3iwfIkeUe creates and stores a new N3IWFIkeUe for the given SPI
 func (n3iwfCtx *N3IWFContext) NewN3iwfIkeUe(spi uint64) *N3IWFIkeUe {
 	n3iwfIkeUe := &N3IWFIkeUe{N3iwfCtx: n3iwfCtx}
@@ -281,25 +484,72 @@ func (n3iwfCtx *N3IWFContext) AMFReInitAvailableListStore(sctpAddr string, flag
 // NewIKESecurityAssociation creates and stores a new IKE Security Association with a unique SPI
 func (n3iwfCtx *N3IWFContext) NewIKESecurityAssociation() *IKESecurityAssociation {
 	ikeSecurityAssociation := new(IKESecurityAssociation)
-	maxSPI := new(big.Int).SetUint64(math.MaxUint64)
+	buf := make([]byte, 8)
 	for {
-		localSPI, err := rand.Int(rand.Reader, maxSPI)
-		if err != nil {
+		if err := security.ReadRandom(buf); err != nil {
 			logger.CtxLog.Errorln("error occurs when generate new IKE SPI")
 			return nil
 		}
-		localSPIuint64 := localSPI.Uint64()
+		localSPIuint64 := binary.BigEndian.Uint64(buf)
+		// RFC 7296 section 3.1: the SPI of the responder is never zero
+		if localSPIuint64 == 0 {
+			continue
+		}
 		if _, duplicate := n3iwfCtx.IkeSA.LoadOrStore(localSPIuint64, ikeSecurityAssociation); !duplicate {
 			ikeSecurityAssociation.LocalSPI = localSPIuint64
 			break
 		}
 	}
+	n3iwfCtx.ikeSAs.Add(1)
+	ikeSecurityAssociation.Transcript = NewIKETranscript(n3iwfCtx.IKETranscriptSize)
+	n3iwfCtx.halfOpenSAs.Add(1)
+	ikeSecurityAssociation.halfOpenCount = &n3iwfCtx.halfOpenSAs
+	if n3iwfCtx.HalfOpenSATimeout > 0 {
+		spi := ikeSecurityAssociation.LocalSPI
+		ikeSecurityAssociation.halfOpenTimer = time.AfterFunc(n3iwfCtx.HalfOpenSATimeout, func() {
+			// The IKE event handler owns the SA, let it decide whether to reap it
+			n3iwfCtx.IkeServer.SendEvent(NewHalfOpenIKESATimeoutEvt(spi))
+		})
+	}
 	return ikeSecurityAssociation
 }
 
+// HalfOpenIKESAs returns the number of IKE SAs whose UE has not completed
+// authentication yet
+func (n3iwfCtx *N3IWFContext) HalfOpenIKESAs() int64 {
+	return n3iwfCtx.halfOpenSAs.Load()
+}
+
+// CookieRequired reports whether UEs must echo a cookie in IKE_SA_INIT before
+// the N3IWF allocates an SA for them
+func (n3iwfCtx *N3IWFContext) CookieRequired() bool {
+	return n3iwfCtx.CookieSecrets != nil && n3iwfCtx.HalfOpenIKESAs() >= n3iwfCtx.CookieThreshold
+}
+
 // DeleteIKESecurityAssociation removes IKE SA for SPI
 func (n3iwfCtx *N3IWFContext) DeleteIKESecurityAssociation(spi uint64) {
-	n3iwfCtx.IkeSA.Delete(spi)
+	if ikeSA, ok := n3iwfCtx.IkeSA.LoadAndDelete(spi); ok {
+		n3iwfCtx.ikeSAs.Add(-1)
+		ikeSA.(*IKESecurityAssociation).StopHalfOpenTimer()
+		ikeSA.(*IKESecurityAssociation).StopEAPRoundTimer()
+		ikeSA.(*IKESecurityAssociation).StopNATKeepalive()
+	}
+}
+
+// StartEAPRoundTimer starts a new round of the EAP-5G exchange of ikeSA,
+// waiting for the UE or the AMF to answer. Unless the next round starts
+// within EAPRoundTimeout, an EAPRoundTimeout event is sent to the IKE event
+// handler. Must be called with the SA locked
+func (n3iwfCtx *N3IWFContext) StartEAPRoundTimer(ikeSA *IKESecurityAssociation) {
+	ikeSA.StopEAPRoundTimer()
+	ikeSA.eapRound++
+	if n3iwfCtx.EAPRoundTimeout <= 0 {
+		return
+	}
+	spi, round := ikeSA.LocalSPI, ikeSA.eapRound
+	ikeSA.eapRoundTimer = time.AfterFunc(n3iwfCtx.EAPRoundTimeout, func() {
+		n3iwfCtx.IkeServer.SendEvent(NewEAPRoundTimeoutEvt(spi, round))
+	})
 }
 
 // IKESALoad returns IKE SA for SPI
@@ -330,26 +580,33 @@ func (n3iwfCtx *N3IWFContext) GTPConnectionWithUPFStore(upfAddr string, conn *gt
 	n3iwfCtx.GtpConnectionUPF.Store(upfAddr, conn)
 }
 
-// NewInternalUEIPAddr generates a new unique internal UE IP address within the subnet
-func (n3iwfCtx *N3IWFContext) NewInternalUEIPAddr(ikeUe *N3IWFIkeUe) net.IP {
-	for {
-		ueIPAddr := generateRandomIPinRange(n3iwfCtx.Subnet)
-		if ueIPAddr == nil {
-			continue
-		}
-		if ueIPAddr.String() == n3iwfCtx.IpSecGatewayAddress {
-			continue
-		}
-		if _, ok := n3iwfCtx.AllocatedUeIpAddress.LoadOrStore(ueIPAddr.String(), ikeUe); !ok {
-			return ueIPAddr
-		}
-		logger.CtxLog.Warnf("IP(%v) is used by other IkeUE", ueIPAddr.String())
+// DefaultXfrmIfaceId returns the if_id of the signalling child SAs and of the
+// first PDU session of the UEs, 0 in policy mode
+func (n3iwfCtx *N3IWFContext) DefaultXfrmIfaceId() uint32 {
+	if n3iwfCtx.IPsecMode == IPsecModePolicy {
+		return 0
 	}
+	return n3iwfCtx.XfrmInterfaceId
 }
 
-// DeleteInternalUEIPAddr removes allocated UE IP address
-func (n3iwfCtx *N3IWFContext) DeleteInternalUEIPAddr(ipAddr string) {
-	n3iwfCtx.AllocatedUeIpAddress.Delete(ipAddr)
+// AllocateXfrmIfaceId returns the if_id of the XFRM interface of an
+// additional PDU session, or its firewall mark in policy mode
+func (n3iwfCtx *N3IWFContext) AllocateXfrmIfaceId() (uint32, error) {
+	return n3iwfCtx.XfrmIfaceIds.Allocate()
+}
+
+// ReserveXfrmIfaceId marks as used the XFRM interface ID, or firewall mark, of
+// a child SA reconstructed from the kernel, so that no additional PDU session
+// is given it again
+func (n3iwfCtx *N3IWFContext) ReserveXfrmIfaceId(ifId uint32) {
+	n3iwfCtx.XfrmIfaceIds.Reserve(ifId)
+}
+
+// releaseXfrmIfaceId forgets a deleted XFRM interface, or firewall mark, of an
+// additional PDU session, so that its ID can be given again
+func (n3iwfCtx *N3IWFContext) releaseXfrmIfaceId(ifId uint32) {
+	n3iwfCtx.XfrmIfaces.Delete(ifId)
+	n3iwfCtx.XfrmIfaceIds.Release(ifId)
 }
 
 // NewTEID allocates a new TEID and stores mapping to RanUe
@@ -397,17 +654,3 @@ func (n3iwfCtx *N3IWFContext) AMFSelection(ueSpecifiedGUAMI *ngapType.GUAMI, ueS
 	}
 	return availableAMF
 }
-
-// generateRandomIPinRange returns a random IP within the given subnet
-func generateRandomIPinRange(subnet *net.IPNet) net.IP {
-	ipAddr := make([]byte, 4)
-	randomNumber := make([]byte, 4)
-	if _, err := rand.Read(randomNumber); err != nil {
-		logger.CtxLog.Errorf("generate random number for IP address failed: %+v", err)
-		return nil
-	}
-	for i := range randomNumber {
-		ipAddr[i] = subnet.IP[i] + (randomNumber[i] & ^subnet.Mask[i])
-	}
-	return net.IPv4(ipAddr[0], ipAddr[1], ipAddr[2], ipAddr[3])
-}
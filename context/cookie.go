@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/omec-project/n3iwf/ike/security"
+)
+
+const (
+	cookieSecretLength  = 32
+	cookieVersionLength = 4
+	// RFC 7296 section 3.10.1: COOKIE notifications are 1 to 64 octets long
+	cookieLength = cookieVersionLength + sha256.Size
+)
+
+type cookieSecret struct {
+	version uint32
+	key     []byte
+}
+
+// CookieSecrets generates and verifies the anti-DoS cookies of IKE_SA_INIT
+// (RFC 7296 section 2.6), <VersionIDofSecret> | HMAC(<secret>, Ni | IPi | SPIi).
+// The secret rotates every interval, limiting how long a harvested cookie
+// can be replayed, and the previous one still verifies the cookies handed
+// out just before the rotation for a grace period
+type CookieSecrets struct {
+	mu       sync.Mutex
+	interval time.Duration
+	grace    time.Duration
+	now      func() time.Time
+
+	current  cookieSecret
+	previous *cookieSecret
+	// Creation of the current secret, and end of the validity of the previous one
+	rotated         time.Time
+	previousExpires time.Time
+}
+
+// NewCookieSecrets returns cookie secrets rotating every interval, the
+// previous secret being accepted for grace after a rotation
+func NewCookieSecrets(interval, grace time.Duration) (*CookieSecrets, error) {
+	return newCookieSecrets(interval, grace, time.Now)
+}
+
+func newCookieSecrets(interval, grace time.Duration, now func() time.Time) (*CookieSecrets, error) {
+	if interval <= 0 || grace < 0 {
+		return nil, fmt.Errorf("NewCookieSecrets: invalid rotation interval %v or grace period %v", interval, grace)
+	}
+	s := &CookieSecrets{interval: interval, grace: grace, now: now}
+	key, err := newCookieSecretKey()
+	if err != nil {
+		return nil, fmt.Errorf("NewCookieSecrets: %w", err)
+	}
+	s.current = cookieSecret{version: 1, key: key}
+	s.rotated = now()
+	return s, nil
+}
+
+func newCookieSecretKey() ([]byte, error) {
+	key := make([]byte, cookieSecretLength)
+	if err := security.ReadRandom(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// rotateLocked replaces the current secret once it is interval old. The
+// previous secret expires grace after the rotation was due, even when no
+// cookie was generated or verified at that time
+func (s *CookieSecrets) rotateLocked(now time.Time) error {
+	if now.Sub(s.rotated) < s.interval {
+		return nil
+	}
+	key, err := newCookieSecretKey()
+	if err != nil {
+		return err
+	}
+	due := s.rotated.Add(s.interval)
+	previous := s.current
+	s.previous = &previous
+	s.previousExpires = due.Add(s.grace)
+	s.current = cookieSecret{version: previous.version + 1, key: key}
+	s.rotated = now
+	return nil
+}
+
+func (secret *cookieSecret) cookie(ni []byte, ipi net.IP, spii uint64) []byte {
+	mac := hmac.New(sha256.New, secret.key)
+	mac.Write(ni)
+	if ip4 := ipi.To4(); ip4 != nil {
+		ipi = ip4
+	}
+	mac.Write(ipi)
+	mac.Write(binary.BigEndian.AppendUint64(nil, spii))
+	return mac.Sum(binary.BigEndian.AppendUint32(make([]byte, 0, cookieLength), secret.version))
+}
+
+// Cookie returns the cookie the UE at ipi must echo in its IKE_SA_INIT with
+// nonce ni and SPI spii
+func (s *CookieSecrets) Cookie(ni []byte, ipi net.IP, spii uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.rotateLocked(s.now()); err != nil {
+		return nil, fmt.Errorf("Cookie: %w", err)
+	}
+	return s.current.cookie(ni, ipi, spii), nil
+}
+
+// Verify reports whether cookie was generated by the current secret, or by
+// the previous one within its grace period, for the same ni, ipi and spii
+func (s *CookieSecrets) Verify(cookie, ni []byte, ipi net.IP, spii uint64) bool {
+	if len(cookie) != cookieLength {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if err := s.rotateLocked(now); err != nil {
+		return false
+	}
+	secret := &s.current
+	if version := binary.BigEndian.Uint32(cookie); version != secret.version {
+		if s.previous == nil || version != s.previous.version || !now.Before(s.previousExpires) {
+			return false
+		}
+		secret = s.previous
+	}
+	return hmac.Equal(cookie, secret.cookie(ni, ipi, spii))
+}
@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCookieSecrets(t *testing.T) {
+	start := time.Now()
+	now := start
+	s, err := newCookieSecrets(time.Minute, 10*time.Second, func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ni := []byte("nonce of the UE")
+	ueIP := net.ParseIP("192.168.1.10")
+	cookie, err := s.Cookie(ni, ueIP, 0x1111)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(cookie) == 0 || len(cookie) > 64 {
+		t.Fatalf("cookie length %d out of 1..64", len(cookie))
+	}
+
+	testcases := []struct {
+		description string
+		elapsed     time.Duration
+		ni          []byte
+		ip          net.IP
+		spi         uint64
+		expValid    bool
+	}{
+		{
+			description: "echoed cookie",
+			ni:          ni,
+			ip:          ueIP,
+			spi:         0x1111,
+			expValid:    true,
+		},
+		{
+			description: "other nonce",
+			ni:          []byte("another nonce"),
+			ip:          ueIP,
+			spi:         0x1111,
+		},
+		{
+			description: "other address",
+			ni:          ni,
+			ip:          net.ParseIP("192.168.1.11"),
+			spi:         0x1111,
+		},
+		{
+			description: "other SPI",
+			ni:          ni,
+			ip:          ueIP,
+			spi:         0x2222,
+		},
+		{
+			description: "previous secret within the grace period",
+			elapsed:     time.Minute + 5*time.Second,
+			ni:          ni,
+			ip:          ueIP,
+			spi:         0x1111,
+			expValid:    true,
+		},
+		{
+			description: "previous secret after the grace period",
+			elapsed:     time.Minute + 10*time.Second,
+			ni:          ni,
+			ip:          ueIP,
+			spi:         0x1111,
+		},
+		{
+			description: "secret retired long ago",
+			elapsed:     time.Hour,
+			ni:          ni,
+			ip:          ueIP,
+			spi:         0x1111,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			now = start
+			s, err := newCookieSecrets(time.Minute, 10*time.Second, func() time.Time { return now })
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			cookie, err := s.Cookie(ni, ueIP, 0x1111)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			now = start.Add(tc.elapsed)
+			if got := s.Verify(cookie, tc.ni, tc.ip, tc.spi); got != tc.expValid {
+				t.Errorf("validity mismatch. got = %v, want = %v", got, tc.expValid)
+			}
+		})
+	}
+
+	// Cookies handed out after a rotation carry the new secret
+	now = start.Add(time.Minute)
+	rotated, err := s.Cookie(ni, ueIP, 0x1111)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(rotated) == string(cookie) || !s.Verify(rotated, ni, ueIP, 0x1111) {
+		t.Errorf("cookie not generated with the rotated secret")
+	}
+	if s.Verify(rotated[:len(rotated)-1], ni, ueIP, 0x1111) {
+		t.Errorf("truncated cookie accepted")
+	}
+}
+
+func TestCookieRequired(t *testing.T) {
+	n3iwfCtx := &N3IWFContext{CookieThreshold: 2}
+	if n3iwfCtx.CookieRequired() {
+		t.Errorf("cookie required without cookie secrets")
+	}
+	s, err := NewCookieSecrets(time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	n3iwfCtx.CookieSecrets = s
+
+	first := n3iwfCtx.NewIKESecurityAssociation()
+	second := n3iwfCtx.NewIKESecurityAssociation()
+	if !n3iwfCtx.CookieRequired() || n3iwfCtx.HalfOpenIKESAs() != 2 {
+		t.Errorf("cookie not required with %d half-open SAs", n3iwfCtx.HalfOpenIKESAs())
+	}
+	// Authenticated, then deleted: counted once
+	first.StopHalfOpenTimer()
+	n3iwfCtx.DeleteIKESecurityAssociation(first.LocalSPI)
+	if n3iwfCtx.CookieRequired() || n3iwfCtx.HalfOpenIKESAs() != 1 {
+		t.Errorf("cookie required with %d half-open SAs", n3iwfCtx.HalfOpenIKESAs())
+	}
+	n3iwfCtx.DeleteIKESecurityAssociation(second.LocalSPI)
+	if n3iwfCtx.HalfOpenIKESAs() != 0 {
+		t.Errorf("half-open SA count mismatch. got = %d, want = 0", n3iwfCtx.HalfOpenIKESAs())
+	}
+}
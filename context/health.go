@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Components reported by the health endpoint
+const (
+	HealthXFRM         = "xfrm"
+	HealthIKEEventLoop = "ikeEventLoop"
+)
+
+// HealthIKEListener names the component of the IKE receiver of port
+func HealthIKEListener(port int) string {
+	return fmt.Sprintf("ikeListener:%d", port)
+}
+
+// HealthNGAP names the component of the SCTP association with the AMF at amfAddr
+func HealthNGAP(amfAddr string) string {
+	return "ngap:" + amfAddr
+}
+
+// Health records whether the services of the N3IWF are up. The services set
+// their component up once started and down when their goroutine exits, so
+// that a probe notices a dead listener. The zero value is ready to use
+type Health struct {
+	components sync.Map // map[string]bool
+}
+
+// Set records component as up or down
+func (h *Health) Set(component string, up bool) {
+	h.components.Store(component, up)
+}
+
+// Status returns the state of every component, and whether they are all up
+func (h *Health) Status() (map[string]bool, bool) {
+	status := make(map[string]bool)
+	healthy := true
+	h.components.Range(func(key, value any) bool {
+		up := value.(bool)
+		status[key.(string)] = up
+		healthy = healthy && up
+		return true
+	})
+	return status, healthy
+}
@@ -6,24 +6,101 @@
 package context
 
 import (
+	"errors"
 	"net"
+	"sync/atomic"
 )
 
+// IKEConn sends the IKE messages of the N3IWF. It is implemented by the
+// *net.UDPConn of the IKE listeners, by their IKESendQueue when sends are
+// paced, and by in-memory fakes in tests
+type IKEConn interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
 // IkeServer manages IKE UDP listeners and event channels
 type IkeServer struct {
-	Listener    map[int]*net.UDPConn
+	Listener    map[int]*net.UDPConn  // Filled in before Run returns, read-only afterwards
+	SendQueue   map[int]*IKESendQueue // Of the listeners whose sends are paced, as Listener
 	RcvIkePktCh chan IkeReceivePacket
 	RcvEventCh  chan IkeEvt
 	StopServer  chan struct{}
+	Done        chan struct{} // Closed once the IKE event loop has stopped
+
+	MaxPendingInits int // IKE_SA_INIT requests waiting in RcvIkePktCh, unbounded if 0
+	pendingInits    atomic.Int64
+	initsShed       atomic.Uint64
+}
+
+// AdmitIKESAInit reports whether an IKE_SA_INIT request may wait for the event
+// loop, counting it until DoneIKESAInit. Beyond MaxPendingInits, the request is
+// shed: a burst of them must not stall the events of the established SAs
+// behind their Diffie-Hellman computations. The UE retransmits it later
+func (s *IkeServer) AdmitIKESAInit() bool {
+	if s.MaxPendingInits <= 0 {
+		return true
+	}
+	if s.pendingInits.Add(1) > int64(s.MaxPendingInits) {
+		s.pendingInits.Add(-1)
+		s.initsShed.Add(1)
+		return false
+	}
+	return true
+}
+
+// DoneIKESAInit ends the wait of an IKE_SA_INIT request admitted by
+// AdmitIKESAInit, once the event loop has handled it
+func (s *IkeServer) DoneIKESAInit() {
+	if s.MaxPendingInits > 0 {
+		s.pendingInits.Add(-1)
+	}
+}
+
+// IKESAInitShed returns the number of IKE_SA_INIT requests shed by
+// AdmitIKESAInit
+func (s *IkeServer) IKESAInitShed() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.initsShed.Load()
+}
+
+// SendEvent queues evt for the IKE event loop, waiting for room in the
+// channel. It returns false, dropping evt, once the event loop has stopped,
+// so the timers and goroutines posting events may outlive it
+func (s *IkeServer) SendEvent(evt IkeEvt) bool {
+	if s == nil {
+		return false
+	}
+	select {
+	case s.RcvEventCh <- evt:
+		return true
+	case <-s.Done:
+		return false
+	}
+}
+
+// SendDropped returns the number of datagrams dropped by the send queues of
+// the listeners
+func (s *IkeServer) SendDropped() uint64 {
+	if s == nil {
+		return 0
+	}
+	var dropped uint64
+	for _, sendQueue := range s.SendQueue {
+		dropped += sendQueue.Dropped()
+	}
+	return dropped
 }
 
 // IkeReceivePacket represents a received IKE packet
 // Use pointer types for efficiency
 type IkeReceivePacket struct {
-	Listener   *net.UDPConn
-	LocalAddr  *net.UDPAddr
-	RemoteAddr *net.UDPAddr
-	Msg        []byte
+	Listener    IKEConn // Sends through the send queue of the listener, if any
+	LocalAddr   *net.UDPAddr
+	RemoteAddr  *net.UDPAddr
+	Msg         []byte
+	PendingInit bool // Admitted IKE_SA_INIT request, see IkeServer.AdmitIKESAInit
 }
 
 // IkeEventType enumerates IKE event types
@@ -39,6 +116,13 @@ const (
 	SendChildSADeleteRequest
 	IKEContextUpdate
 	GetNGAPContextResponse
+	HalfOpenIKESATimeout
+	Shutdown
+	DeleteChildSABySPI
+	EAPRoundTimeout
+	LivenessCheck
+	ChildSAExpire
+	RevocationChecked
 )
 
 // IkeEvt is the interface for all IKE events
@@ -46,6 +130,13 @@ type IkeEvt interface {
 	Type() IkeEventType
 }
 
+// IkeSAEvt is implemented by the IKE events acting on a single IKE SA, which
+// is locked while the event is handled
+type IkeSAEvt interface {
+	IkeEvt
+	SPI() uint64
+}
+
 // UnmarshalEAP5GDataResponseEvt event
 type UnmarshalEAP5GDataResponseEvt struct {
 	LocalSPI    uint64
@@ -57,6 +148,10 @@ func (e *UnmarshalEAP5GDataResponseEvt) Type() IkeEventType {
 	return UnmarshalEAP5GDataResponse
 }
 
+func (e *UnmarshalEAP5GDataResponseEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
 func NewUnmarshalEAP5GDataResponseEvt(localSPI uint64, ranUeNgapId int64, nasPDU []byte) *UnmarshalEAP5GDataResponseEvt {
 	return &UnmarshalEAP5GDataResponseEvt{
 		LocalSPI:    localSPI,
@@ -75,6 +170,10 @@ func (e *SendEAP5GFailureMsgEvt) Type() IkeEventType {
 	return SendEAP5GFailureMsg
 }
 
+func (e *SendEAP5GFailureMsgEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
 func NewSendEAP5GFailureMsgEvt(localSPI uint64, errMsg EvtError) *SendEAP5GFailureMsgEvt {
 	return &SendEAP5GFailureMsgEvt{
 		LocalSPI: localSPI,
@@ -92,6 +191,10 @@ func (e *SendEAPNASMsgEvt) Type() IkeEventType {
 	return SendEAPNASMsg
 }
 
+func (e *SendEAPNASMsgEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
 func NewSendEAPNASMsgEvt(localSPI uint64, nasPDU []byte) *SendEAPNASMsgEvt {
 	return &SendEAPNASMsgEvt{
 		LocalSPI: localSPI,
@@ -110,6 +213,10 @@ func (e *SendEAPSuccessMsgEvt) Type() IkeEventType {
 	return SendEAPSuccessMsg
 }
 
+func (e *SendEAPSuccessMsgEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
 func NewSendEAPSuccessMsgEvt(localSPI uint64, kn3iwf []byte, pduSessionListLen int) *SendEAPSuccessMsgEvt {
 	return &SendEAPSuccessMsgEvt{
 		LocalSPI:          localSPI,
@@ -129,6 +236,10 @@ func (e *CreatePDUSessionEvt) Type() IkeEventType {
 	return CreatePDUSession
 }
 
+func (e *CreatePDUSessionEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
 func NewCreatePDUSessionEvt(localSPI uint64, pduSessionListLen int, tempPDUSessionSetupData *PDUSessionSetupTemporaryData) *CreatePDUSessionEvt {
 	return &CreatePDUSessionEvt{
 		LocalSPI:                localSPI,
@@ -146,6 +257,10 @@ func (e *IKEDeleteRequestEvt) Type() IkeEventType {
 	return IKEDeleteRequest
 }
 
+func (e *IKEDeleteRequestEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
 func NewIKEDeleteRequestEvt(localSPI uint64) *IKEDeleteRequestEvt {
 	return &IKEDeleteRequestEvt{
 		LocalSPI: localSPI,
@@ -162,6 +277,10 @@ func (e *SendChildSADeleteRequestEvt) Type() IkeEventType {
 	return SendChildSADeleteRequest
 }
 
+func (e *SendChildSADeleteRequestEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
 func NewSendChildSADeleteRequestEvt(localSPI uint64, releaseIdList []int64) *SendChildSADeleteRequestEvt {
 	return &SendChildSADeleteRequestEvt{
 		LocalSPI:      localSPI,
@@ -179,6 +298,10 @@ func (e *IKEContextUpdateEvt) Type() IkeEventType {
 	return IKEContextUpdate
 }
 
+func (e *IKEContextUpdateEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
 func NewIKEContextUpdateEvt(localSPI uint64, kn3iwf []byte) *IKEContextUpdateEvt {
 	return &IKEContextUpdateEvt{
 		LocalSPI: localSPI,
@@ -189,6 +312,7 @@ func NewIKEContextUpdateEvt(localSPI uint64, kn3iwf []byte) *IKEContextUpdateEvt
 // GetNGAPContextRepEvt event
 type GetNGAPContextRepEvt struct {
 	LocalSPI          uint64
+	Token             uint64 // That of the GetNGAPContextEvt
 	NgapCxtReqNumlist []int64
 	NgapCxt           []any
 }
@@ -197,10 +321,180 @@ func (e *GetNGAPContextRepEvt) Type() IkeEventType {
 	return GetNGAPContextResponse
 }
 
-func NewGetNGAPContextRepEvt(localSPI uint64, ngapCxtReqNumlist []int64, ngapCxt []any) *GetNGAPContextRepEvt {
+func (e *GetNGAPContextRepEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
+func NewGetNGAPContextRepEvt(localSPI, token uint64, ngapCxtReqNumlist []int64, ngapCxt []any) *GetNGAPContextRepEvt {
 	return &GetNGAPContextRepEvt{
 		LocalSPI:          localSPI,
+		Token:             token,
 		NgapCxtReqNumlist: ngapCxtReqNumlist,
 		NgapCxt:           ngapCxt,
 	}
 }
+
+// HalfOpenIKESATimeoutEvt event
+type HalfOpenIKESATimeoutEvt struct {
+	LocalSPI uint64
+}
+
+func (e *HalfOpenIKESATimeoutEvt) Type() IkeEventType {
+	return HalfOpenIKESATimeout
+}
+
+func (e *HalfOpenIKESATimeoutEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
+func NewHalfOpenIKESATimeoutEvt(localSPI uint64) *HalfOpenIKESATimeoutEvt {
+	return &HalfOpenIKESATimeoutEvt{
+		LocalSPI: localSPI,
+	}
+}
+
+// ShutdownEvt event, Done is closed once every UE session is torn down
+type ShutdownEvt struct {
+	Done chan struct{}
+}
+
+func (e *ShutdownEvt) Type() IkeEventType {
+	return Shutdown
+}
+
+func NewShutdownEvt() *ShutdownEvt {
+	return &ShutdownEvt{
+		Done: make(chan struct{}),
+	}
+}
+
+// DeleteChildSABySPIEvt event, sent by the admin endpoint. InboundSPIs are the
+// N3IWF inbound SPIs of the child SAs to delete
+type DeleteChildSABySPIEvt struct {
+	LocalSPI    uint64
+	InboundSPIs []uint32
+}
+
+func (e *DeleteChildSABySPIEvt) Type() IkeEventType {
+	return DeleteChildSABySPI
+}
+
+func (e *DeleteChildSABySPIEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
+func NewDeleteChildSABySPIEvt(localSPI uint64, inboundSPIs []uint32) *DeleteChildSABySPIEvt {
+	return &DeleteChildSABySPIEvt{
+		LocalSPI:    localSPI,
+		InboundSPIs: inboundSPIs,
+	}
+}
+
+// EAPRoundTimeoutEvt event, Round tells apart the rounds of the EAP-5G
+// exchange, see StartEAPRoundTimer
+type EAPRoundTimeoutEvt struct {
+	LocalSPI uint64
+	Round    uint64
+}
+
+func (e *EAPRoundTimeoutEvt) Type() IkeEventType {
+	return EAPRoundTimeout
+}
+
+func (e *EAPRoundTimeoutEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
+func NewEAPRoundTimeoutEvt(localSPI, round uint64) *EAPRoundTimeoutEvt {
+	return &EAPRoundTimeoutEvt{
+		LocalSPI: localSPI,
+		Round:    round,
+	}
+}
+
+// ErrDPDTimeout is the outcome of a liveness check the UE did not answer in time
+var ErrDPDTimeout = errors.New("no answer to the DPD request")
+
+// LivenessCheckEvt event, sends a DPD request to the UE outside of the periodic
+// liveness check. Result receives nil once the UE answers, ErrDPDTimeout if it
+// does not, or why the request could not be sent
+type LivenessCheckEvt struct {
+	LocalSPI uint64
+	Result   chan error
+}
+
+func (e *LivenessCheckEvt) Type() IkeEventType {
+	return LivenessCheck
+}
+
+func (e *LivenessCheckEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
+func NewLivenessCheckEvt(localSPI uint64) *LivenessCheckEvt {
+	return &LivenessCheckEvt{
+		LocalSPI: localSPI,
+		Result:   make(chan error, 1),
+	}
+}
+
+// ChildSAExpireEvt event, an XFRM state of the child SA with N3IWF inbound SPI
+// InboundSPI reached its soft lifetime, or its hard one when Hard is set. For
+// the expiries reported by the kernel, StateDst is set instead: the child SA
+// is the one owning the state with SPI StateSPI to StateDst, resolved with the
+// IKE SA locked
+type ChildSAExpireEvt struct {
+	LocalSPI   uint64
+	InboundSPI uint32
+	StateSPI   uint32
+	StateDst   net.IP
+	Hard       bool
+}
+
+func (e *ChildSAExpireEvt) Type() IkeEventType {
+	return ChildSAExpire
+}
+
+func (e *ChildSAExpireEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
+func NewChildSAExpireEvt(localSPI uint64, inboundSPI uint32, hard bool) *ChildSAExpireEvt {
+	return &ChildSAExpireEvt{
+		LocalSPI:   localSPI,
+		InboundSPI: inboundSPI,
+		Hard:       hard,
+	}
+}
+
+func NewXfrmStateExpireEvt(localSPI uint64, stateSPI uint32, stateDst net.IP, hard bool) *ChildSAExpireEvt {
+	return &ChildSAExpireEvt{
+		LocalSPI: localSPI,
+		StateSPI: stateSPI,
+		StateDst: stateDst,
+		Hard:     hard,
+	}
+}
+
+// RevocationCheckedEvt event, the revocation status of the certificate of the
+// UE was fetched for its parked IKE_AUTH request. Err is nil if the
+// certificate is not revoked
+type RevocationCheckedEvt struct {
+	LocalSPI uint64
+	Err      error
+}
+
+func (e *RevocationCheckedEvt) Type() IkeEventType {
+	return RevocationChecked
+}
+
+func (e *RevocationCheckedEvt) SPI() uint64 {
+	return e.LocalSPI
+}
+
+func NewRevocationCheckedEvt(localSPI uint64, err error) *RevocationCheckedEvt {
+	return &RevocationCheckedEvt{
+		LocalSPI: localSPI,
+		Err:      err,
+	}
+}
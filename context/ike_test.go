@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import "testing"
+
+func TestIkeServerAdmitIKESAInit(t *testing.T) {
+	testcases := []struct {
+		description string
+		maxPending  int
+		expAdmitted int
+	}{
+		{description: "bounded", maxPending: 3, expAdmitted: 3},
+		{description: "unbounded", maxPending: 0, expAdmitted: 8},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			server := &IkeServer{MaxPendingInits: tc.maxPending}
+			admitted := 0
+			for range 8 {
+				if server.AdmitIKESAInit() {
+					admitted++
+				}
+			}
+			if admitted != tc.expAdmitted {
+				t.Errorf("admitted mismatch. got = %d, want = %d", admitted, tc.expAdmitted)
+			}
+			if got := server.IKESAInitShed(); got != uint64(8-tc.expAdmitted) {
+				t.Errorf("shed mismatch. got = %d, want = %d", got, 8-tc.expAdmitted)
+			}
+			server.DoneIKESAInit()
+			if !server.AdmitIKESAInit() {
+				t.Error("IKE_SA_INIT request shed after DoneIKESAInit")
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omec-project/n3iwf/logger"
+)
+
+// ErrIKESendQueueFull is returned when a datagram is sent while the send queue
+// of the socket is full. The datagram is dropped, as on a congested link, and
+// left to the retransmissions of the exchange
+var ErrIKESendQueueFull = errors.New("IKE send queue full")
+
+type ikeDatagram struct {
+	b    []byte
+	addr *net.UDPAddr
+}
+
+// IKESendQueue serializes and paces the datagrams sent on an IKE socket, so
+// mass attaches do not burst the socket, fragmented messages in particular.
+// Datagrams are sent in the order they were queued, which keeps the order of
+// the messages of each IKE SA. Queuing never blocks: the handlers hold the
+// IKE SA locks and the event loop, which the sending goroutine never waits for
+type IKESendQueue struct {
+	conn  IKEConn
+	rate  float64 // datagrams per second
+	burst float64
+
+	queue     chan ikeDatagram
+	done      chan struct{}
+	closeOnce sync.Once
+	tokens    float64
+	last      time.Time
+	dropped   atomic.Uint64
+	now       func() time.Time
+	sleep     func(time.Duration)
+}
+
+// NewIKESendQueue returns a queue sending rate datagrams per second through
+// conn, with bursts of up to burst datagrams and at most queueSize datagrams
+// waiting. It returns nil without rate, conn is then to be written directly
+func NewIKESendQueue(conn IKEConn, rate float64, burst, queueSize int) *IKESendQueue {
+	q := newIKESendQueue(conn, rate, burst, queueSize, time.Now, time.Sleep)
+	if q != nil {
+		go q.run()
+	}
+	return q
+}
+
+func newIKESendQueue(conn IKEConn, rate float64, burst, queueSize int,
+	now func() time.Time, sleep func(time.Duration),
+) *IKESendQueue {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &IKESendQueue{
+		conn:   conn,
+		rate:   rate,
+		burst:  float64(burst),
+		queue:  make(chan ikeDatagram, queueSize),
+		done:   make(chan struct{}),
+		tokens: float64(burst),
+		last:   now(),
+		now:    now,
+		sleep:  sleep,
+	}
+}
+
+// WriteToUDP queues a copy of b for addr. The error of the actual send is
+// only logged
+func (q *IKESendQueue) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-q.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case q.queue <- ikeDatagram{b: append([]byte(nil), b...), addr: addr}:
+		return len(b), nil
+	default:
+		q.dropped.Add(1)
+		return 0, ErrIKESendQueueFull
+	}
+}
+
+// Queued returns the number of datagrams waiting to be sent
+func (q *IKESendQueue) Queued() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.queue)
+}
+
+// Dropped returns the number of datagrams refused because the queue was full
+func (q *IKESendQueue) Dropped() uint64 {
+	if q == nil {
+		return 0
+	}
+	return q.dropped.Load()
+}
+
+// Close stops the sending goroutine, the datagrams still queued are dropped
+func (q *IKESendQueue) Close() {
+	q.closeOnce.Do(func() { close(q.done) })
+}
+
+func (q *IKESendQueue) run() {
+	for {
+		select {
+		case datagram := <-q.queue:
+			q.wait()
+			if _, err := q.conn.WriteToUDP(datagram.b, datagram.addr); err != nil {
+				logger.CtxLog.Errorf("send IKE datagram to %s: %v", datagram.addr, err)
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// wait consumes a token, sleeping until one is available
+func (q *IKESendQueue) wait() {
+	now := q.now()
+	q.tokens = min(q.burst, q.tokens+now.Sub(q.last).Seconds()*q.rate)
+	q.last = now
+	if q.tokens >= 1 {
+		q.tokens--
+		return
+	}
+	delay := time.Duration((1 - q.tokens) / q.rate * float64(time.Second))
+	q.sleep(delay)
+	q.tokens = 0
+	q.last = now.Add(delay)
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type sentDatagram struct {
+	b  []byte
+	at time.Duration
+}
+
+type recordingIKEConn struct {
+	sent chan sentDatagram
+	at   func() time.Duration
+}
+
+func (conn *recordingIKEConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	conn.sent <- sentDatagram{b: b, at: conn.at()}
+	return len(b), nil
+}
+
+func TestIKESendQueuePacing(t *testing.T) {
+	start := time.Now()
+	now := start
+	conn := &recordingIKEConn{sent: make(chan sentDatagram, 16), at: func() time.Duration { return now.Sub(start) }}
+	q := newIKESendQueue(conn, 100, 2, 16,
+		func() time.Time { return now },
+		func(d time.Duration) { now = now.Add(d) })
+
+	ueAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 4500}
+	for i := range 5 {
+		b := []byte{byte(i)}
+		if _, err := q.WriteToUDP(b, ueAddr); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// The queued datagram is a copy
+		b[0] = 0xff
+	}
+	go q.run()
+	defer q.Close()
+
+	// The burst goes out at once, the rest at 100 datagrams per second, in order
+	expected := []time.Duration{0, 0, 10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}
+	for i, want := range expected {
+		select {
+		case got := <-conn.sent:
+			if len(got.b) != 1 || got.b[0] != byte(i) {
+				t.Errorf("datagram %d mismatch. got = %v, want = [%d]", i, got.b, i)
+			}
+			if got.at != want {
+				t.Errorf("datagram %d send time mismatch. got = %v, want = %v", i, got.at, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("datagram %d not sent", i)
+		}
+	}
+}
+
+func TestIKESendQueueFull(t *testing.T) {
+	q := newIKESendQueue(&recordingIKEConn{}, 1, 1, 2, time.Now, time.Sleep)
+	for range 2 {
+		if _, err := q.WriteToUDP([]byte{0}, nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if _, err := q.WriteToUDP([]byte{0}, nil); !errors.Is(err, ErrIKESendQueueFull) {
+		t.Errorf("error mismatch. got = %v, want = %v", err, ErrIKESendQueueFull)
+	}
+	if q.Queued() != 2 || q.Dropped() != 1 {
+		t.Errorf("counters mismatch. got = %d queued/%d dropped, want = 2/1", q.Queued(), q.Dropped())
+	}
+
+	q.Close()
+	if _, err := q.WriteToUDP([]byte{0}, nil); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("error mismatch. got = %v, want = %v", err, net.ErrClosed)
+	}
+	server := &IkeServer{SendQueue: map[int]*IKESendQueue{4500: q}}
+	if server.SendDropped() != 1 {
+		t.Errorf("dropped mismatch. got = %d, want = 1", server.SendDropped())
+	}
+}
+
+func TestNilIKESendQueue(t *testing.T) {
+	if q := NewIKESendQueue(&recordingIKEConn{}, 0, 10, 10); q != nil {
+		t.Fatalf("Expected nil queue without rate")
+	}
+	var server *IkeServer
+	if server.SendDropped() != 0 {
+		t.Errorf("Expected no drops without IKE server")
+	}
+}
@@ -6,13 +6,25 @@
 package context
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"maps"
 	"math"
 	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	greMsg "github.com/omec-project/n3iwf/gre/message"
 	"github.com/omec-project/n3iwf/ike/message"
 	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/logger"
 	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
 )
 
 const AmfUeNgapIdUnspecified int64 = 0xffffffffff
@@ -25,6 +37,8 @@ type N3IWFIkeUe struct {
 	// UE identity
 	IPSecInnerIP     net.IP
 	IPSecInnerIPAddr *net.IPAddr // Used to send UP packets to UE
+	InnerNetmask     net.IPMask
+	InnerDNSServers  []net.IP // From the AddressAllocator, the configured ones if nil
 
 	// IKE Security Association
 	N3IWFIKESecurityAssociation   *IKESecurityAssociation
@@ -49,6 +63,8 @@ type IkeMsgTemporaryData struct {
 	SecurityAssociation      *message.SecurityAssociation
 	TrafficSelectorInitiator *message.TrafficSelectorInitiator
 	TrafficSelectorResponder *message.TrafficSelectorResponder
+	// Error notify of a CREATE_CHILD_SA response rejecting the exchange, 0 if accepted
+	ErrorNotify uint16
 }
 
 type IKESecurityAssociation struct {
@@ -70,21 +86,69 @@ type IKESecurityAssociation struct {
 	// Temporary data stored for the use in later exchange
 	InitiatorID              *message.IdentificationInitiator
 	InitiatorCertificate     *message.Certificate
+	PendingRevocationCheck   *RevocationCheck // IKE_AUTH waiting for the UE certificate status
 	IKEAuthResponseSA        *message.SecurityAssociation
 	TrafficSelectorInitiator *message.TrafficSelectorInitiator
 	TrafficSelectorResponder *message.TrafficSelectorResponder
-	LastEAPIdentifier        uint8
+
+	// EAP method in progress in IKE_AUTH
+	EAP EAPSession
+	// Fragmented 5G-NAS message being sent to or received from the UE
+	EAP5GFragments EAP5GFragments
+	// AN parameters of the initial 5G-NAS message of the UE, for policy and
+	// troubleshooting. Forwarded to the AMF within the raw vendor data
+	ANParameters *ANParameters
 
 	// UDP Connection
 	IKEConnection *UDPSocketInfo
 
 	// Authentication data
-	ResponderSignedOctets []byte
+	ResponderSignedOctets []byte // Without the MACed IDr, which depends on the identity
 	InitiatorSignedOctets []byte
+	ResponderIdentity     *ResponderIdentity // Selected in IKE_AUTH from the IDr sent by the UE
+	// Hash algorithms of RFC 7427 accepted by the UE, nil if not announced
+	SignatureHashAlgorithms []uint16
 
 	// NAT detection
 	UeBehindNAT    bool // If true, N3IWF should enable NAT traversal and
-	N3iwfBehindNAT bool // TODO: If true, N3IWF should send UDP keepalive periodically
+	N3iwfBehindNAT bool // If true, NAT-T keepalives may be needed, see StartNATKeepalive
+
+	// Childless IKE_AUTH (RFC 6023), announced by the UE in IKE_SA_INIT. The
+	// CP child SA of a childless IKE_AUTH is pending until the UE requests it
+	// with CREATE_CHILD_SA
+	ChildlessSupported bool
+	CPChildSAPending   bool
+
+	// Vendor IDs received from the UE in IKE_SA_INIT, to key interop
+	// workarounds off
+	PeerVendorIDs [][]byte
+
+	// MOBIKE (RFC 4555)
+	MobikeSupported      bool
+	PendingAddressUpdate *MobikeAddressUpdate // Waiting for its return routability check
+
+	// Child SA delete waiting for the UE acknowledgement, and the deletes
+	// requested meanwhile
+	PendingChildSADelete *ChildSADeleteRequest
+	QueuedChildSADeletes []*ChildSADeleteRequest
+
+	// IKE SA delete waiting for the UE acknowledgement
+	PendingIKEDelete *IKESADeleteRequest
+
+	// Retransmission of the CREATE_CHILD_SA request of a PDU session, until the
+	// UE answers it
+	ChildSACreateRetransmit *RetransmitTimer
+
+	// Child SA rekey of the N3IWF waiting for the UE answer
+	PendingChildSARekey *ChildSARekeyRequest
+
+	// Other requests of the N3IWF waiting for the pending one to be answered,
+	// sent in order. The N3IWF keeps a single request outstanding
+	QueuedRequests []func()
+
+	// Answer to the last CREATE_CHILD_SA request of the UE, resent as is when
+	// the UE retransmits the request
+	LastChildSAResponse *CachedResponse
 
 	// IKE UE context
 	IkeUE *N3IWFIkeUe
@@ -92,10 +156,31 @@ type IKESecurityAssociation struct {
 	// Temporary store the receive ike message
 	TemporaryIkeMsg *IkeMsgTemporaryData
 
-	DPDReqRetransTimer *Timer // The time from sending the DPD request to receiving the response
-	CurrentRetryTimes  int32  // Accumulate the number of times the DPD response wasn't received
+	// Messages of the SA logged in full when an exchange fails, nil when
+	// disabled, see LogTranscript
+	Transcript *IKETranscript
+
+	// Outstanding GetNGAPContext requests by token, see NewNGAPContextRequest
+	ngapContextRequests map[uint64]NGAPContextRequest
+	ngapContextToken    uint64
+
+	EstablishmentStart time.Time     // IKE_SA_INIT receipt, zero once the establishment latency is recorded
+	TeardownReason     AuditReason   // Reason audited when the SA is torn down, that of the teardown if unset
+	Unresponsive       bool          // The UE left a request of the N3IWF unanswered, nothing more is sent to it
+	halfOpenTimer      *time.Timer   // Reaps the SA if the UE never completes authentication
+	halfOpenCount      *atomic.Int64 // Half-open SAs of the context, nil once the SA is no longer counted
+	eapRoundTimer      *time.Timer   // Reaps the SA if an EAP-5G round stalls, see StartEAPRoundTimer
+	eapRound           uint64        // Incremented by StartEAPRoundTimer
+	natKeepaliveTimer  *time.Timer   // Sends the NAT-T keepalives, see StartNATKeepalive
+	DPDReqRetransTimer *Timer        // The time from sending the DPD request to receiving the response
+	CurrentRetryTimes  int32         // Accumulate the number of times the DPD response wasn't received
 	IKESAClosedCh      chan struct{}
 	IsUseDPD           bool
+	livenessWaiters    []chan<- error // Of the outstanding DPD request, see AddLivenessWaiter
+
+	// Serializes the handlers of the SA with the DPD goroutine and the
+	// introspection API, see Lock
+	mu sync.Mutex
 }
 
 func (ikeSA *IKESecurityAssociation) String() string {
@@ -105,18 +190,254 @@ func (ikeSA *IKESecurityAssociation) String() string {
 		"\nIKESAKey: " + ikeSA.IKESAKey.String()
 }
 
+// Lock acquires the SA for a state transition. Every IKE message and IKE
+// event acting on the SA holds it for the whole handling, so that the State,
+// the message IDs and the signed octets are never seen half updated
+func (ikeSA *IKESecurityAssociation) Lock() {
+	ikeSA.mu.Lock()
+}
+
+// Unlock releases the SA acquired by Lock
+func (ikeSA *IKESecurityAssociation) Unlock() {
+	ikeSA.mu.Unlock()
+}
+
+// NewNGAPContextRequest records an outstanding GetNGAPContext request and
+// returns the token its response echoes, see TakeNGAPContextRequest
+func (ikeSA *IKESecurityAssociation) NewNGAPContextRequest(request NGAPContextRequest) uint64 {
+	if ikeSA.ngapContextRequests == nil {
+		ikeSA.ngapContextRequests = make(map[uint64]NGAPContextRequest)
+	}
+	ikeSA.ngapContextToken++
+	ikeSA.ngapContextRequests[ikeSA.ngapContextToken] = request
+	return ikeSA.ngapContextToken
+}
+
+// TakeNGAPContextRequest returns and forgets the GetNGAPContext request of
+// token, false if no such request is outstanding
+func (ikeSA *IKESecurityAssociation) TakeNGAPContextRequest(token uint64) (NGAPContextRequest, bool) {
+	request, ok := ikeSA.ngapContextRequests[token]
+	delete(ikeSA.ngapContextRequests, token)
+	return request, ok
+}
+
+// LogTranscript logs the messages recorded in the transcript of the SA as a
+// single error, the exchange having failed for reason, and discards them
+func (ikeSA *IKESecurityAssociation) LogTranscript(reason error) {
+	entries := ikeSA.Transcript.Entries()
+	if len(entries) == 0 {
+		return
+	}
+	ikeSA.Log().Errorw("failed IKE exchange transcript", "reason", reason, "messages", entries)
+	ikeSA.Transcript.Reset()
+}
+
+// UEIdentity returns the identity of the UE from its IDi payload, empty
+// before IKE_AUTH
+func (ikeSA *IKESecurityAssociation) UEIdentity() string {
+	if ikeSA.InitiatorID == nil {
+		return ""
+	}
+	return string(ikeSA.InitiatorID.IDData)
+}
+
+// Log returns the IKE logger with the SPIs and, once known, the hashed
+// identity of the UE as fields, so the lines of one UE can be filtered. A nil SA returns
+// the IKE logger itself
+func (ikeSA *IKESecurityAssociation) Log() *zap.SugaredLogger {
+	if ikeSA == nil {
+		return logger.IKELog
+	}
+	fields := []any{
+		"localSPI", fmt.Sprintf("%016x", ikeSA.LocalSPI),
+		"remoteSPI", fmt.Sprintf("%016x", ikeSA.RemoteSPI),
+	}
+	if identity := ikeSA.UEIdentity(); identity != "" {
+		fields = append(fields, "ueIdentity", logIdentity(identity))
+	}
+	if ikeSA.EAP.Identity != "" {
+		fields = append(fields, "eapIdentity", logIdentity(ikeSA.EAP.Identity))
+	}
+	return logger.IKELog.With(fields...)
+}
+
+// logIdentity returns the truncated SHA-256 digest of a UE identity, so the
+// lines of one UE can be filtered without logging its SUPI or NAI
+func logIdentity(identity string) string {
+	digest := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(digest[:8])
+}
+
+// StopHalfOpenTimer cancels the reaping of an SA that is no longer half-open
+func (ikeSA *IKESecurityAssociation) StopHalfOpenTimer() {
+	if ikeSA.halfOpenTimer != nil {
+		ikeSA.halfOpenTimer.Stop()
+	}
+	if ikeSA.halfOpenCount != nil {
+		ikeSA.halfOpenCount.Add(-1)
+		ikeSA.halfOpenCount = nil
+	}
+}
+
+// StopEAPRoundTimer cancels the timeout of the current EAP-5G round
+func (ikeSA *IKESecurityAssociation) StopEAPRoundTimer() {
+	if ikeSA.eapRoundTimer != nil {
+		ikeSA.eapRoundTimer.Stop()
+	}
+}
+
+// EAPRound returns the current round of the EAP-5G exchange, to tell a stale
+// EAPRoundTimeout event apart
+func (ikeSA *IKESecurityAssociation) EAPRound() uint64 {
+	return ikeSA.eapRound
+}
+
+// StartNATKeepalive sends a NAT-keepalive (RFC 3948 section 2.3), a single
+// 0xFF octet, to the UE every interval while any of its child SAs is UDP
+// encapsulated, so that the NAT mapping survives idle periods even if the UE
+// sends none. Nothing is sent when interval is 0. Must be called with the SA
+// locked, the keepalives run until StopNATKeepalive
+func (ikeSA *IKESecurityAssociation) StartNATKeepalive(interval time.Duration) {
+	if interval <= 0 || ikeSA.natKeepaliveTimer != nil {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(interval, func() {
+		ikeSA.Lock()
+		defer ikeSA.Unlock()
+		if ikeSA.natKeepaliveTimer != timer {
+			return
+		}
+		if ikeSA.udpEncapsulated() {
+			conn := ikeSA.IKEConnection
+			if _, err := conn.Conn.WriteToUDP([]byte{0xff}, conn.UEAddr); err != nil {
+				ikeSA.Log().Warnf("send NAT-T keepalive to %s: %v", conn.UEAddr, err)
+			}
+		}
+		timer.Reset(interval)
+	})
+	ikeSA.natKeepaliveTimer = timer
+}
+
+// StopNATKeepalive stops the keepalives started by StartNATKeepalive, if any
+func (ikeSA *IKESecurityAssociation) StopNATKeepalive() {
+	if ikeSA.natKeepaliveTimer != nil {
+		ikeSA.natKeepaliveTimer.Stop()
+		ikeSA.natKeepaliveTimer = nil
+	}
+}
+
+// AddLivenessWaiter registers result to receive the outcome of the
+// outstanding DPD request, see NotifyLivenessWaiters. result must be buffered,
+// the waiters are notified with the SA locked
+func (ikeSA *IKESecurityAssociation) AddLivenessWaiter(result chan<- error) {
+	ikeSA.livenessWaiters = append(ikeSA.livenessWaiters, result)
+}
+
+// NotifyLivenessWaiters sends err to the waiters of the outstanding DPD
+// request, nil when the UE answered, and forgets them
+func (ikeSA *IKESecurityAssociation) NotifyLivenessWaiters(err error) {
+	for _, result := range ikeSA.livenessWaiters {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	ikeSA.livenessWaiters = nil
+}
+
+// udpEncapsulated reports whether any child SA of the UE is UDP encapsulated
+func (ikeSA *IKESecurityAssociation) udpEncapsulated() bool {
+	if ikeSA.IkeUE == nil || ikeSA.IKEConnection == nil {
+		return false
+	}
+	for _, childSA := range ikeSA.IkeUE.N3IWFChildSecurityAssociation {
+		if childSA.EnableEncapsulate {
+			return true
+		}
+	}
+	return false
+}
+
+// EAPSession tracks the EAP method run in IKE_AUTH. The EAP-AKA' round trips
+// of the UE authentication are carried by its EAP-5G NAS messages
+type EAPSession struct {
+	Method     message.EAPType // Type of the requests sent, zero before the first one
+	Identifier uint8           // Identifier of the outstanding request
+	MessageID  uint8           // EAP-5G message ID of the outstanding request
+	Rounds     int             // Number of requests sent
+	// NAI of an EAP Response/Identity answering the 5G-Start, which some UEs
+	// send before EAP-5G. Only used for logging and policy, the UE is
+	// identified by the AMF
+	Identity         string
+	IdentityReceived bool
+}
+
+// NextRequest records a new EAP request of method and EAP-5G messageID and
+// returns its identifier. The first identifier is random and the next ones
+// are incremented, so that a response to an earlier request can be told apart
+func (eapSession *EAPSession) NextRequest(method message.EAPType, messageID uint8) (uint8, error) {
+	if eapSession.Rounds == 0 {
+		identifier, err := security.GenerateRandomUint8()
+		if err != nil {
+			return 0, fmt.Errorf("NextRequest: %w", err)
+		}
+		eapSession.Identifier = identifier
+	} else {
+		eapSession.Identifier++
+	}
+	eapSession.Method = method
+	eapSession.MessageID = messageID
+	eapSession.Rounds++
+	return eapSession.Identifier, nil
+}
+
+// IsEarlier reports whether identifier is the one of a request sent before
+// the outstanding one
+func (eapSession *EAPSession) IsEarlier(identifier uint8) bool {
+	distance := int(eapSession.Identifier - identifier)
+	return distance > 0 && distance < eapSession.Rounds
+}
+
+// EAP5GFragments holds a 5G-NAS message fragmented over several EAP-5G
+// requests or responses, see message.FragmentEAP5GNAS
+type EAP5GFragments struct {
+	Outbound      [][]byte // Vendor data of the fragments not sent yet
+	Inbound       []byte   // Data of the fragments received so far, nil if none
+	InboundLength int      // Length of the reassembled data announced by the UE
+}
+
 // Temporary State Data Args
 const (
 	ArgsUEUDPConn string = "UE UDP Socket Info"
 )
 
+// ChildSALifetime bounds the XFRM states of a child SA by age and by bytes
+// processed, each limit disabled when 0. Past a soft limit the kernel reports
+// the expiry and the N3IWF rekeys the child SA, past a hard one the kernel
+// deletes the state
+type ChildSALifetime struct {
+	SoftTime  time.Duration
+	HardTime  time.Duration
+	SoftBytes uint64
+	HardBytes uint64
+}
+
+// Enabled reports whether any limit is set
+func (l ChildSALifetime) Enabled() bool {
+	return l != ChildSALifetime{}
+}
+
 type ChildSecurityAssociation struct {
 	// SPI
 	InboundSPI  uint32 // N3IWF Specify
 	OutboundSPI uint32 // Non-3GPP UE Specify
 
-	// Associated XFRM interface
+	// Associated XFRM interface, nil in policy mode
 	XfrmIface netlink.Link
+	// Firewall mark of the states and policies of an additional PDU session in
+	// policy mode, 0 for those matching any mark
+	XfrmMark uint32
 
 	XfrmStateList  []netlink.XfrmState
 	XfrmPolicyList []netlink.XfrmPolicy
@@ -124,15 +445,31 @@ type ChildSecurityAssociation struct {
 	// IP address
 	PeerPublicIPAddr  net.IP
 	LocalPublicIPAddr net.IP
+	// Outbound SPI and peer address under which the child SA is indexed
+	outboundID outboundSAID
 
 	// Traffic selector
 	SelectedIPProtocol    uint8
 	TrafficSelectorLocal  net.IPNet
 	TrafficSelectorRemote net.IPNet
+	// Ports of the selected protocol, any when 0
+	SelectedLocalPort  uint16
+	SelectedRemotePort uint16
 
 	// Security
 	*security.ChildSAKey
 
+	// ESP mode, tunnel unless USE_TRANSPORT_MODE was negotiated
+	TransportMode bool
+
+	// Anti-replay window in packets of the XFRM states, disabled when 0
+	ReplayWindow uint32
+
+	// Soft and hard limits of the XFRM states, see ChildSALifetime
+	Lifetime ChildSALifetime
+	// Replaced by a rekeyed child SA, until the old one is deleted
+	Rekeyed bool
+
 	// Encapsulate
 	EnableEncapsulate bool
 	N3IWFPort         int
@@ -141,10 +478,105 @@ type ChildSecurityAssociation struct {
 	// PDU Session IDs associated with this child SA
 	PDUSessionIds []int64
 
+	// GRE keys of the QoS flows carried by this child SA, QFI as key
+	GREKeys map[uint8]uint32
+	// QFI of downlink packets received without QoS information
+	DefaultQFI uint8
+
 	// IKE UE context
 	IkeUE *N3IWFIkeUe
 
 	LocalIsInitiator bool
+
+	// Proposals of the N3IWF initiated CREATE_CHILD_SA, until the UE answers
+	OfferedProposals message.ProposalContainer
+}
+
+// AssignGREKeys allocates a GRE key to each QoS flow announced to the UE in
+// the 5G_QOS_INFO notify, the first QFI being the default one
+func (childSA *ChildSecurityAssociation) AssignGREKeys(qfiList []uint8) {
+	childSA.GREKeys = make(map[uint8]uint32, len(qfiList))
+	for _, qfi := range qfiList {
+		childSA.GREKeys[qfi] = greMsg.QoSKey(qfi, false)
+	}
+	if len(qfiList) > 0 {
+		childSA.DefaultQFI = qfiList[0]
+	}
+}
+
+// GREKey returns the GRE key of a packet of the given QoS flow, and whether
+// the flow is carried by this child SA
+func (childSA *ChildSecurityAssociation) GREKey(qfi uint8, rqi bool) (uint32, bool) {
+	key, ok := childSA.GREKeys[qfi]
+	if rqi {
+		key |= greMsg.QoSKey(0, true)
+	}
+	return key, ok
+}
+
+// LogFields returns the key/value pairs summarizing an installed child SA for
+// structured logging, without any key material
+func (childSA *ChildSecurityAssociation) LogFields(xfrmiId uint32) []any {
+	fields := []any{
+		"ipProtocol", childSA.SelectedIPProtocol,
+		"tsLocal", childSA.TrafficSelectorLocal.String(),
+		"tsRemote", childSA.TrafficSelectorRemote.String(),
+		"xfrmIfId", xfrmiId,
+		"inboundSPI", fmt.Sprintf("0x%08x", childSA.InboundSPI),
+		"outboundSPI", fmt.Sprintf("0x%08x", childSA.OutboundSPI),
+		"encapsulation", childSA.EnableEncapsulate,
+		"n3iwfPort", childSA.N3IWFPort,
+		"natPort", childSA.NATPort,
+	}
+	if childSA.XfrmMark != 0 {
+		fields = append(fields, "xfrmMark", childSA.XfrmMark)
+	}
+	if len(childSA.GREKeys) > 0 {
+		fields = append(fields, "qfis", slices.Sorted(maps.Keys(childSA.GREKeys)))
+	}
+	return fields
+}
+
+// ChildSAInfo describes the child SA carrying a PDU session, without any key
+// material, so that operators can correlate it with the PDU session
+type ChildSAInfo struct {
+	PDUSessionId        int64
+	InboundSPI          uint32
+	OutboundSPI         uint32
+	EncryptionAlgorithm uint16 // ESP transform ID, e.g. 12 for ENCR_AES_CBC
+	EncryptionKeyLength int    // Bytes
+	IntegrityAlgorithm  uint16 // Integrity transform ID, 0 with a combined mode cipher
+}
+
+// LogFields returns the key/value pairs of info for structured logging
+func (info ChildSAInfo) LogFields() []any {
+	return []any{
+		"pduSessionId", info.PDUSessionId,
+		"inboundSPI", fmt.Sprintf("0x%08x", info.InboundSPI),
+		"outboundSPI", fmt.Sprintf("0x%08x", info.OutboundSPI),
+		"encryption", info.EncryptionAlgorithm,
+		"encryptionKeyLength", info.EncryptionKeyLength,
+		"integrity", info.IntegrityAlgorithm,
+	}
+}
+
+// Info describes the child SA as the carrier of the PDU session pduSessionId
+func (childSA *ChildSecurityAssociation) Info(pduSessionId int64) ChildSAInfo {
+	info := ChildSAInfo{
+		PDUSessionId: pduSessionId,
+		InboundSPI:   childSA.InboundSPI,
+		OutboundSPI:  childSA.OutboundSPI,
+	}
+	if childSA.ChildSAKey != nil {
+		if childSA.EncrKInfo != nil {
+			info.EncryptionAlgorithm = childSA.EncrKInfo.TransformID()
+			info.EncryptionKeyLength = childSA.EncrKInfo.GetKeyLength()
+		}
+		if childSA.IntegKInfo != nil {
+			info.IntegrityAlgorithm = childSA.IntegKInfo.TransformID()
+		}
+	}
+	return info
 }
 
 func (childSA *ChildSecurityAssociation) String(xfrmiId uint32) string {
@@ -161,6 +593,11 @@ func (childSA *ChildSecurityAssociation) String(xfrmiId uint32) string {
 		outboundEncryptionKey = childSA.ResponderToInitiatorEncryptionKey
 		outboundIntegrityKey = childSA.ResponderToInitiatorIntegrityKey
 	}
+	// AEAD ciphers have no separate integrity algorithm
+	var integrityAlgorithm uint16
+	if childSA.IntegKInfo != nil {
+		integrityAlgorithm = childSA.IntegKInfo.TransformID()
+	}
 
 	return fmt.Sprintf("====== IPSec/Child SA Info ======"+
 		"\n====== Inbound ======"+
@@ -186,7 +623,7 @@ func (childSA *ChildSecurityAssociation) String(xfrmiId uint32) string {
 		childSA.LocalPublicIPAddr,
 		childSA.EncrKInfo.TransformID(),
 		inboundEncryptionKey,
-		childSA.IntegKInfo.TransformID(),
+		integrityAlgorithm,
 		inboundIntegrityKey,
 		xfrmiId,
 		childSA.OutboundSPI,
@@ -194,14 +631,73 @@ func (childSA *ChildSecurityAssociation) String(xfrmiId uint32) string {
 		childSA.PeerPublicIPAddr,
 		childSA.EncrKInfo.TransformID(),
 		outboundEncryptionKey,
-		childSA.IntegKInfo.TransformID(),
+		integrityAlgorithm,
 		outboundIntegrityKey,
 	)
 }
 
+// MobikeAddressUpdate holds the addresses announced by UPDATE_SA_ADDRESSES, or
+// those a UE behind a NAT was rebound to, until the UE answers the COOKIE2
+// return routability check from them
+type MobikeAddressUpdate struct {
+	Cookie2        []byte
+	MessageID      uint32 // Of the check, taken when it is sent
+	Conn           IKEConn
+	N3IWFAddr      *net.UDPAddr
+	UEAddr         *net.UDPAddr
+	UeBehindNAT    bool
+	N3iwfBehindNAT bool
+	Retransmit     *RetransmitTimer
+}
+
+// ChildSADeleteRequest holds the inbound SPIs announced in an ESP Delete sent
+// to the UE, until the INFORMATIONAL exchange with MessageID is answered
+type ChildSADeleteRequest struct {
+	MessageID   uint32
+	InboundSPIs []uint32
+	// PDU sessions carried by the child SAs, whose PDU Session Resource
+	// Release Command is answered to the AMF once deleted
+	ReleasedPDUSessions []int64
+	Retransmit          *RetransmitTimer
+}
+
+// ChildSARekeyRequest holds a CREATE_CHILD_SA request rekeying the child SA
+// with inbound SPI OldInboundSPI, until the exchange with MessageID is answered
+type ChildSARekeyRequest struct {
+	MessageID     uint32
+	OldInboundSPI uint32
+	NewInboundSPI uint32
+	LocalNonce    []byte
+	// Proposals offered to the UE, with NewInboundSPI
+	OfferedProposals message.ProposalContainer
+	Retransmit       *RetransmitTimer
+}
+
+// IKESADeleteRequest holds an IKE Delete sent to the UE, until the
+// INFORMATIONAL exchange with MessageID is answered
+type IKESADeleteRequest struct {
+	MessageID  uint32
+	Retransmit *RetransmitTimer
+}
+
+// RevocationCheck holds an IKE_AUTH request whose UE certificate revocation
+// status is being fetched, replayed once Done with the status Err
+type RevocationCheck struct {
+	Conn    *UDPSocketInfo
+	Request *message.IKEMessage
+	Done    bool
+	Err     error
+}
+
+// CachedResponse is the datagram that answered the request with MessageID
+type CachedResponse struct {
+	MessageID uint32
+	Datagram  []byte
+}
+
 // UDPSocketInfo holds UDP connection info for IKE
 type UDPSocketInfo struct {
-	Conn      *net.UDPConn
+	Conn      IKEConn
 	N3IWFAddr *net.UDPAddr
 	UEAddr    *net.UDPAddr
 }
@@ -212,7 +708,8 @@ func (ikeUe *N3IWFIkeUe) init() {
 	ikeUe.TemporaryExchangeMsgIDChildSAMapping = make(map[uint32]*ChildSecurityAssociation)
 }
 
-// Remove cleans up the UE context and associated SAs
+// Remove cleans up the UE context and associated SAs. The kernel state of
+// every child SA is deleted even if some deletion fails, the errors are joined
 func (ikeUe *N3IWFIkeUe) Remove() error {
 	if ikeUe.N3IWFIKESecurityAssociation.IsUseDPD {
 		select {
@@ -221,72 +718,232 @@ func (ikeUe *N3IWFIkeUe) Remove() error {
 		}
 	}
 
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	if ikeSA.PendingChildSADelete != nil {
+		ikeSA.PendingChildSADelete.Retransmit.Stop()
+	}
+	if ikeSA.PendingIKEDelete != nil {
+		ikeSA.PendingIKEDelete.Retransmit.Stop()
+	}
+	ikeSA.ChildSACreateRetransmit.Stop()
+	if ikeSA.PendingChildSARekey != nil {
+		ikeSA.PendingChildSARekey.Retransmit.Stop()
+	}
+	if ikeSA.PendingAddressUpdate != nil {
+		ikeSA.PendingAddressUpdate.Retransmit.Stop()
+	}
+	ikeSA.QueuedRequests = nil
+
 	n3iwfCtx := ikeUe.N3iwfCtx
+	// An InitialUEMessage still paced would set up a UE context at the AMF
+	n3iwfCtx.InitialUEPacer.Cancel(ikeUe.N3IWFIKESecurityAssociation.LocalSPI)
 	n3iwfCtx.DeleteIKESecurityAssociation(ikeUe.N3IWFIKESecurityAssociation.LocalSPI)
-	n3iwfCtx.DeleteInternalUEIPAddr(ikeUe.IPSecInnerIP.String())
+	n3iwfCtx.ReleaseUEInnerAddress(ikeUe, ikeUe.IPSecInnerIP)
 
+	var errs []error
 	for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
 		if err := ikeUe.DeleteChildSA(childSA); err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("child SA 0x%08x: %w", childSA.InboundSPI, err))
 		}
 	}
 	n3iwfCtx.DeleteIKEUe(ikeUe.N3IWFIKESecurityAssociation.LocalSPI)
 
-	return nil
+	return errors.Join(errs...)
 }
 
-// DeleteChildSAXfrm deletes XFRM state, policy, and interface for a Child SA
+// Netlink calls used to delete XFRM resources, replaced in tests
+var (
+	xfrmStateDel  = netlink.XfrmStateDel
+	xfrmPolicyDel = netlink.XfrmPolicyDel
+	linkDel       = netlink.LinkDel
+)
+
+// DeleteChildSAXfrm deletes XFRM state, policy, and interface for a Child SA.
+// It goes on after a failure so that as little as possible is left behind
 func (ikeUe *N3IWFIkeUe) DeleteChildSAXfrm(childSA *ChildSecurityAssociation) error {
 	n3iwfCtx := ikeUe.N3iwfCtx
 	iface := childSA.XfrmIface
+	var errs []error
 
 	// Delete child SA xfrmState
 	for _, xfrmState := range childSA.XfrmStateList {
-		if err := netlink.XfrmStateDel(&xfrmState); err != nil {
-			return fmt.Errorf("delete xfrmstate: %w", err)
+		if err := xfrmStateDel(&xfrmState); err != nil {
+			errs = append(errs, fmt.Errorf("delete xfrmstate: %w", err))
 		}
 	}
 	// Delete child SA xfrmPolicy
 	for _, xfrmPolicy := range childSA.XfrmPolicyList {
-		if err := netlink.XfrmPolicyDel(&xfrmPolicy); err != nil {
-			return fmt.Errorf("delete xfrmPolicy: %w", err)
+		if err := xfrmPolicyDel(&xfrmPolicy); err != nil {
+			errs = append(errs, fmt.Errorf("delete xfrmPolicy: %w", err))
 		}
 	}
 
-	if iface != nil && iface.Attrs().Name != "xfrmi-default" {
-		if err := netlink.LinkDel(iface); err != nil {
-			return fmt.Errorf("delete interface[%s]: %w", iface.Attrs().Name, err)
-		}
-		ifId := childSA.XfrmStateList[0].Ifid
-		if ifId < 0 || ifId > math.MaxUint32 {
-			return fmt.Errorf("ifid is out of uint32 range value: %d", ifId)
+	// Only the interfaces of additional PDU sessions are per child SA, the
+	// default one is shared by all UEs
+	if iface != nil {
+		ifId, err := childSA.xfrmIfaceId()
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case ifId != n3iwfCtx.XfrmInterfaceId:
+			if err := linkDel(iface); err != nil {
+				errs = append(errs, fmt.Errorf("delete interface[%s]: %w", iface.Attrs().Name, err))
+			} else {
+				n3iwfCtx.releaseXfrmIfaceId(ifId)
+			}
 		}
-		n3iwfCtx.XfrmIfaces.Delete(uint32(ifId))
+	}
+
+	if childSA.XfrmMark != 0 {
+		n3iwfCtx.releaseXfrmIfaceId(childSA.XfrmMark)
 	}
 
 	childSA.XfrmStateList = nil
 	childSA.XfrmPolicyList = nil
+	childSA.XfrmIface = nil
+	childSA.XfrmMark = 0
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// xfrmIfaceId returns the if_id of the XFRM interface of the child SA
+func (childSA *ChildSecurityAssociation) xfrmIfaceId() (uint32, error) {
+	if xfrmi, ok := childSA.XfrmIface.(*netlink.Xfrmi); ok {
+		return xfrmi.Ifid, nil
+	}
+	if len(childSA.XfrmStateList) == 0 {
+		return 0, fmt.Errorf("unknown if_id of interface[%s]", childSA.XfrmIface.Attrs().Name)
+	}
+	ifId := childSA.XfrmStateList[0].Ifid
+	if ifId < 0 || ifId > math.MaxUint32 {
+		return 0, fmt.Errorf("ifid is out of uint32 range value: %d", ifId)
+	}
+	return uint32(ifId), nil
 }
 
 // DeleteChildSA deletes a Child SA and its XFRM resources
 func (ikeUe *N3IWFIkeUe) DeleteChildSA(childSA *ChildSecurityAssociation) error {
-	if err := ikeUe.DeleteChildSAXfrm(childSA); err != nil {
-		return err
-	}
+	err := ikeUe.DeleteChildSAXfrm(childSA)
 	delete(ikeUe.N3IWFChildSecurityAssociation, childSA.InboundSPI)
-	return nil
+	ikeUe.N3iwfCtx.ChildSA.Delete(childSA.InboundSPI)
+	ikeUe.N3iwfCtx.outboundChildSA.CompareAndDelete(childSA.outboundID, childSA)
+	return err
+}
+
+// PDUSessionChildSASPIs returns the inbound SPIs, in ascending order, of the
+// child SAs carrying any of the given PDU sessions
+func (ikeUe *N3IWFIkeUe) PDUSessionChildSASPIs(pduSessionIDs []int64) []uint32 {
+	var spis []uint32
+	for spi, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+		if slices.ContainsFunc(childSA.PDUSessionIds, func(id int64) bool {
+			return slices.Contains(pduSessionIDs, id)
+		}) {
+			spis = append(spis, spi)
+		}
+	}
+	slices.Sort(spis)
+	return spis
+}
+
+// ReleasePDUSessions accounts for the release of PDU sessions, so the next one
+// set up gets the default XFRM interface again when it is the only one left
+func (ikeUe *N3IWFIkeUe) ReleasePDUSessions(count int) {
+	ikeUe.PduSessionListLen = max(ikeUe.PduSessionListLen-count, 0)
 }
 
 // CreateHalfChildSA creates a half Child SA for a CREATE_CHILD_SA request
-func (ikeUe *N3IWFIkeUe) CreateHalfChildSA(msgID, inboundSPI uint32, pduSessionID int64) {
+func (ikeUe *N3IWFIkeUe) CreateHalfChildSA(msgID, inboundSPI uint32, pduSessionID int64) *ChildSecurityAssociation {
 	childSA := &ChildSecurityAssociation{
 		InboundSPI:    inboundSPI,
 		PDUSessionIds: []int64{pduSessionID},
+		ReplayWindow:  ikeUe.N3iwfCtx.ESPReplayWindow,
+		Lifetime:      ikeUe.N3iwfCtx.ChildSALifetime,
 		IkeUE:         ikeUe,
 	}
 	ikeUe.TemporaryExchangeMsgIDChildSAMapping[msgID] = childSA
+	return childSA
+}
+
+// ErrInvalidOutboundSPI is returned when the SPI chosen by the UE for a child
+// SA is zero or already used
+var ErrInvalidOutboundSPI = errors.New("invalid outbound child SA SPI")
+
+// CheckOutboundSPI checks that spi, chosen by the UE for a new child SA to
+// peerIP, is not zero and used by no other child SA of the UE. Nor may a child
+// SA of another UE behind the same public address use it, as the kernel tells
+// the outbound XFRM states apart by destination address and SPI
+func (ikeUe *N3IWFIkeUe) CheckOutboundSPI(spi uint32, peerIP net.IP) error {
+	if spi == 0 {
+		return fmt.Errorf("%w: SPI is zero", ErrInvalidOutboundSPI)
+	}
+	for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+		if childSA.OutboundSPI == spi {
+			return fmt.Errorf("%w: 0x%08x already used by child SA 0x%08x", ErrInvalidOutboundSPI, spi,
+				childSA.InboundSPI)
+		}
+	}
+	if childSA := ikeUe.N3iwfCtx.OutboundChildSA(peerIP, spi); childSA != nil {
+		return fmt.Errorf("%w: 0x%08x already used towards %s by child SA 0x%08x", ErrInvalidOutboundSPI,
+			spi, peerIP, childSA.InboundSPI)
+	}
+	return nil
+}
+
+// outboundSAID identifies the outbound XFRM state of a child SA as the kernel
+// does, by destination address and SPI
+type outboundSAID struct {
+	peer netip.Addr
+	spi  uint32
+}
+
+func newOutboundSAID(peerIP net.IP, spi uint32) outboundSAID {
+	peer, _ := netip.AddrFromSlice(peerIP)
+	return outboundSAID{peer: peer.Unmap(), spi: spi}
+}
+
+// IndexOutboundSPI records childSA under its outbound SPI and peer address,
+// see OutboundChildSA. It is called again when the peer address changes
+func (n3iwfCtx *N3IWFContext) IndexOutboundSPI(childSA *ChildSecurityAssociation) {
+	n3iwfCtx.outboundChildSA.CompareAndDelete(childSA.outboundID, childSA)
+	childSA.outboundID = newOutboundSAID(childSA.PeerPublicIPAddr, childSA.OutboundSPI)
+	n3iwfCtx.outboundChildSA.Store(childSA.outboundID, childSA)
+}
+
+// OutboundChildSA returns the child SA whose outbound XFRM state goes to
+// peerIP with spi, nil if none. A child SA dropped without DeleteChildSA, or
+// since moved to another address, is not returned
+func (n3iwfCtx *N3IWFContext) OutboundChildSA(peerIP net.IP, spi uint32) *ChildSecurityAssociation {
+	value, ok := n3iwfCtx.outboundChildSA.Load(newOutboundSAID(peerIP, spi))
+	if !ok {
+		return nil
+	}
+	childSA, ok := value.(*ChildSecurityAssociation)
+	if !ok || childSA.OutboundSPI != spi || !childSA.PeerPublicIPAddr.Equal(peerIP) {
+		return nil
+	}
+	if registered, ok := n3iwfCtx.ChildSA.Load(childSA.InboundSPI); !ok || registered != childSA {
+		return nil
+	}
+	return childSA
+}
+
+// XfrmStateCandidates returns the child SAs which may own the XFRM state with
+// spi to dst: the one with inbound SPI spi, and the one indexed under the
+// outbound SPI spi to dst. Their fields are not read, the caller checks which
+// one owns the state with its IKE SA locked
+func (n3iwfCtx *N3IWFContext) XfrmStateCandidates(spi uint32, dst net.IP) []*ChildSecurityAssociation {
+	var candidates []*ChildSecurityAssociation
+	if value, ok := n3iwfCtx.ChildSA.Load(spi); ok {
+		if childSA, ok := value.(*ChildSecurityAssociation); ok {
+			candidates = append(candidates, childSA)
+		}
+	}
+	if value, ok := n3iwfCtx.outboundChildSA.Load(newOutboundSAID(dst, spi)); ok {
+		if childSA, ok := value.(*ChildSecurityAssociation); ok && !slices.Contains(candidates, childSA) {
+			candidates = append(candidates, childSA)
+		}
+	}
+	return candidates
 }
 
 // CompleteChildSA finalizes a Child SA after receiving a response
@@ -307,6 +964,7 @@ func (ikeUe *N3IWFIkeUe) CompleteChildSA(msgID uint32, outboundSPI uint32,
 	}
 
 	childSA.OutboundSPI = outboundSPI
+	childSA.OfferedProposals = nil
 	var err error
 	childSA.ChildSAKey, err = security.NewChildSAKeyByProposal(chosenSecurityAssociation.Proposals[0])
 	if err != nil {
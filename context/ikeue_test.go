@@ -0,0 +1,531 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/logger"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/sys/unix"
+)
+
+func TestChildSALogFields(t *testing.T) {
+	childSA := &ChildSecurityAssociation{
+		InboundSPI:            0x0a0b0c0d,
+		OutboundSPI:           0x01020304,
+		SelectedIPProtocol:    unix.IPPROTO_TCP,
+		TrafficSelectorLocal:  net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)},
+		TrafficSelectorRemote: net.IPNet{IP: net.IPv4(10, 0, 0, 2).To4(), Mask: net.CIDRMask(32, 32)},
+		EnableEncapsulate:     true,
+		N3IWFPort:             4500,
+		NATPort:               34567,
+	}
+
+	fields := childSA.LogFields(7)
+	if len(fields)%2 != 0 {
+		t.Fatalf("odd number of log fields: %d", len(fields))
+	}
+	got := make(map[string]any)
+	for i := 0; i < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			t.Fatalf("log field key %v is not a string", fields[i])
+		}
+		got[key] = fields[i+1]
+	}
+
+	expected := map[string]any{
+		"ipProtocol":    uint8(unix.IPPROTO_TCP),
+		"tsLocal":       "10.0.0.1/32",
+		"tsRemote":      "10.0.0.2/32",
+		"xfrmIfId":      uint32(7),
+		"inboundSPI":    "0x0a0b0c0d",
+		"outboundSPI":   "0x01020304",
+		"encapsulation": true,
+		"n3iwfPort":     4500,
+		"natPort":       34567,
+	}
+	if len(got) != len(expected) {
+		t.Errorf("log field count mismatch. got = %d, want = %d", len(got), len(expected))
+	}
+	for key, value := range expected {
+		if got[key] != value {
+			t.Errorf("log field %s mismatch. got = %v, want = %v", key, got[key], value)
+		}
+	}
+}
+
+func TestIKESALog(t *testing.T) {
+	ikeLog := logger.IKELog
+	defer func() { logger.IKELog = ikeLog }()
+	core, logs := observer.New(zap.DebugLevel)
+	logger.IKELog = zap.New(core).Sugar()
+
+	var nilSA *IKESecurityAssociation
+	nilSA.Log().Info("before IKE_SA_INIT")
+	ikeSA := &IKESecurityAssociation{LocalSPI: 0x0102030405060708, RemoteSPI: 0x1112131415161718}
+	ikeSA.Log().Info("before IKE_AUTH")
+	ikeSA.InitiatorID = &message.IdentificationInitiator{IDType: message.ID_FQDN, IDData: []byte("ue.example.org")}
+	ikeSA.Log().Info("after IKE_AUTH")
+	ikeSA.EAP.Identity = "imsi-001010000000001"
+	ikeSA.Log().Info("after EAP identity")
+
+	testcases := []struct {
+		description string
+		expFields   map[string]any
+	}{
+		{
+			description: "no SA",
+			expFields:   map[string]any{},
+		},
+		{
+			description: "SPIs",
+			expFields: map[string]any{
+				"localSPI":  "0102030405060708",
+				"remoteSPI": "1112131415161718",
+			},
+		},
+		{
+			description: "SPIs and UE identity",
+			expFields: map[string]any{
+				"localSPI":   "0102030405060708",
+				"remoteSPI":  "1112131415161718",
+				"ueIdentity": "5fcf12e2bdcbe2b7",
+			},
+		},
+		{
+			description: "SPIs and UE and EAP identities",
+			expFields: map[string]any{
+				"localSPI":    "0102030405060708",
+				"remoteSPI":   "1112131415161718",
+				"ueIdentity":  "5fcf12e2bdcbe2b7",
+				"eapIdentity": "af6a486f32823283",
+			},
+		},
+	}
+
+	entries := logs.AllUntimed()
+	if len(entries) != len(testcases) {
+		t.Fatalf("log entries mismatch. got = %d, want = %d", len(entries), len(testcases))
+	}
+	for i, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			fields := entries[i].ContextMap()
+			if len(fields) != len(tc.expFields) {
+				t.Errorf("log fields mismatch. got = %v, want = %v", fields, tc.expFields)
+			}
+			for key, value := range tc.expFields {
+				if fields[key] != value {
+					t.Errorf("log field %s mismatch. got = %v, want = %v", key, fields[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestChildSAGREKeys(t *testing.T) {
+	childSA := &ChildSecurityAssociation{}
+	childSA.AssignGREKeys([]uint8{9, 1})
+	if childSA.DefaultQFI != 9 {
+		t.Errorf("DefaultQFI mismatch. got = %d, want = %d", childSA.DefaultQFI, 9)
+	}
+
+	testcases := []struct {
+		description string
+		qfi         uint8
+		rqi         bool
+		expKey      uint32
+		expOk       bool
+	}{
+		{
+			description: "default QoS flow",
+			qfi:         9,
+			expKey:      0x09000000,
+			expOk:       true,
+		},
+		{
+			description: "reflective QoS",
+			qfi:         1,
+			rqi:         true,
+			expKey:      0x01000080,
+			expOk:       true,
+		},
+		{
+			description: "QoS flow not carried",
+			qfi:         5,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			key, ok := childSA.GREKey(tc.qfi, tc.rqi)
+			if ok != tc.expOk {
+				t.Errorf("ok mismatch. got = %v, want = %v", ok, tc.expOk)
+			}
+			if ok && key != tc.expKey {
+				t.Errorf("key mismatch. got = 0x%08x, want = 0x%08x", key, tc.expKey)
+			}
+		})
+	}
+}
+
+func TestChildSAStringWithoutIntegrity(t *testing.T) {
+	var proposal message.Proposal
+	keyLength := uint16(128)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_GCM_16, &attrType, &keyLength, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+	childSAKey, err := security.NewChildSAKeyByProposal(&proposal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	childSA := &ChildSecurityAssociation{InboundSPI: 0x0a0b0c0d, ChildSAKey: childSAKey}
+	if info := childSA.String(7); !strings.Contains(info, "0x0a0b0c0d") {
+		t.Errorf("child SA info without inbound SPI: %s", info)
+	}
+}
+
+func TestCheckOutboundSPI(t *testing.T) {
+	peerIP := net.ParseIP("192.0.2.10")
+	n3iwfCtx := &N3IWFContext{}
+	ikeUe := n3iwfCtx.NewN3iwfIkeUe(0x1234)
+	ikeUe.N3IWFChildSecurityAssociation[0x100] = &ChildSecurityAssociation{
+		InboundSPI: 0x100, OutboundSPI: 0x200, PeerPublicIPAddr: peerIP,
+	}
+	childSAs := []*ChildSecurityAssociation{
+		{InboundSPI: 0x101, OutboundSPI: 0x300, PeerPublicIPAddr: peerIP},
+		{InboundSPI: 0x102, OutboundSPI: 0x500, PeerPublicIPAddr: peerIP},
+		{InboundSPI: 0x103, OutboundSPI: 0x600, PeerPublicIPAddr: peerIP},
+	}
+	for _, childSA := range childSAs {
+		n3iwfCtx.ChildSA.Store(childSA.InboundSPI, childSA)
+		n3iwfCtx.IndexOutboundSPI(childSA)
+	}
+	// Child SA 0x102 moved to another address, 0x103 was dropped
+	childSAs[1].PeerPublicIPAddr = net.ParseIP("192.0.2.30")
+	n3iwfCtx.IndexOutboundSPI(childSAs[1])
+	n3iwfCtx.ChildSA.Delete(childSAs[2].InboundSPI)
+
+	testcases := []struct {
+		description string
+		spi         uint32
+		peerIP      net.IP
+		expErr      bool
+	}{
+		{description: "zero SPI", spi: 0, peerIP: peerIP, expErr: true},
+		{description: "SPI of a child SA of the UE", spi: 0x200, peerIP: net.ParseIP("192.0.2.20"), expErr: true},
+		{description: "SPI of another UE behind the same address", spi: 0x300, peerIP: peerIP, expErr: true},
+		{description: "SPI of another UE behind another address", spi: 0x300, peerIP: net.ParseIP("192.0.2.20")},
+		{description: "unused SPI", spi: 0x400, peerIP: peerIP},
+		{description: "SPI of a child SA moved away", spi: 0x500, peerIP: peerIP},
+		{description: "SPI of a child SA moved to the address", spi: 0x500, peerIP: net.ParseIP("192.0.2.30"), expErr: true},
+		{description: "SPI of a dropped child SA", spi: 0x600, peerIP: peerIP},
+		{description: "SPI of another UE behind the same IPv4-mapped address", spi: 0x300,
+			peerIP: net.ParseIP("::ffff:192.0.2.10"), expErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := ikeUe.CheckOutboundSPI(tc.spi, tc.peerIP)
+			if tc.expErr {
+				if !errors.Is(err, ErrInvalidOutboundSPI) {
+					t.Errorf("Expected ErrInvalidOutboundSPI, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRemoveDeletesXfrmResources(t *testing.T) {
+	var deletedStates, deletedPolicies []int
+	var deletedLinks []string
+	origStateDel, origPolicyDel, origLinkDel := xfrmStateDel, xfrmPolicyDel, linkDel
+	t.Cleanup(func() {
+		xfrmStateDel, xfrmPolicyDel, linkDel = origStateDel, origPolicyDel, origLinkDel
+	})
+	xfrmStateDel = func(state *netlink.XfrmState) error {
+		deletedStates = append(deletedStates, state.Spi)
+		return nil
+	}
+	xfrmPolicyDel = func(policy *netlink.XfrmPolicy) error {
+		deletedPolicies = append(deletedPolicies, policy.Ifid)
+		if policy.Dir == netlink.XFRM_DIR_OUT && policy.Ifid == 16 {
+			return errors.New("no such policy")
+		}
+		return nil
+	}
+	linkDel = func(link netlink.Link) error {
+		deletedLinks = append(deletedLinks, link.Attrs().Name)
+		return nil
+	}
+
+	xfrmi := func(name string, ifId uint32) *netlink.Xfrmi {
+		return &netlink.Xfrmi{LinkAttrs: netlink.LinkAttrs{Name: name}, Ifid: ifId}
+	}
+	childSA := func(spi uint32, iface *netlink.Xfrmi) *ChildSecurityAssociation {
+		ifId := int(iface.Ifid)
+		return &ChildSecurityAssociation{
+			InboundSPI: spi,
+			XfrmIface:  iface,
+			XfrmStateList: []netlink.XfrmState{
+				{Spi: int(spi), Ifid: ifId},
+				{Spi: int(spi) + 1, Ifid: ifId},
+			},
+			XfrmPolicyList: []netlink.XfrmPolicy{
+				{Dir: netlink.XFRM_DIR_IN, Ifid: ifId},
+				{Dir: netlink.XFRM_DIR_OUT, Ifid: ifId},
+			},
+		}
+	}
+
+	// Default interface 7, additional PDU session interfaces 15 and 16
+	xfrmIfaceIds, err := NewXfrmIfaceIds(15, 20)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	xfrmIfaceIds.Reserve(15)
+	xfrmIfaceIds.Reserve(16)
+	n3iwfCtx := &N3IWFContext{XfrmInterfaceId: 7, XfrmIfaceIds: xfrmIfaceIds}
+	defaultIface := xfrmi("ipsec-default", 7)
+	n3iwfCtx.XfrmIfaces.Store(uint32(7), defaultIface)
+	n3iwfCtx.XfrmIfaces.Store(uint32(15), xfrmi("ipsec-15", 15))
+	n3iwfCtx.XfrmIfaces.Store(uint32(16), xfrmi("ipsec-16", 16))
+
+	ikeUe := n3iwfCtx.NewN3iwfIkeUe(0x1234)
+	ikeUe.N3IWFIKESecurityAssociation = &IKESecurityAssociation{LocalSPI: 0x1234}
+	for _, sa := range []*ChildSecurityAssociation{
+		childSA(0x100, defaultIface),
+		childSA(0x200, xfrmi("ipsec-15", 15)),
+		childSA(0x300, xfrmi("ipsec-16", 16)),
+	} {
+		ikeUe.N3IWFChildSecurityAssociation[sa.InboundSPI] = sa
+		n3iwfCtx.ChildSA.Store(sa.InboundSPI, sa)
+	}
+
+	if err := ikeUe.Remove(); err == nil {
+		t.Errorf("Expected error but got none")
+	}
+
+	if len(deletedStates) != 6 {
+		t.Errorf("deleted XFRM states mismatch. got = %d, want = %d", len(deletedStates), 6)
+	}
+	if len(deletedPolicies) != 6 {
+		t.Errorf("deleted XFRM policies mismatch. got = %d, want = %d", len(deletedPolicies), 6)
+	}
+	slices.Sort(deletedLinks)
+	if expLinks := []string{"ipsec-15", "ipsec-16"}; !slices.Equal(deletedLinks, expLinks) {
+		t.Errorf("deleted interfaces mismatch. got = %v, want = %v", deletedLinks, expLinks)
+	}
+	if _, ok := n3iwfCtx.XfrmIfaces.Load(uint32(7)); !ok {
+		t.Errorf("default XFRM interface was forgotten")
+	}
+	for _, ifId := range []uint32{15, 16} {
+		if _, ok := n3iwfCtx.XfrmIfaces.Load(ifId); ok {
+			t.Errorf("XFRM interface %d was not forgotten", ifId)
+		}
+	}
+	if inUse := xfrmIfaceIds.InUse(); inUse != 0 {
+		t.Errorf("XFRM interface IDs in use mismatch. got = %d, want = %d", inUse, 0)
+	}
+	if len(ikeUe.N3IWFChildSecurityAssociation) != 0 {
+		t.Errorf("child SAs left: %d", len(ikeUe.N3IWFChildSecurityAssociation))
+	}
+	n3iwfCtx.ChildSA.Range(func(key, value any) bool {
+		t.Errorf("child SA 0x%08x left in the context", key)
+		return true
+	})
+	if _, ok := n3iwfCtx.IkeUePoolLoad(0x1234); ok {
+		t.Errorf("IKE UE was not deleted")
+	}
+}
+
+func TestNATKeepalive(t *testing.T) {
+	n3iwfConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer n3iwfConn.Close()
+	ueConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+
+	testcases := []struct {
+		description       string
+		enableEncapsulate bool
+	}{
+		{
+			description:       "UDP encapsulated child SA",
+			enableEncapsulate: true,
+		},
+		{
+			description: "plain ESP child SA",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeUe := (&N3IWFContext{}).NewN3iwfIkeUe(0x1234)
+			ikeUe.N3IWFChildSecurityAssociation[0x100] = &ChildSecurityAssociation{
+				InboundSPI:        0x100,
+				EnableEncapsulate: tc.enableEncapsulate,
+			}
+			ikeSA := &IKESecurityAssociation{
+				LocalSPI: 0x1234,
+				IkeUE:    ikeUe,
+				IKEConnection: &UDPSocketInfo{
+					Conn:      n3iwfConn,
+					N3IWFAddr: n3iwfConn.LocalAddr().(*net.UDPAddr),
+					UEAddr:    ueConn.LocalAddr().(*net.UDPAddr),
+				},
+			}
+
+			ikeSA.Lock()
+			ikeSA.StartNATKeepalive(10 * time.Millisecond)
+			ikeSA.Unlock()
+
+			buf := make([]byte, 16)
+			for range 2 {
+				if err := ueConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				n, _, err := ueConn.ReadFromUDP(buf)
+				if !tc.enableEncapsulate {
+					if err == nil {
+						t.Fatalf("Unexpected keepalive: %x", buf[:n])
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("keepalive not received: %v", err)
+				}
+				if n != 1 || buf[0] != 0xff {
+					t.Fatalf("keepalive mismatch. got = %x, want = ff", buf[:n])
+				}
+			}
+
+			ikeSA.Lock()
+			ikeSA.StopNATKeepalive()
+			ikeSA.Unlock()
+			// Drain a keepalive sent while stopping
+			if err := ueConn.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			_, _, _ = ueConn.ReadFromUDP(buf)
+			if err := ueConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if n, _, err := ueConn.ReadFromUDP(buf); err == nil {
+				t.Errorf("Unexpected keepalive after stop: %x", buf[:n])
+			}
+		})
+	}
+}
+
+func TestPDUSessionChildSASPIs(t *testing.T) {
+	n3iwfCtx := &N3IWFContext{}
+	ikeUe := n3iwfCtx.NewN3iwfIkeUe(0x1234)
+	for spi, pduSessionIds := range map[uint32][]int64{
+		0x300: {1},
+		0x100: {1},
+		0x200: {2, 3},
+		0x400: nil,
+	} {
+		ikeUe.N3IWFChildSecurityAssociation[spi] = &ChildSecurityAssociation{InboundSPI: spi, PDUSessionIds: pduSessionIds}
+	}
+
+	testcases := []struct {
+		description   string
+		pduSessionIDs []int64
+		expSPIs       []uint32
+	}{
+		{
+			description:   "PDU session with two child SAs",
+			pduSessionIDs: []int64{1},
+			expSPIs:       []uint32{0x100, 0x300},
+		},
+		{
+			description:   "PDU session sharing a child SA",
+			pduSessionIDs: []int64{3},
+			expSPIs:       []uint32{0x200},
+		},
+		{
+			description:   "PDU sessions sharing a child SA",
+			pduSessionIDs: []int64{2, 3},
+			expSPIs:       []uint32{0x200},
+		},
+		{
+			description:   "unknown PDU session",
+			pduSessionIDs: []int64{5},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if spis := ikeUe.PDUSessionChildSASPIs(tc.pduSessionIDs); !slices.Equal(spis, tc.expSPIs) {
+				t.Errorf("SPIs mismatch. got = %x, want = %x", spis, tc.expSPIs)
+			}
+		})
+	}
+
+	ikeUe.PduSessionListLen = 2
+	ikeUe.ReleasePDUSessions(3)
+	if ikeUe.PduSessionListLen != 0 {
+		t.Errorf("PduSessionListLen mismatch. got = %d, want = %d", ikeUe.PduSessionListLen, 0)
+	}
+}
+
+func TestEAPSessionIdentifiers(t *testing.T) {
+	var eapSession EAPSession
+	first, err := eapSession.NextRequest(message.EAPTypeExpanded, message.EAP5GType5GStart)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for round := 1; round <= 300; round++ {
+		identifier, err := eapSession.NextRequest(message.EAPTypeExpanded, message.EAP5GType5GNAS)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if want := first + uint8(round); identifier != want {
+			t.Fatalf("identifier mismatch. got = %d, want = %d", identifier, want)
+		}
+	}
+	if eapSession.Rounds != 301 || eapSession.MessageID != message.EAP5GType5GNAS {
+		t.Errorf("session mismatch. got = %+v", eapSession)
+	}
+
+	eapSession = EAPSession{Identifier: 1, Rounds: 3}
+	testcases := []struct {
+		description string
+		identifier  uint8
+		expEarlier  bool
+	}{
+		{description: "outstanding request", identifier: 1},
+		{description: "previous request", identifier: 0, expEarlier: true},
+		{description: "first request across the wrap", identifier: 255, expEarlier: true},
+		{description: "before the first request", identifier: 254},
+		{description: "next request", identifier: 2},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if got := eapSession.IsEarlier(tc.identifier); got != tc.expEarlier {
+				t.Errorf("IsEarlier mismatch. got = %v, want = %v", got, tc.expEarlier)
+			}
+		})
+	}
+}
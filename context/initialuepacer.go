@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InitialUEPacer smooths the rate at which InitialUEMessages are sent to the
+// AMFs, so a mass attach (e.g. after an outage) does not flood them. Messages
+// beyond the burst are queued and released at the configured rate; when the
+// queue is full new UEs are rejected. A nil pacer sends immediately
+type InitialUEPacer struct {
+	rate  float64 // messages per second
+	burst float64
+
+	mu        sync.Mutex
+	queue     []pacedSend
+	queueSize int
+	wake      chan struct{} // Signalled when a message is queued
+	tokens    float64
+	last      time.Time
+	rejected  atomic.Uint64
+	now       func() time.Time
+	sleep     func(time.Duration)
+}
+
+// NewInitialUEPacer returns a pacer releasing rate messages per second, with
+// bursts of up to burst messages and at most queueSize messages waiting
+func NewInitialUEPacer(rate float64, burst, queueSize int) *InitialUEPacer {
+	p := newInitialUEPacer(rate, burst, queueSize, time.Now, time.Sleep)
+	if p != nil {
+		go p.run()
+	}
+	return p
+}
+
+func newInitialUEPacer(rate float64, burst, queueSize int,
+	now func() time.Time, sleep func(time.Duration),
+) *InitialUEPacer {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &InitialUEPacer{
+		rate:      rate,
+		burst:     float64(burst),
+		queueSize: queueSize,
+		wake:      make(chan struct{}, 1),
+		tokens:    float64(burst),
+		last:      now(),
+		now:       now,
+		sleep:     sleep,
+	}
+}
+
+// pacedSend is a queued message, key being the local SPI of the IKE SA of
+// the UE, see Cancel
+type pacedSend struct {
+	key  uint64
+	send func()
+}
+
+// Submit schedules send for the UE of the IKE SA key and reports whether it
+// was accepted. send runs on the pacer goroutine, or synchronously for a nil
+// pacer
+func (p *InitialUEPacer) Submit(key uint64, send func()) bool {
+	if p == nil {
+		send()
+		return true
+	}
+	p.mu.Lock()
+	if len(p.queue) >= p.queueSize {
+		p.mu.Unlock()
+		p.rejected.Add(1)
+		return false
+	}
+	p.queue = append(p.queue, pacedSend{key: key, send: send})
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Cancel drops the messages still queued for the UE of the IKE SA key, once
+// its context is removed
+func (p *InitialUEPacer) Cancel(key uint64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = slices.DeleteFunc(p.queue, func(queued pacedSend) bool { return queued.key == key })
+}
+
+// Queued returns the number of messages waiting to be sent
+func (p *InitialUEPacer) Queued() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// Rejected returns the number of messages refused because the queue was full
+func (p *InitialUEPacer) Rejected() uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.rejected.Load()
+}
+
+func (p *InitialUEPacer) run() {
+	for range p.wake {
+		for p.Queued() > 0 {
+			p.wait()
+			if send := p.pop(); send != nil {
+				send()
+			} else {
+				// Canceled while waiting, the token is left to the next message
+				p.tokens++
+			}
+		}
+	}
+}
+
+// pop removes the first queued message, nil if it was canceled meanwhile
+func (p *InitialUEPacer) pop() func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return nil
+	}
+	send := p.queue[0].send
+	p.queue = p.queue[1:]
+	return send
+}
+
+// wait consumes a token, sleeping until one is available
+func (p *InitialUEPacer) wait() {
+	now := p.now()
+	p.tokens = min(p.burst, p.tokens+now.Sub(p.last).Seconds()*p.rate)
+	p.last = now
+	if p.tokens >= 1 {
+		p.tokens--
+		return
+	}
+	delay := time.Duration((1 - p.tokens) / p.rate * float64(time.Second))
+	p.sleep(delay)
+	p.tokens = 0
+	p.last = now.Add(delay)
+}
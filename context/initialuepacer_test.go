@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInitialUEPacerBurst(t *testing.T) {
+	start := time.Now()
+	now := start
+	pacer := newInitialUEPacer(10, 2, 16,
+		func() time.Time { return now },
+		func(d time.Duration) { now = now.Add(d) })
+
+	sent := make(chan time.Duration, 16)
+	for range 5 {
+		if !pacer.Submit(1, func() { sent <- now.Sub(start) }) {
+			t.Fatalf("Submit rejected with room in the queue")
+		}
+	}
+	go pacer.run()
+
+	// The burst goes out at once, the rest at 10 messages per second
+	expected := []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	for i, want := range expected {
+		select {
+		case got := <-sent:
+			if got != want {
+				t.Errorf("message %d send time mismatch. got = %v, want = %v", i, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d not sent", i)
+		}
+	}
+}
+
+func TestInitialUEPacerQueueFull(t *testing.T) {
+	pacer := newInitialUEPacer(1, 1, 2, time.Now, time.Sleep)
+	for range 2 {
+		if !pacer.Submit(1, func() {}) {
+			t.Fatalf("Submit rejected with room in the queue")
+		}
+	}
+	if pacer.Submit(1, func() {}) {
+		t.Errorf("Expected Submit to be rejected on a full queue")
+	}
+	if pacer.Queued() != 2 || pacer.Rejected() != 1 {
+		t.Errorf("counters mismatch. got = %d queued/%d rejected, want = 2/1", pacer.Queued(), pacer.Rejected())
+	}
+}
+
+func TestNilInitialUEPacer(t *testing.T) {
+	if pacer := NewInitialUEPacer(0, 10, 10); pacer != nil {
+		t.Fatalf("Expected nil pacer without rate")
+	}
+	var pacer *InitialUEPacer
+	sent := false
+	if !pacer.Submit(1, func() { sent = true }) || !sent {
+		t.Errorf("nil pacer must send immediately")
+	}
+}
+
+func TestInitialUEPacerCancel(t *testing.T) {
+	pacer := newInitialUEPacer(1000, 10, 3, time.Now, time.Sleep)
+	sent := make(chan uint64, 4)
+	for _, key := range []uint64{1, 2, 3} {
+		if !pacer.Submit(key, func() { sent <- key }) {
+			t.Fatalf("Submit rejected with room in the queue")
+		}
+	}
+	// The canceled message leaves room in the queue
+	pacer.Cancel(2)
+	if pacer.Queued() != 2 {
+		t.Errorf("queued mismatch. got = %d, want = 2", pacer.Queued())
+	}
+	if !pacer.Submit(4, func() { sent <- 4 }) {
+		t.Fatalf("Submit rejected after Cancel")
+	}
+	go pacer.run()
+
+	for _, want := range []uint64{1, 3, 4} {
+		select {
+		case got := <-sent:
+			if got != want {
+				t.Errorf("sent message mismatch. got = %d, want = %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d not sent", want)
+		}
+	}
+	select {
+	case got := <-sent:
+		t.Errorf("canceled message %d sent", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+)
+
+// IKESASummary is a read-only snapshot of an IKE SA for introspection
+type IKESASummary struct {
+	LocalSPI       string `json:"localSpi"`
+	RemoteSPI      string `json:"remoteSpi"`
+	UEIdentity     string `json:"ueIdentity,omitempty"` // Digest of the SUPI or NAI, as logged
+	RanUeNgapId    int64  `json:"ranUeNgapId,omitempty"`
+	State          uint8  `json:"state"`
+	EAPRounds      int    `json:"eapRounds"` // EAP requests sent to the UE in IKE_AUTH
+	UeBehindNAT    bool   `json:"ueBehindNat"`
+	N3iwfBehindNAT bool   `json:"n3iwfBehindNat"`
+	PeerAddress    string `json:"peerAddress,omitempty"`
+	InnerIPAddress string `json:"innerIpAddress,omitempty"`
+	ChildSACount   int    `json:"childSaCount"`
+}
+
+// ChildSASummary is a read-only snapshot of a child SA for introspection
+type ChildSASummary struct {
+	InboundSPI            string           `json:"inboundSpi"`
+	OutboundSPI           string           `json:"outboundSpi"`
+	IPProtocol            uint8            `json:"ipProtocol"`
+	TrafficSelectorLocal  string           `json:"trafficSelectorLocal"`
+	TrafficSelectorRemote string           `json:"trafficSelectorRemote"`
+	EncryptionAlgorithm   uint16           `json:"encryptionAlgorithm,omitempty"`
+	EncryptionKeyLength   int              `json:"encryptionKeyLength,omitempty"`
+	IntegrityAlgorithm    uint16           `json:"integrityAlgorithm,omitempty"`
+	EnableEncapsulate     bool             `json:"enableEncapsulate"`
+	N3IWFPort             int              `json:"n3iwfPort,omitempty"`
+	NATPort               int              `json:"natPort,omitempty"`
+	XfrmInterface         string           `json:"xfrmInterface,omitempty"`
+	PDUSessionIds         []int64          `json:"pduSessionIds,omitempty"`
+	GREKeys               map[uint8]uint32 `json:"greKeys,omitempty"`
+}
+
+// ListIKESecurityAssociations returns a summary of every IKE SA, ordered by local SPI
+func (n3iwfCtx *N3IWFContext) ListIKESecurityAssociations() []IKESASummary {
+	var summaries []IKESASummary
+	n3iwfCtx.IkeSA.Range(func(key, value any) bool {
+		ikeSA, ok := value.(*IKESecurityAssociation)
+		if !ok {
+			return true
+		}
+		ikeSA.Lock()
+		defer ikeSA.Unlock()
+		summary := IKESASummary{
+			LocalSPI:       fmt.Sprintf("%016x", ikeSA.LocalSPI),
+			RemoteSPI:      fmt.Sprintf("%016x", ikeSA.RemoteSPI),
+			State:          ikeSA.State,
+			EAPRounds:      ikeSA.EAP.Rounds,
+			UeBehindNAT:    ikeSA.UeBehindNAT,
+			N3iwfBehindNAT: ikeSA.N3iwfBehindNAT,
+		}
+		if identity := ikeSA.UEIdentity(); identity != "" {
+			summary.UEIdentity = logIdentity(identity)
+		}
+		if ranUeNgapId, ok := n3iwfCtx.NgapIdLoad(ikeSA.LocalSPI); ok {
+			summary.RanUeNgapId = ranUeNgapId
+		}
+		if ikeSA.IKEConnection != nil && ikeSA.IKEConnection.UEAddr != nil {
+			summary.PeerAddress = ikeSA.IKEConnection.UEAddr.String()
+		}
+		if ikeUe := ikeSA.IkeUE; ikeUe != nil {
+			if ikeUe.IPSecInnerIP != nil {
+				summary.InnerIPAddress = ikeUe.IPSecInnerIP.String()
+			}
+			summary.ChildSACount = len(ikeUe.N3IWFChildSecurityAssociation)
+		}
+		summaries = append(summaries, summary)
+		return true
+	})
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].LocalSPI < summaries[j].LocalSPI
+	})
+	return summaries
+}
+
+// ListChildSAs returns a summary of the child SAs of the IKE SA with the given local SPI
+func (n3iwfCtx *N3IWFContext) ListChildSAs(localSPI uint64) ([]ChildSASummary, error) {
+	ikeSA, ok := n3iwfCtx.IKESALoad(localSPI)
+	if !ok {
+		return nil, fmt.Errorf("ListChildSAs: IKE SA %016x not found", localSPI)
+	}
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	ikeUe := ikeSA.IkeUE
+	if ikeUe == nil {
+		return nil, nil
+	}
+
+	summaries := make([]ChildSASummary, 0, len(ikeUe.N3IWFChildSecurityAssociation))
+	for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+		summary := ChildSASummary{
+			InboundSPI:            fmt.Sprintf("%08x", childSA.InboundSPI),
+			OutboundSPI:           fmt.Sprintf("%08x", childSA.OutboundSPI),
+			IPProtocol:            childSA.SelectedIPProtocol,
+			TrafficSelectorLocal:  childSA.TrafficSelectorLocal.String(),
+			TrafficSelectorRemote: childSA.TrafficSelectorRemote.String(),
+			EnableEncapsulate:     childSA.EnableEncapsulate,
+			N3IWFPort:             childSA.N3IWFPort,
+			NATPort:               childSA.NATPort,
+			PDUSessionIds:         append([]int64(nil), childSA.PDUSessionIds...),
+			GREKeys:               maps.Clone(childSA.GREKeys),
+		}
+		info := childSA.Info(0)
+		summary.EncryptionAlgorithm = info.EncryptionAlgorithm
+		summary.EncryptionKeyLength = info.EncryptionKeyLength
+		summary.IntegrityAlgorithm = info.IntegrityAlgorithm
+		if childSA.XfrmIface != nil {
+			summary.XfrmInterface = childSA.XfrmIface.Attrs().Name
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].InboundSPI < summaries[j].InboundSPI
+	})
+	return summaries, nil
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/omec-project/n3iwf/logger"
+)
+
+// ErrUEIPPoolExhausted is returned when every inner IP address of the subnet is leased
+var ErrUEIPPoolExhausted = errors.New("UE inner IP address pool exhausted")
+
+// NewInternalUEIPAddr leases a free inner IP address of Subnet to ikeUe. The
+// lease is kept until ReleaseInternalUEIPAddr is called for the same IkeUE
+func (n3iwfCtx *N3IWFContext) NewInternalUEIPAddr(ikeUe *N3IWFIkeUe) (net.IP, error) {
+	first, size, err := ueIPPoolRange(n3iwfCtx.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("NewInternalUEIPAddr: %w", err)
+	}
+
+	// Start at a random offset and probe linearly, so a nearly full pool is
+	// still scanned exactly once before giving up
+	offset, err := rand.Int(rand.Reader, big.NewInt(int64(size)))
+	if err != nil {
+		return nil, fmt.Errorf("NewInternalUEIPAddr: %w", err)
+	}
+	start := uint32(offset.Uint64()) // #nosec G115
+	for i := range size {
+		ueIPAddr := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ueIPAddr, first+(start+i)%size)
+		if ueIPAddr.String() == n3iwfCtx.IpSecGatewayAddress {
+			continue
+		}
+		if _, loaded := n3iwfCtx.AllocatedUeIpAddress.LoadOrStore(ueIPAddr.String(), ikeUe); !loaded {
+			return ueIPAddr, nil
+		}
+	}
+	return nil, ErrUEIPPoolExhausted
+}
+
+// RenewInternalUEIPAddr renews the lease of the inner IP address of ikeUe,
+// leasing it again if it was released in the meantime. The address is never
+// changed, the child SAs of the UE being bound to it
+func (n3iwfCtx *N3IWFContext) RenewInternalUEIPAddr(ikeUe *N3IWFIkeUe) (net.IP, error) {
+	if ikeUe.IPSecInnerIP == nil {
+		return nil, errors.New("RenewInternalUEIPAddr: no inner IP address leased to the UE")
+	}
+	holder, loaded := n3iwfCtx.AllocatedUeIpAddress.LoadOrStore(ikeUe.IPSecInnerIP.String(), ikeUe)
+	if loaded && holder != ikeUe {
+		return nil, fmt.Errorf("RenewInternalUEIPAddr: %s is leased to another UE", ikeUe.IPSecInnerIP)
+	}
+	return ikeUe.IPSecInnerIP, nil
+}
+
+// ReleaseInternalUEIPAddr releases the lease of ipAddr if it is held by ikeUe,
+// and reports whether a lease was released
+func (n3iwfCtx *N3IWFContext) ReleaseInternalUEIPAddr(ikeUe *N3IWFIkeUe, ipAddr net.IP) bool {
+	if ipAddr == nil {
+		return false
+	}
+	if !n3iwfCtx.AllocatedUeIpAddress.CompareAndDelete(ipAddr.String(), ikeUe) {
+		logger.CtxLog.Warnf("IP(%s) is not leased to this IkeUE", ipAddr)
+		return false
+	}
+	return true
+}
+
+// ueIPPoolRange returns the first usable host address of an IPv4 subnet and
+// the number of usable addresses, excluding network and broadcast addresses
+func ueIPPoolRange(subnet *net.IPNet) (uint32, uint32, error) {
+	if subnet == nil || subnet.IP.To4() == nil {
+		return 0, 0, errors.New("UE IP subnet is not an IPv4 subnet")
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits != 8*net.IPv4len {
+		return 0, 0, errors.New("UE IP subnet mask is not an IPv4 mask")
+	}
+	network := binary.BigEndian.Uint32(subnet.IP.To4().Mask(subnet.Mask))
+	hostBits := bits - ones
+	if hostBits >= bits {
+		return 0, 0, errors.New("UE IP subnet is too large")
+	}
+	if hostBits < 2 {
+		// RFC 3021 point-to-point (/31) and host (/32) subnets have no reserved addresses
+		return network, uint32(1) << hostBits, nil
+	}
+	return network + 1, uint32(1)<<hostBits - 2, nil
+}
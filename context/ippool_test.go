@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func newIPPoolTestContext(t *testing.T, cidr, gateway string) *N3IWFContext {
+	t.Helper()
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("ParseCIDR failed: %v", err)
+	}
+	return &N3IWFContext{Subnet: subnet, IpSecGatewayAddress: gateway}
+}
+
+func TestNewInternalUEIPAddr(t *testing.T) {
+	// 10.0.0.0/29 has 6 host addresses, one of them is the gateway
+	n3iwfCtx := newIPPoolTestContext(t, "10.0.0.0/29", "10.0.0.1")
+
+	leased := make(map[string]bool)
+	for range 5 {
+		ikeUe := new(N3IWFIkeUe)
+		ip, err := n3iwfCtx.NewInternalUEIPAddr(ikeUe)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !n3iwfCtx.Subnet.Contains(ip) {
+			t.Errorf("leased IP %s is outside of subnet %s", ip, n3iwfCtx.Subnet)
+		}
+		switch ip.String() {
+		case "10.0.0.0", "10.0.0.7", "10.0.0.1":
+			t.Errorf("leased reserved IP %s", ip)
+		}
+		if leased[ip.String()] {
+			t.Errorf("IP %s leased twice", ip)
+		}
+		leased[ip.String()] = true
+		if owner, ok := n3iwfCtx.AllocatedUEIPAddressLoad(ip.String()); !ok || owner != ikeUe {
+			t.Errorf("lease of IP %s is not recorded for its IkeUE", ip)
+		}
+	}
+
+	if _, err := n3iwfCtx.NewInternalUEIPAddr(new(N3IWFIkeUe)); !errors.Is(err, ErrUEIPPoolExhausted) {
+		t.Errorf("Expected ErrUEIPPoolExhausted, got: %v", err)
+	}
+}
+
+func TestReleaseInternalUEIPAddr(t *testing.T) {
+	n3iwfCtx := newIPPoolTestContext(t, "10.0.0.0/30", "10.0.0.1")
+
+	ikeUe := new(N3IWFIkeUe)
+	ip, err := n3iwfCtx.NewInternalUEIPAddr(ikeUe)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := n3iwfCtx.NewInternalUEIPAddr(new(N3IWFIkeUe)); !errors.Is(err, ErrUEIPPoolExhausted) {
+		t.Fatalf("Expected ErrUEIPPoolExhausted, got: %v", err)
+	}
+
+	testcases := []struct {
+		description     string
+		ikeUe           *N3IWFIkeUe
+		ip              net.IP
+		expectedRelease bool
+	}{
+		{
+			description:     "nil IP",
+			ikeUe:           ikeUe,
+			expectedRelease: false,
+		},
+		{
+			description:     "lease held by another IkeUE",
+			ikeUe:           new(N3IWFIkeUe),
+			ip:              ip,
+			expectedRelease: false,
+		},
+		{
+			description:     "lease held by the IkeUE",
+			ikeUe:           ikeUe,
+			ip:              ip,
+			expectedRelease: true,
+		},
+		{
+			description:     "already released",
+			ikeUe:           ikeUe,
+			ip:              ip,
+			expectedRelease: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if got := n3iwfCtx.ReleaseInternalUEIPAddr(tc.ikeUe, tc.ip); got != tc.expectedRelease {
+				t.Errorf("release mismatch. got = %v, want = %v", got, tc.expectedRelease)
+			}
+		})
+	}
+
+	newUe := new(N3IWFIkeUe)
+	reused, err := n3iwfCtx.NewInternalUEIPAddr(newUe)
+	if err != nil {
+		t.Fatalf("Unexpected error after release: %v", err)
+	}
+	if !reused.Equal(ip) {
+		t.Errorf("reused IP mismatch. got = %s, want = %s", reused, ip)
+	}
+}
+
+func TestRenewInternalUEIPAddr(t *testing.T) {
+	n3iwfCtx := newIPPoolTestContext(t, "10.0.0.0/29", "10.0.0.1")
+
+	ikeUe := new(N3IWFIkeUe)
+	ip, err := n3iwfCtx.NewInternalUEIPAddr(ikeUe)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ikeUe.IPSecInnerIP = ip
+
+	testcases := []struct {
+		description string
+		prepare     func()
+		ikeUe       *N3IWFIkeUe
+		expectedErr bool
+	}{
+		{
+			description: "lease held by the IkeUE",
+			prepare:     func() {},
+			ikeUe:       ikeUe,
+		},
+		{
+			description: "lease released",
+			prepare:     func() { n3iwfCtx.ReleaseInternalUEIPAddr(ikeUe, ip) },
+			ikeUe:       ikeUe,
+		},
+		{
+			description: "lease held by another IkeUE",
+			prepare: func() {
+				n3iwfCtx.ReleaseInternalUEIPAddr(ikeUe, ip)
+				n3iwfCtx.AllocatedUeIpAddress.Store(ip.String(), new(N3IWFIkeUe))
+			},
+			ikeUe:       ikeUe,
+			expectedErr: true,
+		},
+		{
+			description: "no address",
+			prepare:     func() {},
+			ikeUe:       new(N3IWFIkeUe),
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			tc.prepare()
+			renewed, err := n3iwfCtx.RenewInternalUEIPAddr(tc.ikeUe)
+			if tc.expectedErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !renewed.Equal(ip) {
+				t.Errorf("renewed IP mismatch. got = %s, want = %s", renewed, ip)
+			}
+			if owner, ok := n3iwfCtx.AllocatedUEIPAddressLoad(ip.String()); !ok || owner != tc.ikeUe {
+				t.Errorf("lease of IP %s is not recorded for its IkeUE", ip)
+			}
+		})
+	}
+}
+
+func TestNewInternalUEIPAddrInvalidSubnet(t *testing.T) {
+	testcases := []struct {
+		description string
+		cidr        string
+	}{
+		{
+			description: "IPv6 subnet",
+			cidr:        "2001:db8::/64",
+		},
+		{
+			description: "whole address space",
+			cidr:        "0.0.0.0/0",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx := newIPPoolTestContext(t, tc.cidr, "")
+			if _, err := n3iwfCtx.NewInternalUEIPAddr(new(N3IWFIkeUe)); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
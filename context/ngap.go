@@ -6,6 +6,11 @@
 package context
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/ishidawataru/sctp"
 	"github.com/omec-project/ngap/v2/ngapType"
 )
@@ -17,6 +22,31 @@ type NgapServer struct {
 	RcvEventCh   chan NgapEvt
 }
 
+// ErrNgapEventChannelFull is returned when an NGAP event cannot be queued in time
+var ErrNgapEventChannelFull = errors.New("NGAP event channel is full")
+
+// SendEvent queues an event for the NGAP event handler. It waits at most
+// timeout for room in the channel; a non-positive timeout never blocks
+func (s *NgapServer) SendEvent(evt NgapEvt, timeout time.Duration) error {
+	if timeout <= 0 {
+		select {
+		case s.RcvEventCh <- evt:
+			return nil
+		default:
+			return ErrNgapEventChannelFull
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.RcvEventCh <- evt:
+		return nil
+	case <-timer.C:
+		return ErrNgapEventChannelFull
+	}
+}
+
 // NgapReceivePacket represents a received NGAP packet
 type NgapReceivePacket struct {
 	Conn *sctp.SCTPConn
@@ -53,6 +83,12 @@ const (
 	ErrRadioConnWithUeLost          = EvtError("RadioConnectionWithUeLost")
 	ErrTransportResourceUnavailable = EvtError("TransportResourceUnavailable")
 	ErrAMFSelection                 = EvtError("No available AMF for this UE")
+	ErrInitialUEQueueFull           = EvtError("Initial UE message queue full")
+	ErrNoAdditionalSAs              = EvtError("NoAdditionalSAs")
+	ErrChildSARejected              = EvtError("ChildSARejected")
+	ErrNoProposalChosen             = EvtError("NoProposalChosen")
+	ErrTSUnacceptable               = EvtError("TSUnacceptable")
+	ErrTemporaryFailure             = EvtError("TemporaryFailure")
 )
 
 // NgapEvt is the interface for all NGAP events
@@ -77,28 +113,30 @@ func NewUnmarshalEAP5GDataEvt(localSPI uint64, eapVendorData []byte, isInitialUE
 // SendInitialUEMessageEvt event
 type SendInitialUEMessageEvt struct {
 	RanUeNgapId int64
-	IPv4Addr    string
-	IPv4Port    int
+	IPAddr      string // Outer address of the UE, IPv4 or IPv6
+	Port        int
 	NasPDU      []byte
 }
 
 func (e *SendInitialUEMessageEvt) Type() NgapEventType { return SendInitialUEMessage }
 
-func NewSendInitialUEMessageEvt(ranUeNgapId int64, ipv4Addr string, ipv4Port int, nasPDU []byte) *SendInitialUEMessageEvt {
-	return &SendInitialUEMessageEvt{RanUeNgapId: ranUeNgapId, IPv4Addr: ipv4Addr, IPv4Port: ipv4Port, NasPDU: nasPDU}
+func NewSendInitialUEMessageEvt(ranUeNgapId int64, ipAddr string, port int, nasPDU []byte) *SendInitialUEMessageEvt {
+	return &SendInitialUEMessageEvt{RanUeNgapId: ranUeNgapId, IPAddr: ipAddr, Port: port, NasPDU: nasPDU}
 }
 
-// SendPDUSessionResourceSetupResEvt event
+// SendPDUSessionResourceSetupResEvt event, ChildSAs describe the child SAs
+// installed for the PDU sessions set up, if known
 type SendPDUSessionResourceSetupResEvt struct {
 	RanUeNgapId int64
+	ChildSAs    []ChildSAInfo
 }
 
 func (e *SendPDUSessionResourceSetupResEvt) Type() NgapEventType {
 	return SendPDUSessionResourceSetupResponse
 }
 
-func NewSendPDUSessionResourceSetupResEvt(ranUeNgapId int64) *SendPDUSessionResourceSetupResEvt {
-	return &SendPDUSessionResourceSetupResEvt{RanUeNgapId: ranUeNgapId}
+func NewSendPDUSessionResourceSetupResEvt(ranUeNgapId int64, childSAs []ChildSAInfo) *SendPDUSessionResourceSetupResEvt {
+	return &SendPDUSessionResourceSetupResEvt{RanUeNgapId: ranUeNgapId, ChildSAs: childSAs}
 }
 
 // SendNASMsgEvt event
@@ -173,16 +211,27 @@ func NewSendPDUSessionResourceReleaseResEvt(ranUeNgapId int64) *SendPDUSessionRe
 // Ngap context constant
 const CxtTempPDUSessionSetupData int64 = iota
 
+// NGAPContextRequest tells the IKE handler what a GetNGAPContext response is for
+type NGAPContextRequest uint8
+
+const (
+	// PDU sessions to set up once NAS signalling started over the CP child SA
+	NGAPContextPDUSessionSetup NGAPContextRequest = iota + 1
+	// Continuation of the CREATE_CHILD_SA exchange of a PDU session
+	NGAPContextCreateChildSA
+)
+
 // GetNGAPContextEvt event
 type GetNGAPContextEvt struct {
 	RanUeNgapId       int64
+	Token             uint64 // Echoed in the GetNGAPContextRepEvt
 	NgapCxtReqNumlist []int64
 }
 
 func (e *GetNGAPContextEvt) Type() NgapEventType { return GetNGAPContext }
 
-func NewGetNGAPContextEvt(ranUeNgapId int64, ngapCxtReqNumlist []int64) *GetNGAPContextEvt {
-	return &GetNGAPContextEvt{RanUeNgapId: ranUeNgapId, NgapCxtReqNumlist: ngapCxtReqNumlist}
+func NewGetNGAPContextEvt(ranUeNgapId int64, token uint64, ngapCxtReqNumlist []int64) *GetNGAPContextEvt {
+	return &GetNGAPContextEvt{RanUeNgapId: ranUeNgapId, Token: token, NgapCxtReqNumlist: ngapCxtReqNumlist}
 }
 
 // SendUplinkNASTransportEvt event
@@ -243,3 +292,38 @@ func (e *SendPDUSessionResourceReleaseEvt) Type() NgapEventType { return SendPDU
 func NewSendPDUSessionResourceReleaseEvt(ranUeNgapId int64, deletePduIds []int64) *SendPDUSessionResourceReleaseEvt {
 	return &SendPDUSessionResourceReleaseEvt{RanUeNgapId: ranUeNgapId, DeletePduIds: deletePduIds}
 }
+
+// ANParameters are the Access Network parameters of a 5G-NAS message of the
+// UE, TS 24.502 section 9.3.2.2.2, see message.UnmarshalEAP5GData
+type ANParameters struct {
+	GUAMI              *ngapType.GUAMI
+	SelectedPLMNID     *ngapType.PLMNIdentity
+	RequestedNSSAI     *ngapType.AllowedNSSAI
+	EstablishmentCause *ngapType.RRCEstablishmentCause
+}
+
+func (p *ANParameters) String() string {
+	var fields []string
+	if p.GUAMI != nil {
+		fields = append(fields, fmt.Sprintf("GUAMI: PLMN ID %x AMF region %x set %x pointer %x", p.GUAMI.PLMNIdentity.Value,
+			p.GUAMI.AMFRegionID.Value.Bytes, p.GUAMI.AMFSetID.Value.Bytes, p.GUAMI.AMFPointer.Value.Bytes))
+	}
+	if p.SelectedPLMNID != nil {
+		fields = append(fields, fmt.Sprintf("selected PLMN ID: %x", p.SelectedPLMNID.Value))
+	}
+	if p.RequestedNSSAI != nil {
+		nssai := make([]string, 0, len(p.RequestedNSSAI.List))
+		for _, item := range p.RequestedNSSAI.List {
+			if item.SNSSAI.SD == nil {
+				nssai = append(nssai, fmt.Sprintf("SST %x", item.SNSSAI.SST.Value))
+			} else {
+				nssai = append(nssai, fmt.Sprintf("SST %x SD %x", item.SNSSAI.SST.Value, item.SNSSAI.SD.Value))
+			}
+		}
+		fields = append(fields, "requested NSSAI: ["+strings.Join(nssai, ", ")+"]")
+	}
+	if p.EstablishmentCause != nil {
+		fields = append(fields, fmt.Sprintf("establishment cause: %d", p.EstablishmentCause.Value))
+	}
+	return strings.Join(fields, ", ")
+}
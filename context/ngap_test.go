@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNgapServerSendEventFullChannel(t *testing.T) {
+	testcases := []struct {
+		description string
+		timeout     time.Duration
+	}{
+		{
+			description: "non-blocking send",
+			timeout:     0,
+		},
+		{
+			description: "send with timeout",
+			timeout:     50 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			server := &NgapServer{RcvEventCh: make(chan NgapEvt, 1)}
+			if err := server.SendEvent(NewSendNASMsgEvt(1), tc.timeout); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- server.SendEvent(NewSendNASMsgEvt(2), tc.timeout)
+			}()
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, ErrNgapEventChannelFull) {
+					t.Errorf("Expected ErrNgapEventChannelFull, got: %v", err)
+				}
+			case <-time.After(tc.timeout + time.Second):
+				t.Fatal("SendEvent blocked on a full channel")
+			}
+		})
+	}
+}
+
+func TestSendNgapEvent(t *testing.T) {
+	n3iwfCtx := &N3IWFContext{
+		NgapServer:       &NgapServer{RcvEventCh: make(chan NgapEvt, 1)},
+		NgapEventTimeout: 10 * time.Millisecond,
+	}
+
+	if err := n3iwfCtx.SendNgapEvent(NewStartTCPSignalNASMsgEvt(1)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := n3iwfCtx.SendNgapEvent(NewStartTCPSignalNASMsgEvt(2)); !errors.Is(err, ErrNgapEventChannelFull) {
+		t.Errorf("Expected ErrNgapEventChannelFull, got: %v", err)
+	}
+
+	evt := <-n3iwfCtx.NgapServer.RcvEventCh
+	if evt.(*StartTCPSignalNASMsgEvt).RanUeNgapId != 1 {
+		t.Errorf("Unexpected event queued: %+v", evt)
+	}
+}
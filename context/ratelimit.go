@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Interval at which the idle buckets are pruned
+	rateLimitPruneInterval = 10 * time.Second
+	// Number of tracked sources beyond which a new source evicts a random one,
+	// bounding the memory spent on spoofed source addresses
+	rateLimitMaxSources = 65536
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// InitRateLimiter is a token bucket per source IP address bounding how often a
+// UE can start IKE_SA_INIT. A nil limiter allows everything
+type InitRateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64
+
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	maxSources int
+	pruned     time.Time // Last pruning of the idle buckets
+	dropped    atomic.Uint64
+	now        func() time.Time
+}
+
+// NewInitRateLimiter returns a limiter allowing rate attempts per second from
+// each source, with bursts of up to burst attempts
+func NewInitRateLimiter(rate float64, burst int) *InitRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &InitRateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		buckets:    make(map[string]*tokenBucket),
+		maxSources: rateLimitMaxSources,
+		now:        time.Now,
+	}
+}
+
+// Allow consumes a token of the source bucket and reports whether the attempt
+// may proceed. Denied attempts are counted
+func (l *InitRateLimiter) Allow(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	key := ip.String()
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) >= rateLimitPruneInterval {
+		l.prune(now)
+		l.pruned = now
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.maxSources {
+			l.evict()
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens < 1 {
+		l.dropped.Add(1)
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Dropped returns the number of attempts denied so far
+func (l *InitRateLimiter) Dropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
+
+// prune forgets the sources whose bucket has refilled, as they behave the same as unknown ones
+func (l *InitRateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// evict forgets a random source, the iteration order of maps being random
+func (l *InitRateLimiter) evict() {
+	for key := range l.buckets {
+		delete(l.buckets, key)
+		return
+	}
+}
@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInitRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewInitRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	ueA := net.ParseIP("192.168.0.10")
+	ueB := net.ParseIP("192.168.0.20")
+
+	for i := range 3 {
+		if !limiter.Allow(ueA) {
+			t.Fatalf("attempt %d within burst denied", i)
+		}
+	}
+	if limiter.Allow(ueA) {
+		t.Error("Expected attempt beyond burst to be denied")
+	}
+	if !limiter.Allow(ueB) {
+		t.Error("Expected another source to have its own bucket")
+	}
+	if got := limiter.Dropped(); got != 1 {
+		t.Errorf("dropped count mismatch. got = %d, want = 1", got)
+	}
+
+	// Two tokens per second: one token after 500ms
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow(ueA) {
+		t.Error("Expected attempt to be allowed after refill")
+	}
+	if limiter.Allow(ueA) {
+		t.Error("Expected attempt to be denied once refilled token is used")
+	}
+	if got := limiter.Dropped(); got != 2 {
+		t.Errorf("dropped count mismatch. got = %d, want = 2", got)
+	}
+}
+
+func TestInitRateLimiterPrune(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewInitRateLimiter(1, 1)
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow(net.ParseIP("10.0.0.1"))
+	now = now.Add(2 * time.Second)
+	limiter.prune(now)
+	if len(limiter.buckets) != 0 {
+		t.Errorf("bucket count mismatch. got = %d, want = 0", len(limiter.buckets))
+	}
+}
+
+func TestInitRateLimiterPruneInterval(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewInitRateLimiter(1, 1)
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow(net.ParseIP("10.0.0.1"))
+	now = now.Add(2 * time.Second)
+	// Refilled but not pruned before the interval
+	limiter.Allow(net.ParseIP("10.0.0.2"))
+	if len(limiter.buckets) != 2 {
+		t.Errorf("bucket count mismatch. got = %d, want = 2", len(limiter.buckets))
+	}
+	now = now.Add(rateLimitPruneInterval)
+	limiter.Allow(net.ParseIP("10.0.0.3"))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("bucket count mismatch. got = %d, want = 1", len(limiter.buckets))
+	}
+}
+
+func TestInitRateLimiterMaxSources(t *testing.T) {
+	limiter := NewInitRateLimiter(1, 1)
+	limiter.maxSources = 2
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if !limiter.Allow(net.ParseIP(ip)) {
+			t.Errorf("first attempt of %s denied", ip)
+		}
+	}
+	if len(limiter.buckets) != 2 {
+		t.Errorf("bucket count mismatch. got = %d, want = 2", len(limiter.buckets))
+	}
+	if _, ok := limiter.buckets["10.0.0.3"]; !ok {
+		t.Error("bucket of the new source not tracked")
+	}
+}
+
+func TestNilInitRateLimiter(t *testing.T) {
+	limiter := NewInitRateLimiter(0, 10)
+	if limiter != nil {
+		t.Fatal("Expected nil limiter when rate is not set")
+	}
+	if !limiter.Allow(net.ParseIP("10.0.0.1")) || limiter.Dropped() != 0 {
+		t.Error("Expected nil limiter to allow everything")
+	}
+}
@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// RedirectSelector picks the gateway (IP address or FQDN) a UE is redirected
+// to when this N3IWF is overloaded (RFC 5685)
+type RedirectSelector interface {
+	SelectGateway(ueAddr *net.UDPAddr) (string, bool)
+}
+
+// RoundRobinRedirectSelector cycles through a static list of gateways
+type RoundRobinRedirectSelector struct {
+	Gateways []string
+	next     atomic.Uint32
+}
+
+func (s *RoundRobinRedirectSelector) SelectGateway(ueAddr *net.UDPAddr) (string, bool) {
+	if len(s.Gateways) == 0 {
+		return "", false
+	}
+	idx := (s.next.Add(1) - 1) % uint32(len(s.Gateways))
+	return s.Gateways[idx], true
+}
+
+// IKESACount returns the number of IKE SAs currently held by the N3IWF
+func (n3iwfCtx *N3IWFContext) IKESACount() int {
+	return int(n3iwfCtx.ikeSAs.Load())
+}
+
+// AdmitIKESA reports whether one more IKE SA may be created without
+// exceeding MaxIKESAs, counting the refusals
+func (n3iwfCtx *N3IWFContext) AdmitIKESA() bool {
+	if n3iwfCtx.MaxIKESAs <= 0 || n3iwfCtx.IKESACount() < n3iwfCtx.MaxIKESAs {
+		return true
+	}
+	n3iwfCtx.ikeSACapRejected.Add(1)
+	return false
+}
+
+// IKESACapRejections returns the number of IKE_SA_INIT requests refused by
+// AdmitIKESA
+func (n3iwfCtx *N3IWFContext) IKESACapRejections() uint64 {
+	return n3iwfCtx.ikeSACapRejected.Load()
+}
+
+// RedirectTarget returns the gateway the UE should be redirected to, if the
+// number of active IKE SAs has reached RedirectThreshold
+func (n3iwfCtx *N3IWFContext) RedirectTarget(ueAddr *net.UDPAddr) (string, bool) {
+	if n3iwfCtx.RedirectSelector == nil || n3iwfCtx.RedirectThreshold <= 0 {
+		return "", false
+	}
+	if n3iwfCtx.IKESACount() < n3iwfCtx.RedirectThreshold {
+		return "", false
+	}
+	return n3iwfCtx.RedirectSelector.SelectGateway(ueAddr)
+}
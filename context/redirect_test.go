@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"testing"
+)
+
+func TestRedirectTarget(t *testing.T) {
+	n3iwfCtx := &N3IWFContext{
+		RedirectThreshold: 2,
+		RedirectSelector:  &RoundRobinRedirectSelector{Gateways: []string{"10.0.0.2", "n3iwf2.example.org"}},
+	}
+
+	n3iwfCtx.NewIKESecurityAssociation()
+	if _, ok := n3iwfCtx.RedirectTarget(nil); ok {
+		t.Error("Expected no redirect below the threshold")
+	}
+
+	n3iwfCtx.NewIKESecurityAssociation()
+	expected := []string{"10.0.0.2", "n3iwf2.example.org", "10.0.0.2"}
+	for i, exp := range expected {
+		gateway, ok := n3iwfCtx.RedirectTarget(nil)
+		if !ok {
+			t.Fatalf("Expected redirect at round %d", i)
+		}
+		if gateway != exp {
+			t.Errorf("gateway mismatch at round %d. got = %s, want = %s", i, gateway, exp)
+		}
+	}
+
+	n3iwfCtx.RedirectSelector = nil
+	if _, ok := n3iwfCtx.RedirectTarget(nil); ok {
+		t.Error("Expected no redirect without a selector")
+	}
+}
+
+func TestAdmitIKESA(t *testing.T) {
+	n3iwfCtx := &N3IWFContext{}
+	first := n3iwfCtx.NewIKESecurityAssociation()
+	n3iwfCtx.NewIKESecurityAssociation()
+	if !n3iwfCtx.AdmitIKESA() {
+		t.Error("Expected admission without a cap")
+	}
+
+	n3iwfCtx.MaxIKESAs = 3
+	if !n3iwfCtx.AdmitIKESA() {
+		t.Error("Expected admission below the cap")
+	}
+	n3iwfCtx.NewIKESecurityAssociation()
+	for range 2 {
+		if n3iwfCtx.AdmitIKESA() {
+			t.Error("Expected refusal at the cap")
+		}
+	}
+	if got := n3iwfCtx.IKESACapRejections(); got != 2 {
+		t.Errorf("rejection count mismatch. got = %d, want = 2", got)
+	}
+
+	n3iwfCtx.DeleteIKESecurityAssociation(first.LocalSPI)
+	n3iwfCtx.DeleteIKESecurityAssociation(first.LocalSPI)
+	if got := n3iwfCtx.IKESACount(); got != 2 {
+		t.Errorf("IKE SA count mismatch. got = %d, want = 2", got)
+	}
+	if !n3iwfCtx.AdmitIKESA() {
+		t.Error("Expected admission once an IKE SA is deleted")
+	}
+}
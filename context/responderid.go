@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// Responder identity types accepted in the configuration
+const (
+	ResponderIDFQDN       = "fqdn"
+	ResponderIDRFC822Addr = "rfc822"
+	ResponderIDDERASN1DN  = "dn"
+)
+
+// ResponderIdentity is an identity the N3IWF authenticates as, with the
+// certificate (DER) and private key proving it
+type ResponderIdentity struct {
+	IDType      uint8
+	IDData      []byte
+	Certificate []byte
+	PrivateKey  crypto.Signer
+}
+
+// Matches reports whether the identity is the one the UE expects in its IDr
+func (identity *ResponderIdentity) Matches(idr *message.IdentificationResponder) bool {
+	if idr == nil || idr.IDType != identity.IDType {
+		return false
+	}
+	if identity.IDType == message.ID_FQDN {
+		return strings.EqualFold(string(idr.IDData), string(identity.IDData))
+	}
+	return bytes.Equal(idr.IDData, identity.IDData)
+}
+
+// SelectResponderIdentity returns the configured identity matching the IDr
+// sent by the UE, or the default identity if the UE sent none or an unknown one
+func (n3iwfCtx *N3IWFContext) SelectResponderIdentity(idr *message.IdentificationResponder) *ResponderIdentity {
+	for _, identity := range n3iwfCtx.ResponderIdentities {
+		if identity.Matches(idr) {
+			return identity
+		}
+	}
+	return &ResponderIdentity{
+		IDType:      n3iwfCtx.ResponderIDType,
+		IDData:      n3iwfCtx.ResponderIDData,
+		Certificate: n3iwfCtx.N3iwfCertificate,
+		PrivateKey:  n3iwfCtx.N3iwfPrivateKey,
+	}
+}
+
+// Object identifiers of the DN attributes accepted in a configured DN
+var dnAttributeOIDs = map[string]asn1.ObjectIdentifier{
+	"C":            {2, 5, 4, 6},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"CN":           {2, 5, 4, 3},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"SERIALNUMBER": {2, 5, 4, 5},
+}
+
+// ParseResponderID returns the IKEv2 identification type and data announced
+// in IDr. An empty type selects ID_FQDN. An empty value defaults to fqdn for
+// ID_FQDN and to the subject of certificate (DER) for ID_DER_ASN1_DN. A DN
+// value is a comma separated list of attributes such as "CN=n3iwf,O=Aether",
+// most significant attribute last as in RFC 4514, without escaped characters
+func ParseResponderID(idType, value, fqdn string, certificate []byte) (uint8, []byte, error) {
+	switch strings.ToLower(idType) {
+	case "", ResponderIDFQDN:
+		if value == "" {
+			value = fqdn
+		}
+		if value == "" {
+			return 0, nil, fmt.Errorf("ParseResponderID: empty FQDN")
+		}
+		return message.ID_FQDN, []byte(value), nil
+	case ResponderIDRFC822Addr:
+		address, err := mail.ParseAddress(value)
+		if err != nil || address.Name != "" || address.Address != value {
+			return 0, nil, fmt.Errorf("ParseResponderID: invalid RFC 822 address %q", value)
+		}
+		return message.ID_RFC822_ADDR, []byte(value), nil
+	case ResponderIDDERASN1DN:
+		if value == "" {
+			cert, err := x509.ParseCertificate(certificate)
+			if err != nil {
+				return 0, nil, fmt.Errorf("ParseResponderID: %w", err)
+			}
+			return message.ID_DER_ASN1_DN, cert.RawSubject, nil
+		}
+		dn, err := marshalDN(value)
+		if err != nil {
+			return 0, nil, fmt.Errorf("ParseResponderID: %w", err)
+		}
+		return message.ID_DER_ASN1_DN, dn, nil
+	default:
+		return 0, nil, fmt.Errorf("ParseResponderID: unsupported identity type %q", idType)
+	}
+}
+
+func marshalDN(value string) ([]byte, error) {
+	parts := strings.Split(value, ",")
+	var rdns pkix.RDNSequence
+	// RFC 4514 lists the attributes in reverse order of the encoding
+	for i := len(parts) - 1; i >= 0; i-- {
+		key, attrValue, found := strings.Cut(strings.TrimSpace(parts[i]), "=")
+		if !found || attrValue == "" {
+			return nil, fmt.Errorf("invalid DN attribute %q", parts[i])
+		}
+		oid, ok := dnAttributeOIDs[strings.ToUpper(strings.TrimSpace(key))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported DN attribute %q", key)
+		}
+		rdns = append(rdns, pkix.RelativeDistinguishedNameSET{
+			{Type: oid, Value: strings.TrimSpace(attrValue)},
+		})
+	}
+	return asn1.Marshal(rdns)
+}
@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestParseResponderID(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	subject := pkix.Name{Country: []string{"US"}, Organization: []string{"Aether"}, CommonName: "n3iwf"}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certificate)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		description string
+		idType      string
+		value       string
+		expType     uint8
+		expData     []byte
+		expErr      bool
+	}{
+		{
+			description: "default to FQDN",
+			expType:     message.ID_FQDN,
+			expData:     []byte("n3iwf.aether.org"),
+		},
+		{
+			description: "explicit FQDN",
+			idType:      "fqdn",
+			value:       "gw.aether.org",
+			expType:     message.ID_FQDN,
+			expData:     []byte("gw.aether.org"),
+		},
+		{
+			description: "RFC 822 address",
+			idType:      "rfc822",
+			value:       "n3iwf@aether.org",
+			expType:     message.ID_RFC822_ADDR,
+			expData:     []byte("n3iwf@aether.org"),
+		},
+		{
+			description: "invalid RFC 822 address",
+			idType:      "rfc822",
+			value:       "n3iwf",
+			expErr:      true,
+		},
+		{
+			description: "DN from certificate",
+			idType:      "dn",
+			expType:     message.ID_DER_ASN1_DN,
+			expData:     cert.RawSubject,
+		},
+		{
+			description: "configured DN",
+			idType:      "DN",
+			value:       "CN=n3iwf, O=Aether, C=US",
+			expType:     message.ID_DER_ASN1_DN,
+			expData:     cert.RawSubject,
+		},
+		{
+			description: "unsupported DN attribute",
+			idType:      "dn",
+			value:       "UID=n3iwf",
+			expErr:      true,
+		},
+		{
+			description: "unsupported type",
+			idType:      "ipv4",
+			value:       "10.0.0.1",
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			idType, idData, err := ParseResponderID(tc.idType, tc.value, "n3iwf.aether.org", certificate)
+			if tc.expErr {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if idType != tc.expType {
+				t.Errorf("ID type mismatch. got = %d, want = %d", idType, tc.expType)
+			}
+			if !bytes.Equal(idData, tc.expData) {
+				t.Errorf("ID data mismatch. got = %x, want = %x", idData, tc.expData)
+			}
+		})
+	}
+}
+
+func TestSelectResponderIdentity(t *testing.T) {
+	n3iwfCtx := &N3IWFContext{
+		ResponderIDType:  message.ID_FQDN,
+		ResponderIDData:  []byte("n3iwf.aether.org"),
+		N3iwfCertificate: []byte("default certificate"),
+	}
+	operatorA := &ResponderIdentity{
+		IDType:      message.ID_FQDN,
+		IDData:      []byte("n3iwf.operator-a.org"),
+		Certificate: []byte("operator A certificate"),
+	}
+	operatorB := &ResponderIdentity{
+		IDType:      message.ID_FQDN,
+		IDData:      []byte("n3iwf.operator-b.org"),
+		Certificate: []byte("operator B certificate"),
+	}
+	n3iwfCtx.ResponderIdentities = []*ResponderIdentity{operatorA, operatorB}
+
+	testcases := []struct {
+		description    string
+		idr            *message.IdentificationResponder
+		expCertificate []byte
+	}{
+		{
+			description:    "no IDr",
+			expCertificate: n3iwfCtx.N3iwfCertificate,
+		},
+		{
+			description:    "IDr selects first identity",
+			idr:            &message.IdentificationResponder{IDType: message.ID_FQDN, IDData: []byte("n3iwf.operator-a.org")},
+			expCertificate: operatorA.Certificate,
+		},
+		{
+			description:    "IDr selects second identity, case insensitive",
+			idr:            &message.IdentificationResponder{IDType: message.ID_FQDN, IDData: []byte("N3IWF.Operator-B.org")},
+			expCertificate: operatorB.Certificate,
+		},
+		{
+			description:    "unknown IDr",
+			idr:            &message.IdentificationResponder{IDType: message.ID_FQDN, IDData: []byte("n3iwf.operator-c.org")},
+			expCertificate: n3iwfCtx.N3iwfCertificate,
+		},
+		{
+			description:    "IDr of another type",
+			idr:            &message.IdentificationResponder{IDType: message.ID_RFC822_ADDR, IDData: []byte("n3iwf.operator-a.org")},
+			expCertificate: n3iwfCtx.N3iwfCertificate,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			identity := n3iwfCtx.SelectResponderIdentity(tc.idr)
+			if !bytes.Equal(identity.Certificate, tc.expCertificate) {
+				t.Errorf("certificate mismatch. got = %s, want = %s", identity.Certificate, tc.expCertificate)
+			}
+		})
+	}
+}
@@ -53,3 +53,65 @@ func (t *Timer) Stop() {
 		t.cancel()
 	}
 }
+
+// RetransmitTimer resends a request initiated by the N3IWF until the UE
+// answers it, see NewRetransmitTimer
+type RetransmitTimer struct {
+	ikeSA       *IKESecurityAssociation
+	timer       *time.Timer
+	interval    time.Duration
+	attempts    int
+	maxAttempts int
+	retransmit  func()
+	giveUp      func()
+	stopped     bool // Guarded by the lock of the SA
+}
+
+// NewRetransmitTimer calls retransmit after interval, then after twice as
+// long each time, until the timer is stopped. giveUp is called instead once
+// maxAttempts retransmissions went unanswered. Both run with ikeSA locked, and
+// the timer must be created and stopped with ikeSA locked
+func NewRetransmitTimer(ikeSA *IKESecurityAssociation, interval time.Duration, maxAttempts int,
+	retransmit, giveUp func(),
+) *RetransmitTimer {
+	t := &RetransmitTimer{
+		ikeSA:       ikeSA,
+		interval:    interval,
+		maxAttempts: maxAttempts,
+		retransmit:  retransmit,
+		giveUp:      giveUp,
+	}
+	t.timer = time.AfterFunc(interval, t.expire)
+	return t
+}
+
+func (t *RetransmitTimer) expire() {
+	t.ikeSA.Lock()
+	defer t.ikeSA.Unlock()
+	if t.stopped {
+		return
+	}
+	if t.attempts >= t.maxAttempts {
+		t.stopped = true
+		t.giveUp()
+		return
+	}
+	t.attempts++
+	t.retransmit()
+	t.interval *= 2
+	t.timer.Reset(t.interval)
+}
+
+// Attempts returns the number of retransmissions sent so far
+func (t *RetransmitTimer) Attempts() int {
+	return t.attempts
+}
+
+// Stop cancels the retransmissions. A nil timer is ignored
+func (t *RetransmitTimer) Stop() {
+	if t == nil {
+		return
+	}
+	t.stopped = true
+	t.timer.Stop()
+}
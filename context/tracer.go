@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/logger"
+)
+
+// TraceDirection tells whether a traced IKE message was received or sent
+type TraceDirection uint8
+
+const (
+	TraceInbound TraceDirection = iota
+	TraceOutbound
+)
+
+func (d TraceDirection) String() string {
+	if d == TraceOutbound {
+		return "out"
+	}
+	return "in"
+}
+
+// IKETraceRecord describes one IKE message as seen in clear by the N3IWF:
+// after decryption for inbound messages, before encryption for outbound ones
+type IKETraceRecord struct {
+	Direction    TraceDirection
+	LocalAddr    *net.UDPAddr
+	RemoteAddr   *net.UDPAddr
+	InitiatorSPI uint64
+	ResponderSPI uint64
+	ExchangeType uint8
+	MessageID    uint32
+	IsResponse   bool
+	PayloadTypes []message.IKEPayloadType
+}
+
+// IKETracer receives every parsed IKE message exchanged with UEs. It is
+// called from the IKE event loop and must not block
+type IKETracer interface {
+	TraceIKEMessage(record *IKETraceRecord)
+}
+
+// NewIKETraceRecord summarizes ikeMsg. It must be called before the payloads
+// of an outbound message are replaced by the SK payload
+func NewIKETraceRecord(direction TraceDirection, localAddr, remoteAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage,
+) *IKETraceRecord {
+	record := &IKETraceRecord{
+		Direction:  direction,
+		LocalAddr:  localAddr,
+		RemoteAddr: remoteAddr,
+	}
+	if ikeMsg.IKEHeader != nil {
+		record.InitiatorSPI = ikeMsg.InitiatorSPI
+		record.ResponderSPI = ikeMsg.ResponderSPI
+		record.ExchangeType = ikeMsg.ExchangeType
+		record.MessageID = ikeMsg.MessageID
+		record.IsResponse = ikeMsg.IsResponse()
+	}
+	for _, payload := range ikeMsg.Payloads {
+		record.PayloadTypes = append(record.PayloadTypes, payload.Type())
+	}
+	return record
+}
+
+// TraceIKEMessage passes ikeMsg to the configured tracer, if any
+func (n3iwfCtx *N3IWFContext) TraceIKEMessage(direction TraceDirection, localAddr, remoteAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage,
+) {
+	if n3iwfCtx.IKETracer == nil || ikeMsg == nil {
+		return
+	}
+	n3iwfCtx.IKETracer.TraceIKEMessage(NewIKETraceRecord(direction, localAddr, remoteAddr, ikeMsg))
+}
+
+// LogIKETracer writes one structured log line per IKE message
+type LogIKETracer struct{}
+
+func (LogIKETracer) TraceIKEMessage(record *IKETraceRecord) {
+	logger.IKELog.Infow("IKE message",
+		"direction", record.Direction.String(),
+		"local", addrString(record.LocalAddr),
+		"remote", addrString(record.RemoteAddr),
+		"ispi", strconv.FormatUint(record.InitiatorSPI, 16),
+		"rspi", strconv.FormatUint(record.ResponderSPI, 16),
+		"exchange", exchangeTypeName(record.ExchangeType),
+		"messageId", record.MessageID,
+		"response", record.IsResponse,
+		"payloads", payloadTypeNames(record.PayloadTypes),
+	)
+}
+
+func addrString(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func exchangeTypeName(exchangeType uint8) string {
+	switch exchangeType {
+	case message.IKE_SA_INIT:
+		return "IKE_SA_INIT"
+	case message.IKE_AUTH:
+		return "IKE_AUTH"
+	case message.CREATE_CHILD_SA:
+		return "CREATE_CHILD_SA"
+	case message.INFORMATIONAL:
+		return "INFORMATIONAL"
+	default:
+		return strconv.Itoa(int(exchangeType))
+	}
+}
+
+// Payload type names as in RFC 7296 section 3.2
+var payloadTypeName = map[message.IKEPayloadType]string{
+	message.TypeSA:      "SA",
+	message.TypeKE:      "KE",
+	message.TypeIDi:     "IDi",
+	message.TypeIDr:     "IDr",
+	message.TypeCERT:    "CERT",
+	message.TypeCERTreq: "CERTREQ",
+	message.TypeAUTH:    "AUTH",
+	message.TypeNiNr:    "Nonce",
+	message.TypeN:       "N",
+	message.TypeD:       "D",
+	message.TypeV:       "V",
+	message.TypeTSi:     "TSi",
+	message.TypeTSr:     "TSr",
+	message.TypeSK:      "SK",
+	message.TypeCP:      "CP",
+	message.TypeEAP:     "EAP",
+}
+
+func payloadTypeString(payloadType message.IKEPayloadType) string {
+	if name, ok := payloadTypeName[payloadType]; ok {
+		return name
+	}
+	return strconv.Itoa(int(payloadType))
+}
+
+func payloadTypeNames(types []message.IKEPayloadType) []string {
+	names := make([]string, 0, len(types))
+	for _, payloadType := range types {
+		names = append(names, payloadTypeString(payloadType))
+	}
+	return names
+}
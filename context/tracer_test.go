@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+type recordingTracer struct {
+	records []*IKETraceRecord
+}
+
+func (r *recordingTracer) TraceIKEMessage(record *IKETraceRecord) {
+	r.records = append(r.records, record)
+}
+
+func TestTraceIKEMessage(t *testing.T) {
+	localAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 500}
+	remoteAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 500}
+	ikeMsg := message.NewMessage(0x1111, 0x2222, message.IKE_AUTH, true, false, 4, nil)
+	ikeMsg.Payloads.BuildIdentificationResponder(message.ID_FQDN, []byte("n3iwf"))
+	ikeMsg.Payloads.BuildNotification(message.TypeNone, message.MOBIKE_SUPPORTED, nil, nil)
+	ikeMsg.Payloads.BuildEAP5GStart(1)
+
+	n3iwfCtx := &N3IWFContext{}
+	// No tracer configured
+	n3iwfCtx.TraceIKEMessage(TraceInbound, localAddr, remoteAddr, ikeMsg)
+
+	tracer := &recordingTracer{}
+	n3iwfCtx.IKETracer = tracer
+	n3iwfCtx.TraceIKEMessage(TraceOutbound, localAddr, remoteAddr, ikeMsg)
+	if len(tracer.records) != 1 {
+		t.Fatalf("record count mismatch. got = %d, want = 1", len(tracer.records))
+	}
+	record := tracer.records[0]
+	if record.Direction != TraceOutbound || record.Direction.String() != "out" {
+		t.Errorf("direction mismatch. got = %v, want = out", record.Direction)
+	}
+	if record.LocalAddr != localAddr || record.RemoteAddr != remoteAddr {
+		t.Errorf("address mismatch. got = %s/%s, want = %s/%s", record.LocalAddr, record.RemoteAddr, localAddr, remoteAddr)
+	}
+	if record.InitiatorSPI != 0x1111 || record.ResponderSPI != 0x2222 {
+		t.Errorf("SPI mismatch. got = %x/%x, want = 1111/2222", record.InitiatorSPI, record.ResponderSPI)
+	}
+	if record.ExchangeType != message.IKE_AUTH || record.MessageID != 4 || !record.IsResponse {
+		t.Errorf("header mismatch. got = %+v", record)
+	}
+	expTypes := []message.IKEPayloadType{message.TypeIDr, message.TypeN, message.TypeEAP}
+	if !slices.Equal(record.PayloadTypes, expTypes) {
+		t.Errorf("payload types mismatch. got = %v, want = %v", record.PayloadTypes, expTypes)
+	}
+	expNames := []string{"IDr", "N", "EAP"}
+	if names := payloadTypeNames(record.PayloadTypes); !slices.Equal(names, expNames) {
+		t.Errorf("payload names mismatch. got = %v, want = %v", names, expNames)
+	}
+
+	// Must not panic on a message without payloads
+	LogIKETracer{}.TraceIKEMessage(NewIKETraceRecord(TraceInbound, nil, nil, &message.IKEMessage{}))
+}
@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/omec-project/n3iwf/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Netlink call reading the counters of a XFRM state, replaced in tests
+var xfrmStateGet = netlink.XfrmStateGet
+
+// ChildSATraffic is the traffic of a child SA, counted by its XFRM states
+type ChildSATraffic struct {
+	LocalSPI        string  `json:"localSpi"` // Of the IKE SA
+	InboundSPI      string  `json:"inboundSpi"`
+	PDUSessionIds   []int64 `json:"pduSessionIds,omitempty"`
+	InboundBytes    uint64  `json:"inboundBytes"`
+	InboundPackets  uint64  `json:"inboundPackets"`
+	OutboundBytes   uint64  `json:"outboundBytes"`
+	OutboundPackets uint64  `json:"outboundPackets"`
+	// A XFRM state is no longer in the kernel, its counters are left to 0
+	Removed bool `json:"removed,omitempty"`
+}
+
+// TrafficSnapshot is the traffic of the child SAs, keyed by UE identity or by
+// IKE SA SPI for the UEs without identity
+type TrafficSnapshot struct {
+	Updated time.Time                   `json:"updated"`
+	UEs     map[string][]ChildSATraffic `json:"ues"`
+}
+
+// childSATrafficSource is what is needed to read the counters of a child SA,
+// copied with its IKE SA locked
+type childSATrafficSource struct {
+	ueKey   string
+	traffic ChildSATraffic
+	spi     uint32
+	states  []netlink.XfrmState
+}
+
+// RefreshTraffic reads the counters of the XFRM states of every child SA and
+// keeps them for Traffic
+func (n3iwfCtx *N3IWFContext) RefreshTraffic() {
+	var sources []childSATrafficSource
+	n3iwfCtx.IkeSA.Range(func(key, value any) bool {
+		ikeSA, ok := value.(*IKESecurityAssociation)
+		if !ok {
+			return true
+		}
+		ikeSA.Lock()
+		defer ikeSA.Unlock()
+		if ikeSA.IkeUE == nil {
+			return true
+		}
+		localSPI := fmt.Sprintf("%016x", ikeSA.LocalSPI)
+		ueKey := ikeSA.UEIdentity()
+		if ueKey == "" {
+			ueKey = localSPI
+		}
+		for _, childSA := range ikeSA.IkeUE.N3IWFChildSecurityAssociation {
+			sources = append(sources, childSATrafficSource{
+				ueKey: ueKey,
+				traffic: ChildSATraffic{
+					LocalSPI:      localSPI,
+					InboundSPI:    fmt.Sprintf("%08x", childSA.InboundSPI),
+					PDUSessionIds: append([]int64(nil), childSA.PDUSessionIds...),
+				},
+				spi:    childSA.InboundSPI,
+				states: append([]netlink.XfrmState(nil), childSA.XfrmStateList...),
+			})
+		}
+		return true
+	})
+
+	// The kernel is queried without holding the locks of the SAs
+	snapshot := &TrafficSnapshot{Updated: time.Now(), UEs: make(map[string][]ChildSATraffic)}
+	for _, source := range sources {
+		traffic := source.traffic
+		for i := range source.states {
+			state, err := xfrmStateGet(&source.states[i])
+			switch {
+			case errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT):
+				traffic.Removed = true
+				continue
+			case err != nil:
+				logger.CtxLog.Warnf("RefreshTraffic: XFRM state %08x: %v", source.states[i].Spi, err)
+				continue
+			}
+			if uint32(state.Spi) == source.spi { // #nosec G115
+				traffic.InboundBytes = state.Statistics.Bytes
+				traffic.InboundPackets = state.Statistics.Packets
+			} else {
+				traffic.OutboundBytes = state.Statistics.Bytes
+				traffic.OutboundPackets = state.Statistics.Packets
+			}
+		}
+		snapshot.UEs[source.ueKey] = append(snapshot.UEs[source.ueKey], traffic)
+	}
+	for _, traffic := range snapshot.UEs {
+		sort.Slice(traffic, func(i, j int) bool {
+			return traffic[i].InboundSPI < traffic[j].InboundSPI
+		})
+	}
+	n3iwfCtx.traffic.Store(snapshot)
+}
+
+// Traffic returns the counters read by the last RefreshTraffic, none before
+// the first one
+func (n3iwfCtx *N3IWFContext) Traffic() TrafficSnapshot {
+	if snapshot := n3iwfCtx.traffic.Load(); snapshot != nil {
+		return *snapshot
+	}
+	return TrafficSnapshot{UEs: map[string][]ChildSATraffic{}}
+}
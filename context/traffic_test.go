@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestRefreshTraffic(t *testing.T) {
+	origStateGet := xfrmStateGet
+	t.Cleanup(func() { xfrmStateGet = origStateGet })
+	// State 0x301 of the second child SA is gone from the kernel
+	xfrmStateGet = func(state *netlink.XfrmState) (*netlink.XfrmState, error) {
+		if state.Spi == 0x301 {
+			return nil, unix.ESRCH
+		}
+		got := *state
+		got.Statistics = netlink.XfrmStateStats{Bytes: uint64(state.Spi) * 100, Packets: uint64(state.Spi)}
+		return &got, nil
+	}
+
+	n3iwfCtx := &N3IWFContext{}
+	if snapshot := n3iwfCtx.Traffic(); len(snapshot.UEs) != 0 {
+		t.Errorf("Unexpected traffic before the first refresh: %+v", snapshot)
+	}
+
+	ikeSA := &IKESecurityAssociation{
+		LocalSPI:    0x1234,
+		InitiatorID: &message.IdentificationInitiator{IDType: message.ID_FQDN, IDData: []byte("ue.aether.org")},
+	}
+	n3iwfCtx.IkeSA.Store(ikeSA.LocalSPI, ikeSA)
+	ikeSA.IkeUE = n3iwfCtx.NewN3iwfIkeUe(ikeSA.LocalSPI)
+	for _, spi := range []uint32{0x300, 0x200} {
+		ikeSA.IkeUE.N3IWFChildSecurityAssociation[spi] = &ChildSecurityAssociation{
+			InboundSPI:    spi,
+			PDUSessionIds: []int64{int64(spi >> 8)},
+			XfrmStateList: []netlink.XfrmState{{Spi: int(spi)}, {Spi: int(spi) + 1}},
+		}
+	}
+	// Not bound to a UE yet, left out
+	n3iwfCtx.IkeSA.Store(uint64(0x5678), &IKESecurityAssociation{LocalSPI: 0x5678})
+
+	n3iwfCtx.RefreshTraffic()
+	snapshot := n3iwfCtx.Traffic()
+	if len(snapshot.UEs) != 1 {
+		t.Fatalf("UEs mismatch. got = %d, want = 1", len(snapshot.UEs))
+	}
+	traffic := snapshot.UEs["ue.aether.org"]
+	expTraffic := []ChildSATraffic{
+		{
+			LocalSPI: "0000000000001234", InboundSPI: "00000200", PDUSessionIds: []int64{2},
+			InboundBytes: 0x200 * 100, InboundPackets: 0x200, OutboundBytes: 0x201 * 100, OutboundPackets: 0x201,
+		},
+		{
+			LocalSPI: "0000000000001234", InboundSPI: "00000300", PDUSessionIds: []int64{3},
+			InboundBytes: 0x300 * 100, InboundPackets: 0x300, Removed: true,
+		},
+	}
+	if !reflect.DeepEqual(traffic, expTraffic) {
+		t.Errorf("traffic mismatch. got = %+v, want = %+v", traffic, expTraffic)
+	}
+	if snapshot.Updated.IsZero() {
+		t.Errorf("Updated not set")
+	}
+}
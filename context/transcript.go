@@ -0,0 +1,185 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// IKETranscript keeps the last IKE messages of an IKE SA with their parsed
+// payloads, so that the whole exchange can be logged at once when it fails.
+// It holds at most its capacity of messages, the oldest are dropped first. A
+// nil transcript records nothing
+type IKETranscript struct {
+	entries []string
+	next    int // Index overwritten by the next message once full
+}
+
+// NewIKETranscript returns a transcript of at most capacity messages, nil if
+// capacity is not positive
+func NewIKETranscript(capacity int) *IKETranscript {
+	if capacity <= 0 {
+		return nil
+	}
+	return &IKETranscript{entries: make([]string, 0, capacity)}
+}
+
+// Add records ikeMsg. Its payloads are rendered at once, so it must be called
+// before the payloads of an outbound message are replaced by the SK payload.
+// Identities and NAS messages are left out, see renderPayload
+func (t *IKETranscript) Add(direction TraceDirection, localAddr, remoteAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage,
+) {
+	if t == nil || ikeMsg == nil || ikeMsg.IKEHeader == nil {
+		return
+	}
+	kind := "request"
+	if ikeMsg.IsResponse() {
+		kind = "response"
+	}
+	payloads := make([]string, 0, len(ikeMsg.Payloads))
+	for _, payload := range ikeMsg.Payloads {
+		payloads = append(payloads, renderPayload(payload))
+	}
+	entry := fmt.Sprintf("%s %s %s %d %s->%s %v", direction, exchangeTypeName(ikeMsg.ExchangeType), kind,
+		ikeMsg.MessageID, addrString(localAddr), addrString(remoteAddr), payloads)
+	if len(t.entries) < cap(t.entries) {
+		t.entries = append(t.entries, entry)
+		return
+	}
+	t.entries[t.next] = entry
+	t.next = (t.next + 1) % len(t.entries)
+}
+
+// Entries returns the recorded messages, oldest first
+func (t *IKETranscript) Entries() []string {
+	if t == nil {
+		return nil
+	}
+	return append(append([]string(nil), t.entries[t.next:]...), t.entries[:t.next]...)
+}
+
+// Reset forgets the recorded messages
+func (t *IKETranscript) Reset() {
+	if t == nil {
+		return
+	}
+	clear(t.entries)
+	t.entries = t.entries[:0]
+	t.next = 0
+}
+
+// renderPayload describes payload for the transcript. The identity of the UE
+// (IDi, EAP identity) and the NAS messages carried by EAP-5G, which hold the
+// SUCI, are only given by their length
+func renderPayload(payload message.IKEPayload) string {
+	name := payloadTypeString(payload.Type())
+	switch payload := payload.(type) {
+	case *message.SecurityAssociation:
+		proposals := make([]string, 0, len(payload.Proposals))
+		for _, proposal := range payload.Proposals {
+			proposals = append(proposals, renderProposal(proposal))
+		}
+		return fmt.Sprintf("%s [%s]", name, strings.Join(proposals, ", "))
+	case *message.KeyExchange:
+		return fmt.Sprintf("%s group %d, %d bytes", name, payload.DiffieHellmanGroup, len(payload.KeyExchangeData))
+	case *message.IdentificationInitiator:
+		return fmt.Sprintf("%s type %d, %d bytes", name, payload.IDType, len(payload.IDData))
+	case *message.IdentificationResponder:
+		return fmt.Sprintf("%s type %d %x", name, payload.IDType, payload.IDData)
+	case *message.Certificate:
+		return fmt.Sprintf("%s encoding %d, %d bytes", name, payload.CertificateEncoding, len(payload.CertificateData))
+	case *message.CertificateRequest:
+		return fmt.Sprintf("%s encoding %d, %d bytes", name, payload.CertificateEncoding,
+			len(payload.CertificationAuthority))
+	case *message.Authentication:
+		return fmt.Sprintf("%s method %d, %d bytes", name, payload.AuthenticationMethod, len(payload.AuthenticationData))
+	case *message.Nonce:
+		return fmt.Sprintf("%s %d bytes", name, len(payload.NonceData))
+	case *message.Notification:
+		return fmt.Sprintf("%s type %d, protocol %d, SPI %x, data %x", name, payload.NotifyMessageType,
+			payload.ProtocolID, payload.SPI, payload.NotificationData)
+	case *message.Delete:
+		return fmt.Sprintf("%s protocol %d, SPIs %x", name, payload.ProtocolID, payload.SPIs)
+	case *message.VendorID:
+		return fmt.Sprintf("%s %x", name, payload.VendorIDData)
+	case *message.TrafficSelectorInitiator:
+		return fmt.Sprintf("%s %s", name, renderTrafficSelectors(payload.TrafficSelectors))
+	case *message.TrafficSelectorResponder:
+		return fmt.Sprintf("%s %s", name, renderTrafficSelectors(payload.TrafficSelectors))
+	case *message.Encrypted:
+		return fmt.Sprintf("%s next %s, %d bytes", name, payloadTypeString(payload.NextPayload),
+			len(payload.EncryptedData))
+	case *message.Configuration:
+		attributes := make([]string, 0, len(payload.ConfigurationAttribute))
+		for _, attribute := range payload.ConfigurationAttribute {
+			attributes = append(attributes, fmt.Sprintf("%d/%d", attribute.Type, len(attribute.Value)))
+		}
+		return fmt.Sprintf("%s type %d, attributes [%s]", name, payload.ConfigurationType, strings.Join(attributes, " "))
+	case *message.EAP:
+		return fmt.Sprintf("%s code %d, identifier %d%s", name, payload.Code, payload.Identifier,
+			renderEAPTypeData(payload.EAPTypeData))
+	case *message.UnknownPayload:
+		return fmt.Sprintf("%s critical %v, %d bytes", name, payload.Critical, len(payload.Data))
+	default:
+		return name
+	}
+}
+
+// renderProposal describes proposal with its transforms as type/ID, followed
+// by the key length when given
+func renderProposal(proposal *message.Proposal) string {
+	var transforms []string
+	for _, container := range []message.TransformContainer{
+		proposal.EncryptionAlgorithm, proposal.PseudorandomFunction, proposal.IntegrityAlgorithm,
+		proposal.DiffieHellmanGroup, proposal.ExtendedSequenceNumbers,
+	} {
+		for _, transform := range container {
+			rendered := fmt.Sprintf("%d/%d", transform.TransformType, transform.TransformID)
+			if transform.AttributePresent && transform.AttributeType == message.AttributeTypeKeyLength {
+				rendered += fmt.Sprintf("/%d", transform.AttributeValue)
+			}
+			transforms = append(transforms, rendered)
+		}
+	}
+	return fmt.Sprintf("#%d protocol %d SPI %x (%s)", proposal.ProposalNumber, proposal.ProtocolID, proposal.SPI,
+		strings.Join(transforms, " "))
+}
+
+func renderTrafficSelectors(trafficSelectors message.IndividualTrafficSelectorContainer) string {
+	rendered := make([]string, 0, len(trafficSelectors))
+	for _, ts := range trafficSelectors {
+		rendered = append(rendered, fmt.Sprintf("%s-%s protocol %d ports %d-%d", net.IP(ts.StartAddress),
+			net.IP(ts.EndAddress), ts.IPProtocolID, ts.StartPort, ts.EndPort))
+	}
+	return "[" + strings.Join(rendered, ", ") + "]"
+}
+
+// renderEAPTypeData gives the EAP type and the length of its data, never the
+// data itself
+func renderEAPTypeData(typeData message.EAPTypeDataContainer) string {
+	if len(typeData) == 0 {
+		return ""
+	}
+	switch data := typeData[0].(type) {
+	case *message.EAPIdentity:
+		return fmt.Sprintf(", type %d, %d bytes", data.Type(), len(data.IdentityData))
+	case *message.EAPNotification:
+		return fmt.Sprintf(", type %d, %d bytes", data.Type(), len(data.NotificationData))
+	case *message.EAPNak:
+		return fmt.Sprintf(", type %d, %d bytes", data.Type(), len(data.NakData))
+	case *message.EAPExpanded:
+		return fmt.Sprintf(", type %d, vendor %d/%d, %d bytes", data.Type(), data.VendorID, data.VendorType,
+			len(data.VendorData))
+	case *message.EAPUnsupported:
+		return fmt.Sprintf(", type %d, %d bytes", data.EAPType, len(data.TypeData))
+	default:
+		return fmt.Sprintf(", type %d", data.Type())
+	}
+}
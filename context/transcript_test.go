@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestIKETranscript(t *testing.T) {
+	if NewIKETranscript(0) != nil {
+		t.Fatalf("transcript enabled with a capacity of 0")
+	}
+	var disabled *IKETranscript
+	disabled.Add(TraceInbound, nil, nil, message.NewMessage(1, 2, message.IKE_AUTH, false, true, 1, nil))
+	if entries := disabled.Entries(); entries != nil {
+		t.Errorf("disabled transcript recorded %v", entries)
+	}
+
+	localAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 500}
+	remoteAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 500}
+	transcript := NewIKETranscript(2)
+	for messageID := range uint32(3) {
+		var payloads message.IKEPayloadContainer
+		payloads.BuildNotification(message.TypeNone, message.AUTHENTICATION_FAILED, nil, nil)
+		transcript.Add(TraceOutbound, localAddr, remoteAddr,
+			message.NewMessage(1, 2, message.IKE_AUTH, true, false, messageID, payloads))
+	}
+
+	entries := transcript.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("entries mismatch. got = %d, want = 2", len(entries))
+	}
+	for i, expPrefix := range []string{"out IKE_AUTH response 1 ", "out IKE_AUTH response 2 "} {
+		if !strings.HasPrefix(entries[i], expPrefix) {
+			t.Errorf("entry %d mismatch. got = %q, want prefix %q", i, entries[i], expPrefix)
+		}
+		if !strings.Contains(entries[i], "10.0.0.1:500->192.168.1.10:500") ||
+			!strings.Contains(entries[i], "N type 24,") {
+			t.Errorf("entry %d lacks the addresses or the payloads: %q", i, entries[i])
+		}
+	}
+
+	transcript.Reset()
+	if entries = transcript.Entries(); len(entries) != 0 {
+		t.Errorf("entries left after reset: %v", entries)
+	}
+}
+
+func TestRenderPayload(t *testing.T) {
+	var payloads message.IKEPayloadContainer
+	proposal := payloads.BuildSecurityAssociation().Proposals.BuildProposal(1, message.TypeESP, []byte{1, 2, 3, 4})
+	attrType, keyLength := uint16(message.AttributeTypeKeyLength), uint16(256)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC,
+		&attrType, &keyLength, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE,
+		nil, nil, nil)
+	payloads.BuildIdentificationInitiator(message.ID_FQDN, []byte("imsi-208930000000001"))
+	eap := payloads.BuildEAP(message.EAPCodeResponse, 7)
+	eap.EAPTypeData.BuildEAPExpanded(message.VendorID3GPP, message.VendorTypeEAP5G, []byte("suci-0-208-93-0000"))
+	eapIdentity := payloads.BuildEAP(message.EAPCodeResponse, 8)
+	eapIdentity.EAPTypeData = append(eapIdentity.EAPTypeData,
+		&message.EAPIdentity{IdentityData: []byte("user@example.org")})
+
+	testcases := []struct {
+		description string
+		payload     message.IKEPayload
+		exp         string
+	}{
+		{"proposals and transforms", payloads[0], "SA [#1 protocol 3 SPI 01020304 (1/12/256 5/0)]"},
+		{"IDi", payloads[1], "IDi type 2, 20 bytes"},
+		{"EAP-5G", payloads[2], "EAP code 2, identifier 7, type 254, vendor 10415/3, 18 bytes"},
+		{"EAP identity", payloads[3], "EAP code 2, identifier 8, type 1, 16 bytes"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if got := renderPayload(tc.payload); got != tc.exp {
+				t.Errorf("renderPayload mismatch. got = %q, want = %q", got, tc.exp)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"slices"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// TransformSet holds transforms by transform type and ID, with the key
+// lengths in bits allowed for each. An ID without key lengths matches the
+// transform whatever its key length attribute
+type TransformSet map[uint8]map[uint16][]uint16
+
+// Add adds the transform transformID of transformType with keyLengths, any
+// key length when empty
+func (set TransformSet) Add(transformType uint8, transformID uint16, keyLengths ...uint16) {
+	if set[transformType] == nil {
+		set[transformType] = make(map[uint16][]uint16)
+	}
+	set[transformType][transformID] = keyLengths
+}
+
+// Contains reports whether transform, with its key length if it must have
+// one, is in the set
+func (set TransformSet) Contains(transform *message.Transform) bool {
+	keyLengths, ok := set[transform.TransformType][transform.TransformID]
+	if !ok {
+		return false
+	}
+	if len(keyLengths) == 0 {
+		return true
+	}
+	return transform.AttributePresent && slices.Contains(keyLengths, transform.AttributeValue)
+}
+
+// TransformPolicy selects the transforms the N3IWF accepts in the proposals
+// of the UEs: those of Allow, any when Allow is nil, except those of Block
+type TransformPolicy struct {
+	Allow TransformSet
+	Block TransformSet
+}
+
+// Allows reports whether the policy accepts transform
+func (policy *TransformPolicy) Allows(transform *message.Transform) bool {
+	if policy.Allow != nil && !policy.Allow.Contains(transform) {
+		return false
+	}
+	return !policy.Block.Contains(transform)
+}
+
+// ESPSupported reports whether the XFRM framework of the kernel can install
+// the ESP transform and the ESP transform policy allows it. A configured
+// allowlist cannot add transforms the kernel lacks
+func (n3iwfCtx *N3IWFContext) ESPSupported(transform *message.Transform) bool {
+	return kernelESPTransforms.Contains(transform) && n3iwfCtx.ESPTransformPolicy.Allows(transform)
+}
+
+var kernelESPTransforms = DefaultESPTransforms()
+
+// DefaultESPTransforms returns the ESP transforms the XFRM framework of the
+// kernel can install
+func DefaultESPTransforms() TransformSet {
+	set := make(TransformSet)
+	for _, transformID := range []uint16{
+		message.ENCR_DES, message.ENCR_3DES, message.ENCR_BLOWFISH, message.ENCR_NULL,
+	} {
+		set.Add(message.TypeEncryptionAlgorithm, transformID)
+	}
+	set.Add(message.TypeEncryptionAlgorithm, message.ENCR_CAST, 128)
+	for _, transformID := range []uint16{
+		message.ENCR_AES_CBC, message.ENCR_AES_CTR, message.ENCR_AES_GCM_16,
+	} {
+		set.Add(message.TypeEncryptionAlgorithm, transformID, 128, 192, 256)
+	}
+	for _, transformID := range []uint16{
+		message.AUTH_HMAC_MD5_96, message.AUTH_HMAC_SHA1_96, message.AUTH_AES_XCBC_96,
+		message.AUTH_HMAC_SHA2_256_128, message.AUTH_HMAC_SHA2_384_192, message.AUTH_HMAC_SHA2_512_256,
+	} {
+		set.Add(message.TypeIntegrityAlgorithm, transformID)
+	}
+	set.Add(message.TypeExtendedSequenceNumbers, message.ESN_ENABLE)
+	set.Add(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE)
+	return set
+}
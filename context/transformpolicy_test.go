@@ -0,0 +1,116 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func newKeyLengthTransform(transformType uint8, transformID uint16, keyLength uint16) *message.Transform {
+	return &message.Transform{
+		TransformType:    transformType,
+		TransformID:      transformID,
+		AttributePresent: keyLength != 0,
+		AttributeType:    message.AttributeTypeKeyLength,
+		AttributeValue:   keyLength,
+	}
+}
+
+func TestTransformPolicy(t *testing.T) {
+	block := make(TransformSet)
+	block.Add(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, 128)
+	block.Add(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_MD5_96)
+	esp := TransformPolicy{Allow: DefaultESPTransforms(), Block: block}
+
+	testcases := []struct {
+		description string
+		policy      TransformPolicy
+		transform   *message.Transform
+		expAllowed  bool
+	}{
+		{
+			description: "any transform without allowlist",
+			transform:   newKeyLengthTransform(message.TypeDiffieHellmanGroup, message.DH_1024_BIT_MODP, 0),
+			expAllowed:  true,
+		},
+		{
+			description: "allowed key length",
+			policy:      esp,
+			transform:   newKeyLengthTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, 256),
+			expAllowed:  true,
+		},
+		{
+			description: "blocked key length",
+			policy:      esp,
+			transform:   newKeyLengthTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, 128),
+		},
+		{
+			description: "missing key length",
+			policy:      esp,
+			transform:   newKeyLengthTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_GCM_16, 0),
+		},
+		{
+			description: "any key length",
+			policy:      esp,
+			transform:   newKeyLengthTransform(message.TypeEncryptionAlgorithm, message.ENCR_3DES, 0),
+			expAllowed:  true,
+		},
+		{
+			description: "blocked transform",
+			policy:      esp,
+			transform:   newKeyLengthTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_MD5_96, 0),
+		},
+		{
+			description: "transform missing from the allowlist",
+			policy:      esp,
+			transform:   newKeyLengthTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, 0),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if allowed := tc.policy.Allows(tc.transform); allowed != tc.expAllowed {
+				t.Errorf("allowed mismatch. got = %v, want = %v", allowed, tc.expAllowed)
+			}
+		})
+	}
+}
+
+func TestESPSupported(t *testing.T) {
+	allow := make(TransformSet)
+	allow.Add(message.TypeEncryptionAlgorithm, message.ENCR_AES_CCM_16)
+	allow.Add(message.TypeEncryptionAlgorithm, message.ENCR_AES_GCM_16, 256)
+	n3iwfCtx := &N3IWFContext{ESPTransformPolicy: TransformPolicy{Allow: allow}}
+
+	testcases := []struct {
+		description  string
+		transform    *message.Transform
+		expSupported bool
+	}{
+		{
+			description:  "allowed and installable",
+			transform:    newKeyLengthTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_GCM_16, 256),
+			expSupported: true,
+		},
+		{
+			description: "allowed but missing from the kernel",
+			transform:   newKeyLengthTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CCM_16, 256),
+		},
+		{
+			description: "installable but not allowed",
+			transform:   newKeyLengthTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, 256),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if supported := n3iwfCtx.ESPSupported(tc.transform); supported != tc.expSupported {
+				t.Errorf("supported mismatch. got = %v, want = %v", supported, tc.expSupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrXfrmIfaceIdExhausted is returned when every ID of the range is in use
+var ErrXfrmIfaceIdExhausted = errors.New("XFRM interface ID range exhausted")
+
+// XfrmIfaceIds allocates the if_id of the XFRM interfaces of additional PDU
+// sessions, or their firewall marks in policy mode, from [first, last]. The
+// IDs in use are tracked in a set, so that none is handed out twice, even
+// when it was found taken by another N3IWF sharing the host
+type XfrmIfaceIds struct {
+	mu    sync.Mutex
+	first uint32
+	last  uint32
+	used  map[uint32]struct{}
+}
+
+// NewXfrmIfaceIds returns an allocator of the IDs of [first, last]
+func NewXfrmIfaceIds(first, last uint32) (*XfrmIfaceIds, error) {
+	if first == 0 || first > last {
+		return nil, fmt.Errorf("NewXfrmIfaceIds: invalid XFRM interface ID range [%d, %d]", first, last)
+	}
+	return &XfrmIfaceIds{first: first, last: last, used: make(map[uint32]struct{})}, nil
+}
+
+// Contains reports whether id is in the range of the allocator
+func (ids *XfrmIfaceIds) Contains(id uint32) bool {
+	return ids != nil && id >= ids.first && id <= ids.last
+}
+
+// Allocate returns the lowest ID of the range not in use
+func (ids *XfrmIfaceIds) Allocate() (uint32, error) {
+	if ids == nil {
+		return 0, ErrXfrmIfaceIdExhausted
+	}
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	for id := ids.first; ; id++ {
+		if _, used := ids.used[id]; !used {
+			ids.used[id] = struct{}{}
+			return id, nil
+		}
+		if id == ids.last {
+			return 0, ErrXfrmIfaceIdExhausted
+		}
+	}
+}
+
+// Reserve marks id as in use, e.g. held by a child SA reconstructed from the
+// kernel or by an interface of another N3IWF. IDs out of the range are ignored
+func (ids *XfrmIfaceIds) Reserve(id uint32) {
+	if !ids.Contains(id) {
+		return
+	}
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	ids.used[id] = struct{}{}
+}
+
+// Release gives id back to the allocator
+func (ids *XfrmIfaceIds) Release(id uint32) {
+	if ids == nil {
+		return
+	}
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	delete(ids.used, id)
+}
+
+// InUse returns the number of IDs in use
+func (ids *XfrmIfaceIds) InUse() int {
+	if ids == nil {
+		return 0
+	}
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	return len(ids.used)
+}
@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewXfrmIfaceIds(t *testing.T) {
+	testcases := []struct {
+		description string
+		first       uint32
+		last        uint32
+		expErr      bool
+	}{
+		{description: "range", first: 15, last: 20},
+		{description: "single ID", first: 15, last: 15},
+		{description: "zero ID", first: 0, last: 20, expErr: true},
+		{description: "reversed range", first: 20, last: 15, expErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := NewXfrmIfaceIds(tc.first, tc.last)
+			if tc.expErr && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tc.expErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestXfrmIfaceIds(t *testing.T) {
+	ids, err := NewXfrmIfaceIds(15, 18)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	n3iwfCtx := &N3IWFContext{XfrmInterfaceId: 7, XfrmIfaceIds: ids}
+
+	// An ID found in the kernel, or taken by another N3IWF, is skipped
+	n3iwfCtx.ReserveXfrmIfaceId(16)
+	n3iwfCtx.ReserveXfrmIfaceId(7)
+	var allocated []uint32
+	for range 3 {
+		id, err := n3iwfCtx.AllocateXfrmIfaceId()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		allocated = append(allocated, id)
+	}
+	if allocated[0] != 15 || allocated[1] != 17 || allocated[2] != 18 {
+		t.Errorf("allocated IDs mismatch. got = %v, want = [15 17 18]", allocated)
+	}
+	if _, err = n3iwfCtx.AllocateXfrmIfaceId(); !errors.Is(err, ErrXfrmIfaceIdExhausted) {
+		t.Errorf("error mismatch. got = %v, want = %v", err, ErrXfrmIfaceIdExhausted)
+	}
+
+	// A released ID is given again, and its interface forgotten
+	n3iwfCtx.XfrmIfaces.Store(uint32(17), struct{}{})
+	n3iwfCtx.releaseXfrmIfaceId(17)
+	if _, ok := n3iwfCtx.XfrmIfaces.Load(uint32(17)); ok {
+		t.Errorf("XFRM interface 17 was not forgotten")
+	}
+	if id, err := n3iwfCtx.AllocateXfrmIfaceId(); err != nil || id != 17 {
+		t.Errorf("allocated ID mismatch. got = %d (%v), want = %d", id, err, 17)
+	}
+	if inUse := ids.InUse(); inUse != 4 {
+		t.Errorf("IDs in use mismatch. got = %d, want = %d", inUse, 4)
+	}
+}
@@ -32,20 +32,201 @@ type Info struct {
 
 // Configuration contains all N3IWF-specific settings
 type Configuration struct {
-	N3iwfInfo            context.N3iwfNfInfo        `yaml:"n3iwfInformation"`           // N3IWF network function info
-	AmfSctpAddresses     []context.AmfSctpAddresses `yaml:"amfSctpAddresses"`           // AMF SCTP addresses
-	LocalSctpAddress     string                     `yaml:"localSctpAddress,omitempty"` // Local SCTP address (optional)
-	IkeBindAddress       string                     `yaml:"ikeBindAddress"`             // IKE bind address
-	IpSecAddress         string                     `yaml:"ipSecAddress"`               // IPsec address range (e.g. 10.0.1.0/24)
-	GtpBindAddress       string                     `yaml:"gtpBindAddress"`             // GTP bind address
-	TcpPort              uint16                     `yaml:"nasTcpPort"`                 // NAS TCP port
-	Fqdn                 string                     `yaml:"fqdn"`                       // FQDN (e.g. n3iwf.aether.org)
-	PrivateKey           string                     `yaml:"privateKey"`                 // Private key path
-	CertificateAuthority string                     `yaml:"certificateAuthority"`       // CA certificate path
-	Certificate          string                     `yaml:"certificate"`                // Certificate path
-	XfrmInterfaceName    string                     `yaml:"xfrmInterfaceName"`          // XFRM interface name
-	XfrmInterfaceId      uint32                     `yaml:"xfrmInterfaceId"`            // XFRM interface ID (must be != 0)
-	LivenessCheck        TimerValue                 `yaml:"livenessCheck"`              // Liveness check settings
+	N3iwfInfo            context.N3iwfNfInfo        `yaml:"n3iwfInformation"`                     // N3IWF network function info
+	AmfSctpAddresses     []context.AmfSctpAddresses `yaml:"amfSctpAddresses"`                     // AMF SCTP addresses
+	LocalSctpAddress     string                     `yaml:"localSctpAddress,omitempty"`           // Local SCTP address (optional)
+	IkeBindAddress       string                     `yaml:"ikeBindAddress"`                       // IKE bind address, IPv4 or IPv6
+	IpSecAddress         string                     `yaml:"ipSecAddress"`                         // IPsec address range (e.g. 10.0.1.0/24)
+	GtpBindAddress       string                     `yaml:"gtpBindAddress"`                       // GTP bind address
+	TcpPort              uint16                     `yaml:"nasTcpPort"`                           // NAS TCP port
+	Fqdn                 string                     `yaml:"fqdn"`                                 // FQDN (e.g. n3iwf.aether.org)
+	ResponderId          ResponderId                `yaml:"responderId,omitempty"`                // IKE responder identity, FQDN if unset (optional)
+	PrivateKey           string                     `yaml:"privateKey"`                           // Private key path
+	CertificateAuthority string                     `yaml:"certificateAuthority"`                 // CA certificate path
+	Certificate          string                     `yaml:"certificate"`                          // Certificate path
+	ResponderIdentities  []ResponderIdentity        `yaml:"responderIdentities,omitempty"`        // Extra identities, selected by the IDr sent by the UE (optional)
+	XfrmInterfaceName    string                     `yaml:"xfrmInterfaceName"`                    // XFRM interface name
+	XfrmInterfaceId      uint32                     `yaml:"xfrmInterfaceId"`                      // XFRM interface ID (must be != 0)
+	XfrmInterfaceIdRange XfrmInterfaceIdRange       `yaml:"xfrmInterfaceIdRange,omitempty"`       // XFRM interface IDs, or firewall marks, of additional PDU sessions, 4096 from 2 * xfrmInterfaceId + 1 if unset (optional)
+	IpsecMode            string                     `yaml:"ipsecMode,omitempty"`                  // Binding of the child SAs: xfrmi, or policy for firewall marks from Linux 5.19, xfrmi if empty (optional)
+	UserPlaneMtu         UserPlaneMtu               `yaml:"userPlaneMtu,omitempty"`               // MTU of the XFRM interfaces and TCP MSS clamping (optional)
+	LivenessCheck        TimerValue                 `yaml:"livenessCheck"`                        // Liveness check settings
+	NgapEventTimeout     time.Duration              `yaml:"ngapEventTimeout,omitempty"`           // Max wait for room in the NGAP event queue (optional)
+	Redirect             Redirect                   `yaml:"redirect,omitempty"`                   // IKE SA redirection settings (optional)
+	MaxIkeSa             int                        `yaml:"maxIkeSa,omitempty"`                   // Max concurrent IKE SAs, new UEs redirected if configured or refused beyond it, unlimited if 0 (optional)
+	MaxPendingIkeSaInit  int                        `yaml:"maxPendingIkeSaInit,omitempty"`        // Max IKE_SA_INIT requests waiting for the IKE event loop, the excess dropped, unbounded if 0 (optional)
+	AdminAddress         string                     `yaml:"adminAddress,omitempty"`               // Local admin HTTP endpoint (e.g. 127.0.0.1:9090), disabled if empty (optional)
+	DhGroupPreference    DhGroupPreference          `yaml:"dhGroupPreference,omitempty"`          // Diffie-Hellman group chosen when the one of the UE KE payload is not acceptable, the strongest if unset (optional)
+	ConfigurationReply   ConfigurationReply         `yaml:"configurationReply,omitempty"`         // Extra attributes returned to the UE in CFG_REPLY (optional)
+	MaxCfgAttributes     int                        `yaml:"maxConfigurationAttributes,omitempty"` // Max attributes accepted in a UE CP payload, 32 if 0 (optional)
+	IkeSaInitRateLimit   RateLimit                  `yaml:"ikeSaInitRateLimit,omitempty"`         // Per UE IP IKE_SA_INIT rate limit, disabled if rate is 0 (optional)
+	Cookie               Cookie                     `yaml:"cookie,omitempty"`                     // IKE_SA_INIT anti-DoS cookies, disabled if threshold is 0 (optional)
+	InitialUeRateLimit   RateLimit                  `yaml:"initialUeRateLimit,omitempty"`         // InitialUEMessages sent to the AMFs per second, unpaced if rate is 0 (optional)
+	InitialUeQueueSize   int                        `yaml:"initialUeQueueSize,omitempty"`         // Max UEs waiting for their InitialUEMessage, 1024 if 0 (optional)
+	IkeSendRateLimit     RateLimit                  `yaml:"ikeSendRateLimit,omitempty"`           // IKE datagrams sent per second on each socket, queued in order, sent directly if rate is 0 (optional)
+	IkeSendQueueSize     int                        `yaml:"ikeSendQueueSize,omitempty"`           // Max IKE datagrams waiting on each socket, 1024 if 0 (optional)
+	Mobike               bool                       `yaml:"mobike,omitempty"`                     // Support UE outer address changes with MOBIKE (optional)
+	ChildSaEncryption    ChildSaEncryption          `yaml:"childSaEncryption,omitempty"`          // ESP cipher proposed for PDU session child SAs, that of the IKE SA if unset (optional)
+	ProposalSelection    string                     `yaml:"proposalSelection,omitempty"`          // Transform chosen in UE proposals: strongest or peerOrder, strongest if empty (optional)
+	AllowTransportMode   bool                       `yaml:"allowTransportMode,omitempty"`         // Accept transport mode child SAs requested by UEs (optional)
+	CpSaNasPortOnly      bool                       `yaml:"cpSaNasPortOnly,omitempty"`            // Narrow the signalling child SA to the NAS TCP port instead of any TCP traffic (optional)
+	ReturnRoutability    bool                       `yaml:"returnRoutabilityCheck,omitempty"`     // Follow NAT rebindings of UEs without MOBIKE after a COOKIE2 echo (optional)
+	EspReplayWindow      EspReplayWindow            `yaml:"espReplayWindow,omitempty"`            // ESP anti-replay window of child SAs (optional)
+	ChildSaLifetime      ChildSaLifetime            `yaml:"childSaLifetime,omitempty"`            // Lifetime of child SAs, rekeyed by the N3IWF past a soft limit, unlimited if unset (optional)
+	IkeTrace             bool                       `yaml:"ikeTrace,omitempty"`                   // Log a structured line for every IKE message sent or received (optional)
+	IkeCapture           string                     `yaml:"ikeCapture,omitempty"`                 // pcap file receiving the raw IKE datagrams, disabled if empty (optional)
+	IkeFailureTranscript int                        `yaml:"ikeFailureTranscript,omitempty"`       // Last IKE messages of an IKE SA logged with their payloads when an exchange fails, disabled if 0 (optional)
+	AuditLog             string                     `yaml:"auditLog,omitempty"`                   // File the SA establishment and teardown records are appended to as JSON lines, disabled if empty (optional)
+	EmptyChildSaDelete   bool                       `yaml:"emptyChildSaDelete,omitempty"`         // Answer deletes of unknown child SAs with an empty ESP Delete payload (optional)
+	HalfOpenSaTimeout    time.Duration              `yaml:"halfOpenSaTimeout,omitempty"`          // Max lifetime of an IKE SA whose UE never authenticates (optional)
+	EapRoundTimeout      time.Duration              `yaml:"eapRoundTimeout,omitempty"`            // Max wait for the UE or the AMF to answer an EAP-5G round, or for the CP child SA request after a childless IKE_AUTH, 30s if 0 (optional)
+	RequireChildSaPfs    bool                       `yaml:"requireChildSaPfs,omitempty"`          // Refuse child SA rekeys of UEs without a fresh Diffie-Hellman exchange (optional)
+	RevocationCheck      RevocationCheck            `yaml:"revocationCheck,omitempty"`            // UE certificate revocation checking, disabled if no source is set (optional)
+	NatKeepalive         time.Duration              `yaml:"natKeepalive,omitempty"`               // Interval of the NAT-T keepalives sent to UEs behind a NAT, disabled if 0 (optional)
+	AlgorithmPolicy      AlgorithmPolicy            `yaml:"algorithmPolicy,omitempty"`            // Transforms accepted from UEs, those implemented if unset (optional)
+	IkeMaxMessageSize    int                        `yaml:"ikeMaxMessageSize,omitempty"`          // Largest IKE message in bytes accepted from UEs, 1280 to 65535, 65535 if 0 (optional)
+	Eap5gFragmentSize    int                        `yaml:"eap5gFragmentSize,omitempty"`          // Fragment 5G-NAS messages larger than this over several EAP-5G messages, non-standard, disabled if 0 (optional)
+	TrafficStatsInterval time.Duration              `yaml:"trafficStatsInterval,omitempty"`       // Refresh interval of the child SA traffic counters of the admin endpoint, 10s if 0 (optional)
+	Dscp                 Dscp                       `yaml:"dscp,omitempty"`                       // DSCP marking of the packets sent to the UEs, unmarked if 0 (optional)
+	ChildSaRetransmit    ChildSaRetransmit          `yaml:"childSaRetransmit,omitempty"`          // Retransmission of the CREATE_CHILD_SA requests of PDU sessions (optional)
+	VendorId             string                     `yaml:"vendorId,omitempty"`                   // Hex encoded Vendor ID payload sent in IKE_SA_INIT responses, none if empty (optional)
+}
+
+// ConfigurationReply configures the attributes sent to the UE in the IKE_AUTH configuration payload
+type ConfigurationReply struct {
+	DnsServers         []string `yaml:"dnsServers,omitempty"`         // IPv4 DNS servers (INTERNAL_IP4_DNS)
+	AlwaysSendDns      bool     `yaml:"alwaysSendDns,omitempty"`      // Send DNS servers even if the UE did not request them
+	Subnets            []string `yaml:"subnets,omitempty"`            // Protected IPv4 subnets for split tunneling (INTERNAL_IP4_SUBNET)
+	NbnsServers        []string `yaml:"nbnsServers,omitempty"`        // IPv4 NetBIOS name servers (INTERNAL_IP4_NBNS)
+	DhcpServers        []string `yaml:"dhcpServers,omitempty"`        // IPv4 DHCP servers (INTERNAL_IP4_DHCP)
+	ApplicationVersion string   `yaml:"applicationVersion,omitempty"` // Version announced to the UE (APPLICATION_VERSION)
+}
+
+// ResponderId configures the identity announced in the IKE_AUTH IDr payload
+type ResponderId struct {
+	Type  string `yaml:"type,omitempty"`  // fqdn, rfc822 or dn
+	Value string `yaml:"value,omitempty"` // Identity, defaults to the FQDN or to the certificate subject for dn
+}
+
+// ResponderIdentity configures an identity presented instead of the default
+// one to UEs naming it in their IKE_AUTH IDr payload
+type ResponderIdentity struct {
+	Type        string `yaml:"type,omitempty"` // fqdn, rfc822 or dn
+	Value       string `yaml:"value"`          // Identity, defaults to the certificate subject for dn
+	PrivateKey  string `yaml:"privateKey"`     // Private key path
+	Certificate string `yaml:"certificate"`    // Certificate path
+}
+
+// ChildSaEncryption configures the ESP cipher the N3IWF proposes to the UE
+// for PDU session child SAs
+type ChildSaEncryption struct {
+	Algorithm string `yaml:"algorithm,omitempty"` // aes-cbc, aes-ctr or aes-gcm-16
+	KeyLength uint16 `yaml:"keyLength,omitempty"` // Key length in bits: 128, 192 or 256, 256 if 0
+}
+
+// ChildSaRetransmit configures the retransmission of the CREATE_CHILD_SA
+// requests sent to the UE for PDU sessions. The interval doubles after each
+// retransmission, and the PDU session fails once the last one is unanswered
+type ChildSaRetransmit struct {
+	Interval   time.Duration `yaml:"interval,omitempty"`   // Wait before the first retransmission, 1s if 0
+	MaxRetries int           `yaml:"maxRetries,omitempty"` // Retransmissions before giving up, 5 if 0
+}
+
+// EspReplayWindow configures the anti-replay window of the ESP child SAs
+// installed in the kernel. Without ESN the window is capped at 32 packets, and
+// replay protection can only be disabled if the ESP algorithm policy blocks ESN
+type EspReplayWindow struct {
+	Size    uint32 `yaml:"size,omitempty"`    // Window in packets, a power of two up to 4096, 32 if 0
+	Disable bool   `yaml:"disable,omitempty"` // Accept replayed ESP packets
+}
+
+// ChildSaLifetime configures the limits of the ESP child SAs installed in the
+// kernel. Past a soft limit the N3IWF rekeys the child SA, past a hard limit
+// the kernel deletes it. Times are whole seconds
+type ChildSaLifetime struct {
+	SoftTime  time.Duration `yaml:"softTime,omitempty"`  // Age at which the child SA is rekeyed, never if 0
+	HardTime  time.Duration `yaml:"hardTime,omitempty"`  // Age at which the child SA is deleted, never if 0
+	SoftBytes uint64        `yaml:"softBytes,omitempty"` // Bytes after which the child SA is rekeyed, unlimited if 0
+	HardBytes uint64        `yaml:"hardBytes,omitempty"` // Bytes after which the child SA is deleted, unlimited if 0
+}
+
+// AlgorithmPolicy configures the transforms accepted in the IKE SA and child
+// SA proposals of the UEs, to comply with a crypto policy
+type AlgorithmPolicy struct {
+	Ike AlgorithmRules `yaml:"ike,omitempty"` // IKE SA transforms, among those the N3IWF implements
+	Esp AlgorithmRules `yaml:"esp,omitempty"` // Child SA transforms, among those the kernel installs by default
+}
+
+// AlgorithmRules restricts the transforms of one SA type
+type AlgorithmRules struct {
+	Allow []AlgorithmRule `yaml:"allow,omitempty"` // Only transforms accepted, the default ones if empty
+	Block []AlgorithmRule `yaml:"block,omitempty"` // Transforms refused even if allowed
+}
+
+// AlgorithmRule selects a transform by its IANA IKEv2 transform type and ID
+type AlgorithmRule struct {
+	Type       string   `yaml:"type"`                 // encr, prf, integ, dh or esn
+	Id         uint16   `yaml:"id"`                   // Transform ID, e.g. 12 for ENCR_AES_CBC
+	KeyLengths []uint16 `yaml:"keyLengths,omitempty"` // Key lengths in bits, any if empty
+}
+
+// UserPlaneMtu configures the MTU of the XFRM interfaces, derived from the MTU
+// of the path to the UEs minus the outer IP, NAT-T and ESP overhead
+type UserPlaneMtu struct {
+	BaseMtu     int  `yaml:"baseMtu,omitempty"`     // MTU of the path to the UEs, 1500 if 0
+	ClampTcpMss bool `yaml:"clampTcpMss,omitempty"` // Lower the MSS of user plane TCP SYNs to fit the GRE tunnel
+}
+
+// Dscp configures the DSCP (RFC 2474), 0 to 63, of the packets sent to the
+// UEs. The outer header of ESP packets, with or without NAT-T encapsulation,
+// carries that of the packets they protect
+type Dscp struct {
+	ControlPlane uint8 `yaml:"controlPlane,omitempty"` // IKE messages and NAS over TCP
+	UserPlane    uint8 `yaml:"userPlane,omitempty"`    // GRE encapsulated user plane
+}
+
+// XfrmInterfaceIdRange bounds the XFRM interface IDs given to additional PDU
+// sessions. N3IWFs sharing a network namespace must use disjoint ranges and
+// interface names
+type XfrmInterfaceIdRange struct {
+	First uint32 `yaml:"first"`          // First ID of the range
+	Last  uint32 `yaml:"last,omitempty"` // Last ID of the range, first + 4095 if 0
+}
+
+// DhGroupPreference biases the Diffie-Hellman group chosen in IKE_SA_INIT
+// when the group of the KE payload of the UE is not acceptable, the UE then
+// being asked for the chosen one with INVALID_KE_PAYLOAD
+type DhGroupPreference struct {
+	Group uint16 `yaml:"group,omitempty"` // Group chosen when offered, e.g. 14 for the 2048-bit MODP group
+}
+
+// Cookie configures the IKE_SA_INIT cookies demanded from the UEs under load
+type Cookie struct {
+	Threshold      int           `yaml:"threshold"`                // Half-open IKE SAs from which cookies are demanded
+	SecretRotation time.Duration `yaml:"secretRotation,omitempty"` // Lifetime of a cookie secret, 5m if 0
+	GracePeriod    time.Duration `yaml:"gracePeriod,omitempty"`    // Cookies of the previous secret accepted after a rotation, 30s if 0
+}
+
+// RateLimit configures a token bucket
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`  // Sustained attempts per second
+	Burst int     `yaml:"burst"` // Attempts allowed in a burst
+}
+
+// RevocationCheck configures CRL and OCSP checking of UE certificates issued by the CA
+type RevocationCheck struct {
+	CrlDistributionPoints []string      `yaml:"crlDistributionPoints,omitempty"` // CRL URLs
+	OcspResponders        []string      `yaml:"ocspResponders,omitempty"`        // OCSP responder URLs, queried before the CRLs
+	CacheTtl              time.Duration `yaml:"cacheTtl,omitempty"`              // Max time a CRL or OCSP response is cached
+	Timeout               time.Duration `yaml:"timeout,omitempty"`               // HTTP timeout per request
+	SoftFail              bool          `yaml:"softFail,omitempty"`              // Accept certificates whose status cannot be determined
+}
+
+// Redirect configures RFC 5685 redirection of UEs to other N3IWF instances
+type Redirect struct {
+	Enable   bool     `yaml:"enable"`   // Enable redirection
+	MaxIkeSa int      `yaml:"maxIkeSa"` // Active IKE SA count from which new UEs are redirected
+	Gateways []string `yaml:"gateways"` // Target gateways (IP address or FQDN), used round robin
 }
 
 // TimerValue configures liveness check timers
@@ -117,5 +117,24 @@ func (p *GREPacket) SetQoS(qfi uint8, rqi bool) {
 	p.setKeyFlag()
 }
 
+// SetKey sets the whole key field and marks the Key Present flag.
+func (p *GREPacket) SetKey(key uint32) {
+	p.key = key
+	p.setKeyFlag()
+}
+
+// GetKey returns the key field.
+func (p *GREPacket) GetKey() uint32 {
+	return p.key
+}
+
+// QoSKey returns the GRE key field carrying the given QFI and RQI values.
+func QoSKey(qfi uint8, rqi bool) uint32 {
+	p := GREPacket{}
+	p.setQFI(qfi)
+	p.setRQI(rqi)
+	return p.key
+}
+
 // ErrInvalidPacketLength is returned when the input packet is too short.
 var ErrInvalidPacketLength = errors.New("invalid GRE packet length")
@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package message
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	ipv4MinHeaderLength = 20
+	ipv6HeaderLength    = 40
+	tcpMinHeaderLength  = 20
+	ipProtocolTCP       = 6
+	tcpFlagSYN          = 0x02
+	tcpOptionEnd        = 0
+	tcpOptionNOP        = 1
+	tcpOptionMSS        = 2
+	tcpOptionMSSLength  = 4
+)
+
+// ClampTCPMSS lowers the MSS option of a TCP SYN carried by the IPv4 or IPv6
+// packet so that the segments of the connection fit in IP packets of
+// maxPacketLength octets, and updates the TCP checksum. IPv6 extension headers
+// are not walked. It returns true if the packet was modified.
+func ClampTCPMSS(packet []byte, maxPacketLength int) bool {
+	if len(packet) == 0 {
+		return false
+	}
+	var ipHeaderLength int
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < ipv4MinHeaderLength || packet[9] != ipProtocolTCP {
+			return false
+		}
+		// Only the first fragment carries the TCP header
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return false
+		}
+		ipHeaderLength = int(packet[0]&0x0f) * 4
+	case 6:
+		if len(packet) < ipv6HeaderLength || packet[6] != ipProtocolTCP {
+			return false
+		}
+		ipHeaderLength = ipv6HeaderLength
+	default:
+		return false
+	}
+	if ipHeaderLength < ipv4MinHeaderLength || len(packet) < ipHeaderLength+tcpMinHeaderLength {
+		return false
+	}
+	tcp := packet[ipHeaderLength:]
+	if tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+	tcpHeaderLength := int(tcp[12]>>4) * 4
+	if tcpHeaderLength < tcpMinHeaderLength || len(tcp) < tcpHeaderLength {
+		return false
+	}
+	maxMSS := maxPacketLength - ipHeaderLength - tcpMinHeaderLength
+	if maxMSS <= 0 || maxMSS > 0xffff {
+		return false
+	}
+
+	options := tcp[tcpMinHeaderLength:tcpHeaderLength]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return false
+		}
+		if options[i] != tcpOptionMSS || options[i+1] != tcpOptionMSSLength {
+			i += int(options[i+1])
+			continue
+		}
+		oldMSS := binary.BigEndian.Uint16(options[i+2 : i+4])
+		newMSS := uint16(maxMSS) // #nosec G115
+		if oldMSS <= newMSS {
+			return false
+		}
+		binary.BigEndian.PutUint16(options[i+2:i+4], newMSS)
+		// The checksum sums 16 bit words, an MSS at an odd offset straddles two
+		if (tcpMinHeaderLength+i+2)%2 == 1 {
+			oldMSS, newMSS = bits.ReverseBytes16(oldMSS), bits.ReverseBytes16(newMSS)
+		}
+		checksum := updateChecksum(binary.BigEndian.Uint16(tcp[16:18]), oldMSS, newMSS)
+		binary.BigEndian.PutUint16(tcp[16:18], checksum)
+		return true
+	}
+	return false
+}
+
+// updateChecksum returns the Internet checksum of data in which one 16 bit
+// word changed from oldWord to newWord, as in RFC 1624 section 3
+func updateChecksum(checksum, oldWord, newWord uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^oldWord) + uint32(newWord)
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package message
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// newTCPPacket returns an IPv4 or IPv6 packet carrying a TCP segment with the
+// given flags and options, and a valid TCP checksum
+func newTCPPacket(ipv6 bool, flags uint8, options []byte) []byte {
+	tcp := make([]byte, tcpMinHeaderLength+len(options))
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 80)
+	tcp[12] = uint8(len(tcp)/4) << 4
+	tcp[13] = flags
+	copy(tcp[tcpMinHeaderLength:], options)
+
+	var header, pseudoHeader []byte
+	if ipv6 {
+		header = make([]byte, ipv6HeaderLength)
+		header[0] = 6 << 4
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(tcp)))
+		header[6] = ipProtocolTCP
+		header[8], header[24] = 0x20, 0x20
+		pseudoHeader = append(append([]byte{}, header[8:40]...), 0, 0, header[4], header[5], 0, 0, 0, ipProtocolTCP)
+	} else {
+		header = make([]byte, ipv4MinHeaderLength)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+len(tcp)))
+		header[9] = ipProtocolTCP
+		copy(header[12:16], []byte{10, 0, 0, 5})
+		copy(header[16:20], []byte{10, 60, 0, 1})
+		pseudoHeader = append(append([]byte{}, header[12:20]...), 0, ipProtocolTCP, 0, uint8(len(tcp)))
+	}
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(append(pseudoHeader, tcp...)))
+	return append(header, tcp...)
+}
+
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func TestClampTCPMSS(t *testing.T) {
+	mss1460 := []byte{tcpOptionMSS, tcpOptionMSSLength, 0x05, 0xb4}
+
+	testcases := []struct {
+		description string
+		ipv6        bool
+		flags       uint8
+		options     []byte
+		mssOffset   int
+		expClamped  bool
+		expMSS      uint16
+	}{
+		{
+			description: "IPv4 SYN",
+			flags:       tcpFlagSYN,
+			options:     mss1460,
+			mssOffset:   2,
+			expClamped:  true,
+			expMSS:      1300 - 40,
+		},
+		{
+			description: "IPv6 SYN-ACK",
+			ipv6:        true,
+			flags:       tcpFlagSYN | 0x10,
+			options:     mss1460,
+			mssOffset:   2,
+			expClamped:  true,
+			expMSS:      1300 - 60,
+		},
+		{
+			description: "MSS at an odd offset",
+			flags:       tcpFlagSYN,
+			options:     append([]byte{tcpOptionNOP}, append(mss1460, tcpOptionNOP, tcpOptionNOP, tcpOptionNOP)...),
+			mssOffset:   3,
+			expClamped:  true,
+			expMSS:      1300 - 40,
+		},
+		{
+			description: "MSS already small enough",
+			flags:       tcpFlagSYN,
+			options:     []byte{tcpOptionMSS, tcpOptionMSSLength, 0x04, 0x00},
+			mssOffset:   2,
+			expMSS:      0x400,
+		},
+		{
+			description: "not a SYN",
+			flags:       0x10,
+			options:     mss1460,
+			mssOffset:   2,
+			expMSS:      1460,
+		},
+		{
+			description: "truncated option",
+			flags:       tcpFlagSYN,
+			options:     []byte{tcpOptionNOP, tcpOptionNOP, tcpOptionNOP, 8},
+			mssOffset:   -1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			packet := newTCPPacket(tc.ipv6, tc.flags, tc.options)
+			if clamped := ClampTCPMSS(packet, 1300); clamped != tc.expClamped {
+				t.Fatalf("clamped mismatch. got = %v, want = %v", clamped, tc.expClamped)
+			}
+			ipHeaderLength := ipv4MinHeaderLength
+			if tc.ipv6 {
+				ipHeaderLength = ipv6HeaderLength
+			}
+			tcp := packet[ipHeaderLength:]
+			if tc.mssOffset >= 0 {
+				mssField := tcpMinHeaderLength + tc.mssOffset
+				if mss := binary.BigEndian.Uint16(tcp[mssField : mssField+2]); mss != tc.expMSS {
+					t.Errorf("MSS mismatch. got = %d, want = %d", mss, tc.expMSS)
+				}
+			}
+			verified := newTCPPacket(tc.ipv6, tc.flags, tcp[tcpMinHeaderLength:])
+			if got, want := binary.BigEndian.Uint16(tcp[16:18]),
+				binary.BigEndian.Uint16(verified[ipHeaderLength+16:ipHeaderLength+18]); got != want {
+				t.Errorf("checksum mismatch. got = 0x%04x, want = 0x%04x", got, want)
+			}
+		})
+	}
+}
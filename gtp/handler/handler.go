@@ -6,6 +6,7 @@
 package handler
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/omec-project/n3iwf/context"
@@ -49,38 +50,45 @@ func forwardDL(n3iwfCtx *context.N3IWFContext, packet gtpMsg.QoSTPDUPacket) {
 	}
 
 	ueInnerIPAddr := ikeUe.IPSecInnerIPAddr
-	var cm *ipv4.ControlMessage
+	var matchedChildSA *context.ChildSecurityAssociation
 
 	// Find matching ChildSA for TEID
 	for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
-		if len(childSA.PDUSessionIds) == 0 {
+		// A rekeyed child SA hands its traffic over to the new one
+		if len(childSA.PDUSessionIds) == 0 || childSA.Rekeyed {
 			continue
 		}
 		pduSession := ranUe.FindPDUSession(childSA.PDUSessionIds[0])
 		if pduSession != nil && pduSession.GTPConnection.IncomingTEID == pktTEID {
-			cm = &ipv4.ControlMessage{IfIndex: childSA.XfrmIface.Attrs().Index}
-			logger.GTPLog.Debugf("forwarding IPSec xfrm interfaceid: %d", childSA.XfrmIface.Attrs().Index)
+			matchedChildSA = childSA
+			logger.GTPLog.Debugf("forwarding through child SA 0x%08x", childSA.InboundSPI)
 			break
 		}
 	}
-	if cm == nil {
+	if matchedChildSA == nil {
 		logger.GTPLog.Warnf("cannot match TEID(%d) to ChildSA", pktTEID)
 		return
 	}
-
-	var qfi uint8
+	qfi := matchedChildSA.DefaultQFI
 	var rqi bool
 	if packet.HasQoS() {
 		qfi, rqi = packet.GetQoSParameters()
 		logger.GTPLog.Debugf("QFI: %v, RQI: %v", qfi, rqi)
 	}
 
+	payload := packet.GetPayload()
+	clampTCPMSS(n3iwfCtx, payload)
 	grePacket := greMsg.GREPacket{}
-	grePacket.SetPayload(packet.GetPayload(), greMsg.IPv4)
-	grePacket.SetQoS(qfi, rqi)
+	grePacket.SetPayload(payload, greMsg.IPv4)
+	greKey, ok := matchedChildSA.GREKey(qfi, rqi)
+	if !ok {
+		logger.GTPLog.Warnf("QFI %d is not carried by child SA 0x%08x", qfi, matchedChildSA.InboundSPI)
+		greKey = greMsg.QoSKey(qfi, rqi)
+	}
+	grePacket.SetKey(greKey)
 	forwardData := grePacket.Marshal()
 
-	n, err := n3iwfCtx.GreConn.WriteTo(forwardData, cm, ueInnerIPAddr)
+	n, err := writeToUE(n3iwfCtx, matchedChildSA, forwardData, ueInnerIPAddr)
 	if err != nil {
 		logger.GTPLog.Errorf("write to UE failed: %+v", err)
 		return
@@ -89,8 +97,42 @@ func forwardDL(n3iwfCtx *context.N3IWFContext, packet gtpMsg.QoSTPDUPacket) {
 	logger.GTPLog.Debugf("wrote %d bytes", n)
 }
 
+// writeToUE sends a GRE packet to the inner address of a UE through childSA:
+// out of its XFRM interface or, in policy mode, with its firewall mark
+func writeToUE(n3iwfCtx *context.N3IWFContext, childSA *context.ChildSecurityAssociation, data []byte,
+	dst *net.IPAddr,
+) (int, error) {
+	if childSA.XfrmIface != nil {
+		return n3iwfCtx.GreConn.WriteTo(data, &ipv4.ControlMessage{IfIndex: childSA.XfrmIface.Attrs().Index}, dst)
+	}
+	if childSA.XfrmMark == 0 {
+		return n3iwfCtx.GreConn.WriteTo(data, nil, dst)
+	}
+	ipConn, ok := n3iwfCtx.GreConn.PacketConn.(*net.IPConn)
+	if !ok {
+		return 0, fmt.Errorf("GRE connection of type %T cannot mark packets", n3iwfCtx.GreConn.PacketConn)
+	}
+	n, _, err := ipConn.WriteMsgIP(data, util.MarkControlMessage(childSA.XfrmMark), dst)
+	return n, err
+}
+
+// receivedThrough reports whether a packet received on the interface ifIndex
+// with the firewall mark mark went through the child SA of a PDU session. The
+// packets of a rekeyed child SA are those of the child SA replacing it
+func receivedThrough(childSA *context.ChildSecurityAssociation, ifIndex int, mark uint32) bool {
+	if len(childSA.PDUSessionIds) == 0 || childSA.PDUSessionIds[0] < 0 || childSA.Rekeyed {
+		return false
+	}
+	if childSA.XfrmIface != nil {
+		return childSA.XfrmIface.Attrs().Index == ifIndex
+	}
+	return childSA.XfrmMark == mark
+}
+
 // ForwardUL forwards user plane packets from NWu to UPF with GTP header encapsulation.
-func ForwardUL(n3iwfCtx *context.N3IWFContext, ueInnerIP string, ifIndex int, rawData []byte) {
+// The PDU session is told apart by the XFRM interface ifIndex the packet was
+// received on or, in policy mode, by its firewall mark
+func ForwardUL(n3iwfCtx *context.N3IWFContext, ueInnerIP string, ifIndex int, mark uint32, rawData []byte) {
 	defer util.RecoverWithLog(logger.NWuUPLog)
 
 	ikeUe, ok := n3iwfCtx.AllocatedUEIPAddressLoad(ueInnerIP)
@@ -106,9 +148,11 @@ func ForwardUL(n3iwfCtx *context.N3IWFContext, ueInnerIP string, ifIndex int, ra
 	}
 
 	var pduSession *context.PDUSession
+	var matchedChildSA *context.ChildSecurityAssociation
 	for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
-		if childSA.XfrmIface != nil && childSA.XfrmIface.Attrs().Index == ifIndex && len(childSA.PDUSessionIds) > 0 {
+		if receivedThrough(childSA, ifIndex, mark) {
 			pduSession = ranUe.GetSharedCtx().PduSessionList[childSA.PDUSessionIds[0]]
+			matchedChildSA = childSA
 			break
 		}
 	}
@@ -127,9 +171,13 @@ func ForwardUL(n3iwfCtx *context.N3IWFContext, ueInnerIP string, ifIndex int, ra
 	}
 
 	payload, _ := grePacket.GetPayload()
+	clampTCPMSS(n3iwfCtx, payload)
 
 	// Encapsulate UL PDU SESSION INFORMATION with extension header if the QoS parameters exist
 	if grePacket.GetKeyFlag() {
+		if _, ok := matchedChildSA.GREKey(grePacket.GetQFI(), false); !ok {
+			logger.NWuUPLog.Warnf("QFI %d is not carried by child SA 0x%08x", grePacket.GetQFI(), matchedChildSA.InboundSPI)
+		}
 		gtpPacket, err := gtpMsg.BuildQoSGTPPacket(gtpConnection.OutgoingTEID, grePacket.GetQFI(), payload)
 		if err != nil {
 			logger.NWuUPLog.Errorf("buildQoSGTPPacket err: %+v", err)
@@ -155,6 +203,18 @@ func ForwardUL(n3iwfCtx *context.N3IWFContext, ueInnerIP string, ifIndex int, ra
 	logger.NWuUPLog.Debugf("wrote %d bytes", n)
 }
 
+// clampTCPMSS lowers the MSS of a TCP SYN to what fits in the XFRM
+// interfaces once encapsulated in GRE over IPv4
+func clampTCPMSS(n3iwfCtx *context.N3IWFContext, payload []byte) {
+	if !n3iwfCtx.ClampTCPMSS || n3iwfCtx.XfrmIfaceMTU == 0 {
+		return
+	}
+	maxPacketLength := n3iwfCtx.XfrmIfaceMTU - ipv4.HeaderLen - greMsg.GREHeaderFieldLength
+	if greMsg.ClampTCPMSS(payload, maxPacketLength) {
+		logger.GTPLog.Debugf("clamped TCP MSS to fit %d byte packets", maxPacketLength)
+	}
+}
+
 // logGTPWriteError logs GTP write errors and handles closed connection.
 func logGTPWriteError(err error) {
 	logger.NWuUPLog.Errorf("write to UPF failed: %+v", err)
@@ -6,28 +6,37 @@
 package ike
 
 import (
+	"fmt"
 	"net"
+	"runtime/debug"
+	"sync/atomic"
 
 	"github.com/omec-project/n3iwf/context"
 	"github.com/omec-project/n3iwf/ike/handler"
 	"github.com/omec-project/n3iwf/ike/message"
 	"github.com/omec-project/n3iwf/logger"
-	"github.com/omec-project/n3iwf/util"
 )
 
 // Dispatch routes incoming IKE messages to the appropriate handler based on ExchangeType.
-// It recovers from panics and logs errors.
-func Dispatch(udpConn *net.UDPConn, localAddr, remoteAddr *net.UDPAddr,
+// It holds the IKE SA of the message while it is handled, and recovers from panics and logs errors.
+func Dispatch(udpConn context.IKEConn, localAddr, remoteAddr *net.UDPAddr,
 	ikeMessage *message.IKEMessage, msg []byte,
 	ikeSA *context.IKESecurityAssociation,
 ) {
-	defer util.RecoverWithLog(logger.IKELog)
+	defer recoverHandlerPanic(remoteAddr, ikeMessage)
 
 	if ikeMessage == nil {
 		logger.IKELog.Warnln("received nil IKEMessage")
 		return
 	}
 
+	// Deferred after the recovery, so a panicking handler releases the SA
+	if ikeSA != nil {
+		ikeSA.Lock()
+		defer ikeSA.Unlock()
+		ikeSA.Transcript.Add(context.TraceInbound, localAddr, remoteAddr, ikeMessage)
+	}
+
 	switch ikeMessage.ExchangeType {
 	case message.IKE_SA_INIT:
 		handler.HandleIKESAINIT(udpConn, localAddr, remoteAddr, ikeMessage, msg)
@@ -38,7 +47,45 @@ func Dispatch(udpConn *net.UDPConn, localAddr, remoteAddr *net.UDPAddr,
 	case message.INFORMATIONAL:
 		handler.HandleInformational(udpConn, localAddr, remoteAddr, ikeMessage, ikeSA)
 	default:
-		logger.IKELog.Warnf("unimplemented IKE message type, exchange type: %d", ikeMessage.ExchangeType)
+		ikeSA.Log().Warnf("unimplemented IKE message type, exchange type: %d", ikeMessage.ExchangeType)
+		return
+	}
+}
+
+// recoverHandlerPanic logs a panic raised while handling ikeMessage with the
+// SPIs and payload types of the message, so that a single misbehaving peer
+// does not stop the IKE server for every other UE
+func recoverHandlerPanic(remoteAddr *net.UDPAddr, ikeMessage *message.IKEMessage) {
+	p := recover()
+	if p == nil {
 		return
 	}
+	panicsRecovered.Add(1)
+
+	fields := []any{"error", p, "remote", remoteAddr.String()}
+	if ikeMessage != nil {
+		if ikeMessage.IKEHeader != nil {
+			fields = append(fields,
+				"ispi", fmt.Sprintf("%016x", ikeMessage.InitiatorSPI),
+				"rspi", fmt.Sprintf("%016x", ikeMessage.ResponderSPI),
+				"exchange", ikeMessage.ExchangeType,
+				"messageId", ikeMessage.MessageID)
+		}
+		// Not []uint8, which would be logged base64 encoded
+		payloadTypes := make([]int, 0, len(ikeMessage.Payloads))
+		for _, payload := range ikeMessage.Payloads {
+			payloadTypes = append(payloadTypes, int(payload.Type()))
+		}
+		fields = append(fields, "payloads", payloadTypes)
+	}
+	fields = append(fields, "stack", string(debug.Stack()))
+	logger.IKELog.Errorw("panic recovered in IKE handler", fields...)
+}
+
+// Number of IKE messages whose handler panicked
+var panicsRecovered atomic.Uint64
+
+// PanicsRecovered returns the number of IKE messages whose handler panicked
+func PanicsRecovered() uint64 {
+	return panicsRecovered.Load()
 }
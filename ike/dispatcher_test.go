@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ike
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/handler"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+)
+
+func TestDispatchRecoversHandlerPanic(t *testing.T) {
+	remoteAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 4500}
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, message.INITIAL_CONTACT, nil, nil)
+	// IKE_AUTH without an IKE SA makes the handler dereference a nil pointer
+	ikeMsg := message.NewMessage(0x1234, 0x5678, message.IKE_AUTH, false, true, 1, payloads)
+
+	before := PanicsRecovered()
+	Dispatch(nil, nil, remoteAddr, ikeMsg, nil, nil)
+	if got := PanicsRecovered() - before; got != 1 {
+		t.Errorf("recovered panics mismatch. got = %d, want = 1", got)
+	}
+}
+
+// Run with -race: the IKE_AUTH messages and the NGAP originated events of the
+// same SA must not interleave
+func TestDispatchConcurrentWithEvents(t *testing.T) {
+	n3iwfConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer n3iwfConn.Close()
+	ueConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	proposal := new(message.Proposal)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA1, nil, nil, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+	ikesaKey, _, err := security.NewIKESAKey(proposal, bytes.Repeat([]byte{0x5a}, 256),
+		bytes.Repeat([]byte{0x01}, 32), 0x1111, 0x2222)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	n3iwfCtx := context.N3IWFSelf()
+	ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+	ikeSA.StopHalfOpenTimer()
+	defer n3iwfCtx.DeleteIKESecurityAssociation(ikeSA.LocalSPI)
+	ikeSA.IKESAKey = ikesaKey
+	ikeSA.RemoteSPI = 0x1111
+	ikeSA.State = handler.PreSignalling
+	ikeSA.IKEConnection = &context.UDPSocketInfo{
+		Conn:      n3iwfConn,
+		N3IWFAddr: n3iwfConn.LocalAddr().(*net.UDPAddr),
+		UEAddr:    ueConn.LocalAddr().(*net.UDPAddr),
+	}
+
+	const rounds = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for msgID := uint32(1); msgID <= rounds; msgID++ {
+			// Without IDi, the handler records the message ID and drops the message
+			ikeMsg := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.IKE_AUTH, false, true, msgID, nil)
+			Dispatch(n3iwfConn, ikeSA.IKEConnection.N3IWFAddr, ikeSA.IKEConnection.UEAddr, ikeMsg, nil, ikeSA)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range rounds {
+			handler.HandleEvent(context.NewSendEAPNASMsgEvt(ikeSA.LocalSPI, []byte{0x7e, 0x00}))
+		}
+	}()
+	wg.Wait()
+
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	if ikeSA.InitiatorMessageID != rounds {
+		t.Errorf("InitiatorMessageID mismatch. got = %d, want = %d", ikeSA.InitiatorMessageID, rounds)
+	}
+	if ikeSA.State != handler.PreSignalling {
+		t.Errorf("State mismatch. got = %d, want = %d", ikeSA.State, handler.PreSignalling)
+	}
+}
@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/ike/security/dh"
+)
+
+// negotiateChildless answers the CHILDLESS_IKEV2_SUPPORTED notification of the
+// UE in IKE_SA_INIT (RFC 6023), which may then leave the CP child SA out of
+// IKE_AUTH
+func negotiateChildless(ikeSecurityAssociation *context.IKESecurityAssociation,
+	notifications []*message.Notification, responseIKEPayload *message.IKEPayloadContainer,
+) {
+	if findNotification(notifications, message.CHILDLESS_IKEV2_SUPPORTED) == nil {
+		return
+	}
+	ikeSecurityAssociation.Log().Debugln("childless IKE_AUTH supported by UE")
+	ikeSecurityAssociation.ChildlessSupported = true
+	responseIKEPayload.BuildNotification(message.TypeNone, message.CHILDLESS_IKEV2_SUPPORTED, nil, nil)
+}
+
+// handleCPChildSARequest answers the CREATE_CHILD_SA request of a UE whose
+// IKE_AUTH was childless, setting up its CP child SA as IKE_AUTH would have.
+// Unlike in IKE_AUTH, the UE may ask for PFS with a KE payload (RFC 7296
+// section 1.3.1), its keys then also derive from the Diffie-Hellman shared
+// secret. NAS is then forwarded over it
+func handleCPChildSARequest(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation,
+	securityAssociation *message.SecurityAssociation, nonce *message.Nonce, keyExchange *message.KeyExchange,
+	trafficSelectorInitiator *message.TrafficSelectorInitiator,
+	trafficSelectorResponder *message.TrafficSelectorResponder,
+) error {
+	n3iwfCtx := context.N3IWFSelf()
+	ikeSecurityAssociation.InitiatorMessageID = ikeMsg.MessageID
+
+	if securityAssociation == nil || nonce == nil ||
+		trafficSelectorInitiator == nil || len(trafficSelectorInitiator.TrafficSelectors) == 0 ||
+		trafficSelectorResponder == nil || len(trafficSelectorResponder.TrafficSelectors) == 0 {
+		sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, message.INVALID_SYNTAX)
+		return &ExchangeError{Notify: message.INVALID_SYNTAX,
+			Err: errors.New("SA, nonce or traffic selectors missing in CP child SA request")}
+	}
+	var dhGroups []uint16
+	if keyExchange != nil {
+		dhGroups = append(dhGroups, keyExchange.DiffieHellmanGroup)
+	}
+	responseSecurityAssociation := selectChildSAProposal(securityAssociation, rekeyDHSupported(keyExchange != nil),
+		dhGroups...)
+	if len(responseSecurityAssociation.Proposals) == 0 {
+		sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+			message.NO_PROPOSAL_CHOSEN)
+		return &ExchangeError{Notify: message.NO_PROPOSAL_CHOSEN, Err: errors.New("no proposal chosen for CP child SA")}
+	}
+	// PFS is optional, as the CP child SA of IKE_AUTH has none
+	dhGroup, notifyType, notifyData, err := negotiateRekeyPFS(responseSecurityAssociation.Proposals[0], keyExchange,
+		false)
+	if err != nil {
+		sendProtectedNotifyResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, notifyType, notifyData)
+		return &ExchangeError{Notify: notifyType, Err: err}
+	}
+
+	localNonceBigInt, err := security.GenerateRandomNumber()
+	if err != nil {
+		return fmt.Errorf("handleCPChildSARequest(): %w", err)
+	}
+	localNonce := localNonceBigInt.Bytes()
+	concatenatedNonce := append(append([]byte{}, nonce.NonceData...), localNonce...)
+
+	var localPublicValue, sharedKey []byte
+	if dhGroup != nil {
+		localPublicValue, sharedKey, err = security.CalculateDiffieHellmanMaterials(dh.DecodeTransform(dhGroup),
+			keyExchange.KeyExchangeData)
+		if err != nil {
+			notifyData := make([]byte, 2)
+			binary.BigEndian.PutUint16(notifyData, dhGroup.TransformID)
+			sendProtectedNotifyResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+				message.INVALID_KE_PAYLOAD, notifyData)
+			return &ExchangeError{Notify: message.INVALID_KE_PAYLOAD, Err: err}
+		}
+	}
+
+	ikeSecurityAssociation.TrafficSelectorInitiator = trafficSelectorInitiator
+	ikeSecurityAssociation.TrafficSelectorResponder = trafficSelectorResponder
+	childSA, err := installCPChildSA(n3iwfCtx, ikeSecurityAssociation, n3iwfAddr, ueAddr,
+		responseSecurityAssociation, sharedKey, concatenatedNonce)
+	if err != nil {
+		var exchangeErr *ExchangeError
+		if errors.As(err, &exchangeErr) {
+			sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+				exchangeErr.Notify)
+		}
+		return err
+	}
+	ikeSecurityAssociation.CPChildSAPending = false
+	ikeSecurityAssociation.StopEAPRoundTimer()
+
+	var responseIKEPayload message.IKEPayloadContainer
+	responseIKEPayload = append(responseIKEPayload, responseSecurityAssociation)
+	responseIKEPayload.BuildNonce(localNonce)
+	if dhGroup != nil {
+		responseIKEPayload.BuildKeyExchange(dhGroup.TransformID, localPublicValue)
+	}
+	responseIKEPayload = append(responseIKEPayload,
+		ikeSecurityAssociation.TrafficSelectorInitiator, ikeSecurityAssociation.TrafficSelectorResponder)
+	responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
+		message.CREATE_CHILD_SA, true, false, ikeMsg.MessageID, responseIKEPayload)
+	if err = SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
+		ikeSecurityAssociation.IKESAKey); err != nil {
+		return fmt.Errorf("handleCPChildSARequest(): %w", err)
+	}
+	n3iwfCtx.AuditChildSA(ikeSecurityAssociation, childSA, context.AuditEstablish, context.AuditAuthSuccess)
+
+	ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeSecurityAssociation.LocalSPI)
+	if !ok {
+		return fmt.Errorf("cannot get RanNgapId from SPI: %+v", ikeSecurityAssociation.LocalSPI)
+	}
+	return startNASSignalling(n3iwfCtx, ikeSecurityAssociation, ranNgapId)
+}
@@ -0,0 +1,218 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security/dh"
+	"golang.org/x/sys/unix"
+)
+
+func TestNegotiateChildless(t *testing.T) {
+	testcases := []struct {
+		description   string
+		notifications []*message.Notification
+		expSupported  bool
+	}{
+		{
+			description:   "announced by UE",
+			notifications: []*message.Notification{{NotifyMessageType: message.CHILDLESS_IKEV2_SUPPORTED}},
+			expSupported:  true,
+		},
+		{
+			description:   "not announced by UE",
+			notifications: []*message.Notification{{NotifyMessageType: message.MOBIKE_SUPPORTED}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeSA := &context.IKESecurityAssociation{}
+			var response message.IKEPayloadContainer
+			negotiateChildless(ikeSA, tc.notifications, &response)
+			if ikeSA.ChildlessSupported != tc.expSupported {
+				t.Errorf("ChildlessSupported mismatch. got = %v, want = %v", ikeSA.ChildlessSupported, tc.expSupported)
+			}
+			echoed := false
+			for _, payload := range response {
+				if notification, ok := payload.(*message.Notification); ok &&
+					notification.NotifyMessageType == message.CHILDLESS_IKEV2_SUPPORTED {
+					echoed = true
+				}
+			}
+			if echoed != tc.expSupported {
+				t.Errorf("CHILDLESS_IKEV2_SUPPORTED echo mismatch. got = %v, want = %v", echoed, tc.expSupported)
+			}
+		})
+	}
+}
+
+// buildCPChildSARequest returns the CREATE_CHILD_SA request of a UE for its
+// CP child SA, offering a Diffie-Hellman group if withDH is set, with its KE
+// payload if withKE is also set
+func buildCPChildSARequest(ikeSA *context.IKESecurityAssociation, withDH, withKE, withTS bool) *message.IKEMessage {
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	var payloads message.IKEPayloadContainer
+	proposal := payloads.BuildSecurityAssociation().Proposals.BuildProposal(1, message.TypeESP,
+		[]byte{0x0a, 0x0b, 0x0c, 0x0d})
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC,
+		&attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96,
+		nil, nil, nil)
+	if withDH {
+		proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP,
+			nil, nil, nil)
+	}
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers,
+		message.ESN_DISABLE, nil, nil, nil)
+	payloads.BuildNonce(make([]byte, 32))
+	if withDH && withKE {
+		dhGroup := dh.DecodeTransform(proposal.DiffieHellmanGroup[0])
+		payloads.BuildKeyExchange(message.DH_2048_BIT_MODP, dhGroup.GetPublicValue(big.NewInt(0x5a5a5a5a)))
+	}
+	if withTS {
+		payloads.BuildTrafficSelectorInitiator().TrafficSelectors.BuildIndividualTrafficSelector(
+			message.TS_IPV4_ADDR_RANGE, message.IPProtocolAll, 0, 65535,
+			net.IPv4zero.To4(), net.IPv4bcast.To4())
+		payloads.BuildTrafficSelectorResponder().TrafficSelectors.BuildIndividualTrafficSelector(
+			message.TS_IPV4_ADDR_RANGE, message.IPProtocolAll, 0, 65535,
+			net.IPv4zero.To4(), net.IPv4bcast.To4())
+	}
+	return message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.CREATE_CHILD_SA, false, true, 2, payloads)
+}
+
+func TestHandleCPChildSARequest(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	savedGwAddr, savedBindAddr, savedNgapServer := n3iwfCtx.IpSecGatewayAddress, n3iwfCtx.IkeBindAddress,
+		n3iwfCtx.NgapServer
+	savedApply := applyXFRMRule
+	t.Cleanup(func() {
+		n3iwfCtx.IpSecGatewayAddress, n3iwfCtx.IkeBindAddress = savedGwAddr, savedBindAddr
+		n3iwfCtx.NgapServer = savedNgapServer
+		applyXFRMRule = savedApply
+	})
+	n3iwfCtx.IpSecGatewayAddress, n3iwfCtx.IkeBindAddress = "10.0.0.1", "127.0.0.1"
+	applyXFRMRule = func(bool, uint32, *context.ChildSecurityAssociation) error { return nil }
+
+	testcases := []struct {
+		description string
+		withDH      bool
+		withKE      bool
+		withTS      bool
+		expNotify   uint16
+	}{
+		{
+			description: "CP child SA set up",
+			withTS:      true,
+		},
+		{
+			description: "traffic selectors missing",
+			expNotify:   message.INVALID_SYNTAX,
+		},
+		{
+			description: "Diffie-Hellman group without KE payload",
+			withDH:      true,
+			withTS:      true,
+			expNotify:   message.NO_PROPOSAL_CHOSEN,
+		},
+		{
+			description: "CP child SA set up with PFS",
+			withDH:      true,
+			withKE:      true,
+			withTS:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx.NgapServer = &context.NgapServer{RcvEventCh: make(chan context.NgapEvt, 4)}
+			ikeUe, _ := newDeleteTestIkeUe(t)
+			ikeSA := ikeUe.N3IWFIKESecurityAssociation
+			ikeSA.State = EndSignalling
+			ikeSA.CPChildSAPending = true
+			ikeUe.IPSecInnerIP = net.IPv4(10, 0, 0, 2).To4()
+			n3iwfCtx.IkeSpiNgapIdMapping(ikeSA.LocalSPI, 43)
+			t.Cleanup(func() {
+				n3iwfCtx.DeleteIkeSPIFromNgapId(43)
+				for spi := range ikeUe.N3IWFChildSecurityAssociation {
+					n3iwfCtx.ChildSA.Delete(spi)
+				}
+			})
+
+			conn := new(fakeIKEConn)
+			request := buildCPChildSARequest(ikeSA, tc.withDH, tc.withKE, tc.withTS)
+			err := handleCREATECHILDSA(conn, ikeUe.IKEConnection.N3IWFAddr, ikeUe.IKEConnection.UEAddr, request,
+				ikeSA)
+			if tc.expNotify == 0 && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tc.expNotify != 0 && err == nil {
+				t.Fatalf("Expected error but got none")
+			}
+
+			datagram := conn.next(t)
+			ikeHeader, err := message.ParseHeader(datagram.data)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			response, err := DecodeDecrypt(datagram.data, ikeHeader, ikeSA.IKESAKey, message.Role_Initiator)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tc.expNotify != 0 {
+				notification, ok := response.Payloads[0].(*message.Notification)
+				if !ok || notification.NotifyMessageType != tc.expNotify {
+					t.Errorf("Unexpected response payload: %+v", response.Payloads[0])
+				}
+				if !ikeSA.CPChildSAPending || len(ikeUe.N3IWFChildSecurityAssociation) != 0 {
+					t.Errorf("CP child SA set up after a failed request")
+				}
+				return
+			}
+
+			var payloadTypes []message.IKEPayloadType
+			for _, payload := range response.Payloads {
+				payloadTypes = append(payloadTypes, payload.Type())
+			}
+			expPayloadTypes := []message.IKEPayloadType{message.TypeSA, message.TypeNiNr}
+			if tc.withKE {
+				expPayloadTypes = append(expPayloadTypes, message.TypeKE)
+			}
+			expPayloadTypes = append(expPayloadTypes, message.TypeTSi, message.TypeTSr)
+			if !slices.Equal(payloadTypes, expPayloadTypes) {
+				t.Errorf("response payloads mismatch. got = %v, want = %v", payloadTypes, expPayloadTypes)
+			}
+			if ikeSA.CPChildSAPending {
+				t.Errorf("CP child SA still pending")
+			}
+			if len(ikeUe.N3IWFChildSecurityAssociation) != 1 {
+				t.Fatalf("child SAs mismatch. got = %d, want = 1", len(ikeUe.N3IWFChildSecurityAssociation))
+			}
+			for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+				if childSA.SelectedIPProtocol != unix.IPPROTO_TCP || childSA.OutboundSPI != 0x0a0b0c0d {
+					t.Errorf("Unexpected CP child SA: protocol %d, outbound SPI 0x%08x",
+						childSA.SelectedIPProtocol, childSA.OutboundSPI)
+				}
+			}
+			for _, expType := range []context.NgapEventType{context.StartTCPSignalNASMsg, context.GetNGAPContext} {
+				select {
+				case evt := <-n3iwfCtx.NgapServer.RcvEventCh:
+					if evt.Type() != expType {
+						t.Errorf("NGAP event mismatch. got = %d, want = %d", evt.Type(), expType)
+					}
+				default:
+					t.Errorf("NGAP event %d not sent", expType)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security/integ"
+)
+
+// childSAFallback is an ESP cipher suite offered after the preferred one
+type childSAFallback struct {
+	encrID    uint16
+	keyLength uint16
+	integIDs  []uint16
+}
+
+// Cipher suites offered in N3IWF initiated CREATE_CHILD_SA requests after the
+// preferred one, for UEs whose kernel lacks it, most preferred first
+var childSAFallbacks = []childSAFallback{
+	{encrID: message.ENCR_AES_GCM_16, keyLength: 256},
+	{encrID: message.ENCR_AES_CBC, keyLength: 256, integIDs: childSAIntegrityPreference},
+	{encrID: message.ENCR_AES_CBC, keyLength: 128, integIDs: []uint16{message.AUTH_HMAC_SHA1_96}},
+}
+
+// buildChildSAProposals adds the proposals of a N3IWF initiated child SA to
+// securityAssociation, numbered from 1: the preferred cipher with the
+// integrity algorithms of childSAIntegrityTransforms, then the fallbacks with
+// another cipher. Integrity is only proposed with non AEAD ciphers, if the PDU
+// session requires it. Transforms refused by the ESP transform policy are left
+// out
+func buildChildSAProposals(securityAssociation *message.SecurityAssociation, spi []byte,
+	preferred *message.Transform, ikeIntegInfo integ.INTEGType, integrityRequired bool,
+) {
+	addProposal := func(encrTransform *message.Transform, integrity message.TransformContainer) {
+		proposalNumber := uint8(len(securityAssociation.Proposals) + 1) // #nosec G115
+		proposal := securityAssociation.Proposals.BuildProposal(proposalNumber, message.TypeESP, spi)
+		proposal.EncryptionAlgorithm = append(proposal.EncryptionAlgorithm, encrTransform)
+		if integrityRequired && !isAEADEncryptionAlgorithm(encrTransform.TransformID) {
+			proposal.IntegrityAlgorithm = integrity
+		}
+		proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers,
+			message.ESN_DISABLE, nil, nil, nil)
+	}
+
+	if kernelSupported(preferred) {
+		addProposal(preferred, childSAIntegrityTransforms(ikeIntegInfo))
+	}
+	attrType := uint16(message.AttributeTypeKeyLength)
+	for _, fallback := range childSAFallbacks {
+		var encrTransforms, integTransforms message.TransformContainer
+		encrTransforms.BuildTransform(message.TypeEncryptionAlgorithm, fallback.encrID, &attrType,
+			&fallback.keyLength, nil)
+		if sameTransform(encrTransforms[0], preferred) || !kernelSupported(encrTransforms[0]) {
+			continue
+		}
+		for _, integID := range fallback.integIDs {
+			integTransforms.BuildTransform(message.TypeIntegrityAlgorithm, integID, nil, nil, nil)
+		}
+		integTransforms = slices.DeleteFunc(integTransforms, func(transform *message.Transform) bool {
+			return !kernelSupported(transform)
+		})
+		if len(fallback.integIDs) > 0 && len(integTransforms) == 0 {
+			continue
+		}
+		addProposal(encrTransforms[0], integTransforms)
+	}
+}
+
+// checkChosenChildSAProposal checks that the UE answered a N3IWF initiated
+// CREATE_CHILD_SA with a single proposal, matching an offered one by its
+// number, and one of the offered transforms of each type of that proposal
+func checkChosenChildSAProposal(offered message.ProposalContainer,
+	securityAssociation *message.SecurityAssociation,
+) error {
+	if securityAssociation == nil {
+		return errors.New("no security association")
+	}
+	if len(securityAssociation.Proposals) != 1 {
+		return fmt.Errorf("expected one proposal, got %d", len(securityAssociation.Proposals))
+	}
+	chosen := securityAssociation.Proposals[0]
+	index := slices.IndexFunc(offered, func(proposal *message.Proposal) bool {
+		return proposal.ProposalNumber == chosen.ProposalNumber
+	})
+	if index < 0 {
+		return fmt.Errorf("proposal %d was not offered", chosen.ProposalNumber)
+	}
+	proposal := offered[index]
+	if chosen.ProtocolID != proposal.ProtocolID || len(chosen.SPI) != len(proposal.SPI) {
+		return fmt.Errorf("proposal %d with protocol %d and SPI size %d", chosen.ProposalNumber,
+			chosen.ProtocolID, len(chosen.SPI))
+	}
+
+	for _, transforms := range []struct {
+		transformType uint8
+		offered       message.TransformContainer
+		chosen        message.TransformContainer
+	}{
+		{message.TypeEncryptionAlgorithm, proposal.EncryptionAlgorithm, chosen.EncryptionAlgorithm},
+		{message.TypePseudorandomFunction, proposal.PseudorandomFunction, chosen.PseudorandomFunction},
+		{message.TypeIntegrityAlgorithm, proposal.IntegrityAlgorithm, chosen.IntegrityAlgorithm},
+		{message.TypeDiffieHellmanGroup, proposal.DiffieHellmanGroup, chosen.DiffieHellmanGroup},
+		{message.TypeExtendedSequenceNumbers, proposal.ExtendedSequenceNumbers, chosen.ExtendedSequenceNumbers},
+	} {
+		if len(transforms.offered) == 0 {
+			if len(transforms.chosen) != 0 {
+				return fmt.Errorf("transform of type %d was not offered", transforms.transformType)
+			}
+			continue
+		}
+		if len(transforms.chosen) != 1 {
+			return fmt.Errorf("expected one transform of type %d, got %d", transforms.transformType,
+				len(transforms.chosen))
+		}
+		if !slices.ContainsFunc(transforms.offered, func(transform *message.Transform) bool {
+			return sameTransform(transform, transforms.chosen[0])
+		}) {
+			return fmt.Errorf("transform %d of type %d was not offered", transforms.chosen[0].TransformID,
+				transforms.transformType)
+		}
+	}
+	return nil
+}
+
+// sameTransform reports whether a and b are the same algorithm, with the same
+// key length if any
+func sameTransform(a, b *message.Transform) bool {
+	return a.TransformType == b.TransformType && a.TransformID == b.TransformID &&
+		a.AttributePresent == b.AttributePresent &&
+		(!a.AttributePresent || a.AttributeType == b.AttributeType && a.AttributeValue == b.AttributeValue)
+}
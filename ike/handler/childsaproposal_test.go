@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security/integ"
+)
+
+func newEncryptionTransform(transformID, keyLength uint16) *message.Transform {
+	attrType := uint16(message.AttributeTypeKeyLength)
+	var transforms message.TransformContainer
+	transforms.BuildTransform(message.TypeEncryptionAlgorithm, transformID, &attrType, &keyLength, nil)
+	return transforms[0]
+}
+
+func TestBuildChildSAProposals(t *testing.T) {
+	ikeIntegInfo := integ.DecodeTransform(&message.Transform{
+		TransformType: message.TypeIntegrityAlgorithm,
+		TransformID:   message.AUTH_HMAC_SHA1_96,
+	})
+
+	testcases := []struct {
+		description       string
+		preferred         *message.Transform
+		integrityRequired bool
+		expEncr           []*message.Transform
+		expInteg          []int
+	}{
+		{
+			description:       "AES-CTR preferred",
+			preferred:         newEncryptionTransform(message.ENCR_AES_CTR, 128),
+			integrityRequired: true,
+			expEncr: []*message.Transform{
+				newEncryptionTransform(message.ENCR_AES_CTR, 128),
+				newEncryptionTransform(message.ENCR_AES_GCM_16, 256),
+				newEncryptionTransform(message.ENCR_AES_CBC, 256),
+				newEncryptionTransform(message.ENCR_AES_CBC, 128),
+			},
+			expInteg: []int{4, 0, 3, 1},
+		},
+		{
+			description:       "fallback preferred, integrity not required",
+			preferred:         newEncryptionTransform(message.ENCR_AES_CBC, 256),
+			integrityRequired: false,
+			expEncr: []*message.Transform{
+				newEncryptionTransform(message.ENCR_AES_CBC, 256),
+				newEncryptionTransform(message.ENCR_AES_GCM_16, 256),
+				newEncryptionTransform(message.ENCR_AES_CBC, 128),
+			},
+			expInteg: []int{0, 0, 0},
+		},
+	}
+
+	spi := []byte{0x01, 0x02, 0x03, 0x04}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			securityAssociation := new(message.SecurityAssociation)
+			buildChildSAProposals(securityAssociation, spi, tc.preferred, ikeIntegInfo, tc.integrityRequired)
+			if len(securityAssociation.Proposals) != len(tc.expEncr) {
+				t.Fatalf("proposals mismatch. got = %d, want = %d", len(securityAssociation.Proposals), len(tc.expEncr))
+			}
+			for i, proposal := range securityAssociation.Proposals {
+				if int(proposal.ProposalNumber) != i+1 || proposal.ProtocolID != message.TypeESP {
+					t.Errorf("proposal %d mismatch. got = %d/%d", i, proposal.ProposalNumber, proposal.ProtocolID)
+				}
+				if len(proposal.EncryptionAlgorithm) != 1 || !sameTransform(proposal.EncryptionAlgorithm[0], tc.expEncr[i]) {
+					t.Errorf("proposal %d encryption mismatch. got = %+v, want = %+v", i+1,
+						proposal.EncryptionAlgorithm, tc.expEncr[i])
+				}
+				if len(proposal.IntegrityAlgorithm) != tc.expInteg[i] {
+					t.Errorf("proposal %d integrity mismatch. got = %d, want = %d", i+1,
+						len(proposal.IntegrityAlgorithm), tc.expInteg[i])
+				}
+				if len(proposal.ExtendedSequenceNumbers) != 1 {
+					t.Errorf("proposal %d ESN mismatch. got = %d, want = 1", i+1, len(proposal.ExtendedSequenceNumbers))
+				}
+			}
+			if err := validateChildSAResponseProposal(securityAssociation.Proposals[1]); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckChosenChildSAProposal(t *testing.T) {
+	offered := new(message.SecurityAssociation)
+	buildChildSAProposals(offered, []byte{0x01, 0x02, 0x03, 0x04},
+		newEncryptionTransform(message.ENCR_AES_CTR, 128), nil, true)
+
+	chosenSA := func(proposalNumber uint8, encrTransform *message.Transform, integID uint16) *message.SecurityAssociation {
+		securityAssociation := new(message.SecurityAssociation)
+		proposal := securityAssociation.Proposals.BuildProposal(proposalNumber, message.TypeESP,
+			[]byte{0x0a, 0x0b, 0x0c, 0x0d})
+		proposal.EncryptionAlgorithm = append(proposal.EncryptionAlgorithm, encrTransform)
+		if integID != 0 {
+			proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, integID, nil, nil, nil)
+		}
+		proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers,
+			message.ESN_DISABLE, nil, nil, nil)
+		return securityAssociation
+	}
+
+	testcases := []struct {
+		description string
+		chosen      *message.SecurityAssociation
+		expErr      bool
+	}{
+		{
+			description: "preferred proposal",
+			chosen:      chosenSA(1, newEncryptionTransform(message.ENCR_AES_CTR, 128), message.AUTH_HMAC_SHA2_384_192),
+		},
+		{
+			description: "AEAD fallback",
+			chosen:      chosenSA(2, newEncryptionTransform(message.ENCR_AES_GCM_16, 256), 0),
+		},
+		{
+			description: "SHA1 fallback",
+			chosen:      chosenSA(4, newEncryptionTransform(message.ENCR_AES_CBC, 128), message.AUTH_HMAC_SHA1_96),
+		},
+		{
+			description: "no security association",
+			expErr:      true,
+		},
+		{
+			description: "proposal not offered",
+			chosen:      chosenSA(5, newEncryptionTransform(message.ENCR_AES_CBC, 128), message.AUTH_HMAC_SHA1_96),
+			expErr:      true,
+		},
+		{
+			description: "transform of another proposal",
+			chosen:      chosenSA(3, newEncryptionTransform(message.ENCR_AES_CBC, 128), message.AUTH_HMAC_SHA1_96),
+			expErr:      true,
+		},
+		{
+			description: "missing integrity",
+			chosen:      chosenSA(3, newEncryptionTransform(message.ENCR_AES_CBC, 256), 0),
+			expErr:      true,
+		},
+		{
+			description: "integrity with AEAD",
+			chosen:      chosenSA(2, newEncryptionTransform(message.ENCR_AES_GCM_16, 256), message.AUTH_HMAC_SHA1_96),
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := checkChosenChildSAProposal(offered.Proposals, tc.chosen)
+			if tc.expErr && err == nil {
+				t.Errorf("Expected error but got none")
+			}
+			if !tc.expErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// configurationAttribute answers a configuration attribute requested by the
+// UE: values returns the values sent to ikeUe, none when the attribute is not
+// configured, and sentUnrequested whether they are sent even if not requested
+type configurationAttribute struct {
+	attributeType   uint16
+	values          func(n3iwfCtx *context.N3IWFContext, ikeUe *context.N3IWFIkeUe) [][]byte
+	sentUnrequested func(n3iwfCtx *context.N3IWFContext) bool
+}
+
+// Configuration attributes answered by the N3IWF besides the inner IP address
+// of the UE and its netmask, in the order of the CFG_REPLY. An attribute
+// without value is not supported
+var configurationAttributes = []configurationAttribute{
+	{
+		attributeType: message.INTERNAL_IP4_DNS,
+		values: func(n3iwfCtx *context.N3IWFContext, ikeUe *context.N3IWFIkeUe) [][]byte {
+			return ipv4AttributeValues(n3iwfCtx.UEDNSServers(ikeUe))
+		},
+		sentUnrequested: func(n3iwfCtx *context.N3IWFContext) bool { return n3iwfCtx.AlwaysSendDNS },
+	},
+	{
+		attributeType: message.INTERNAL_IP4_NBNS,
+		values: func(n3iwfCtx *context.N3IWFContext, _ *context.N3IWFIkeUe) [][]byte {
+			return ipv4AttributeValues(n3iwfCtx.NBNSServers)
+		},
+	},
+	{
+		attributeType: message.INTERNAL_IP4_DHCP,
+		values: func(n3iwfCtx *context.N3IWFContext, _ *context.N3IWFIkeUe) [][]byte {
+			return ipv4AttributeValues(n3iwfCtx.DHCPServers)
+		},
+	},
+	{
+		attributeType: message.APPLICATION_VERSION,
+		values: func(n3iwfCtx *context.N3IWFContext, _ *context.N3IWFIkeUe) [][]byte {
+			if n3iwfCtx.ApplicationVersion == "" {
+				return nil
+			}
+			return [][]byte{[]byte(n3iwfCtx.ApplicationVersion)}
+		},
+	},
+	{
+		attributeType: message.INTERNAL_IP4_SUBNET,
+		values: func(n3iwfCtx *context.N3IWFContext, _ *context.N3IWFIkeUe) [][]byte {
+			var values [][]byte
+			for _, subnet := range n3iwfCtx.SplitTunnelSubnets {
+				// RFC 7296 section 3.15.1: address followed by netmask
+				values = append(values, append(append([]byte{}, subnet.IP.To4()...), subnet.Mask...))
+			}
+			return values
+		},
+		// The split tunnel subnets are part of the policy of the UE
+		sentUnrequested: func(*context.N3IWFContext) bool { return true },
+	},
+}
+
+func ipv4AttributeValues(ips []net.IP) [][]byte {
+	values := make([][]byte, 0, len(ips))
+	for _, ip := range ips {
+		values = append(values, ip.To4())
+	}
+	return values
+}
+
+// requestedConfigurationAttributes returns the types of the attributes of a
+// CFG_REQUEST, none without configuration payload
+func requestedConfigurationAttributes(configuration *message.Configuration) map[uint16]bool {
+	requested := make(map[uint16]bool)
+	if configuration == nil {
+		return requested
+	}
+	for _, attribute := range configuration.ConfigurationAttribute {
+		requested[attribute.Type] = true
+	}
+	return requested
+}
+
+// buildConfigurationReplyAttributes appends the values of the configuration
+// attributes requested by the UE, or sent unrequested. As of RFC 7296 section
+// 3.15.1 the attributes not supported are left out of the reply, which then
+// lists the supported ones in a SUPPORTED_ATTRIBUTES attribute. The inner IP
+// address and netmask of the UE are appended by the caller
+func buildConfigurationReplyAttributes(attributes *message.ConfigurationAttributeContainer,
+	n3iwfCtx *context.N3IWFContext, ikeUe *context.N3IWFIkeUe, requested map[uint16]bool,
+) {
+	supported := []uint16{message.INTERNAL_IP4_ADDRESS, message.INTERNAL_IP4_NETMASK}
+	for _, attribute := range configurationAttributes {
+		values := attribute.values(n3iwfCtx, ikeUe)
+		if len(values) == 0 {
+			continue
+		}
+		supported = append(supported, attribute.attributeType)
+		if !requested[attribute.attributeType] &&
+			(attribute.sentUnrequested == nil || !attribute.sentUnrequested(n3iwfCtx)) {
+			continue
+		}
+		for _, value := range values {
+			attributes.BuildConfigurationAttribute(attribute.attributeType, value)
+		}
+	}
+	supported = append(supported, message.SUPPORTED_ATTRIBUTES)
+
+	var unsupported []uint16
+	for attributeType := range requested {
+		if !slices.Contains(supported, attributeType) {
+			unsupported = append(unsupported, attributeType)
+		}
+	}
+	if len(unsupported) != 0 {
+		slices.Sort(unsupported)
+		ikeUe.N3IWFIKESecurityAssociation.Log().Debugf("configuration attributes %v not supported", unsupported)
+	} else if !requested[message.SUPPORTED_ATTRIBUTES] {
+		return
+	}
+	value := make([]byte, 0, 2*len(supported))
+	for _, attributeType := range supported {
+		value = binary.BigEndian.AppendUint16(value, attributeType)
+	}
+	attributes.BuildConfigurationAttribute(message.SUPPORTED_ATTRIBUTES, value)
+}
+
+// validateConfigurationRequest checks the type of a configuration payload
+// received in a request, only the initiator sending CFG_REQUEST and CFG_SET
+func validateConfigurationRequest(configuration *message.Configuration) error {
+	switch configuration.ConfigurationType {
+	case message.CFG_REQUEST, message.CFG_SET:
+		return nil
+	default:
+		return fmt.Errorf("configuration payload of type %d in a request", configuration.ConfigurationType)
+	}
+}
+
+// answerConfigurationRequest builds the configuration payload answering the
+// configuration payload of an INFORMATIONAL request of ikeUe. A requested
+// internal address renews the lease of the inner IP address of the UE, which
+// is never changed
+func answerConfigurationRequest(n3iwfCtx *context.N3IWFContext, ikeUe *context.N3IWFIkeUe,
+	configuration *message.Configuration,
+) (*message.Configuration, error) {
+	var reply message.IKEPayloadContainer
+	if configuration.ConfigurationType == message.CFG_SET {
+		// None of the values set by the UE is accepted, so none is acknowledged
+		return reply.BuildConfiguration(message.CFG_ACK), nil
+	}
+
+	requested := requestedConfigurationAttributes(configuration)
+	responseConfiguration := reply.BuildConfiguration(message.CFG_REPLY)
+	if requested[message.INTERNAL_IP4_ADDRESS] {
+		ueIPAddr, err := n3iwfCtx.RenewInternalUEIPAddr(ikeUe)
+		if err != nil {
+			return nil, fmt.Errorf("answerConfigurationRequest: %w", err)
+		}
+		responseConfiguration.ConfigurationAttribute.BuildConfigurationAttribute(
+			message.INTERNAL_IP4_ADDRESS, ueIPAddr.To4())
+		responseConfiguration.ConfigurationAttribute.BuildConfigurationAttribute(
+			message.INTERNAL_IP4_NETMASK, ikeUe.InnerNetmask)
+	}
+	buildConfigurationReplyAttributes(&responseConfiguration.ConfigurationAttribute, n3iwfCtx, ikeUe, requested)
+	return responseConfiguration, nil
+}
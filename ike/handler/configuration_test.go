@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestValidateConfigurationRequest(t *testing.T) {
+	testcases := []struct {
+		description       string
+		configurationType uint8
+		expectedErr       bool
+	}{
+		{description: "CFG_REQUEST", configurationType: message.CFG_REQUEST},
+		{description: "CFG_SET", configurationType: message.CFG_SET},
+		{description: "CFG_REPLY", configurationType: message.CFG_REPLY, expectedErr: true},
+		{description: "CFG_ACK", configurationType: message.CFG_ACK, expectedErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := validateConfigurationRequest(&message.Configuration{ConfigurationType: tc.configurationType})
+			if tc.expectedErr && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tc.expectedErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAnswerConfigurationRequest(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	ueIP := net.ParseIP("10.0.0.2").To4()
+	supported := []byte{0, 1, 0, 2, 0, 3, 0, 14}
+
+	testcases := []struct {
+		description       string
+		configurationType uint8
+		attributes        []uint16
+		otherLease        bool
+		expectedErr       bool
+		expectedType      uint8
+		expectedAttrs     []uint16
+	}{
+		{
+			description:       "address renewal",
+			configurationType: message.CFG_REQUEST,
+			attributes:        []uint16{message.INTERNAL_IP4_ADDRESS},
+			expectedType:      message.CFG_REPLY,
+			expectedAttrs:     []uint16{message.INTERNAL_IP4_ADDRESS, message.INTERNAL_IP4_NETMASK},
+		},
+		{
+			description:       "address and DNS",
+			configurationType: message.CFG_REQUEST,
+			attributes:        []uint16{message.INTERNAL_IP4_ADDRESS, message.INTERNAL_IP4_DNS},
+			expectedType:      message.CFG_REPLY,
+			expectedAttrs: []uint16{
+				message.INTERNAL_IP4_ADDRESS, message.INTERNAL_IP4_NETMASK, message.INTERNAL_IP4_DNS,
+			},
+		},
+		{
+			description:       "unsupported attribute",
+			configurationType: message.CFG_REQUEST,
+			attributes:        []uint16{message.INTERNAL_IP6_ADDRESS},
+			expectedType:      message.CFG_REPLY,
+			expectedAttrs:     []uint16{message.SUPPORTED_ATTRIBUTES},
+		},
+		{
+			description:       "supported attributes query",
+			configurationType: message.CFG_REQUEST,
+			attributes:        []uint16{message.SUPPORTED_ATTRIBUTES},
+			expectedType:      message.CFG_REPLY,
+			expectedAttrs:     []uint16{message.SUPPORTED_ATTRIBUTES},
+		},
+		{
+			description:       "address leased to another UE",
+			configurationType: message.CFG_REQUEST,
+			attributes:        []uint16{message.INTERNAL_IP4_ADDRESS},
+			otherLease:        true,
+			expectedErr:       true,
+		},
+		{
+			description:       "CFG_SET",
+			configurationType: message.CFG_SET,
+			attributes:        []uint16{message.INTERNAL_IP4_ADDRESS},
+			expectedType:      message.CFG_ACK,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx := &context.N3IWFContext{
+				Subnet:     subnet,
+				DNSServers: []net.IP{net.ParseIP("8.8.8.8")},
+			}
+			ikeSA := &context.IKESecurityAssociation{}
+			ikeUe := &context.N3IWFIkeUe{
+				N3IWFIKESecurityAssociation: ikeSA,
+				IPSecInnerIP:                ueIP,
+				InnerNetmask:                subnet.Mask,
+			}
+			ikeSA.IkeUE = ikeUe
+			if tc.otherLease {
+				n3iwfCtx.AllocatedUeIpAddress.Store(ueIP.String(), new(context.N3IWFIkeUe))
+			}
+
+			configuration := &message.Configuration{ConfigurationType: tc.configurationType}
+			for _, attributeType := range tc.attributes {
+				configuration.ConfigurationAttribute.BuildConfigurationAttribute(attributeType, nil)
+			}
+			reply, err := answerConfigurationRequest(n3iwfCtx, ikeUe, configuration)
+			if tc.expectedErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if reply.ConfigurationType != tc.expectedType {
+				t.Errorf("configuration type mismatch. got = %d, want = %d", reply.ConfigurationType, tc.expectedType)
+			}
+			if len(reply.ConfigurationAttribute) != len(tc.expectedAttrs) {
+				t.Fatalf("attribute count mismatch. got = %d, want = %d",
+					len(reply.ConfigurationAttribute), len(tc.expectedAttrs))
+			}
+			for i, attribute := range reply.ConfigurationAttribute {
+				if attribute.Type != tc.expectedAttrs[i] {
+					t.Errorf("attribute type mismatch. got = %d, want = %d", attribute.Type, tc.expectedAttrs[i])
+				}
+				var expected []byte
+				switch attribute.Type {
+				case message.INTERNAL_IP4_ADDRESS:
+					expected = ueIP
+				case message.INTERNAL_IP4_NETMASK:
+					expected = subnet.Mask
+				case message.INTERNAL_IP4_DNS:
+					expected = net.ParseIP("8.8.8.8").To4()
+				case message.SUPPORTED_ATTRIBUTES:
+					expected = supported
+				}
+				if !bytes.Equal(attribute.Value, expected) {
+					t.Errorf("attribute %d value mismatch. got = %v, want = %v", attribute.Type, attribute.Value, expected)
+				}
+			}
+			if owner, ok := n3iwfCtx.AllocatedUEIPAddressLoad(ueIP.String()); tc.expectedType == message.CFG_REPLY &&
+				tc.attributes[0] == message.INTERNAL_IP4_ADDRESS && (!ok || owner != ikeUe) {
+				t.Errorf("lease of IP %s is not renewed", ueIP)
+			}
+		})
+	}
+}
+
+func TestBuildConfigurationReplyAttributes(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.60.0.0/16")
+	dns := []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1")}
+	nbns := []net.IP{net.ParseIP("10.60.0.10")}
+	dhcp := []net.IP{net.ParseIP("10.60.0.20")}
+
+	testcases := []struct {
+		description   string
+		alwaysSendDNS bool
+		unconfigured  bool
+		requested     []uint16
+		expectedAttrs []uint16
+	}{
+		{
+			description:   "nothing requested",
+			expectedAttrs: []uint16{message.INTERNAL_IP4_SUBNET},
+		},
+		{
+			description:   "DNS requested",
+			requested:     []uint16{message.INTERNAL_IP4_DNS},
+			expectedAttrs: []uint16{message.INTERNAL_IP4_DNS, message.INTERNAL_IP4_DNS, message.INTERNAL_IP4_SUBNET},
+		},
+		{
+			description:   "DNS always sent",
+			alwaysSendDNS: true,
+			expectedAttrs: []uint16{message.INTERNAL_IP4_DNS, message.INTERNAL_IP4_DNS, message.INTERNAL_IP4_SUBNET},
+		},
+		{
+			description: "NBNS, DHCP and application version",
+			requested:   []uint16{message.APPLICATION_VERSION, message.INTERNAL_IP4_DHCP, message.INTERNAL_IP4_NBNS},
+			expectedAttrs: []uint16{
+				message.INTERNAL_IP4_NBNS, message.INTERNAL_IP4_DHCP, message.APPLICATION_VERSION,
+				message.INTERNAL_IP4_SUBNET,
+			},
+		},
+		{
+			description: "unsupported attribute",
+			requested:   []uint16{message.INTERNAL_IP6_DNS},
+			expectedAttrs: []uint16{
+				message.INTERNAL_IP4_SUBNET, message.SUPPORTED_ATTRIBUTES,
+			},
+		},
+		{
+			description:   "attributes not configured",
+			unconfigured:  true,
+			requested:     []uint16{message.INTERNAL_IP4_NBNS, message.APPLICATION_VERSION},
+			expectedAttrs: []uint16{message.INTERNAL_IP4_SUBNET, message.SUPPORTED_ATTRIBUTES},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx := &context.N3IWFContext{
+				DNSServers:         dns,
+				AlwaysSendDNS:      tc.alwaysSendDNS,
+				SplitTunnelSubnets: []*net.IPNet{subnet},
+			}
+			supported := []byte{0, 1, 0, 2, 0, 3, 0, 13, 0, 14}
+			if !tc.unconfigured {
+				n3iwfCtx.NBNSServers, n3iwfCtx.DHCPServers = nbns, dhcp
+				n3iwfCtx.ApplicationVersion = "n3iwf-1.0"
+				supported = []byte{0, 1, 0, 2, 0, 3, 0, 4, 0, 6, 0, 7, 0, 13, 0, 14}
+			}
+			ikeSA := &context.IKESecurityAssociation{}
+			ikeUe := &context.N3IWFIkeUe{N3IWFIKESecurityAssociation: ikeSA}
+			ikeSA.IkeUE = ikeUe
+
+			configuration := &message.Configuration{ConfigurationType: message.CFG_REQUEST}
+			for _, attributeType := range tc.requested {
+				configuration.ConfigurationAttribute.BuildConfigurationAttribute(attributeType, nil)
+			}
+			var attributes message.ConfigurationAttributeContainer
+			buildConfigurationReplyAttributes(&attributes, n3iwfCtx, ikeUe,
+				requestedConfigurationAttributes(configuration))
+
+			var types []uint16
+			var dnsIndex int
+			for _, attribute := range attributes {
+				types = append(types, attribute.Type)
+				var expected []byte
+				switch attribute.Type {
+				case message.INTERNAL_IP4_DNS:
+					expected = dns[dnsIndex].To4()
+					dnsIndex++
+				case message.INTERNAL_IP4_NBNS:
+					expected = nbns[0].To4()
+				case message.INTERNAL_IP4_DHCP:
+					expected = dhcp[0].To4()
+				case message.APPLICATION_VERSION:
+					expected = []byte("n3iwf-1.0")
+				case message.INTERNAL_IP4_SUBNET:
+					expected = []byte{10, 60, 0, 0, 255, 255, 0, 0}
+				case message.SUPPORTED_ATTRIBUTES:
+					expected = supported
+				}
+				if !bytes.Equal(attribute.Value, expected) {
+					t.Errorf("attribute %d value mismatch. got = %v, want = %v", attribute.Type, attribute.Value, expected)
+				}
+			}
+			if !slices.Equal(types, tc.expectedAttrs) {
+				t.Errorf("attribute types mismatch. got = %v, want = %v", types, tc.expectedAttrs)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	ngapMsg "github.com/omec-project/n3iwf/ngap/message"
+)
+
+var (
+	// ErrStaleEAPResponse is returned for a response to an EAP request sent
+	// before the outstanding one, e.g. retransmitted by the UE
+	ErrStaleEAPResponse = errors.New("stale EAP response")
+	// ErrUnexpectedEAPType is returned for a response of another EAP method
+	// than the one in progress
+	ErrUnexpectedEAPType = errors.New("unexpected EAP type")
+	// ErrUnexpectedEAP5GMessage is returned for an EAP-5G response whose
+	// message ID does not answer the outstanding 5G-Start or 5G-NAS request
+	ErrUnexpectedEAP5GMessage = errors.New("unexpected EAP-5G message")
+	// ErrEAP5GReassembly is returned for a fragment of a 5G-NAS message of
+	// the UE out of sequence or beyond the announced length
+	ErrEAP5GReassembly = errors.New("EAP-5G reassembly failed")
+)
+
+// validateEAPResponse checks that an EAP payload received from the UE is a
+// response to the outstanding request of eapSession
+func validateEAPResponse(eap *message.EAP, eapSession *context.EAPSession) error {
+	if eap == nil {
+		return errors.New("EAP is nil")
+	}
+	if eap.Code != message.EAPCodeResponse {
+		return fmt.Errorf("received an EAP payload with code other than response: %d", eap.Code)
+	}
+	if eap.Identifier != eapSession.Identifier {
+		if eapSession.IsEarlier(eap.Identifier) {
+			return fmt.Errorf("%w: identifier %d, outstanding request: %d",
+				ErrStaleEAPResponse, eap.Identifier, eapSession.Identifier)
+		}
+		return fmt.Errorf("received an EAP payload with out of sequence identifier: %d, expected: %d",
+			eap.Identifier, eapSession.Identifier)
+	}
+	if len(eap.EAPTypeData) == 0 {
+		return errors.New("received an EAP response without type data")
+	}
+	return nil
+}
+
+// validateEAP5GResponse validates the EAP response and returns its EAP-5G
+// expanded type data
+func validateEAP5GResponse(eap *message.EAP, eapSession *context.EAPSession) (*message.EAPExpanded, error) {
+	if err := validateEAPResponse(eap, eapSession); err != nil {
+		return nil, err
+	}
+
+	eapTypeData := eap.EAPTypeData[0]
+	eapExpanded, ok := eapTypeData.(*message.EAPExpanded)
+	if !ok {
+		if eapTypeData.Type() == message.EAPTypeAKAPrime {
+			return nil, fmt.Errorf("%w: EAP-AKA' (%d) outside of EAP-5G, expected: %d",
+				ErrUnexpectedEAPType, eapTypeData.Type(), eapSession.Method)
+		}
+		return nil, fmt.Errorf("%w: %d, expected: %d", ErrUnexpectedEAPType, eapTypeData.Type(), eapSession.Method)
+	}
+	if eapExpanded.VendorID != message.VendorID3GPP {
+		return nil, fmt.Errorf("%w: EAP expanded packet with wrong vendor ID: %d", ErrUnexpectedEAPType, eapExpanded.VendorID)
+	}
+	if eapExpanded.VendorType != message.VendorTypeEAP5G {
+		return nil, fmt.Errorf("%w: EAP expanded packet with wrong vendor type: %d", ErrUnexpectedEAPType, eapExpanded.VendorType)
+	}
+	if len(eapExpanded.VendorData) == 0 {
+		return nil, errors.New("peer sent EAP-5G packet without vendor data")
+	}
+	return eapExpanded, nil
+}
+
+// eapIdentityResponse returns the EAP Response/Identity with which some UEs
+// answer the outstanding 5G-Start, nil for any other EAP payload
+func eapIdentityResponse(eap *message.EAP, eapSession *context.EAPSession) *message.EAPIdentity {
+	if eapSession.Method != message.EAPTypeExpanded || eapSession.MessageID != message.EAP5GType5GStart {
+		return nil
+	}
+	if validateEAPResponse(eap, eapSession) != nil {
+		return nil
+	}
+	identity, _ := eap.EAPTypeData[0].(*message.EAPIdentity)
+	return identity
+}
+
+// reassembleEAP5GNAS adds the 5G-NAS vendorData received from the UE to
+// fragments. It returns the vendor data of the whole message once its last
+// fragment is received, and nil before. A message that is not fragmented is
+// returned as is, as is any message when fragmentation is not enabled, the
+// flags octet being then spare. Partial state is dropped on error
+func reassembleEAP5GNAS(fragments *context.EAP5GFragments, vendorData []byte, fragmentation bool) ([]byte, error) {
+	if !fragmentation {
+		return vendorData, nil
+	}
+	reassembled, err := addEAP5GFragment(fragments, vendorData)
+	if err != nil || reassembled != nil {
+		fragments.Inbound = nil
+		fragments.InboundLength = 0
+	}
+	return reassembled, err
+}
+
+func addEAP5GFragment(fragments *context.EAP5GFragments, vendorData []byte) ([]byte, error) {
+	if len(vendorData) < message.EAP5GHeaderLen {
+		return nil, fmt.Errorf("%w: no EAP-5G header", ErrEAP5GReassembly)
+	}
+	flags := vendorData[1]
+	data := vendorData[message.EAP5GHeaderLen:]
+	switch {
+	case flags&message.EAP5GFlagLengthIncluded != 0:
+		if fragments.Inbound != nil {
+			return nil, fmt.Errorf("%w: first fragment received after %d bytes", ErrEAP5GReassembly,
+				len(fragments.Inbound))
+		}
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%w: first fragment without length", ErrEAP5GReassembly)
+		}
+		// At most 65535 bytes, from a 2 octet length
+		fragments.InboundLength = int(binary.BigEndian.Uint16(data))
+		fragments.Inbound = make([]byte, 0, fragments.InboundLength)
+		data = data[2:]
+	case fragments.Inbound == nil:
+		if flags&message.EAP5GFlagMoreFragments != 0 {
+			return nil, fmt.Errorf("%w: fragment received before the first one", ErrEAP5GReassembly)
+		}
+		return vendorData, nil
+	}
+
+	if len(fragments.Inbound)+len(data) > fragments.InboundLength {
+		return nil, fmt.Errorf("%w: more than the %d bytes announced", ErrEAP5GReassembly, fragments.InboundLength)
+	}
+	fragments.Inbound = append(fragments.Inbound, data...)
+	if flags&message.EAP5GFlagMoreFragments != 0 {
+		return nil, nil
+	}
+	if len(fragments.Inbound) != fragments.InboundLength {
+		return nil, fmt.Errorf("%w: %d of the %d bytes announced received", ErrEAP5GReassembly,
+			len(fragments.Inbound), fragments.InboundLength)
+	}
+	return append([]byte{message.EAP5GType5GNAS, message.EAP5GSpareValue}, fragments.Inbound...), nil
+}
+
+// sendEAP5GRequest sends a 5G-NAS request with vendorData to the UE, in the
+// IKE_AUTH response to messageID
+func sendEAP5GRequest(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, messageID uint32,
+	ikeSecurityAssociation *context.IKESecurityAssociation, vendorData []byte,
+) error {
+	identifier, err := ikeSecurityAssociation.EAP.NextRequest(message.EAPTypeExpanded, message.EAP5GType5GNAS)
+	if err != nil {
+		return fmt.Errorf("sendEAP5GRequest: %w", err)
+	}
+	ikeSecurityAssociation.Log().Debugf("EAP-5G NAS request: identifier %d, round %d, flags %#02x",
+		identifier, ikeSecurityAssociation.EAP.Rounds, vendorData[1])
+
+	var payload message.IKEPayloadContainer
+	payload.BuildEAP5GRequest(identifier, vendorData)
+	responseIKEMessage := message.NewMessage(ikeSecurityAssociation.RemoteSPI, ikeSecurityAssociation.LocalSPI,
+		message.IKE_AUTH, true, false, messageID, payload)
+	if err = SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
+		ikeSecurityAssociation.IKESAKey); err != nil {
+		return fmt.Errorf("sendEAP5GRequest: %w", err)
+	}
+	context.N3IWFSelf().StartEAPRoundTimer(ikeSecurityAssociation)
+	return nil
+}
+
+// sendEAP5GStart sends a new 5G-Start request to the UE, in the IKE_AUTH
+// response to messageID
+func sendEAP5GStart(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, messageID uint32,
+	ikeSecurityAssociation *context.IKESecurityAssociation,
+) error {
+	identifier, err := ikeSecurityAssociation.EAP.NextRequest(message.EAPTypeExpanded, message.EAP5GType5GStart)
+	if err != nil {
+		return fmt.Errorf("sendEAP5GStart: %w", err)
+	}
+	ikeSecurityAssociation.Log().Debugf("EAP-5G Start request: identifier %d", identifier)
+
+	var payload message.IKEPayloadContainer
+	payload.BuildEAP5GStart(identifier)
+	responseIKEMessage := message.NewMessage(ikeSecurityAssociation.RemoteSPI, ikeSecurityAssociation.LocalSPI,
+		message.IKE_AUTH, true, false, messageID, payload)
+	if err = SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
+		ikeSecurityAssociation.IKESAKey); err != nil {
+		return fmt.Errorf("sendEAP5GStart: %w", err)
+	}
+	context.N3IWFSelf().StartEAPRoundTimer(ikeSecurityAssociation)
+	return nil
+}
+
+// recordANParameters keeps the AN parameters of the 5G-NAS vendorData of the
+// UE on the IKE SA, for the first message carrying them. vendorData is
+// forwarded to the AMF as is, even when it cannot be parsed here
+func recordANParameters(ikeSecurityAssociation *context.IKESecurityAssociation, vendorData []byte) {
+	if ikeSecurityAssociation.ANParameters != nil {
+		return
+	}
+	anParameters, _, err := ngapMsg.UnmarshalEAP5GData(vendorData)
+	if err != nil {
+		ikeSecurityAssociation.Log().Warnf("AN parameters not recorded: %v", err)
+		return
+	}
+	if anParameters != nil {
+		ikeSecurityAssociation.ANParameters = anParameters
+		ikeSecurityAssociation.Log().Infof("AN parameters: %s", anParameters)
+	}
+}
@@ -0,0 +1,324 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// newEAPSession returns a session whose third request, of identifier 7, is outstanding
+func newEAPSession() *context.EAPSession {
+	return &context.EAPSession{
+		Method:     message.EAPTypeExpanded,
+		Identifier: 7,
+		MessageID:  message.EAP5GType5GNAS,
+		Rounds:     3,
+	}
+}
+
+func newEAP5GResponse(code, identifier uint8) *message.EAP {
+	return newEAP5GMessage(code, identifier, message.EAP5GType5GNAS)
+}
+
+func newEAP5GMessage(code, identifier, messageID uint8) *message.EAP {
+	eap := &message.EAP{
+		Code:       code,
+		Identifier: identifier,
+	}
+	eap.EAPTypeData.BuildEAPExpanded(message.VendorID3GPP, message.VendorTypeEAP5G,
+		[]byte{messageID, message.EAP5GSpareValue})
+	return eap
+}
+
+func newEAPIdentityResponse(code, identifier uint8) *message.EAP {
+	return &message.EAP{
+		Code:       code,
+		Identifier: identifier,
+		EAPTypeData: message.EAPTypeDataContainer{
+			&message.EAPIdentity{IdentityData: []byte("ue")},
+		},
+	}
+}
+
+func TestValidateEAPResponse(t *testing.T) {
+	testcases := []struct {
+		description string
+		eap         *message.EAP
+		expErr      bool
+		expErrIs    error
+	}{
+		{
+			description: "valid identity response",
+			eap:         newEAPIdentityResponse(message.EAPCodeResponse, 7),
+			expErr:      false,
+		},
+		{
+			description: "identity request instead of response",
+			eap:         newEAPIdentityResponse(message.EAPCodeRequest, 7),
+			expErr:      true,
+		},
+		{
+			description: "identity response with out of sequence identifier",
+			eap:         newEAPIdentityResponse(message.EAPCodeResponse, 8),
+			expErr:      true,
+		},
+		{
+			description: "response to an earlier request",
+			eap:         newEAPIdentityResponse(message.EAPCodeResponse, 5),
+			expErr:      true,
+			expErrIs:    ErrStaleEAPResponse,
+		},
+		{
+			description: "identifier before the first request",
+			eap:         newEAPIdentityResponse(message.EAPCodeResponse, 4),
+			expErr:      true,
+		},
+		{
+			description: "EAP-5G success code",
+			eap:         newEAP5GResponse(message.EAPCodeSuccess, 7),
+			expErr:      true,
+		},
+		{
+			description: "response without type data",
+			eap:         &message.EAP{Code: message.EAPCodeResponse, Identifier: 7},
+			expErr:      true,
+		},
+		{
+			description: "nil EAP",
+			eap:         nil,
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := validateEAPResponse(tc.eap, newEAPSession())
+			if tc.expErr && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tc.expErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if (tc.expErrIs != nil) != errors.Is(err, ErrStaleEAPResponse) {
+				t.Errorf("stale response mismatch. got = %v, want = %v", err, tc.expErrIs)
+			}
+		})
+	}
+}
+
+func TestValidateEAP5GResponse(t *testing.T) {
+	wrongVendor := newEAP5GResponse(message.EAPCodeResponse, 7)
+	wrongVendor.EAPTypeData[0].(*message.EAPExpanded).VendorID = 1
+	akaPrime := &message.EAP{
+		Code:       message.EAPCodeResponse,
+		Identifier: 7,
+		EAPTypeData: message.EAPTypeDataContainer{
+			&message.EAPUnsupported{EAPType: message.EAPTypeAKAPrime, TypeData: []byte{0x01, 0x00, 0x00}},
+		},
+	}
+
+	testcases := []struct {
+		description string
+		eap         *message.EAP
+		expErr      bool
+		expErrIs    error
+	}{
+		{
+			description: "valid EAP-5G response",
+			eap:         newEAP5GResponse(message.EAPCodeResponse, 7),
+			expErr:      false,
+		},
+		{
+			description: "EAP-5G request instead of response",
+			eap:         newEAP5GResponse(message.EAPCodeRequest, 7),
+			expErr:      true,
+		},
+		{
+			description: "EAP-5G response to an earlier request",
+			eap:         newEAP5GResponse(message.EAPCodeResponse, 6),
+			expErr:      true,
+			expErrIs:    ErrStaleEAPResponse,
+		},
+		{
+			description: "non expanded EAP type",
+			eap:         newEAPIdentityResponse(message.EAPCodeResponse, 7),
+			expErr:      true,
+			expErrIs:    ErrUnexpectedEAPType,
+		},
+		{
+			description: "EAP-AKA' outside of EAP-5G",
+			eap:         akaPrime,
+			expErr:      true,
+			expErrIs:    ErrUnexpectedEAPType,
+		},
+		{
+			description: "wrong vendor ID",
+			eap:         wrongVendor,
+			expErr:      true,
+			expErrIs:    ErrUnexpectedEAPType,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			eapExpanded, err := validateEAP5GResponse(tc.eap, newEAPSession())
+			if tc.expErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				if tc.expErrIs != nil && !errors.Is(err, tc.expErrIs) {
+					t.Errorf("error mismatch. got = %v, want = %v", err, tc.expErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if eapExpanded == nil {
+				t.Error("Expected EAP expanded data but got nil")
+			}
+		})
+	}
+}
+
+func TestReassembleEAP5GNAS(t *testing.T) {
+	header := []byte{message.EAP5GType5GNAS, message.EAP5GSpareValue}
+	first := []byte{message.EAP5GType5GNAS, message.EAP5GFlagLengthIncluded | message.EAP5GFlagMoreFragments, 0, 4, 0x01, 0x02}
+	middle := []byte{message.EAP5GType5GNAS, message.EAP5GFlagMoreFragments, 0x03}
+	last := []byte{message.EAP5GType5GNAS, 0, 0x04}
+	testcases := []struct {
+		description   string
+		fragments     [][]byte
+		disabled      bool
+		expVendorData []byte
+		expErr        bool
+	}{
+		{
+			description:   "not fragmented",
+			fragments:     [][]byte{append(header, 0x01, 0x02)},
+			expVendorData: append(header, 0x01, 0x02),
+		},
+		{
+			description:   "fragmentation disabled",
+			fragments:     [][]byte{first},
+			disabled:      true,
+			expVendorData: first,
+		},
+		{
+			description:   "three fragments",
+			fragments:     [][]byte{first, middle, last},
+			expVendorData: append(header, 0x01, 0x02, 0x03, 0x04),
+		},
+		{
+			description: "fragment before the first one",
+			fragments:   [][]byte{middle},
+			expErr:      true,
+		},
+		{
+			description: "first fragment twice",
+			fragments:   [][]byte{first, first},
+			expErr:      true,
+		},
+		{
+			description: "more bytes than announced",
+			fragments:   [][]byte{first, middle, middle, last},
+			expErr:      true,
+		},
+		{
+			description: "fewer bytes than announced",
+			fragments:   [][]byte{first, last},
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var fragments context.EAP5GFragments
+			var vendorData []byte
+			var err error
+			for i, fragment := range tc.fragments {
+				vendorData, err = reassembleEAP5GNAS(&fragments, fragment, !tc.disabled)
+				if err != nil {
+					break
+				}
+				if i < len(tc.fragments)-1 && vendorData != nil {
+					t.Fatalf("message complete after fragment %d of %d", i+1, len(tc.fragments))
+				}
+			}
+			if fragments.Inbound != nil {
+				t.Errorf("partial state left: %x", fragments.Inbound)
+			}
+			if tc.expErr {
+				if !errors.Is(err, ErrEAP5GReassembly) {
+					t.Errorf("error mismatch. got = %v, want = %v", err, ErrEAP5GReassembly)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !bytes.Equal(vendorData, tc.expVendorData) {
+				t.Errorf("vendor data mismatch. got = %x, want = %x", vendorData, tc.expVendorData)
+			}
+		})
+	}
+}
+
+func TestRecordANParameters(t *testing.T) {
+	initial := []byte{message.EAP5GType5GNAS, message.EAP5GSpareValue, 0x00, 0x05,
+		message.ANParametersTypeSelectedPLMNID, 3, 0x02, 0xf8, 0x39, 0x00, 0x02, 0x7e, 0x00}
+	subsequent := []byte{message.EAP5GType5GNAS, message.EAP5GSpareValue, 0x00, 0x00, 0x00, 0x02, 0x7e, 0x00}
+	malformed := []byte{message.EAP5GType5GNAS, message.EAP5GSpareValue, 0x00, 0x10}
+	// S-NSSAIs with the mapped HPLMN SST, and SST and SD, of a roaming UE
+	roaming := []byte{message.EAP5GType5GNAS, message.EAP5GSpareValue, 0x00, 0x19,
+		message.ANParametersTypeSelectedPLMNID, 3, 0x02, 0xf8, 0x39,
+		message.ANParametersTypeRequestedNSSAI, 18, 2, 0x01, 0x02, 5, 0x01, 0x01, 0x02, 0x03, 0x02,
+		8, 0x01, 0x01, 0x02, 0x03, 0x02, 0x04, 0x05, 0x06,
+		0x00, 0x02, 0x7e, 0x00}
+	testcases := []struct {
+		description string
+		vendorData  [][]byte
+		expPLMNID   []byte
+		expNSSAI    int
+	}{
+		{description: "initial message", vendorData: [][]byte{initial}, expPLMNID: []byte{0x02, 0xf8, 0x39}},
+		{description: "kept over later messages", vendorData: [][]byte{initial, subsequent}, expPLMNID: []byte{0x02, 0xf8, 0x39}},
+		{description: "none carried", vendorData: [][]byte{subsequent}},
+		{description: "malformed", vendorData: [][]byte{malformed}},
+		{description: "roaming UE", vendorData: [][]byte{roaming}, expPLMNID: []byte{0x02, 0xf8, 0x39}, expNSSAI: 3},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeSA := new(context.IKESecurityAssociation)
+			for _, vendorData := range tc.vendorData {
+				forwarded := bytes.Clone(vendorData)
+				recordANParameters(ikeSA, vendorData)
+				if !bytes.Equal(vendorData, forwarded) {
+					t.Errorf("vendor data modified. got = %x, want = %x", vendorData, forwarded)
+				}
+			}
+			if tc.expPLMNID == nil {
+				if ikeSA.ANParameters != nil {
+					t.Errorf("AN parameters mismatch. got = %v, want = nil", ikeSA.ANParameters)
+				}
+				return
+			}
+			if ikeSA.ANParameters == nil || ikeSA.ANParameters.SelectedPLMNID == nil ||
+				!bytes.Equal(ikeSA.ANParameters.SelectedPLMNID.Value, tc.expPLMNID) {
+				t.Fatalf("AN parameters mismatch. got = %v, want = selected PLMN ID: %x", ikeSA.ANParameters, tc.expPLMNID)
+			}
+			if tc.expNSSAI != 0 && (ikeSA.ANParameters.RequestedNSSAI == nil ||
+				len(ikeSA.ANParameters.RequestedNSSAI.List) != tc.expNSSAI) {
+				t.Errorf("requested NSSAI mismatch. got = %v, want = %d S-NSSAIs", ikeSA.ANParameters, tc.expNSSAI)
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security/dh"
+)
+
+// fakeIKEConn records the datagrams sent by the N3IWF instead of writing them
+// to a socket
+type fakeIKEConn struct {
+	mu        sync.Mutex
+	datagrams []fakeDatagram
+}
+
+type fakeDatagram struct {
+	addr *net.UDPAddr
+	data []byte
+}
+
+func (conn *fakeIKEConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.datagrams = append(conn.datagrams, fakeDatagram{addr: addr, data: bytes.Clone(b)})
+	return len(b), nil
+}
+
+// next returns the oldest datagram not returned yet
+func (conn *fakeIKEConn) next(t *testing.T) fakeDatagram {
+	t.Helper()
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.datagrams) == 0 {
+		t.Fatalf("no datagram sent")
+	}
+	datagram := conn.datagrams[0]
+	conn.datagrams = conn.datagrams[1:]
+	return datagram
+}
+
+// newTestResponderIdentity configures a self-signed certificate as the
+// default responder identity of n3iwfCtx until the end of the test
+func newTestResponderIdentity(t *testing.T, n3iwfCtx *context.N3IWFContext) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "n3iwf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	idType, idData, cert, privateKey := n3iwfCtx.ResponderIDType, n3iwfCtx.ResponderIDData,
+		n3iwfCtx.N3iwfCertificate, n3iwfCtx.N3iwfPrivateKey
+	t.Cleanup(func() {
+		n3iwfCtx.ResponderIDType, n3iwfCtx.ResponderIDData = idType, idData
+		n3iwfCtx.N3iwfCertificate, n3iwfCtx.N3iwfPrivateKey = cert, privateKey
+	})
+	n3iwfCtx.ResponderIDType = message.ID_FQDN
+	n3iwfCtx.ResponderIDData = []byte("n3iwf.aether.org")
+	n3iwfCtx.N3iwfCertificate = certificate
+	n3iwfCtx.N3iwfPrivateKey = key
+}
+
+// runIKESAINITAndAUTH plays the IKE_SA_INIT and first IKE_AUTH exchanges of
+// a UE through conn, checks the answers of the N3IWF and returns the IKE SA,
+// waiting for the EAP-5G response of the UE
+func runIKESAINITAndAUTH(t *testing.T, n3iwfCtx *context.N3IWFContext,
+	conn *fakeIKEConn,
+) *context.IKESecurityAssociation {
+	t.Helper()
+	newTestResponderIdentity(t, n3iwfCtx)
+	n3iwfAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 500}
+	ueAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 2), Port: 500}
+
+	// IKE_SA_INIT
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	var payloads message.IKEPayloadContainer
+	proposal := payloads.BuildSecurityAssociation().Proposals.BuildProposal(1, message.TypeIKE, nil)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC,
+		&attrType, &keyLength, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA1,
+		nil, nil, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96,
+		nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP,
+		nil, nil, nil)
+	dhGroup := dh.DecodeTransform(proposal.DiffieHellmanGroup[0])
+	payloads.BuildKeyExchange(message.DH_2048_BIT_MODP, dhGroup.GetPublicValue(big.NewInt(0x5a5a5a5a)))
+	payloads.BuildNonce(bytes.Repeat([]byte{0x01}, 32))
+	initRequest := message.NewMessage(0x1111, 0, message.IKE_SA_INIT, false, true, 0, payloads)
+	initRequestData, err := initRequest.Encode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = handleIKESAINIT(conn, n3iwfAddr, ueAddr, initRequest, initRequestData); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	datagram := conn.next(t)
+	if !datagram.addr.IP.Equal(ueAddr.IP) || datagram.addr.Port != ueAddr.Port {
+		t.Errorf("address mismatch. got = %v, want = %v", datagram.addr, ueAddr)
+	}
+	initResponse := new(message.IKEMessage)
+	if err = initResponse.Decode(datagram.data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if initResponse.ExchangeType != message.IKE_SA_INIT || !initResponse.IsResponse() ||
+		initResponse.InitiatorSPI != 0x1111 || initResponse.ResponderSPI == 0 {
+		t.Fatalf("Unexpected IKE_SA_INIT response header: %+v", initResponse.IKEHeader)
+	}
+	responsePayloads := parseIKEPayloads(initResponse.Payloads)
+	for _, payloadType := range []message.IKEPayloadType{message.TypeSA, message.TypeKE, message.TypeNiNr} {
+		if responsePayloads[payloadType] == nil {
+			t.Errorf("payload %d missing from the IKE_SA_INIT response", payloadType)
+		}
+	}
+
+	ikeSA, ok := n3iwfCtx.IKESALoad(initResponse.ResponderSPI)
+	if !ok {
+		t.Fatalf("IKE SA %016x not found", initResponse.ResponderSPI)
+	}
+	t.Cleanup(func() { n3iwfCtx.DeleteIKESecurityAssociation(ikeSA.LocalSPI) })
+
+	// IKE_AUTH, protected with the keys of the N3IWF playing the UE
+	payloads.Reset()
+	payloads.BuildIdentificationInitiator(message.ID_FQDN, []byte("ue.aether.org"))
+	childProposal := payloads.BuildSecurityAssociation().Proposals.BuildProposal(1, message.TypeESP,
+		[]byte{0x01, 0x02, 0x03, 0x04})
+	childProposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC,
+		&attrType, &keyLength, nil)
+	childProposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96,
+		nil, nil, nil)
+	childProposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers,
+		message.ESN_DISABLE, nil, nil, nil)
+	payloads.BuildTrafficSelectorInitiator().TrafficSelectors.BuildIndividualTrafficSelector(
+		message.TS_IPV4_ADDR_RANGE, message.IPProtocolAll, 0, 65535,
+		net.IPv4zero.To4(), net.IPv4bcast.To4())
+	payloads.BuildTrafficSelectorResponder().TrafficSelectors.BuildIndividualTrafficSelector(
+		message.TS_IPV4_ADDR_RANGE, message.IPProtocolAll, 0, 65535,
+		net.IPv4zero.To4(), net.IPv4bcast.To4())
+	authRequest := message.NewMessage(0x1111, ikeSA.LocalSPI, message.IKE_AUTH, false, true, 1, payloads)
+	authRequestData, err := EncodeEncrypt(authRequest, ikeSA.IKESAKey, message.Role_Initiator)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	authHeader, err := message.ParseHeader(authRequestData)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	authRequest, err = DecodeDecrypt(authRequestData, authHeader, ikeSA.IKESAKey, message.Role_Responder)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = handleIKEAUTH(conn, n3iwfAddr, ueAddr, authRequest, ikeSA); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	datagram = conn.next(t)
+	authResponseHeader, err := message.ParseHeader(datagram.data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	authResponse, err := DecodeDecrypt(datagram.data, authResponseHeader, ikeSA.IKESAKey, message.Role_Initiator)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if authResponse.ExchangeType != message.IKE_AUTH || authResponse.MessageID != 1 {
+		t.Errorf("Unexpected IKE_AUTH response header: %+v", authResponse.IKEHeader)
+	}
+	var payloadTypes []message.IKEPayloadType
+	for _, payload := range authResponse.Payloads {
+		payloadTypes = append(payloadTypes, payload.Type())
+		if eap, ok := payload.(*message.EAP); ok && eap.Code != message.EAPCodeRequest {
+			t.Errorf("EAP code mismatch. got = %d, want = %d", eap.Code, message.EAPCodeRequest)
+		}
+	}
+	expPayloadTypes := []message.IKEPayloadType{message.TypeIDr, message.TypeCERT, message.TypeAUTH, message.TypeEAP}
+	if !slices.Equal(payloadTypes, expPayloadTypes) {
+		t.Errorf("IKE_AUTH response payloads mismatch. got = %v, want = %v", payloadTypes, expPayloadTypes)
+	}
+	if ikeSA.State != EAPSignalling {
+		t.Errorf("State mismatch. got = %d, want = %d", ikeSA.State, EAPSignalling)
+	}
+	return ikeSA
+}
+
+func TestIKESAINITAndAUTHExchange(t *testing.T) {
+	runIKESAINITAndAUTH(t, context.N3IWFSelf(), new(fakeIKEConn))
+}
+
+func TestEAP5GStopReapsIKESA(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	defer func(subnet *net.IPNet) { n3iwfCtx.Subnet = subnet }(n3iwfCtx.Subnet)
+	_, n3iwfCtx.Subnet, _ = net.ParseCIDR("10.0.0.0/24")
+
+	conn := new(fakeIKEConn)
+	ikeSA := runIKESAINITAndAUTH(t, n3iwfCtx, conn)
+	localSPI := ikeSA.LocalSPI
+
+	// UE context of a first NAS message forwarded to the AMF
+	ikeUe := n3iwfCtx.NewN3iwfIkeUe(localSPI)
+	ikeUe.N3IWFIKESecurityAssociation = ikeSA
+	ikeSA.IkeUE = ikeUe
+	innerIP, err := n3iwfCtx.NewInternalUEIPAddr(ikeUe)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ikeUe.IPSecInnerIP = innerIP
+	ranUeNgapId := int64(42)
+	n3iwfCtx.IkeSpiNgapIdMapping(localSPI, ranUeNgapId)
+	t.Cleanup(func() {
+		n3iwfCtx.DeleteIKEUe(localSPI)
+		n3iwfCtx.DeleteIkeSPIFromNgapId(ranUeNgapId)
+		n3iwfCtx.AllocatedUeIpAddress.Delete(innerIP.String())
+	})
+
+	var payloads message.IKEPayloadContainer
+	eap := payloads.BuildEAP(message.EAPCodeResponse, ikeSA.EAP.Identifier)
+	eap.EAPTypeData.BuildEAPExpanded(message.VendorID3GPP, message.VendorTypeEAP5G,
+		[]byte{message.EAP5GType5GStop, message.EAP5GSpareValue})
+	stopRequest := message.NewMessage(ikeSA.RemoteSPI, localSPI, message.IKE_AUTH, false, true, 2, payloads)
+	n3iwfAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 500}
+	ueAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 2), Port: 500}
+	if err = handleIKEAUTH(conn, n3iwfAddr, ueAddr, stopRequest, ikeSA); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	datagram := conn.next(t)
+	ikeHeader, err := message.ParseHeader(datagram.data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response, err := DecodeDecrypt(datagram.data, ikeHeader, ikeSA.IKESAKey, message.Role_Initiator)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(response.Payloads) != 1 {
+		t.Fatalf("payloads mismatch. got = %d, want = 1", len(response.Payloads))
+	}
+	if eap, ok := response.Payloads[0].(*message.EAP); !ok || eap.Code != message.EAPCodeFailure {
+		t.Errorf("Unexpected EAP payload: %+v", response.Payloads[0])
+	}
+
+	if _, ok := n3iwfCtx.IKESALoad(localSPI); ok {
+		t.Errorf("IKE SA %016x not removed", localSPI)
+	}
+	if _, ok := n3iwfCtx.IkeUePoolLoad(localSPI); ok {
+		t.Errorf("IKE UE %016x not removed", localSPI)
+	}
+	if _, ok := n3iwfCtx.NgapIdLoad(localSPI); ok {
+		t.Errorf("RAN UE NGAP ID of SPI %016x not removed", localSPI)
+	}
+	if _, ok := n3iwfCtx.IkeSpiLoad(ranUeNgapId); ok {
+		t.Errorf("SPI of RAN UE NGAP ID %d not removed", ranUeNgapId)
+	}
+	if _, ok := n3iwfCtx.AllocatedUeIpAddress.Load(innerIP.String()); ok {
+		t.Errorf("inner IP address %s not released", innerIP)
+	}
+}
+
+// readEAP5GRequest decrypts the next IKE_AUTH response sent through conn and
+// returns the vendor data of its EAP-5G request
+func readEAP5GRequest(t *testing.T, conn *fakeIKEConn, ikeSA *context.IKESecurityAssociation) []byte {
+	t.Helper()
+	datagram := conn.next(t)
+	ikeHeader, err := message.ParseHeader(datagram.data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response, err := DecodeDecrypt(datagram.data, ikeHeader, ikeSA.IKESAKey, message.Role_Initiator)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(response.Payloads) != 1 {
+		t.Fatalf("payloads mismatch. got = %d, want = 1", len(response.Payloads))
+	}
+	eap, ok := response.Payloads[0].(*message.EAP)
+	if !ok || eap.Code != message.EAPCodeRequest || eap.Identifier != ikeSA.EAP.Identifier {
+		t.Fatalf("Unexpected EAP payload: %+v", response.Payloads[0])
+	}
+	return eap.EAPTypeData[0].(*message.EAPExpanded).VendorData
+}
+
+func TestEAP5GNASFragmentation(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	defer func(fragmentSize int) { n3iwfCtx.EAP5GFragmentSize = fragmentSize }(n3iwfCtx.EAP5GFragmentSize)
+	n3iwfCtx.EAP5GFragmentSize = 4
+
+	conn := new(fakeIKEConn)
+	ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+	ikeSA.StopHalfOpenTimer()
+	t.Cleanup(func() { n3iwfCtx.DeleteIKESecurityAssociation(ikeSA.LocalSPI) })
+	ikeSA.IKESAKey = newTestIKESAKey(t)
+	ikeSA.RemoteSPI = 0x1111
+	ikeSA.State = EAPSignalling
+	ikeSA.InitiatorMessageID = 2
+	ikeSA.IKEConnection = &context.UDPSocketInfo{
+		Conn:      conn,
+		N3IWFAddr: &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 500},
+		UEAddr:    &net.UDPAddr{IP: net.IPv4(10, 1, 0, 2), Port: 500},
+	}
+	sendEAP5GResponse := func(vendorData []byte) error {
+		var payloads message.IKEPayloadContainer
+		eap := payloads.BuildEAP(message.EAPCodeResponse, ikeSA.EAP.Identifier)
+		eap.EAPTypeData.BuildEAPExpanded(message.VendorID3GPP, message.VendorTypeEAP5G, vendorData)
+		ikeSA.InitiatorMessageID++
+		ikeMsg := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.IKE_AUTH, false, true,
+			ikeSA.InitiatorMessageID, payloads)
+		return handleIKEAUTH(conn, ikeSA.IKEConnection.N3IWFAddr, ikeSA.IKEConnection.UEAddr, ikeMsg, ikeSA)
+	}
+	ack := []byte{message.EAP5GType5GNAS, message.EAP5GSpareValue}
+
+	// NAS PDU sent to the UE, one fragment per acknowledgement
+	nasPDU := []byte{0x7e, 0x00, 0x41, 0x79, 0x00, 0x0d}
+	HandleSendEAPNASMsg(context.NewSendEAPNASMsgEvt(ikeSA.LocalSPI, nasPDU))
+	var received context.EAP5GFragments
+	var vendorData []byte
+	for range 3 {
+		fragment := readEAP5GRequest(t, conn, ikeSA)
+		var err error
+		if vendorData, err = reassembleEAP5GNAS(&received, fragment, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if vendorData != nil {
+			break
+		}
+		if err = sendEAP5GResponse(ack); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	expVendorData, err := message.EAP5GNASVendorData(nasPDU)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(vendorData, expVendorData) {
+		t.Errorf("vendor data mismatch. got = %x, want = %x", vendorData, expVendorData)
+	}
+	if len(ikeSA.EAP5GFragments.Outbound) != 0 {
+		t.Errorf("%d fragments left to send", len(ikeSA.EAP5GFragments.Outbound))
+	}
+
+	// First fragment of the UE, acknowledged by the N3IWF
+	if err = sendEAP5GResponse([]byte{
+		message.EAP5GType5GNAS, message.EAP5GFlagLengthIncluded | message.EAP5GFlagMoreFragments, 0, 8, 0x00, 0x02,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if request := readEAP5GRequest(t, conn, ikeSA); !bytes.Equal(request, ack) {
+		t.Errorf("acknowledgement mismatch. got = %x, want = %x", request, ack)
+	}
+	if len(ikeSA.EAP5GFragments.Inbound) != 2 || ikeSA.EAP5GFragments.InboundLength != 8 {
+		t.Errorf("Unexpected reassembly state: %+v", ikeSA.EAP5GFragments)
+	}
+}
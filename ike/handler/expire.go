@@ -0,0 +1,321 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/logger"
+)
+
+// Wait before the rekey of an expiring child SA is tried again, while another
+// request of the N3IWF waits for the UE answer. Shortened in tests
+var childSARekeyRetryInterval = time.Second
+
+// HandleXfrmStateExpire handles the expiry of the XFRM state with spi to dst
+// reported by the kernel, as a ChildSAExpire event of each IKE SA whose child
+// SAs may own it. States no child SA owns, such as the states of a child SA
+// already deleted, are ignored
+func HandleXfrmStateExpire(spi uint32, dst net.IP, hard bool) {
+	var localSPIs []uint64
+	for _, childSA := range context.N3IWFSelf().XfrmStateCandidates(spi, dst) {
+		ikeUe := childSA.IkeUE
+		if ikeUe == nil || ikeUe.N3IWFIKESecurityAssociation == nil {
+			continue
+		}
+		if localSPI := ikeUe.N3IWFIKESecurityAssociation.LocalSPI; !slices.Contains(localSPIs, localSPI) {
+			localSPIs = append(localSPIs, localSPI)
+		}
+	}
+	if len(localSPIs) == 0 {
+		logger.IKELog.Debugf("expiry of XFRM state 0x%08x without child SA", spi)
+		return
+	}
+	for _, localSPI := range localSPIs {
+		HandleEvent(context.NewXfrmStateExpireEvt(localSPI, spi, dst, hard))
+	}
+}
+
+func HandleChildSAExpire(ikeEvt context.IkeEvt) {
+	logger.IKELog.Debugln("handle ChildSAExpire event")
+
+	childSAExpireEvt := ikeEvt.(*context.ChildSAExpireEvt)
+	localSPI := childSAExpireEvt.LocalSPI
+
+	ikeUe, ok := context.N3IWFSelf().IkeUePoolLoad(localSPI)
+	if !ok {
+		logger.IKELog.Debugf("child SA 0x%08x expired after its IKE SA %016x was deleted",
+			childSAExpireEvt.InboundSPI, localSPI)
+		return
+	}
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	var childSA *context.ChildSecurityAssociation
+	if childSAExpireEvt.StateDst != nil {
+		// MOBIKE moves the states of the child SAs, so their owner is only
+		// resolved with the IKE SA locked
+		if childSA = xfrmStateOwner(ikeUe, childSAExpireEvt.StateSPI, childSAExpireEvt.StateDst); childSA == nil {
+			ikeSA.Log().Debugf("expiry of XFRM state 0x%08x without child SA", childSAExpireEvt.StateSPI)
+			return
+		}
+	} else {
+		// The child SA may have been deleted, or rekeyed by the UE, since the
+		// kernel reported the expiry
+		if childSA, ok = ikeUe.N3IWFChildSecurityAssociation[childSAExpireEvt.InboundSPI]; !ok {
+			ikeSA.Log().Debugf("child SA 0x%08x expired after its deletion", childSAExpireEvt.InboundSPI)
+			return
+		}
+	}
+	if childSAExpireEvt.Hard {
+		expireChildSA(ikeUe, childSA)
+		return
+	}
+	if err := startChildSARekey(ikeUe, childSA); err != nil {
+		ikeSA.Log().Errorf("HandleChildSAExpire(): %v", err)
+	}
+}
+
+// xfrmStateOwner returns the child SA of ikeUe owning the XFRM state with spi
+// to dst: by inbound SPI for a state to the N3IWF, by outbound SPI and peer
+// address for a state to the UE
+func xfrmStateOwner(ikeUe *context.N3IWFIkeUe, spi uint32, dst net.IP) *context.ChildSecurityAssociation {
+	if childSA, ok := ikeUe.N3IWFChildSecurityAssociation[spi]; ok && childSA.LocalPublicIPAddr.Equal(dst) {
+		return childSA
+	}
+	for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+		if childSA.OutboundSPI == spi && childSA.PeerPublicIPAddr.Equal(dst) {
+			return childSA
+		}
+	}
+	return nil
+}
+
+// expireChildSA deletes a child SA whose XFRM states reached their hard
+// lifetime, and were deleted by the kernel, unless a rekey replaces it
+func expireChildSA(ikeUe *context.N3IWFIkeUe, childSA *context.ChildSecurityAssociation) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	if childSA.Rekeyed {
+		return
+	}
+	if pending := ikeSA.PendingChildSARekey; pending != nil && pending.OldInboundSPI == childSA.InboundSPI {
+		return
+	}
+	if childSADeleteRequested(ikeSA, childSA.InboundSPI) {
+		return
+	}
+	ikeSA.Log().Warnf("child SA 0x%08x reached its hard lifetime before being rekeyed", childSA.InboundSPI)
+	queueChildSADelete(ikeUe, &context.ChildSADeleteRequest{InboundSPIs: []uint32{childSA.InboundSPI}})
+}
+
+// childSADeleteRequested reports whether a delete request of the N3IWF,
+// pending or queued, covers the child SA with inbound SPI spi
+func childSADeleteRequested(ikeSA *context.IKESecurityAssociation, spi uint32) bool {
+	requests := ikeSA.QueuedChildSADeletes
+	if ikeSA.PendingChildSADelete != nil {
+		requests = append([]*context.ChildSADeleteRequest{ikeSA.PendingChildSADelete}, requests...)
+	}
+	for _, request := range requests {
+		for _, inboundSPI := range request.InboundSPIs {
+			if inboundSPI == spi {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scheduleChildSARekey reports the soft expiry of the child SA with inbound
+// SPI inboundSPI again after childSARekeyRetryInterval
+func scheduleChildSARekey(localSPI uint64, inboundSPI uint32) {
+	n3iwfCtx := context.N3IWFSelf()
+	time.AfterFunc(childSARekeyRetryInterval, func() {
+		n3iwfCtx.IkeServer.SendEvent(context.NewChildSAExpireEvt(localSPI, inboundSPI, false))
+	})
+}
+
+// startChildSARekey sends the CREATE_CHILD_SA request rekeying a child SA
+// whose XFRM states reached their soft lifetime (RFC 7296 section 1.3.3), with
+// the transforms of the child SA and without PFS. The rekey is postponed while
+// another request of the N3IWF is pending, and completed by completeChildSARekey.
+// Left unanswered, the UE is released, see releaseUnresponsiveUe
+func startChildSARekey(ikeUe *context.N3IWFIkeUe, childSA *context.ChildSecurityAssociation) error {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	// The inbound and outbound states expire alike
+	if childSA.Rekeyed {
+		return nil
+	}
+	if pending := ikeSA.PendingChildSARekey; pending != nil && pending.OldInboundSPI == childSA.InboundSPI {
+		return nil
+	}
+	if childSADeleteRequested(ikeSA, childSA.InboundSPI) {
+		return nil
+	}
+	if ikeUe.IKEConnection == nil || ikeSA.IKEConnection == nil {
+		return errors.New("startChildSARekey: IKE SA not established")
+	}
+	if n3iwfRequestPending(ikeSA) {
+		ikeSA.Log().Debugf("rekey of child SA 0x%08x postponed, another request is pending", childSA.InboundSPI)
+		scheduleChildSARekey(ikeSA.LocalSPI, childSA.InboundSPI)
+		return nil
+	}
+	if childSA.ChildSAKey == nil {
+		return fmt.Errorf("startChildSARekey: child SA 0x%08x has no keys", childSA.InboundSPI)
+	}
+
+	n3iwfCtx := ikeUe.N3iwfCtx
+	inboundSPI, err := allocateChildSAInboundSPI(n3iwfCtx)
+	if err != nil {
+		return fmt.Errorf("startChildSARekey: %w", err)
+	}
+	proposal, err := childSA.ToProposal()
+	if err != nil {
+		return fmt.Errorf("startChildSARekey: %w", err)
+	}
+	proposal.ProposalNumber = 1
+	proposal.SPI = binary.BigEndian.AppendUint32(nil, inboundSPI)
+	proposal.DiffieHellmanGroup = nil
+
+	localNonceBigInt, err := security.GenerateRandomNumber()
+	if err != nil {
+		return fmt.Errorf("startChildSARekey: %w", err)
+	}
+	localNonce := localNonceBigInt.Bytes()
+
+	var requestPayload message.IKEPayloadContainer
+	requestPayload.BuildNotification(message.TypeESP, message.REKEY_SA,
+		binary.BigEndian.AppendUint32(nil, childSA.InboundSPI), nil)
+	requestSA := requestPayload.BuildSecurityAssociation()
+	requestSA.Proposals = append(requestSA.Proposals, proposal)
+	requestPayload.BuildNonce(localNonce)
+	if childSA.TransportMode {
+		requestPayload.BuildNotification(message.TypeNone, message.USE_TRANSPORT_MODE, nil, nil)
+	}
+	// The N3IWF is the initiator of the exchange
+	requestPayload = append(requestPayload,
+		&message.TrafficSelectorInitiator{TrafficSelectors: childSATrafficSelectors(
+			childSA.TrafficSelectorLocal, childSA.SelectedIPProtocol, childSA.SelectedLocalPort)},
+		&message.TrafficSelectorResponder{TrafficSelectors: childSATrafficSelectors(
+			childSA.TrafficSelectorRemote, childSA.SelectedIPProtocol, childSA.SelectedRemotePort)})
+
+	request := &context.ChildSARekeyRequest{
+		MessageID:        ikeSA.ResponderMessageID,
+		OldInboundSPI:    childSA.InboundSPI,
+		NewInboundSPI:    inboundSPI,
+		LocalNonce:       localNonce,
+		OfferedProposals: requestSA.Proposals,
+	}
+	ikeMessage := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.CREATE_CHILD_SA,
+		false, false, request.MessageID, requestPayload)
+	request.Retransmit, err = sendRetransmittedChildSARequest(ikeUe, ikeMessage, func() {
+		ikeSA.Log().Warnf("CREATE_CHILD_SA request %d rekeying child SA 0x%08x unanswered, release the UE",
+			request.MessageID, request.OldInboundSPI)
+		releaseUnresponsiveUe(ikeUe)
+	})
+	if err != nil {
+		return fmt.Errorf("startChildSARekey: %w", err)
+	}
+	ikeSA.PendingChildSARekey = request
+	ikeSA.Log().Infof("rekey child SA 0x%08x reaching its soft lifetime", childSA.InboundSPI)
+	return nil
+}
+
+// childSATrafficSelectors returns the traffic selector of the host address of
+// ipNet, with protocol and port, any when 0
+func childSATrafficSelectors(ipNet net.IPNet, protocol uint8, port uint16) message.IndividualTrafficSelectorContainer {
+	var trafficSelectors message.IndividualTrafficSelectorContainer
+	tsType, ip := uint8(message.TS_IPV6_ADDR_RANGE), ipNet.IP.To16()
+	if ipv4 := ipNet.IP.To4(); ipv4 != nil {
+		tsType, ip = message.TS_IPV4_ADDR_RANGE, ipv4
+	}
+	startPort, endPort := portRange(port)
+	trafficSelectors.BuildIndividualTrafficSelector(tsType, protocol, startPort, endPort, ip, ip)
+	return trafficSelectors
+}
+
+// completeChildSARekey installs the child SA negotiated by the UE answer to
+// the pending rekey request, moves the traffic over to it, and asks the UE to
+// delete the old child SA. Refused by the UE, the old child SA is kept until its
+// hard lifetime, the rekey being tried again on TEMPORARY_FAILURE
+func completeChildSARekey(ikeSecurityAssociation *context.IKESecurityAssociation,
+	securityAssociation *message.SecurityAssociation, nonce *message.Nonce, notifications []*message.Notification,
+) error {
+	ikeUe := ikeSecurityAssociation.IkeUE
+	pending := ikeSecurityAssociation.PendingChildSARekey
+	pending.Retransmit.Stop()
+	ikeSecurityAssociation.PendingChildSARekey = nil
+	ikeSecurityAssociation.ResponderMessageID++
+	defer sendQueuedRequests(ikeUe)
+
+	oldChildSA, ok := ikeUe.N3IWFChildSecurityAssociation[pending.OldInboundSPI]
+	if !ok {
+		return fmt.Errorf("child SA 0x%08x deleted during its rekey", pending.OldInboundSPI)
+	}
+	if errorNotification := childSAErrorNotification(notifications); errorNotification != nil {
+		if errorNotification.NotifyMessageType == message.TEMPORARY_FAILURE {
+			scheduleChildSARekey(ikeSecurityAssociation.LocalSPI, oldChildSA.InboundSPI)
+		}
+		return fmt.Errorf("UE refused the rekey of child SA 0x%08x with notify %d", oldChildSA.InboundSPI,
+			errorNotification.NotifyMessageType)
+	}
+	if err := checkChosenChildSAProposal(pending.OfferedProposals, securityAssociation); err != nil {
+		return fmt.Errorf("rekey of child SA 0x%08x: %w", oldChildSA.InboundSPI, err)
+	}
+	if nonce == nil {
+		return fmt.Errorf("rekey of child SA 0x%08x: nonce missing", oldChildSA.InboundSPI)
+	}
+	transportMode := findNotification(notifications, message.USE_TRANSPORT_MODE) != nil
+	if transportMode != oldChildSA.TransportMode {
+		return fmt.Errorf("rekey of child SA 0x%08x: UE changed the ESP mode", oldChildSA.InboundSPI)
+	}
+
+	proposal := securityAssociation.Proposals[0]
+	outboundSPI := binary.BigEndian.Uint32(proposal.SPI)
+	if err := ikeUe.CheckOutboundSPI(outboundSPI, oldChildSA.PeerPublicIPAddr); err != nil {
+		return fmt.Errorf("rekey of child SA 0x%08x: %w", oldChildSA.InboundSPI, err)
+	}
+	newChildSA := newRekeyedChildSA(oldChildSA, pending.NewInboundSPI, outboundSPI, transportMode, true)
+	var err error
+	if newChildSA.ChildSAKey, err = security.NewChildSAKeyByProposal(proposal); err != nil {
+		return fmt.Errorf("rekey of child SA 0x%08x: %w", oldChildSA.InboundSPI, err)
+	}
+	concatenatedNonce := bytes.Clone(pending.LocalNonce)
+	concatenatedNonce = append(concatenatedNonce, nonce.NonceData...)
+	if err = newChildSA.GenerateKeyForChildSA(ikeSecurityAssociation.IKESAKey, nil, concatenatedNonce); err != nil {
+		return fmt.Errorf("rekey of child SA 0x%08x: %w", oldChildSA.InboundSPI, err)
+	}
+
+	n3iwfCtx := ikeUe.N3iwfCtx
+	if err = rekeyXFRMRule(true, childSAXfrmIfaceId(n3iwfCtx, oldChildSA), newChildSA, oldChildSA); err != nil {
+		return fmt.Errorf("rekey of child SA 0x%08x: %w", oldChildSA.InboundSPI, err)
+	}
+	oldChildSA.Rekeyed = true
+	ikeUe.N3IWFChildSecurityAssociation[newChildSA.InboundSPI] = newChildSA
+	n3iwfCtx.ChildSA.Store(newChildSA.InboundSPI, newChildSA)
+	n3iwfCtx.IndexOutboundSPI(newChildSA)
+	ikeSecurityAssociation.Log().Infof("child SA rekeyed by the N3IWF: inbound SPI 0x%08x -> 0x%08x",
+		oldChildSA.InboundSPI, newChildSA.InboundSPI)
+	n3iwfCtx.AuditChildSA(ikeSecurityAssociation, newChildSA, context.AuditEstablish, context.AuditRekey)
+
+	// RFC 7296 section 2.8: the initiator of the rekey deletes the old child SA
+	queueChildSADelete(ikeUe, &context.ChildSADeleteRequest{InboundSPIs: []uint32{oldChildSA.InboundSPI}})
+	return nil
+}
+
+// childSAXfrmIfaceId returns the if_id of the XFRM interface the states of a
+// child SA are bound to
+func childSAXfrmIfaceId(n3iwfCtx *context.N3IWFContext, childSA *context.ChildSecurityAssociation) uint32 {
+	if len(childSA.XfrmStateList) == 0 {
+		return n3iwfCtx.DefaultXfrmIfaceId()
+	}
+	return uint32(childSA.XfrmStateList[0].Ifid) // #nosec G115
+}
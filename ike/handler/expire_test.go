@@ -0,0 +1,325 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"golang.org/x/sys/unix"
+)
+
+// newExpireTestChildSA adds to ikeUe a child SA with inbound SPI spi, keyed
+// as negotiated with AES-CBC-128 and HMAC-SHA1-96
+func newExpireTestChildSA(t *testing.T, ikeUe *context.N3IWFIkeUe, spi uint32) *context.ChildSecurityAssociation {
+	t.Helper()
+	keyLength := uint16(128)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	proposal := new(message.Proposal)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+	childSAKey, err := security.NewChildSAKeyByProposal(proposal)
+	if err != nil {
+		t.Fatalf("NewChildSAKeyByProposal failed: %v", err)
+	}
+
+	_, tsLocal, _ := net.ParseCIDR("10.0.0.1/32")
+	_, tsRemote, _ := net.ParseCIDR("10.0.0.5/32")
+	childSA := &context.ChildSecurityAssociation{
+		InboundSPI:            spi,
+		OutboundSPI:           spi + 0x1000,
+		PeerPublicIPAddr:      ikeUe.IKEConnection.UEAddr.IP,
+		LocalPublicIPAddr:     ikeUe.IKEConnection.N3IWFAddr.IP,
+		SelectedIPProtocol:    unix.IPPROTO_GRE,
+		TrafficSelectorLocal:  *tsLocal,
+		TrafficSelectorRemote: *tsRemote,
+		PDUSessionIds:         []int64{1},
+		ChildSAKey:            childSAKey,
+		IkeUE:                 ikeUe,
+	}
+	ikeUe.N3IWFChildSecurityAssociation[spi] = childSA
+	n3iwfCtx := context.N3IWFSelf()
+	n3iwfCtx.ChildSA.Store(spi, childSA)
+	t.Cleanup(func() { n3iwfCtx.ChildSA.Delete(spi) })
+	return childSA
+}
+
+// readCreateChildSARequest reads the next request received by ueConn, which
+// must be a CREATE_CHILD_SA request of the N3IWF
+func readCreateChildSARequest(t *testing.T, ueConn *net.UDPConn, ikeUe *context.N3IWFIkeUe) *message.IKEMessage {
+	t.Helper()
+	msg := readDatagram(t, ueConn)
+	ikeHeader, err := message.ParseHeader(msg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.Lock()
+	request, err := DecodeDecrypt(msg, ikeHeader, ikeSA.IKESAKey, message.Role_Initiator)
+	ikeSA.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if request.ExchangeType != message.CREATE_CHILD_SA || request.IsResponse() {
+		t.Fatalf("Unexpected request: exchange %d, response %v", request.ExchangeType, request.IsResponse())
+	}
+	return request
+}
+
+func TestChildSARekeyOnSoftExpiry(t *testing.T) {
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	n3iwfCtx := context.N3IWFSelf()
+	oldChildSA := newExpireTestChildSA(t, ikeUe, 0x1001)
+
+	var xfrmCalls int
+	var newChildSA *context.ChildSecurityAssociation
+	origRekeyXFRMRule := rekeyXFRMRule
+	defer func() { rekeyXFRMRule = origRekeyXFRMRule }()
+	rekeyXFRMRule = func(n3iwfIsInitiator bool, xfrmiId uint32, newSA, old *context.ChildSecurityAssociation) error {
+		xfrmCalls++
+		if !n3iwfIsInitiator || xfrmiId != n3iwfCtx.DefaultXfrmIfaceId() || old != oldChildSA {
+			t.Errorf("unexpected XFRM rekey arguments: %v %d %p", n3iwfIsInitiator, xfrmiId, old)
+		}
+		newChildSA = newSA
+		return nil
+	}
+
+	HandleEvent(context.NewChildSAExpireEvt(ikeSA.LocalSPI, oldChildSA.InboundSPI, false))
+	request := readCreateChildSARequest(t, ueConn, ikeUe)
+	if request.MessageID != 7 {
+		t.Errorf("message ID mismatch. got = %d, want = 7", request.MessageID)
+	}
+	var requestSA *message.SecurityAssociation
+	var rekeySA *message.Notification
+	var hasNonce, hasTSi, hasTSr bool
+	for _, payload := range request.Payloads {
+		switch payload := payload.(type) {
+		case *message.SecurityAssociation:
+			requestSA = payload
+		case *message.Notification:
+			if payload.NotifyMessageType == message.REKEY_SA {
+				rekeySA = payload
+			}
+		case *message.Nonce:
+			hasNonce = true
+		case *message.TrafficSelectorInitiator:
+			hasTSi = true
+		case *message.TrafficSelectorResponder:
+			hasTSr = true
+		}
+	}
+	if rekeySA == nil || rekeySA.ProtocolID != message.TypeESP ||
+		!bytes.Equal(rekeySA.SPI, binary.BigEndian.AppendUint32(nil, oldChildSA.InboundSPI)) {
+		t.Fatalf("REKEY_SA notify mismatch: %+v", rekeySA)
+	}
+	if requestSA == nil || len(requestSA.Proposals) != 1 || !hasNonce || !hasTSi || !hasTSr {
+		t.Fatalf("CREATE_CHILD_SA request payloads mismatch: %+v", request.Payloads)
+	}
+	offered := requestSA.Proposals[0]
+	if len(offered.DiffieHellmanGroup) != 0 {
+		t.Errorf("unexpected PFS in the rekey: %+v", offered.DiffieHellmanGroup)
+	}
+
+	// The expiry of the other state of the child SA is ignored
+	HandleEvent(context.NewChildSAExpireEvt(ikeSA.LocalSPI, oldChildSA.InboundSPI, false))
+	ikeSA.Lock()
+	pending := ikeSA.PendingChildSARekey
+	ikeSA.Unlock()
+	if pending == nil || pending.OldInboundSPI != oldChildSA.InboundSPI ||
+		!bytes.Equal(offered.SPI, binary.BigEndian.AppendUint32(nil, pending.NewInboundSPI)) {
+		t.Fatalf("pending rekey mismatch: %+v", pending)
+	}
+
+	var payloads message.IKEPayloadContainer
+	responseSA := payloads.BuildSecurityAssociation()
+	chosen := responseSA.Proposals.BuildProposal(offered.ProposalNumber, message.TypeESP, []byte{0x00, 0x00, 0x40, 0x04})
+	chosen.EncryptionAlgorithm = offered.EncryptionAlgorithm
+	chosen.IntegrityAlgorithm = offered.IntegrityAlgorithm
+	chosen.ExtendedSequenceNumbers = offered.ExtendedSequenceNumbers
+	payloads.BuildNonce(bytes.Repeat([]byte{0x42}, 32))
+	response := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.CREATE_CHILD_SA, true, false, 7, payloads)
+	conn := ikeUe.IKEConnection
+	ikeSA.Lock()
+	err := handleCREATECHILDSA(conn.Conn, conn.N3IWFAddr, conn.UEAddr, response, ikeSA)
+	ikeSA.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if xfrmCalls != 1 || newChildSA == nil {
+		t.Fatalf("XFRM rekey calls mismatch. got = %d, want = 1", xfrmCalls)
+	}
+	defer n3iwfCtx.ChildSA.Delete(newChildSA.InboundSPI)
+	if newChildSA.InboundSPI != pending.NewInboundSPI || newChildSA.OutboundSPI != 0x4004 ||
+		!newChildSA.LocalIsInitiator || !slices.Equal(newChildSA.PDUSessionIds, oldChildSA.PDUSessionIds) {
+		t.Errorf("new child SA mismatch: %+v", newChildSA)
+	}
+	if ikeUe.N3IWFChildSecurityAssociation[newChildSA.InboundSPI] != newChildSA || !oldChildSA.Rekeyed {
+		t.Errorf("new child SA not installed")
+	}
+
+	// The N3IWF deletes the old child SA with the next request
+	messageID, deletePayload := readDeleteRequest(t, ueConn, ikeUe)
+	if messageID != 8 || !slices.Equal(deletePayload.SPIs, []uint32{oldChildSA.InboundSPI}) {
+		t.Fatalf("Unexpected delete request %d: %x", messageID, deletePayload.SPIs)
+	}
+	answerDelete(ikeUe, messageID)
+	if _, ok := ikeUe.N3IWFChildSecurityAssociation[oldChildSA.InboundSPI]; ok {
+		t.Errorf("old child SA 0x%08x not deleted", oldChildSA.InboundSPI)
+	}
+	if ikeUe.N3IWFChildSecurityAssociation[newChildSA.InboundSPI] != newChildSA {
+		t.Errorf("new child SA 0x%08x deleted with the old one", newChildSA.InboundSPI)
+	}
+}
+
+func TestChildSAHardExpiry(t *testing.T) {
+	testcases := []struct {
+		description string
+		inboundSPI  uint32
+		rekeying    bool
+		expDelete   bool
+	}{
+		{
+			description: "not rekeyed",
+			inboundSPI:  0x1001,
+			expDelete:   true,
+		},
+		{
+			description: "rekey pending",
+			inboundSPI:  0x1001,
+			rekeying:    true,
+		},
+		{
+			description: "already deleted",
+			inboundSPI:  0x3003,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeUe, ueConn := newDeleteTestIkeUe(t)
+			ikeSA := ikeUe.N3IWFIKESecurityAssociation
+			newExpireTestChildSA(t, ikeUe, 0x1001)
+			if tc.rekeying {
+				ikeSA.PendingChildSARekey = &context.ChildSARekeyRequest{MessageID: 7, OldInboundSPI: 0x1001}
+			}
+
+			HandleEvent(context.NewChildSAExpireEvt(ikeSA.LocalSPI, tc.inboundSPI, true))
+			ikeSA.Lock()
+			pendingDelete := ikeSA.PendingChildSADelete
+			ikeSA.Unlock()
+			if !tc.expDelete {
+				if pendingDelete != nil {
+					t.Fatalf("unexpected delete request: %+v", pendingDelete)
+				}
+				return
+			}
+			messageID, deletePayload := readDeleteRequest(t, ueConn, ikeUe)
+			if messageID != 7 || !slices.Equal(deletePayload.SPIs, []uint32{tc.inboundSPI}) {
+				t.Fatalf("Unexpected delete request %d: %x", messageID, deletePayload.SPIs)
+			}
+			answerDelete(ikeUe, messageID)
+		})
+	}
+}
+
+func TestXfrmStateExpire(t *testing.T) {
+	testcases := []struct {
+		description string
+		spi         uint32
+		dst         string
+		expDelete   bool
+	}{
+		{"inbound state", 0x1001, "192.0.2.1", true},
+		{"outbound state", 0x2001, "198.51.100.7", true},
+		{"inbound SPI to another address", 0x1001, "198.51.100.7", false},
+		{"outbound SPI to another address", 0x2001, "192.0.2.1", false},
+		{"unknown SPI", 0x3003, "192.0.2.1", false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeUe, _ := newDeleteTestIkeUe(t)
+			ikeSA := ikeUe.N3IWFIKESecurityAssociation
+			childSA := newExpireTestChildSA(t, ikeUe, 0x1001)
+			childSA.LocalPublicIPAddr = net.ParseIP("192.0.2.1")
+			childSA.PeerPublicIPAddr = net.ParseIP("198.51.100.7")
+			context.N3IWFSelf().IndexOutboundSPI(childSA)
+
+			HandleXfrmStateExpire(tc.spi, net.ParseIP(tc.dst), true)
+			ikeSA.Lock()
+			pendingDelete := ikeSA.PendingChildSADelete
+			ikeSA.Unlock()
+			if tc.expDelete && (pendingDelete == nil || !slices.Equal(pendingDelete.InboundSPIs, []uint32{0x1001})) {
+				t.Errorf("delete request mismatch: %+v", pendingDelete)
+			}
+			if !tc.expDelete && pendingDelete != nil {
+				t.Errorf("unexpected delete request: %+v", pendingDelete)
+			}
+		})
+	}
+}
+
+func TestChildSARekeyPostponed(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	origIkeServer, origRetryInterval := n3iwfCtx.IkeServer, childSARekeyRetryInterval
+	defer func() { n3iwfCtx.IkeServer, childSARekeyRetryInterval = origIkeServer, origRetryInterval }()
+	n3iwfCtx.IkeServer = &context.IkeServer{RcvEventCh: make(chan context.IkeEvt, 1)}
+	childSARekeyRetryInterval = 10 * time.Millisecond
+
+	ikeUe, _ := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	childSA := newExpireTestChildSA(t, ikeUe, 0x1001)
+	// A delete of another child SA waits for the UE answer
+	ikeSA.PendingChildSADelete = &context.ChildSADeleteRequest{MessageID: 7, InboundSPIs: []uint32{0x5005}}
+
+	HandleEvent(context.NewChildSAExpireEvt(ikeSA.LocalSPI, childSA.InboundSPI, false))
+	if ikeSA.PendingChildSARekey != nil || ikeSA.ResponderMessageID != 7 {
+		t.Fatalf("rekey started while a delete is pending")
+	}
+	select {
+	case ikeEvt := <-n3iwfCtx.IkeServer.RcvEventCh:
+		expireEvt, ok := ikeEvt.(*context.ChildSAExpireEvt)
+		if !ok || expireEvt.LocalSPI != ikeSA.LocalSPI || expireEvt.InboundSPI != childSA.InboundSPI || expireEvt.Hard {
+			t.Errorf("Unexpected event: %+v", ikeEvt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rekey not tried again")
+	}
+}
+
+func TestChildSARekeyUnanswered(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	retransmitInterval, maxRetransmissions := n3iwfCtx.ChildSARetransmitInterval, n3iwfCtx.ChildSAMaxRetransmissions
+	defer func() {
+		n3iwfCtx.ChildSARetransmitInterval, n3iwfCtx.ChildSAMaxRetransmissions = retransmitInterval, maxRetransmissions
+	}()
+	n3iwfCtx.ChildSARetransmitInterval, n3iwfCtx.ChildSAMaxRetransmissions = 10*time.Millisecond, 1
+
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	childSA := newExpireTestChildSA(t, ikeUe, 0x1001)
+
+	HandleEvent(context.NewChildSAExpireEvt(ikeSA.LocalSPI, childSA.InboundSPI, false))
+	readCreateChildSARequest(t, ueConn, ikeUe)
+	readCreateChildSARequest(t, ueConn, ikeUe)
+
+	// Without NGAP context, the UE is removed right away
+	waitIkeUeRemoved(t, ikeSA.LocalSPI)
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	if !ikeSA.Unresponsive || ikeSA.TeardownReason != context.AuditDPDTimeout || ikeSA.ResponderMessageID != 7 {
+		t.Errorf("unresponsive SA mismatch: unresponsive %v, reason %v, message ID %d",
+			ikeSA.Unresponsive, ikeSA.TeardownReason, ikeSA.ResponderMessageID)
+	}
+}
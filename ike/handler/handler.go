@@ -7,15 +7,15 @@ package handler
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
 	"net"
+	"slices"
 	"sync/atomic"
 	"time"
 
@@ -51,8 +51,169 @@ func parseIKEPayloads(payloads []message.IKEPayload) map[message.IKEPayloadType]
 	return result
 }
 
+// assertPayload returns ikePayload as T, nil if the payload is absent. A
+// payload decoded as another concrete type than its type field announces
+// makes the message malformed
+func assertPayload[T message.IKEPayload](ikePayload any) (T, error) {
+	var zero T
+	if ikePayload == nil {
+		return zero, nil
+	}
+	payload, ok := ikePayload.(T)
+	if !ok {
+		return zero, fmt.Errorf("payload decoded as %T instead of %T: %w", ikePayload, zero, ErrInvalidSyntax)
+	}
+	return payload, nil
+}
+
+// ExchangeError reports an IKE request answered with the error notification
+// Notify. The other errors of the exchange handlers mean that the message was
+// dropped or could not be answered
+type ExchangeError struct {
+	Notify uint16
+	Err    error
+}
+
+func (e *ExchangeError) Error() string {
+	return fmt.Sprintf("%v, answered with notify %d", e.Err, e.Notify)
+}
+
+func (e *ExchangeError) Unwrap() error {
+	return e.Err
+}
+
+// Number of IKE messages whose handling failed, by exchange type
+var exchangeFailures = map[uint8]*atomic.Uint64{
+	message.IKE_SA_INIT:     new(atomic.Uint64),
+	message.IKE_AUTH:        new(atomic.Uint64),
+	message.CREATE_CHILD_SA: new(atomic.Uint64),
+	message.INFORMATIONAL:   new(atomic.Uint64),
+}
+
+// ExchangeFailures returns the number of IKE messages of exchangeType whose
+// handling failed, the requests rejected with an error notification included
+func ExchangeFailures(exchangeType uint8) uint64 {
+	if counter, ok := exchangeFailures[exchangeType]; ok {
+		return counter.Load()
+	}
+	return 0
+}
+
+// logExchangeError logs and counts the failure of the handler of an exchange.
+// Rejected requests are expected from misbehaving UEs and only warned about
+func logExchangeError(ikeSecurityAssociation *context.IKESecurityAssociation, exchangeType uint8,
+	handlerName string, err error,
+) {
+	if err == nil {
+		return
+	}
+	exchangeFailures[exchangeType].Add(1)
+	var exchangeErr *ExchangeError
+	if errors.As(err, &exchangeErr) {
+		ikeSecurityAssociation.Log().Warnf("%s(): %v", handlerName, err)
+		if ikeSecurityAssociation != nil {
+			ikeSecurityAssociation.LogTranscript(err)
+		}
+		return
+	}
+	ikeSecurityAssociation.Log().Errorf("%s(): %v", handlerName, err)
+}
+
+// rejectMalformedMessage answers a protected request whose payloads do not
+// match their types with INVALID_SYNTAX; malformed responses are dropped
+func rejectMalformedMessage(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation, err error,
+) error {
+	err = fmt.Errorf("malformed message (message ID %d): %w", ikeMsg.MessageID, err)
+	if ikeMsg.IsResponse() {
+		return err
+	}
+	sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, message.INVALID_SYNTAX)
+	return &ExchangeError{Notify: message.INVALID_SYNTAX, Err: err}
+}
+
+// rejectUnsupportedCriticalPayload answers a protected request carrying a
+// payload of an unrecognized type marked critical with UNSUPPORTED_CRITICAL_PAYLOAD
+// and the payload type (RFC 7296 section 2.5); such responses are dropped
+func rejectUnsupportedCriticalPayload(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation,
+	payload *message.UnknownPayload,
+) error {
+	err := fmt.Errorf("unsupported critical payload type %d (message ID %d)", payload.PayloadType, ikeMsg.MessageID)
+	if ikeMsg.IsResponse() {
+		return err
+	}
+	sendProtectedNotifyResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+		message.UNSUPPORTED_CRITICAL_PAYLOAD, []byte{byte(payload.PayloadType)})
+	return &ExchangeError{Notify: message.UNSUPPORTED_CRITICAL_PAYLOAD, Err: err}
+}
+
+// sendEAPFailure ends the EAP-5G authentication of an IKE_AUTH request with
+// an EAP Failure carrying the identifier of the UE response (RFC 3748 section 4.2)
+func sendEAPFailure(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation,
+) {
+	var payload message.IKEPayloadContainer
+	payload.BuildEAPFailure(ikeSecurityAssociation.EAP.Identifier)
+	msg := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
+		message.IKE_AUTH, true, false, ikeMsg.MessageID, payload)
+	if err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, msg, ikeSecurityAssociation.IKESAKey); err != nil {
+		ikeSecurityAssociation.Log().Errorf("sendEAPFailure: %v", err)
+	}
+	ikeSecurityAssociation.LogTranscript(errors.New("EAP-5G authentication failed"))
+	observeEstablishment(ikeSecurityAssociation, EstablishmentEAPFailure)
+	reapFailedIKESA(ikeSecurityAssociation)
+}
+
+// reapFailedIKESA releases an IKE SA whose EAP-5G authentication or IKE_AUTH
+// failed, with its IKE UE context, inner IP address and SPI mappings, so that
+// UEs failing authentication over and over leak nothing. The RAN UE context,
+// if any, is left to the UE Context Release of the AMF
+func reapFailedIKESA(ikeSecurityAssociation *context.IKESecurityAssociation) {
+	n3iwfCtx := context.N3IWFSelf()
+	localSPI := ikeSecurityAssociation.LocalSPI
+	n3iwfCtx.AuditIKESATeardown(ikeSecurityAssociation, context.AuditAuthFailure)
+	if ranUeNgapId, ok := n3iwfCtx.NgapIdLoad(localSPI); ok {
+		n3iwfCtx.DeleteIkeSPIFromNgapId(ranUeNgapId)
+	}
+	if ikeUe := ikeSecurityAssociation.IkeUE; ikeUe != nil {
+		ikeSecurityAssociation.IkeUE = nil
+		if err := ikeUe.Remove(); err != nil {
+			ikeSecurityAssociation.Log().Errorf("reapFailedIKESA: %v", err)
+		}
+	}
+	n3iwfCtx.DeleteNgapIdFromIkeSPI(localSPI)
+	n3iwfCtx.DeleteIKESecurityAssociation(localSPI)
+	ikeSecurityAssociation.Log().Infof("reap failed IKE SA: SPI %016x", localSPI)
+}
+
+// releaseFailedIKESA reaps an IKE SA failing before NAS reaches the UE over
+// the CP child SA, see reapFailedIKESA, and asks the AMF to release the UE
+// context, if any
+func releaseFailedIKESA(n3iwfCtx *context.N3IWFContext, ikeSecurityAssociation *context.IKESecurityAssociation) {
+	ranUeNgapId, bound := n3iwfCtx.NgapIdLoad(ikeSecurityAssociation.LocalSPI)
+	reapFailedIKESA(ikeSecurityAssociation)
+	if !bound {
+		return
+	}
+	err := n3iwfCtx.SendNgapEvent(context.NewSendUEContextReleaseRequestEvt(ranUeNgapId, context.ErrRadioConnWithUeLost))
+	if err != nil {
+		ikeSecurityAssociation.Log().Errorf("releaseFailedIKESA(): %v", err)
+	}
+}
+
+// rejectIKESAINIT answers an IKE_SA_INIT request with the error notification
+// notifyType, err being the reason of the rejection
+func rejectIKESAINIT(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage,
+	notifyType uint16, notifyData []byte, err error,
+) error {
+	sendErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
+		message.IKE_SA_INIT, ikeMsg.MessageID, notifyType, notifyData)
+	return &ExchangeError{Notify: notifyType, Err: err}
+}
+
 // Helper for error response
-func sendErrorResponse(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, spiI, spiR uint64, msgType uint8, msgID uint32, notifyType uint16, key []byte) {
+func sendErrorResponse(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, spiI, spiR uint64, msgType uint8, msgID uint32, notifyType uint16, key []byte) {
 	var payload message.IKEPayloadContainer
 	payload.Reset()
 	payload.BuildNotification(message.TypeNone, notifyType, nil, key)
@@ -62,19 +223,122 @@ func sendErrorResponse(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, spi
 	}
 }
 
-func HandleIKESAINIT(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, realMessage1 []byte) {
+// redirectSupported reports whether the UE announced REDIRECT_SUPPORTED
+func redirectSupported(notifications []*message.Notification) bool {
+	for _, notification := range notifications {
+		if notification.NotifyMessageType == message.REDIRECT_SUPPORTED {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateSignatureHashAlgorithms records the hash algorithms the UE accepts
+// in digital signatures, announced with SIGNATURE_HASH_ALGORITHMS (RFC 7427
+// section 4), and answers with those the N3IWF supports
+func negotiateSignatureHashAlgorithms(ikeSecurityAssociation *context.IKESecurityAssociation,
+	notifications []*message.Notification, responseIKEPayload *message.IKEPayloadContainer,
+) {
+	notification := findNotification(notifications, message.SIGNATURE_HASH_ALGORITHMS)
+	if notification == nil {
+		return
+	}
+	notificationData := notification.NotificationData
+	if len(notificationData) == 0 || len(notificationData)%2 != 0 {
+		ikeSecurityAssociation.Log().Warnf("ignore SIGNATURE_HASH_ALGORITHMS of %d bytes", len(notificationData))
+		return
+	}
+	hashAlgorithms := make([]uint16, 0, len(notificationData)/2)
+	for i := 0; i < len(notificationData); i += 2 {
+		hashAlgorithms = append(hashAlgorithms, binary.BigEndian.Uint16(notificationData[i:]))
+	}
+	ikeSecurityAssociation.Log().Debugf("signature hash algorithms of UE: %v", hashAlgorithms)
+	ikeSecurityAssociation.SignatureHashAlgorithms = hashAlgorithms
+	responseIKEPayload.BuildNotifySignatureHashAlgorithms(security.SignatureHashAlgorithms)
+}
+
+// sendRedirectResponse answers IKE_SA_INIT with a REDIRECT notification (RFC 5685)
+func sendRedirectResponse(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, gateway string, nonceData []byte,
+) {
+	var payload message.IKEPayloadContainer
+	if err := payload.BuildNotifyREDIRECT(gateway, nonceData); err != nil {
+		logger.IKELog.Errorf("sendRedirectResponse: %v", err)
+		return
+	}
+	logger.IKELog.Infof("redirect UE %v to gateway %s", ueAddr, gateway)
+	msg := message.NewMessage(ikeMsg.InitiatorSPI, 0, message.IKE_SA_INIT, true, false, ikeMsg.MessageID, payload)
+	if err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, msg, nil); err != nil {
+		logger.IKELog.Errorf("sendRedirectResponse: %v", err)
+	}
+}
+
+// sendCookie answers IKE_SA_INIT with a COOKIE notification the UE must echo
+// in its next IKE_SA_INIT (RFC 7296 section 2.6)
+func sendCookie(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage,
+	cookieSecrets *context.CookieSecrets, nonceData []byte,
+) error {
+	cookie, err := cookieSecrets.Cookie(nonceData, ueAddr.IP, ikeMsg.InitiatorSPI)
+	if err != nil {
+		return fmt.Errorf("sendCookie: %w", err)
+	}
+	logger.IKELog.Debugf("demand a cookie from UE %v", ueAddr)
+	sendErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg.InitiatorSPI, 0, message.IKE_SA_INIT, ikeMsg.MessageID,
+		message.COOKIE, cookie)
+	return nil
+}
+
+// HandleIKESAINIT handles an IKE_SA_INIT request, logging and counting its failure
+func HandleIKESAINIT(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, realMessage1 []byte) {
+	logExchangeError(nil, message.IKE_SA_INIT, "HandleIKESAINIT", handleIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, realMessage1))
+}
+
+func handleIKESAINIT(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, realMessage1 []byte) error {
 	logger.IKELog.Infoln("handle IKE_SA_INIT")
+	received := time.Now()
+
+	// Counted by the limiter, not as a failure
+	if !context.N3IWFSelf().IKESAInitLimiter.Allow(ueAddr.IP) {
+		logger.IKELog.Warnf("IKE_SA_INIT rate limit exceeded for %s, dropping", ueAddr.IP)
+		return nil
+	}
 
 	payloads := parseIKEPayloads(ikeMsg.Payloads)
-	securityAssociation, _ := payloads[message.TypeSA].(*message.SecurityAssociation)
-	keyExcahge, _ := payloads[message.TypeKE].(*message.KeyExchange)
-	nonce, _ := payloads[message.TypeNiNr].(*message.Nonce)
+	securityAssociation, errSA := assertPayload[*message.SecurityAssociation](payloads[message.TypeSA])
+	keyExcahge, errKE := assertPayload[*message.KeyExchange](payloads[message.TypeKE])
+	nonce, errNonce := assertPayload[*message.Nonce](payloads[message.TypeNiNr])
+	if err := errors.Join(errSA, errKE, errNonce); err != nil {
+		return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.INVALID_SYNTAX, nil,
+			fmt.Errorf("malformed IKE_SA_INIT message: %w", err))
+	}
 	var notifications []*message.Notification
-	if n, ok := payloads[message.TypeN]; ok {
-		notifications = append(notifications, n.(*message.Notification))
+	var vendorIDs []*message.VendorID
+	for _, ikePayload := range ikeMsg.Payloads {
+		switch payload := ikePayload.(type) {
+		case *message.Notification:
+			notifications = append(notifications, payload)
+		case *message.VendorID:
+			vendorIDs = append(vendorIDs, payload)
+		case *message.UnknownPayload:
+			if payload.Critical {
+				return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.UNSUPPORTED_CRITICAL_PAYLOAD,
+					[]byte{byte(payload.PayloadType)}, fmt.Errorf("unsupported critical payload type %d", payload.PayloadType))
+			}
+		}
 	}
 
 	n3iwfCtx := context.N3IWFSelf()
+	// Before any state or Diffie-Hellman work is spent on the UE, it proves
+	// that it receives at its address
+	if nonce != nil && n3iwfCtx.CookieSecrets != nil {
+		cookie := findNotification(notifications, message.COOKIE)
+		if (cookie == nil && n3iwfCtx.CookieRequired()) ||
+			(cookie != nil && !n3iwfCtx.CookieSecrets.Verify(cookie.NotificationData, nonce.NonceData, ueAddr.IP,
+				ikeMsg.InitiatorSPI)) {
+			return sendCookie(udpConn, n3iwfAddr, ueAddr, ikeMsg, n3iwfCtx.CookieSecrets, nonce.NonceData)
+		}
+	}
+
 	var responseIKEPayload message.IKEPayloadContainer
 	var localNonce, concatenatedNonce []byte
 	var chooseProposal message.ProposalContainer
@@ -82,42 +346,69 @@ func HandleIKESAINIT(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMs
 	var chosenDiffieHellmanGroup uint16
 
 	if securityAssociation == nil {
-		logger.IKELog.Errorln("security association field is nil")
-		sendErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI, message.IKE_SA_INIT, ikeMsg.MessageID, message.NO_PROPOSAL_CHOSEN, nil)
-		return
+		return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.NO_PROPOSAL_CHOSEN, nil,
+			errors.New("security association field is nil"))
 	}
 	responseSecurityAssociation := responseIKEPayload.BuildSecurityAssociation()
-	chooseProposal = SelectProposal(securityAssociation.Proposals)
+	// The group of the KE payload is chosen when acceptable, the configured
+	// one otherwise
+	var dhGroups []uint16
+	if keyExcahge != nil {
+		dhGroups = append(dhGroups, keyExcahge.DiffieHellmanGroup)
+	}
+	if n3iwfCtx.PreferredDHGroup != 0 {
+		dhGroups = append(dhGroups, n3iwfCtx.PreferredDHGroup)
+	}
+	chooseProposal = SelectProposal(securityAssociation.Proposals, dhGroups...)
 	responseSecurityAssociation.Proposals = append(responseSecurityAssociation.Proposals, chooseProposal...)
 
 	if len(responseSecurityAssociation.Proposals) == 0 {
-		logger.IKELog.Warnln("no proposal chosen")
-		sendErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI, message.IKE_SA_INIT, ikeMsg.MessageID, message.NO_PROPOSAL_CHOSEN, nil)
-		return
+		return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.NO_PROPOSAL_CHOSEN, nil,
+			errors.New("no proposal chosen"))
 	}
 
 	if keyExcahge == nil {
-		logger.IKELog.Errorln("key exchange field is nil")
-		return
+		return errors.New("key exchange field is nil")
 	}
 	chosenDiffieHellmanGroup = chooseProposal[0].DiffieHellmanGroup[0].TransformID
 	if chosenDiffieHellmanGroup != keyExcahge.DiffieHellmanGroup {
-		logger.IKELog.Warnln("Diffie-Hellman group mismatch")
 		notificationData := make([]byte, 2)
 		binary.BigEndian.PutUint16(notificationData, chosenDiffieHellmanGroup)
-		sendErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI, message.IKE_SA_INIT, ikeMsg.MessageID, message.INVALID_KE_PAYLOAD, notificationData)
-		return
+		return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.INVALID_KE_PAYLOAD, notificationData,
+			errors.New("Diffie-Hellman group mismatch"))
 	}
 
 	if nonce == nil {
-		logger.IKELog.Errorln("nonce field is nil")
-		return
+		return errors.New("nonce field is nil")
+	}
+	if prfInfo := prf.DecodeTransform(chooseProposal[0].PseudorandomFunction[0]); prfInfo != nil &&
+		len(nonce.NonceData) < security.MinNonceLengthForPRF(prfInfo) {
+		return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.INVALID_SYNTAX, nil,
+			fmt.Errorf("UE nonce of %d bytes is too short for the negotiated PRF", len(nonce.NonceData)))
+	}
+
+	// Redirect before any SA state is allocated, so nothing is left half-open
+	if redirectSupported(notifications) {
+		if gateway, ok := n3iwfCtx.RedirectTarget(ueAddr); ok {
+			sendRedirectResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, gateway, nonce.NonceData)
+			return nil
+		}
+	}
+	// Past the IKE SA cap, the UE goes to another gateway or nowhere
+	if !n3iwfCtx.AdmitIKESA() {
+		if redirectSupported(notifications) && n3iwfCtx.RedirectSelector != nil {
+			if gateway, ok := n3iwfCtx.RedirectSelector.SelectGateway(ueAddr); ok {
+				sendRedirectResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, gateway, nonce.NonceData)
+				return nil
+			}
+		}
+		return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.NO_PROPOSAL_CHOSEN, nil,
+			fmt.Errorf("%d IKE SAs reached, rejecting IKE_SA_INIT from %s", n3iwfCtx.MaxIKESAs, ueAddr))
 	}
 
 	localNonceBigInt, err := security.GenerateRandomNumber()
 	if err != nil {
-		logger.IKELog.Errorf("HandleIKESAINIT: %v", err)
-		return
+		return err
 	}
 	localNonce = localNonceBigInt.Bytes()
 	concatenatedNonce = append(nonce.NonceData, localNonce...)
@@ -125,59 +416,76 @@ func HandleIKESAINIT(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMs
 
 	ueBehindNAT, n3iwfBehindNAT, err := handleNATDetect(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI, notifications, ueAddr, n3iwfAddr)
 	if err != nil {
-		logger.IKELog.Errorf("Handle IKE_SA_INIT: %v", err)
-		return
+		return err
 	}
 
 	ikeSecurityAssociation := n3iwfCtx.NewIKESecurityAssociation()
+	if ikeSecurityAssociation == nil {
+		return errors.New("generate IKE SA SPI failed")
+	}
+	ikeSecurityAssociation.EstablishmentStart = received
+	ikeSecurityAssociation.Transcript.Add(context.TraceInbound, n3iwfAddr, ueAddr, ikeMsg)
 	ikeSecurityAssociation.RemoteSPI = ikeMsg.InitiatorSPI
 	ikeSecurityAssociation.InitiatorMessageID = ikeMsg.MessageID
 
 	ikeSecurityAssociation.IKESAKey, localPublicValue, err = security.NewIKESAKey(chooseProposal[0], keyExcahge.KeyExchangeData, concatenatedNonce, ikeSecurityAssociation.RemoteSPI, ikeSecurityAssociation.LocalSPI)
 	if err != nil {
-		logger.IKELog.Errorf("handle IKE_SA_INIT: %v", err)
-		return
+		n3iwfCtx.DeleteIKESecurityAssociation(ikeSecurityAssociation.LocalSPI)
+		switch {
+		case errors.Is(err, security.ErrNonceTooShort):
+			return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.INVALID_SYNTAX, nil, err)
+		case errors.Is(err, security.ErrInvalidKEPayload):
+			notificationData := make([]byte, 2)
+			binary.BigEndian.PutUint16(notificationData, chosenDiffieHellmanGroup)
+			return rejectIKESAINIT(udpConn, n3iwfAddr, ueAddr, ikeMsg, message.INVALID_KE_PAYLOAD, notificationData, err)
+		}
+		return err
 	}
 
-	logger.IKELog.Debugln(ikeSecurityAssociation.String())
+	ikeSecurityAssociation.Log().Debugln(ikeSecurityAssociation.String())
 	ikeSecurityAssociation.ConcatenatedNonce = append(ikeSecurityAssociation.ConcatenatedNonce, concatenatedNonce...)
 	ikeSecurityAssociation.UeBehindNAT = ueBehindNAT
 	ikeSecurityAssociation.N3iwfBehindNAT = n3iwfBehindNAT
 
 	responseIKEPayload.BuildKeyExchange(chosenDiffieHellmanGroup, localPublicValue)
 	if err = buildNATDetectNotifPayload(ikeSecurityAssociation, &responseIKEPayload, ueAddr, n3iwfAddr); err != nil {
-		logger.IKELog.Warnf("handle IKE_SA_INIT: %v", err)
-		return
+		return err
 	}
+	negotiateSignatureHashAlgorithms(ikeSecurityAssociation, notifications, &responseIKEPayload)
+	negotiateChildless(ikeSecurityAssociation, notifications, &responseIKEPayload)
+	negotiateVendorID(n3iwfCtx, ikeSecurityAssociation, vendorIDs, &responseIKEPayload)
 
 	responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeSecurityAssociation.LocalSPI, message.IKE_SA_INIT, true, false, ikeMsg.MessageID, responseIKEPayload)
 	ikeSecurityAssociation.InitiatorSignedOctets = append(realMessage1, localNonce...)
 
 	responseIKEMessageData, err := responseIKEMessage.Encode()
 	if err != nil {
-		logger.IKELog.Errorf("encoding IKE ikeMsg failed: %+v", err)
-		return
+		return fmt.Errorf("encoding IKE ikeMsg failed: %w", err)
 	}
+	// MACedIDForR is appended in IKE_AUTH, once the identity is selected
 	ikeSecurityAssociation.ResponderSignedOctets = append(responseIKEMessageData, nonce.NonceData...)
+
+	return SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage, nil)
+}
+
+// responderSignedOctets returns the octets covered by the responder AUTH
+// (RFC 7296 section 2.15), ending with the MAC of the selected identity
+func responderSignedOctets(ikeSA *context.IKESecurityAssociation) ([]byte, error) {
+	identity := ikeSA.ResponderIdentity
+	if identity == nil {
+		return nil, fmt.Errorf("responderSignedOctets: no responder identity selected")
+	}
 	var idPayload message.IKEPayloadContainer
-	idPayload.BuildIdentificationResponder(message.ID_FQDN, []byte(n3iwfCtx.Fqdn))
+	idPayload.BuildIdentificationResponder(identity.IDType, identity.IDData)
 	idPayloadData, err := idPayload.Encode()
 	if err != nil {
-		logger.IKELog.Errorf("encode IKE payload failed: %+v", err)
-		return
-	}
-	ikeSecurityAssociation.Prf_r.Reset()
-	_, err = ikeSecurityAssociation.Prf_r.Write(idPayloadData[4:])
-	if err != nil {
-		logger.IKELog.Errorf("pseudorandom function write error: %+v", err)
-		return
+		return nil, fmt.Errorf("responderSignedOctets: %w", err)
 	}
-	ikeSecurityAssociation.ResponderSignedOctets = append(ikeSecurityAssociation.ResponderSignedOctets, ikeSecurityAssociation.Prf_r.Sum(nil)...) // MACedIDForR
-
-	logger.IKELog.Debugf("local unsigned authentication data:\n%s", hex.Dump(ikeSecurityAssociation.ResponderSignedOctets))
-	if err = SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage, nil); err != nil {
-		logger.IKELog.Errorf("HandleIKESAINIT(): %v", err)
+	ikeSA.Prf_r.Reset()
+	if _, err = ikeSA.Prf_r.Write(idPayloadData[4:]); err != nil {
+		return nil, fmt.Errorf("responderSignedOctets: %w", err)
 	}
+	return slices.Concat(ikeSA.ResponderSignedOctets, ikeSA.Prf_r.Sum(nil)), nil // MACedIDForR
 }
 
 // IKE_AUTH state
@@ -189,10 +497,99 @@ const (
 	HandleCreateChildSA
 )
 
-func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
+// innerIPAddr wraps the UE inner IP address allocated from the pool, which is
+// already a literal address and needs no resolution
+func innerIPAddr(ip net.IP) *net.IPAddr {
+	return &net.IPAddr{IP: append(net.IP(nil), ip...)}
+}
+
+// checkUECertificateRevocation verifies that the X.509 certificate sent by the
+// UE has not been revoked. Nothing is checked when checker is nil. A status
+// not cached by the checker is fetched in the background, the request being
+// parked until the RevocationChecked event replays it, see
+// HandleRevocationChecked. It returns false while the request is parked
+func checkUECertificateRevocation(checker *security.RevocationChecker, ikeSA *context.IKESecurityAssociation,
+	udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage,
+	certificate *message.Certificate,
+) (bool, error) {
+	if checker == nil {
+		return true, nil
+	}
+	if pending := ikeSA.PendingRevocationCheck; pending != nil {
+		if !pending.Done {
+			ikeSA.Log().Debugln("certificate status still being fetched, drop the retransmitted IKE_AUTH")
+			return false, nil
+		}
+		ikeSA.PendingRevocationCheck = nil
+		if pending.Err != nil {
+			return true, fmt.Errorf("checkUECertificateRevocation: %w", pending.Err)
+		}
+		return true, nil
+	}
+
+	if certificate.CertificateEncoding != message.X509CertificateSignature {
+		return true, fmt.Errorf("checkUECertificateRevocation: unsupported certificate encoding %d",
+			certificate.CertificateEncoding)
+	}
+	cert, err := x509.ParseCertificate(certificate.CertificateData)
+	if err != nil {
+		return true, fmt.Errorf("checkUECertificateRevocation: %w", err)
+	}
+	decided, err := checker.CheckCached(cert)
+	if decided {
+		if err != nil {
+			return true, fmt.Errorf("checkUECertificateRevocation: %w", err)
+		}
+		return true, nil
+	}
+
+	// The OCSP responders and CRL distribution points may take their whole
+	// timeout to answer, which the IKE event loop cannot wait for
+	ikeSA.PendingRevocationCheck = &context.RevocationCheck{
+		Conn:    &context.UDPSocketInfo{Conn: udpConn, N3IWFAddr: n3iwfAddr, UEAddr: ueAddr},
+		Request: ikeMsg,
+	}
+	ikeServer := context.N3IWFSelf().IkeServer
+	localSPI := ikeSA.LocalSPI
+	go func() {
+		ikeServer.SendEvent(context.NewRevocationCheckedEvt(localSPI, checker.Check(cert)))
+	}()
+	return false, nil
+}
+
+// HandleRevocationChecked replays the IKE_AUTH request parked while the
+// status of the UE certificate was fetched
+func HandleRevocationChecked(ikeEvt context.IkeEvt) {
+	logger.IKELog.Debugln("handle RevocationChecked event")
+
+	revocationCheckedEvt := ikeEvt.(*context.RevocationCheckedEvt)
+	ikeSA, ok := context.N3IWFSelf().IKESALoad(revocationCheckedEvt.LocalSPI)
+	if !ok {
+		logger.IKELog.Warnf("IKE SA %016x is gone, drop the certificate status", revocationCheckedEvt.LocalSPI)
+		return
+	}
+	pending := ikeSA.PendingRevocationCheck
+	if pending == nil || pending.Done {
+		ikeSA.Log().Warnln("no IKE_AUTH waiting for the certificate status")
+		return
+	}
+	pending.Done = true
+	pending.Err = revocationCheckedEvt.Err
+	HandleIKEAUTH(pending.Conn.Conn, pending.Conn.N3IWFAddr, pending.Conn.UEAddr, pending.Request, ikeSA)
+}
+
+// HandleIKEAUTH handles an IKE_AUTH request, logging and counting its failure
+func HandleIKEAUTH(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
 	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation,
 ) {
-	logger.IKELog.Debugln("handle IKE_AUTH")
+	logExchangeError(ikeSecurityAssociation, message.IKE_AUTH, "HandleIKEAUTH", handleIKEAUTH(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation))
+}
+
+func handleIKEAUTH(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation,
+) error {
+	ikeLog := ikeSecurityAssociation.Log()
+	ikeLog.Debugln("handle IKE_AUTH")
 
 	n3iwfCtx := context.N3IWFSelf()
 	ipsecGwAddr := n3iwfCtx.IpSecGatewayAddress
@@ -202,6 +599,7 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 
 	// Parse payloads
 	var initiatorID *message.IdentificationInitiator
+	var responderID *message.IdentificationResponder
 	var certificateRequest *message.CertificateRequest
 	var certificate *message.Certificate
 	var securityAssociation *message.SecurityAssociation
@@ -210,46 +608,89 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 	var eap *message.EAP
 	var authentication *message.Authentication
 	var configuration *message.Configuration
+	var notifications []*message.Notification
 	var ok bool
 
 	for _, ikePayload := range ikeMsg.Payloads {
+		var err error
 		switch ikePayload.Type() {
 		case message.TypeIDi:
-			initiatorID = ikePayload.(*message.IdentificationInitiator)
+			initiatorID, err = assertPayload[*message.IdentificationInitiator](ikePayload)
+		case message.TypeIDr:
+			responderID, err = assertPayload[*message.IdentificationResponder](ikePayload)
 		case message.TypeCERTreq:
-			certificateRequest = ikePayload.(*message.CertificateRequest)
+			certificateRequest, err = assertPayload[*message.CertificateRequest](ikePayload)
 		case message.TypeCERT:
-			certificate = ikePayload.(*message.Certificate)
+			certificate, err = assertPayload[*message.Certificate](ikePayload)
 		case message.TypeSA:
-			securityAssociation = ikePayload.(*message.SecurityAssociation)
+			securityAssociation, err = assertPayload[*message.SecurityAssociation](ikePayload)
 		case message.TypeTSi:
-			trafficSelectorInitiator = ikePayload.(*message.TrafficSelectorInitiator)
+			trafficSelectorInitiator, err = assertPayload[*message.TrafficSelectorInitiator](ikePayload)
 		case message.TypeTSr:
-			trafficSelectorResponder = ikePayload.(*message.TrafficSelectorResponder)
+			trafficSelectorResponder, err = assertPayload[*message.TrafficSelectorResponder](ikePayload)
 		case message.TypeEAP:
-			eap = ikePayload.(*message.EAP)
+			eap, err = assertPayload[*message.EAP](ikePayload)
 		case message.TypeAUTH:
-			authentication = ikePayload.(*message.Authentication)
+			authentication, err = assertPayload[*message.Authentication](ikePayload)
 		case message.TypeCP:
-			configuration = ikePayload.(*message.Configuration)
+			configuration, err = assertPayload[*message.Configuration](ikePayload)
+		case message.TypeN:
+			var notification *message.Notification
+			notification, err = assertPayload[*message.Notification](ikePayload)
+			notifications = append(notifications, notification)
 		default:
-			logger.IKELog.Warnf(
+			if unknown, ok := ikePayload.(*message.UnknownPayload); ok && unknown.Critical {
+				return rejectUnsupportedCriticalPayload(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, unknown)
+			}
+			ikeLog.Warnf(
 				"get IKE payload (type %d) in IKE_AUTH ikeMsg, this payload will not be handled by IKE handler",
 				ikePayload.Type())
 		}
+		if err != nil {
+			return rejectMalformedMessage(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, err)
+		}
 	}
 
 	ikeSecurityAssociation.InitiatorMessageID = ikeMsg.MessageID
 
+	// Any EAP payload must answer the outstanding EAP request, whatever the state
+	if eap != nil && ikeSecurityAssociation.State != EAPSignalling {
+		if err := validateEAPResponse(eap, &ikeSecurityAssociation.EAP); err != nil {
+			return err
+		}
+	}
+
 	switch ikeSecurityAssociation.State {
 	case PreSignalling:
 		if initiatorID == nil {
-			logger.IKELog.Errorln("initiator identification field is nil")
 			// TODO: send error ikeMsg to UE
-			return
+			return errors.New("initiator identification field is nil")
 		}
-		logger.IKELog.Debugln("encoding initiator for later IKE authentication")
+
+		// Checked before any state is changed, so that a request parked
+		// during the check is replayed as received
+		if certificate != nil {
+			ikeLog.Infoln("UE send its certficate")
+			checked, err := checkUECertificateRevocation(n3iwfCtx.RevocationChecker, ikeSecurityAssociation,
+				udpConn, n3iwfAddr, ueAddr, ikeMsg, certificate)
+			if !checked {
+				return nil
+			}
+			if err != nil {
+				sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+					message.AUTHENTICATION_FAILED)
+				observeEstablishment(ikeSecurityAssociation, EstablishmentAuthFailure)
+				return &ExchangeError{
+					Notify: message.AUTHENTICATION_FAILED,
+					Err:    fmt.Errorf("UE certificate rejected: %w", err),
+				}
+			}
+			ikeSecurityAssociation.InitiatorCertificate = certificate
+		}
+
+		ikeLog.Debugln("encoding initiator for later IKE authentication")
 		ikeSecurityAssociation.InitiatorID = initiatorID
+		ikeLog = ikeSecurityAssociation.Log()
 
 		// Record maced identification for authentication
 		idPayload := message.IKEPayloadContainer{
@@ -257,13 +698,11 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 		}
 		idPayloadData, err := idPayload.Encode()
 		if err != nil {
-			logger.IKELog.Errorf("encoding ID payload ikeMsg failed: %+v", err)
-			return
+			return fmt.Errorf("encoding ID payload ikeMsg failed: %w", err)
 		}
 		ikeSecurityAssociation.Prf_i.Reset()
 		if _, err := ikeSecurityAssociation.Prf_i.Write(idPayloadData[4:]); err != nil {
-			logger.IKELog.Errorf("pseudorandom function write error: %v", err)
-			return
+			return fmt.Errorf("pseudorandom function write error: %w", err)
 		}
 		ikeSecurityAssociation.InitiatorSignedOctets = append(ikeSecurityAssociation.InitiatorSignedOctets, ikeSecurityAssociation.Prf_i.Sum(nil)...)
 
@@ -276,180 +715,98 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 		// can be validated up to one of the specified certification
 		// authorities.  This can be a chain of certificates.
 		if certificateRequest != nil {
-			logger.IKELog.Infoln("UE request N3IWF certificate")
+			ikeLog.Infoln("UE request N3IWF certificate")
 			if security.CompareRootCertificate(n3iwfCtx.CertificateAuthority, certificateRequest.CertificateEncoding, certificateRequest.CertificationAuthority) {
 				// TODO: Complete N3IWF Certificate/Certificate Authority related procedure
-				logger.IKELog.Infoln("certificate Request sent from UE matches N3IWF CA")
+				ikeLog.Infoln("certificate Request sent from UE matches N3IWF CA")
 			}
 		}
 
-		if certificate != nil {
-			logger.IKELog.Infoln("UE send its certficate")
-			ikeSecurityAssociation.InitiatorCertificate = certificate
-		}
-
-		if securityAssociation == nil {
-			logger.IKELog.Errorln("security association field is nil")
-			// TODO: send error ikeMsg to UE
-			return
-		}
-		logger.IKELog.Debugln("parsing security association")
-		responseSecurityAssociation := new(message.SecurityAssociation)
+		// RFC 6023 section 2: without SA payload the UE sets up the IKE SA
+		// alone, and requests the CP child SA once authenticated
+		if securityAssociation == nil && ikeSecurityAssociation.ChildlessSupported {
+			ikeLog.Infoln("childless IKE_AUTH, the UE requests the CP child SA afterwards")
+		} else {
+			if securityAssociation == nil {
+				// TODO: send error ikeMsg to UE
+				return errors.New("security association field is nil")
+			}
+			ikeLog.Debugln("parsing security association")
+			responseSecurityAssociation := selectChildSAProposal(securityAssociation, kernelSupported)
 
-		for _, proposal := range securityAssociation.Proposals {
-			var encryptionAlgorithmTransform *message.Transform = nil
-			var integrityAlgorithmTransform *message.Transform = nil
-			var diffieHellmanGroupTransform *message.Transform = nil
-			var extendedSequenceNumbersTransform *message.Transform = nil
+			if len(responseSecurityAssociation.Proposals) == 0 {
+				// Respond NO_PROPOSAL_CHOSEN to UE
+				// Notification
+				responseIKEPayload.BuildNotification(message.TypeNone, message.NO_PROPOSAL_CHOSEN, nil, nil)
 
-			if len(proposal.SPI) != 4 {
-				continue // The SPI of ESP must be 32-bit
-			}
+				responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
+					message.IKE_AUTH, true, false, ikeMsg.MessageID, responseIKEPayload)
 
-			if len(proposal.EncryptionAlgorithm) > 0 {
-				for _, transform := range proposal.EncryptionAlgorithm {
-					if isTransformKernelSupported(message.TypeEncryptionAlgorithm, transform.TransformID,
-						transform.AttributePresent, transform.AttributeValue) {
-						encryptionAlgorithmTransform = transform
-						break
-					}
-				}
-				if encryptionAlgorithmTransform == nil {
-					continue
-				}
-			} else {
-				continue // mandatory
-			}
-			if len(proposal.PseudorandomFunction) > 0 {
-				continue // Pseudorandom function is not used by ESP
-			}
-			if len(proposal.IntegrityAlgorithm) > 0 {
-				for _, transform := range proposal.IntegrityAlgorithm {
-					if isTransformKernelSupported(message.TypeIntegrityAlgorithm, transform.TransformID,
-						transform.AttributePresent, transform.AttributeValue) {
-						integrityAlgorithmTransform = transform
-						break
-					}
-				}
-				if integrityAlgorithmTransform == nil {
-					continue
-				}
-			} // Optional
-			if len(proposal.DiffieHellmanGroup) > 0 {
-				for _, transform := range proposal.DiffieHellmanGroup {
-					if isTransformKernelSupported(message.TypeDiffieHellmanGroup, transform.TransformID,
-						transform.AttributePresent, transform.AttributeValue) {
-						diffieHellmanGroupTransform = transform
-						break
-					}
-				}
-				if diffieHellmanGroupTransform == nil {
-					continue
-				}
-			} // Optional
-			if len(proposal.ExtendedSequenceNumbers) > 0 {
-				for _, transform := range proposal.ExtendedSequenceNumbers {
-					if isTransformKernelSupported(message.TypeExtendedSequenceNumbers, transform.TransformID,
-						transform.AttributePresent, transform.AttributeValue) {
-						extendedSequenceNumbersTransform = transform
-						break
-					}
-				}
-				if extendedSequenceNumbersTransform == nil {
-					continue
+				// Send IKE ikeMsg to UE
+				err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
+					ikeSecurityAssociation.IKESAKey)
+				if err != nil {
+					return err
 				}
-			} else {
-				continue // Mandatory
+				return &ExchangeError{Notify: message.NO_PROPOSAL_CHOSEN, Err: errors.New("no proposal chosen")}
 			}
 
-			chosenProposal := responseSecurityAssociation.Proposals.BuildProposal(
-				proposal.ProposalNumber, proposal.ProtocolID, proposal.SPI)
-			chosenProposal.EncryptionAlgorithm = append(chosenProposal.EncryptionAlgorithm, encryptionAlgorithmTransform)
-			chosenProposal.ExtendedSequenceNumbers = append(
-				chosenProposal.ExtendedSequenceNumbers, extendedSequenceNumbersTransform)
-			if integrityAlgorithmTransform != nil {
-				chosenProposal.IntegrityAlgorithm = append(chosenProposal.IntegrityAlgorithm, integrityAlgorithmTransform)
-			}
-			if diffieHellmanGroupTransform != nil {
-				chosenProposal.DiffieHellmanGroup = append(chosenProposal.DiffieHellmanGroup, diffieHellmanGroupTransform)
-			}
+			ikeSecurityAssociation.IKEAuthResponseSA = responseSecurityAssociation
 
-			break
-		}
-
-		if len(responseSecurityAssociation.Proposals) == 0 {
-			logger.IKELog.Warnln("no proposal chosen")
-			// Respond NO_PROPOSAL_CHOSEN to UE
-			// Notification
-			responseIKEPayload.BuildNotification(message.TypeNone, message.NO_PROPOSAL_CHOSEN, nil, nil)
-
-			responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
-				message.IKE_AUTH, true, false, ikeMsg.MessageID, responseIKEPayload)
+			if trafficSelectorInitiator == nil || len(trafficSelectorInitiator.TrafficSelectors) == 0 {
+				// TODO: send error ikeMsg to UE
+				return errors.New("initiator traffic selector field is nil")
+			}
+			ikeLog.Debugln("received traffic selector initiator from UE")
+			ikeSecurityAssociation.TrafficSelectorInitiator = trafficSelectorInitiator
 
-			// Send IKE ikeMsg to UE
-			err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
-				ikeSecurityAssociation.IKESAKey)
-			if err != nil {
-				logger.IKELog.Errorf("HandleIKEAUTH(): %v", err)
+			if trafficSelectorResponder == nil || len(trafficSelectorResponder.TrafficSelectors) == 0 {
+				// TODO: send error ikeMsg to UE
+				return errors.New("responder traffic selector field is nil")
 			}
-			return
+			ikeLog.Debugln("received traffic selector responder from UE")
+			ikeSecurityAssociation.TrafficSelectorResponder = trafficSelectorResponder
 		}
 
-		ikeSecurityAssociation.IKEAuthResponseSA = responseSecurityAssociation
-
-		if trafficSelectorInitiator == nil {
-			logger.IKELog.Errorln("initiator traffic selector field is nil")
-			// TODO: send error ikeMsg to UE
-			return
+		// RFC 7296 section 2.15: the UE may name the identity it expects in IDr
+		responderIdentity := n3iwfCtx.SelectResponderIdentity(responderID)
+		if responderID != nil && !responderIdentity.Matches(responderID) {
+			ikeLog.Infoln("no identity matches the IDr sent by UE, using the default one")
 		}
-		logger.IKELog.Debugln("received traffic selector initiator from UE")
-		ikeSecurityAssociation.TrafficSelectorInitiator = trafficSelectorInitiator
-
-		if trafficSelectorResponder == nil {
-			logger.IKELog.Errorln("responder traffic selector field is nil")
-			// TODO: send error ikeMsg to UE
-			return
+		ikeSecurityAssociation.ResponderIdentity = responderIdentity
+		signedOctets, err := responderSignedOctets(ikeSecurityAssociation)
+		if err != nil {
+			return err
 		}
-		logger.IKELog.Debugln("received traffic selector responder from UE")
-		ikeSecurityAssociation.TrafficSelectorResponder = trafficSelectorResponder
 
 		responseIKEPayload.Reset()
 		// Identification
-		responseIKEPayload.BuildIdentificationResponder(message.ID_FQDN, []byte(n3iwfCtx.Fqdn))
+		responseIKEPayload.BuildIdentificationResponder(responderIdentity.IDType, responderIdentity.IDData)
 
 		// Certificate
-		responseIKEPayload.BuildCertificate(message.X509CertificateSignature, n3iwfCtx.N3iwfCertificate)
+		responseIKEPayload.BuildCertificate(message.X509CertificateSignature, responderIdentity.Certificate)
 
 		// Authentication Data
-		logger.IKELog.Debugf("local authentication data:\n%s", hex.Dump(ikeSecurityAssociation.ResponderSignedOctets))
-		sha1HashFunction := sha1.New()
-		if _, err := sha1HashFunction.Write(ikeSecurityAssociation.ResponderSignedOctets); err != nil {
-			logger.IKELog.Errorf("hash function write error: %+v", err)
-			return
-		}
-
-		signedAuth, err := rsa.SignPKCS1v15(rand.Reader, n3iwfCtx.N3iwfPrivateKey, crypto.SHA1, sha1HashFunction.Sum(nil))
+		ikeLog.Debugf("local authentication data:\n%s", hex.Dump(signedOctets))
+		authMethod, signedAuth, err := security.SignAuthentication(responderIdentity.PrivateKey, signedOctets,
+			ikeSecurityAssociation.SignatureHashAlgorithms)
 		if err != nil {
-			logger.IKELog.Errorf("sign authentication data failed: %+v", err)
+			return fmt.Errorf("sign authentication data failed: %w", err)
 		}
 
-		responseIKEPayload.BuildAuthentication(message.RSADigitalSignature, signedAuth)
+		responseIKEPayload.BuildAuthentication(authMethod, signedAuth)
 
 		// EAP expanded 5G-Start
-		var identifier uint8
-		for {
-			identifier, err = security.GenerateRandomUint8()
-			if err != nil {
-				logger.IKELog.Errorf("random number failed: %+v", err)
-				return
-			}
-			if identifier != ikeSecurityAssociation.LastEAPIdentifier {
-				ikeSecurityAssociation.LastEAPIdentifier = identifier
-				break
-			}
+		identifier, err := ikeSecurityAssociation.EAP.NextRequest(message.EAPTypeExpanded, message.EAP5GType5GStart)
+		if err != nil {
+			return err
 		}
+		ikeLog.Debugf("EAP-5G Start request: identifier %d", identifier)
 		responseIKEPayload.BuildEAP5GStart(identifier)
 
+		// RFC 4555 section 3.3: MOBIKE_SUPPORTED is exchanged in IKE_AUTH
+		negotiateMOBIKE(n3iwfCtx, ikeSecurityAssociation, notifications, &responseIKEPayload)
+
 		responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
 			message.IKE_AUTH, true, false, ikeMsg.MessageID, responseIKEPayload)
 
@@ -460,75 +817,81 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 		err = SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
 			ikeSecurityAssociation.IKESAKey)
 		if err != nil {
-			logger.IKELog.Errorf("HandleIKEAUTH(): %v", err)
-			return
+			return err
 		}
+		n3iwfCtx.StartEAPRoundTimer(ikeSecurityAssociation)
 
 	case EAPSignalling:
 		// If success, N3IWF will send an UPLinkNASTransport to AMF
-		if eap == nil {
-			logger.IKELog.Errorln("EAP is nil")
-			return
-		}
-		if eap.Code != message.EAPCodeResponse {
-			logger.IKELog.Errorln("received an EAP payload with code other than response. Drop the payload")
-			return
-		}
-		if eap.Identifier != ikeSecurityAssociation.LastEAPIdentifier {
-			logger.IKELog.Errorln("received an EAP payload with unmatched identifier. Drop the payload")
-			return
-		}
-
-		eapTypeData := eap.EAPTypeData[0]
-		var eapExpanded *message.EAPExpanded
-
-		switch eapTypeData.Type() {
-		// TODO: handle
-		// case message.EAPTypeIdentity:
-		// case message.EAPTypeNotification:
-		// case message.EAPTypeNak:
-		case message.EAPTypeExpanded:
-			eapExpanded = eapTypeData.(*message.EAPExpanded)
-		default:
-			logger.IKELog.Errorf("received EAP packet with type other than EAP expanded type: %d", eapTypeData.Type())
-			return
-		}
-
-		if eapExpanded.VendorID != message.VendorID3GPP {
-			logger.IKELog.Errorln("peer sent EAP expended packet with wrong vendor ID. Drop the packet")
-			return
-		}
-		if eapExpanded.VendorType != message.VendorTypeEAP5G {
-			logger.IKELog.Errorln("peer sent EAP expanded packet with wrong vendor type. Drop the packet")
-			return
+		eapSession := &ikeSecurityAssociation.EAP
+		if identity := eapIdentityResponse(eap, eapSession); identity != nil {
+			if eapSession.IdentityReceived {
+				sendEAPFailure(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation)
+				return fmt.Errorf("%w: EAP Identity again in response to the repeated 5G-Start", ErrUnexpectedEAPType)
+			}
+			// Some UEs answer the 5G-Start with their identity first, ask again
+			eapSession.IdentityReceived = true
+			eapSession.Identity = string(identity.IdentityData)
+			ikeSecurityAssociation.Log().Infoln("EAP Identity in response to the 5G-Start, repeating it")
+			return sendEAP5GStart(udpConn, n3iwfAddr, ueAddr, ikeMsg.MessageID, ikeSecurityAssociation)
+		}
+		eapExpanded, err := validateEAP5GResponse(eap, eapSession)
+		switch {
+		case errors.Is(err, ErrStaleEAPResponse):
+			// A retransmission, not a failure
+			ikeLog.Infof("%v. Drop the payload", err)
+			return nil
+		case errors.Is(err, ErrUnexpectedEAPType):
+			sendEAPFailure(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation)
+			return fmt.Errorf("EAP authentication failed after %d rounds, last EAP-5G request %d: %w",
+				eapSession.Rounds, eapSession.MessageID, err)
+		case err != nil:
+			return err
 		}
 
 		eap5GMessageID := eapExpanded.VendorData[0]
-		logger.IKELog.Debugf("EAP5G MessageID: %+v", eap5GMessageID)
-
-		if eap5GMessageID == message.EAP5GType5GStop {
-			// Send EAP failure
-			responseIKEPayload.Reset()
-
-			// EAP
-			identifier, err := security.GenerateRandomUint8()
-			if err != nil {
-				logger.IKELog.Errorf("generate random uint8 failed: %+v", err)
-				return
+		ikeLog.Debugf("EAP-5G response: identifier %d, message ID %d, round %d",
+			eap.Identifier, eap5GMessageID, eapSession.Rounds)
+
+		var vendorData []byte
+		switch eap5GMessageID {
+		case message.EAP5GType5GNAS:
+			fragments := &ikeSecurityAssociation.EAP5GFragments
+			if len(fragments.Outbound) > 0 {
+				if len(eapExpanded.VendorData) != message.EAP5GHeaderLen {
+					sendEAPFailure(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation)
+					return fmt.Errorf("%w: 5G-NAS with data while %d fragments are left to send",
+						ErrUnexpectedEAP5GMessage, len(fragments.Outbound))
+				}
+				next := fragments.Outbound[0]
+				fragments.Outbound = fragments.Outbound[1:]
+				return sendEAP5GRequest(udpConn, n3iwfAddr, ueAddr, ikeMsg.MessageID, ikeSecurityAssociation, next)
 			}
-			responseIKEPayload.BuildEAPFailure(identifier)
-
-			// Build IKE ikeMsg
-			responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
-				message.IKE_AUTH, true, false, ikeMsg.MessageID, responseIKEPayload)
-
-			// Send IKE ikeMsg to UE
-			err = SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
-				ikeSecurityAssociation.IKESAKey)
+			vendorData, err = reassembleEAP5GNAS(fragments, eapExpanded.VendorData, n3iwfCtx.EAP5GFragmentSize != 0)
 			if err != nil {
-				logger.IKELog.Errorf("HandleIKEAUTH(): %v", err)
+				sendEAPFailure(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation)
+				return err
 			}
-			return
+			if vendorData == nil {
+				// Acknowledge the fragment, soliciting the next one
+				return sendEAP5GRequest(udpConn, n3iwfAddr, ueAddr, ikeMsg.MessageID, ikeSecurityAssociation,
+					[]byte{message.EAP5GType5GNAS, message.EAP5GSpareValue})
+			}
+			recordANParameters(ikeSecurityAssociation, vendorData)
+			// Forwarded to the AMF below
+		case message.EAP5GType5GStop:
+			ikeLog.Infof("UE stopped EAP-5G after %d rounds", eapSession.Rounds)
+			sendEAPFailure(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation)
+			return nil
+		case message.EAP5GType5GNotification:
+			// TS 24.502 section 9.3.2.2: a 5G-Notification response acknowledges
+			// a 5G-Notification request, which only a TNGF sends
+			sendEAPFailure(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation)
+			return fmt.Errorf("%w: 5G-Notification response, no 5G-Notification request sent", ErrUnexpectedEAP5GMessage)
+		default:
+			sendEAPFailure(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation)
+			return fmt.Errorf("%w: message ID %d after %d rounds", ErrUnexpectedEAP5GMessage,
+				eap5GMessageID, eapSession.Rounds)
 		}
 
 		var ranNgapId int64
@@ -537,17 +900,27 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 			ranNgapId = 0
 		}
 
-		n3iwfCtx.NgapServer.RcvEventCh <- context.NewUnmarshalEAP5GDataEvt(
+		err = n3iwfCtx.SendNgapEvent(context.NewUnmarshalEAP5GDataEvt(
 			ikeSecurityAssociation.LocalSPI,
-			eapExpanded.VendorData,
+			vendorData,
 			ikeSecurityAssociation.IkeUE != nil,
 			ranNgapId,
-		)
-
-		ikeSecurityAssociation.IKEConnection = &context.UDPSocketInfo{
-			Conn:      udpConn,
-			N3IWFAddr: n3iwfAddr,
-			UEAddr:    ueAddr,
+		))
+		if err != nil {
+			// Left unanswered, so that the retransmission of the UE is forwarded again
+			return err
+		}
+		// Now waiting for the AMF
+		n3iwfCtx.StartEAPRoundTimer(ikeSecurityAssociation)
+
+		// With the return routability check, a changed address is only
+		// followed once the IKE SA is established and the UE echoed a COOKIE2
+		if ikeSecurityAssociation.IKEConnection == nil || !n3iwfCtx.ReturnRoutabilityCheck {
+			ikeSecurityAssociation.IKEConnection = &context.UDPSocketInfo{
+				Conn:      udpConn,
+				N3IWFAddr: n3iwfAddr,
+				UEAddr:    ueAddr,
+			}
 		}
 
 		ikeSecurityAssociation.InitiatorMessageID = ikeMsg.MessageID
@@ -559,8 +932,7 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 		// Prepare pseudorandom function for calculating/verifying authentication data
 		pseudorandomFunction := ikeSecurityAssociation.PrfInfo.Init(ikeUE.Kn3iwf)
 		if _, err := pseudorandomFunction.Write([]byte("Key Pad for IKEv2")); err != nil {
-			logger.IKELog.Errorf("pseudorandom function write error: %+v", err)
-			return
+			return fmt.Errorf("pseudorandom function write error: %w", err)
 		}
 		secret := pseudorandomFunction.Sum(nil)
 		pseudorandomFunction = ikeSecurityAssociation.PrfInfo.Init(secret)
@@ -569,17 +941,15 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 			// Verifying remote AUTH
 			pseudorandomFunction.Reset()
 			if _, err := pseudorandomFunction.Write(ikeSecurityAssociation.InitiatorSignedOctets); err != nil {
-				logger.IKELog.Errorf("pseudorandom function write error: %+v", err)
-				return
+				return fmt.Errorf("pseudorandom function write error: %w", err)
 			}
 			expectedAuthenticationData := pseudorandomFunction.Sum(nil)
 
-			logger.IKELog.Debugf("Kn3iwf:\n%s", hex.Dump(ikeUE.Kn3iwf))
-			logger.IKELog.Debugf("secret:\n%s", hex.Dump(secret))
-			logger.IKELog.Debugf("InitiatorSignedOctets:\n%s", hex.Dump(ikeSecurityAssociation.InitiatorSignedOctets))
-			logger.IKELog.Debugf("expected Authentication Data: %s", hex.Dump(expectedAuthenticationData))
+			ikeLog.Debugf("Kn3iwf:\n%s", hex.Dump(ikeUE.Kn3iwf))
+			ikeLog.Debugf("secret:\n%s", hex.Dump(secret))
+			ikeLog.Debugf("InitiatorSignedOctets:\n%s", hex.Dump(ikeSecurityAssociation.InitiatorSignedOctets))
+			ikeLog.Debugf("expected Authentication Data: %s", hex.Dump(expectedAuthenticationData))
 			if !bytes.Equal(authentication.AuthenticationData, expectedAuthenticationData) {
-				logger.IKELog.Warnln("peer authentication failed")
 				// Inform UE the authentication has failed
 				responseIKEPayload.Reset()
 
@@ -592,15 +962,15 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 					message.IKE_AUTH, true, false, ikeMsg.MessageID, responseIKEPayload)
 
 				// Send IKE ikeMsg to UE
+				observeEstablishment(ikeSecurityAssociation, EstablishmentAuthFailure)
 				if err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
 					ikeSecurityAssociation.IKESAKey); err != nil {
-					logger.IKELog.Errorf("HandleIKEAUTH(): %v", err)
+					return err
 				}
-				return
+				return &ExchangeError{Notify: message.AUTHENTICATION_FAILED, Err: errors.New("peer authentication failed")}
 			}
-			logger.IKELog.Debugln("peer authentication success")
+			ikeLog.Debugln("peer authentication success")
 		} else {
-			logger.IKELog.Warnln("peer authentication failed")
 			// Inform UE the authentication has failed
 			responseIKEPayload.Reset()
 
@@ -612,44 +982,33 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 				message.IKE_AUTH, true, false, ikeMsg.MessageID, responseIKEPayload)
 
 			// Send IKE ikeMsg to UE
+			observeEstablishment(ikeSecurityAssociation, EstablishmentAuthFailure)
 			if err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
 				ikeSecurityAssociation.IKESAKey); err != nil {
-				logger.IKELog.Errorf("HandleIKEAUTH(): %v", err)
+				return err
 			}
-			return
+			return &ExchangeError{Notify: message.AUTHENTICATION_FAILED, Err: errors.New("peer authentication failed, no AUTH payload")}
 		}
 
 		// Parse configuration request to get if the UE has requested internal address,
 		// and prepare configuration payload to UE
-		var addrRequest bool = false
-
+		requestedAttributes := requestedConfigurationAttributes(configuration)
 		if configuration != nil {
-			logger.IKELog.Debugf("received configuration payload with type: %d", configuration.ConfigurationType)
-
-			var attribute *message.IndividualConfigurationAttribute
-			for _, attribute = range configuration.ConfigurationAttribute {
-				switch attribute.Type {
-				case message.INTERNAL_IP4_ADDRESS:
-					addrRequest = true
-					if len(attribute.Value) != 0 {
-						logger.IKELog.Debugf("got client requested address: %d.%d.%d.%d",
-							attribute.Value[0], attribute.Value[1], attribute.Value[2], attribute.Value[3])
-					}
-				default:
-					logger.IKELog.Warnf("receive other type of configuration request: %d", attribute.Type)
-				}
-			}
+			ikeLog.Debugf("received configuration payload with type: %d", configuration.ConfigurationType)
 		} else {
-			logger.IKELog.Warnln("configuration is nil. UE did not sent any configuration request")
+			ikeLog.Warnln("configuration is nil. UE did not sent any configuration request")
 		}
 
 		responseIKEPayload.Reset()
 
 		// Calculate local AUTH
+		signedOctets, err := responderSignedOctets(ikeSecurityAssociation)
+		if err != nil {
+			return err
+		}
 		pseudorandomFunction.Reset()
-		if _, err := pseudorandomFunction.Write(ikeSecurityAssociation.ResponderSignedOctets); err != nil {
-			logger.IKELog.Errorf("pseudorandom function write error: %+v", err)
-			return
+		if _, err := pseudorandomFunction.Write(signedOctets); err != nil {
+			return fmt.Errorf("pseudorandom function write error: %w", err)
 		}
 
 		// Authentication
@@ -657,102 +1016,56 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 			message.SharedKeyMesageIntegrityCode, pseudorandomFunction.Sum(nil))
 
 		// Prepare configuration payload and traffic selector payload for initiator and responder
-		var ueIPAddr, n3iwfIPAddr net.IP
-		if !addrRequest {
-			logger.IKELog.Errorln("UE did not send any configuration request for its IP address")
-			return
+		var ueIPAddr net.IP
+		if !requestedAttributes[message.INTERNAL_IP4_ADDRESS] {
+			return errors.New("UE did not send any configuration request for its IP address")
 		}
 		// IP addresses (IPSec)
-		ueIp := n3iwfCtx.NewInternalUEIPAddr(ikeUE)
-		if ueIp == nil {
-			logger.IKELog.Errorln("UE IP is nil")
-			return
+		ueIp, err := n3iwfCtx.AllocateUEInnerAddress(ikeUE)
+		if err != nil {
+			responseIKEPayload.Reset()
+			responseIKEPayload.BuildNotification(message.TypeNone, message.INTERNAL_ADDRESS_FAILURE, nil, nil)
+			responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
+				message.IKE_AUTH, true, false, ikeMsg.MessageID, responseIKEPayload)
+			if err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
+				ikeSecurityAssociation.IKESAKey); err != nil {
+				return err
+			}
+			return &ExchangeError{Notify: message.INTERNAL_ADDRESS_FAILURE, Err: err}
 		}
 		ueIPAddr = ueIp.To4()
-		n3iwfIPAddr = net.ParseIP(ipsecGwAddr).To4()
 
 		responseConfiguration := responseIKEPayload.BuildConfiguration(message.CFG_REPLY)
 		responseConfiguration.ConfigurationAttribute.BuildConfigurationAttribute(message.INTERNAL_IP4_ADDRESS, ueIPAddr)
-		responseConfiguration.ConfigurationAttribute.BuildConfigurationAttribute(message.INTERNAL_IP4_NETMASK, n3iwfCtx.Subnet.Mask)
+		responseConfiguration.ConfigurationAttribute.BuildConfigurationAttribute(message.INTERNAL_IP4_NETMASK, ikeUE.InnerNetmask)
+		buildConfigurationReplyAttributes(&responseConfiguration.ConfigurationAttribute, n3iwfCtx, ikeUE,
+			requestedAttributes)
 
 		ikeUE.IPSecInnerIP = ueIPAddr
-		ipsecInnerIPAddr, err := net.ResolveIPAddr("ip", ueIPAddr.String())
+		ikeUE.IPSecInnerIPAddr = innerIPAddr(ueIPAddr)
+		ikeLog.Debugf("ueIPAddr: %+v", ueIPAddr)
+
+		rebinding, err := checkNATRebinding(n3iwfCtx, udpConn, n3iwfAddr, ueAddr, ikeSecurityAssociation)
 		if err != nil {
-			logger.IKELog.Errorf("resolve UE inner IP address failed: %+v", err)
-			return
+			ikeLog.Warnf("HandleIKEAUTH(): %v", err)
 		}
-		ikeUE.IPSecInnerIPAddr = ipsecInnerIPAddr
-		logger.IKELog.Debugf("ueIPAddr: %+v", ueIPAddr)
-
-		// Security Association
-		responseIKEPayload = append(responseIKEPayload, ikeSecurityAssociation.IKEAuthResponseSA)
-
-		// Traffic Selectors initiator/responder
-		responseTrafficSelectorInitiator := responseIKEPayload.BuildTrafficSelectorInitiator()
-		responseTrafficSelectorInitiator.TrafficSelectors.BuildIndividualTrafficSelector(
-			message.TS_IPV4_ADDR_RANGE, message.IPProtocolAll, 0, 65535, ueIPAddr.To4(), ueIPAddr.To4())
-		responseTrafficSelectorResponder := responseIKEPayload.BuildTrafficSelectorResponder()
-		responseTrafficSelectorResponder.TrafficSelectors.BuildIndividualTrafficSelector(
-			message.TS_IPV4_ADDR_RANGE, message.IPProtocolAll, 0, 65535, n3iwfIPAddr.To4(), n3iwfIPAddr.To4())
-
-		// Record traffic selector to IKE security association
-		ikeSecurityAssociation.TrafficSelectorInitiator = responseTrafficSelectorInitiator
-		ikeSecurityAssociation.TrafficSelectorResponder = responseTrafficSelectorResponder
-
-		// Get data needed by xfrm
-
-		// Allocate N3IWF inbound SPI
-		var inboundSPI uint32
-		inboundSPIByte := make([]byte, 4)
-		for {
-			buf := make([]byte, 4)
-			_, err = rand.Read(buf)
+		// Security Association and Traffic Selectors, left out of a childless IKE_AUTH
+		var childSecurityAssociationContext *context.ChildSecurityAssociation
+		if ikeSecurityAssociation.IKEAuthResponseSA != nil {
+			childSecurityAssociationContext, err = installCPChildSA(n3iwfCtx, ikeSecurityAssociation, n3iwfAddr,
+				ueAddr, ikeSecurityAssociation.IKEAuthResponseSA, nil, ikeSecurityAssociation.ConcatenatedNonce)
 			if err != nil {
-				logger.IKELog.Errorf("handle IKE_AUTH Generate ChildSA inboundSPI: %v", err)
-				return
-			}
-			randomUint32 := binary.BigEndian.Uint32(buf)
-			// check if the inbound SPI havn't been allocated by N3IWF
-			if _, ok := n3iwfCtx.ChildSA.Load(randomUint32); !ok {
-				inboundSPI = randomUint32
-				break
+				var exchangeErr *ExchangeError
+				if errors.As(err, &exchangeErr) {
+					sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+						exchangeErr.Notify)
+				}
+				// Without the CP child SA, NAS cannot reach the UE
+				releaseFailedIKESA(n3iwfCtx, ikeSecurityAssociation)
+				return err
 			}
-		}
-		binary.BigEndian.PutUint32(inboundSPIByte, inboundSPI)
-
-		outboundSPI := binary.BigEndian.Uint32(ikeSecurityAssociation.IKEAuthResponseSA.Proposals[0].SPI)
-		logger.IKELog.Debugf("inbound SPI: %+v, outbound SPI: %+v", inboundSPI, outboundSPI)
-
-		// SPI field of IKEAuthResponseSA is used to save outbound SPI temporarily.
-		// After N3IWF produced its inbound SPI, the field will be overwritten with the SPI.
-		ikeSecurityAssociation.IKEAuthResponseSA.Proposals[0].SPI = inboundSPIByte
-
-		// Consider 0x01 as the speicified index for IKE_AUTH exchange
-		ikeUE.CreateHalfChildSA(0x01, inboundSPI, -1)
-		childSecurityAssociationContext, err := ikeUE.CompleteChildSA(0x01, outboundSPI, ikeSecurityAssociation.IKEAuthResponseSA)
-		if err != nil {
-			logger.IKELog.Errorf("create child security association context failed: %+v", err)
-			return
-		}
-		err = parseIPAddressInformationToChildSecurityAssociation(childSecurityAssociationContext, ueAddr.IP,
-			ikeSecurityAssociation.TrafficSelectorResponder.TrafficSelectors[0],
-			ikeSecurityAssociation.TrafficSelectorInitiator.TrafficSelectors[0])
-		if err != nil {
-			logger.IKELog.Errorf("parse IP address to child security association failed: %+v", err)
-			return
-		}
-		// Select TCP traffic
-		childSecurityAssociationContext.SelectedIPProtocol = unix.IPPROTO_TCP
-
-		if err := childSecurityAssociationContext.ChildSAKey.GenerateKeyForChildSA(ikeSecurityAssociation.IKESAKey, ikeSecurityAssociation.ConcatenatedNonce); err != nil {
-			logger.IKELog.Errorf("generate key for child SA failed: %+v", err)
-			return
-		}
-		// NAT-T concern
-		if ikeSecurityAssociation.UeBehindNAT || ikeSecurityAssociation.N3iwfBehindNAT {
-			childSecurityAssociationContext.EnableEncapsulate = true
-			childSecurityAssociationContext.N3IWFPort = n3iwfAddr.Port
-			childSecurityAssociationContext.NATPort = ueAddr.Port
+			responseIKEPayload = append(responseIKEPayload, ikeSecurityAssociation.IKEAuthResponseSA,
+				ikeSecurityAssociation.TrafficSelectorInitiator, ikeSecurityAssociation.TrafficSelectorResponder)
 		}
 
 		// Notification(NAS_IP_ADDRESS)
@@ -765,47 +1078,187 @@ func HandleIKEAUTH(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr,
 		responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
 			message.IKE_AUTH, true, false, ikeMsg.MessageID, responseIKEPayload)
 
-		childSecurityAssociationContext.LocalIsInitiator = false
-		// Apply XFRM rules
-		// IPsec for CP always use default XFRM interface
-		if err = xfrm.ApplyXFRMRule(false, n3iwfCtx.XfrmInterfaceId, childSecurityAssociationContext); err != nil {
-			logger.IKELog.Errorf("applying XFRM rules failed: %+v", err)
-			return
-		}
-		logger.IKELog.Debugln(childSecurityAssociationContext.String(n3iwfCtx.XfrmInterfaceId))
-
 		// Send IKE ikeMsg to UE
 		if err = SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
 			ikeSecurityAssociation.IKESAKey); err != nil {
-			logger.IKELog.Errorf("HandleIKEAUTH(): %v", err)
-			return
+			return err
 		}
 
 		ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeUE.N3IWFIKESecurityAssociation.LocalSPI)
 		if !ok {
-			logger.IKELog.Errorf("cannot get RanNgapId from SPI: %+v", ikeUE.N3IWFIKESecurityAssociation.LocalSPI)
-			return
+			return fmt.Errorf("cannot get RanNgapId from SPI: %+v", ikeUE.N3IWFIKESecurityAssociation.LocalSPI)
 		}
 
 		ikeSecurityAssociation.State++
+		observeEstablishment(ikeSecurityAssociation, EstablishmentSuccess)
+		ikeSecurityAssociation.Transcript.Reset()
+		n3iwfCtx.AuditIKESA(ikeSecurityAssociation, context.AuditEstablish, context.AuditAuthSuccess)
+		if rebinding != nil {
+			sendReturnRoutabilityCheck(ikeSecurityAssociation, rebinding)
+		}
+		ikeSecurityAssociation.StartNATKeepalive(n3iwfCtx.NATKeepaliveInterval)
+
+		// NAS waits for the CP child SA, see handleCPChildSARequest. The
+		// request of the UE for it is awaited as an EAP-5G round would be
+		if childSecurityAssociationContext == nil {
+			ikeSecurityAssociation.CPChildSAPending = true
+			n3iwfCtx.StartEAPRoundTimer(ikeSecurityAssociation)
+			return nil
+		}
+		n3iwfCtx.AuditChildSA(ikeSecurityAssociation, childSecurityAssociationContext, context.AuditEstablish,
+			context.AuditAuthSuccess)
+		return startNASSignalling(n3iwfCtx, ikeSecurityAssociation, ranNgapId)
+	}
+	return nil
+}
+
+// Installs the XFRM states and policies of a child SA, replaced in tests
+var applyXFRMRule = xfrm.ApplyXFRMRule
+
+// installCPChildSA installs the CP child SA, which carries NAS over TCP, with
+// the proposal chosen in responseSecurityAssociation, whose SPI is overwritten
+// with the N3IWF inbound SPI. The traffic selectors of the UE recorded in the
+// IKE SA are replaced with those narrowed to NAS, to be sent back. Its keys
+// derive from sharedKey, the Diffie-Hellman shared secret when set up with
+// PFS, and concatenatedNonce. The failures to answer with an error notify
+// are returned as *ExchangeError
+func installCPChildSA(n3iwfCtx *context.N3IWFContext, ikeSecurityAssociation *context.IKESecurityAssociation,
+	n3iwfAddr, ueAddr *net.UDPAddr, responseSecurityAssociation *message.SecurityAssociation,
+	sharedKey, concatenatedNonce []byte,
+) (*context.ChildSecurityAssociation, error) {
+	ikeLog := ikeSecurityAssociation.Log()
+	ikeUE := ikeSecurityAssociation.IkeUE
+	ueIPAddr := ikeUE.IPSecInnerIP.To4()
+	n3iwfIPAddr := net.ParseIP(n3iwfCtx.IpSecGatewayAddress).To4()
+
+	// Traffic Selectors initiator/responder, narrowed to NAS over TCP
+	selector, err := narrowChildSASelector(cpChildSASelector(n3iwfCtx),
+		ikeSecurityAssociation.TrafficSelectorResponder.TrafficSelectors[0],
+		ikeSecurityAssociation.TrafficSelectorInitiator.TrafficSelectors[0])
+	if err != nil {
+		return nil, &ExchangeError{Notify: message.TS_UNACCEPTABLE, Err: err}
+	}
+	ueStartPort, ueEndPort := portRange(selector.remotePort)
+	responseTrafficSelectorInitiator := new(message.TrafficSelectorInitiator)
+	responseTrafficSelectorInitiator.TrafficSelectors.BuildIndividualTrafficSelector(
+		message.TS_IPV4_ADDR_RANGE, selector.ipProtocol, ueStartPort, ueEndPort, ueIPAddr, ueIPAddr)
+	n3iwfStartPort, n3iwfEndPort := portRange(selector.localPort)
+	responseTrafficSelectorResponder := new(message.TrafficSelectorResponder)
+	responseTrafficSelectorResponder.TrafficSelectors.BuildIndividualTrafficSelector(
+		message.TS_IPV4_ADDR_RANGE, selector.ipProtocol, n3iwfStartPort, n3iwfEndPort, n3iwfIPAddr, n3iwfIPAddr)
+
+	// Record traffic selector to IKE security association
+	ikeSecurityAssociation.TrafficSelectorInitiator = responseTrafficSelectorInitiator
+	ikeSecurityAssociation.TrafficSelectorResponder = responseTrafficSelectorResponder
+
+	// Allocate N3IWF inbound SPI
+	inboundSPI, err := allocateChildSAInboundSPI(n3iwfCtx)
+	if err != nil {
+		if errors.Is(err, ErrSPIExhausted) {
+			return nil, &ExchangeError{Notify: message.NO_ADDITIONAL_SAS, Err: err}
+		}
+		return nil, fmt.Errorf("generate CP child SA inbound SPI: %w", err)
+	}
+	inboundSPIByte := make([]byte, 4)
+	binary.BigEndian.PutUint32(inboundSPIByte, inboundSPI)
+
+	outboundSPI := binary.BigEndian.Uint32(responseSecurityAssociation.Proposals[0].SPI)
+	ikeLog.Debugf("inbound SPI: %+v, outbound SPI: %+v", inboundSPI, outboundSPI)
+	// RFC 7296 section 2.21.2: the IKE SA is kept, without child SA
+	if err = ikeUE.CheckOutboundSPI(outboundSPI, ueAddr.IP); err != nil {
+		return nil, &ExchangeError{Notify: message.NO_PROPOSAL_CHOSEN, Err: err}
+	}
+
+	// SPI field of the response SA is used to save outbound SPI temporarily.
+	// After N3IWF produced its inbound SPI, the field will be overwritten with the SPI.
+	responseSecurityAssociation.Proposals[0].SPI = inboundSPIByte
+
+	// Consider 0x01 as the speicified index for the CP child SA exchange
+	ikeUE.CreateHalfChildSA(0x01, inboundSPI, -1)
+	childSecurityAssociationContext, err := ikeUE.CompleteChildSA(0x01, outboundSPI, responseSecurityAssociation)
+	if err != nil {
+		return nil, fmt.Errorf("create child security association context failed: %w", err)
+	}
+	// The CP child SA uses the address of the IKE SA until the UE passes the check
+	peerAddr := ueAddr
+	if n3iwfCtx.ReturnRoutabilityCheck {
+		peerAddr = ikeSecurityAssociation.IKEConnection.UEAddr
+	}
+	err = parseIPAddressInformationToChildSecurityAssociation(childSecurityAssociationContext, peerAddr.IP,
+		ikeSecurityAssociation.TrafficSelectorResponder.TrafficSelectors[0],
+		ikeSecurityAssociation.TrafficSelectorInitiator.TrafficSelectors[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse IP address to child security association failed: %w", err)
+	}
+	n3iwfCtx.IndexOutboundSPI(childSecurityAssociationContext)
+	childSecurityAssociationContext.SelectedIPProtocol = selector.ipProtocol
+	childSecurityAssociationContext.SelectedLocalPort = selector.localPort
+	childSecurityAssociationContext.SelectedRemotePort = selector.remotePort
+
+	if err := childSecurityAssociationContext.ChildSAKey.GenerateKeyForChildSA(ikeSecurityAssociation.IKESAKey, sharedKey, concatenatedNonce); err != nil {
+		return nil, fmt.Errorf("generate key for child SA failed: %w", err)
+	}
+	// NAT-T concern
+	if ikeSecurityAssociation.UeBehindNAT || ikeSecurityAssociation.N3iwfBehindNAT {
+		childSecurityAssociationContext.EnableEncapsulate = true
+		childSecurityAssociationContext.N3IWFPort = n3iwfAddr.Port
+		childSecurityAssociationContext.NATPort = peerAddr.Port
+	}
 
-		// After this, N3IWF will forward NAS with Child SA (IPSec SA)
-		n3iwfCtx.NgapServer.RcvEventCh <- context.NewStartTCPSignalNASMsgEvt(ranNgapId)
+	childSecurityAssociationContext.LocalIsInitiator = false
+	// Apply XFRM rules
+	// IPsec for CP always use default XFRM interface
+	xfrmiId := n3iwfCtx.DefaultXfrmIfaceId()
+	// A colliding policy would fail the install or capture the traffic of
+	// another UE, the UE is left without child SA
+	if conflict := xfrm.FindPolicyConflict(n3iwfCtx, xfrmiId, childSecurityAssociationContext); conflict != nil {
+		if err = ikeUE.DeleteChildSA(childSecurityAssociationContext); err != nil {
+			ikeLog.Warnf("delete CP child SA: %v", err)
+		}
+		return nil, &ExchangeError{
+			Notify: message.TS_UNACCEPTABLE,
+			Err:    fmt.Errorf("CP child SA selectors collide with %s", conflict),
+		}
+	}
+	if err = applyXFRMRule(false, xfrmiId, childSecurityAssociationContext); err != nil {
+		return nil, fmt.Errorf("applying XFRM rules failed: %w", err)
+	}
+	ikeLog.Infow("CP child SA installed", childSecurityAssociationContext.LogFields(xfrmiId)...)
+	ikeLog.Debugln(childSecurityAssociationContext.String(xfrmiId))
+	return childSecurityAssociationContext, nil
+}
 
-		// Get TempPDUSessionSetupData from NGAP to setup PDU session if needed
-		n3iwfCtx.NgapServer.RcvEventCh <- context.NewGetNGAPContextEvt(ranNgapId, []int64{context.CxtTempPDUSessionSetupData})
+// startNASSignalling lets NGAP forward NAS over the CP child SA of the UE, and
+// fetches the PDU sessions to set up, if any
+func startNASSignalling(n3iwfCtx *context.N3IWFContext, ikeSecurityAssociation *context.IKESecurityAssociation,
+	ranNgapId int64,
+) error {
+	// After this, N3IWF will forward NAS with Child SA (IPSec SA)
+	if err := n3iwfCtx.SendNgapEvent(context.NewStartTCPSignalNASMsgEvt(ranNgapId)); err != nil {
+		return err
 	}
+
+	// Get TempPDUSessionSetupData from NGAP to setup PDU session if needed
+	token := ikeSecurityAssociation.NewNGAPContextRequest(context.NGAPContextPDUSessionSetup)
+	return n3iwfCtx.SendNgapEvent(context.NewGetNGAPContextEvt(ranNgapId, token,
+		[]int64{context.CxtTempPDUSessionSetupData}))
+}
+
+// HandleCREATECHILDSA handles a CREATE_CHILD_SA message, logging and counting its failure
+func HandleCREATECHILDSA(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation) {
+	logExchangeError(ikeSecurityAssociation, message.CREATE_CHILD_SA, "HandleCREATECHILDSA",
+		handleCREATECHILDSA(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation))
 }
 
-func HandleCREATECHILDSA(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation) {
-	logger.IKELog.Debugln("handle CREATE_CHILD_SA")
+func handleCREATECHILDSA(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation) error {
+	ikeLog := ikeSecurityAssociation.Log()
+	ikeLog.Debugln("handle CREATE_CHILD_SA")
 
 	n3iwfCtx := context.N3IWFSelf()
 
 	if !ikeSecurityAssociation.IKEConnection.UEAddr.IP.Equal(ueAddr.IP) ||
 		!ikeSecurityAssociation.IKEConnection.N3IWFAddr.IP.Equal(n3iwfAddr.IP) {
-		logger.IKELog.Warnf("get unexpteced IP in SPI: %016x", ikeSecurityAssociation.LocalSPI)
-		return
+		return fmt.Errorf("get unexpteced IP in SPI: %016x", ikeSecurityAssociation.LocalSPI)
 	}
 
 	// Parse payloads
@@ -813,45 +1266,128 @@ func HandleCREATECHILDSA(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, i
 	var nonce *message.Nonce
 	var trafficSelectorInitiator *message.TrafficSelectorInitiator
 	var trafficSelectorResponder *message.TrafficSelectorResponder
+	var keyExchange *message.KeyExchange
+	var notifications []*message.Notification
 
 	for _, ikePayload := range ikeMsg.Payloads {
+		var err error
 		switch ikePayload.Type() {
 		case message.TypeSA:
-			securityAssociation = ikePayload.(*message.SecurityAssociation)
+			securityAssociation, err = assertPayload[*message.SecurityAssociation](ikePayload)
 		case message.TypeNiNr:
-			nonce = ikePayload.(*message.Nonce)
+			nonce, err = assertPayload[*message.Nonce](ikePayload)
 		case message.TypeTSi:
-			trafficSelectorInitiator = ikePayload.(*message.TrafficSelectorInitiator)
+			trafficSelectorInitiator, err = assertPayload[*message.TrafficSelectorInitiator](ikePayload)
 		case message.TypeTSr:
-			trafficSelectorResponder = ikePayload.(*message.TrafficSelectorResponder)
+			trafficSelectorResponder, err = assertPayload[*message.TrafficSelectorResponder](ikePayload)
+		case message.TypeKE:
+			keyExchange, err = assertPayload[*message.KeyExchange](ikePayload)
+		case message.TypeN:
+			var notification *message.Notification
+			notification, err = assertPayload[*message.Notification](ikePayload)
+			notifications = append(notifications, notification)
 		default:
-			logger.IKELog.Warnf(
+			if unknown, ok := ikePayload.(*message.UnknownPayload); ok && unknown.Critical {
+				return rejectUnsupportedCriticalPayload(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, unknown)
+			}
+			ikeLog.Warnf(
 				"get IKE payload (type %d) in CREATE_CHILD_SA ikeMsg, this payload will not be handled by IKE handler",
 				ikePayload.Type())
 		}
+		if err != nil {
+			return rejectMalformedMessage(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, err)
+		}
+	}
+
+	if !ikeMsg.IsResponse() {
+		// A retransmitted request must not install another child SA
+		if cached := ikeSecurityAssociation.LastChildSAResponse; cached != nil && cached.MessageID == ikeMsg.MessageID {
+			return resendCachedResponse(udpConn, n3iwfAddr, ueAddr, ikeSecurityAssociation, cached)
+		}
+		// A request from the UE rekeys one of its child SAs
+		if rekeyNotification := findNotification(notifications, message.REKEY_SA); rekeyNotification != nil {
+			recorder := &responseRecorder{IKEConn: udpConn}
+			err := handleChildSARekeyRequest(recorder, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+				rekeyNotification, securityAssociation, nonce, keyExchange, notifications)
+			cacheChildSAResponse(ikeSecurityAssociation, ikeMsg.MessageID, recorder)
+			return err
+		}
+		// After a childless IKE_AUTH, the first request of the UE sets up the CP child SA
+		if ikeSecurityAssociation.CPChildSAPending {
+			recorder := &responseRecorder{IKEConn: udpConn}
+			err := handleCPChildSARequest(recorder, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+				securityAssociation, nonce, keyExchange, trafficSelectorInitiator, trafficSelectorResponder)
+			cacheChildSAResponse(ikeSecurityAssociation, ikeMsg.MessageID, recorder)
+			return err
+		}
+		// Any other request of the UE for a new child SA is refused
+		recorder := &responseRecorder{IKEConn: udpConn}
+		err := answerUEChildSARequest(recorder, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation)
+		cacheChildSAResponse(ikeSecurityAssociation, ikeMsg.MessageID, recorder)
+		return err
+	}
+
+	// The UE refused the child SA of a PDU session, e.g. with NO_PROPOSAL_CHOSEN,
+	// or chose a proposal that was not offered. This fails the PDU session setup
+	// with the matching NGAP cause
+	if ikeMsg.IsResponse() {
+		if pending := ikeSecurityAssociation.PendingChildSARekey; pending != nil && pending.MessageID == ikeMsg.MessageID {
+			return completeChildSARekey(ikeSecurityAssociation, securityAssociation, nonce, notifications)
+		}
+		if !pendingPDUSessionChildSA(ikeSecurityAssociation, ikeMsg.MessageID) {
+			return fmt.Errorf("response to unknown CREATE_CHILD_SA (message ID %d)", ikeMsg.MessageID)
+		}
+		// The UE answers each retransmission of the request
+		if ikeSecurityAssociation.TemporaryIkeMsg != nil {
+			ikeLog.Debugf("CREATE_CHILD_SA response (message ID %d) already received", ikeMsg.MessageID)
+			return nil
+		}
+		ikeSecurityAssociation.ChildSACreateRetransmit.Stop()
+		ikeSecurityAssociation.ChildSACreateRetransmit = nil
+		errorNotify := uint16(0)
+		if errorNotification := childSAErrorNotification(notifications); errorNotification != nil {
+			ikeLog.Warnf("UE rejected CREATE_CHILD_SA (message ID %d) with notify %d",
+				ikeMsg.MessageID, errorNotification.NotifyMessageType)
+			errorNotify = errorNotification.NotifyMessageType
+		} else {
+			halfChildSA := ikeSecurityAssociation.IkeUE.TemporaryExchangeMsgIDChildSAMapping[ikeMsg.MessageID]
+			if err := checkChosenChildSAProposal(halfChildSA.OfferedProposals, securityAssociation); err != nil {
+				ikeLog.Warnf("UE answered CREATE_CHILD_SA (message ID %d) with an unacceptable proposal: %v",
+					ikeMsg.MessageID, err)
+				errorNotify = message.NO_PROPOSAL_CHOSEN
+			} else if findNotification(notifications, message.USE_TRANSPORT_MODE) != nil {
+				// RFC 7296 section 1.3.1: the child SAs of PDU sessions are
+				// requested in tunnel mode, which the UE cannot change
+				ikeLog.Warnf("UE answered CREATE_CHILD_SA (message ID %d) with USE_TRANSPORT_MODE, not requested",
+					ikeMsg.MessageID)
+				errorNotify = message.NO_PROPOSAL_CHOSEN
+			}
+		}
+		if errorNotify != 0 {
+			ikeSecurityAssociation.TemporaryIkeMsg = &context.IkeMsgTemporaryData{
+				ErrorNotify: errorNotify,
+			}
+			return requestPDUSessionSetupData(n3iwfCtx, ikeSecurityAssociation)
+		}
 	}
 
 	// Check received ikeMsg
 	if securityAssociation == nil {
-		logger.IKELog.Errorln("security association field is nil")
-		return
+		return errors.New("security association field is nil")
 	}
 
 	if trafficSelectorInitiator == nil {
-		logger.IKELog.Errorln("traffic selector initiator field is nil")
-		return
+		return errors.New("traffic selector initiator field is nil")
 	}
 
 	if trafficSelectorResponder == nil {
-		logger.IKELog.Errorln("traffic selector responder field is nil")
-		return
+		return errors.New("traffic selector responder field is nil")
 	}
 
 	// Nonce
 	if nonce == nil {
-		logger.IKELog.Errorln("nonce field is nil")
 		// TODO: send error ikeMsg to UE
-		return
+		return errors.New("nonce field is nil")
 	}
 	ikeSecurityAssociation.ConcatenatedNonce = append(ikeSecurityAssociation.ConcatenatedNonce, nonce.NonceData...)
 
@@ -860,16 +1396,78 @@ func HandleCREATECHILDSA(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, i
 		TrafficSelectorInitiator: trafficSelectorInitiator,
 		TrafficSelectorResponder: trafficSelectorResponder,
 	}
+	return requestPDUSessionSetupData(n3iwfCtx, ikeSecurityAssociation)
+}
+
+// answerUEChildSARequest refuses a CREATE_CHILD_SA request of the UE for a new
+// child SA with TEMPORARY_FAILURE, without waiting for NGAP. The child SAs of
+// PDU sessions are only created by the N3IWF, the UE gets them from the
+// requests of the N3IWF
+func answerUEChildSARequest(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage,
+	ikeSecurityAssociation *context.IKESecurityAssociation,
+) error {
+	sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, message.TEMPORARY_FAILURE)
+	return &ExchangeError{
+		Notify: message.TEMPORARY_FAILURE,
+		Err: fmt.Errorf("CREATE_CHILD_SA request (message ID %d) for a new child SA in state %d",
+			ikeMsg.MessageID, ikeSecurityAssociation.State),
+	}
+}
 
+// requestPDUSessionSetupData fetches the PDU session setup state from NGAP,
+// the CREATE_CHILD_SA response is then completed by continueCreateChildSA
+func requestPDUSessionSetupData(n3iwfCtx *context.N3IWFContext, ikeSecurityAssociation *context.IKESecurityAssociation) error {
 	ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeSecurityAssociation.LocalSPI)
 	if !ok {
-		logger.IKELog.Errorf("cannot get RanNgapID from SPI: %+v", ikeSecurityAssociation.LocalSPI)
-		return
+		return fmt.Errorf("cannot get RanNgapID from SPI: %+v", ikeSecurityAssociation.LocalSPI)
 	}
 
 	ngapCxtReqNumlist := []int64{context.CxtTempPDUSessionSetupData}
 
-	n3iwfCtx.NgapServer.RcvEventCh <- context.NewGetNGAPContextEvt(ranNgapId, ngapCxtReqNumlist)
+	token := ikeSecurityAssociation.NewNGAPContextRequest(context.NGAPContextCreateChildSA)
+	if err := n3iwfCtx.SendNgapEvent(context.NewGetNGAPContextEvt(ranNgapId, token, ngapCxtReqNumlist)); err != nil {
+		return fmt.Errorf("requestPDUSessionSetupData: %w", err)
+	}
+	return nil
+}
+
+// childSAErrorNotification returns the first error notify of a CREATE_CHILD_SA
+// response, RFC 7296 section 3.10.1 reserves types below 16384 for errors
+func childSAErrorNotification(notifications []*message.Notification) *message.Notification {
+	for _, notification := range notifications {
+		if notification.NotifyMessageType < 16384 {
+			return notification
+		}
+	}
+	return nil
+}
+
+// pendingPDUSessionChildSA reports whether messageID is the CREATE_CHILD_SA
+// request the N3IWF is waiting for, for the child SA of a PDU session
+func pendingPDUSessionChildSA(ikeSecurityAssociation *context.IKESecurityAssociation, messageID uint32) bool {
+	ikeUe := ikeSecurityAssociation.IkeUE
+	if ikeUe == nil || messageID != ikeSecurityAssociation.ResponderMessageID {
+		return false
+	}
+	_, ok := ikeUe.TemporaryExchangeMsgIDChildSAMapping[messageID]
+	return ok
+}
+
+// childSARejectionError returns the reason reported to NGAP for a PDU session
+// whose child SA the UE refused with notifyType
+func childSARejectionError(notifyType uint16) context.EvtError {
+	switch notifyType {
+	case message.NO_ADDITIONAL_SAS:
+		return context.ErrNoAdditionalSAs
+	case message.NO_PROPOSAL_CHOSEN:
+		return context.ErrNoProposalChosen
+	case message.TS_UNACCEPTABLE:
+		return context.ErrTSUnacceptable
+	case message.TEMPORARY_FAILURE:
+		return context.ErrTemporaryFailure
+	default:
+		return context.ErrChildSARejected
+	}
 }
 
 func continueCreateChildSA(ikeSecurityAssociation *context.IKESecurityAssociation,
@@ -877,28 +1475,48 @@ func continueCreateChildSA(ikeSecurityAssociation *context.IKESecurityAssociatio
 ) {
 	n3iwfCtx := context.N3IWFSelf()
 	ipsecGwAddr := n3iwfCtx.IpSecGatewayAddress
+	ikeLog := ikeSecurityAssociation.Log()
 
 	// UE context
 	ikeUe := ikeSecurityAssociation.IkeUE
 	if ikeUe == nil {
-		logger.IKELog.Errorln("UE context is nil")
+		ikeLog.Errorln("UE context is nil")
 		return
 	}
 
-	// PDU session information
-	if temporaryPDUSessionSetupData == nil {
-		logger.IKELog.Errorln("no PDU session information")
+	temporaryIkeMsg := ikeSecurityAssociation.TemporaryIkeMsg
+	if temporaryIkeMsg == nil {
+		ikeLog.Errorln("no CREATE_CHILD_SA waiting for the PDU session information")
 		return
 	}
+	ikeSecurityAssociation.TemporaryIkeMsg = nil
 
-	if len(temporaryPDUSessionSetupData.UnactivatedPDUSession) == 0 {
-		logger.IKELog.Errorln("no unactivated PDU session information")
+	// PDU session information, without which the exchange answered by the UE
+	// is given up
+	if temporaryPDUSessionSetupData == nil || len(temporaryPDUSessionSetupData.UnactivatedPDUSession) == 0 {
+		ikeLog.Errorln("no PDU session information for the CREATE_CHILD_SA response")
+		delete(ikeUe.TemporaryExchangeMsgIDChildSAMapping, ikeSecurityAssociation.ResponderMessageID)
+		ikeSecurityAssociation.ResponderMessageID++
 		return
 	}
 
-	temporaryIkeMsg := ikeSecurityAssociation.TemporaryIkeMsg
+	if temporaryIkeMsg.ErrorNotify != 0 {
+		delete(ikeUe.TemporaryExchangeMsgIDChildSAMapping, ikeSecurityAssociation.ResponderMessageID)
+		temporaryPDUSessionSetupData.FailedErrStr = append(temporaryPDUSessionSetupData.FailedErrStr,
+			childSARejectionError(temporaryIkeMsg.ErrorNotify))
+		ikeSecurityAssociation.ResponderMessageID++
+		CreatePDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData)
+		return
+	}
 	ikeConnection := ikeSecurityAssociation.IKEConnection
 
+	// The UE installed the child SA, which is deleted if the N3IWF fails to
+	// set up its side
+	var inboundSPI uint32
+	if halfChildSA, ok := ikeUe.TemporaryExchangeMsgIDChildSAMapping[ikeSecurityAssociation.ResponderMessageID]; ok {
+		inboundSPI = halfChildSA.InboundSPI
+	}
+
 	// Get xfrm needed data
 	// As specified in RFC 7296, ESP negotiate two child security association (pair) in one exchange
 	// Message ID is used to be a index to pair two SPI in serveral IKE messages.
@@ -906,13 +1524,14 @@ func continueCreateChildSA(ikeSecurityAssociation *context.IKESecurityAssociatio
 	childSecurityAssociationContext, err := ikeUe.CompleteChildSA(
 		ikeSecurityAssociation.ResponderMessageID, outboundSPI, temporaryIkeMsg.SecurityAssociation)
 	if err != nil {
-		logger.IKELog.Errorf("create child security association context failed: %+v", err)
+		ikeLog.Errorf("create child security association context failed: %+v", err)
+		failPDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData, inboundSPI)
 		return
 	}
 
 	// Build TSi if there is no one in the response
 	if len(temporaryIkeMsg.TrafficSelectorInitiator.TrafficSelectors) == 0 {
-		logger.IKELog.Warnln("there is no TSi in CREATE_CHILD_SA response")
+		ikeLog.Warnln("there is no TSi in CREATE_CHILD_SA response")
 		n3iwfIPAddr := net.ParseIP(ipsecGwAddr)
 		temporaryIkeMsg.TrafficSelectorInitiator.TrafficSelectors.BuildIndividualTrafficSelector(
 			message.TS_IPV4_ADDR_RANGE, message.IPProtocolAll,
@@ -921,7 +1540,7 @@ func continueCreateChildSA(ikeSecurityAssociation *context.IKESecurityAssociatio
 
 	// Build TSr if there is no one in the response
 	if len(temporaryIkeMsg.TrafficSelectorResponder.TrafficSelectors) == 0 {
-		logger.IKELog.Warnln("there is no TSr in CREATE_CHILD_SA response")
+		ikeLog.Warnln("there is no TSr in CREATE_CHILD_SA response")
 		ueIPAddr := ikeUe.IPSecInnerIP
 		temporaryIkeMsg.TrafficSelectorResponder.TrafficSelectors.BuildIndividualTrafficSelector(
 			message.TS_IPV4_ADDR_RANGE, message.IPProtocolAll,
@@ -933,14 +1552,25 @@ func continueCreateChildSA(ikeSecurityAssociation *context.IKESecurityAssociatio
 		temporaryIkeMsg.TrafficSelectorInitiator.TrafficSelectors[0],
 		temporaryIkeMsg.TrafficSelectorResponder.TrafficSelectors[0])
 	if err != nil {
-		logger.IKELog.Errorf("parse IP address to child security association failed: %+v", err)
+		ikeLog.Errorf("parse IP address to child security association failed: %+v", err)
+		failPDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData, inboundSPI)
 		return
 	}
-	// Select GRE traffic
-	childSecurityAssociationContext.SelectedIPProtocol = unix.IPPROTO_GRE
+	n3iwfCtx.IndexOutboundSPI(childSecurityAssociationContext)
+	// The user plane is carried over GRE, within the selectors accepted by the UE
+	selector, err := narrowChildSASelector(childSASelector{ipProtocol: unix.IPPROTO_GRE},
+		temporaryIkeMsg.TrafficSelectorInitiator.TrafficSelectors[0],
+		temporaryIkeMsg.TrafficSelectorResponder.TrafficSelectors[0])
+	if err != nil {
+		ikeLog.Errorf("traffic selectors of the UE exclude GRE: %+v", err)
+		failPDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData, inboundSPI)
+		return
+	}
+	childSecurityAssociationContext.SelectedIPProtocol = selector.ipProtocol
 
-	if err := childSecurityAssociationContext.ChildSAKey.GenerateKeyForChildSA(ikeSecurityAssociation.IKESAKey, ikeSecurityAssociation.ConcatenatedNonce); err != nil {
-		logger.IKELog.Errorf("generate key for child SA failed: %+v", err)
+	if err := childSecurityAssociationContext.ChildSAKey.GenerateKeyForChildSA(ikeSecurityAssociation.IKESAKey, nil, ikeSecurityAssociation.ConcatenatedNonce); err != nil {
+		ikeLog.Errorf("generate key for child SA failed: %+v", err)
+		failPDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData, inboundSPI)
 		return
 	}
 	// NAT-T concern
@@ -950,31 +1580,42 @@ func continueCreateChildSA(ikeSecurityAssociation *context.IKESecurityAssociatio
 		childSecurityAssociationContext.NATPort = ikeConnection.UEAddr.Port
 	}
 
-	newXfrmiId := n3iwfCtx.XfrmInterfaceId
+	newXfrmiId := n3iwfCtx.DefaultXfrmIfaceId()
 
-	// The additional PDU session will be separated from default xfrm interface
-	// to avoid SPD entry collision
-	if ikeUe.PduSessionListLen > 1 {
+	// The additional PDU session, or one whose selectors collide with those
+	// of another child SA, will be separated from default xfrm interface to
+	// avoid SPD entry collision, or get its own firewall mark in policy mode
+	dedicated := ikeUe.PduSessionListLen > 1
+	if !dedicated {
+		if conflict := xfrm.FindPolicyConflict(n3iwfCtx, newXfrmiId, childSecurityAssociationContext); conflict != nil {
+			ikeLog.Warnf("selectors of the PDU session collide with %s", conflict)
+			dedicated = true
+		}
+	}
+	switch {
+	case n3iwfCtx.IPsecMode == context.IPsecModePolicy:
+		if dedicated {
+			if childSecurityAssociationContext.XfrmMark, err = n3iwfCtx.AllocateXfrmIfaceId(); err != nil {
+				ikeLog.Errorf("allocate firewall mark of the PDU session: %+v", err)
+				failPDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData, inboundSPI)
+				return
+			}
+			ikeLog.Infof("firewall mark of the PDU session: %d", childSecurityAssociationContext.XfrmMark)
+		}
+	case dedicated:
 		// Setup XFRM interface for ipsec
 		var linkIPSec netlink.Link
-		n3iwfIPAddr := net.ParseIP(ipsecGwAddr).To4()
-		n3iwfIPAddrAndSubnet := net.IPNet{IP: n3iwfIPAddr, Mask: n3iwfCtx.Subnet.Mask}
-		newXfrmiId += n3iwfCtx.XfrmInterfaceId + n3iwfCtx.XfrmIfaceIdOffsetForUP
-		newXfrmiName := fmt.Sprintf("%s-%d", n3iwfCtx.XfrmInterfaceName, newXfrmiId)
-
-		if linkIPSec, err = xfrm.SetupIPsecXfrmi(newXfrmiName, n3iwfCtx.XfrmParentIfaceName, newXfrmiId, n3iwfIPAddrAndSubnet); err != nil {
-			logger.IKELog.Errorf("setup XFRM interface %s fail: %+v", newXfrmiName, err)
+		if newXfrmiId, linkIPSec, err = setupDedicatedXfrmi(n3iwfCtx, ipsecGwAddr, ikeSecurityAssociation); err != nil {
+			ikeLog.Errorf("setup XFRM interface of the PDU session fail: %+v", err)
+			failPDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData, inboundSPI)
 			return
 		}
-
-		logger.IKELog.Infof("setup XFRM interface: %s", newXfrmiName)
-		n3iwfCtx.XfrmIfaces.LoadOrStore(newXfrmiId, linkIPSec)
 		childSecurityAssociationContext.XfrmIface = linkIPSec
-		n3iwfCtx.XfrmIfaceIdOffsetForUP++
-	} else {
+	default:
 		linkIPSec, ok := n3iwfCtx.XfrmIfaces.Load(newXfrmiId)
 		if !ok {
-			logger.IKELog.Warnf("cannot find the XFRM interface with if_id: %d", newXfrmiId)
+			ikeLog.Warnf("cannot find the XFRM interface with if_id: %d", newXfrmiId)
+			failPDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData, inboundSPI)
 			return
 		}
 		childSecurityAssociationContext.XfrmIface = linkIPSec.(netlink.Link)
@@ -982,19 +1623,22 @@ func continueCreateChildSA(ikeSecurityAssociation *context.IKESecurityAssociatio
 
 	// Apply XFRM rules
 	childSecurityAssociationContext.LocalIsInitiator = true
-	if err = xfrm.ApplyXFRMRule(true, newXfrmiId, childSecurityAssociationContext); err != nil {
-		logger.IKELog.Errorf("applying XFRM rules failed: %+v", err)
+	if err = applyXFRMRule(true, newXfrmiId, childSecurityAssociationContext); err != nil {
+		ikeLog.Errorf("applying XFRM rules failed: %+v", err)
+		failPDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData, inboundSPI)
 		return
 	}
-	logger.IKELog.Debugln(childSecurityAssociationContext.String(newXfrmiId))
+	ikeLog.Infow("UP child SA installed", childSecurityAssociationContext.LogFields(newXfrmiId)...)
+	ikeLog.Debugln(childSecurityAssociationContext.String(newXfrmiId))
+	n3iwfCtx.AuditChildSA(ikeSecurityAssociation, childSecurityAssociationContext, context.AuditEstablish,
+		context.AuditPDUSession)
 
-	ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeSecurityAssociation.LocalSPI)
-	if !ok {
-		logger.IKELog.Errorf("cannot get RanNgapId from SPI: %+v", ikeSecurityAssociation.LocalSPI)
-		return
-	}
 	// Forward NAS ikeMsg related to PDU Seesion Establishment Accept to UE
-	n3iwfCtx.NgapServer.RcvEventCh <- context.NewSendNASMsgEvt(ranNgapId)
+	if ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeSecurityAssociation.LocalSPI); !ok {
+		ikeLog.Errorf("cannot get RanNgapId from SPI: %+v", ikeSecurityAssociation.LocalSPI)
+	} else if err := n3iwfCtx.SendNgapEvent(context.NewSendNASMsgEvt(ranNgapId)); err != nil {
+		ikeLog.Errorf("continueCreateChildSA(): %v", err)
+	}
 
 	temporaryPDUSessionSetupData.FailedErrStr = append(temporaryPDUSessionSetupData.FailedErrStr, context.ErrNil)
 
@@ -1004,10 +1648,36 @@ func continueCreateChildSA(ikeSecurityAssociation *context.IKESecurityAssociatio
 	CreatePDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData)
 }
 
-func HandleInformational(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation) {
-	logger.IKELog.Debugln("handle Informational")
+// failPDUSessionChildSA fails the PDU session whose CREATE_CHILD_SA exchange,
+// answered by the UE, the N3IWF could not complete, and moves on to the next
+// one. The UE is asked to delete the child SA with inbound SPI inboundSPI, if
+// any, that it installed
+func failPDUSessionChildSA(ikeUe *context.N3IWFIkeUe,
+	temporaryPDUSessionSetupData *context.PDUSessionSetupTemporaryData, inboundSPI uint32,
+) {
+	ikeSecurityAssociation := ikeUe.N3IWFIKESecurityAssociation
+	delete(ikeUe.TemporaryExchangeMsgIDChildSAMapping, ikeSecurityAssociation.ResponderMessageID)
+	temporaryPDUSessionSetupData.FailedErrStr = append(temporaryPDUSessionSetupData.FailedErrStr,
+		context.ErrTransportResourceUnavailable)
+	ikeSecurityAssociation.ResponderMessageID++
+	if inboundSPI != 0 {
+		queueChildSADelete(ikeUe, &context.ChildSADeleteRequest{InboundSPIs: []uint32{inboundSPI}})
+	}
+	CreatePDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData)
+}
+
+// HandleInformational handles an INFORMATIONAL message, logging and counting its failure
+func HandleInformational(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation) {
+	logExchangeError(ikeSecurityAssociation, message.INFORMATIONAL, "HandleInformational",
+		handleInformational(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation))
+}
+
+func handleInformational(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation) error {
+	ikeLog := ikeSecurityAssociation.Log()
+	ikeLog.Debugln("handle Informational")
 
-	var deletePayload *message.Delete
+	var deletePayloads []*message.Delete
+	var configuration *message.Configuration
 	var err error
 	responseIKEPayload := new(message.IKEPayloadContainer)
 
@@ -1017,39 +1687,115 @@ func HandleInformational(udpConn *net.UDPConn, n3iwfAddr, ueAddr *net.UDPAddr, i
 		n3iwfIke.N3IWFIKESecurityAssociation.DPDReqRetransTimer.Stop()
 		n3iwfIke.N3IWFIKESecurityAssociation.DPDReqRetransTimer = nil
 		atomic.StoreInt32(&n3iwfIke.N3IWFIKESecurityAssociation.CurrentRetryTimes, 0)
+		n3iwfIke.N3IWFIKESecurityAssociation.NotifyLivenessWaiters(nil)
 	}
 
+	var notifications []*message.Notification
 	for _, ikePayload := range ikeMsg.Payloads {
 		switch ikePayload.Type() {
 		case message.TypeD:
-			deletePayload = ikePayload.(*message.Delete)
+			var deletePayload *message.Delete
+			deletePayload, err = assertPayload[*message.Delete](ikePayload)
+			if err == nil && !ikeMsg.IsResponse() {
+				err = validateDeletePayload(deletePayload)
+			}
+			deletePayloads = append(deletePayloads, deletePayload)
+		case message.TypeN:
+			var notification *message.Notification
+			notification, err = assertPayload[*message.Notification](ikePayload)
+			notifications = append(notifications, notification)
+		case message.TypeCP:
+			configuration, err = assertPayload[*message.Configuration](ikePayload)
+			if err == nil && !ikeMsg.IsResponse() {
+				err = validateConfigurationRequest(configuration)
+			}
 		default:
-			logger.IKELog.Warnf(
+			if unknown, ok := ikePayload.(*message.UnknownPayload); ok && unknown.Critical {
+				return rejectUnsupportedCriticalPayload(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, unknown)
+			}
+			ikeLog.Warnf(
 				"get IKE payload (type %d) in Inoformational ikeMsg, this payload will not be handled by IKE handler",
 				ikePayload.Type())
 		}
+		if err != nil {
+			return rejectMalformedMessage(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, err)
+		}
+	}
+
+	// The acknowledgements of the deletes sent by the N3IWF end their exchange,
+	// whatever payloads they carry
+	if ikeMsg.IsResponse() && completeIKESADelete(ikeMsg, ikeSecurityAssociation) {
+		return nil
+	}
+	if ikeMsg.IsResponse() && completeChildSADelete(ikeMsg, ikeSecurityAssociation) {
+		return nil
 	}
 
-	if deletePayload != nil {
-		responseIKEPayload, err = handleDeletePayload(deletePayload, ikeMsg.IsResponse(), ikeSecurityAssociation)
+	// The configuration is answered before any delete is processed, so a
+	// failure rejects the whole request
+	var configurationReply *message.Configuration
+	if configuration != nil && !ikeMsg.IsResponse() {
+		configurationReply, err = answerConfigurationRequest(context.N3IWFSelf(), n3iwfIke, configuration)
 		if err != nil {
-			logger.IKELog.Errorf("HandleInformational(): %v", err)
-			return
+			sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+				message.INTERNAL_ADDRESS_FAILURE)
+			return &ExchangeError{Notify: message.INTERNAL_ADDRESS_FAILURE, Err: err}
+		}
+	}
+
+	// Each Delete payload is answered by its own, the IKE SA delete taking
+	// its child SAs along
+	for _, deletePayload := range deletePayloads {
+		deleteResponse, err := handleDeletePayload(deletePayload, ikeMsg.IsResponse(), ikeSecurityAssociation)
+		if err != nil {
+			return err
+		}
+		*responseIKEPayload = append(*responseIKEPayload, *deleteResponse...)
+		if deletePayload.ProtocolID == message.TypeIKE {
+			break
 		}
 	}
 
 	if ikeMsg.IsResponse() {
+		if err = handleReturnRoutabilityResponse(ueAddr, ikeMsg, ikeSecurityAssociation, notifications); err != nil {
+			ikeLog.Warnf("HandleInformational(): %v", err)
+		}
 		ikeSecurityAssociation.ResponderMessageID++
+		sendQueuedRequests(n3iwfIke)
 	} else { // Get Request ikeMsg
+		var addressUpdate *context.MobikeAddressUpdate
+		if findNotification(notifications, message.UPDATE_SA_ADDRESSES) != nil {
+			addressUpdate, err = handleUpdateSAAddresses(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+				notifications, responseIKEPayload)
+		} else {
+			addressUpdate, err = checkNATRebinding(context.N3IWFSelf(), udpConn, n3iwfAddr, ueAddr, ikeSecurityAssociation)
+		}
+		if err != nil {
+			ikeLog.Warnf("HandleInformational(): %v", err)
+		}
+		if configurationReply != nil {
+			*responseIKEPayload = append(*responseIKEPayload, configurationReply)
+		}
 		SendUEInformationExchange(ikeSecurityAssociation, ikeSecurityAssociation.IKESAKey,
 			responseIKEPayload, false, true, ikeMsg.MessageID,
 			udpConn, ueAddr, n3iwfAddr)
+		if addressUpdate != nil {
+			sendReturnRoutabilityCheck(ikeSecurityAssociation, addressUpdate)
+		}
 	}
+	return nil
 }
 
 func HandleEvent(ikeEvt context.IkeEvt) {
 	logger.IKELog.Debugln("handle IKE event")
 
+	if saEvt, ok := ikeEvt.(context.IkeSAEvt); ok {
+		if ikeSA, ok := context.N3IWFSelf().IKESALoad(saEvt.SPI()); ok {
+			ikeSA.Lock()
+			defer ikeSA.Unlock()
+		}
+	}
+
 	switch ikeEvt.Type() {
 	case context.UnmarshalEAP5GDataResponse:
 		HandleUnmarshalEAP5GDataResponse(ikeEvt)
@@ -1069,6 +1815,20 @@ func HandleEvent(ikeEvt context.IkeEvt) {
 		HandleIKEContextUpdate(ikeEvt)
 	case context.GetNGAPContextResponse:
 		HandleGetNGAPContextResponse(ikeEvt)
+	case context.HalfOpenIKESATimeout:
+		HandleHalfOpenIKESATimeout(ikeEvt)
+	case context.Shutdown:
+		HandleShutdown(ikeEvt)
+	case context.DeleteChildSABySPI:
+		HandleDeleteChildSABySPI(ikeEvt)
+	case context.EAPRoundTimeout:
+		HandleEAPRoundTimeout(ikeEvt)
+	case context.LivenessCheck:
+		HandleLivenessCheck(ikeEvt)
+	case context.ChildSAExpire:
+		HandleChildSAExpire(ikeEvt)
+	case context.RevocationChecked:
+		HandleRevocationChecked(ikeEvt)
 	default:
 		logger.IKELog.Errorf("undefined IKE event type: %d", ikeEvt.Type())
 		return
@@ -1084,7 +1844,13 @@ func HandleUnmarshalEAP5GDataResponse(ikeEvt context.IkeEvt) {
 	nasPDU := unmarshalEAP5GDataResponseEvt.NasPDU
 
 	n3iwfCtx := context.N3IWFSelf()
-	ikeSecurityAssociation, _ := n3iwfCtx.IKESALoad(localSPI)
+	ikeSecurityAssociation, ok := n3iwfCtx.IKESALoad(localSPI)
+	if !ok {
+		logger.IKELog.Warnf("IKE SA %016x is gone, drop the EAP-5G response", localSPI)
+		return
+	}
+	// Also used by the InitialUEMessage sender, which does not hold the SA
+	ikeLog := ikeSecurityAssociation.Log()
 
 	// Create UE context
 	ikeUe := n3iwfCtx.NewN3iwfIkeUe(localSPI)
@@ -1096,12 +1862,24 @@ func HandleUnmarshalEAP5GDataResponse(ikeEvt context.IkeEvt) {
 
 	n3iwfCtx.IkeSpiNgapIdMapping(ikeUe.N3IWFIKESecurityAssociation.LocalSPI, ranUeNgapId)
 
-	n3iwfCtx.NgapServer.RcvEventCh <- context.NewSendInitialUEMessageEvt(
+	evt := context.NewSendInitialUEMessageEvt(
 		ranUeNgapId,
-		ikeSecurityAssociation.IKEConnection.UEAddr.IP.To4().String(),
+		ikeSecurityAssociation.IKEConnection.UEAddr.IP.String(),
 		ikeSecurityAssociation.IKEConnection.UEAddr.Port,
 		nasPDU,
 	)
+	accepted := n3iwfCtx.InitialUEPacer.Submit(localSPI, func() {
+		if err := n3iwfCtx.SendNgapEvent(evt); err != nil {
+			ikeLog.Errorf("HandleUnmarshalEAP5GDataResponse(): %v", err)
+		}
+	})
+	if !accepted {
+		ikeLog.Warnf("InitialUEMessage queue full, reject UE (SPI: %016x)", localSPI)
+		ikeSecurityAssociation.IkeUE = nil
+		n3iwfCtx.DeleteIKEUe(localSPI)
+		n3iwfCtx.DeleteRanUe(ranUeNgapId)
+		HandleSendEAP5GFailureMsg(context.NewSendEAP5GFailureMsgEvt(localSPI, context.ErrInitialUEQueueFull))
+	}
 }
 
 func HandleSendEAP5GFailureMsg(ikeEvt context.IkeEvt) {
@@ -1112,31 +1890,34 @@ func HandleSendEAP5GFailureMsg(ikeEvt context.IkeEvt) {
 	localSPI := sendEAP5GFailureMsgEvt.LocalSPI
 
 	n3iwfCtx := context.N3IWFSelf()
-	ikeSecurityAssociation, _ := n3iwfCtx.IKESALoad(localSPI)
-	logger.IKELog.Warnf("EAP Failure: %s", errMsg.Error())
+	ikeSecurityAssociation, ok := n3iwfCtx.IKESALoad(localSPI)
+	if !ok {
+		logger.IKELog.Warnf("IKE SA %016x is gone, drop the EAP failure", localSPI)
+		return
+	}
+	ikeSecurityAssociation.Log().Warnf("EAP Failure after %d rounds, last EAP-5G request %d: %s",
+		ikeSecurityAssociation.EAP.Rounds, ikeSecurityAssociation.EAP.MessageID, errMsg.Error())
 
 	var responseIKEPayload message.IKEPayloadContainer
 	// Send EAP failure
 
 	// EAP
-	identifier, err := security.GenerateRandomUint8()
-	if err != nil {
-		logger.IKELog.Errorf("generate random uint8 failed: %+v", err)
-		return
-	}
-	responseIKEPayload.BuildEAPFailure(identifier)
+	responseIKEPayload.BuildEAPFailure(ikeSecurityAssociation.EAP.Identifier)
 
 	// Build IKE ikeMsg
 	responseIKEMessage := message.NewMessage(ikeSecurityAssociation.RemoteSPI, ikeSecurityAssociation.LocalSPI,
 		message.IKE_AUTH, true, false, ikeSecurityAssociation.InitiatorMessageID, responseIKEPayload)
 
 	// Send IKE ikeMsg to UE
-	err = SendIKEMessageToUE(ikeSecurityAssociation.IKEConnection.Conn,
+	err := SendIKEMessageToUE(ikeSecurityAssociation.IKEConnection.Conn,
 		ikeSecurityAssociation.IKEConnection.N3IWFAddr, ikeSecurityAssociation.IKEConnection.UEAddr,
 		responseIKEMessage, ikeSecurityAssociation.IKESAKey)
 	if err != nil {
-		logger.IKELog.Errorf("HandleSendEAP5GFailureMsg(): %v", err)
+		ikeSecurityAssociation.Log().Errorf("HandleSendEAP5GFailureMsg(): %v", err)
 	}
+	ikeSecurityAssociation.LogTranscript(errMsg)
+	observeEstablishment(ikeSecurityAssociation, EstablishmentEAPFailure)
+	reapFailedIKESA(ikeSecurityAssociation)
 }
 
 func HandleSendEAPSuccessMsg(ikeEvt context.IkeEvt) {
@@ -1160,21 +1941,9 @@ func HandleSendEAPSuccessMsg(ikeEvt context.IkeEvt) {
 
 	responseIKEPayload.Reset()
 
-	var identifier uint8
-	var err error
-	for {
-		identifier, err = security.GenerateRandomUint8()
-		if err != nil {
-			logger.IKELog.Errorf("HandleSendEAPSuccessMsg() rand: %v", err)
-			return
-		}
-		if identifier != ikeSecurityAssociation.LastEAPIdentifier {
-			ikeSecurityAssociation.LastEAPIdentifier = identifier
-			break
-		}
-	}
-
-	responseIKEPayload.BuildEAPSuccess(identifier)
+	// RFC 3748 section 4.2: Success carries the identifier of the last response
+	ikeSecurityAssociation.Log().Infof("EAP Success after %d rounds", ikeSecurityAssociation.EAP.Rounds)
+	responseIKEPayload.BuildEAPSuccess(ikeSecurityAssociation.EAP.Identifier)
 
 	// Build IKE ikeMsg
 	responseIKEMessage := message.NewMessage(ikeSecurityAssociation.RemoteSPI,
@@ -1182,16 +1951,18 @@ func HandleSendEAPSuccessMsg(ikeEvt context.IkeEvt) {
 		ikeSecurityAssociation.InitiatorMessageID, responseIKEPayload)
 
 	// Send IKE ikeMsg to UE
-	err = SendIKEMessageToUE(ikeSecurityAssociation.IKEConnection.Conn,
+	err := SendIKEMessageToUE(ikeSecurityAssociation.IKEConnection.Conn,
 		ikeSecurityAssociation.IKEConnection.N3IWFAddr,
 		ikeSecurityAssociation.IKEConnection.UEAddr, responseIKEMessage,
 		ikeSecurityAssociation.IKESAKey)
 	if err != nil {
-		logger.IKELog.Errorf("HandleSendEAPSuccessMsg(): %v", err)
+		ikeSecurityAssociation.Log().Errorf("HandleSendEAPSuccessMsg(): %v", err)
 		return
 	}
 
 	ikeSecurityAssociation.State++
+	ikeSecurityAssociation.StopHalfOpenTimer()
+	ikeSecurityAssociation.StopEAPRoundTimer()
 }
 
 func HandleSendEAPNASMsg(ikeEvt context.IkeEvt) {
@@ -1204,41 +1975,122 @@ func HandleSendEAPNASMsg(ikeEvt context.IkeEvt) {
 	n3iwfCtx := context.N3IWFSelf()
 	ikeSecurityAssociation, _ := n3iwfCtx.IKESALoad(localSPI)
 
-	var responseIKEPayload message.IKEPayloadContainer
-	responseIKEPayload.Reset()
+	vendorData, err := message.EAP5GNASVendorData(nasPDU)
+	if err != nil {
+		ikeSecurityAssociation.Log().Errorf("HandleSendEAPNASMsg() EAP5GNASVendorData: %v", err)
+		return
+	}
+	// The next fragments are sent as the UE acknowledges each of them
+	fragments, err := message.FragmentEAP5GNAS(vendorData, n3iwfCtx.EAP5GFragmentSize)
+	if err != nil {
+		ikeSecurityAssociation.Log().Errorf("HandleSendEAPNASMsg() FragmentEAP5GNAS: %v", err)
+		return
+	}
+	if len(fragments) > 1 {
+		ikeSecurityAssociation.Log().Debugf("NAS PDU of %d bytes sent in %d fragments", len(nasPDU), len(fragments))
+	}
+	ikeSecurityAssociation.EAP5GFragments.Outbound = fragments[1:]
 
-	var identifier uint8
-	var err error
-	for {
-		identifier, err = security.GenerateRandomUint8()
-		if err != nil {
-			logger.IKELog.Errorf("HandleSendEAPNASMsg() rand: %v", err)
-			return
-		}
-		if identifier != ikeSecurityAssociation.LastEAPIdentifier {
-			ikeSecurityAssociation.LastEAPIdentifier = identifier
-			break
-		}
+	ikeConnection := ikeSecurityAssociation.IKEConnection
+	if err = sendEAP5GRequest(ikeConnection.Conn, ikeConnection.N3IWFAddr, ikeConnection.UEAddr,
+		ikeSecurityAssociation.InitiatorMessageID, ikeSecurityAssociation, fragments[0]); err != nil {
+		ikeSecurityAssociation.Log().Errorf("HandleSendEAPNASMsg(): %v", err)
+	}
+}
+
+// HandleHalfOpenIKESATimeout removes an IKE SA whose UE did not get through
+// EAP-5G in time. SAs already bound to a UE context are released through NGAP
+func HandleHalfOpenIKESATimeout(ikeEvt context.IkeEvt) {
+	logger.IKELog.Debugln("handle HalfOpenIKESATimeout event")
+
+	localSPI := ikeEvt.(*context.HalfOpenIKESATimeoutEvt).LocalSPI
+
+	n3iwfCtx := context.N3IWFSelf()
+	ikeSecurityAssociation, ok := n3iwfCtx.IKESALoad(localSPI)
+	if !ok {
+		return
+	}
+	if ikeSecurityAssociation.IkeUE != nil || ikeSecurityAssociation.State >= PostSignalling {
+		return
+	}
+
+	ikeSecurityAssociation.Log().Infof("reap half-open IKE SA: SPI %016x, state %d", localSPI, ikeSecurityAssociation.State)
+	observeEstablishment(ikeSecurityAssociation, EstablishmentTimeout)
+	n3iwfCtx.AuditIKESA(ikeSecurityAssociation, context.AuditTeardown, context.AuditAuthFailure)
+	n3iwfCtx.DeleteIKESecurityAssociation(localSPI)
+}
+
+// HandleEAPRoundTimeout tears down an IKE SA whose EAP-5G exchange stalled,
+// the UE or the AMF leaving a round unanswered, or whose UE never asked for
+// its CP child SA after a childless IKE_AUTH. The AMF is asked to release the
+// UE context, if any
+func HandleEAPRoundTimeout(ikeEvt context.IkeEvt) {
+	logger.IKELog.Debugln("handle EAPRoundTimeout event")
+
+	evt := ikeEvt.(*context.EAPRoundTimeoutEvt)
+	localSPI := evt.LocalSPI
+
+	n3iwfCtx := context.N3IWFSelf()
+	ikeSecurityAssociation, ok := n3iwfCtx.IKESALoad(localSPI)
+	if !ok {
+		return
 	}
-
-	err = responseIKEPayload.BuildEAP5GNAS(identifier, nasPDU)
-	if err != nil {
-		logger.IKELog.Errorf("HandleSendEAPNASMsg() BuildEAP5GNAS: %v", err)
+	// The round was answered in the meantime
+	if ikeSecurityAssociation.EAPRound() != evt.Round {
+		return
+	}
+	switch {
+	case ikeSecurityAssociation.CPChildSAPending:
+		ikeSecurityAssociation.Log().Warnf("no CP child SA requested within %v of the childless IKE_AUTH",
+			n3iwfCtx.EAPRoundTimeout)
+		releaseFailedIKESA(n3iwfCtx, ikeSecurityAssociation)
+		return
+	case ikeSecurityAssociation.State != EAPSignalling:
 		return
 	}
 
-	// Build IKE ikeMsg
-	responseIKEMessage := message.NewMessage(ikeSecurityAssociation.RemoteSPI,
-		ikeSecurityAssociation.LocalSPI, message.IKE_AUTH, true, false,
-		ikeSecurityAssociation.InitiatorMessageID, responseIKEPayload)
+	ikeSecurityAssociation.Log().Warnf("EAP-5G round timed out after %v: %d EAP requests, last EAP-5G request %d",
+		n3iwfCtx.EAPRoundTimeout, ikeSecurityAssociation.EAP.Rounds, ikeSecurityAssociation.EAP.MessageID)
+	observeEstablishment(ikeSecurityAssociation, EstablishmentTimeout)
+	releaseFailedIKESA(n3iwfCtx, ikeSecurityAssociation)
+}
 
-	// Send IKE ikeMsg to UE
-	err = SendIKEMessageToUE(ikeSecurityAssociation.IKEConnection.Conn,
-		ikeSecurityAssociation.IKEConnection.N3IWFAddr,
-		ikeSecurityAssociation.IKEConnection.UEAddr, responseIKEMessage,
-		ikeSecurityAssociation.IKESAKey)
-	if err != nil {
-		logger.IKELog.Errorf("HandleSendEAPNASMsg(): %v", err)
+// HandleShutdown sends an IKE Delete to every UE, without waiting for the
+// answers, and removes the XFRM states, policies and interfaces of their child
+// SAs so no kernel state outlives the process
+func HandleShutdown(ikeEvt context.IkeEvt) {
+	logger.IKELog.Debugln("handle Shutdown event")
+
+	shutdownEvt := ikeEvt.(*context.ShutdownEvt)
+	defer close(shutdownEvt.Done)
+
+	n3iwfCtx := context.N3IWFSelf()
+	var ikeUes []*context.N3IWFIkeUe
+	n3iwfCtx.IkeUePool.Range(func(key, value any) bool {
+		ikeUes = append(ikeUes, value.(*context.N3IWFIkeUe))
+		return true
+	})
+	logger.IKELog.Infof("shutdown: delete %d IKE SAs", len(ikeUes))
+
+	for _, ikeUe := range ikeUes {
+		ikeSecurityAssociation := ikeUe.N3IWFIKESecurityAssociation
+		if ikeSecurityAssociation == nil {
+			continue
+		}
+		ikeSecurityAssociation.Lock()
+		if ikeUe.IKEConnection != nil {
+			SendIKEDeleteRequest(n3iwfCtx, ikeSecurityAssociation.LocalSPI)
+		}
+		n3iwfCtx.AuditIKESATeardown(ikeSecurityAssociation, context.AuditDelete)
+		// Best effort: a failure must not keep the other SAs in the kernel
+		for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+			if err := ikeUe.DeleteChildSA(childSA); err != nil {
+				ikeSecurityAssociation.Log().Warnf("shutdown: child SA 0x%08x: %v", childSA.InboundSPI, err)
+			}
+		}
+		n3iwfCtx.DeleteIKESecurityAssociation(ikeSecurityAssociation.LocalSPI)
+		n3iwfCtx.DeleteIKEUe(ikeSecurityAssociation.LocalSPI)
+		ikeSecurityAssociation.Unlock()
 	}
 }
 
@@ -1263,14 +2115,18 @@ func HandleIKEDeleteEvt(ikeEvt context.IkeEvt) {
 	ikeDeleteRequest := ikeEvt.(*context.IKEDeleteRequestEvt)
 	localSPI := ikeDeleteRequest.LocalSPI
 
-	SendIKEDeleteRequest(context.N3IWFSelf(), localSPI)
-
-	// In normal case, should wait response and then remove ikeUe.
-	// Remove ikeUe here to prevent no response received.
-	// Even response replied, it will be discarded.
-	err := removeIkeUe(localSPI)
-	if err != nil {
-		logger.IKELog.Errorf("HandleIKEDeleteEvt(): %v", err)
+	ikeUe, ok := context.N3IWFSelf().IkeUePoolLoad(localSPI)
+	if !ok {
+		logger.IKELog.Errorf("cannot get IkeUE from SPI: %016x", localSPI)
+		return
+	}
+	// The IKE UE context is removed with the answer of the UE, or right away
+	// when no Delete can be sent
+	if err := startIKESADelete(ikeUe); err != nil {
+		ikeUe.N3IWFIKESecurityAssociation.Log().Warnf("HandleIKEDeleteEvt(): %v", err)
+		if err = removeIkeUe(localSPI); err != nil {
+			ikeUe.N3IWFIKESecurityAssociation.Log().Errorf("HandleIKEDeleteEvt(): %v", err)
+		}
 	}
 }
 
@@ -1280,6 +2136,7 @@ func removeIkeUe(localSPI uint64) error {
 	if !ok {
 		return fmt.Errorf("cannot get IkeUE from SPI: %016x", localSPI)
 	}
+	n3iwfCtx.AuditIKESATeardown(ikeUe.N3IWFIKESecurityAssociation, context.AuditDelete)
 	err := ikeUe.Remove()
 	if err != nil {
 		return fmt.Errorf("delete IkeUe error: %w", err)
@@ -1302,6 +2159,63 @@ func HandleSendChildSADeleteRequest(ikeEvt context.IkeEvt) {
 	SendChildSADeleteRequest(ikeUe, releaseIdList)
 }
 
+func HandleDeleteChildSABySPI(ikeEvt context.IkeEvt) {
+	logger.IKELog.Debugln("handle DeleteChildSABySPI event")
+
+	deleteChildSABySPIEvt := ikeEvt.(*context.DeleteChildSABySPIEvt)
+	localSPI := deleteChildSABySPIEvt.LocalSPI
+
+	ikeUe, ok := context.N3IWFSelf().IkeUePoolLoad(localSPI)
+	if !ok {
+		logger.IKELog.Errorf("cannot get IkeUE from SPI: %+v", localSPI)
+		return
+	}
+	if err := SendChildSADeleteRequestBySPI(ikeUe, deleteChildSABySPIEvt.InboundSPIs); err != nil {
+		ikeUe.N3IWFIKESecurityAssociation.Log().Errorf("HandleDeleteChildSABySPI(): %v", err)
+	}
+}
+
+func HandleLivenessCheck(ikeEvt context.IkeEvt) {
+	logger.IKELog.Debugln("handle LivenessCheck event")
+
+	livenessCheckEvt := ikeEvt.(*context.LivenessCheckEvt)
+	localSPI := livenessCheckEvt.LocalSPI
+
+	ikeUe, ok := context.N3IWFSelf().IkeUePoolLoad(localSPI)
+	if !ok {
+		livenessCheckEvt.Result <- fmt.Errorf("cannot get IkeUE from SPI: %016x", localSPI)
+		return
+	}
+	sendLivenessCheck(ikeUe, livenessCheckEvt.Result)
+}
+
+// sendLivenessCheck sends a DPD request to the UE and reports to result
+// whether it is answered, see sendDPDRequest. A DPD request already
+// outstanding, such as one of the periodic liveness check, is not repeated:
+// its answer tells as much. While another request of the N3IWF is pending,
+// the DPD request waits for it
+func sendLivenessCheck(ikeUe *context.N3IWFIkeUe, result chan<- error) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.AddLivenessWaiter(result)
+	if ikeSA.DPDReqRetransTimer != nil {
+		return
+	}
+	switch {
+	case ikeUe.IKEConnection == nil:
+		ikeSA.NotifyLivenessWaiters(errors.New("UE is not connected"))
+	case ikeSA.Unresponsive:
+		ikeSA.NotifyLivenessWaiters(context.ErrDPDTimeout)
+	case n3iwfRequestPending(ikeSA):
+		queueN3IWFRequest(ikeSA, func() {
+			if ikeSA.DPDReqRetransTimer == nil {
+				sendDPDRequest(ikeUe)
+			}
+		})
+	default:
+		sendDPDRequest(ikeUe)
+	}
+}
+
 func HandleIKEContextUpdate(ikeEvt context.IkeEvt) {
 	logger.IKELog.Debugln("handle IKEContextUpdate event")
 
@@ -1329,7 +2243,19 @@ func HandleGetNGAPContextResponse(ikeEvt context.IkeEvt) {
 	ngapCxt := getNGAPContextRepEvt.NgapCxt
 
 	n3iwfCtx := context.N3IWFSelf()
-	ikeSecurityAssociation, _ := n3iwfCtx.IKESALoad(localSPI)
+	ikeSecurityAssociation, ok := n3iwfCtx.IKESALoad(localSPI)
+	if !ok {
+		logger.IKELog.Warnf("NGAP context received for unknown IKE SA %016x, ignored", localSPI)
+		return
+	}
+	// Routed by the request it answers, the SA state may have moved on if
+	// several requests are outstanding
+	request, ok := ikeSecurityAssociation.TakeNGAPContextRequest(getNGAPContextRepEvt.Token)
+	if !ok {
+		ikeSecurityAssociation.Log().Warnf("NGAP context received for unknown request %d, ignored",
+			getNGAPContextRepEvt.Token)
+		return
+	}
 
 	var tempPDUSessionSetupData *context.PDUSessionSetupTemporaryData
 
@@ -1338,20 +2264,26 @@ func HandleGetNGAPContextResponse(ikeEvt context.IkeEvt) {
 		case context.CxtTempPDUSessionSetupData:
 			tempPDUSessionSetupData = ngapCxt[i].(*context.PDUSessionSetupTemporaryData)
 		default:
-			logger.IKELog.Errorf("receive undefined NGAP context request number: %d", num)
+			ikeSecurityAssociation.Log().Errorf("receive undefined NGAP context request number: %d", num)
 		}
 	}
 
-	switch ikeSecurityAssociation.State {
-	case EndSignalling:
+	switch request {
+	case context.NGAPContextPDUSessionSetup:
 		CreatePDUSessionChildSA(ikeSecurityAssociation.IkeUE, tempPDUSessionSetupData)
-		ikeSecurityAssociation.State++
-		go StartDPD(ikeSecurityAssociation.IkeUE)
-	case HandleCreateChildSA:
+		if ikeSecurityAssociation.State == EndSignalling {
+			ikeSecurityAssociation.State++
+			go StartDPD(ikeSecurityAssociation.IkeUE)
+		}
+	case context.NGAPContextCreateChildSA:
 		continueCreateChildSA(ikeSecurityAssociation, tempPDUSessionSetupData)
 	}
 }
 
+// CreatePDUSessionChildSA sends the CREATE_CHILD_SA request of the next PDU
+// session to set up, continued by continueCreateChildSA once the UE answers,
+// and answers the AMF once every PDU session was tried. The request waits for
+// the pending request of the N3IWF, if any
 func CreatePDUSessionChildSA(ikeUe *context.N3IWFIkeUe,
 	temporaryPDUSessionSetupData *context.PDUSessionSetupTemporaryData,
 ) {
@@ -1359,10 +2291,18 @@ func CreatePDUSessionChildSA(ikeUe *context.N3IWFIkeUe,
 	ipsecGwAddr := n3iwfCtx.IpSecGatewayAddress
 
 	ikeSecurityAssociation := ikeUe.N3IWFIKESecurityAssociation
+	if temporaryPDUSessionSetupData.Index < len(temporaryPDUSessionSetupData.UnactivatedPDUSession) &&
+		n3iwfRequestPending(ikeSecurityAssociation) {
+		ikeSecurityAssociation.Log().Debugln("CREATE_CHILD_SA of the PDU session waits for the pending request")
+		queueN3IWFRequest(ikeSecurityAssociation, func() {
+			CreatePDUSessionChildSA(ikeUe, temporaryPDUSessionSetupData)
+		})
+		return
+	}
 
 	ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeUe.N3IWFIKESecurityAssociation.LocalSPI)
 	if !ok {
-		logger.IKELog.Errorf("cannot get RanNgapId from SPI: %+v", ikeUe.N3IWFIKESecurityAssociation.LocalSPI)
+		ikeSecurityAssociation.Log().Errorf("cannot get RanNgapId from SPI: %+v", ikeUe.N3IWFIKESecurityAssociation.LocalSPI)
 		return
 	}
 
@@ -1373,7 +2313,6 @@ func CreatePDUSessionChildSA(ikeUe *context.N3IWFIkeUe,
 
 			// Send CREATE_CHILD_SA to UE
 			var responseIKEPayload message.IKEPayloadContainer
-			errStr := context.ErrNil
 
 			responseIKEPayload.Reset()
 
@@ -1381,59 +2320,37 @@ func CreatePDUSessionChildSA(ikeUe *context.N3IWFIkeUe,
 			requestSA := responseIKEPayload.BuildSecurityAssociation()
 
 			// Allocate SPI
-			var spi uint32
-			spiByte := make([]byte, 4)
-			for {
-				var err error
-				buf := make([]byte, 4)
-				_, err = rand.Read(buf)
-				if err != nil {
-					logger.IKELog.Errorf("createPDUSessionChildSA Generate SPI: %v", err)
-					return
-				}
-				randomUint32 := binary.BigEndian.Uint32(buf)
-				if _, ok := n3iwfCtx.ChildSA.Load(randomUint32); !ok {
-					spi = randomUint32
-					break
-				}
+			spi, err := allocateChildSAInboundSPI(n3iwfCtx)
+			if err != nil {
+				ikeSecurityAssociation.Log().Errorf("createPDUSessionChildSA Generate SPI: %v", err)
+				skipPDUSessionChildSA(temporaryPDUSessionSetupData, context.ErrTransportResourceUnavailable)
+				continue
 			}
+			spiByte := make([]byte, 4)
 			binary.BigEndian.PutUint32(spiByte, spi)
 
-			// First Proposal - Proposal No.1
-			proposal := requestSA.Proposals.BuildProposal(1, message.TypeESP, spiByte)
-
 			// Encryption transform
-			encrTranform, err := encr.ToTransform(ikeSecurityAssociation.EncrInfo)
+			encrTranform, err := childSAEncryptionTransform(n3iwfCtx.ChildSAEncryption, ikeSecurityAssociation.EncrInfo)
 			if err != nil {
-				logger.IKELog.Errorf("encr ToTransform error: %v", err)
-				break
-			}
-
-			proposal.EncryptionAlgorithm = append(proposal.EncryptionAlgorithm,
-				encrTranform)
-			// Integrity transform
-			if pduSession.SecurityIntegrity {
-				proposal.IntegrityAlgorithm = append(proposal.IntegrityAlgorithm,
-					integ.ToTransform(ikeSecurityAssociation.IntegInfo))
+				ikeSecurityAssociation.Log().Errorf("encr ToTransform error: %v", err)
+				skipPDUSessionChildSA(temporaryPDUSessionSetupData, context.ErrTransportResourceUnavailable)
+				continue
 			}
 
-			// ESN transform
-			proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
-
-			ikeUe.CreateHalfChildSA(ikeSecurityAssociation.ResponderMessageID, spi, pduSessionID)
+			// Proposals, the preferred cipher first then the fallbacks
+			buildChildSAProposals(requestSA, spiByte, encrTranform, ikeSecurityAssociation.IntegInfo,
+				pduSession.SecurityIntegrity)
 
 			// Build Nonce
 			nonceDataBigInt, errGen := security.GenerateRandomNumber()
 			if errGen != nil {
-				logger.IKELog.Errorf("createPDUSessionChildSA Build Nonce: %v", errGen)
-				return
+				ikeSecurityAssociation.Log().Errorf("createPDUSessionChildSA Build Nonce: %v", errGen)
+				skipPDUSessionChildSA(temporaryPDUSessionSetupData, context.ErrTransportResourceUnavailable)
+				continue
 			}
 			nonceData := nonceDataBigInt.Bytes()
 			responseIKEPayload.BuildNonce(nonceData)
 
-			// Store nonce into context
-			ikeSecurityAssociation.ConcatenatedNonce = nonceData
-
 			// TSi
 			n3iwfIPAddr := net.ParseIP(ipsecGwAddr)
 			tsi := responseIKEPayload.BuildTrafficSelectorInitiator()
@@ -1448,58 +2365,164 @@ func CreatePDUSessionChildSA(ikeUe *context.N3IWFIkeUe,
 				0, 65535, ueIPAddr.To4(), ueIPAddr.To4())
 
 			if pduSessionID < 0 || pduSessionID > math.MaxUint8 {
-				logger.IKELog.Errorf("createPDUSessionChildSA pduSessionID exceeds uint8 range: %d", pduSessionID)
-				break
+				ikeSecurityAssociation.Log().Errorf("createPDUSessionChildSA pduSessionID exceeds uint8 range: %d", pduSessionID)
+				skipPDUSessionChildSA(temporaryPDUSessionSetupData, context.ErrTransportResourceUnavailable)
+				continue
 			}
 			// Notify-Qos
 			err = responseIKEPayload.BuildNotify5G_QOS_INFO(uint8(pduSessionID), pduSession.QFIList, true, false, 0)
 			if err != nil {
-				logger.IKELog.Errorf("createPDUSessionChildSA error: %v", err)
-				break
+				ikeSecurityAssociation.Log().Errorf("createPDUSessionChildSA error: %v", err)
+				skipPDUSessionChildSA(temporaryPDUSessionSetupData, context.ErrTransportResourceUnavailable)
+				continue
 			}
 
 			// Notify-UP_IP_ADDRESS
 			responseIKEPayload.BuildNotifyUP_IP4_ADDRESS(ipsecGwAddr)
 
-			temporaryPDUSessionSetupData.Index++
+			childSA := ikeUe.CreateHalfChildSA(ikeSecurityAssociation.ResponderMessageID, spi, pduSessionID)
+			childSA.AssignGREKeys(pduSession.QFIList)
+			childSA.OfferedProposals = requestSA.Proposals
+			// Store nonce into context
+			ikeSecurityAssociation.ConcatenatedNonce = nonceData
 
 			// Build IKE ikeMsg
 			ikeMessage := message.NewMessage(ikeSecurityAssociation.RemoteSPI, ikeSecurityAssociation.LocalSPI,
 				message.CREATE_CHILD_SA, false, false, ikeSecurityAssociation.ResponderMessageID,
 				responseIKEPayload)
 
-			err = SendIKEMessageToUE(ikeSecurityAssociation.IKEConnection.Conn,
-				ikeSecurityAssociation.IKEConnection.N3IWFAddr,
-				ikeSecurityAssociation.IKEConnection.UEAddr, ikeMessage,
-				ikeSecurityAssociation.IKESAKey)
-			if err != nil {
-				logger.IKELog.Errorf("createPDUSessionChildSA error: %v", err)
-				errStr = context.ErrTransportResourceUnavailable
-				temporaryPDUSessionSetupData.FailedErrStr = append(temporaryPDUSessionSetupData.FailedErrStr,
-					errStr)
-			} else {
-				temporaryPDUSessionSetupData.FailedErrStr = append(temporaryPDUSessionSetupData.FailedErrStr,
-					errStr)
-				break
+			if err = sendChildSACreateRequest(ikeUe, ikeMessage); err != nil {
+				ikeSecurityAssociation.Log().Errorf("createPDUSessionChildSA error: %v", err)
+				delete(ikeUe.TemporaryExchangeMsgIDChildSAMapping, ikeSecurityAssociation.ResponderMessageID)
+				skipPDUSessionChildSA(temporaryPDUSessionSetupData, context.ErrTransportResourceUnavailable)
+				continue
 			}
+			// The outcome is recorded once the UE answers, in continueCreateChildSA
+			temporaryPDUSessionSetupData.Index++
+			break
 		} else {
-			n3iwfCtx.NgapServer.RcvEventCh <- context.NewSendPDUSessionResourceSetupResEvt(ranNgapId)
+			if err := n3iwfCtx.SendNgapEvent(context.NewSendPDUSessionResourceSetupResEvt(ranNgapId,
+				pduSessionChildSAs(ikeUe, temporaryPDUSessionSetupData))); err != nil {
+				ikeSecurityAssociation.Log().Errorf("CreatePDUSessionChildSA(): %v", err)
+			}
+			sendQueuedRequests(ikeUe)
 			break
 		}
 	}
 }
 
+// pduSessionChildSAs describes the child SAs of the PDU sessions set up
+// successfully, in the order of the setup
+func pduSessionChildSAs(ikeUe *context.N3IWFIkeUe,
+	temporaryPDUSessionSetupData *context.PDUSessionSetupTemporaryData,
+) []context.ChildSAInfo {
+	var childSAs []context.ChildSAInfo
+	for index, pduSession := range temporaryPDUSessionSetupData.UnactivatedPDUSession {
+		if index >= len(temporaryPDUSessionSetupData.FailedErrStr) ||
+			temporaryPDUSessionSetupData.FailedErrStr[index] != context.ErrNil {
+			continue
+		}
+		for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+			if slices.Contains(childSA.PDUSessionIds, pduSession.Id) {
+				childSAs = append(childSAs, childSA.Info(pduSession.Id))
+				break
+			}
+		}
+	}
+	return childSAs
+}
+
+// maxXfrmiCollisions bounds the XFRM interface IDs tried by setupDedicatedXfrmi
+const maxXfrmiCollisions = 8
+
+var setupIPsecXfrmi = xfrm.SetupIPsecXfrmi
+
+// setupDedicatedXfrmi creates the XFRM interface of an additional PDU session
+// and returns its if_id. An ID or name already taken in the network namespace,
+// e.g. by another N3IWF sharing the host, stays reserved and the next free ID
+// of the range is tried
+func setupDedicatedXfrmi(n3iwfCtx *context.N3IWFContext, ipsecGwAddr string,
+	ikeSecurityAssociation *context.IKESecurityAssociation,
+) (uint32, netlink.Link, error) {
+	ikeLog := ikeSecurityAssociation.Log()
+	n3iwfIPAddrAndSubnet := net.IPNet{IP: net.ParseIP(ipsecGwAddr).To4(), Mask: n3iwfCtx.Subnet.Mask}
+	for range maxXfrmiCollisions {
+		xfrmiId, err := n3iwfCtx.AllocateXfrmIfaceId()
+		if err != nil {
+			return 0, nil, err
+		}
+		xfrmiName := fmt.Sprintf("%s-%d", n3iwfCtx.XfrmInterfaceName, xfrmiId)
+		link, err := setupIPsecXfrmi(xfrmiName, n3iwfCtx.XfrmParentIfaceName, xfrmiId,
+			n3iwfIPAddrAndSubnet, n3iwfCtx.XfrmIfaceMTU)
+		if err == nil {
+			ikeLog.Infof("setup XFRM interface: %s", xfrmiName)
+			n3iwfCtx.XfrmIfaces.Store(xfrmiId, link)
+			return xfrmiId, link, nil
+		}
+		if !errors.Is(err, unix.EEXIST) {
+			n3iwfCtx.XfrmIfaceIds.Release(xfrmiId)
+			return 0, nil, fmt.Errorf("setup XFRM interface %s: %w", xfrmiName, err)
+		}
+		ikeLog.Warnf("XFRM interface %s or its if_id is already taken, try another ID", xfrmiName)
+	}
+	return 0, nil, fmt.Errorf("no free XFRM interface ID after %d collisions", maxXfrmiCollisions)
+}
+
+// skipPDUSessionChildSA records why the child SA of the current PDU session
+// could not be set up, so it is reported to the AMF as a failed item, and
+// moves on to the next PDU session
+func skipPDUSessionChildSA(temporaryPDUSessionSetupData *context.PDUSessionSetupTemporaryData,
+	errStr context.EvtError,
+) {
+	temporaryPDUSessionSetupData.FailedErrStr = append(temporaryPDUSessionSetupData.FailedErrStr, errStr)
+	temporaryPDUSessionSetupData.Index++
+}
+
+// Wait for the answer to a DPD request, DPDMaxRetryTimes times more before
+// the UE is deemed down, replaced in tests
+var dpdRetransmitInterval = 2 * time.Second
+
+// sendDPDRequest sends an empty INFORMATIONAL request to the UE. Left
+// unanswered, the waiters of the request are told and the UE is released, see
+// releaseUnresponsiveUe
+func sendDPDRequest(ikeUe *context.N3IWFIkeUe) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	SendUEInformationExchange(ikeSA, ikeSA.IKESAKey, nil, false, false,
+		ikeSA.ResponderMessageID, ikeUe.IKEConnection.Conn, ikeUe.IKEConnection.UEAddr,
+		ikeUe.IKEConnection.N3IWFAddr)
+
+	atomic.StoreInt32(&ikeSA.CurrentRetryTimes, 0)
+	var timer *context.Timer
+	timer = context.NewDPDPeriodicTimer(dpdRetransmitInterval, context.N3IWFSelf().DPDMaxRetryTimes, ikeSA,
+		func() {
+			ikeSA.Lock()
+			defer ikeSA.Unlock()
+			// Answered, or abandoned with the IKE SA
+			if ikeSA.DPDReqRetransTimer != timer {
+				return
+			}
+			ikeSA.Log().Errorf("UE is down")
+			ikeSA.DPDReqRetransTimer = nil
+			ikeSA.ResponderMessageID++
+			ikeSA.NotifyLivenessWaiters(context.ErrDPDTimeout)
+			releaseUnresponsiveUe(ikeUe)
+		})
+	ikeSA.DPDReqRetransTimer = timer
+}
+
 func StartDPD(ikeUe *context.N3IWFIkeUe) {
 	defer util.RecoverWithLog(logger.IKELog)
 
 	ikeUe.N3IWFIKESecurityAssociation.IKESAClosedCh = make(chan struct{})
 
-	n3iwfCtx := context.N3IWFSelf()
 	ikeSA := ikeUe.N3IWFIKESecurityAssociation
 
 	liveness := factory.N3iwfConfig.Configuration.LivenessCheck
 	if liveness.Enable {
+		// Started by a handler still holding the SA
+		ikeSA.Lock()
 		ikeSA.IsUseDPD = true
+		ikeSA.Unlock()
 		timer := time.NewTicker(liveness.TransFreq)
 		for {
 			select {
@@ -1508,30 +2531,15 @@ func StartDPD(ikeUe *context.N3IWFIkeUe) {
 				timer.Stop()
 				return
 			case <-timer.C:
-				var payload *message.IKEPayloadContainer
-				SendUEInformationExchange(ikeSA, ikeSA.IKESAKey, payload, false, false,
-					ikeSA.ResponderMessageID, ikeUe.IKEConnection.Conn, ikeUe.IKEConnection.UEAddr,
-					ikeUe.IKEConnection.N3IWFAddr)
-
-				var DPDReqRetransTime time.Duration = 2 * time.Second // TODO: make it configurable
-				ikeSA.DPDReqRetransTimer = context.NewDPDPeriodicTimer(
-					DPDReqRetransTime, liveness.MaxRetryTimes, ikeSA,
-					func() {
-						logger.IKELog.Errorf("UE is down")
-						ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeSA.LocalSPI)
-						if !ok {
-							logger.IKELog.Infof("cannot find ranNgapId form SPI: %+v",
-								ikeSA.LocalSPI)
-							return
-						}
-
-						n3iwfCtx.NgapServer.RcvEventCh <- context.NewSendUEContextReleaseRequestEvt(
-							ranNgapId, context.ErrRadioConnWithUeLost,
-						)
-
-						ikeSA.DPDReqRetransTimer = nil
-						timer.Stop()
-					})
+				ikeSA.Lock()
+				// The UE answering the pending request of the N3IWF, or its
+				// retransmissions going unanswered, tells as much
+				if n3iwfRequestPending(ikeSA) {
+					ikeSA.Unlock()
+					continue
+				}
+				sendDPDRequest(ikeUe)
+				ikeSA.Unlock()
 			}
 		}
 	}
@@ -1576,12 +2584,16 @@ func generateNATDetectHash(
 	addr *net.UDPAddr,
 ) ([]byte, error) {
 	// Calculate NAT_DETECTION hash for NAT-T
-	// : sha1(ispi | rspi | ip | port)
-	natdData := make([]byte, 22)
+	// : sha1(ispi | rspi | ip | port), ip being 4 or 16 octets (RFC 7296 section 2.23)
+	ip := outerIP(addr.IP)
+	if ip == nil {
+		return nil, fmt.Errorf("generate NATD Hash: invalid address %s", addr.IP)
+	}
+	natdData := make([]byte, 16, 16+len(ip)+2)
 	binary.BigEndian.PutUint64(natdData[0:8], initiatorSPI)
 	binary.BigEndian.PutUint64(natdData[8:16], responderSPI)
-	copy(natdData[16:20], addr.IP.To4())
-	binary.BigEndian.PutUint16(natdData[20:22], uint16(addr.Port)) // #nosec G115
+	natdData = append(natdData, ip...)
+	natdData = binary.BigEndian.AppendUint16(natdData, uint16(addr.Port)) // #nosec G115
 
 	sha1HashFunction := sha1.New() // #nosec G401
 	_, err := sha1HashFunction.Write(natdData)
@@ -1614,6 +2626,24 @@ func buildNATDetectNotifPayload(ikeSA *context.IKESecurityAssociation,
 	return nil
 }
 
+// validateDeletePayload checks the SPIs of a Delete payload requested by the
+// UE against its protocol (RFC 7296 section 3.11)
+func validateDeletePayload(payload *message.Delete) error {
+	switch payload.ProtocolID {
+	case message.TypeIKE:
+		if payload.SPISize != 0 || payload.NumberOfSPI != 0 {
+			return fmt.Errorf("IKE SA delete with %d SPIs of %d bytes", payload.NumberOfSPI, payload.SPISize)
+		}
+	case message.TypeAH, message.TypeESP:
+		if payload.SPISize != 4 {
+			return fmt.Errorf("child SA delete with SPIs of %d bytes", payload.SPISize)
+		}
+	default:
+		return fmt.Errorf("delete of unknown protocol ID %d", payload.ProtocolID)
+	}
+	return nil
+}
+
 func handleDeletePayload(payload *message.Delete, isResponse bool,
 	ikeSecurityAssociation *context.IKESecurityAssociation) (
 	*message.IKEPayloadContainer, error,
@@ -1633,6 +2663,7 @@ func handleDeletePayload(payload *message.Delete, isResponse bool,
 	switch payload.ProtocolID {
 	case message.TypeIKE:
 		if !isResponse {
+			n3iwfCtx.AuditIKESATeardown(ikeSecurityAssociation, context.AuditDelete)
 			err = n3iwfIke.Remove()
 			if err != nil {
 				return nil, fmt.Errorf("delete IkeUe Context error: %w", err)
@@ -1648,139 +2679,331 @@ func handleDeletePayload(payload *message.Delete, isResponse bool,
 			if err != nil {
 				return nil, fmt.Errorf("handleDeletePayload: %w", err)
 			}
-			responseIKEPayload.BuildDeletePayload(message.TypeESP, 4, uint16(len(deletSPIs)), deletSPIs)
+			buildChildSADeleteResponse(responseIKEPayload, deletSPIs, n3iwfCtx.EmptyChildSADeleteResponse)
+			if len(deletPduIds) == 0 {
+				return responseIKEPayload, nil
+			}
 		}
 
 		evt = context.NewSendPDUSessionResourceReleaseEvt(ranNgapId, deletPduIds)
+	case message.TypeAH:
+		// No AH SA is ever negotiated, the SPIs cannot belong to this UE
+		ikeSecurityAssociation.Log().Warnf("ignore delete of unknown AH SPIs: %08x", payload.SPIs)
+		return responseIKEPayload, nil
 	default:
 		return nil, fmt.Errorf("get Protocol ID %d in Informational delete payload, "+
 			"this payload will not be handled by IKE handler", payload.ProtocolID)
 	}
-	n3iwfCtx.NgapServer.RcvEventCh <- evt
+	if err := n3iwfCtx.SendNgapEvent(evt); err != nil {
+		return nil, fmt.Errorf("handleDeletePayload: %w", err)
+	}
 	return responseIKEPayload, nil
 }
 
-func isTransformKernelSupported(transformType uint8, transformID uint16, attributePresent bool, attributeValue uint16) bool {
-	switch transformType {
-	case message.TypeEncryptionAlgorithm:
-		switch transformID {
-		case message.ENCR_DES_IV64:
-			return false
-		case message.ENCR_DES:
-			return true
-		case message.ENCR_3DES:
-			return true
-		case message.ENCR_RC5:
-			return false
-		case message.ENCR_IDEA:
-			return false
-		case message.ENCR_CAST:
-			if !attributePresent {
-				return false
-			}
-			switch attributeValue {
-			case 128:
-				return true
-			case 256:
-				return false
-			default:
-				return false
+// completeChildSADelete removes the child SAs of the pending delete request
+// answered by ikeMsg, and reports whether ikeMsg was that answer
+func completeChildSADelete(ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation) bool {
+	pending := ikeSecurityAssociation.PendingChildSADelete
+	if pending == nil || ikeMsg.MessageID != pending.MessageID {
+		return false
+	}
+	pending.Retransmit.Stop()
+	// Before a queued delete request takes the next message ID
+	ikeSecurityAssociation.ResponderMessageID++
+	finishChildSADelete(ikeSecurityAssociation.IkeUE, pending)
+	return true
+}
+
+// finishChildSADelete removes the child SAs of request, answers the AMF for
+// released PDU sessions, and sends the next queued delete request
+func finishChildSADelete(ikeUe *context.N3IWFIkeUe, request *context.ChildSADeleteRequest) {
+	ikeSecurityAssociation := ikeUe.N3IWFIKESecurityAssociation
+	ikeSecurityAssociation.PendingChildSADelete = nil
+
+	for _, spi := range request.InboundSPIs {
+		childSA, ok := ikeUe.N3IWFChildSecurityAssociation[spi]
+		if !ok {
+			continue
+		}
+		if err := ikeUe.DeleteChildSA(childSA); err != nil {
+			ikeUe.N3IWFIKESecurityAssociation.Log().Warnf("delete child SA 0x%08x: %v", spi, err)
+			continue
+		}
+		context.N3IWFSelf().AuditChildSA(ikeSecurityAssociation, childSA, context.AuditTeardown, context.AuditDelete)
+		ikeUe.N3IWFIKESecurityAssociation.Log().Infof("child SA 0x%08x deleted", spi)
+	}
+
+	if len(request.ReleasedPDUSessions) > 0 {
+		ikeUe.ReleasePDUSessions(len(request.ReleasedPDUSessions))
+		n3iwfCtx := context.N3IWFSelf()
+		if ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeSecurityAssociation.LocalSPI); ok {
+			if err := n3iwfCtx.SendNgapEvent(context.NewSendPDUSessionResourceReleaseEvt(ranNgapId, nil)); err != nil {
+				ikeUe.N3IWFIKESecurityAssociation.Log().Errorf("finishChildSADelete(): %v", err)
 			}
-		case message.ENCR_BLOWFISH:
-			return true
-		case message.ENCR_3IDEA:
-			return false
-		case message.ENCR_DES_IV32:
-			return false
-		case message.ENCR_NULL:
-			return true
-		case message.ENCR_AES_CBC:
-			if !attributePresent {
-				return false
+		}
+	}
+
+	sendQueuedRequests(ikeUe)
+}
+
+// completeIKESADelete removes the IKE UE context whose pending IKE Delete is
+// answered by ikeMsg, and reports whether ikeMsg was that answer
+func completeIKESADelete(ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation) bool {
+	pending := ikeSecurityAssociation.PendingIKEDelete
+	if pending == nil || ikeMsg.MessageID != pending.MessageID {
+		return false
+	}
+	pending.Retransmit.Stop()
+	ikeSecurityAssociation.PendingIKEDelete = nil
+	context.N3IWFSelf().AuditIKESATeardown(ikeSecurityAssociation, context.AuditDelete)
+	if err := ikeSecurityAssociation.IkeUE.Remove(); err != nil {
+		ikeSecurityAssociation.Log().Errorf("completeIKESADelete(): %v", err)
+	}
+	ikeSecurityAssociation.Log().Infof("IKE SA %016x deleted", ikeSecurityAssociation.LocalSPI)
+	return true
+}
+
+// buildChildSADeleteResponse answers an ESP Delete with the inbound SPIs of the
+// child SAs actually deleted. When none of the requested SPIs was known, RFC 7296
+// section 1.4.1 allows an empty INFORMATIONAL response; emptyDelete instead
+// keeps an ESP Delete payload without SPIs for UEs expecting one
+func buildChildSADeleteResponse(responseIKEPayload *message.IKEPayloadContainer,
+	deleteSPIs []uint32, emptyDelete bool,
+) {
+	if len(deleteSPIs) == 0 && !emptyDelete {
+		return
+	}
+	responseIKEPayload.BuildDeletePayload(message.TypeESP, 4, uint16(len(deleteSPIs)), deleteSPIs)
+}
+
+// Random SPIs drawn before giving up on finding an unused one
+const maxSPIAllocationAttempts = 64
+
+// ErrSPIExhausted is returned when no unused inbound SPI was found for a new
+// child SA, because the SPI space is saturated or the random source degraded
+var ErrSPIExhausted = errors.New("no child SA SPI available")
+
+// allocateChildSAInboundSPI picks a random non-zero inbound SPI that is not
+// used by any child SA yet
+func allocateChildSAInboundSPI(n3iwfCtx *context.N3IWFContext) (uint32, error) {
+	buf := make([]byte, 4)
+	for range maxSPIAllocationAttempts {
+		if err := security.ReadRandom(buf); err != nil {
+			return 0, fmt.Errorf("allocateChildSAInboundSPI: %w", err)
+		}
+		spi := binary.BigEndian.Uint32(buf)
+		if spi == 0 {
+			continue
+		}
+		if _, ok := n3iwfCtx.ChildSA.Load(spi); !ok {
+			return spi, nil
+		}
+	}
+	return 0, fmt.Errorf("allocateChildSAInboundSPI: %d attempts: %w", maxSPIAllocationAttempts, ErrSPIExhausted)
+}
+
+// selectChildSAProposal picks the first ESP proposal whose transforms are all
+// supported by the kernel, its Diffie-Hellman groups by dhSupported, and
+// returns it as the response SA with the preferred transform of each type. The
+// first of dhGroups offered in a proposal is chosen over the preferred group
+func selectChildSAProposal(securityAssociation *message.SecurityAssociation,
+	dhSupported func(*message.Transform) bool, dhGroups ...uint16,
+) *message.SecurityAssociation {
+	responseSecurityAssociation := new(message.SecurityAssociation)
+	for _, proposal := range securityAssociation.Proposals {
+		var encryptionAlgorithmTransform *message.Transform = nil
+		var integrityAlgorithmTransform *message.Transform = nil
+		var diffieHellmanGroupTransform *message.Transform = nil
+		var extendedSequenceNumbersTransform *message.Transform = nil
+
+		if len(proposal.SPI) != 4 {
+			continue // The SPI of ESP must be 32-bit
+		}
+
+		if len(proposal.EncryptionAlgorithm) > 0 {
+			encryptionAlgorithmTransform = preferredTransform(proposal.EncryptionAlgorithm, kernelSupported)
+			if encryptionAlgorithmTransform == nil {
+				continue
 			}
-			switch attributeValue {
-			case 128:
-				return true
-			case 192:
-				return true
-			case 256:
-				return true
-			default:
-				return false
+		} else {
+			continue // mandatory
+		}
+		if len(proposal.PseudorandomFunction) > 0 {
+			continue // Pseudorandom function is not used by ESP
+		}
+		aead := isAEADEncryptionAlgorithm(encryptionAlgorithmTransform.TransformID)
+		if aead && !onlyNoneIntegrity(proposal.IntegrityAlgorithm) {
+			continue // RFC 5282: AEAD is offered with no integrity or only NONE
+		}
+		if len(proposal.IntegrityAlgorithm) > 0 && !aead {
+			integrityAlgorithmTransform = preferredTransform(proposal.IntegrityAlgorithm, kernelSupported)
+			if integrityAlgorithmTransform == nil {
+				continue
 			}
-		case message.ENCR_AES_CTR:
-			if !attributePresent {
-				return false
+		} // Optional
+		if len(proposal.DiffieHellmanGroup) > 0 {
+			diffieHellmanGroupTransform = preferredDHGroup(proposal.DiffieHellmanGroup, dhGroups, dhSupported)
+			if diffieHellmanGroupTransform == nil {
+				continue
 			}
-			switch attributeValue {
-			case 128:
-				return true
-			case 192:
-				return true
-			case 256:
-				return true
-			default:
-				return false
+		} // Optional
+		if len(proposal.ExtendedSequenceNumbers) > 0 {
+			extendedSequenceNumbersTransform = preferredTransform(proposal.ExtendedSequenceNumbers, kernelSupported)
+			if extendedSequenceNumbersTransform == nil {
+				continue
 			}
-		default:
-			return false
+		} else {
+			continue // Mandatory
 		}
-	case message.TypeIntegrityAlgorithm:
-		switch transformID {
-		case message.AUTH_NONE:
-			return false
-		case message.AUTH_HMAC_MD5_96:
-			return true
-		case message.AUTH_HMAC_SHA1_96:
-			return true
-		case message.AUTH_DES_MAC:
-			return false
-		case message.AUTH_KPDK_MD5:
-			return false
-		case message.AUTH_AES_XCBC_96:
-			return true
-		case message.AUTH_HMAC_SHA2_256_128:
-			return true
-		default:
-			return false
+
+		var chosenProposals message.ProposalContainer
+		chosenProposal := chosenProposals.BuildProposal(
+			proposal.ProposalNumber, proposal.ProtocolID, proposal.SPI)
+		chosenProposal.EncryptionAlgorithm = append(chosenProposal.EncryptionAlgorithm, encryptionAlgorithmTransform)
+		chosenProposal.ExtendedSequenceNumbers = append(
+			chosenProposal.ExtendedSequenceNumbers, extendedSequenceNumbersTransform)
+		if integrityAlgorithmTransform != nil {
+			chosenProposal.IntegrityAlgorithm = append(chosenProposal.IntegrityAlgorithm, integrityAlgorithmTransform)
 		}
-	case message.TypeDiffieHellmanGroup:
-		switch transformID {
-		// case message.DH_NONE:
-		// 	return false
-		// case message.DH_768_BIT_MODP:
-		// 	return false
-		// case message.DH_1024_BIT_MODP:
-		// 	return false
-		// case message.DH_1536_BIT_MODP:
-		// 	return false
-		// case message.DH_2048_BIT_MODP:
-		// 	return false
-		// case message.DH_3072_BIT_MODP:
-		// 	return false
-		// case message.DH_4096_BIT_MODP:
-		// 	return false
-		// case message.DH_6144_BIT_MODP:
-		// 	return false
-		// case message.DH_8192_BIT_MODP:
-		// 	return false
-		default:
-			return false
+		if diffieHellmanGroupTransform != nil {
+			chosenProposal.DiffieHellmanGroup = append(chosenProposal.DiffieHellmanGroup, diffieHellmanGroupTransform)
 		}
-	case message.TypeExtendedSequenceNumbers:
-		switch transformID {
-		case message.ESN_ENABLE:
-			return true
-		case message.ESN_DISABLE:
-			return true
-		default:
-			return false
+		if err := validateChildSAResponseProposal(chosenProposal); err != nil {
+			logger.IKELog.Warnf("selectChildSAProposal(): skip proposal %d: %v", proposal.ProposalNumber, err)
+			continue
 		}
+		responseSecurityAssociation.Proposals = append(responseSecurityAssociation.Proposals, chosenProposal)
+
+		break
+	}
+	return responseSecurityAssociation
+}
+
+// isAEADEncryptionAlgorithm reports whether the ESP encryption transform is a
+// combined mode cipher, which provides integrity by itself
+func isAEADEncryptionAlgorithm(transformID uint16) bool {
+	switch transformID {
+	case message.ENCR_AES_CCM_8, message.ENCR_AES_CCM_12, message.ENCR_AES_CCM_16,
+		message.ENCR_AES_GCM_8, message.ENCR_AES_GCM_12, message.ENCR_AES_GCM_16:
+		return true
 	default:
 		return false
 	}
 }
 
+// onlyNoneIntegrity reports whether the transforms are empty or a single AUTH_NONE
+func onlyNoneIntegrity(transforms message.TransformContainer) bool {
+	return len(transforms) == 0 || (len(transforms) == 1 && transforms[0].TransformID == message.AUTH_NONE)
+}
+
+// childSAEncryptionTransform returns the encryption transform proposed for a
+// PDU session child SA: the configured cipher, or that of the IKE SA
+func childSAEncryptionTransform(configured encr.ENCRKType, ikeEncrInfo encr.ENCRType) (*message.Transform, error) {
+	if configured != nil {
+		return encr.ToTransformChildSA(configured)
+	}
+	return encr.ToTransform(ikeEncrInfo)
+}
+
+// ESP integrity algorithms offered for N3IWF initiated child SAs, most
+// preferred first
+var childSAIntegrityPreference = []uint16{
+	message.AUTH_HMAC_SHA2_256_128,
+	message.AUTH_HMAC_SHA2_384_192,
+	message.AUTH_HMAC_SHA2_512_256,
+}
+
+// childSAIntegrityTransforms returns the integrity transforms proposed for a
+// PDU session child SA: the SHA-2 family, then the algorithm of the IKE SA
+// for UEs without SHA-2 support in ESP, as far as the ESP transform policy
+// allows them
+func childSAIntegrityTransforms(ikeIntegInfo integ.INTEGType) message.TransformContainer {
+	var transforms message.TransformContainer
+	for _, transformID := range childSAIntegrityPreference {
+		transforms.BuildTransform(message.TypeIntegrityAlgorithm, transformID, nil, nil, nil)
+	}
+	if ikeIntegInfo != nil && !slices.Contains(childSAIntegrityPreference, ikeIntegInfo.TransformID()) {
+		transforms = append(transforms, integ.ToTransform(ikeIntegInfo))
+	}
+	return slices.DeleteFunc(transforms, func(transform *message.Transform) bool {
+		return !kernelSupported(transform)
+	})
+}
+
+// validateChildSAResponseProposal checks the child SA proposal sent back to
+// the UE carries exactly one transform of each selected type. An AEAD cipher
+// must come with its key length and without an integrity transform
+func validateChildSAResponseProposal(proposal *message.Proposal) error {
+	if proposal == nil {
+		return errors.New("proposal is nil")
+	}
+	if len(proposal.SPI) != 4 {
+		return fmt.Errorf("invalid ESP SPI size %d", len(proposal.SPI))
+	}
+	if len(proposal.EncryptionAlgorithm) != 1 {
+		return fmt.Errorf("expected one encryption transform, got %d", len(proposal.EncryptionAlgorithm))
+	}
+	if len(proposal.ExtendedSequenceNumbers) != 1 {
+		return fmt.Errorf("expected one ESN transform, got %d", len(proposal.ExtendedSequenceNumbers))
+	}
+	if len(proposal.PseudorandomFunction) != 0 {
+		return errors.New("unexpected PRF transform for ESP")
+	}
+	if len(proposal.IntegrityAlgorithm) > 1 || len(proposal.DiffieHellmanGroup) > 1 {
+		return errors.New("more than one integrity or DH transform")
+	}
+
+	encrTransform := proposal.EncryptionAlgorithm[0]
+	if !isAEADEncryptionAlgorithm(encrTransform.TransformID) {
+		return nil
+	}
+	if !encrTransform.AttributePresent || encrTransform.AttributeType != message.AttributeTypeKeyLength {
+		return fmt.Errorf("AEAD transform %d without key length", encrTransform.TransformID)
+	}
+	switch encrTransform.AttributeValue {
+	case 128, 192, 256:
+	default:
+		return fmt.Errorf("invalid AEAD key length %d", encrTransform.AttributeValue)
+	}
+	if len(proposal.IntegrityAlgorithm) != 0 {
+		return errors.New("integrity transform present with AEAD encryption")
+	}
+	return nil
+}
+
+// kernelSupported reports whether the ESP transform can be installed by the
+// kernel and is allowed by the ESP transform policy
+func kernelSupported(transform *message.Transform) bool {
+	return context.N3IWFSelf().ESPSupported(transform)
+}
+
+func isTransformKernelSupported(transformType uint8, transformID uint16, attributePresent bool, attributeValue uint16) bool {
+	return kernelSupported(&message.Transform{
+		TransformType:    transformType,
+		TransformID:      transformID,
+		AttributePresent: attributePresent,
+		AttributeType:    message.AttributeTypeKeyLength,
+		AttributeValue:   attributeValue,
+	})
+}
+
+// ikeSupported reports whether the IKE SA transform is implemented by the
+// N3IWF and allowed by the IKE transform policy
+func ikeSupported(transform *message.Transform) bool {
+	var implemented bool
+	switch transform.TransformType {
+	case message.TypeEncryptionAlgorithm:
+		implemented = encr.DecodeTransform(transform) != nil
+	case message.TypePseudorandomFunction:
+		implemented = prf.DecodeTransform(transform) != nil
+	case message.TypeIntegrityAlgorithm:
+		implemented = integ.DecodeTransform(transform) != nil
+	case message.TypeDiffieHellmanGroup:
+		implemented = dh.DecodeTransform(transform) != nil
+	}
+	return implemented && context.N3IWFSelf().IKETransformPolicy.Allows(transform)
+}
+
 func parseIPAddressInformationToChildSecurityAssociation(
 	childSecurityAssociation *context.ChildSecurityAssociation,
 	uePublicIPAddr net.IP,
@@ -1791,87 +3014,64 @@ func parseIPAddressInformationToChildSecurityAssociation(
 		return fmt.Errorf("childSecurityAssociation is nil")
 	}
 
-	childSecurityAssociation.PeerPublicIPAddr = uePublicIPAddr
-	childSecurityAssociation.LocalPublicIPAddr = net.ParseIP(context.N3IWFSelf().IkeBindAddress)
+	// The outer addresses may be IPv6 while the inner ones are IPv4
+	childSecurityAssociation.PeerPublicIPAddr = outerIP(uePublicIPAddr)
+	childSecurityAssociation.LocalPublicIPAddr = outerIP(net.ParseIP(context.N3IWFSelf().IkeBindAddress))
+	if childSecurityAssociation.PeerPublicIPAddr == nil || childSecurityAssociation.LocalPublicIPAddr == nil {
+		return fmt.Errorf("invalid outer address, UE: %s, N3IWF: %s",
+			uePublicIPAddr, context.N3IWFSelf().IkeBindAddress)
+	}
 
 	logger.IKELog.Debugf("local TS: %+v", trafficSelectorLocal.StartAddress)
 	logger.IKELog.Debugf("remote TS: %+v", trafficSelectorRemote.StartAddress)
 
-	childSecurityAssociation.TrafficSelectorLocal = net.IPNet{
-		IP:   trafficSelectorLocal.StartAddress,
-		Mask: []byte{255, 255, 255, 255},
-	}
+	childSecurityAssociation.TrafficSelectorLocal = hostIPNet(trafficSelectorLocal.StartAddress)
+	childSecurityAssociation.TrafficSelectorRemote = hostIPNet(trafficSelectorRemote.StartAddress)
+
+	return nil
+}
 
-	childSecurityAssociation.TrafficSelectorRemote = net.IPNet{
-		IP:   trafficSelectorRemote.StartAddress,
-		Mask: []byte{255, 255, 255, 255},
+// outerIP returns ip in its 4 octet form for IPv4, including IPv4-mapped IPv6
+// addresses received on a dual stack socket, and in its 16 octet form for IPv6
+func outerIP(ip net.IP) net.IP {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4
 	}
+	return ip.To16()
+}
 
-	return nil
+// hostIPNet returns the single host network of a traffic selector address
+func hostIPNet(ip net.IP) net.IPNet {
+	bits := 8 * len(ip)
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
 }
 
-func SelectProposal(proposals message.ProposalContainer) message.ProposalContainer {
+// SelectProposal picks the first IKE proposal whose transforms are all
+// supported, see ikeSupported, with the preferred transform of each type. The
+// first of dhGroups offered in a proposal is chosen over the preferred group
+func SelectProposal(proposals message.ProposalContainer, dhGroups ...uint16) message.ProposalContainer {
 	var chooseProposal message.ProposalContainer
 
 	for _, proposal := range proposals {
 		// We need ENCR, PRF, INTEG, DH, but not ESN
 
-		var encryptionAlgorithmTransform, pseudorandomFunctionTransform *message.Transform
-		var integrityAlgorithmTransform, diffieHellmanGroupTransform *message.Transform
-		var chooseDH dh.DHType
-		var chooseEncr encr.ENCRType
-		var chooseInte integ.INTEGType
-		var choosePrf prf.PRFType
-
-		for _, transform := range proposal.DiffieHellmanGroup {
-			dhType := dh.DecodeTransform(transform)
-			if dhType != nil {
-				if diffieHellmanGroupTransform == nil {
-					diffieHellmanGroupTransform = transform
-					chooseDH = dhType
-				}
-			}
-		}
-		if chooseDH == nil {
+		diffieHellmanGroupTransform := preferredDHGroup(proposal.DiffieHellmanGroup, dhGroups, ikeSupported)
+		if diffieHellmanGroupTransform == nil {
 			continue // mandatory
 		}
 
-		for _, transform := range proposal.EncryptionAlgorithm {
-			encrType := encr.DecodeTransform(transform)
-			if encrType != nil {
-				if encryptionAlgorithmTransform == nil {
-					encryptionAlgorithmTransform = transform
-					chooseEncr = encrType
-				}
-			}
-		}
-		if chooseEncr == nil {
+		encryptionAlgorithmTransform := preferredTransform(proposal.EncryptionAlgorithm, ikeSupported)
+		if encryptionAlgorithmTransform == nil {
 			continue // mandatory
 		}
 
-		for _, transform := range proposal.IntegrityAlgorithm {
-			integType := integ.DecodeTransform(transform)
-			if integType != nil {
-				if integrityAlgorithmTransform == nil {
-					integrityAlgorithmTransform = transform
-					chooseInte = integType
-				}
-			}
-		}
-		if chooseInte == nil {
+		integrityAlgorithmTransform := preferredTransform(proposal.IntegrityAlgorithm, ikeSupported)
+		if integrityAlgorithmTransform == nil {
 			continue // mandatory
 		}
 
-		for _, transform := range proposal.PseudorandomFunction {
-			prfType := prf.DecodeTransform(transform)
-			if prfType != nil {
-				if pseudorandomFunctionTransform == nil {
-					pseudorandomFunctionTransform = transform
-					choosePrf = prfType
-				}
-			}
-		}
-		if choosePrf == nil {
+		pseudorandomFunctionTransform := preferredTransform(proposal.PseudorandomFunction, ikeSupported)
+		if pseudorandomFunctionTransform == nil {
 			continue // mandatory
 		}
 		if len(proposal.ExtendedSequenceNumbers) > 0 {
@@ -1893,7 +3093,7 @@ func SelectProposal(proposals message.ProposalContainer) message.ProposalContain
 func deleteChildSAFromSPIList(ikeUe *context.N3IWFIkeUe, spiList []uint32) (
 	[]uint32, []int64, error,
 ) {
-	var deleteSPIs []uint32
+	var deleteSPIs, unknownSPIs []uint32
 	var deletePduIds []int64
 
 	for _, spi := range spiList {
@@ -1906,19 +3106,29 @@ func deleteChildSAFromSPIList(ikeUe *context.N3IWFIkeUe, spiList []uint32) (
 				if len(childSA.PDUSessionIds) == 0 {
 					return nil, nil, fmt.Errorf("child_SA SPI: 0x%08x does not have PDU session id", spi)
 				}
-				deletePduIds = append(deletePduIds, childSA.PDUSessionIds[0])
+				// The CP child SA is not bound to a PDU session, e.g. when the UE
+				// deletes it after a rekey
+				if childSA.PDUSessionIds[0] >= 0 {
+					deletePduIds = append(deletePduIds, childSA.PDUSessionIds[0])
+				}
 
 				err := ikeUe.DeleteChildSA(childSA)
 				if err != nil {
 					return nil, nil, fmt.Errorf("DeleteChildSAFromSPIList: %w", err)
 				}
+				context.N3IWFSelf().AuditChildSA(ikeUe.N3IWFIKESecurityAssociation, childSA,
+					context.AuditTeardown, context.AuditDelete)
 				break
 			}
 		}
 		if !found {
-			logger.IKELog.Warnf("get unknown Child_SA with SPI: 0x%08x", spi)
+			unknownSPIs = append(unknownSPIs, spi)
 		}
 	}
+	if len(unknownSPIs) > 0 {
+		// The SA may already be gone, e.g. after simultaneous deletes
+		ikeUe.N3IWFIKESecurityAssociation.Log().Warnf("ignore delete of unknown Child_SA SPIs: %08x", unknownSPIs)
+	}
 
 	return deleteSPIs, deletePduIds, nil
 }
@@ -0,0 +1,1766 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/ike/security/encr"
+	"github.com/omec-project/n3iwf/ike/security/integ"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func newChildSAResponseProposal(encrID uint16, keyLength *uint16, integID *uint16) *message.Proposal {
+	var proposals message.ProposalContainer
+	proposal := proposals.BuildProposal(1, message.TypeESP, []byte{0x01, 0x02, 0x03, 0x04})
+	if keyLength != nil {
+		attrType := uint16(message.AttributeTypeKeyLength)
+		proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, encrID, &attrType, keyLength, nil)
+	} else {
+		proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, encrID, nil, nil, nil)
+	}
+	if integID != nil {
+		proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, *integID, nil, nil, nil)
+	}
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+	return proposal
+}
+
+func TestValidateChildSAResponseProposal(t *testing.T) {
+	keyLength256 := uint16(256)
+	keyLength100 := uint16(100)
+	hmacSHA1 := uint16(message.AUTH_HMAC_SHA1_96)
+
+	testcases := []struct {
+		description string
+		proposal    *message.Proposal
+		expectErr   bool
+	}{
+		{
+			description: "AES-CBC with integrity",
+			proposal:    newChildSAResponseProposal(message.ENCR_AES_CBC, &keyLength256, &hmacSHA1),
+		},
+		{
+			description: "AES-GCM without integrity",
+			proposal:    newChildSAResponseProposal(message.ENCR_AES_GCM_16, &keyLength256, nil),
+		},
+		{
+			description: "AES-GCM with integrity",
+			proposal:    newChildSAResponseProposal(message.ENCR_AES_GCM_16, &keyLength256, &hmacSHA1),
+			expectErr:   true,
+		},
+		{
+			description: "AES-GCM without key length",
+			proposal:    newChildSAResponseProposal(message.ENCR_AES_GCM_16, nil, nil),
+			expectErr:   true,
+		},
+		{
+			description: "AES-CCM with invalid key length",
+			proposal:    newChildSAResponseProposal(message.ENCR_AES_CCM_8, &keyLength100, nil),
+			expectErr:   true,
+		},
+		{
+			description: "missing ESN",
+			proposal: func() *message.Proposal {
+				proposal := newChildSAResponseProposal(message.ENCR_AES_GCM_16, &keyLength256, nil)
+				proposal.ExtendedSequenceNumbers = nil
+				return proposal
+			}(),
+			expectErr: true,
+		},
+		{
+			description: "nil proposal",
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := validateChildSAResponseProposal(tc.proposal)
+			if tc.expectErr && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAEADResponseSAEncoding(t *testing.T) {
+	keyLength := uint16(256)
+	proposal := newChildSAResponseProposal(message.ENCR_AES_GCM_16, &keyLength, nil)
+	if err := validateChildSAResponseProposal(proposal); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var payloads message.IKEPayloadContainer
+	sa := payloads.BuildSecurityAssociation()
+	sa.Proposals = append(sa.Proposals, proposal)
+	data, err := payloads.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	var decoded message.IKEPayloadContainer
+	if err := decoded.Decode(message.TypeSA, data); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	decodedSA, ok := decoded[0].(*message.SecurityAssociation)
+	if !ok || len(decodedSA.Proposals) != 1 {
+		t.Fatalf("Expected one decoded proposal, got %+v", decoded[0])
+	}
+	decodedProposal := decodedSA.Proposals[0]
+	if err := validateChildSAResponseProposal(decodedProposal); err != nil {
+		t.Errorf("decoded proposal is not well-formed: %v", err)
+	}
+	if len(decodedProposal.IntegrityAlgorithm) != 0 {
+		t.Errorf("integrity transform count mismatch. got = %d, want = 0", len(decodedProposal.IntegrityAlgorithm))
+	}
+	encrTransform := decodedProposal.EncryptionAlgorithm[0]
+	if encrTransform.TransformID != message.ENCR_AES_GCM_16 || encrTransform.AttributeValue != keyLength {
+		t.Errorf("encryption transform mismatch. got = %d/%d, want = %d/%d", encrTransform.TransformID,
+			encrTransform.AttributeValue, message.ENCR_AES_GCM_16, keyLength)
+	}
+	if decodedProposal.ExtendedSequenceNumbers[0].TransformID != message.ESN_DISABLE {
+		t.Errorf("ESN transform mismatch. got = %d, want = %d",
+			decodedProposal.ExtendedSequenceNumbers[0].TransformID, message.ESN_DISABLE)
+	}
+}
+
+func TestInnerIPAddr(t *testing.T) {
+	ueIP := net.ParseIP("10.0.0.5").To4()
+	ipAddr := innerIPAddr(ueIP)
+	if !ipAddr.IP.Equal(ueIP) {
+		t.Errorf("inner IP mismatch. got = %v, want = %v", ipAddr.IP, ueIP)
+	}
+	if ipAddr.Zone != "" {
+		t.Errorf("inner IP zone mismatch. got = %q, want = \"\"", ipAddr.Zone)
+	}
+	// The address must not alias the pool allocation
+	ueIP[3] = 6
+	if ipAddr.String() != "10.0.0.5" {
+		t.Errorf("inner IP aliased. got = %v, want = 10.0.0.5", ipAddr)
+	}
+}
+
+func TestHalfOpenIKESAReaper(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	savedTimeout, savedServer := n3iwfCtx.HalfOpenSATimeout, n3iwfCtx.IkeServer
+	t.Cleanup(func() {
+		n3iwfCtx.HalfOpenSATimeout, n3iwfCtx.IkeServer = savedTimeout, savedServer
+	})
+	n3iwfCtx.HalfOpenSATimeout = 10 * time.Millisecond
+	n3iwfCtx.IkeServer = &context.IkeServer{RcvEventCh: make(chan context.IkeEvt, 4)}
+
+	waitEvent := func(t *testing.T) context.IkeEvt {
+		t.Helper()
+		select {
+		case evt := <-n3iwfCtx.IkeServer.RcvEventCh:
+			return evt
+		case <-time.After(time.Second):
+			t.Fatalf("half-open timeout event not received")
+			return nil
+		}
+	}
+
+	t.Run("abandoned init is reaped", func(t *testing.T) {
+		ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+		evt := waitEvent(t)
+		if evt.Type() != context.HalfOpenIKESATimeout {
+			t.Fatalf("event type mismatch. got = %d, want = %d", evt.Type(), context.HalfOpenIKESATimeout)
+		}
+		HandleEvent(evt)
+		if _, ok := n3iwfCtx.IKESALoad(ikeSA.LocalSPI); ok {
+			t.Errorf("half-open IKE SA %016x was not reaped", ikeSA.LocalSPI)
+		}
+	})
+
+	t.Run("SA bound to a UE is kept", func(t *testing.T) {
+		ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+		t.Cleanup(func() { n3iwfCtx.DeleteIKESecurityAssociation(ikeSA.LocalSPI) })
+		ikeSA.IkeUE = &context.N3IWFIkeUe{}
+		HandleEvent(waitEvent(t))
+		if _, ok := n3iwfCtx.IKESALoad(ikeSA.LocalSPI); !ok {
+			t.Errorf("IKE SA %016x bound to a UE was reaped", ikeSA.LocalSPI)
+		}
+	})
+
+	t.Run("authenticated SA stops its timer", func(t *testing.T) {
+		ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+		t.Cleanup(func() { n3iwfCtx.DeleteIKESecurityAssociation(ikeSA.LocalSPI) })
+		ikeSA.StopHalfOpenTimer()
+		select {
+		case evt := <-n3iwfCtx.IkeServer.RcvEventCh:
+			t.Errorf("unexpected event after the timer was stopped: %d", evt.Type())
+		case <-time.After(5 * n3iwfCtx.HalfOpenSATimeout):
+		}
+	})
+}
+
+func TestEAPRoundTimeout(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	savedTimeout, savedIkeServer, savedNgapServer := n3iwfCtx.EAPRoundTimeout, n3iwfCtx.IkeServer, n3iwfCtx.NgapServer
+	t.Cleanup(func() {
+		n3iwfCtx.EAPRoundTimeout, n3iwfCtx.IkeServer, n3iwfCtx.NgapServer = savedTimeout, savedIkeServer, savedNgapServer
+	})
+	n3iwfCtx.EAPRoundTimeout = 10 * time.Millisecond
+	n3iwfCtx.IkeServer = &context.IkeServer{RcvEventCh: make(chan context.IkeEvt, 4)}
+	n3iwfCtx.NgapServer = &context.NgapServer{RcvEventCh: make(chan context.NgapEvt, 4)}
+
+	newEAPSA := func(t *testing.T) *context.IKESecurityAssociation {
+		t.Helper()
+		ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+		ikeSA.StopHalfOpenTimer()
+		t.Cleanup(func() { n3iwfCtx.DeleteIKESecurityAssociation(ikeSA.LocalSPI) })
+		ikeSA.State = EAPSignalling
+		return ikeSA
+	}
+
+	t.Run("stalled round is reaped", func(t *testing.T) {
+		ikeSA := newEAPSA(t)
+		n3iwfCtx.IkeSpiNgapIdMapping(ikeSA.LocalSPI, 42)
+		n3iwfCtx.StartEAPRoundTimer(ikeSA)
+		var evt context.IkeEvt
+		select {
+		case evt = <-n3iwfCtx.IkeServer.RcvEventCh:
+		case <-time.After(time.Second):
+			t.Fatalf("EAP round timeout event not received")
+		}
+		if evt.Type() != context.EAPRoundTimeout {
+			t.Fatalf("event type mismatch. got = %d, want = %d", evt.Type(), context.EAPRoundTimeout)
+		}
+		HandleEvent(evt)
+		if _, ok := n3iwfCtx.IKESALoad(ikeSA.LocalSPI); ok {
+			t.Errorf("stalled IKE SA %016x was not reaped", ikeSA.LocalSPI)
+		}
+		if _, ok := n3iwfCtx.IkeSpiLoad(42); ok {
+			t.Errorf("NGAP ID 42 still mapped to an IKE SA")
+		}
+		select {
+		case ngapEvt := <-n3iwfCtx.NgapServer.RcvEventCh:
+			releaseEvt, ok := ngapEvt.(*context.SendUEContextReleaseRequestEvt)
+			if !ok || releaseEvt.RanUeNgapId != 42 {
+				t.Errorf("NGAP event mismatch. got = %+v, want = UE Context Release Request of 42", ngapEvt)
+			}
+		default:
+			t.Errorf("UE Context Release Request not sent")
+		}
+	})
+
+	t.Run("answered round is kept", func(t *testing.T) {
+		ikeSA := newEAPSA(t)
+		n3iwfCtx.StartEAPRoundTimer(ikeSA)
+		round := ikeSA.EAPRound()
+		n3iwfCtx.StartEAPRoundTimer(ikeSA)
+		HandleEvent(context.NewEAPRoundTimeoutEvt(ikeSA.LocalSPI, round))
+		if _, ok := n3iwfCtx.IKESALoad(ikeSA.LocalSPI); !ok {
+			t.Errorf("IKE SA %016x reaped for an answered round", ikeSA.LocalSPI)
+		}
+		ikeSA.StopEAPRoundTimer()
+	})
+
+	t.Run("authenticated SA is kept", func(t *testing.T) {
+		ikeSA := newEAPSA(t)
+		n3iwfCtx.StartEAPRoundTimer(ikeSA)
+		ikeSA.StopEAPRoundTimer()
+		ikeSA.State = PostSignalling
+		HandleEvent(context.NewEAPRoundTimeoutEvt(ikeSA.LocalSPI, ikeSA.EAPRound()))
+		if _, ok := n3iwfCtx.IKESALoad(ikeSA.LocalSPI); !ok {
+			t.Errorf("authenticated IKE SA %016x was reaped", ikeSA.LocalSPI)
+		}
+	})
+
+	t.Run("CP child SA never requested", func(t *testing.T) {
+		ikeSA := newEAPSA(t)
+		n3iwfCtx.StartEAPRoundTimer(ikeSA)
+		ikeSA.StopEAPRoundTimer()
+		ikeSA.State = PostSignalling
+		ikeSA.CPChildSAPending = true
+		HandleEvent(context.NewEAPRoundTimeoutEvt(ikeSA.LocalSPI, ikeSA.EAPRound()))
+		if _, ok := n3iwfCtx.IKESALoad(ikeSA.LocalSPI); ok {
+			t.Errorf("IKE SA %016x without CP child SA was not reaped", ikeSA.LocalSPI)
+		}
+	})
+}
+
+func TestDeleteUnknownChildSA(t *testing.T) {
+	newIkeUe := func() *context.N3IWFIkeUe {
+		ikeUe := &context.N3IWFIkeUe{
+			N3iwfCtx:                      &context.N3IWFContext{},
+			N3IWFChildSecurityAssociation: make(map[uint32]*context.ChildSecurityAssociation),
+		}
+		ikeUe.N3IWFChildSecurityAssociation[0x1001] = &context.ChildSecurityAssociation{
+			InboundSPI:    0x1001,
+			OutboundSPI:   0x2001,
+			PDUSessionIds: []int64{5},
+			IkeUE:         ikeUe,
+		}
+		return ikeUe
+	}
+
+	testcases := []struct {
+		description  string
+		spis         []uint32
+		emptyDelete  bool
+		expSPIs      []uint32
+		expPduIds    []int64
+		expDelete    bool
+		expRemaining int
+	}{
+		{
+			description:  "known and unknown SPIs",
+			spis:         []uint32{0xdead, 0x2001},
+			expSPIs:      []uint32{0x1001},
+			expPduIds:    []int64{5},
+			expDelete:    true,
+			expRemaining: 0,
+		},
+		{
+			description:  "only unknown SPIs",
+			spis:         []uint32{0xdead},
+			expRemaining: 1,
+		},
+		{
+			description:  "only unknown SPIs with empty delete",
+			spis:         []uint32{0xdead},
+			emptyDelete:  true,
+			expDelete:    true,
+			expRemaining: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeUe := newIkeUe()
+			deleteSPIs, deletePduIds, err := deleteChildSAFromSPIList(ikeUe, tc.spis)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(deleteSPIs, tc.expSPIs) {
+				t.Errorf("deleted SPIs mismatch. got = %v, want = %v", deleteSPIs, tc.expSPIs)
+			}
+			if !slices.Equal(deletePduIds, tc.expPduIds) {
+				t.Errorf("deleted PDU session IDs mismatch. got = %v, want = %v", deletePduIds, tc.expPduIds)
+			}
+			if len(ikeUe.N3IWFChildSecurityAssociation) != tc.expRemaining {
+				t.Errorf("child SA count mismatch. got = %d, want = %d",
+					len(ikeUe.N3IWFChildSecurityAssociation), tc.expRemaining)
+			}
+
+			var response message.IKEPayloadContainer
+			buildChildSADeleteResponse(&response, deleteSPIs, tc.emptyDelete)
+			if !tc.expDelete {
+				if len(response) != 0 {
+					t.Errorf("Expected empty response, got %d payloads", len(response))
+				}
+				return
+			}
+			if len(response) != 1 {
+				t.Fatalf("response payload count mismatch. got = %d, want = 1", len(response))
+			}
+			deletePayload, ok := response[0].(*message.Delete)
+			if !ok {
+				t.Fatalf("Expected Delete payload, got %T", response[0])
+			}
+			if deletePayload.ProtocolID != message.TypeESP || int(deletePayload.NumberOfSPI) != len(tc.expSPIs) ||
+				!slices.Equal(deletePayload.SPIs, tc.expSPIs) {
+				t.Errorf("Delete payload mismatch. got = %+v, want SPIs = %v", deletePayload, tc.expSPIs)
+			}
+			if _, err = message.NewMessage(1, 2, message.INFORMATIONAL, true, false, 1, response).Encode(); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateDeletePayload(t *testing.T) {
+	testcases := []struct {
+		description string
+		payload     message.Delete
+		expectedErr bool
+	}{
+		{
+			description: "IKE SA",
+			payload:     message.Delete{ProtocolID: message.TypeIKE},
+		},
+		{
+			description: "IKE SA with SPIs",
+			payload:     message.Delete{ProtocolID: message.TypeIKE, SPISize: 4, NumberOfSPI: 1, SPIs: []uint32{0x2001}},
+			expectedErr: true,
+		},
+		{
+			description: "ESP SPIs",
+			payload: message.Delete{
+				ProtocolID: message.TypeESP, SPISize: 4, NumberOfSPI: 2, SPIs: []uint32{0x2001, 0x2002},
+			},
+		},
+		{
+			description: "ESP without SPI size",
+			payload:     message.Delete{ProtocolID: message.TypeESP},
+			expectedErr: true,
+		},
+		{
+			description: "AH SPIs",
+			payload:     message.Delete{ProtocolID: message.TypeAH, SPISize: 4, NumberOfSPI: 1, SPIs: []uint32{0x2001}},
+		},
+		{
+			description: "unknown protocol",
+			payload:     message.Delete{ProtocolID: 7, SPISize: 4},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := validateDeletePayload(&tc.payload)
+			if tc.expectedErr && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tc.expectedErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestLogExchangeErrorTranscript(t *testing.T) {
+	ikeSA := &context.IKESecurityAssociation{Transcript: context.NewIKETranscript(4)}
+	ikeSA.Transcript.Add(context.TraceInbound, nil, nil,
+		message.NewMessage(1, 2, message.CREATE_CHILD_SA, false, true, 3, nil))
+
+	logExchangeError(ikeSA, message.CREATE_CHILD_SA, "test", errors.New("dropped"))
+	if len(ikeSA.Transcript.Entries()) != 1 {
+		t.Fatalf("transcript not kept after a dropped message")
+	}
+	logExchangeError(ikeSA, message.CREATE_CHILD_SA, "test",
+		&ExchangeError{Notify: message.NO_PROPOSAL_CHOSEN, Err: errors.New("rejected")})
+	if entries := ikeSA.Transcript.Entries(); len(entries) != 0 {
+		t.Errorf("transcript kept after an error notify: %v", entries)
+	}
+}
+
+func TestRejectedPDUSessionChildSA(t *testing.T) {
+	testcases := []struct {
+		description   string
+		notifications []*message.Notification
+		expErrStr     context.EvtError
+	}{
+		{
+			description:   "NO_ADDITIONAL_SAS",
+			notifications: []*message.Notification{{NotifyMessageType: message.NO_ADDITIONAL_SAS}},
+			expErrStr:     context.ErrNoAdditionalSAs,
+		},
+		{
+			description: "other error after a status notify",
+			notifications: []*message.Notification{
+				{NotifyMessageType: message.USE_TRANSPORT_MODE},
+				{NotifyMessageType: message.NO_PROPOSAL_CHOSEN},
+			},
+			expErrStr: context.ErrNoProposalChosen,
+		},
+		{
+			description:   "TS_UNACCEPTABLE",
+			notifications: []*message.Notification{{NotifyMessageType: message.TS_UNACCEPTABLE}},
+			expErrStr:     context.ErrTSUnacceptable,
+		},
+		{
+			description:   "TEMPORARY_FAILURE",
+			notifications: []*message.Notification{{NotifyMessageType: message.TEMPORARY_FAILURE}},
+			expErrStr:     context.ErrTemporaryFailure,
+		},
+		{
+			description:   "other error",
+			notifications: []*message.Notification{{NotifyMessageType: message.INVALID_SYNTAX}},
+			expErrStr:     context.ErrChildSARejected,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			errorNotification := childSAErrorNotification(tc.notifications)
+			if errorNotification == nil {
+				t.Fatalf("Expected an error notify")
+			}
+
+			ikeUe := &context.N3IWFIkeUe{
+				N3iwfCtx:                             &context.N3IWFContext{},
+				TemporaryExchangeMsgIDChildSAMapping: make(map[uint32]*context.ChildSecurityAssociation),
+			}
+			ikeSA := &context.IKESecurityAssociation{
+				LocalSPI:           0x1234,
+				ResponderMessageID: 5,
+				IkeUE:              ikeUe,
+				TemporaryIkeMsg: &context.IkeMsgTemporaryData{
+					ErrorNotify: errorNotification.NotifyMessageType,
+				},
+			}
+			ikeUe.N3IWFIKESecurityAssociation = ikeSA
+			ikeUe.CreateHalfChildSA(5, 0x1001, 1)
+			if pendingPDUSessionChildSA(ikeSA, 4) || !pendingPDUSessionChildSA(ikeSA, 5) {
+				t.Fatalf("pending CREATE_CHILD_SA mismatch, want message ID 5")
+			}
+			setupData := &context.PDUSessionSetupTemporaryData{
+				UnactivatedPDUSession: []*context.PDUSession{{Id: 1}},
+				Index:                 1,
+			}
+
+			continueCreateChildSA(ikeSA, setupData)
+			if len(setupData.FailedErrStr) != 1 || setupData.FailedErrStr[0] != tc.expErrStr {
+				t.Errorf("FailedErrStr mismatch. got = %v, want = [%v]", setupData.FailedErrStr, tc.expErrStr)
+			}
+			if _, ok := ikeUe.TemporaryExchangeMsgIDChildSAMapping[5]; ok {
+				t.Errorf("half child SA of the rejected exchange not removed")
+			}
+			if ikeSA.ResponderMessageID != 6 {
+				t.Errorf("ResponderMessageID mismatch. got = %d, want = 6", ikeSA.ResponderMessageID)
+			}
+		})
+	}
+
+	if childSAErrorNotification([]*message.Notification{{NotifyMessageType: message.USE_TRANSPORT_MODE}}) != nil {
+		t.Errorf("status notify taken as an error")
+	}
+}
+
+func TestPDUSessionChildSATransportMode(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	allowTransportMode := n3iwfCtx.AllowTransportMode
+	defer func() { n3iwfCtx.AllowTransportMode = allowTransportMode }()
+	n3iwfCtx.AllowTransportMode = true
+
+	ikeUe, _ := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	offered := message.ProposalContainer{}
+	proposal := offered.BuildProposal(1, message.TypeESP, []byte{0, 0, 0x10, 0x01})
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_GCM_16,
+		&attrType, &keyLength, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE,
+		nil, nil, nil)
+	ikeUe.CreateHalfChildSA(7, 0x1001, 1).OfferedProposals = offered
+
+	// The UE accepts the tunnel mode request of the N3IWF in transport mode
+	var payloads message.IKEPayloadContainer
+	chosen := payloads.BuildSecurityAssociation()
+	chosenProposal := *proposal
+	chosenProposal.SPI = []byte{0, 0, 0x20, 0x02}
+	chosen.Proposals = append(chosen.Proposals, &chosenProposal)
+	payloads.BuildNotification(message.TypeNone, message.USE_TRANSPORT_MODE, nil, nil)
+	response := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.CREATE_CHILD_SA, true, false, 7, payloads)
+	conn := ikeUe.IKEConnection
+	// Without NGAP context the PDU session information cannot be requested
+	_ = handleCREATECHILDSA(conn.Conn, conn.N3IWFAddr, conn.UEAddr, response, ikeSA)
+	if ikeSA.TemporaryIkeMsg == nil || ikeSA.TemporaryIkeMsg.ErrorNotify != message.NO_PROPOSAL_CHOSEN {
+		t.Errorf("transport mode response not refused: %+v", ikeSA.TemporaryIkeMsg)
+	}
+}
+
+func TestFailedPDUSessionChildSA(t *testing.T) {
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeUe.CreateHalfChildSA(7, 0x1001, 1)
+	// The UE chose a proposal without encryption transform, which the N3IWF
+	// fails to key
+	chosenSA := &message.SecurityAssociation{Proposals: message.ProposalContainer{{SPI: []byte{0, 0, 0x20, 0x02}}}}
+	ikeSA.TemporaryIkeMsg = &context.IkeMsgTemporaryData{SecurityAssociation: chosenSA}
+	setupData := &context.PDUSessionSetupTemporaryData{
+		UnactivatedPDUSession: []*context.PDUSession{{Id: 1}},
+		Index:                 1,
+	}
+
+	ikeSA.Lock()
+	continueCreateChildSA(ikeSA, setupData)
+	ikeSA.Unlock()
+	if len(setupData.FailedErrStr) != 1 || setupData.FailedErrStr[0] != context.ErrTransportResourceUnavailable {
+		t.Errorf("FailedErrStr mismatch. got = %v, want = [%v]", setupData.FailedErrStr,
+			context.ErrTransportResourceUnavailable)
+	}
+	if _, ok := ikeUe.TemporaryExchangeMsgIDChildSAMapping[7]; ok {
+		t.Errorf("half child SA of the failed exchange not removed")
+	}
+	// The UE is asked to delete the child SA it installed
+	messageID, deletePayload := readDeleteRequest(t, ueConn, ikeUe)
+	if messageID != 8 || deletePayload.ProtocolID != message.TypeESP ||
+		!slices.Equal(deletePayload.SPIs, []uint32{0x1001}) {
+		t.Errorf("ESP Delete mismatch: message ID %d, payload %+v", messageID, deletePayload)
+	}
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	if pending := ikeSA.PendingChildSADelete; pending == nil || pending.MessageID != 8 {
+		t.Errorf("ESP Delete not pending: %+v", pending)
+	}
+	if pending := ikeSA.PendingChildSADelete; pending != nil {
+		pending.Retransmit.Stop()
+	}
+}
+
+func TestOverlappingGetNGAPContextResponses(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	savedNgapServer := n3iwfCtx.NgapServer
+	t.Cleanup(func() { n3iwfCtx.NgapServer = savedNgapServer })
+	n3iwfCtx.NgapServer = &context.NgapServer{RcvEventCh: make(chan context.NgapEvt, 4)}
+
+	ikeUe, _ := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.State = EndSignalling
+	n3iwfCtx.IkeSpiNgapIdMapping(ikeSA.LocalSPI, 44)
+	t.Cleanup(func() { n3iwfCtx.DeleteIkeSPIFromNgapId(44) })
+
+	// The PDU session setup request is still outstanding when the SA moves on
+	// and a CREATE_CHILD_SA exchange requests the context again
+	if err := startNASSignalling(n3iwfCtx, ikeSA, 44); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ikeSA.State = HandleCreateChildSA
+	ikeSA.TemporaryIkeMsg = &context.IkeMsgTemporaryData{ErrorNotify: message.TEMPORARY_FAILURE}
+	if err := requestPDUSessionSetupData(n3iwfCtx, ikeSA); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var requests []*context.GetNGAPContextEvt
+	for range 3 {
+		if evt, ok := (<-n3iwfCtx.NgapServer.RcvEventCh).(*context.GetNGAPContextEvt); ok {
+			requests = append(requests, evt)
+		}
+	}
+	if len(requests) != 2 || requests[0].Token == requests[1].Token {
+		t.Fatalf("GetNGAPContext requests mismatch: %+v", requests)
+	}
+
+	expectSetupResponse := func() {
+		t.Helper()
+		select {
+		case evt := <-n3iwfCtx.NgapServer.RcvEventCh:
+			if evt.Type() != context.SendPDUSessionResourceSetupResponse {
+				t.Errorf("NGAP event mismatch. got = %d, want = %d", evt.Type(),
+					context.SendPDUSessionResourceSetupResponse)
+			}
+		default:
+			t.Errorf("PDU session setup not answered")
+		}
+	}
+
+	// Answered in reverse order
+	childSASetupData := &context.PDUSessionSetupTemporaryData{
+		UnactivatedPDUSession: []*context.PDUSession{{Id: 1}},
+		Index:                 1,
+	}
+	HandleEvent(context.NewGetNGAPContextRepEvt(ikeSA.LocalSPI, requests[1].Token,
+		requests[1].NgapCxtReqNumlist, []any{childSASetupData}))
+	if len(childSASetupData.FailedErrStr) != 1 || childSASetupData.FailedErrStr[0] != context.ErrTemporaryFailure {
+		t.Errorf("FailedErrStr mismatch. got = %v, want = [%v]", childSASetupData.FailedErrStr,
+			context.ErrTemporaryFailure)
+	}
+	expectSetupResponse()
+
+	ikeSA.TemporaryIkeMsg = &context.IkeMsgTemporaryData{ErrorNotify: message.TEMPORARY_FAILURE}
+	HandleEvent(context.NewGetNGAPContextRepEvt(ikeSA.LocalSPI, requests[0].Token,
+		requests[0].NgapCxtReqNumlist, []any{&context.PDUSessionSetupTemporaryData{}}))
+	if ikeSA.TemporaryIkeMsg == nil {
+		t.Errorf("PDU session setup data taken as the CREATE_CHILD_SA continuation")
+	}
+	expectSetupResponse()
+
+	// A response already handled is dropped
+	HandleEvent(context.NewGetNGAPContextRepEvt(ikeSA.LocalSPI, requests[0].Token,
+		requests[0].NgapCxtReqNumlist, []any{&context.PDUSessionSetupTemporaryData{}}))
+	select {
+	case evt := <-n3iwfCtx.NgapServer.RcvEventCh:
+		t.Errorf("Unexpected NGAP event %d", evt.Type())
+	default:
+	}
+}
+
+func TestUEChildSARequest(t *testing.T) {
+	testcases := []struct {
+		description string
+		state       uint8
+		waiting     bool
+	}{
+		{description: "before the signalling child SA", state: EndSignalling},
+		{description: "after the signalling child SA", state: HandleCreateChildSA},
+		{description: "PDU session being set up", state: HandleCreateChildSA, waiting: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeUe, ueConn := newDeleteTestIkeUe(t)
+			ikeSA := ikeUe.N3IWFIKESecurityAssociation
+			ikeSA.State = tc.state
+			if tc.waiting {
+				ikeSA.TemporaryIkeMsg = &context.IkeMsgTemporaryData{}
+			}
+			ikeConnection := ikeSA.IKEConnection
+			request := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.CREATE_CHILD_SA, false, true, 3, nil)
+
+			// Answered right away, without asking NGAP
+			err := handleCREATECHILDSA(ikeConnection.Conn, ikeConnection.N3IWFAddr, ikeConnection.UEAddr,
+				request, ikeSA)
+			var exchangeErr *ExchangeError
+			if !errors.As(err, &exchangeErr) || exchangeErr.Notify != message.TEMPORARY_FAILURE {
+				t.Errorf("error mismatch. got = %v, want notify %d", err, message.TEMPORARY_FAILURE)
+			}
+
+			if err := ueConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			buf := make([]byte, 1500)
+			n, _, err := ueConn.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("CREATE_CHILD_SA response not received: %v", err)
+			}
+			ikeHeader, err := message.ParseHeader(buf[:n])
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			answer, err := DecodeDecrypt(buf[:n], ikeHeader, ikeSA.IKESAKey, message.Role_Initiator)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !answer.IsResponse() || answer.MessageID != 3 || answer.ExchangeType != message.CREATE_CHILD_SA {
+				t.Fatalf("Unexpected answer %d to message ID %d", answer.ExchangeType, answer.MessageID)
+			}
+			notification, ok := answer.Payloads[0].(*message.Notification)
+			if !ok || notification.NotifyMessageType != message.TEMPORARY_FAILURE {
+				t.Errorf("Unexpected answer: %+v, want notify %d", answer.Payloads[0], message.TEMPORARY_FAILURE)
+			}
+			if (ikeSA.TemporaryIkeMsg != nil) != tc.waiting {
+				t.Errorf("TemporaryIkeMsg mismatch: %+v", ikeSA.TemporaryIkeMsg)
+			}
+			if ikeSA.ResponderMessageID != 7 {
+				t.Errorf("ResponderMessageID mismatch. got = %d, want = 7", ikeSA.ResponderMessageID)
+			}
+		})
+	}
+}
+
+func TestUEChildSARequestRetransmission(t *testing.T) {
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.State = HandleCreateChildSA
+	ikeConnection := ikeSA.IKEConnection
+	request := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.CREATE_CHILD_SA, false, true, 3, nil)
+	buf := make([]byte, 1500)
+	readResponse := func() []byte {
+		t.Helper()
+		if err := ueConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		n, _, err := ueConn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		return bytes.Clone(buf[:n])
+	}
+
+	err := handleCREATECHILDSA(ikeConnection.Conn, ikeConnection.N3IWFAddr, ikeConnection.UEAddr, request, ikeSA)
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+	response := readResponse()
+	if response == nil {
+		t.Fatalf("CREATE_CHILD_SA response not received")
+	}
+
+	// Answered: the same datagram is resent
+	err = handleCREATECHILDSA(ikeConnection.Conn, ikeConnection.N3IWFAddr, ikeConnection.UEAddr, request, ikeSA)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resent := readResponse(); !bytes.Equal(resent, response) {
+		t.Errorf("resent response mismatch. got = %x, want = %x", resent, response)
+	}
+}
+
+func TestSetupDedicatedXfrmi(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	testcases := []struct {
+		description string
+		taken       []uint32
+		failure     error
+		expID       uint32
+		expErr      bool
+		expInUse    int
+	}{
+		{description: "free ID", expID: 15, expInUse: 1},
+		{description: "ID taken by another N3IWF", taken: []uint32{15, 16}, expID: 17, expInUse: 3},
+		{description: "range exhausted", taken: []uint32{15, 16, 17, 18}, expErr: true, expInUse: 4},
+		{description: "setup failure", failure: unix.EPERM, expErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ids, err := context.NewXfrmIfaceIds(15, 18)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			n3iwfCtx := &context.N3IWFContext{
+				XfrmInterfaceId:   7,
+				XfrmInterfaceName: "ipsec",
+				XfrmIfaceIds:      ids,
+				Subnet:            subnet,
+			}
+			origSetupIPsecXfrmi := setupIPsecXfrmi
+			defer func() { setupIPsecXfrmi = origSetupIPsecXfrmi }()
+			setupIPsecXfrmi = func(name, parent string, ifId uint32, addr net.IPNet, mtu int) (netlink.Link, error) {
+				if name != fmt.Sprintf("ipsec-%d", ifId) {
+					t.Errorf("interface name mismatch. got = %s, if_id %d", name, ifId)
+				}
+				if slices.Contains(tc.taken, ifId) {
+					return nil, unix.EEXIST
+				}
+				if tc.failure != nil {
+					return nil, tc.failure
+				}
+				return &netlink.Xfrmi{LinkAttrs: netlink.LinkAttrs{Name: name}, Ifid: ifId}, nil
+			}
+
+			ifId, link, err := setupDedicatedXfrmi(n3iwfCtx, "10.0.0.1", &context.IKESecurityAssociation{})
+			if inUse := ids.InUse(); inUse != tc.expInUse {
+				t.Errorf("IDs in use mismatch. got = %d, want = %d", inUse, tc.expInUse)
+			}
+			if tc.expErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if ifId != tc.expID {
+				t.Errorf("if_id mismatch. got = %d, want = %d", ifId, tc.expID)
+			}
+			if stored, ok := n3iwfCtx.XfrmIfaces.Load(ifId); !ok || stored != link {
+				t.Errorf("XFRM interface %d not stored", ifId)
+			}
+		})
+	}
+}
+
+func TestPDUSessionChildSAs(t *testing.T) {
+	var proposal message.Proposal
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+	childSAKey, err := security.NewChildSAKeyByProposal(&proposal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ikeUe := &context.N3IWFIkeUe{N3IWFChildSecurityAssociation: map[uint32]*context.ChildSecurityAssociation{
+		0x1001: {InboundSPI: 0x1001, OutboundSPI: 0x2001, PDUSessionIds: []int64{1}, ChildSAKey: childSAKey},
+		0x1002: {InboundSPI: 0x1002, OutboundSPI: 0x2002, PDUSessionIds: []int64{2}, ChildSAKey: childSAKey},
+	}}
+	setupData := &context.PDUSessionSetupTemporaryData{
+		UnactivatedPDUSession: []*context.PDUSession{{Id: 1}, {Id: 2}, {Id: 3}},
+		FailedErrStr:          []context.EvtError{context.ErrNil, context.ErrTransportResourceUnavailable, context.ErrNil},
+	}
+
+	childSAs := pduSessionChildSAs(ikeUe, setupData)
+	expected := []context.ChildSAInfo{{
+		PDUSessionId:        1,
+		InboundSPI:          0x1001,
+		OutboundSPI:         0x2001,
+		EncryptionAlgorithm: message.ENCR_AES_CBC,
+		EncryptionKeyLength: 32,
+		IntegrityAlgorithm:  message.AUTH_HMAC_SHA2_256_128,
+	}}
+	if !slices.Equal(childSAs, expected) {
+		t.Errorf("child SAs mismatch. got = %+v, want = %+v", childSAs, expected)
+	}
+}
+
+func TestHandleShutdown(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+
+	var spis []uint64
+	for range 3 {
+		ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+		ikeSA.StopHalfOpenTimer()
+		ikeUe := n3iwfCtx.NewN3iwfIkeUe(ikeSA.LocalSPI)
+		ikeUe.N3IWFIKESecurityAssociation = ikeSA
+		ikeSA.IkeUE = ikeUe
+		ikeUe.N3IWFChildSecurityAssociation[0x1001] = &context.ChildSecurityAssociation{InboundSPI: 0x1001}
+		spis = append(spis, ikeSA.LocalSPI)
+	}
+
+	evt := context.NewShutdownEvt()
+	HandleEvent(evt)
+
+	select {
+	case <-evt.Done:
+	default:
+		t.Errorf("shutdown event was not completed")
+	}
+	for _, spi := range spis {
+		if _, ok := n3iwfCtx.IkeUePoolLoad(spi); ok {
+			t.Errorf("IKE UE %016x was not deleted", spi)
+		}
+		if _, ok := n3iwfCtx.IKESALoad(spi); ok {
+			t.Errorf("IKE SA %016x was not deleted", spi)
+		}
+	}
+}
+
+func TestChildSAIntegrityTransforms(t *testing.T) {
+	sha2 := []uint16{message.AUTH_HMAC_SHA2_256_128, message.AUTH_HMAC_SHA2_384_192, message.AUTH_HMAC_SHA2_512_256}
+	testcases := []struct {
+		description string
+		ikeIntegID  uint16
+		expIDs      []uint16
+	}{
+		{
+			description: "IKE SA without integrity",
+			expIDs:      sha2,
+		},
+		{
+			description: "IKE SA with HMAC-SHA1-96",
+			ikeIntegID:  message.AUTH_HMAC_SHA1_96,
+			expIDs:      append(slices.Clone(sha2), message.AUTH_HMAC_SHA1_96),
+		},
+		{
+			description: "IKE SA with HMAC-SHA2-512-256",
+			ikeIntegID:  message.AUTH_HMAC_SHA2_512_256,
+			expIDs:      sha2,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var ikeIntegInfo integ.INTEGType
+			if tc.ikeIntegID != 0 {
+				ikeIntegInfo = integ.DecodeTransform(&message.Transform{
+					TransformType: message.TypeIntegrityAlgorithm,
+					TransformID:   tc.ikeIntegID,
+				})
+			}
+			var ids []uint16
+			for _, transform := range childSAIntegrityTransforms(ikeIntegInfo) {
+				if !isTransformKernelSupported(transform.TransformType, transform.TransformID,
+					transform.AttributePresent, transform.AttributeValue) {
+					t.Errorf("transform %d is not supported by the kernel", transform.TransformID)
+				}
+				ids = append(ids, transform.TransformID)
+			}
+			if !slices.Equal(ids, tc.expIDs) {
+				t.Errorf("integrity transforms mismatch. got = %v, want = %v", ids, tc.expIDs)
+			}
+		})
+	}
+}
+
+func TestChildSAEncryptionTransform(t *testing.T) {
+	attrType := uint16(message.AttributeTypeKeyLength)
+	decode := func(transformID, keyLength uint16) *message.Transform {
+		return &message.Transform{
+			TransformType:    message.TypeEncryptionAlgorithm,
+			TransformID:      transformID,
+			AttributePresent: true,
+			AttributeFormat:  message.AttributeFormatUseTV,
+			AttributeType:    attrType,
+			AttributeValue:   keyLength,
+		}
+	}
+	ikeEncrInfo := encr.DecodeTransform(decode(message.ENCR_AES_CBC, 256))
+
+	testcases := []struct {
+		description    string
+		configured     encr.ENCRKType
+		expTransformID uint16
+		expKeyLength   uint16
+	}{
+		{
+			description:    "unset, cipher of the IKE SA",
+			expTransformID: message.ENCR_AES_CBC,
+			expKeyLength:   256,
+		},
+		{
+			description:    "AES-CBC-128",
+			configured:     encr.DecodeTransformChildSA(decode(message.ENCR_AES_CBC, 128)),
+			expTransformID: message.ENCR_AES_CBC,
+			expKeyLength:   128,
+		},
+		{
+			description:    "AES-CTR-192",
+			configured:     encr.DecodeTransformChildSA(decode(message.ENCR_AES_CTR, 192)),
+			expTransformID: message.ENCR_AES_CTR,
+			expKeyLength:   192,
+		},
+		{
+			description:    "AES-GCM-16-256",
+			configured:     encr.DecodeTransformChildSA(decode(message.ENCR_AES_GCM_16, 256)),
+			expTransformID: message.ENCR_AES_GCM_16,
+			expKeyLength:   256,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			transform, err := childSAEncryptionTransform(tc.configured, ikeEncrInfo)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if transform.TransformID != tc.expTransformID || transform.AttributeValue != tc.expKeyLength {
+				t.Errorf("encryption transform mismatch. got = %d/%d, want = %d/%d", transform.TransformID,
+					transform.AttributeValue, tc.expTransformID, tc.expKeyLength)
+			}
+			// The XFRM install must accept what the N3IWF proposes
+			if !isTransformKernelSupported(transform.TransformType, transform.TransformID,
+				transform.AttributePresent, transform.AttributeValue) {
+				t.Errorf("transform %d/%d is not supported by the kernel", transform.TransformID, transform.AttributeValue)
+			}
+		})
+	}
+}
+
+// mislabeledPayload is a payload whose type field does not match its
+// concrete type, as a buggy decoder could yield
+type mislabeledPayload struct {
+	*message.Nonce
+	payloadType message.IKEPayloadType
+}
+
+func (p *mislabeledPayload) Type() message.IKEPayloadType {
+	return p.payloadType
+}
+
+func TestAssertPayload(t *testing.T) {
+	testcases := []struct {
+		description string
+		payload     any
+		expNil      bool
+		expErr      bool
+	}{
+		{
+			description: "absent payload",
+			expNil:      true,
+		},
+		{
+			description: "matching payload",
+			payload:     &message.Delete{},
+		},
+		{
+			description: "mismatched payload",
+			payload:     &mislabeledPayload{Nonce: &message.Nonce{}, payloadType: message.TypeD},
+			expNil:      true,
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			deletePayload, err := assertPayload[*message.Delete](tc.payload)
+			if tc.expErr && !errors.Is(err, ErrInvalidSyntax) {
+				t.Errorf("error mismatch. got = %v, want = %v", err, ErrInvalidSyntax)
+			} else if !tc.expErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if (deletePayload == nil) != tc.expNil {
+				t.Errorf("payload mismatch. got = %v, want nil = %v", deletePayload, tc.expNil)
+			}
+		})
+	}
+}
+
+func TestHandleInformationalMislabeledPayload(t *testing.T) {
+	ikeSA := &context.IKESecurityAssociation{}
+	ikeSA.IkeUE = &context.N3IWFIkeUe{N3IWFIKESecurityAssociation: ikeSA}
+
+	var payloads message.IKEPayloadContainer
+	payloads = append(payloads, &mislabeledPayload{Nonce: &message.Nonce{}, payloadType: message.TypeD})
+	ikeMsg := message.NewMessage(0x5678, 0x1234, message.INFORMATIONAL, true, false, 3, payloads)
+
+	// A malformed response must be dropped instead of crashing the IKE server
+	err := handleInformational(nil, nil, nil, ikeMsg, ikeSA)
+	if !errors.Is(err, ErrInvalidSyntax) {
+		t.Errorf("error mismatch. got = %v, want = %v", err, ErrInvalidSyntax)
+	}
+	var exchangeErr *ExchangeError
+	if errors.As(err, &exchangeErr) {
+		t.Errorf("Unexpected notify %d for a response", exchangeErr.Notify)
+	}
+}
+
+func TestSendChildSADeleteRequestBySPI(t *testing.T) {
+	n3iwfConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer n3iwfConn.Close()
+	ueConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+
+	n3iwfCtx := context.N3IWFSelf()
+	ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+	ikeSA.StopHalfOpenTimer()
+	defer n3iwfCtx.DeleteIKESecurityAssociation(ikeSA.LocalSPI)
+	ikeSA.IKESAKey = newTestIKESAKey(t)
+	ikeSA.ResponderMessageID = 4
+	ikeUe := n3iwfCtx.NewN3iwfIkeUe(ikeSA.LocalSPI)
+	defer n3iwfCtx.DeleteIKEUe(ikeSA.LocalSPI)
+	ikeUe.N3IWFIKESecurityAssociation = ikeSA
+	ikeSA.IkeUE = ikeUe
+	ikeUe.IKEConnection = &context.UDPSocketInfo{
+		Conn:      n3iwfConn,
+		N3IWFAddr: n3iwfConn.LocalAddr().(*net.UDPAddr),
+		UEAddr:    ueConn.LocalAddr().(*net.UDPAddr),
+	}
+	ikeSA.IKEConnection = ikeUe.IKEConnection
+	for _, spi := range []uint32{0x1001, 0x1002} {
+		childSA := &context.ChildSecurityAssociation{InboundSPI: spi, IkeUE: ikeUe}
+		ikeUe.N3IWFChildSecurityAssociation[spi] = childSA
+		n3iwfCtx.ChildSA.Store(spi, childSA)
+	}
+	defer n3iwfCtx.ChildSA.Delete(uint32(0x1002))
+
+	if err = SendChildSADeleteRequestBySPI(ikeUe, []uint32{0x3003}); err == nil {
+		t.Errorf("Expected error for unknown SPI but got none")
+	}
+	if err = SendChildSADeleteRequestBySPI(ikeUe, []uint32{0x1001, 0x1001}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pending := ikeSA.PendingChildSADelete
+	if pending == nil || pending.MessageID != 4 || !slices.Equal(pending.InboundSPIs, []uint32{0x1001}) {
+		t.Fatalf("Unexpected pending delete: %+v", pending)
+	}
+	if err = SendChildSADeleteRequestBySPI(ikeUe, []uint32{0x1002}); err == nil {
+		t.Errorf("Expected error while a delete is pending but got none")
+	}
+
+	if err = ueConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err = ueConn.ReadFromUDP(make([]byte, 1500)); err != nil {
+		t.Fatalf("delete request not received: %v", err)
+	}
+
+	// Child SAs are kept until the UE answers
+	if _, ok := ikeUe.N3IWFChildSecurityAssociation[0x1001]; !ok {
+		t.Fatalf("child SA 0x1001 deleted before the acknowledgement")
+	}
+
+	var payloads message.IKEPayloadContainer
+	payloads.BuildDeletePayload(message.TypeESP, 4, 1, []uint32{0x2001})
+	answer := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.INFORMATIONAL, true, false, 4, payloads)
+	HandleInformational(n3iwfConn, ikeUe.IKEConnection.N3IWFAddr, ikeUe.IKEConnection.UEAddr, answer, ikeSA)
+
+	if _, ok := ikeUe.N3IWFChildSecurityAssociation[0x1001]; ok {
+		t.Errorf("child SA 0x1001 was not deleted")
+	}
+	if _, ok := n3iwfCtx.ChildSA.Load(uint32(0x1001)); ok {
+		t.Errorf("child SA 0x1001 still in the context")
+	}
+	if _, ok := ikeUe.N3IWFChildSecurityAssociation[0x1002]; !ok {
+		t.Errorf("child SA 0x1002 was deleted")
+	}
+	if ikeSA.PendingChildSADelete != nil {
+		t.Errorf("pending delete was not cleared")
+	}
+	if ikeSA.ResponderMessageID != 5 {
+		t.Errorf("ResponderMessageID mismatch. got = %d, want = %d", ikeSA.ResponderMessageID, 5)
+	}
+}
+
+func TestGenerateNATDetectHash(t *testing.T) {
+	testcases := []struct {
+		description string
+		ip          net.IP
+		expIPLen    int
+	}{
+		{
+			description: "IPv4 address",
+			ip:          net.ParseIP("192.168.0.1").To4(),
+			expIPLen:    net.IPv4len,
+		},
+		{
+			description: "IPv4-mapped IPv6 address",
+			ip:          net.ParseIP("::ffff:192.168.0.1"),
+			expIPLen:    net.IPv4len,
+		},
+		{
+			description: "IPv6 address",
+			ip:          net.ParseIP("2001:db8::1"),
+			expIPLen:    net.IPv6len,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			addr := &net.UDPAddr{IP: tc.ip, Port: 4500}
+			hash, err := generateNATDetectHash(0x0102030405060708, 0x1112131415161718, addr)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			natdData := binary.BigEndian.AppendUint64(nil, 0x0102030405060708)
+			natdData = binary.BigEndian.AppendUint64(natdData, 0x1112131415161718)
+			if tc.expIPLen == net.IPv4len {
+				natdData = append(natdData, tc.ip.To4()...)
+			} else {
+				natdData = append(natdData, tc.ip.To16()...)
+			}
+			natdData = binary.BigEndian.AppendUint16(natdData, 4500)
+			expHash := sha1.Sum(natdData) // #nosec G401
+			if !bytes.Equal(hash, expHash[:]) {
+				t.Errorf("NATD hash mismatch. got = %x, want = %x", hash, expHash)
+			}
+		})
+	}
+
+	if _, err := generateNATDetectHash(1, 2, &net.UDPAddr{Port: 4500}); err == nil {
+		t.Errorf("Expected error but got none")
+	}
+}
+
+func TestParseIPAddressInformationIPv6Outer(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	ikeBindAddress := n3iwfCtx.IkeBindAddress
+	defer func() { n3iwfCtx.IkeBindAddress = ikeBindAddress }()
+	n3iwfCtx.IkeBindAddress = "2001:db8::1"
+
+	childSA := &context.ChildSecurityAssociation{}
+	tsLocal := &message.IndividualTrafficSelector{StartAddress: net.ParseIP("10.0.0.1").To4()}
+	tsRemote := &message.IndividualTrafficSelector{StartAddress: net.ParseIP("10.0.0.5").To4()}
+	err := parseIPAddressInformationToChildSecurityAssociation(childSA, net.ParseIP("2001:db8::5"), tsLocal, tsRemote)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !childSA.LocalPublicIPAddr.Equal(net.ParseIP("2001:db8::1")) || len(childSA.LocalPublicIPAddr) != net.IPv6len {
+		t.Errorf("local outer address mismatch. got = %v, want = 2001:db8::1", childSA.LocalPublicIPAddr)
+	}
+	if !childSA.PeerPublicIPAddr.Equal(net.ParseIP("2001:db8::5")) || len(childSA.PeerPublicIPAddr) != net.IPv6len {
+		t.Errorf("peer outer address mismatch. got = %v, want = 2001:db8::5", childSA.PeerPublicIPAddr)
+	}
+	if childSA.TrafficSelectorLocal.String() != "10.0.0.1/32" {
+		t.Errorf("local TS mismatch. got = %v, want = 10.0.0.1/32", &childSA.TrafficSelectorLocal)
+	}
+	if childSA.TrafficSelectorRemote.String() != "10.0.0.5/32" {
+		t.Errorf("remote TS mismatch. got = %v, want = 10.0.0.5/32", &childSA.TrafficSelectorRemote)
+	}
+
+	n3iwfCtx.IkeBindAddress = "invalid"
+	err = parseIPAddressInformationToChildSecurityAssociation(childSA, net.ParseIP("2001:db8::5"), tsLocal, tsRemote)
+	if err == nil {
+		t.Errorf("Expected error but got none")
+	}
+}
+
+func TestHandleIKEAUTHUnexpectedEAPType(t *testing.T) {
+	n3iwfConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer n3iwfConn.Close()
+	ueConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+	n3iwfAddr := n3iwfConn.LocalAddr().(*net.UDPAddr)
+	ueAddr := ueConn.LocalAddr().(*net.UDPAddr)
+
+	testcases := []struct {
+		description string
+		eap         *message.EAP
+		expAnswer   bool
+		expErr      error
+	}{
+		{
+			description: "response to an earlier request is dropped",
+			eap:         newEAP5GResponse(message.EAPCodeResponse, 6),
+		},
+		{
+			description: "identity response mid-authentication",
+			eap:         newEAPIdentityResponse(message.EAPCodeResponse, 7),
+			expAnswer:   true,
+			expErr:      ErrUnexpectedEAPType,
+		},
+		{
+			description: "5G-Notification response",
+			eap:         newEAP5GMessage(message.EAPCodeResponse, 7, message.EAP5GType5GNotification),
+			expAnswer:   true,
+			expErr:      ErrUnexpectedEAP5GMessage,
+		},
+		{
+			description: "unrecognized EAP-5G message ID",
+			eap:         newEAP5GMessage(message.EAPCodeResponse, 7, 0x7f),
+			expAnswer:   true,
+			expErr:      ErrUnexpectedEAP5GMessage,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeSA := &context.IKESecurityAssociation{
+				IKESAKey:  newTestIKESAKey(t),
+				RemoteSPI: 0x1111,
+				LocalSPI:  0x2222,
+				State:     EAPSignalling,
+				EAP:       *newEAPSession(),
+			}
+			payloads := message.IKEPayloadContainer{tc.eap}
+			ikeMsg := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.IKE_AUTH, false, true, 4, payloads)
+			err := handleIKEAUTH(n3iwfConn, n3iwfAddr, ueAddr, ikeMsg, ikeSA)
+			if tc.expAnswer && !errors.Is(err, tc.expErr) {
+				t.Errorf("error mismatch. got = %v, want = %v", err, tc.expErr)
+			}
+			if !tc.expAnswer && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if err = ueConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			_, _, err = ueConn.ReadFromUDP(make([]byte, 1500))
+			if tc.expAnswer && err != nil {
+				t.Errorf("EAP Failure not received: %v", err)
+			}
+			if !tc.expAnswer && err == nil {
+				t.Errorf("Unexpected answer to a stale EAP response")
+			}
+			if ikeSA.State != EAPSignalling {
+				t.Errorf("State mismatch. got = %d, want = %d", ikeSA.State, EAPSignalling)
+			}
+		})
+	}
+}
+
+func TestHandleIKEAUTHIdentityFirst(t *testing.T) {
+	n3iwfConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer n3iwfConn.Close()
+	ueConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+	n3iwfAddr := n3iwfConn.LocalAddr().(*net.UDPAddr)
+	ueAddr := ueConn.LocalAddr().(*net.UDPAddr)
+
+	ikeSA := &context.IKESecurityAssociation{
+		IKESAKey:  newTestIKESAKey(t),
+		RemoteSPI: 0x1111,
+		LocalSPI:  0x2222,
+		State:     EAPSignalling,
+		EAP: context.EAPSession{
+			Method:     message.EAPTypeExpanded,
+			Identifier: 7,
+			MessageID:  message.EAP5GType5GStart,
+			Rounds:     1,
+		},
+	}
+	receive := func() *message.IKEMessage {
+		t.Helper()
+		if err := ueConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		buf := make([]byte, 1500)
+		n, _, err := ueConn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("IKE_AUTH response not received: %v", err)
+		}
+		rsp, err := DecodeDecrypt(buf[:n], nil, ikeSA.IKESAKey, message.Role_Initiator)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return rsp
+	}
+
+	// The UE answers the 5G-Start with its identity
+	payloads := message.IKEPayloadContainer{newEAPIdentityResponse(message.EAPCodeResponse, 7)}
+	ikeMsg := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.IKE_AUTH, false, true, 2, payloads)
+	if err = handleIKEAUTH(n3iwfConn, n3iwfAddr, ueAddr, ikeMsg, ikeSA); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ikeSA.EAP.Identity != "ue" {
+		t.Errorf("EAP identity mismatch. got = %q, want = %q", ikeSA.EAP.Identity, "ue")
+	}
+	rsp := receive()
+	eap, ok := rsp.Payloads[0].(*message.EAP)
+	if !ok || eap.Code != message.EAPCodeRequest || eap.Identifier != 8 {
+		t.Fatalf("expected a 5G-Start request of identifier 8, got %+v", rsp.Payloads[0])
+	}
+	if expanded, ok := eap.EAPTypeData[0].(*message.EAPExpanded); !ok ||
+		expanded.VendorData[0] != message.EAP5GType5GStart {
+		t.Errorf("expected a 5G-Start request, got %+v", eap.EAPTypeData[0])
+	}
+	if ikeSA.State != EAPSignalling {
+		t.Errorf("State mismatch. got = %d, want = %d", ikeSA.State, EAPSignalling)
+	}
+
+	// Its identity again ends the authentication
+	payloads = message.IKEPayloadContainer{newEAPIdentityResponse(message.EAPCodeResponse, 8)}
+	ikeMsg = message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.IKE_AUTH, false, true, 3, payloads)
+	if err = handleIKEAUTH(n3iwfConn, n3iwfAddr, ueAddr, ikeMsg, ikeSA); !errors.Is(err, ErrUnexpectedEAPType) {
+		t.Errorf("error mismatch. got = %v, want = %v", err, ErrUnexpectedEAPType)
+	}
+	rsp = receive()
+	if eap, ok := rsp.Payloads[0].(*message.EAP); !ok || eap.Code != message.EAPCodeFailure {
+		t.Errorf("expected an EAP Failure, got %+v", rsp.Payloads[0])
+	}
+}
+
+func TestHandleIKESAINITRejection(t *testing.T) {
+	n3iwfConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer n3iwfConn.Close()
+	ueConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+	n3iwfAddr := n3iwfConn.LocalAddr().(*net.UDPAddr)
+	ueAddr := ueConn.LocalAddr().(*net.UDPAddr)
+
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNonce(make([]byte, 32))
+	ikeMsg := message.NewMessage(0x1111, 0, message.IKE_SA_INIT, false, true, 0, payloads)
+
+	err = handleIKESAINIT(n3iwfConn, n3iwfAddr, ueAddr, ikeMsg, nil)
+	var exchangeErr *ExchangeError
+	if !errors.As(err, &exchangeErr) {
+		t.Fatalf("error mismatch. got = %v, want an ExchangeError", err)
+	}
+	if exchangeErr.Notify != message.NO_PROPOSAL_CHOSEN {
+		t.Errorf("Notify mismatch. got = %d, want = %d", exchangeErr.Notify, message.NO_PROPOSAL_CHOSEN)
+	}
+
+	failures := ExchangeFailures(message.IKE_SA_INIT)
+	HandleIKESAINIT(n3iwfConn, n3iwfAddr, ueAddr, ikeMsg, nil)
+	if got := ExchangeFailures(message.IKE_SA_INIT); got != failures+1 {
+		t.Errorf("failure count mismatch. got = %d, want = %d", got, failures+1)
+	}
+
+	for range 2 {
+		if err = ueConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, _, err = ueConn.ReadFromUDP(make([]byte, 1500)); err != nil {
+			t.Errorf("NO_PROPOSAL_CHOSEN not received: %v", err)
+		}
+	}
+}
+
+func TestHandleIKESAINITCookie(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	cookieSecrets, err := context.NewCookieSecrets(time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	n3iwfCtx.CookieSecrets = cookieSecrets
+	defer func() { n3iwfCtx.CookieSecrets = nil }()
+
+	n3iwfAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 500}
+	ueAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 500}
+	nonce := make([]byte, 32)
+	validCookie, err := cookieSecrets.Cookie(nonce, ueAddr.IP, 0x1111)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	forgedCookie := bytes.Clone(validCookie)
+	forgedCookie[len(forgedCookie)-1] ^= 0xff
+
+	testcases := []struct {
+		description string
+		threshold   int64
+		cookie      []byte
+		expCookie   bool
+	}{
+		{
+			description: "below the threshold",
+			threshold:   1 << 30,
+		},
+		{
+			description: "cookie demanded",
+			expCookie:   true,
+		},
+		{
+			description: "forged cookie",
+			cookie:      forgedCookie,
+			expCookie:   true,
+		},
+		{
+			description: "valid cookie",
+			cookie:      validCookie,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx.CookieThreshold = tc.threshold
+			var payloads message.IKEPayloadContainer
+			if tc.cookie != nil {
+				payloads.BuildNotification(message.TypeNone, message.COOKIE, nil, tc.cookie)
+			}
+			payloads.BuildNonce(nonce)
+			ikeMsg := message.NewMessage(0x1111, 0, message.IKE_SA_INIT, false, true, 0, payloads)
+
+			conn := new(fakeIKEConn)
+			err := handleIKESAINIT(conn, n3iwfAddr, ueAddr, ikeMsg, nil)
+			if tc.expCookie && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// Past the cookie, the request without SA payload is rejected
+			if !tc.expCookie && err == nil {
+				t.Fatalf("Expected error but got none")
+			}
+
+			response := new(message.IKEMessage)
+			if err = response.Decode(conn.next(t).data); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if response.ResponderSPI != 0 || len(response.Payloads) != 1 {
+				t.Fatalf("Unexpected response: %+v", response)
+			}
+			notification, ok := response.Payloads[0].(*message.Notification)
+			if !ok {
+				t.Fatalf("Expected Notification payload, got %T", response.Payloads[0])
+			}
+			if got := notification.NotifyMessageType == message.COOKIE; got != tc.expCookie {
+				t.Fatalf("COOKIE mismatch. got = %d, want COOKIE = %v", notification.NotifyMessageType, tc.expCookie)
+			}
+			if tc.expCookie && !bytes.Equal(notification.NotificationData, validCookie) {
+				t.Errorf("cookie mismatch. got = %x, want = %x", notification.NotificationData, validCookie)
+			}
+		})
+	}
+}
+
+func TestRejectUnsupportedCriticalPayload(t *testing.T) {
+	n3iwfConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer n3iwfConn.Close()
+	ueConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+	n3iwfAddr := n3iwfConn.LocalAddr().(*net.UDPAddr)
+	ueAddr := ueConn.LocalAddr().(*net.UDPAddr)
+
+	ikeSA := &context.IKESecurityAssociation{
+		IKESAKey:  newTestIKESAKey(t),
+		RemoteSPI: 0x1111,
+		LocalSPI:  0x2222,
+	}
+	ikeSA.IkeUE = &context.N3IWFIkeUe{N3IWFIKESecurityAssociation: ikeSA}
+
+	testcases := []struct {
+		description string
+		critical    bool
+		response    bool
+		expAnswer   bool
+	}{
+		{
+			description: "critical payload in a request",
+			critical:    true,
+			expAnswer:   true,
+		},
+		{
+			description: "critical payload in a response",
+			critical:    true,
+			response:    true,
+		},
+		{
+			description: "non critical payload",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			payloads := message.IKEPayloadContainer{&message.UnknownPayload{PayloadType: 200, Critical: tc.critical}}
+			ikeMsg := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.INFORMATIONAL, tc.response, true, 2, payloads)
+			err := handleInformational(n3iwfConn, n3iwfAddr, ueAddr, ikeMsg, ikeSA)
+			if tc.critical && err == nil {
+				t.Errorf("Expected error but got none")
+			}
+			var exchangeErr *ExchangeError
+			if errors.As(err, &exchangeErr) != tc.expAnswer {
+				t.Errorf("answered mismatch. got = %v, want = %v", err, tc.expAnswer)
+			}
+			if !tc.expAnswer {
+				return
+			}
+			if exchangeErr.Notify != message.UNSUPPORTED_CRITICAL_PAYLOAD {
+				t.Errorf("Notify mismatch. got = %d, want = %d", exchangeErr.Notify, message.UNSUPPORTED_CRITICAL_PAYLOAD)
+			}
+
+			if err = ueConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			buf := make([]byte, 1500)
+			n, _, err := ueConn.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("UNSUPPORTED_CRITICAL_PAYLOAD not received: %v", err)
+			}
+			ikeHeader, err := message.ParseHeader(buf[:n])
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			answer, err := DecodeDecrypt(buf[:n], ikeHeader, ikeSA.IKESAKey, message.Role_Initiator)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			notification, ok := answer.Payloads[0].(*message.Notification)
+			if !ok || notification.NotifyMessageType != message.UNSUPPORTED_CRITICAL_PAYLOAD ||
+				!bytes.Equal(notification.NotificationData, []byte{200}) {
+				t.Errorf("Unexpected answer: %+v", answer.Payloads[0])
+			}
+		})
+	}
+}
+
+// cyclicReader endlessly repeats its bytes
+type cyclicReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *cyclicReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.data[r.pos%len(r.data)]
+		r.pos++
+	}
+	return len(p), nil
+}
+
+func TestAllocateChildSAInboundSPI(t *testing.T) {
+	testcases := []struct {
+		description string
+		random      []byte
+		usedSPIs    []uint32
+		expSPI      uint32
+		expErr      error
+	}{
+		{
+			description: "first SPI in use",
+			random:      []byte{0x01, 0x01, 0x01, 0x01, 0x02, 0x02, 0x02, 0x02},
+			usedSPIs:    []uint32{0x01010101},
+			expSPI:      0x02020202,
+		},
+		{
+			description: "saturated SPI space",
+			random:      []byte{0x01, 0x01, 0x01, 0x01, 0x02, 0x02, 0x02, 0x02},
+			usedSPIs:    []uint32{0x01010101, 0x02020202},
+			expErr:      ErrSPIExhausted,
+		},
+		{
+			description: "degraded random source",
+			random:      []byte{0x00},
+			expErr:      ErrSPIExhausted,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			previous := security.SetRandReader(&cyclicReader{data: tc.random})
+			defer security.SetRandReader(previous)
+
+			n3iwfCtx := &context.N3IWFContext{}
+			for _, spi := range tc.usedSPIs {
+				n3iwfCtx.ChildSA.Store(spi, &context.ChildSecurityAssociation{InboundSPI: spi})
+			}
+			spi, err := allocateChildSAInboundSPI(n3iwfCtx)
+			if tc.expErr != nil {
+				if !errors.Is(err, tc.expErr) {
+					t.Errorf("error mismatch. got = %v, want = %v", err, tc.expErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if spi != tc.expSPI {
+				t.Errorf("SPI mismatch. got = 0x%08x, want = 0x%08x", spi, tc.expSPI)
+			}
+		})
+	}
+}
+
+func TestNegotiateSignatureHashAlgorithms(t *testing.T) {
+	testcases := []struct {
+		description       string
+		notifications     []*message.Notification
+		expHashAlgorithms []uint16
+	}{
+		{
+			description: "announced by UE",
+			notifications: []*message.Notification{{
+				NotifyMessageType: message.SIGNATURE_HASH_ALGORITHMS,
+				NotificationData:  []byte{0x00, 0x02, 0x00, 0x04},
+			}},
+			expHashAlgorithms: []uint16{message.HASH_SHA2_256, message.HASH_SHA2_512},
+		},
+		{
+			description: "not announced by UE",
+		},
+		{
+			description: "odd length",
+			notifications: []*message.Notification{{
+				NotifyMessageType: message.SIGNATURE_HASH_ALGORITHMS,
+				NotificationData:  []byte{0x00, 0x02, 0x00},
+			}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeSA := &context.IKESecurityAssociation{}
+			var response message.IKEPayloadContainer
+			negotiateSignatureHashAlgorithms(ikeSA, tc.notifications, &response)
+			if !slices.Equal(ikeSA.SignatureHashAlgorithms, tc.expHashAlgorithms) {
+				t.Errorf("SignatureHashAlgorithms mismatch. got = %v, want = %v",
+					ikeSA.SignatureHashAlgorithms, tc.expHashAlgorithms)
+			}
+			var notifications []*message.Notification
+			for _, payload := range response {
+				if notification, ok := payload.(*message.Notification); ok {
+					notifications = append(notifications, notification)
+				}
+			}
+			notification := findNotification(notifications, message.SIGNATURE_HASH_ALGORITHMS)
+			if tc.expHashAlgorithms == nil {
+				if notification != nil {
+					t.Errorf("Unexpected SIGNATURE_HASH_ALGORITHMS in the response")
+				}
+				return
+			}
+			if notification == nil {
+				t.Fatalf("SIGNATURE_HASH_ALGORITHMS missing from the response")
+			}
+			expData := []byte{0x00, 0x02, 0x00, 0x03, 0x00, 0x04, 0x00, 0x05}
+			if !bytes.Equal(notification.NotificationData, expData) {
+				t.Errorf("notification data mismatch. got = %x, want = %x", notification.NotificationData, expData)
+			}
+		})
+	}
+}
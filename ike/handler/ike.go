@@ -9,12 +9,28 @@ import (
 	"crypto/hmac"
 	"errors"
 	"fmt"
-	"hash"
+	"sync/atomic"
 
 	"github.com/omec-project/n3iwf/ike/message"
 	"github.com/omec-project/n3iwf/ike/security"
 )
 
+var (
+	// ErrIntegrityCheckFailed reports an SK payload whose checksum does not match
+	ErrIntegrityCheckFailed = errors.New("integrity check failed")
+	// ErrInvalidSyntax reports an authenticated SK payload that cannot be decrypted or decoded
+	ErrInvalidSyntax = errors.New("invalid syntax")
+)
+
+// Number of protected IKE messages dropped on integrity check failure
+var integrityCheckFailures atomic.Uint64
+
+// IntegrityCheckFailures returns the number of protected IKE messages dropped
+// because their integrity check failed
+func IntegrityCheckFailures() uint64 {
+	return integrityCheckFailures.Load()
+}
+
 func EncodeEncrypt(ikeMsg *message.IKEMessage, ikesaKey *security.IKESAKey, role message.Role) ([]byte, error) {
 	if ikesaKey != nil {
 		if err := encryptMsg(ikeMsg, ikesaKey, role); err != nil {
@@ -55,33 +71,41 @@ func DecodeDecrypt(msg []byte, ikeHeader *message.IKEHeader, ikesaKey *security.
 	return ikeMsg, nil
 }
 
+// BuildDecryptErrorResponse classifies a DecodeDecrypt error of a protected
+// request. Integrity check failures (attack or key desync) are counted and
+// dropped silently, so nil is returned. A request that passed the integrity
+// check but cannot be decrypted or decoded gets an INVALID_SYNTAX response
+func BuildDecryptErrorResponse(ikeHeader *message.IKEHeader, err error) *message.IKEMessage {
+	if errors.Is(err, ErrIntegrityCheckFailed) {
+		integrityCheckFailures.Add(1)
+		return nil
+	}
+	if ikeHeader == nil || !errors.Is(err, ErrInvalidSyntax) || ikeHeader.Flags&message.ResponseBitCheck != 0 {
+		return nil
+	}
+	var payload message.IKEPayloadContainer
+	payload.BuildNotification(message.TypeNone, message.INVALID_SYNTAX, nil, nil)
+	return message.NewMessage(ikeHeader.InitiatorSPI, ikeHeader.ResponderSPI,
+		ikeHeader.ExchangeType, true, false, ikeHeader.MessageID, payload)
+}
+
 func verifyIntegrity(originData, checksum []byte, ikesaKey *security.IKESAKey, role message.Role) error {
 	expectChecksum, err := calculateIntegrity(ikesaKey, role, originData)
 	if err != nil {
 		return fmt.Errorf("verifyIntegrity[%d]: %w", ikesaKey.IntegInfo.TransformID(), err)
 	}
 	if !hmac.Equal(checksum, expectChecksum) {
-		return errors.New("invalid checksum")
+		return fmt.Errorf("invalid checksum: %w", ErrIntegrityCheckFailed)
 	}
 	return nil
 }
 
 func calculateIntegrity(ikesaKey *security.IKESAKey, role message.Role, originData []byte) ([]byte, error) {
-	outputLen := ikesaKey.IntegInfo.GetOutputLength()
-	var mac hash.Hash
-	if role == message.Role_Initiator {
-		mac = ikesaKey.Integ_i
-	} else {
-		mac = ikesaKey.Integ_r
-	}
-	if mac == nil {
-		return nil, errors.New("CalcIKEChecksum(): integrity key is nil")
-	}
-	mac.Reset()
-	if _, err := mac.Write(originData); err != nil {
+	checksum, err := ikesaKey.Integrity(role, originData)
+	if err != nil {
 		return nil, fmt.Errorf("CalcIKEChecksum(): %w", err)
 	}
-	return mac.Sum(nil)[:outputLen], nil
+	return checksum, nil
 }
 
 func encryptPayload(plainText []byte, ikesaKey *security.IKESAKey, role message.Role) ([]byte, error) {
@@ -107,7 +131,10 @@ func decryptMsg(msg []byte, ikeMsg *message.IKEMessage, ikesaKey *security.IKESA
 	var encryptedPayload *message.Encrypted
 	for _, ikePayload := range ikeMsg.Payloads {
 		if ikePayload.Type() == message.TypeSK {
-			encryptedPayload = ikePayload.(*message.Encrypted)
+			var ok bool
+			if encryptedPayload, ok = ikePayload.(*message.Encrypted); !ok {
+				return nil, fmt.Errorf("decryptMsg(): SK payload decoded as %T", ikePayload)
+			}
 			break
 		}
 	}
@@ -127,12 +154,12 @@ func decryptMsg(msg []byte, ikeMsg *message.IKEMessage, ikesaKey *security.IKESA
 
 	plainText, err := decryptPayload(encryptedPayload.EncryptedData[:dataLen-checksumLength], ikesaKey, role)
 	if err != nil {
-		return nil, fmt.Errorf("decryptMsg(): Error decrypting message: %w", err)
+		return nil, fmt.Errorf("decryptMsg(): Error decrypting message: %w: %w", ErrInvalidSyntax, err)
 	}
 
 	var decryptedPayloads message.IKEPayloadContainer
 	if err := decryptedPayloads.Decode(encryptedPayload.NextPayload, plainText); err != nil {
-		return nil, fmt.Errorf("decryptMsg(): Decoding decrypted payload failed: %w", err)
+		return nil, fmt.Errorf("decryptMsg(): Decoding decrypted payload failed: %w: %w", ErrInvalidSyntax, err)
 	}
 	ikeMsg.Payloads.Reset()
 	ikeMsg.Payloads = append(ikeMsg.Payloads, decryptedPayloads...)
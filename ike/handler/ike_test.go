@@ -0,0 +1,247 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+)
+
+func newTestIKESAKey(t testing.TB) *security.IKESAKey {
+	t.Helper()
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	proposal := new(message.Proposal)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA1, nil, nil, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+
+	ikesaKey, _, err := security.NewIKESAKey(proposal, bytes.Repeat([]byte{0x5a}, 256),
+		bytes.Repeat([]byte{0x01}, 32), 0x1111, 0x2222)
+	if err != nil {
+		t.Fatalf("NewIKESAKey failed: %v", err)
+	}
+	return ikesaKey
+}
+
+// craftEncryptedMsg encrypts plainText as the UE would, so the N3IWF can
+// verify and decrypt it as responder
+func craftEncryptedMsg(t testing.TB, ikesaKey *security.IKESAKey, nextPayload message.IKEPayloadType, plainText []byte) []byte {
+	t.Helper()
+	cipherText, err := encryptPayload(plainText, ikesaKey, message.Role_Initiator)
+	if err != nil {
+		t.Fatalf("encryptPayload failed: %v", err)
+	}
+	checksumLength := ikesaKey.IntegInfo.GetOutputLength()
+	encryptedData := append(cipherText, make([]byte, checksumLength)...)
+
+	ikeMsg := message.NewMessage(0x1111, 0x2222, message.INFORMATIONAL, false, true, 3, nil)
+	ikeMsg.Payloads.BuildEncrypted(nextPayload, encryptedData)
+	msg, err := ikeMsg.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	checksum, err := calculateIntegrity(ikesaKey, message.Role_Initiator, msg[:len(msg)-checksumLength])
+	if err != nil {
+		t.Fatalf("calculateIntegrity failed: %v", err)
+	}
+	copy(msg[len(msg)-checksumLength:], checksum)
+	return msg
+}
+
+func TestDecodeDecryptFailures(t *testing.T) {
+	ikesaKey := newTestIKESAKey(t)
+
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, message.INITIAL_CONTACT, nil, nil)
+	validPlainText, err := payloads.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	var oversizedPayloads message.IKEPayloadContainer
+	oversizedConfiguration := oversizedPayloads.BuildConfiguration(message.CFG_REQUEST)
+	for range message.DefaultMaxConfigurationAttributes + 1 {
+		oversizedConfiguration.ConfigurationAttribute.BuildConfigurationAttribute(message.INTERNAL_IP4_DNS, nil)
+	}
+	oversizedPlainText, err := oversizedPayloads.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	testcases := []struct {
+		description  string
+		msg          func() []byte
+		expectedErr  error
+		expectNotify bool
+	}{
+		{
+			description: "valid message",
+			msg: func() []byte {
+				return craftEncryptedMsg(t, ikesaKey, message.TypeN, validPlainText)
+			},
+		},
+		{
+			description: "tampered checksum is dropped silently",
+			msg: func() []byte {
+				msg := craftEncryptedMsg(t, ikesaKey, message.TypeN, validPlainText)
+				msg[len(msg)-1] ^= 0xff
+				return msg
+			},
+			expectedErr: ErrIntegrityCheckFailed,
+		},
+		{
+			description: "tampered cipher text is dropped silently",
+			msg: func() []byte {
+				msg := craftEncryptedMsg(t, ikesaKey, message.TypeN, validPlainText)
+				msg[message.IKE_HEADER_LEN+8] ^= 0xff
+				return msg
+			},
+			expectedErr: ErrIntegrityCheckFailed,
+		},
+		{
+			description: "authenticated but undecodable payload gets INVALID_SYNTAX",
+			msg: func() []byte {
+				// Notify payload header claiming more data than present
+				return craftEncryptedMsg(t, ikesaKey, message.TypeN, []byte{0x00, 0x00, 0x00, 0xff, 0x00, 0x00})
+			},
+			expectedErr:  ErrInvalidSyntax,
+			expectNotify: true,
+		},
+		{
+			description: "oversized configuration payload gets INVALID_SYNTAX",
+			msg: func() []byte {
+				return craftEncryptedMsg(t, ikesaKey, message.TypeCP, oversizedPlainText)
+			},
+			expectedErr:  message.ErrTooManyConfigurationAttributes,
+			expectNotify: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			msg := tc.msg()
+			ikeHeader, err := message.ParseHeader(msg)
+			if err != nil {
+				t.Fatalf("ParseHeader failed: %v", err)
+			}
+			failuresBefore := IntegrityCheckFailures()
+
+			_, err = DecodeDecrypt(msg, ikeHeader, ikesaKey, message.Role_Responder)
+			if tc.expectedErr == nil {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("error mismatch. got = %v, want = %v", err, tc.expectedErr)
+			}
+
+			rsp := BuildDecryptErrorResponse(ikeHeader, err)
+			if !tc.expectNotify {
+				if rsp != nil {
+					t.Error("Expected no response for an integrity check failure")
+				}
+				if got := IntegrityCheckFailures(); got != failuresBefore+1 {
+					t.Errorf("integrity check failures mismatch. got = %d, want = %d", got, failuresBefore+1)
+				}
+				return
+			}
+			if rsp == nil {
+				t.Fatal("Expected an INVALID_SYNTAX response but got none")
+			}
+			if rsp.ExchangeType != ikeHeader.ExchangeType || rsp.MessageID != ikeHeader.MessageID ||
+				rsp.Flags&message.ResponseBitCheck == 0 {
+				t.Errorf("response header mismatch: %+v", rsp.IKEHeader)
+			}
+			if len(rsp.Payloads) != 1 {
+				t.Fatalf("response payload count mismatch. got = %d, want = 1", len(rsp.Payloads))
+			}
+			notification, ok := rsp.Payloads[0].(*message.Notification)
+			if !ok || notification.NotifyMessageType != message.INVALID_SYNTAX {
+				t.Errorf("Expected INVALID_SYNTAX notification, got %+v", rsp.Payloads[0])
+			}
+			if got := IntegrityCheckFailures(); got != failuresBefore {
+				t.Errorf("integrity check failures mismatch. got = %d, want = %d", got, failuresBefore)
+			}
+		})
+	}
+}
+
+// FuzzDecodeDecrypt feeds arbitrary plain texts through the decryption path,
+// encrypted and authenticated as the UE would so they reach the decoder
+func FuzzDecodeDecrypt(f *testing.F) {
+	ikesaKey := newTestIKESAKey(f)
+
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, message.INITIAL_CONTACT, nil, nil)
+	payloads.BuildNonce(bytes.Repeat([]byte{0x01}, 16))
+	eap := payloads.BuildEAP(message.EAPCodeResponse, 1)
+	eap.EAPTypeData.BuildEAPExpanded(message.VendorID3GPP, message.VendorTypeEAP5G,
+		[]byte{message.EAP5GType5GNAS, message.EAP5GSpareValue})
+	plainText, err := payloads.Encode()
+	if err != nil {
+		f.Fatalf("Encode failed: %v", err)
+	}
+	f.Add(uint8(message.TypeN), plainText)
+	f.Add(uint8(message.TypeN), []byte{0x00, 0x00, 0x00, 0xff, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, nextPayload uint8, plainText []byte) {
+		msg := craftEncryptedMsg(t, ikesaKey, message.IKEPayloadType(nextPayload), plainText)
+		ikeHeader, err := message.ParseHeader(msg)
+		if err != nil {
+			t.Fatalf("ParseHeader failed: %v", err)
+		}
+		_, err = DecodeDecrypt(msg, ikeHeader, ikesaKey, message.Role_Responder)
+		if errors.Is(err, ErrIntegrityCheckFailed) {
+			t.Errorf("Unexpected integrity check failure: %v", err)
+		}
+	})
+}
+
+func newBenchmarkPayloads(b *testing.B) message.IKEPayloadContainer {
+	b.Helper()
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, message.INITIAL_CONTACT, nil, nil)
+	payloads.BuildNonce(bytes.Repeat([]byte{0x01}, 32))
+	eap := payloads.BuildEAP(message.EAPCodeResponse, 1)
+	eap.EAPTypeData.BuildEAPExpanded(message.VendorID3GPP, message.VendorTypeEAP5G,
+		append([]byte{message.EAP5GType5GNAS, message.EAP5GSpareValue}, bytes.Repeat([]byte{0x7e}, 256)...))
+	return payloads
+}
+
+func BenchmarkEncodeEncrypt(b *testing.B) {
+	ikesaKey := newTestIKESAKey(b)
+	payloads := newBenchmarkPayloads(b)
+	b.ReportAllocs()
+	for b.Loop() {
+		ikeMsg := message.NewMessage(0x1111, 0x2222, message.INFORMATIONAL, true, false, 3, payloads)
+		if _, err := EncodeEncrypt(ikeMsg, ikesaKey, message.Role_Responder); err != nil {
+			b.Fatalf("EncodeEncrypt failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkDecodeDecrypt(b *testing.B) {
+	ikesaKey := newTestIKESAKey(b)
+	payloads := newBenchmarkPayloads(b)
+	plainText, err := payloads.Encode()
+	if err != nil {
+		b.Fatalf("Encode failed: %v", err)
+	}
+	msg := craftEncryptedMsg(b, ikesaKey, message.TypeN, plainText)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := DecodeDecrypt(msg, nil, ikesaKey, message.Role_Responder); err != nil {
+			b.Fatalf("DecodeDecrypt failed: %v", err)
+		}
+	}
+}
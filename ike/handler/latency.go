@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+)
+
+// Outcomes of the IKE SA establishment of a UE
+const (
+	EstablishmentSuccess     = "success"     // IKE_AUTH completed with the signalling child SA
+	EstablishmentEAPFailure  = "eapFailure"  // EAP-5G ended with an EAP Failure
+	EstablishmentAuthFailure = "authFailure" // AUTHENTICATION_FAILED after EAP-5G or a rejected certificate
+	EstablishmentTimeout     = "timeout"     // Half-open IKE SA reaped
+)
+
+// EstablishmentOutcomes lists the outcomes of EstablishmentLatency
+var EstablishmentOutcomes = []string{
+	EstablishmentSuccess, EstablishmentEAPFailure, EstablishmentAuthFailure, EstablishmentTimeout,
+}
+
+// Upper bounds of the establishment latency buckets, the last bucket being
+// unbounded. Most of the time is spent in the EAP-5G round trips to the AMF
+var establishmentLatencyBounds = []time.Duration{
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+var establishmentLatency = func() map[string]*latencyHistogram {
+	histograms := make(map[string]*latencyHistogram)
+	for _, outcome := range EstablishmentOutcomes {
+		histograms[outcome] = newLatencyHistogram(establishmentLatencyBounds)
+	}
+	return histograms
+}()
+
+// latencyHistogram counts durations in buckets of fixed upper bounds
+type latencyHistogram struct {
+	bounds  []time.Duration
+	buckets []atomic.Uint64 // One per bound, then the unbounded one
+	sum     atomic.Int64    // Nanoseconds
+}
+
+func newLatencyHistogram(bounds []time.Duration) *latencyHistogram {
+	return &latencyHistogram{
+		bounds:  bounds,
+		buckets: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// LatencyHistogram is a snapshot of a latency histogram. As in Prometheus,
+// the buckets are cumulative, the last one counting every observation
+type LatencyHistogram struct {
+	Buckets    []LatencyBucket `json:"buckets"`
+	Count      uint64          `json:"count"`
+	SumSeconds float64         `json:"sumSeconds"`
+}
+
+// LatencyBucket counts the observations up to LE, "+Inf" for the last bucket
+type LatencyBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	var snapshot LatencyHistogram
+	for i := range h.buckets {
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = h.bounds[i].String()
+		}
+		snapshot.Count += h.buckets[i].Load()
+		snapshot.Buckets = append(snapshot.Buckets, LatencyBucket{LE: le, Count: snapshot.Count})
+	}
+	snapshot.SumSeconds = time.Duration(h.sum.Load()).Seconds()
+	return snapshot
+}
+
+// EstablishmentLatency returns the histogram of the time from the IKE_SA_INIT
+// of the UEs to the outcome of their authentication
+func EstablishmentLatency(outcome string) LatencyHistogram {
+	if histogram, ok := establishmentLatency[outcome]; ok {
+		return histogram.snapshot()
+	}
+	return LatencyHistogram{}
+}
+
+// observeEstablishment records the establishment latency of the IKE SA with
+// outcome, once per IKE SA
+func observeEstablishment(ikeSecurityAssociation *context.IKESecurityAssociation, outcome string) {
+	if ikeSecurityAssociation.EstablishmentStart.IsZero() {
+		return
+	}
+	establishmentLatency[outcome].observe(time.Since(ikeSecurityAssociation.EstablishmentStart))
+	ikeSecurityAssociation.EstablishmentStart = time.Time{}
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	histogram := newLatencyHistogram([]time.Duration{time.Second, 5 * time.Second})
+	for _, d := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, time.Minute} {
+		histogram.observe(d)
+	}
+	snapshot := histogram.snapshot()
+	expBuckets := []LatencyBucket{{LE: "1s", Count: 2}, {LE: "5s", Count: 3}, {LE: "+Inf", Count: 4}}
+	if len(snapshot.Buckets) != len(expBuckets) {
+		t.Fatalf("bucket count mismatch. got = %d, want = %d", len(snapshot.Buckets), len(expBuckets))
+	}
+	for i := range expBuckets {
+		if snapshot.Buckets[i] != expBuckets[i] {
+			t.Errorf("bucket mismatch. got = %+v, want = %+v", snapshot.Buckets[i], expBuckets[i])
+		}
+	}
+	if snapshot.Count != 4 {
+		t.Errorf("count mismatch. got = %d, want = 4", snapshot.Count)
+	}
+	if snapshot.SumSeconds != 63.5 {
+		t.Errorf("sum mismatch. got = %v, want = 63.5", snapshot.SumSeconds)
+	}
+}
+
+func TestObserveEstablishment(t *testing.T) {
+	ikeSA := &context.IKESecurityAssociation{EstablishmentStart: time.Now().Add(-200 * time.Millisecond)}
+	before := EstablishmentLatency(EstablishmentAuthFailure).Count
+	observeEstablishment(ikeSA, EstablishmentAuthFailure)
+	// Once recorded, later outcomes of the same IKE SA are not counted
+	observeEstablishment(ikeSA, EstablishmentAuthFailure)
+	if count := EstablishmentLatency(EstablishmentAuthFailure).Count; count != before+1 {
+		t.Errorf("count mismatch. got = %d, want = %d", count, before+1)
+	}
+	if !ikeSA.EstablishmentStart.IsZero() {
+		t.Errorf("EstablishmentStart not cleared: %v", ikeSA.EstablishmentStart)
+	}
+}
@@ -0,0 +1,254 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/ike/xfrm"
+)
+
+// Moves the XFRM states of a child SA to new outer addresses, replaced in tests
+var updateXFRMPeerAddress = xfrm.UpdateXFRMPeerAddress
+
+// RFC 4555 section 3.5: COOKIE2 is 8 to 64 octets long
+const cookie2Length = 16
+
+// negotiateMOBIKE records MOBIKE support when both the UE and the N3IWF
+// announce it and adds MOBIKE_SUPPORTED to the response
+func negotiateMOBIKE(n3iwfCtx *context.N3IWFContext, ikeSecurityAssociation *context.IKESecurityAssociation,
+	notifications []*message.Notification, responseIKEPayload *message.IKEPayloadContainer,
+) {
+	if !n3iwfCtx.EnableMOBIKE || ikeSecurityAssociation.MobikeSupported ||
+		findNotification(notifications, message.MOBIKE_SUPPORTED) == nil {
+		return
+	}
+	ikeSecurityAssociation.Log().Debugln("MOBIKE supported by UE")
+	ikeSecurityAssociation.MobikeSupported = true
+	responseIKEPayload.BuildNotification(message.TypeNone, message.MOBIKE_SUPPORTED, nil, nil)
+}
+
+// validateMobikeAddress checks that a new UE outer address, IPv4 or IPv6, can
+// carry IKE and ESP
+func validateMobikeAddress(addr *net.UDPAddr) error {
+	if addr == nil || addr.IP.To16() == nil {
+		return errors.New("validateMobikeAddress: not an IP address")
+	}
+	if addr.IP.IsUnspecified() || addr.IP.IsMulticast() || addr.IP.Equal(net.IPv4bcast) {
+		return fmt.Errorf("validateMobikeAddress: invalid address %s", addr.IP)
+	}
+	if addr.Port == 0 {
+		return errors.New("validateMobikeAddress: invalid port 0")
+	}
+	return nil
+}
+
+// handleUpdateSAAddresses processes an UPDATE_SA_ADDRESSES request received
+// from ueAddr on n3iwfAddr and adds the NAT detection answer to the response.
+// When the addresses changed, it returns the update to apply once the UE
+// passes the return routability check
+func handleUpdateSAAddresses(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation,
+	notifications []*message.Notification, responseIKEPayload *message.IKEPayloadContainer,
+) (*context.MobikeAddressUpdate, error) {
+	if !ikeSecurityAssociation.MobikeSupported {
+		return nil, errors.New("handleUpdateSAAddresses: MOBIKE not negotiated")
+	}
+	if err := validateMobikeAddress(ueAddr); err != nil {
+		return nil, fmt.Errorf("handleUpdateSAAddresses: %w", err)
+	}
+
+	ueBehindNAT, n3iwfBehindNAT, err := handleNATDetect(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
+		notifications, ueAddr, n3iwfAddr)
+	if err != nil {
+		return nil, fmt.Errorf("handleUpdateSAAddresses: %w", err)
+	}
+	if findNotification(notifications, message.NAT_DETECTION_SOURCE_IP) != nil {
+		if err = buildNATDetectNotifPayload(ikeSecurityAssociation, responseIKEPayload, ueAddr, n3iwfAddr); err != nil {
+			return nil, fmt.Errorf("handleUpdateSAAddresses: %w", err)
+		}
+	}
+
+	ikeConnection := ikeSecurityAssociation.IKEConnection
+	if sameIKEAddresses(ikeConnection, n3iwfAddr, ueAddr) {
+		ikeSecurityAssociation.Log().Debugln("UPDATE_SA_ADDRESSES without address change")
+		return nil, nil
+	}
+
+	update, err := newAddressUpdate(ikeSecurityAssociation, udpConn, n3iwfAddr, ueAddr, ueBehindNAT, n3iwfBehindNAT)
+	if err != nil {
+		return nil, fmt.Errorf("handleUpdateSAAddresses: %w", err)
+	}
+	ikeSecurityAssociation.Log().Infof("UE moves from %s to %s", ikeConnection.UEAddr, ueAddr)
+	return update, nil
+}
+
+// checkNATRebinding handles a request of an IKE SA without MOBIKE received
+// from ueAddr on n3iwfAddr when the return routability check is enabled. When
+// the addresses differ from those of the SA, as a NAT in front of the UE
+// rebound its mapping, it returns the update to apply once the UE echoes a
+// COOKIE2 from the new address.
+//
+// Following the source address of any authenticated message (RFC 7296 section
+// 2.23) lets an attacker who captured a message of the UE replay it with a
+// spoofed source, redirecting the IKE and ESP traffic of the UE to a host of
+// its choice. Without an echo, the UE keeps its address
+func checkNATRebinding(n3iwfCtx *context.N3IWFContext, udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeSecurityAssociation *context.IKESecurityAssociation,
+) (*context.MobikeAddressUpdate, error) {
+	ikeConnection := ikeSecurityAssociation.IKEConnection
+	if !n3iwfCtx.ReturnRoutabilityCheck || ikeSecurityAssociation.MobikeSupported || ikeConnection == nil ||
+		sameIKEAddresses(ikeConnection, n3iwfAddr, ueAddr) {
+		return nil, nil
+	}
+	if pending := ikeSecurityAssociation.PendingAddressUpdate; pending != nil &&
+		sameIKEAddresses(&context.UDPSocketInfo{N3IWFAddr: pending.N3IWFAddr, UEAddr: pending.UEAddr}, n3iwfAddr, ueAddr) {
+		return nil, nil
+	}
+	// Only a NAT in front of the UE may change its address without MOBIKE
+	if !ikeSecurityAssociation.UeBehindNAT {
+		return nil, fmt.Errorf("checkNATRebinding: UE not behind a NAT moved from %s to %s, address kept",
+			ikeConnection.UEAddr, ueAddr)
+	}
+	if (ueAddr.IP.To4() == nil) != (ikeConnection.UEAddr.IP.To4() == nil) {
+		return nil, fmt.Errorf("checkNATRebinding: UE moved from %s to %s of another family, address kept",
+			ikeConnection.UEAddr, ueAddr)
+	}
+
+	update, err := newAddressUpdate(ikeSecurityAssociation, udpConn, n3iwfAddr, ueAddr,
+		ikeSecurityAssociation.UeBehindNAT, ikeSecurityAssociation.N3iwfBehindNAT)
+	if err != nil {
+		return nil, fmt.Errorf("checkNATRebinding: %w", err)
+	}
+	ikeSecurityAssociation.Log().Infof("UE seen at %s instead of %s, checking return routability",
+		ueAddr, ikeConnection.UEAddr)
+	return update, nil
+}
+
+// sameIKEAddresses reports whether n3iwfAddr and ueAddr are the addresses of ikeConnection
+func sameIKEAddresses(ikeConnection *context.UDPSocketInfo, n3iwfAddr, ueAddr *net.UDPAddr) bool {
+	return ikeConnection.UEAddr.IP.Equal(ueAddr.IP) && ikeConnection.UEAddr.Port == ueAddr.Port &&
+		ikeConnection.N3IWFAddr.IP.Equal(n3iwfAddr.IP) && ikeConnection.N3IWFAddr.Port == n3iwfAddr.Port
+}
+
+// newAddressUpdate returns the update moving the IKE SA to n3iwfAddr and
+// ueAddr, with a fresh COOKIE2 for its return routability check
+func newAddressUpdate(ikeSecurityAssociation *context.IKESecurityAssociation, udpConn context.IKEConn,
+	n3iwfAddr, ueAddr *net.UDPAddr, ueBehindNAT, n3iwfBehindNAT bool,
+) (*context.MobikeAddressUpdate, error) {
+	cookie2 := make([]byte, cookie2Length)
+	if err := security.ReadRandom(cookie2); err != nil {
+		return nil, err
+	}
+	return &context.MobikeAddressUpdate{
+		Cookie2:        cookie2,
+		Conn:           udpConn,
+		N3IWFAddr:      n3iwfAddr,
+		UEAddr:         ueAddr,
+		UeBehindNAT:    ueBehindNAT,
+		N3iwfBehindNAT: n3iwfBehindNAT,
+	}, nil
+}
+
+// sendReturnRoutabilityCheck sends the COOKIE2 check of RFC 4555 section 3.5
+// to the new UE address, so a spoofed UPDATE_SA_ADDRESSES cannot redirect
+// traffic. The check waits for the pending request of the N3IWF, if any, and
+// is retransmitted until answered. Left unanswered, the update is dropped
+// without taking the message ID, which the UE at its old address never saw
+func sendReturnRoutabilityCheck(ikeSecurityAssociation *context.IKESecurityAssociation,
+	update *context.MobikeAddressUpdate,
+) {
+	if n3iwfRequestPending(ikeSecurityAssociation) {
+		queueN3IWFRequest(ikeSecurityAssociation, func() {
+			sendReturnRoutabilityCheck(ikeSecurityAssociation, update)
+		})
+		return
+	}
+	update.MessageID = ikeSecurityAssociation.ResponderMessageID
+	var checkPayload message.IKEPayloadContainer
+	checkPayload.BuildNotification(message.TypeNone, message.COOKIE2, nil, update.Cookie2)
+	send := func() {
+		SendUEInformationExchange(ikeSecurityAssociation, ikeSecurityAssociation.IKESAKey,
+			&checkPayload, false, false, update.MessageID, update.Conn, update.UEAddr, update.N3IWFAddr)
+	}
+	update.Retransmit = context.NewRetransmitTimer(ikeSecurityAssociation, deleteRetransmitInterval,
+		deleteMaxRetransmissions, send, func() {
+			ikeSecurityAssociation.Log().Warnf("return routability check %d of %s unanswered, address kept",
+				update.MessageID, update.UEAddr)
+			ikeSecurityAssociation.PendingAddressUpdate = nil
+			if ikeUe := ikeSecurityAssociation.IkeUE; ikeUe != nil {
+				sendQueuedRequests(ikeUe)
+			}
+		})
+	ikeSecurityAssociation.PendingAddressUpdate = update
+	send()
+}
+
+// handleReturnRoutabilityResponse applies the pending address update once the
+// UE echoed its COOKIE2 from the new address
+func handleReturnRoutabilityResponse(ueAddr *net.UDPAddr, ikeMsg *message.IKEMessage,
+	ikeSecurityAssociation *context.IKESecurityAssociation, notifications []*message.Notification,
+) error {
+	update := ikeSecurityAssociation.PendingAddressUpdate
+	if update == nil || ikeMsg.MessageID != update.MessageID {
+		return nil
+	}
+	update.Retransmit.Stop()
+	ikeSecurityAssociation.PendingAddressUpdate = nil
+
+	cookie2 := findNotification(notifications, message.COOKIE2)
+	if cookie2 == nil || !bytes.Equal(cookie2.NotificationData, update.Cookie2) {
+		return errors.New("handleReturnRoutabilityResponse: COOKIE2 mismatch, address update dropped")
+	}
+	if !ueAddr.IP.Equal(update.UEAddr.IP) || ueAddr.Port != update.UEAddr.Port {
+		return fmt.Errorf("handleReturnRoutabilityResponse: answer from %s instead of %s", ueAddr, update.UEAddr)
+	}
+	if err := applyMobikeAddressUpdate(ikeSecurityAssociation, update); err != nil {
+		return fmt.Errorf("handleReturnRoutabilityResponse: %w", err)
+	}
+	return nil
+}
+
+// applyMobikeAddressUpdate switches the IKE SA and every child SA of the UE to
+// the addresses of update
+func applyMobikeAddressUpdate(ikeSecurityAssociation *context.IKESecurityAssociation,
+	update *context.MobikeAddressUpdate,
+) error {
+	ikeConnection := ikeSecurityAssociation.IKEConnection
+	ikeConnection.Conn = update.Conn
+	ikeConnection.N3IWFAddr = update.N3IWFAddr
+	ikeConnection.UEAddr = update.UEAddr
+	ikeSecurityAssociation.UeBehindNAT = update.UeBehindNAT
+	ikeSecurityAssociation.N3iwfBehindNAT = update.N3iwfBehindNAT
+
+	ikeUe := ikeSecurityAssociation.IkeUE
+	if ikeUe == nil {
+		return nil
+	}
+	enableEncapsulate := update.UeBehindNAT || update.N3iwfBehindNAT
+	var errs []error
+	for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+		var n3iwfPort, natPort int
+		if enableEncapsulate {
+			n3iwfPort, natPort = update.N3IWFAddr.Port, update.UEAddr.Port
+		}
+		if err := updateXFRMPeerAddress(childSA, update.UEAddr.IP, update.N3IWFAddr.IP,
+			enableEncapsulate, n3iwfPort, natPort); err != nil {
+			errs = append(errs, err)
+		}
+		ikeUe.N3iwfCtx.IndexOutboundSPI(childSA)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("applyMobikeAddressUpdate: %w", err)
+	}
+	ikeSecurityAssociation.Log().Infof("UE now reachable at %s", update.UEAddr)
+	return nil
+}
@@ -0,0 +1,408 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestValidateMobikeAddress(t *testing.T) {
+	testcases := []struct {
+		description string
+		addr        *net.UDPAddr
+		expErr      bool
+	}{
+		{
+			description: "valid address",
+			addr:        &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 4500},
+		},
+		{
+			description: "nil address",
+			expErr:      true,
+		},
+		{
+			description: "IPv6 address",
+			addr:        &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4500},
+		},
+		{
+			description: "unspecified IPv6 address",
+			addr:        &net.UDPAddr{IP: net.IPv6unspecified, Port: 4500},
+			expErr:      true,
+		},
+		{
+			description: "unspecified address",
+			addr:        &net.UDPAddr{IP: net.IPv4zero, Port: 4500},
+			expErr:      true,
+		},
+		{
+			description: "multicast address",
+			addr:        &net.UDPAddr{IP: net.ParseIP("224.0.0.1"), Port: 4500},
+			expErr:      true,
+		},
+		{
+			description: "broadcast address",
+			addr:        &net.UDPAddr{IP: net.IPv4bcast, Port: 4500},
+			expErr:      true,
+		},
+		{
+			description: "port 0",
+			addr:        &net.UDPAddr{IP: net.ParseIP("192.168.1.10")},
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := validateMobikeAddress(tc.addr)
+			if tc.expErr && err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !tc.expErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNegotiateMOBIKE(t *testing.T) {
+	supported := []*message.Notification{{NotifyMessageType: message.MOBIKE_SUPPORTED}}
+	testcases := []struct {
+		description   string
+		enabled       bool
+		notifications []*message.Notification
+		expSupported  bool
+	}{
+		{
+			description:   "enabled and announced by UE",
+			enabled:       true,
+			notifications: supported,
+			expSupported:  true,
+		},
+		{
+			description:   "disabled",
+			notifications: supported,
+		},
+		{
+			description: "not announced by UE",
+			enabled:     true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeSA := &context.IKESecurityAssociation{}
+			var response message.IKEPayloadContainer
+			negotiateMOBIKE(&context.N3IWFContext{EnableMOBIKE: tc.enabled}, ikeSA, tc.notifications, &response)
+			if ikeSA.MobikeSupported != tc.expSupported {
+				t.Errorf("MobikeSupported mismatch. got = %v, want = %v", ikeSA.MobikeSupported, tc.expSupported)
+			}
+			echoed := false
+			for _, payload := range response {
+				if notification, ok := payload.(*message.Notification); ok &&
+					notification.NotifyMessageType == message.MOBIKE_SUPPORTED {
+					echoed = true
+				}
+			}
+			if echoed != tc.expSupported {
+				t.Errorf("MOBIKE_SUPPORTED echo mismatch. got = %v, want = %v", echoed, tc.expSupported)
+			}
+		})
+	}
+}
+
+func TestMobikeAddressUpdate(t *testing.T) {
+	n3iwfAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4500}
+	oldUEAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 4500}
+	newUEAddr := &net.UDPAddr{IP: net.ParseIP("192.168.2.20"), Port: 4500}
+
+	newIKESA := func() *context.IKESecurityAssociation {
+		ikeUe := &context.N3IWFIkeUe{
+			N3iwfCtx: &context.N3IWFContext{},
+			N3IWFChildSecurityAssociation: map[uint32]*context.ChildSecurityAssociation{
+				0x1001: {InboundSPI: 0x1001},
+				0x1002: {InboundSPI: 0x1002},
+			},
+		}
+		ikeConnection := &context.UDPSocketInfo{N3IWFAddr: n3iwfAddr, UEAddr: oldUEAddr}
+		ikeUe.IKEConnection = ikeConnection
+		return &context.IKESecurityAssociation{
+			LocalSPI:           0x1234,
+			RemoteSPI:          0x5678,
+			ResponderMessageID: 3,
+			MobikeSupported:    true,
+			IKEConnection:      ikeConnection,
+			IkeUE:              ikeUe,
+		}
+	}
+
+	var updated []uint32
+	origUpdateXFRMPeerAddress := updateXFRMPeerAddress
+	defer func() { updateXFRMPeerAddress = origUpdateXFRMPeerAddress }()
+	updateXFRMPeerAddress = func(childSA *context.ChildSecurityAssociation, peerIP, localIP net.IP,
+		enableEncapsulate bool, n3iwfPort, natPort int,
+	) error {
+		if !peerIP.Equal(newUEAddr.IP) || !localIP.Equal(n3iwfAddr.IP) {
+			t.Errorf("XFRM address mismatch. got = %s/%s, want = %s/%s", peerIP, localIP, newUEAddr.IP, n3iwfAddr.IP)
+		}
+		updated = append(updated, childSA.InboundSPI)
+		return nil
+	}
+
+	updateRequest := message.NewMessage(0x5678, 0x1234, message.INFORMATIONAL, false, true, 7, nil)
+
+	t.Run("address unchanged", func(t *testing.T) {
+		ikeSA := newIKESA()
+		var response message.IKEPayloadContainer
+		update, err := handleUpdateSAAddresses(nil, n3iwfAddr, oldUEAddr, updateRequest, ikeSA, nil, &response)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if update != nil {
+			t.Errorf("Expected no address update")
+		}
+	})
+
+	t.Run("MOBIKE not negotiated", func(t *testing.T) {
+		ikeSA := newIKESA()
+		ikeSA.MobikeSupported = false
+		var response message.IKEPayloadContainer
+		if _, err := handleUpdateSAAddresses(nil, n3iwfAddr, newUEAddr, updateRequest, ikeSA, nil, &response); err == nil {
+			t.Errorf("Expected error but got none")
+		}
+	})
+
+	testcases := []struct {
+		description string
+		cookie2     func(update *context.MobikeAddressUpdate) []byte
+		messageID   uint32
+		from        *net.UDPAddr
+		expApplied  bool
+		expErr      bool
+	}{
+		{
+			description: "matching COOKIE2",
+			cookie2:     func(update *context.MobikeAddressUpdate) []byte { return update.Cookie2 },
+			messageID:   3,
+			from:        newUEAddr,
+			expApplied:  true,
+		},
+		{
+			description: "wrong COOKIE2",
+			cookie2:     func(update *context.MobikeAddressUpdate) []byte { return make([]byte, cookie2Length) },
+			messageID:   3,
+			from:        newUEAddr,
+			expErr:      true,
+		},
+		{
+			description: "answer from another address",
+			cookie2:     func(update *context.MobikeAddressUpdate) []byte { return update.Cookie2 },
+			messageID:   3,
+			from:        oldUEAddr,
+			expErr:      true,
+		},
+		{
+			description: "unrelated response",
+			cookie2:     func(update *context.MobikeAddressUpdate) []byte { return update.Cookie2 },
+			messageID:   2,
+			from:        newUEAddr,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			updated = nil
+			ikeSA := newIKESA()
+			var response message.IKEPayloadContainer
+			update, err := handleUpdateSAAddresses(nil, n3iwfAddr, newUEAddr, updateRequest, ikeSA, nil, &response)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if update == nil || len(update.Cookie2) != cookie2Length {
+				t.Fatalf("Unexpected address update: %+v", update)
+			}
+			// As sent by sendReturnRoutabilityCheck
+			update.MessageID = ikeSA.ResponderMessageID
+			ikeSA.PendingAddressUpdate = update
+
+			notifications := []*message.Notification{
+				{NotifyMessageType: message.COOKIE2, NotificationData: tc.cookie2(update)},
+			}
+			answer := message.NewMessage(0x5678, 0x1234, message.INFORMATIONAL, true, false, tc.messageID, nil)
+			err = handleReturnRoutabilityResponse(tc.from, answer, ikeSA, notifications)
+			if tc.expErr && err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !tc.expErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			expUEAddr, expUpdated := oldUEAddr, 0
+			if tc.expApplied {
+				expUEAddr, expUpdated = newUEAddr, 2
+			}
+			if ueAddr := ikeSA.IkeUE.IKEConnection.UEAddr; ueAddr != expUEAddr {
+				t.Errorf("UE address mismatch. got = %s, want = %s", ueAddr, expUEAddr)
+			}
+			if len(updated) != expUpdated {
+				t.Errorf("updated child SAs mismatch. got = %d, want = %d", len(updated), expUpdated)
+			}
+		})
+	}
+}
+
+func TestReturnRoutabilityCheckRetransmission(t *testing.T) {
+	retransmitInterval, maxRetransmissions := deleteRetransmitInterval, deleteMaxRetransmissions
+	defer func() {
+		deleteRetransmitInterval, deleteMaxRetransmissions = retransmitInterval, maxRetransmissions
+	}()
+	deleteRetransmitInterval, deleteMaxRetransmissions = 10*time.Millisecond, 1
+
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	update := &context.MobikeAddressUpdate{
+		Conn:      ikeUe.IKEConnection.Conn,
+		N3IWFAddr: ikeUe.IKEConnection.N3IWFAddr,
+		UEAddr:    ikeUe.IKEConnection.UEAddr,
+		Cookie2:   make([]byte, cookie2Length),
+	}
+	ikeSA.Lock()
+	ikeSA.PendingChildSARekey = &context.ChildSARekeyRequest{MessageID: 7}
+	sendReturnRoutabilityCheck(ikeSA, update)
+	if ikeSA.PendingAddressUpdate != nil || len(ikeSA.QueuedRequests) != 1 {
+		t.Fatalf("return routability check sent while the rekey is pending")
+	}
+
+	// Sent with the next message ID once the rekey is answered
+	ikeSA.PendingChildSARekey = nil
+	ikeSA.ResponderMessageID++
+	sendQueuedRequests(ikeUe)
+	if ikeSA.PendingAddressUpdate != update || update.MessageID != 8 {
+		t.Fatalf("pending address update mismatch: %+v", ikeSA.PendingAddressUpdate)
+	}
+	ikeSA.Unlock()
+	for range 2 {
+		ikeMsg, err := message.ParseHeader(readDatagram(t, ueConn))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if ikeMsg.ExchangeType != message.INFORMATIONAL || ikeMsg.IsResponse() || ikeMsg.MessageID != 8 {
+			t.Errorf("return routability check mismatch. got = %+v", ikeMsg)
+		}
+	}
+
+	// Left unanswered, the update is dropped without taking the message ID
+	deadline := time.Now().Add(time.Second)
+	for {
+		ikeSA.Lock()
+		pending := ikeSA.PendingAddressUpdate
+		messageID := ikeSA.ResponderMessageID
+		ikeSA.Unlock()
+		if pending == nil {
+			if messageID != 8 {
+				t.Errorf("ResponderMessageID mismatch. got = %d, want = 8", messageID)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unanswered return routability check not dropped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCheckNATRebinding(t *testing.T) {
+	n3iwfAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4500}
+	oldUEAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 4500}
+	reboundUEAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 31000}
+	enabledCtx := &context.N3IWFContext{ReturnRoutabilityCheck: true}
+
+	testcases := []struct {
+		description string
+		n3iwfCtx    *context.N3IWFContext
+		ueAddr      *net.UDPAddr
+		mobike      bool
+		notNATed    bool
+		pending     bool
+		expUpdate   bool
+		expErr      bool
+	}{
+		{
+			description: "check disabled",
+			n3iwfCtx:    &context.N3IWFContext{},
+			ueAddr:      reboundUEAddr,
+		},
+		{
+			description: "address unchanged",
+			n3iwfCtx:    enabledCtx,
+			ueAddr:      oldUEAddr,
+		},
+		{
+			description: "MOBIKE negotiated",
+			n3iwfCtx:    enabledCtx,
+			ueAddr:      reboundUEAddr,
+			mobike:      true,
+		},
+		{
+			description: "NAT rebinding",
+			n3iwfCtx:    enabledCtx,
+			ueAddr:      reboundUEAddr,
+			expUpdate:   true,
+		},
+		{
+			description: "check already pending",
+			n3iwfCtx:    enabledCtx,
+			ueAddr:      reboundUEAddr,
+			pending:     true,
+		},
+		{
+			description: "UE not behind a NAT",
+			n3iwfCtx:    enabledCtx,
+			ueAddr:      reboundUEAddr,
+			notNATed:    true,
+			expErr:      true,
+		},
+		{
+			description: "address of another family",
+			n3iwfCtx:    enabledCtx,
+			ueAddr:      &net.UDPAddr{IP: net.ParseIP("2001:db8::10"), Port: 31000},
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeSA := &context.IKESecurityAssociation{
+				ResponderMessageID: 3,
+				MobikeSupported:    tc.mobike,
+				UeBehindNAT:        !tc.notNATed,
+				IKEConnection:      &context.UDPSocketInfo{N3IWFAddr: n3iwfAddr, UEAddr: oldUEAddr},
+			}
+			if tc.pending {
+				ikeSA.PendingAddressUpdate = &context.MobikeAddressUpdate{N3IWFAddr: n3iwfAddr, UEAddr: tc.ueAddr}
+			}
+			update, err := checkNATRebinding(tc.n3iwfCtx, nil, n3iwfAddr, tc.ueAddr, ikeSA)
+			if tc.expErr && err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !tc.expErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if tc.expUpdate != (update != nil) {
+				t.Fatalf("address update mismatch. got = %+v, want update = %v", update, tc.expUpdate)
+			}
+			if update != nil {
+				if update.UEAddr != tc.ueAddr || len(update.Cookie2) != cookie2Length ||
+					!update.UeBehindNAT {
+					t.Errorf("Unexpected address update: %+v", update)
+				}
+			}
+			if ikeSA.IKEConnection.UEAddr != oldUEAddr {
+				t.Errorf("UE address changed before the return routability check")
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"slices"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// Transform ranking, weakest first. Transforms missing from a ranking are
+// weaker than all ranked ones
+var (
+	integrityRanking = []uint16{
+		message.AUTH_HMAC_MD5_96,
+		message.AUTH_HMAC_SHA1_96,
+		message.AUTH_HMAC_SHA2_256_128,
+		message.AUTH_HMAC_SHA2_384_192,
+		message.AUTH_HMAC_SHA2_512_256,
+	}
+	pseudorandomFunctionRanking = []uint16{
+		message.PRF_HMAC_MD5,
+		message.PRF_HMAC_SHA1,
+		message.PRF_HMAC_SHA2_256,
+		message.PRF_HMAC_SHA2_384,
+		message.PRF_HMAC_SHA2_512,
+	}
+	diffieHellmanGroupRanking = []uint16{
+		message.DH_768_BIT_MODP,
+		message.DH_1024_BIT_MODP,
+		message.DH_1536_BIT_MODP,
+		message.DH_2048_BIT_MODP,
+		message.DH_3072_BIT_MODP,
+		message.DH_4096_BIT_MODP,
+		message.DH_6144_BIT_MODP,
+		message.DH_8192_BIT_MODP,
+	}
+)
+
+// preferredTransform returns the transform of transforms, all of one type,
+// chosen among those accepted by supported. Unless the N3IWF follows the
+// order of the UE, it is the strongest one, the first offered among equally
+// strong ones:
+//   - encryption: the longest AES key, then AES-GCM over AES-CBC and AES-CTR
+//   - integrity: HMAC-SHA2-512, HMAC-SHA2-384, HMAC-SHA2-256, HMAC-SHA1, HMAC-MD5
+//   - PRF: HMAC-SHA2-512, HMAC-SHA2-384, HMAC-SHA2-256, HMAC-SHA1, HMAC-MD5
+//   - Diffie-Hellman: the largest MODP group, unless the KE payload group is
+//     acceptable, see preferredDHGroup
+//   - extended sequence numbers: the UE's order
+//
+// Proposals are still considered in the UE's order, only the transforms of a
+// proposal are ranked
+func preferredTransform(transforms message.TransformContainer,
+	supported func(*message.Transform) bool,
+) *message.Transform {
+	peerOrder := context.N3IWFSelf().ProposalPeerOrder
+	var chosen *message.Transform
+	for _, transform := range transforms {
+		if !supported(transform) {
+			continue
+		}
+		if chosen == nil {
+			chosen = transform
+			if peerOrder {
+				break
+			}
+			continue
+		}
+		if transformStrength(transform) > transformStrength(chosen) {
+			chosen = transform
+		}
+	}
+	return chosen
+}
+
+// preferredDHGroup returns the Diffie-Hellman group of transforms accepted by
+// supported: the first of groups offered, the preferred transform otherwise.
+// Callers put the group of the KE payload of the UE first, sparing it an
+// INVALID_KE_PAYLOAD round trip whenever that group is acceptable
+func preferredDHGroup(transforms message.TransformContainer, groups []uint16,
+	supported func(*message.Transform) bool,
+) *message.Transform {
+	if transform := offeredTransform(transforms, groups, supported); transform != nil {
+		return transform
+	}
+	return preferredTransform(transforms, supported)
+}
+
+// offeredTransform returns the transform of transforms, all of one type,
+// with the first of ids accepted by supported, nil if none is offered
+func offeredTransform(transforms message.TransformContainer, ids []uint16,
+	supported func(*message.Transform) bool,
+) *message.Transform {
+	for _, id := range ids {
+		for _, transform := range transforms {
+			if transform.TransformID == id && supported(transform) {
+				return transform
+			}
+		}
+	}
+	return nil
+}
+
+// transformStrength ranks transforms of the same type, the higher the stronger
+func transformStrength(transform *message.Transform) int {
+	switch transform.TransformType {
+	case message.TypeEncryptionAlgorithm:
+		return encryptionStrength(transform)
+	case message.TypeIntegrityAlgorithm:
+		return slices.Index(integrityRanking, transform.TransformID) + 1
+	case message.TypePseudorandomFunction:
+		return slices.Index(pseudorandomFunctionRanking, transform.TransformID) + 1
+	case message.TypeDiffieHellmanGroup:
+		return slices.Index(diffieHellmanGroupRanking, transform.TransformID) + 1
+	default:
+		return 0
+	}
+}
+
+// encryptionStrength ranks AES transforms by key length, then AEAD modes
+// above the others
+func encryptionStrength(transform *message.Transform) int {
+	if !transform.AttributePresent || transform.AttributeType != message.AttributeTypeKeyLength {
+		return 0
+	}
+	keyLength := int(transform.AttributeValue)
+	switch transform.TransformID {
+	case message.ENCR_AES_CBC, message.ENCR_AES_CTR:
+		return 2 * keyLength
+	case message.ENCR_AES_GCM_8, message.ENCR_AES_GCM_12, message.ENCR_AES_GCM_16,
+		message.ENCR_AES_CCM_8, message.ENCR_AES_CCM_12, message.ENCR_AES_CCM_16:
+		return 2*keyLength + 1
+	default:
+		return 0
+	}
+}
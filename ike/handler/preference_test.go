@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestSelectProposalPreference(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	proposalPeerOrder, ikeTransformPolicy := n3iwfCtx.ProposalPeerOrder, n3iwfCtx.IKETransformPolicy
+	defer func() {
+		n3iwfCtx.ProposalPeerOrder, n3iwfCtx.IKETransformPolicy = proposalPeerOrder, ikeTransformPolicy
+	}()
+
+	// Weak transforms refused by a crypto policy
+	weakTransforms := make(context.TransformSet)
+	weakTransforms.Add(message.TypeDiffieHellmanGroup, message.DH_1024_BIT_MODP)
+	weakTransforms.Add(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96)
+	weakTransforms.Add(message.TypePseudorandomFunction, message.PRF_HMAC_MD5)
+	weakTransforms.Add(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, 128)
+
+	attrType := uint16(message.AttributeTypeKeyLength)
+	keyLength128, keyLength256 := uint16(128), uint16(256)
+	var proposals message.ProposalContainer
+	proposal := proposals.BuildProposal(1, message.TypeIKE, nil)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength128, nil)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_3DES, nil, nil, nil)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength256, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_512_256, nil, nil, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_MD5, nil, nil, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_384, nil, nil, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_512, nil, nil, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_256, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_1024_BIT_MODP, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+
+	testcases := []struct {
+		description  string
+		peerOrder    bool
+		policy       context.TransformPolicy
+		expKeyLength uint16
+		expIntegID   uint16
+		expPrfID     uint16
+		expDhID      uint16
+	}{
+		{
+			description:  "strongest",
+			expKeyLength: 256,
+			expIntegID:   message.AUTH_HMAC_SHA2_512_256,
+			expPrfID:     message.PRF_HMAC_SHA2_512,
+			expDhID:      message.DH_2048_BIT_MODP,
+		},
+		{
+			description:  "peer order",
+			peerOrder:    true,
+			expKeyLength: 128,
+			expIntegID:   message.AUTH_HMAC_SHA1_96,
+			expPrfID:     message.PRF_HMAC_MD5,
+			expDhID:      message.DH_1024_BIT_MODP,
+		},
+		{
+			description:  "peer order with weak transforms blocked",
+			peerOrder:    true,
+			policy:       context.TransformPolicy{Block: weakTransforms},
+			expKeyLength: 256,
+			expIntegID:   message.AUTH_HMAC_SHA2_512_256,
+			expPrfID:     message.PRF_HMAC_SHA2_512,
+			expDhID:      message.DH_2048_BIT_MODP,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx.ProposalPeerOrder = tc.peerOrder
+			n3iwfCtx.IKETransformPolicy = tc.policy
+			chosen := SelectProposal(proposals)
+			if len(chosen) != 1 {
+				t.Fatalf("chosen proposals mismatch. got = %d, want = 1", len(chosen))
+			}
+			if keyLength := chosen[0].EncryptionAlgorithm[0].AttributeValue; keyLength != tc.expKeyLength {
+				t.Errorf("key length mismatch. got = %d, want = %d", keyLength, tc.expKeyLength)
+			}
+			if id := chosen[0].IntegrityAlgorithm[0].TransformID; id != tc.expIntegID {
+				t.Errorf("integrity mismatch. got = %d, want = %d", id, tc.expIntegID)
+			}
+			// PRF-HMAC-SHA2-384 is not implemented, hence skipped
+			if id := chosen[0].PseudorandomFunction[0].TransformID; id != tc.expPrfID {
+				t.Errorf("PRF mismatch. got = %d, want = %d", id, tc.expPrfID)
+			}
+			if id := chosen[0].DiffieHellmanGroup[0].TransformID; id != tc.expDhID {
+				t.Errorf("DH group mismatch. got = %d, want = %d", id, tc.expDhID)
+			}
+		})
+	}
+}
+
+func TestSelectProposalDHGroups(t *testing.T) {
+	attrType := uint16(message.AttributeTypeKeyLength)
+	keyLength := uint16(256)
+	var proposals message.ProposalContainer
+	proposal := proposals.BuildProposal(1, message.TypeIKE, nil)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_256, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_1024_BIT_MODP, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+
+	testcases := []struct {
+		description string
+		dhGroups    []uint16
+		expDhID     uint16
+	}{
+		{
+			description: "no preference",
+			expDhID:     message.DH_2048_BIT_MODP,
+		},
+		{
+			description: "preferred group offered",
+			dhGroups:    []uint16{message.DH_1024_BIT_MODP},
+			expDhID:     message.DH_1024_BIT_MODP,
+		},
+		{
+			description: "first preferred group not offered",
+			dhGroups:    []uint16{message.DH_4096_BIT_MODP, message.DH_1024_BIT_MODP},
+			expDhID:     message.DH_1024_BIT_MODP,
+		},
+		{
+			description: "preferred group not offered",
+			dhGroups:    []uint16{message.DH_4096_BIT_MODP},
+			expDhID:     message.DH_2048_BIT_MODP,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			chosen := SelectProposal(proposals, tc.dhGroups...)
+			if len(chosen) != 1 {
+				t.Fatalf("chosen proposals mismatch. got = %d, want = 1", len(chosen))
+			}
+			if id := chosen[0].DiffieHellmanGroup[0].TransformID; id != tc.expDhID {
+				t.Errorf("DH group mismatch. got = %d, want = %d", id, tc.expDhID)
+			}
+		})
+	}
+}
+
+func TestSelectChildSAProposalPreference(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	proposalPeerOrder := n3iwfCtx.ProposalPeerOrder
+	defer func() { n3iwfCtx.ProposalPeerOrder = proposalPeerOrder }()
+
+	attrType := uint16(message.AttributeTypeKeyLength)
+	keyLength128, keyLength192 := uint16(128), uint16(192)
+	requestSA := new(message.SecurityAssociation)
+	proposal := requestSA.Proposals.BuildProposal(1, message.TypeESP, []byte{0x01, 0x02, 0x03, 0x04})
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CTR, &attrType, &keyLength128, nil)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength192, nil)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CTR, &attrType, &keyLength192, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_MD5_96, nil, nil, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_384_192, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_ENABLE, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+
+	testcases := []struct {
+		description  string
+		peerOrder    bool
+		expEncrID    uint16
+		expKeyLength uint16
+		expIntegID   uint16
+	}{
+		{
+			description:  "strongest, first of equally strong",
+			expEncrID:    message.ENCR_AES_CBC,
+			expKeyLength: 192,
+			expIntegID:   message.AUTH_HMAC_SHA2_384_192,
+		},
+		{
+			description:  "peer order",
+			peerOrder:    true,
+			expEncrID:    message.ENCR_AES_CTR,
+			expKeyLength: 128,
+			expIntegID:   message.AUTH_HMAC_MD5_96,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx.ProposalPeerOrder = tc.peerOrder
+			responseSA := selectChildSAProposal(requestSA, kernelSupported)
+			if len(responseSA.Proposals) != 1 {
+				t.Fatalf("chosen proposals mismatch. got = %d, want = 1", len(responseSA.Proposals))
+			}
+			chosen := responseSA.Proposals[0]
+			encrTransform := chosen.EncryptionAlgorithm[0]
+			if encrTransform.TransformID != tc.expEncrID || encrTransform.AttributeValue != tc.expKeyLength {
+				t.Errorf("encryption mismatch. got = %d/%d, want = %d/%d", encrTransform.TransformID,
+					encrTransform.AttributeValue, tc.expEncrID, tc.expKeyLength)
+			}
+			if id := chosen.IntegrityAlgorithm[0].TransformID; id != tc.expIntegID {
+				t.Errorf("integrity mismatch. got = %d, want = %d", id, tc.expIntegID)
+			}
+			// Extended sequence numbers keep the UE's order
+			if id := chosen.ExtendedSequenceNumbers[0].TransformID; id != message.ESN_ENABLE {
+				t.Errorf("ESN mismatch. got = %d, want = %d", id, message.ESN_ENABLE)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/ike/security/dh"
+	"github.com/omec-project/n3iwf/ike/xfrm"
+	"github.com/omec-project/n3iwf/logger"
+	"golang.org/x/sys/unix"
+)
+
+// Installs the XFRM states of a rekeyed child SA, replaced in tests
+var rekeyXFRMRule = xfrm.RekeyXFRMRule
+
+// findNotification returns the first notification of the given type
+func findNotification(notifications []*message.Notification, notifyType uint16) *message.Notification {
+	for _, notification := range notifications {
+		if notification.NotifyMessageType == notifyType {
+			return notification
+		}
+	}
+	return nil
+}
+
+// findChildSAByOutboundSPI returns the child SA whose outbound SPI, the one
+// chosen by the UE, matches spi
+func findChildSAByOutboundSPI(ikeUe *context.N3IWFIkeUe, spi uint32) *context.ChildSecurityAssociation {
+	for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
+		if childSA.OutboundSPI == spi {
+			return childSA
+		}
+	}
+	return nil
+}
+
+// negotiateTransportMode reports whether the child SA requested by the UE with
+// the given notifications uses transport mode. When transport mode is not
+// allowed, the request for it is ignored so the SA falls back to tunnel mode
+func negotiateTransportMode(notifications []*message.Notification, allowed bool) bool {
+	if findNotification(notifications, message.USE_TRANSPORT_MODE) == nil {
+		return false
+	}
+	if !allowed {
+		logger.IKELog.Infoln("UE requested transport mode, tunnel mode is used instead")
+	}
+	return allowed
+}
+
+// sendProtectedErrorResponse answers a request on an established IKE SA with a
+// single error notification
+func sendProtectedErrorResponse(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation, notifyType uint16,
+) {
+	sendProtectedNotifyResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, notifyType, nil)
+}
+
+// sendProtectedNotifyResponse answers a request on an established IKE SA with
+// a single error notification carrying notifyData
+func sendProtectedNotifyResponse(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation,
+	notifyType uint16, notifyData []byte,
+) {
+	var payload message.IKEPayloadContainer
+	payload.BuildNotification(message.TypeNone, notifyType, nil, notifyData)
+	responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
+		ikeMsg.ExchangeType, true, false, ikeMsg.MessageID, payload)
+	if err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
+		ikeSecurityAssociation.IKESAKey); err != nil {
+		ikeSecurityAssociation.Log().Errorf("sendProtectedNotifyResponse: %v", err)
+	}
+}
+
+// handleChildSARekeyRequest answers a CREATE_CHILD_SA request from the UE
+// carrying REKEY_SA. Only the CP child SA, which carries NAS over TCP, can be
+// rekeyed by the UE; the new SA takes over its traffic selectors so the NAS TCP
+// connection keeps running while the UE deletes the old SA
+func handleChildSARekeyRequest(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeMsg *message.IKEMessage, ikeSecurityAssociation *context.IKESecurityAssociation,
+	rekeyNotification *message.Notification, securityAssociation *message.SecurityAssociation,
+	nonce *message.Nonce, keyExchange *message.KeyExchange, notifications []*message.Notification,
+) error {
+	ikeUe := ikeSecurityAssociation.IkeUE
+	if ikeUe == nil {
+		return errors.New("UE context is nil")
+	}
+	ikeSecurityAssociation.InitiatorMessageID = ikeMsg.MessageID
+
+	if rekeyNotification.ProtocolID != message.TypeESP || len(rekeyNotification.SPI) != 4 {
+		sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, message.INVALID_SYNTAX)
+		return &ExchangeError{Notify: message.INVALID_SYNTAX, Err: fmt.Errorf("invalid REKEY_SA notification: protocol %d, SPI size %d",
+			rekeyNotification.ProtocolID, len(rekeyNotification.SPI))}
+	}
+	if securityAssociation == nil || nonce == nil {
+		sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, message.INVALID_SYNTAX)
+		return &ExchangeError{Notify: message.INVALID_SYNTAX, Err: errors.New("SA or nonce missing in child SA rekey request")}
+	}
+
+	rekeyedSPI := binary.BigEndian.Uint32(rekeyNotification.SPI)
+	oldChildSA := findChildSAByOutboundSPI(ikeUe, rekeyedSPI)
+	if oldChildSA == nil {
+		sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, message.CHILD_SA_NOT_FOUND)
+		return &ExchangeError{Notify: message.CHILD_SA_NOT_FOUND, Err: fmt.Errorf("rekey of unknown child SA with SPI: 0x%08x", rekeyedSPI)}
+	}
+	if oldChildSA.SelectedIPProtocol != unix.IPPROTO_TCP {
+		sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, message.NO_PROPOSAL_CHOSEN)
+		return &ExchangeError{Notify: message.NO_PROPOSAL_CHOSEN, Err: fmt.Errorf("rekey of user plane child SA 0x%08x is not supported", rekeyedSPI)}
+	}
+
+	n3iwfCtx := ikeUe.N3iwfCtx
+	var dhGroups []uint16
+	if keyExchange != nil {
+		dhGroups = append(dhGroups, keyExchange.DiffieHellmanGroup)
+	}
+	responseSecurityAssociation := selectChildSAProposal(securityAssociation, rekeyDHSupported(keyExchange != nil),
+		dhGroups...)
+	if len(responseSecurityAssociation.Proposals) == 0 {
+		sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, message.NO_PROPOSAL_CHOSEN)
+		return &ExchangeError{Notify: message.NO_PROPOSAL_CHOSEN, Err: errors.New("no proposal chosen for child SA rekey")}
+	}
+	dhGroup, notifyType, notifyData, err := negotiateRekeyPFS(responseSecurityAssociation.Proposals[0], keyExchange,
+		n3iwfCtx.ChildSAPFSRequired)
+	if err != nil {
+		sendProtectedNotifyResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, notifyType, notifyData)
+		return &ExchangeError{Notify: notifyType, Err: err}
+	}
+	transportMode := negotiateTransportMode(notifications, ikeUe.N3iwfCtx.AllowTransportMode)
+
+	localNonceBigInt, err := security.GenerateRandomNumber()
+	if err != nil {
+		return fmt.Errorf("handleChildSARekeyRequest(): %w", err)
+	}
+	localNonce := localNonceBigInt.Bytes()
+	concatenatedNonce := append(append([]byte{}, nonce.NonceData...), localNonce...)
+
+	// RFC 7296 section 2.17: with PFS, the keys also derive from a fresh DH exchange
+	var localPublicValue, sharedKey []byte
+	if dhGroup != nil {
+		localPublicValue, sharedKey, err = security.CalculateDiffieHellmanMaterials(dh.DecodeTransform(dhGroup),
+			keyExchange.KeyExchangeData)
+		if err != nil {
+			notifyData := make([]byte, 2)
+			binary.BigEndian.PutUint16(notifyData, dhGroup.TransformID)
+			sendProtectedNotifyResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation,
+				message.INVALID_KE_PAYLOAD, notifyData)
+			return &ExchangeError{Notify: message.INVALID_KE_PAYLOAD, Err: err}
+		}
+	}
+
+	newChildSA, err := rekeyCPChildSA(ikeSecurityAssociation, oldChildSA, responseSecurityAssociation,
+		sharedKey, concatenatedNonce, transportMode)
+	if err != nil {
+		notifyType := uint16(message.TEMPORARY_FAILURE)
+		if errors.Is(err, ErrSPIExhausted) {
+			notifyType = message.NO_ADDITIONAL_SAS
+		}
+		sendProtectedErrorResponse(udpConn, n3iwfAddr, ueAddr, ikeMsg, ikeSecurityAssociation, notifyType)
+		return &ExchangeError{Notify: notifyType, Err: err}
+	}
+
+	var responseIKEPayload message.IKEPayloadContainer
+	responseIKEPayload = append(responseIKEPayload, responseSecurityAssociation)
+	responseIKEPayload.BuildNonce(localNonce)
+	if dhGroup != nil {
+		responseIKEPayload.BuildKeyExchange(dhGroup.TransformID, localPublicValue)
+	}
+	if newChildSA.TransportMode {
+		responseIKEPayload.BuildNotification(message.TypeNone, message.USE_TRANSPORT_MODE, nil, nil)
+	}
+	if ikeSecurityAssociation.TrafficSelectorInitiator != nil && ikeSecurityAssociation.TrafficSelectorResponder != nil {
+		responseIKEPayload = append(responseIKEPayload,
+			ikeSecurityAssociation.TrafficSelectorInitiator, ikeSecurityAssociation.TrafficSelectorResponder)
+	}
+	responseIKEMessage := message.NewMessage(ikeMsg.InitiatorSPI, ikeMsg.ResponderSPI,
+		message.CREATE_CHILD_SA, true, false, ikeMsg.MessageID, responseIKEPayload)
+	if err := SendIKEMessageToUE(udpConn, n3iwfAddr, ueAddr, responseIKEMessage,
+		ikeSecurityAssociation.IKESAKey); err != nil {
+		return fmt.Errorf("handleChildSARekeyRequest(): %w", err)
+	}
+	ikeSecurityAssociation.Log().Infof("CP child SA rekeyed: inbound SPI 0x%08x -> 0x%08x, PFS: %t",
+		oldChildSA.InboundSPI, newChildSA.InboundSPI, dhGroup != nil)
+	n3iwfCtx.AuditChildSA(ikeSecurityAssociation, newChildSA, context.AuditEstablish, context.AuditRekey)
+	return nil
+}
+
+// rekeyDHSupported returns the Diffie-Hellman transforms a child SA rekey may
+// choose: the groups implemented by the N3IWF when the UE sent a KE payload,
+// only NONE otherwise
+func rekeyDHSupported(withKeyExchange bool) func(*message.Transform) bool {
+	return func(transform *message.Transform) bool {
+		if transform.TransformID == message.DH_NONE {
+			return true
+		}
+		return withKeyExchange && ikeSupported(transform)
+	}
+}
+
+// negotiateRekeyPFS returns the Diffie-Hellman group of the chosen proposal of
+// a child SA rekey, nil without PFS. On failure, it returns the error notify
+// to answer with and its data: INVALID_KE_PAYLOAD with the chosen group if the
+// KE payload of the UE is of another group, NO_PROPOSAL_CHOSEN if PFS is
+// required and the UE rekeys without it
+func negotiateRekeyPFS(chosenProposal *message.Proposal, keyExchange *message.KeyExchange,
+	pfsRequired bool,
+) (*message.Transform, uint16, []byte, error) {
+	var dhGroup *message.Transform
+	if len(chosenProposal.DiffieHellmanGroup) > 0 && chosenProposal.DiffieHellmanGroup[0].TransformID != message.DH_NONE {
+		dhGroup = chosenProposal.DiffieHellmanGroup[0]
+	}
+	switch {
+	case dhGroup == nil && pfsRequired:
+		return nil, message.NO_PROPOSAL_CHOSEN, nil, errors.New("child SA rekey without PFS, which is required")
+	case dhGroup == nil:
+		return nil, 0, nil, nil
+	case keyExchange == nil:
+		return nil, message.INVALID_SYNTAX, nil,
+			fmt.Errorf("Diffie-Hellman group %d chosen without KE payload", dhGroup.TransformID)
+	case keyExchange.DiffieHellmanGroup != dhGroup.TransformID:
+		notifyData := make([]byte, 2)
+		binary.BigEndian.PutUint16(notifyData, dhGroup.TransformID)
+		return nil, message.INVALID_KE_PAYLOAD, notifyData, fmt.Errorf("KE payload of group %d, Diffie-Hellman group %d chosen",
+			keyExchange.DiffieHellmanGroup, dhGroup.TransformID)
+	}
+	return dhGroup, 0, nil, nil
+}
+
+// rekeyCPChildSA creates the child SA replacing oldChildSA with the proposal
+// chosen in responseSecurityAssociation, whose SPI is overwritten with the new
+// N3IWF inbound SPI. The new SA inherits the addresses, traffic selectors and
+// encapsulation of the old one, and uses transport mode if transportMode is set.
+// Its keys derive from sharedKey, the Diffie-Hellman shared secret of a rekey
+// with PFS, and the nonces
+func rekeyCPChildSA(ikeSecurityAssociation *context.IKESecurityAssociation,
+	oldChildSA *context.ChildSecurityAssociation,
+	responseSecurityAssociation *message.SecurityAssociation, sharedKey, concatenatedNonce []byte, transportMode bool,
+) (*context.ChildSecurityAssociation, error) {
+	ikeUe := ikeSecurityAssociation.IkeUE
+	n3iwfCtx := ikeUe.N3iwfCtx
+	if len(responseSecurityAssociation.Proposals) == 0 {
+		return nil, errors.New("rekeyCPChildSA: no proposal")
+	}
+	proposal := responseSecurityAssociation.Proposals[0]
+	if len(proposal.SPI) != 4 {
+		return nil, fmt.Errorf("rekeyCPChildSA: invalid SPI size %d", len(proposal.SPI))
+	}
+
+	inboundSPI, err := allocateChildSAInboundSPI(n3iwfCtx)
+	if err != nil {
+		return nil, fmt.Errorf("rekeyCPChildSA: %w", err)
+	}
+	// The UE initiated the rekey exchange
+	newChildSA := newRekeyedChildSA(oldChildSA, inboundSPI, binary.BigEndian.Uint32(proposal.SPI), transportMode, false)
+	newChildSA.ChildSAKey, err = security.NewChildSAKeyByProposal(proposal)
+	if err != nil {
+		return nil, fmt.Errorf("rekeyCPChildSA: %w", err)
+	}
+	if err = newChildSA.GenerateKeyForChildSA(ikeSecurityAssociation.IKESAKey, sharedKey, concatenatedNonce); err != nil {
+		return nil, fmt.Errorf("rekeyCPChildSA: %w", err)
+	}
+
+	if err = rekeyXFRMRule(false, n3iwfCtx.DefaultXfrmIfaceId(), newChildSA, oldChildSA); err != nil {
+		return nil, fmt.Errorf("rekeyCPChildSA: %w", err)
+	}
+	oldChildSA.Rekeyed = true
+
+	// Send back the N3IWF inbound SPI in the response SA
+	inboundSPIByte := make([]byte, 4)
+	binary.BigEndian.PutUint32(inboundSPIByte, inboundSPI)
+	proposal.SPI = inboundSPIByte
+	ikeUe.N3IWFChildSecurityAssociation[inboundSPI] = newChildSA
+	n3iwfCtx.ChildSA.Store(inboundSPI, newChildSA)
+	n3iwfCtx.IndexOutboundSPI(newChildSA)
+	return newChildSA, nil
+}
+
+// newRekeyedChildSA returns the child SA replacing oldChildSA, with the given
+// SPIs. It inherits the addresses, traffic selectors, encapsulation, PDU
+// sessions and QoS flows of the old one
+func newRekeyedChildSA(oldChildSA *context.ChildSecurityAssociation, inboundSPI, outboundSPI uint32,
+	transportMode, localIsInitiator bool,
+) *context.ChildSecurityAssociation {
+	return &context.ChildSecurityAssociation{
+		InboundSPI:            inboundSPI,
+		OutboundSPI:           outboundSPI,
+		XfrmIface:             oldChildSA.XfrmIface,
+		XfrmMark:              oldChildSA.XfrmMark,
+		PeerPublicIPAddr:      oldChildSA.PeerPublicIPAddr,
+		LocalPublicIPAddr:     oldChildSA.LocalPublicIPAddr,
+		SelectedIPProtocol:    oldChildSA.SelectedIPProtocol,
+		SelectedLocalPort:     oldChildSA.SelectedLocalPort,
+		SelectedRemotePort:    oldChildSA.SelectedRemotePort,
+		TrafficSelectorLocal:  oldChildSA.TrafficSelectorLocal,
+		TrafficSelectorRemote: oldChildSA.TrafficSelectorRemote,
+		TransportMode:         transportMode,
+		ReplayWindow:          oldChildSA.ReplayWindow,
+		Lifetime:              oldChildSA.Lifetime,
+		EnableEncapsulate:     oldChildSA.EnableEncapsulate,
+		N3IWFPort:             oldChildSA.N3IWFPort,
+		NATPort:               oldChildSA.NATPort,
+		PDUSessionIds:         oldChildSA.PDUSessionIds,
+		GREKeys:               oldChildSA.GREKeys,
+		DefaultQFI:            oldChildSA.DefaultQFI,
+		IkeUE:                 oldChildSA.IkeUE,
+		LocalIsInitiator:      localIsInitiator,
+	}
+}
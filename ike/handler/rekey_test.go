@@ -0,0 +1,335 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestRekeyCPChildSA(t *testing.T) {
+	n3iwfCtx := &context.N3IWFContext{XfrmInterfaceId: 7}
+	ikeUe := &context.N3IWFIkeUe{
+		N3iwfCtx:                      n3iwfCtx,
+		N3IWFChildSecurityAssociation: make(map[uint32]*context.ChildSecurityAssociation),
+	}
+	ikeSA := &context.IKESecurityAssociation{
+		IKESAKey: newTestIKESAKey(t),
+		IkeUE:    ikeUe,
+	}
+	ikeUe.N3IWFIKESecurityAssociation = ikeSA
+
+	_, tsLocal, _ := net.ParseCIDR("10.0.0.1/32")
+	_, tsRemote, _ := net.ParseCIDR("10.0.0.5/32")
+	cpPolicies := []netlink.XfrmPolicy{
+		{Dir: netlink.XFRM_DIR_IN, Tmpls: []netlink.XfrmPolicyTmpl{{Spi: 0x1001}}},
+		{Dir: netlink.XFRM_DIR_OUT, Tmpls: []netlink.XfrmPolicyTmpl{{Spi: 0x2002}}},
+	}
+	oldChildSA := &context.ChildSecurityAssociation{
+		InboundSPI:            0x1001,
+		OutboundSPI:           0x2002,
+		PeerPublicIPAddr:      net.ParseIP("192.168.0.100"),
+		LocalPublicIPAddr:     net.ParseIP("192.168.0.1"),
+		SelectedIPProtocol:    unix.IPPROTO_TCP,
+		TrafficSelectorLocal:  *tsLocal,
+		TrafficSelectorRemote: *tsRemote,
+		EnableEncapsulate:     true,
+		N3IWFPort:             4500,
+		NATPort:               34567,
+		PDUSessionIds:         []int64{-1},
+		XfrmPolicyList:        cpPolicies,
+		IkeUE:                 ikeUe,
+	}
+	ikeUe.N3IWFChildSecurityAssociation[oldChildSA.InboundSPI] = oldChildSA
+	n3iwfCtx.ChildSA.Store(oldChildSA.InboundSPI, oldChildSA)
+
+	var xfrmCalls int
+	origRekeyXFRMRule := rekeyXFRMRule
+	defer func() { rekeyXFRMRule = origRekeyXFRMRule }()
+	rekeyXFRMRule = func(n3iwfIsInitiator bool, xfrmiId uint32, newChildSA, old *context.ChildSecurityAssociation) error {
+		xfrmCalls++
+		if n3iwfIsInitiator || xfrmiId != n3iwfCtx.XfrmInterfaceId || old != oldChildSA {
+			t.Errorf("unexpected XFRM rekey arguments: %v %d %p", n3iwfIsInitiator, xfrmiId, old)
+		}
+		// The policies now point to the new SA
+		newChildSA.XfrmPolicyList = old.XfrmPolicyList
+		old.XfrmPolicyList = nil
+		return nil
+	}
+
+	// UE proposal for the new CP child SA
+	keyLength := uint16(128)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	requestSA := new(message.SecurityAssociation)
+	proposal := requestSA.Proposals.BuildProposal(1, message.TypeESP, []byte{0x00, 0x00, 0x30, 0x03})
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+
+	responseSA := selectChildSAProposal(requestSA, kernelSupported)
+	if len(responseSA.Proposals) != 1 {
+		t.Fatalf("chosen proposal count mismatch. got = %d, want = 1", len(responseSA.Proposals))
+	}
+	concatenatedNonce := bytes.Repeat([]byte{0x42}, 64)
+
+	newChildSA, err := rekeyCPChildSA(ikeSA, oldChildSA, responseSA, nil, concatenatedNonce, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if xfrmCalls != 1 {
+		t.Fatalf("XFRM rekey call count mismatch. got = %d, want = 1", xfrmCalls)
+	}
+
+	if newChildSA.OutboundSPI != 0x3003 || newChildSA.InboundSPI == oldChildSA.InboundSPI {
+		t.Errorf("SPI mismatch. inbound = 0x%08x, outbound = 0x%08x", newChildSA.InboundSPI, newChildSA.OutboundSPI)
+	}
+	if got := binary.BigEndian.Uint32(responseSA.Proposals[0].SPI); got != newChildSA.InboundSPI {
+		t.Errorf("response SA SPI mismatch. got = 0x%08x, want = 0x%08x", got, newChildSA.InboundSPI)
+	}
+	if newChildSA.SelectedIPProtocol != unix.IPPROTO_TCP || newChildSA.LocalIsInitiator ||
+		newChildSA.TrafficSelectorLocal.String() != tsLocal.String() ||
+		newChildSA.TrafficSelectorRemote.String() != tsRemote.String() ||
+		!newChildSA.EnableEncapsulate || newChildSA.N3IWFPort != 4500 || newChildSA.NATPort != 34567 {
+		t.Errorf("new child SA does not inherit the CP child SA: %+v", newChildSA)
+	}
+
+	expectedKey, err := security.NewChildSAKeyByProposal(responseSA.Proposals[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = expectedKey.GenerateKeyForChildSA(ikeSA.IKESAKey, nil, concatenatedNonce); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(newChildSA.InitiatorToResponderEncryptionKey, expectedKey.InitiatorToResponderEncryptionKey) ||
+		!bytes.Equal(newChildSA.ResponderToInitiatorIntegrityKey, expectedKey.ResponderToInitiatorIntegrityKey) {
+		t.Error("new child SA keys are not derived from the rekey nonces")
+	}
+
+	if _, ok := n3iwfCtx.ChildSA.Load(newChildSA.InboundSPI); !ok {
+		t.Error("new child SA not found in context")
+	}
+	if len(ikeUe.N3IWFChildSecurityAssociation) != 2 {
+		t.Errorf("child SA count mismatch before delete. got = %d, want = 2", len(ikeUe.N3IWFChildSecurityAssociation))
+	}
+
+	// The UE deletes the old SA once the rekey completes
+	deletedSPIs, deletedPduIds, err := deleteChildSAFromSPIList(ikeUe, []uint32{oldChildSA.OutboundSPI})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(deletedSPIs) != 1 || deletedSPIs[0] != oldChildSA.InboundSPI {
+		t.Errorf("deleted SPIs mismatch. got = %v, want = [%d]", deletedSPIs, oldChildSA.InboundSPI)
+	}
+	if len(deletedPduIds) != 0 {
+		t.Errorf("deleting the old CP child SA must not release PDU sessions, got %v", deletedPduIds)
+	}
+
+	// NAS continuity: the CP traffic is still covered by the new SA
+	cpChildSA, ok := ikeUe.N3IWFChildSecurityAssociation[newChildSA.InboundSPI]
+	if !ok || len(ikeUe.N3IWFChildSecurityAssociation) != 1 {
+		t.Fatal("new CP child SA missing after deleting the old one")
+	}
+	if len(cpChildSA.XfrmPolicyList) != len(cpPolicies) {
+		t.Errorf("CP policy count mismatch. got = %d, want = %d", len(cpChildSA.XfrmPolicyList), len(cpPolicies))
+	}
+}
+
+func TestNegotiateRekeyPFS(t *testing.T) {
+	newProposal := func(dhGroups ...uint16) *message.Proposal {
+		keyLength := uint16(128)
+		attrType := uint16(message.AttributeTypeKeyLength)
+		requestSA := new(message.SecurityAssociation)
+		proposal := requestSA.Proposals.BuildProposal(1, message.TypeESP, []byte{0x00, 0x00, 0x30, 0x03})
+		proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+		proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+		for _, dhGroup := range dhGroups {
+			proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, dhGroup, nil, nil, nil)
+		}
+		proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+		return proposal
+	}
+	keyExchange := func(dhGroup uint16) *message.KeyExchange {
+		return &message.KeyExchange{DiffieHellmanGroup: dhGroup}
+	}
+
+	testcases := []struct {
+		description   string
+		proposal      *message.Proposal
+		keyExchange   *message.KeyExchange
+		pfsRequired   bool
+		expGroup      uint16
+		expNotify     uint16
+		expNotifyData []byte
+	}{
+		{
+			description: "no PFS",
+			proposal:    newProposal(),
+		},
+		{
+			description: "DH NONE",
+			proposal:    newProposal(message.DH_NONE),
+		},
+		{
+			description: "PFS",
+			proposal:    newProposal(message.DH_2048_BIT_MODP),
+			keyExchange: keyExchange(message.DH_2048_BIT_MODP),
+			expGroup:    message.DH_2048_BIT_MODP,
+		},
+		{
+			description:   "KE payload of another group",
+			proposal:      newProposal(message.DH_2048_BIT_MODP),
+			keyExchange:   keyExchange(message.DH_1024_BIT_MODP),
+			expNotify:     message.INVALID_KE_PAYLOAD,
+			expNotifyData: []byte{0x00, message.DH_2048_BIT_MODP},
+		},
+		{
+			description: "DH group without KE payload",
+			proposal:    newProposal(message.DH_2048_BIT_MODP),
+			expNotify:   message.INVALID_SYNTAX,
+		},
+		{
+			description: "required PFS omitted",
+			proposal:    newProposal(),
+			pfsRequired: true,
+			expNotify:   message.NO_PROPOSAL_CHOSEN,
+		},
+		{
+			description: "required PFS",
+			proposal:    newProposal(message.DH_2048_BIT_MODP),
+			keyExchange: keyExchange(message.DH_2048_BIT_MODP),
+			pfsRequired: true,
+			expGroup:    message.DH_2048_BIT_MODP,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			dhGroup, notifyType, notifyData, err := negotiateRekeyPFS(tc.proposal, tc.keyExchange, tc.pfsRequired)
+			if tc.expNotify != 0 {
+				if err == nil {
+					t.Fatal("Expected error but got none")
+				}
+				if notifyType != tc.expNotify || !bytes.Equal(notifyData, tc.expNotifyData) {
+					t.Errorf("notify mismatch. got = %d %x, want = %d %x", notifyType, notifyData,
+						tc.expNotify, tc.expNotifyData)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var group uint16
+			if dhGroup != nil {
+				group = dhGroup.TransformID
+			}
+			if group != tc.expGroup {
+				t.Errorf("DH group mismatch. got = %d, want = %d", group, tc.expGroup)
+			}
+		})
+	}
+}
+
+func TestSelectChildSARekeyProposalDH(t *testing.T) {
+	keyLength := uint16(128)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	requestSA := new(message.SecurityAssociation)
+	proposal := requestSA.Proposals.BuildProposal(1, message.TypeESP, []byte{0x00, 0x00, 0x30, 0x03})
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+
+	if responseSA := selectChildSAProposal(requestSA, rekeyDHSupported(false)); len(responseSA.Proposals) != 0 {
+		t.Errorf("DH group chosen without KE payload: %+v", responseSA.Proposals[0])
+	}
+	responseSA := selectChildSAProposal(requestSA, rekeyDHSupported(true))
+	if len(responseSA.Proposals) != 1 || len(responseSA.Proposals[0].DiffieHellmanGroup) != 1 ||
+		responseSA.Proposals[0].DiffieHellmanGroup[0].TransformID != message.DH_2048_BIT_MODP {
+		t.Errorf("DH group 14 not chosen with KE payload: %+v", responseSA.Proposals)
+	}
+
+	// The group of the KE payload is chosen over a stronger one
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_4096_BIT_MODP, nil, nil, nil)
+	responseSA = selectChildSAProposal(requestSA, rekeyDHSupported(true), message.DH_2048_BIT_MODP)
+	if len(responseSA.Proposals) != 1 || len(responseSA.Proposals[0].DiffieHellmanGroup) != 1 ||
+		responseSA.Proposals[0].DiffieHellmanGroup[0].TransformID != message.DH_2048_BIT_MODP {
+		t.Errorf("DH group 14 of the KE payload not chosen: %+v", responseSA.Proposals)
+	}
+}
+
+func TestFindChildSAByOutboundSPI(t *testing.T) {
+	childSA := &context.ChildSecurityAssociation{InboundSPI: 0x1, OutboundSPI: 0x2}
+	ikeUe := &context.N3IWFIkeUe{
+		N3IWFChildSecurityAssociation: map[uint32]*context.ChildSecurityAssociation{0x1: childSA},
+	}
+
+	testcases := []struct {
+		description string
+		spi         uint32
+		expected    *context.ChildSecurityAssociation
+	}{
+		{
+			description: "outbound SPI",
+			spi:         0x2,
+			expected:    childSA,
+		},
+		{
+			description: "inbound SPI is not matched",
+			spi:         0x1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if got := findChildSAByOutboundSPI(ikeUe, tc.spi); got != tc.expected {
+				t.Errorf("child SA mismatch. got = %p, want = %p", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNegotiateTransportMode(t *testing.T) {
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, message.USE_TRANSPORT_MODE, nil, nil)
+	transportRequested := []*message.Notification{payloads[0].(*message.Notification)}
+
+	testcases := []struct {
+		description   string
+		notifications []*message.Notification
+		allowed       bool
+		expTransport  bool
+	}{
+		{
+			description: "tunnel mode by default",
+			allowed:     true,
+		},
+		{
+			description:   "transport mode accepted",
+			notifications: transportRequested,
+			allowed:       true,
+			expTransport:  true,
+		},
+		{
+			description:   "transport mode ignored when tunnel is required",
+			notifications: transportRequested,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if transportMode := negotiateTransportMode(tc.notifications, tc.allowed); transportMode != tc.expTransport {
+				t.Errorf("transport mode mismatch. got = %v, want = %v", transportMode, tc.expTransport)
+			}
+		})
+	}
+}
@@ -6,9 +6,12 @@
 package handler
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"math"
 	"net"
+	"slices"
+	"time"
 
 	"github.com/omec-project/n3iwf/context"
 	"github.com/omec-project/n3iwf/ike/message"
@@ -16,18 +19,30 @@ import (
 	"github.com/omec-project/n3iwf/logger"
 )
 
-func SendIKEMessageToUE(udpConn *net.UDPConn, srcAddr, dstAddr *net.UDPAddr, ikeMsg *message.IKEMessage, ikeSAKey *security.IKESAKey) error {
+func SendIKEMessageToUE(udpConn context.IKEConn, srcAddr, dstAddr *net.UDPAddr, ikeMsg *message.IKEMessage, ikeSAKey *security.IKESAKey) error {
 	logger.IKELog.Debugln("send IKE ikeMsg to UE")
 	logger.IKELog.Debugln("encoding")
 
+	// Summarize the payloads before encryption replaces them with SK
+	var traceRecord *context.IKETraceRecord
+	n3iwfCtx := context.N3IWFSelf()
+	if n3iwfCtx.IKETracer != nil {
+		traceRecord = context.NewIKETraceRecord(context.TraceOutbound, srcAddr, dstAddr, ikeMsg)
+	}
+	if n3iwfCtx.IKETranscriptSize > 0 && ikeMsg.IKEHeader != nil {
+		if ikeSA, ok := n3iwfCtx.IKESALoad(ikeMsg.ResponderSPI); ok {
+			ikeSA.Transcript.Add(context.TraceOutbound, srcAddr, dstAddr, ikeMsg)
+		}
+	}
+
 	pkt, err := EncodeEncrypt(ikeMsg, ikeSAKey, message.Role_Responder)
 	if err != nil {
 		return fmt.Errorf("SendIKEMessageToUE: %w", err)
 	}
 
-	// RFC 7296 section 3.1: prepend 4 zero bytes for UDP port 4500
-	if srcAddr.Port == 4500 {
-		pkt = append(make([]byte, 4), pkt...)
+	// RFC 7296 section 3.1: IKE messages on the NAT-T port follow a non-ESP marker
+	if srcAddr.Port == message.NATTPort {
+		pkt = message.AddNonESPMarker(pkt)
 	}
 
 	logger.IKELog.Debugln("sending")
@@ -38,6 +53,10 @@ func SendIKEMessageToUE(udpConn *net.UDPConn, srcAddr, dstAddr *net.UDPAddr, ike
 	if n != len(pkt) {
 		return fmt.Errorf("not all of the data is sent. Total length: %d. Sent: %d", len(pkt), n)
 	}
+	n3iwfCtx.IKECapture.Capture(context.TraceOutbound, srcAddr, dstAddr, pkt)
+	if traceRecord != nil {
+		n3iwfCtx.IKETracer.TraceIKEMessage(traceRecord)
+	}
 	return nil
 }
 
@@ -48,7 +67,7 @@ func SendUEInformationExchange(
 	payload *message.IKEPayloadContainer,
 	initiator, response bool,
 	messageID uint32,
-	conn *net.UDPConn,
+	conn context.IKEConn,
 	ueAddr, n3iwfAddr *net.UDPAddr,
 ) {
 	msg := message.NewMessage(
@@ -59,17 +78,29 @@ func SendUEInformationExchange(
 		msg.Payloads = append(msg.Payloads, *payload...)
 	}
 	if err := SendIKEMessageToUE(conn, n3iwfAddr, ueAddr, msg, ikeSAKey); err != nil {
-		logger.IKELog.Errorf("SendUEInformationExchange err: %+v", err)
+		ikeSA.Log().Errorf("SendUEInformationExchange err: %+v", err)
 	}
 }
 
-// SendIKEDeleteRequest sends an IKE SA delete request to UE
+// Retransmission of the Delete requests and return routability checks sent to
+// the UE, replaced in tests
+var (
+	deleteRetransmitInterval = time.Second
+	deleteMaxRetransmissions = 5
+)
+
+// SendIKEDeleteRequest sends an IKE SA delete request to UE, without waiting
+// for the answer
 func SendIKEDeleteRequest(n3iwfCtx *context.N3IWFContext, localSPI uint64) {
 	ikeUe, ok := n3iwfCtx.IkeUePoolLoad(localSPI)
 	if !ok {
 		logger.IKELog.Errorf("cannot get IkeUE from SPI: %+v", localSPI)
 		return
 	}
+	sendIKEDelete(ikeUe, ikeUe.N3IWFIKESecurityAssociation.ResponderMessageID)
+}
+
+func sendIKEDelete(ikeUe *context.N3IWFIkeUe, messageID uint32) {
 	var deletePayload message.IKEPayloadContainer
 	deletePayload.BuildDeletePayload(message.TypeIKE, 0, 0, nil)
 	SendUEInformationExchange(
@@ -77,48 +108,320 @@ func SendIKEDeleteRequest(n3iwfCtx *context.N3IWFContext, localSPI uint64) {
 		ikeUe.N3IWFIKESecurityAssociation.IKESAKey,
 		&deletePayload,
 		false, false,
-		ikeUe.N3IWFIKESecurityAssociation.ResponderMessageID,
+		messageID,
 		ikeUe.IKEConnection.Conn,
 		ikeUe.IKEConnection.UEAddr,
 		ikeUe.IKEConnection.N3IWFAddr,
 	)
 }
 
-// SendChildSADeleteRequest deletes Child SAs for given release list and sends delete request
+// startIKESADelete sends an IKE Delete to the UE and removes the IKE UE context
+// when the UE acknowledges it, see completeIKESADelete, or once the request
+// was retransmitted deleteMaxRetransmissions times without answer. Nothing is
+// sent while an IKE Delete is already pending
+func startIKESADelete(ikeUe *context.N3IWFIkeUe) error {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	if ikeSA == nil || ikeUe.IKEConnection == nil {
+		return errors.New("startIKESADelete: IKE SA not established")
+	}
+	if ikeSA.PendingIKEDelete != nil {
+		return nil
+	}
+	// The UE would not answer the Delete either
+	if ikeSA.Unresponsive {
+		context.N3IWFSelf().AuditIKESATeardown(ikeSA, context.AuditDelete)
+		return ikeUe.Remove()
+	}
+
+	messageID := abandonN3IWFRequests(ikeSA)
+	ikeSA.PendingIKEDelete = &context.IKESADeleteRequest{
+		MessageID: messageID,
+		Retransmit: context.NewRetransmitTimer(ikeSA, deleteRetransmitInterval, deleteMaxRetransmissions,
+			func() { sendIKEDelete(ikeUe, messageID) },
+			func() {
+				ikeSA.Log().Warnf("IKE SA delete request %d unanswered, remove it", messageID)
+				ikeSA.PendingIKEDelete = nil
+				context.N3IWFSelf().AuditIKESATeardown(ikeSA, context.AuditDelete)
+				if err := ikeUe.Remove(); err != nil {
+					ikeSA.Log().Errorf("startIKESADelete(): %v", err)
+				}
+			}),
+	}
+	sendIKEDelete(ikeUe, messageID)
+	return nil
+}
+
+// abandonN3IWFRequests gives up the pending and queued requests of the
+// N3IWF, the IKE SA going away with its child SAs, and returns the message ID
+// of the IKE Delete replacing them. That of a request still unanswered is
+// taken over, the UE having no other request of the N3IWF in its window
+func abandonN3IWFRequests(ikeSA *context.IKESecurityAssociation) uint32 {
+	if pending := ikeSA.PendingChildSADelete; pending != nil {
+		pending.Retransmit.Stop()
+		ikeSA.PendingChildSADelete = nil
+	}
+	if pending := ikeSA.PendingChildSARekey; pending != nil {
+		pending.Retransmit.Stop()
+		ikeSA.PendingChildSARekey = nil
+	}
+	ikeSA.ChildSACreateRetransmit.Stop()
+	ikeSA.ChildSACreateRetransmit = nil
+	if ikeSA.DPDReqRetransTimer != nil {
+		ikeSA.DPDReqRetransTimer.Stop()
+		ikeSA.DPDReqRetransTimer = nil
+		ikeSA.NotifyLivenessWaiters(errors.New("IKE SA deleted"))
+	}
+	if pending := ikeSA.PendingAddressUpdate; pending != nil {
+		pending.Retransmit.Stop()
+		ikeSA.PendingAddressUpdate = nil
+	}
+	ikeSA.QueuedChildSADeletes = nil
+	ikeSA.QueuedRequests = nil
+
+	messageID := ikeSA.ResponderMessageID
+	// The CREATE_CHILD_SA response of the UE waits for the PDU session
+	// information, its message ID is already answered
+	if ikeSA.TemporaryIkeMsg != nil {
+		messageID++
+	}
+	return messageID
+}
+
+// releaseUnresponsiveUe asks the AMF to release the UE context once the UE
+// left a request of the N3IWF unanswered, RFC 7296 section 2.4 deeming the IKE
+// SA failed. The release removes the IKE UE context without another request,
+// see startIKESADelete, right away when the UE has no NGAP context. Nothing
+// else is sent to the UE meanwhile, see n3iwfRequestPending
+func releaseUnresponsiveUe(ikeUe *context.N3IWFIkeUe) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	n3iwfCtx := context.N3IWFSelf()
+	ikeSA.TeardownReason = context.AuditDPDTimeout
+	ikeSA.Unresponsive = true
+	ranNgapId, ok := n3iwfCtx.NgapIdLoad(ikeSA.LocalSPI)
+	if !ok {
+		n3iwfCtx.AuditIKESATeardown(ikeSA, context.AuditDPDTimeout)
+		if err := ikeUe.Remove(); err != nil {
+			ikeSA.Log().Errorf("releaseUnresponsiveUe(): %v", err)
+		}
+		return
+	}
+	err := n3iwfCtx.SendNgapEvent(context.NewSendUEContextReleaseRequestEvt(ranNgapId, context.ErrRadioConnWithUeLost))
+	if err != nil {
+		ikeSA.Log().Errorf("releaseUnresponsiveUe(): %v", err)
+	}
+}
+
+// SendChildSADeleteRequest asks the UE to delete the child SAs of the released
+// PDU sessions. They are removed, with their XFRM states, policies and per
+// session interface, and the PDU Session Resource Release Command answered,
+// when the UE acknowledges the request. The request waits for the delete still
+// pending, if any
 func SendChildSADeleteRequest(ikeUe *context.N3IWFIkeUe, releaseList []int64) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	if ikeSA == nil || ikeUe.IKEConnection == nil {
+		logger.IKELog.Errorln("SendChildSADeleteRequest: IKE SA not established")
+		return
+	}
+	deleteSPIs := ikeUe.PDUSessionChildSASPIs(releaseList)
+	if len(deleteSPIs) == 0 {
+		ikeSA.Log().Debugln("No Child SAs to delete for given release list")
+		ikeUe.ReleasePDUSessions(len(releaseList))
+		return
+	}
+	queueChildSADelete(ikeUe, &context.ChildSADeleteRequest{
+		InboundSPIs:         deleteSPIs,
+		ReleasedPDUSessions: releaseList,
+	})
+}
+
+// n3iwfRequestPending reports whether a request of the N3IWF waits for the UE
+// answer. Each request of the N3IWF takes ResponderMessageID, which only moves
+// on once the UE answers, so every sender checks it and waits its turn. An
+// unresponsive UE is sent nothing more
+func n3iwfRequestPending(ikeSA *context.IKESecurityAssociation) bool {
+	return ikeSA.Unresponsive || ikeSA.PendingChildSARekey != nil || ikeSA.PendingChildSADelete != nil ||
+		ikeSA.PendingIKEDelete != nil || ikeSA.ChildSACreateRetransmit != nil ||
+		ikeSA.TemporaryIkeMsg != nil || ikeSA.DPDReqRetransTimer != nil ||
+		ikeSA.PendingAddressUpdate != nil ||
+		(ikeSA.IkeUE != nil && len(ikeSA.IkeUE.TemporaryExchangeMsgIDChildSAMapping) > 0)
+}
+
+// queueN3IWFRequest has send, which sends a request of the N3IWF, called once
+// the pending requests were answered, see sendQueuedRequests
+func queueN3IWFRequest(ikeSA *context.IKESecurityAssociation, send func()) {
+	ikeSA.QueuedRequests = append(ikeSA.QueuedRequests, send)
+}
+
+// queueChildSADelete sends the ESP Delete of request once no other request of
+// the N3IWF waits for the UE answer
+func queueChildSADelete(ikeUe *context.N3IWFIkeUe, request *context.ChildSADeleteRequest) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.QueuedChildSADeletes = append(ikeSA.QueuedChildSADeletes, request)
+	sendQueuedRequests(ikeUe)
+}
+
+// sendQueuedRequests sends the next queued request of the N3IWF, the child SA
+// deletes first, unless another request is still pending. Called whenever a
+// request of the N3IWF is answered
+func sendQueuedRequests(ikeUe *context.N3IWFIkeUe) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	// A request failing to be sent leaves the way to the next one
+	for !n3iwfRequestPending(ikeSA) {
+		switch {
+		case len(ikeSA.QueuedChildSADeletes) > 0:
+			next := ikeSA.QueuedChildSADeletes[0]
+			ikeSA.QueuedChildSADeletes = ikeSA.QueuedChildSADeletes[1:]
+			sendChildSADelete(ikeUe, next)
+		case len(ikeSA.QueuedRequests) > 0:
+			next := ikeSA.QueuedRequests[0]
+			ikeSA.QueuedRequests = ikeSA.QueuedRequests[1:]
+			next()
+		default:
+			return
+		}
+	}
+}
+
+// SendChildSADeleteRequestBySPI asks the UE to delete the child SAs with the
+// given inbound SPIs. Their XFRM state is removed when the UE acknowledges the
+// request, see completeChildSADelete
+func SendChildSADeleteRequestBySPI(ikeUe *context.N3IWFIkeUe, inboundSPIs []uint32) error {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	if ikeSA == nil || ikeUe.IKEConnection == nil {
+		return errors.New("SendChildSADeleteRequestBySPI: IKE SA not established")
+	}
+	if n3iwfRequestPending(ikeSA) {
+		return fmt.Errorf("SendChildSADeleteRequestBySPI: request %d of the N3IWF still pending",
+			ikeSA.ResponderMessageID)
+	}
+
 	var deleteSPIs []uint32
-	spiLen := uint16(0)
-	for _, releaseID := range releaseList {
-		for _, childSA := range ikeUe.N3IWFChildSecurityAssociation {
-			if len(childSA.PDUSessionIds) == 0 || childSA.PDUSessionIds[0] != releaseID {
-				continue
-			}
-			spi := childSA.XfrmStateList[0].Spi
-			if spi < 0 || spi > math.MaxUint32 {
-				logger.IKELog.Errorf("SendChildSADeleteRequest spi out of uint32 range: %d", spi)
-				continue
-			}
-			deleteSPIs = append(deleteSPIs, uint32(spi))
-			spiLen++
-			if err := ikeUe.DeleteChildSA(childSA); err != nil {
-				logger.IKELog.Errorf("delete Child SA error: %+v", err)
-			}
+	for _, spi := range inboundSPIs {
+		if _, ok := ikeUe.N3IWFChildSecurityAssociation[spi]; !ok {
+			return fmt.Errorf("SendChildSADeleteRequestBySPI: unknown child SA 0x%08x", spi)
+		}
+		if !slices.Contains(deleteSPIs, spi) {
+			deleteSPIs = append(deleteSPIs, spi)
 		}
 	}
-	if spiLen == 0 {
-		logger.IKELog.Debugln("No Child SAs to delete for given release list")
+	if len(deleteSPIs) == 0 {
+		return errors.New("SendChildSADeleteRequestBySPI: no child SA to delete")
+	}
+
+	sendChildSADelete(ikeUe, &context.ChildSADeleteRequest{InboundSPIs: deleteSPIs})
+	return nil
+}
+
+// sendChildSADelete sends the ESP Delete of request and records it as pending
+// until the UE answers it. Once it was retransmitted deleteMaxRetransmissions
+// times without answer, the UE is released, see releaseUnresponsiveUe
+func sendChildSADelete(ikeUe *context.N3IWFIkeUe, request *context.ChildSADeleteRequest) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	request.MessageID = ikeSA.ResponderMessageID
+	send := func() {
+		var deletePayload message.IKEPayloadContainer
+		deletePayload.BuildDeletePayload(message.TypeESP, 4, uint16(len(request.InboundSPIs)), request.InboundSPIs)
+		SendUEInformationExchange(
+			ikeSA,
+			ikeSA.IKESAKey,
+			&deletePayload,
+			false, false,
+			request.MessageID,
+			ikeUe.IKEConnection.Conn,
+			ikeUe.IKEConnection.UEAddr,
+			ikeUe.IKEConnection.N3IWFAddr,
+		)
+	}
+	request.Retransmit = context.NewRetransmitTimer(ikeSA, deleteRetransmitInterval, deleteMaxRetransmissions,
+		send, func() {
+			ikeSA.Log().Warnf("child SA delete request %d unanswered, release the UE", request.MessageID)
+			releaseUnresponsiveUe(ikeUe)
+		})
+	ikeSA.PendingChildSADelete = request
+	send()
+}
+
+// sendChildSACreateRequest sends the CREATE_CHILD_SA request of a PDU session
+// and resends the same datagram until the UE answers it. Once the last
+// retransmission went unanswered the UE is released, see releaseUnresponsiveUe
+func sendChildSACreateRequest(ikeUe *context.N3IWFIkeUe, ikeMsg *message.IKEMessage) error {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	messageID := ikeMsg.MessageID
+	ikeSA.ChildSACreateRetransmit.Stop()
+	retransmit, err := sendRetransmittedChildSARequest(ikeUe, ikeMsg, func() {
+		ikeSA.Log().Warnf("CREATE_CHILD_SA request %d unanswered, release the UE", messageID)
+		releaseUnresponsiveUe(ikeUe)
+	})
+	if err != nil {
+		return err
+	}
+	ikeSA.ChildSACreateRetransmit = retransmit
+	return nil
+}
+
+// sendRetransmittedChildSARequest sends a CREATE_CHILD_SA request of the N3IWF
+// and resends the same datagram until the returned timer is stopped. giveUp is
+// called once the last retransmission went unanswered
+func sendRetransmittedChildSARequest(ikeUe *context.N3IWFIkeUe, ikeMsg *message.IKEMessage,
+	giveUp func(),
+) (*context.RetransmitTimer, error) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeConnection := ikeSA.IKEConnection
+	recorder := &responseRecorder{IKEConn: ikeConnection.Conn}
+	if err := SendIKEMessageToUE(recorder, ikeConnection.N3IWFAddr, ikeConnection.UEAddr, ikeMsg,
+		ikeSA.IKESAKey); err != nil {
+		return nil, err
+	}
+
+	n3iwfCtx := context.N3IWFSelf()
+	messageID, datagram := ikeMsg.MessageID, recorder.datagram
+	return context.NewRetransmitTimer(ikeSA, n3iwfCtx.ChildSARetransmitInterval,
+		n3iwfCtx.ChildSAMaxRetransmissions,
+		func() {
+			ikeSA.Log().Debugf("retransmit CREATE_CHILD_SA request %d", messageID)
+			ikeConnection := ikeSA.IKEConnection
+			if _, err := ikeConnection.Conn.WriteToUDP(datagram, ikeConnection.UEAddr); err != nil {
+				ikeSA.Log().Errorf("sendRetransmittedChildSARequest(): %v", err)
+				return
+			}
+			n3iwfCtx.IKECapture.Capture(context.TraceOutbound, ikeConnection.N3IWFAddr, ikeConnection.UEAddr,
+				datagram)
+		}, giveUp), nil
+}
+
+// responseRecorder keeps the last datagram sent through IKEConn, so that the
+// response to a request can be cached and resent if the UE retransmits it
+type responseRecorder struct {
+	context.IKEConn
+	datagram []byte
+}
+
+func (r *responseRecorder) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	n, err := r.IKEConn.WriteToUDP(b, addr)
+	if err == nil {
+		r.datagram = bytes.Clone(b)
+	}
+	return n, err
+}
+
+// cacheChildSAResponse records the datagram sent through recorder as the
+// answer to the CREATE_CHILD_SA request with messageID
+func cacheChildSAResponse(ikeSA *context.IKESecurityAssociation, messageID uint32, recorder *responseRecorder) {
+	if recorder.datagram == nil {
 		return
 	}
-	var deletePayload message.IKEPayloadContainer
-	deletePayload.BuildDeletePayload(message.TypeESP, 4, spiLen, deleteSPIs)
-	SendUEInformationExchange(
-		ikeUe.N3IWFIKESecurityAssociation,
-		ikeUe.N3IWFIKESecurityAssociation.IKESAKey,
-		&deletePayload,
-		false, false,
-		ikeUe.N3IWFIKESecurityAssociation.ResponderMessageID,
-		ikeUe.IKEConnection.Conn,
-		ikeUe.IKEConnection.UEAddr,
-		ikeUe.IKEConnection.N3IWFAddr,
-	)
+	ikeSA.LastChildSAResponse = &context.CachedResponse{MessageID: messageID, Datagram: recorder.datagram}
+}
+
+// resendCachedResponse answers a retransmitted request with the datagram that
+// answered it the first time, RFC 7296 section 2.1
+func resendCachedResponse(udpConn context.IKEConn, n3iwfAddr, ueAddr *net.UDPAddr,
+	ikeSA *context.IKESecurityAssociation, cached *context.CachedResponse,
+) error {
+	ikeSA.Log().Debugf("resend the response to the retransmitted request (message ID %d)", cached.MessageID)
+	if _, err := udpConn.WriteToUDP(cached.Datagram, ueAddr); err != nil {
+		return fmt.Errorf("resendCachedResponse: %w", err)
+	}
+	context.N3IWFSelf().IKECapture.Capture(context.TraceOutbound, n3iwfAddr, ueAddr, cached.Datagram)
+	return nil
 }
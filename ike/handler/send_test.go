@@ -0,0 +1,561 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// newDeleteTestIkeUe returns an established IKE UE talking to ueConn
+func newDeleteTestIkeUe(t *testing.T) (*context.N3IWFIkeUe, *net.UDPConn) {
+	t.Helper()
+	n3iwfConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { n3iwfConn.Close() })
+	ueConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { ueConn.Close() })
+
+	n3iwfCtx := context.N3IWFSelf()
+	ikeSA := n3iwfCtx.NewIKESecurityAssociation()
+	ikeSA.StopHalfOpenTimer()
+	ikeSA.IKESAKey = newTestIKESAKey(t)
+	ikeSA.ResponderMessageID = 7
+	ikeUe := n3iwfCtx.NewN3iwfIkeUe(ikeSA.LocalSPI)
+	ikeUe.N3IWFIKESecurityAssociation = ikeSA
+	ikeSA.IkeUE = ikeUe
+	ikeUe.IKEConnection = &context.UDPSocketInfo{
+		Conn:      n3iwfConn,
+		N3IWFAddr: n3iwfConn.LocalAddr().(*net.UDPAddr),
+		UEAddr:    ueConn.LocalAddr().(*net.UDPAddr),
+	}
+	ikeSA.IKEConnection = ikeUe.IKEConnection
+	t.Cleanup(func() {
+		n3iwfCtx.DeleteIKESecurityAssociation(ikeSA.LocalSPI)
+		n3iwfCtx.DeleteIKEUe(ikeSA.LocalSPI)
+	})
+	return ikeUe, ueConn
+}
+
+// readDeleteRequest reads the next request received by ueConn and returns its
+// message ID and Delete payload
+func readDeleteRequest(t *testing.T, ueConn *net.UDPConn, ikeUe *context.N3IWFIkeUe) (uint32, *message.Delete) {
+	t.Helper()
+	if err := ueConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := ueConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("delete request not received: %v", err)
+	}
+	ikeHeader, err := message.ParseHeader(buf[:n])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The keys are shared with the retransmissions of the N3IWF
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.Lock()
+	request, err := DecodeDecrypt(buf[:n], ikeHeader, ikeSA.IKESAKey, message.Role_Initiator)
+	ikeSA.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(request.Payloads) != 1 {
+		t.Fatalf("payloads mismatch. got = %d, want = 1", len(request.Payloads))
+	}
+	deletePayload, ok := request.Payloads[0].(*message.Delete)
+	if !ok {
+		t.Fatalf("Unexpected payload: %+v", request.Payloads[0])
+	}
+	return request.MessageID, deletePayload
+}
+
+func answerDelete(ikeUe *context.N3IWFIkeUe, messageID uint32) {
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	answer := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.INFORMATIONAL, true, false, messageID, nil)
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	HandleInformational(ikeUe.IKEConnection.Conn, ikeUe.IKEConnection.N3IWFAddr, ikeUe.IKEConnection.UEAddr,
+		answer, ikeSA)
+}
+
+func TestSendChildSADeleteRequest(t *testing.T) {
+	retransmitInterval := deleteRetransmitInterval
+	defer func() { deleteRetransmitInterval = retransmitInterval }()
+	deleteRetransmitInterval = 20 * time.Millisecond
+
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	n3iwfCtx := context.N3IWFSelf()
+	for i, spi := range []uint32{0x1001, 0x1002} {
+		childSA := &context.ChildSecurityAssociation{InboundSPI: spi, IkeUE: ikeUe, PDUSessionIds: []int64{int64(i + 1)}}
+		ikeUe.N3IWFChildSecurityAssociation[spi] = childSA
+		n3iwfCtx.ChildSA.Store(spi, childSA)
+		defer n3iwfCtx.ChildSA.Delete(spi)
+	}
+	ikeUe.PduSessionListLen = 2
+
+	ikeSA.Lock()
+	SendChildSADeleteRequest(ikeUe, []int64{1})
+	// Sent once the first delete is answered
+	SendChildSADeleteRequest(ikeUe, []int64{2})
+	ikeSA.Unlock()
+
+	messageID, deletePayload := readDeleteRequest(t, ueConn, ikeUe)
+	if messageID != 7 || !slices.Equal(deletePayload.SPIs, []uint32{0x1001}) {
+		t.Fatalf("Unexpected delete request %d: %x", messageID, deletePayload.SPIs)
+	}
+	// Unanswered requests are retransmitted with the same message ID
+	retransmittedID, retransmitted := readDeleteRequest(t, ueConn, ikeUe)
+	if retransmittedID != messageID || !slices.Equal(retransmitted.SPIs, deletePayload.SPIs) {
+		t.Fatalf("Unexpected retransmission %d: %x", retransmittedID, retransmitted.SPIs)
+	}
+
+	ikeSA.Lock()
+	_, kept := ikeUe.N3IWFChildSecurityAssociation[0x1001]
+	ikeSA.Unlock()
+	if !kept {
+		t.Fatalf("child SA 0x1001 deleted before the acknowledgement")
+	}
+
+	answerDelete(ikeUe, messageID)
+	ikeSA.Lock()
+	_, kept = ikeUe.N3IWFChildSecurityAssociation[0x1001]
+	ikeSA.Unlock()
+	if kept {
+		t.Errorf("child SA 0x1001 was not deleted")
+	}
+	if ikeUe.PduSessionListLen != 1 {
+		t.Errorf("PduSessionListLen mismatch. got = %d, want = %d", ikeUe.PduSessionListLen, 1)
+	}
+
+	// Drain the retransmissions sent before the answer
+	for {
+		messageID, deletePayload = readDeleteRequest(t, ueConn, ikeUe)
+		if messageID != 7 {
+			break
+		}
+	}
+	if messageID != 8 || !slices.Equal(deletePayload.SPIs, []uint32{0x1002}) {
+		t.Fatalf("Unexpected queued delete request %d: %x", messageID, deletePayload.SPIs)
+	}
+	answerDelete(ikeUe, messageID)
+
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	if len(ikeUe.N3IWFChildSecurityAssociation) != 0 {
+		t.Errorf("Unexpected child SAs left: %d", len(ikeUe.N3IWFChildSecurityAssociation))
+	}
+	if ikeSA.PendingChildSADelete != nil || len(ikeSA.QueuedChildSADeletes) != 0 {
+		t.Errorf("Unexpected pending delete: %+v", ikeSA.PendingChildSADelete)
+	}
+	if ikeSA.ResponderMessageID != 9 {
+		t.Errorf("ResponderMessageID mismatch. got = %d, want = %d", ikeSA.ResponderMessageID, 9)
+	}
+}
+
+func TestChildSADeleteUnanswered(t *testing.T) {
+	retransmitInterval, maxRetransmissions := deleteRetransmitInterval, deleteMaxRetransmissions
+	defer func() {
+		deleteRetransmitInterval, deleteMaxRetransmissions = retransmitInterval, maxRetransmissions
+	}()
+	deleteRetransmitInterval, deleteMaxRetransmissions = 10*time.Millisecond, 1
+
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.Lock()
+	queueChildSADelete(ikeUe, &context.ChildSADeleteRequest{InboundSPIs: []uint32{0x1001}})
+	ikeSA.Unlock()
+	readDeleteRequest(t, ueConn, ikeUe)
+	readDeleteRequest(t, ueConn, ikeUe)
+
+	// Without NGAP context, the UE is removed right away
+	waitIkeUeRemoved(t, ikeSA.LocalSPI)
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	if !ikeSA.Unresponsive || ikeSA.TeardownReason != context.AuditDPDTimeout {
+		t.Errorf("unresponsive SA mismatch: unresponsive %v, reason %v", ikeSA.Unresponsive, ikeSA.TeardownReason)
+	}
+}
+
+// waitIkeUeRemoved waits for the IKE UE context of the IKE SA localSPI to be
+// removed
+func waitIkeUeRemoved(t *testing.T, localSPI uint64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := context.N3IWFSelf().IkeUePoolLoad(localSPI); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("IKE UE context not removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIKESADelete(t *testing.T) {
+	retransmitInterval, maxRetransmissions := deleteRetransmitInterval, deleteMaxRetransmissions
+	defer func() {
+		deleteRetransmitInterval, deleteMaxRetransmissions = retransmitInterval, maxRetransmissions
+	}()
+	deleteRetransmitInterval, deleteMaxRetransmissions = 10*time.Millisecond, 2
+
+	testcases := []struct {
+		description string
+		answer      bool
+	}{
+		{
+			description: "acknowledged",
+			answer:      true,
+		},
+		{
+			description: "unanswered",
+		},
+	}
+
+	n3iwfCtx := context.N3IWFSelf()
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeUe, ueConn := newDeleteTestIkeUe(t)
+			localSPI := ikeUe.N3IWFIKESecurityAssociation.LocalSPI
+
+			HandleEvent(context.NewIKEDeleteRequestEvt(localSPI))
+			messageID, deletePayload := readDeleteRequest(t, ueConn, ikeUe)
+			if deletePayload.ProtocolID != message.TypeIKE {
+				t.Fatalf("protocol ID mismatch. got = %d, want = %d", deletePayload.ProtocolID, message.TypeIKE)
+			}
+			if tc.answer {
+				if _, ok := n3iwfCtx.IkeUePoolLoad(localSPI); !ok {
+					t.Fatalf("IKE UE removed before the acknowledgement")
+				}
+				answerDelete(ikeUe, messageID)
+			} else {
+				for range deleteMaxRetransmissions {
+					readDeleteRequest(t, ueConn, ikeUe)
+				}
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for {
+				_, ok := n3iwfCtx.IkeUePoolLoad(localSPI)
+				if !ok {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("IKE UE %016x was not removed", localSPI)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if _, ok := n3iwfCtx.IKESALoad(localSPI); ok {
+				t.Errorf("IKE SA %016x was not removed", localSPI)
+			}
+		})
+	}
+}
+
+func TestSendIKEMessageToUENonESPMarker(t *testing.T) {
+	ueAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 4500}
+	testcases := []struct {
+		description string
+		port        int
+		expMarker   bool
+	}{
+		{description: "IKE port", port: 500},
+		{description: "NAT-T port", port: message.NATTPort, expMarker: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: tc.port}
+			ikeMsg := message.NewMessage(0x1111, 0x2222, message.INFORMATIONAL, true, false, 3, nil)
+			encoded, err := ikeMsg.Encode()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			conn := new(fakeIKEConn)
+			if err = SendIKEMessageToUE(conn, n3iwfAddr, ueAddr, ikeMsg, nil); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			expected := encoded
+			if tc.expMarker {
+				expected = message.AddNonESPMarker(encoded)
+			}
+			if datagram := conn.next(t).data; !slices.Equal(datagram, expected) {
+				t.Errorf("datagram mismatch. got = %x, want = %x", datagram, expected)
+			}
+		})
+	}
+}
+
+func TestSendLivenessCheck(t *testing.T) {
+	retransmitInterval := dpdRetransmitInterval
+	defer func() { dpdRetransmitInterval = retransmitInterval }()
+	dpdRetransmitInterval = 20 * time.Millisecond
+
+	testcases := []struct {
+		description string
+		outstanding bool
+		answer      bool
+		expErr      error
+	}{
+		{description: "answered", answer: true},
+		{description: "unanswered", expErr: context.ErrDPDTimeout},
+		{description: "periodic DPD request outstanding", outstanding: true, answer: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeUe, ueConn := newDeleteTestIkeUe(t)
+			ikeSA := ikeUe.N3IWFIKESecurityAssociation
+			periodic := &context.Timer{}
+			if tc.outstanding {
+				ikeSA.DPDReqRetransTimer = periodic
+			}
+
+			result := make(chan error, 1)
+			ikeSA.Lock()
+			sendLivenessCheck(ikeUe, result)
+			ikeSA.Unlock()
+
+			if !tc.outstanding {
+				if err := ueConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				buf := make([]byte, 1500)
+				n, _, err := ueConn.ReadFromUDP(buf)
+				if err != nil {
+					t.Fatalf("DPD request not received: %v", err)
+				}
+				ikeMsg, err := message.ParseHeader(buf[:n])
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if ikeMsg.ExchangeType != message.INFORMATIONAL || ikeMsg.IsResponse() {
+					t.Errorf("DPD request mismatch. got = %+v", ikeMsg)
+				}
+			} else if ikeSA.DPDReqRetransTimer != periodic {
+				t.Errorf("outstanding DPD request replaced")
+			}
+
+			if tc.answer {
+				ikeMsg := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.INFORMATIONAL, true, true,
+					ikeSA.ResponderMessageID, nil)
+				ikeSA.Lock()
+				err := handleInformational(nil, nil, nil, ikeMsg, ikeSA)
+				ikeSA.Unlock()
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			select {
+			case err := <-result:
+				if !errors.Is(err, tc.expErr) {
+					t.Errorf("error mismatch. got = %v, want = %v", err, tc.expErr)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("liveness check not reported")
+			}
+			ikeSA.Lock()
+			defer ikeSA.Unlock()
+			if ikeSA.DPDReqRetransTimer != nil {
+				t.Errorf("DPD request still outstanding")
+			}
+			// Unanswered, the UE is released and its message ID not reused
+			if ikeSA.Unresponsive != (tc.expErr != nil) || ikeSA.ResponderMessageID != 8 {
+				t.Errorf("SA mismatch: unresponsive %v, message ID %d", ikeSA.Unresponsive, ikeSA.ResponderMessageID)
+			}
+		})
+	}
+}
+
+func TestSendLivenessCheckQueued(t *testing.T) {
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	ikeSA.PendingChildSARekey = &context.ChildSARekeyRequest{MessageID: 7}
+
+	result := make(chan error, 1)
+	sendLivenessCheck(ikeUe, result)
+	if ikeSA.DPDReqRetransTimer != nil || len(ikeSA.QueuedRequests) != 1 {
+		t.Fatalf("DPD request sent while the rekey is pending")
+	}
+
+	// Sent with the next message ID once the rekey is answered
+	ikeSA.PendingChildSARekey = nil
+	ikeSA.ResponderMessageID++
+	sendQueuedRequests(ikeUe)
+	ikeMsg, err := message.ParseHeader(readDatagram(t, ueConn))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ikeMsg.ExchangeType != message.INFORMATIONAL || ikeMsg.IsResponse() || ikeMsg.MessageID != 8 {
+		t.Errorf("DPD request mismatch. got = %+v", ikeMsg)
+	}
+	ikeSA.DPDReqRetransTimer.Stop()
+}
+
+// readDatagram returns the next datagram received by ueConn
+func readDatagram(t *testing.T, ueConn *net.UDPConn) []byte {
+	t.Helper()
+	if err := ueConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := ueConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("datagram not received: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestChildSACreateRetransmission(t *testing.T) {
+	n3iwfCtx := context.N3IWFSelf()
+	retransmitInterval, maxRetransmissions := n3iwfCtx.ChildSARetransmitInterval, n3iwfCtx.ChildSAMaxRetransmissions
+	defer func() {
+		n3iwfCtx.ChildSARetransmitInterval, n3iwfCtx.ChildSAMaxRetransmissions = retransmitInterval, maxRetransmissions
+	}()
+	n3iwfCtx.ChildSARetransmitInterval, n3iwfCtx.ChildSAMaxRetransmissions = 10*time.Millisecond, 2
+
+	testcases := []struct {
+		description string
+		answer      bool
+	}{
+		{
+			description: "answered",
+			answer:      true,
+		},
+		{
+			description: "unanswered",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeUe, ueConn := newDeleteTestIkeUe(t)
+			ikeSA := ikeUe.N3IWFIKESecurityAssociation
+			ikeUe.CreateHalfChildSA(7, 0x1001, 1)
+
+			request := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.CREATE_CHILD_SA, false, false,
+				7, nil)
+			ikeSA.Lock()
+			err := sendChildSACreateRequest(ikeUe, request)
+			ikeSA.Unlock()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			sent := readDatagram(t, ueConn)
+			// The request is resent as is
+			if retransmitted := readDatagram(t, ueConn); !slices.Equal(retransmitted, sent) {
+				t.Fatalf("retransmission mismatch. got = %x, want = %x", retransmitted, sent)
+			}
+
+			if !tc.answer {
+				readDatagram(t, ueConn)
+				// Without NGAP context, the UE is removed right away
+				waitIkeUeRemoved(t, ikeSA.LocalSPI)
+				ikeSA.Lock()
+				defer ikeSA.Unlock()
+				if ikeSA.TemporaryIkeMsg != nil || !ikeSA.Unresponsive || ikeSA.ResponderMessageID != 7 {
+					t.Errorf("unresponsive SA mismatch: temporary message %+v, unresponsive %v, message ID %d",
+						ikeSA.TemporaryIkeMsg, ikeSA.Unresponsive, ikeSA.ResponderMessageID)
+				}
+				return
+			}
+
+			var payloads message.IKEPayloadContainer
+			payloads.BuildNotification(message.TypeNone, message.NO_ADDITIONAL_SAS, nil, nil)
+			response := message.NewMessage(ikeSA.RemoteSPI, ikeSA.LocalSPI, message.CREATE_CHILD_SA, true,
+				false, 7, payloads)
+			conn := ikeUe.IKEConnection
+			for range 2 {
+				ikeSA.Lock()
+				// Without NGAP context the PDU session information cannot be requested
+				_ = handleCREATECHILDSA(conn.Conn, conn.N3IWFAddr, conn.UEAddr, response, ikeSA)
+				ikeSA.Unlock()
+			}
+			ikeSA.Lock()
+			waiting := ikeSA.TemporaryIkeMsg != nil && ikeSA.ChildSACreateRetransmit == nil
+			ikeSA.Unlock()
+			if !waiting {
+				t.Fatalf("CREATE_CHILD_SA request still pending")
+			}
+
+			setupData := &context.PDUSessionSetupTemporaryData{
+				UnactivatedPDUSession: []*context.PDUSession{{Id: 1}},
+				Index:                 1,
+			}
+			ikeSA.Lock()
+			continueCreateChildSA(ikeSA, setupData)
+			ikeSA.Unlock()
+			if len(setupData.FailedErrStr) != 1 || setupData.FailedErrStr[0] != context.ErrNoAdditionalSAs {
+				t.Errorf("FailedErrStr mismatch. got = %v, want = [%v]", setupData.FailedErrStr,
+					context.ErrNoAdditionalSAs)
+			}
+			if ikeSA.ResponderMessageID != 8 {
+				t.Errorf("ResponderMessageID mismatch. got = %d, want = %d", ikeSA.ResponderMessageID, 8)
+			}
+		})
+	}
+}
+
+func TestN3IWFRequestWindow(t *testing.T) {
+	ikeUe, ueConn := newDeleteTestIkeUe(t)
+	ikeSA := ikeUe.N3IWFIKESecurityAssociation
+	ikeSA.Lock()
+	defer ikeSA.Unlock()
+	ikeSA.PendingChildSARekey = &context.ChildSARekeyRequest{MessageID: 7}
+
+	// The PDU session waits for the rekey, without taking its message ID
+	setupData := &context.PDUSessionSetupTemporaryData{UnactivatedPDUSession: []*context.PDUSession{{Id: 1}}}
+	CreatePDUSessionChildSA(ikeUe, setupData)
+	if len(ikeSA.QueuedRequests) != 1 || len(ikeUe.TemporaryExchangeMsgIDChildSAMapping) != 0 {
+		t.Fatalf("CREATE_CHILD_SA of the PDU session not queued: %d queued", len(ikeSA.QueuedRequests))
+	}
+	var sent []string
+	queueN3IWFRequest(ikeSA, func() { sent = append(sent, "request") })
+	queueChildSADelete(ikeUe, &context.ChildSADeleteRequest{InboundSPIs: []uint32{0x1001}})
+	if ikeSA.PendingChildSADelete != nil {
+		t.Fatalf("child SA delete sent while the rekey is pending")
+	}
+
+	// Once answered, the deletes go first, then the requests in order. Without
+	// NGAP context, the PDU session is not set up
+	ikeSA.PendingChildSARekey = nil
+	ikeSA.ResponderMessageID++
+	sendQueuedRequests(ikeUe)
+	if ikeSA.PendingChildSADelete == nil || ikeSA.PendingChildSADelete.MessageID != 8 {
+		t.Fatalf("pending delete mismatch: %+v", ikeSA.PendingChildSADelete)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("request sent while the delete is pending")
+	}
+	ikeSA.Unlock()
+	if messageID, _ := readDeleteRequest(t, ueConn, ikeUe); messageID != 8 {
+		t.Errorf("delete message ID mismatch. got = %d, want = 8", messageID)
+	}
+	answerDelete(ikeUe, 8)
+	ikeSA.Lock()
+	if !slices.Equal(sent, []string{"request"}) || len(ikeSA.QueuedRequests) != 0 {
+		t.Errorf("queued request not sent after the delete: %v", sent)
+	}
+	if ikeSA.ResponderMessageID != 9 {
+		t.Errorf("ResponderMessageID mismatch. got = %d, want = 9", ikeSA.ResponderMessageID)
+	}
+}
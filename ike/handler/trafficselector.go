@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"golang.org/x/sys/unix"
+)
+
+// childSASelector is the protocol and ports carried by a child SA, any when 0
+type childSASelector struct {
+	ipProtocol uint8
+	localPort  uint16
+	remotePort uint16
+}
+
+// cpChildSASelector returns the selector allowed on the CP child SA: NAS over
+// TCP, restricted to the NAS TCP port of the N3IWF if so configured
+func cpChildSASelector(n3iwfCtx *context.N3IWFContext) childSASelector {
+	selector := childSASelector{ipProtocol: unix.IPPROTO_TCP}
+	if n3iwfCtx.CPChildSANASPortOnly {
+		selector.localPort = n3iwfCtx.TcpPort
+	}
+	return selector
+}
+
+// narrowChildSASelector intersects the traffic selectors of the peer with the
+// protocol and ports the N3IWF allows on the child SA, as in RFC 7296 section
+// 2.9. XFRM policies match a single port or any, so a port range other than
+// the full one is narrowed to its first port. Ports only apply to a selected
+// protocol
+func narrowChildSASelector(allowed childSASelector,
+	localTS, remoteTS *message.IndividualTrafficSelector,
+) (childSASelector, error) {
+	var narrowed childSASelector
+	var err error
+	narrowed.ipProtocol, err = narrowIPProtocol(allowed.ipProtocol, localTS.IPProtocolID)
+	if err != nil {
+		return narrowed, fmt.Errorf("narrowChildSASelector: local %w", err)
+	}
+	narrowed.ipProtocol, err = narrowIPProtocol(narrowed.ipProtocol, remoteTS.IPProtocolID)
+	if err != nil {
+		return narrowed, fmt.Errorf("narrowChildSASelector: remote %w", err)
+	}
+	if narrowed.ipProtocol == message.IPProtocolAll {
+		return narrowed, nil
+	}
+	narrowed.localPort, err = narrowPort(allowed.localPort, localTS)
+	if err != nil {
+		return narrowed, fmt.Errorf("narrowChildSASelector: local %w", err)
+	}
+	narrowed.remotePort, err = narrowPort(allowed.remotePort, remoteTS)
+	if err != nil {
+		return narrowed, fmt.Errorf("narrowChildSASelector: remote %w", err)
+	}
+	return narrowed, nil
+}
+
+func narrowIPProtocol(allowed, proposed uint8) (uint8, error) {
+	switch {
+	case allowed == message.IPProtocolAll:
+		return proposed, nil
+	case proposed == message.IPProtocolAll, proposed == allowed:
+		return allowed, nil
+	default:
+		return 0, fmt.Errorf("protocol %d, %d expected", proposed, allowed)
+	}
+}
+
+func narrowPort(allowed uint16, ts *message.IndividualTrafficSelector) (uint16, error) {
+	// RFC 4301 OPAQUE ports, only matched by any port
+	if ts.StartPort > ts.EndPort {
+		if allowed != 0 {
+			return 0, fmt.Errorf("opaque ports, port %d expected", allowed)
+		}
+		return 0, nil
+	}
+	if allowed != 0 {
+		if allowed < ts.StartPort || allowed > ts.EndPort {
+			return 0, fmt.Errorf("ports %d-%d, port %d expected", ts.StartPort, ts.EndPort, allowed)
+		}
+		return allowed, nil
+	}
+	if ts.StartPort == 0 && ts.EndPort == math.MaxUint16 {
+		return 0, nil
+	}
+	return ts.StartPort, nil
+}
+
+// portRange returns the traffic selector ports of port, any when 0
+func portRange(port uint16) (uint16, uint16) {
+	if port == 0 {
+		return 0, math.MaxUint16
+	}
+	return port, port
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"net"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"golang.org/x/sys/unix"
+)
+
+func newTrafficSelector(ipProtocol uint8, startPort, endPort uint16) *message.IndividualTrafficSelector {
+	return &message.IndividualTrafficSelector{
+		TSType:       message.TS_IPV4_ADDR_RANGE,
+		IPProtocolID: ipProtocol,
+		StartPort:    startPort,
+		EndPort:      endPort,
+		StartAddress: net.IPv4(10, 0, 0, 1).To4(),
+		EndAddress:   net.IPv4(10, 0, 0, 1).To4(),
+	}
+}
+
+func TestNarrowChildSASelector(t *testing.T) {
+	tcp := uint8(unix.IPPROTO_TCP)
+	testcases := []struct {
+		description string
+		allowed     childSASelector
+		localTS     *message.IndividualTrafficSelector
+		remoteTS    *message.IndividualTrafficSelector
+		expSelector childSASelector
+		expErr      bool
+	}{
+		{
+			description: "any traffic narrowed to TCP",
+			allowed:     childSASelector{ipProtocol: tcp},
+			localTS:     newTrafficSelector(message.IPProtocolAll, 0, 65535),
+			remoteTS:    newTrafficSelector(message.IPProtocolAll, 0, 65535),
+			expSelector: childSASelector{ipProtocol: tcp},
+		},
+		{
+			description: "any traffic narrowed to the NAS TCP port",
+			allowed:     childSASelector{ipProtocol: tcp, localPort: 20000},
+			localTS:     newTrafficSelector(message.IPProtocolAll, 0, 65535),
+			remoteTS:    newTrafficSelector(message.IPProtocolAll, 0, 65535),
+			expSelector: childSASelector{ipProtocol: tcp, localPort: 20000},
+		},
+		{
+			description: "ports of the UE honored",
+			allowed:     childSASelector{ipProtocol: tcp},
+			localTS:     newTrafficSelector(tcp, 20000, 20000),
+			remoteTS:    newTrafficSelector(tcp, 4000, 4100),
+			expSelector: childSASelector{ipProtocol: tcp, localPort: 20000, remotePort: 4000},
+		},
+		{
+			description: "protocol of the UE honored",
+			allowed:     childSASelector{},
+			localTS:     newTrafficSelector(message.IPProtocolAll, 0, 65535),
+			remoteTS:    newTrafficSelector(unix.IPPROTO_UDP, 53, 53),
+			expSelector: childSASelector{ipProtocol: unix.IPPROTO_UDP, remotePort: 53},
+		},
+		{
+			description: "opaque ports",
+			allowed:     childSASelector{ipProtocol: tcp},
+			localTS:     newTrafficSelector(tcp, 65535, 0),
+			remoteTS:    newTrafficSelector(tcp, 0, 65535),
+			expSelector: childSASelector{ipProtocol: tcp},
+		},
+		{
+			description: "protocol excluded",
+			allowed:     childSASelector{ipProtocol: unix.IPPROTO_GRE},
+			localTS:     newTrafficSelector(message.IPProtocolAll, 0, 65535),
+			remoteTS:    newTrafficSelector(unix.IPPROTO_UDP, 0, 65535),
+			expErr:      true,
+		},
+		{
+			description: "NAS TCP port excluded",
+			allowed:     childSASelector{ipProtocol: tcp, localPort: 20000},
+			localTS:     newTrafficSelector(tcp, 443, 443),
+			remoteTS:    newTrafficSelector(tcp, 0, 65535),
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			selector, err := narrowChildSASelector(tc.allowed, tc.localTS, tc.remoteTS)
+			if tc.expErr {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if selector != tc.expSelector {
+				t.Errorf("selector mismatch. got = %+v, want = %+v", selector, tc.expSelector)
+			}
+		})
+	}
+}
+
+func TestCPChildSASelector(t *testing.T) {
+	n3iwfCtx := &context.N3IWFContext{TcpPort: 20000}
+	if selector := cpChildSASelector(n3iwfCtx); selector != (childSASelector{ipProtocol: unix.IPPROTO_TCP}) {
+		t.Errorf("selector mismatch. got = %+v", selector)
+	}
+	n3iwfCtx.CPChildSANASPortOnly = true
+	expSelector := childSASelector{ipProtocol: unix.IPPROTO_TCP, localPort: 20000}
+	if selector := cpChildSASelector(n3iwfCtx); selector != expSelector {
+		t.Errorf("selector mismatch. got = %+v, want = %+v", selector, expSelector)
+	}
+}
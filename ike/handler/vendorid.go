@@ -0,0 +1,24 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// negotiateVendorID records the Vendor IDs sent by the UE in IKE_SA_INIT and
+// adds the Vendor ID of the N3IWF to the response when one is configured
+func negotiateVendorID(n3iwfCtx *context.N3IWFContext, ikeSecurityAssociation *context.IKESecurityAssociation,
+	vendorIDs []*message.VendorID, responseIKEPayload *message.IKEPayloadContainer,
+) {
+	for _, vendorID := range vendorIDs {
+		ikeSecurityAssociation.Log().Infof("UE Vendor ID: %x", vendorID.VendorIDData)
+		ikeSecurityAssociation.PeerVendorIDs = append(ikeSecurityAssociation.PeerVendorIDs, vendorID.VendorIDData)
+	}
+	if len(n3iwfCtx.VendorID) != 0 {
+		responseIKEPayload.BuildVendorID(n3iwfCtx.VendorID)
+	}
+}
@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package handler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestNegotiateVendorID(t *testing.T) {
+	peerVendorID := []byte{0x4f, 0x70, 0x65, 0x6e}
+	localVendorID := []byte{0x6e, 0x33, 0x69, 0x77, 0x66}
+	testcases := []struct {
+		description   string
+		localVendorID []byte
+		vendorIDs     []*message.VendorID
+		expPeer       int
+	}{
+		{
+			description: "no vendor ID configured or received",
+		},
+		{
+			description: "vendor ID received",
+			vendorIDs:   []*message.VendorID{{VendorIDData: peerVendorID}},
+			expPeer:     1,
+		},
+		{
+			description:   "vendor ID configured",
+			localVendorID: localVendorID,
+			vendorIDs:     []*message.VendorID{{VendorIDData: peerVendorID}, {VendorIDData: localVendorID}},
+			expPeer:       2,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx := &context.N3IWFContext{VendorID: tc.localVendorID}
+			ikeSA := &context.IKESecurityAssociation{}
+			var response message.IKEPayloadContainer
+			negotiateVendorID(n3iwfCtx, ikeSA, tc.vendorIDs, &response)
+			if len(ikeSA.PeerVendorIDs) != tc.expPeer {
+				t.Fatalf("PeerVendorIDs mismatch. got = %d, want = %d", len(ikeSA.PeerVendorIDs), tc.expPeer)
+			}
+			if tc.expPeer > 0 && !bytes.Equal(ikeSA.PeerVendorIDs[0], peerVendorID) {
+				t.Errorf("PeerVendorIDs[0] mismatch. got = %x, want = %x", ikeSA.PeerVendorIDs[0], peerVendorID)
+			}
+			if tc.localVendorID == nil {
+				if len(response) != 0 {
+					t.Errorf("unexpected response payloads: %d", len(response))
+				}
+				return
+			}
+			if len(response) != 1 {
+				t.Fatalf("response payloads mismatch. got = %d, want = 1", len(response))
+			}
+			vendorID, ok := response[0].(*message.VendorID)
+			if !ok || !bytes.Equal(vendorID.VendorIDData, tc.localVendorID) {
+				t.Errorf("response Vendor ID mismatch. got = %+v, want = %x", response[0], tc.localVendorID)
+			}
+		})
+	}
+}
@@ -117,6 +117,13 @@ func (container *IKEPayloadContainer) BuildNonce(nonceData []byte) {
 	*container = append(*container, nonce)
 }
 
+// Vendor ID
+func (container *IKEPayloadContainer) BuildVendorID(vendorIDData []byte) {
+	vendorID := new(VendorID)
+	vendorID.VendorIDData = assignOrAppend(nil, vendorIDData)
+	*container = append(*container, vendorID)
+}
+
 // Traffic Selector
 func (container *IKEPayloadContainer) BuildTrafficSelectorInitiator() *TrafficSelectorInitiator {
 	tsInitiator := new(TrafficSelectorInitiator)
@@ -251,19 +258,65 @@ func (container *IKEPayloadContainer) BuildEAP5GStart(identifier uint8) {
 }
 
 func (container *IKEPayloadContainer) BuildEAP5GNAS(identifier uint8, nasPDU []byte) error {
+	vendorData, err := EAP5GNASVendorData(nasPDU)
+	if err != nil {
+		return err
+	}
+	container.BuildEAP5GRequest(identifier, vendorData)
+	return nil
+}
+
+// BuildEAP5GRequest adds an EAP-5G request carrying vendorData, e.g. a
+// fragment of FragmentEAP5GNAS
+func (container *IKEPayloadContainer) BuildEAP5GRequest(identifier uint8, vendorData []byte) {
+	eap := container.BuildEAP(EAPCodeRequest, identifier)
+	eap.EAPTypeData.BuildEAPExpanded(VendorID3GPP, VendorTypeEAP5G, vendorData)
+}
+
+// EAP5GNASVendorData returns the vendor data of a 5G-NAS message sent to the
+// UE with nasPDU
+func EAP5GNASVendorData(nasPDU []byte) ([]byte, error) {
 	if len(nasPDU) == 0 {
-		return errors.New("NASPDU is nil")
+		return nil, errors.New("NASPDU is nil")
 	}
 	header := make([]byte, 4)
 	header[0] = EAP5GType5GNAS
 	if len(nasPDU) > math.MaxUint16 {
-		return fmt.Errorf("nasPDU length exceeds uint16 limit: %d", len(nasPDU))
+		return nil, fmt.Errorf("nasPDU length exceeds uint16 limit: %d", len(nasPDU))
 	}
 	binary.BigEndian.PutUint16(header[2:4], uint16(len(nasPDU)))
-	vendorData := append(header, nasPDU...)
-	eap := container.BuildEAP(EAPCodeRequest, identifier)
-	eap.EAPTypeData.BuildEAPExpanded(VendorID3GPP, VendorTypeEAP5G, vendorData)
-	return nil
+	return append(header, nasPDU...), nil
+}
+
+// FragmentEAP5GNAS splits the data of the 5G-NAS vendorData into fragments
+// of at most fragmentSize octets, and returns the vendor data of each. The
+// message is returned whole if it fits, or if fragmentSize is 0
+func FragmentEAP5GNAS(vendorData []byte, fragmentSize int) ([][]byte, error) {
+	if len(vendorData) < EAP5GHeaderLen {
+		return nil, errors.New("FragmentEAP5GNAS: no EAP-5G header")
+	}
+	data := vendorData[EAP5GHeaderLen:]
+	if fragmentSize <= 0 || len(data) <= fragmentSize {
+		return [][]byte{vendorData}, nil
+	}
+	if len(data) > math.MaxUint16 {
+		return nil, fmt.Errorf("FragmentEAP5GNAS: data length exceeds uint16 limit: %d", len(data))
+	}
+
+	var fragments [][]byte
+	for offset := 0; offset < len(data); offset += fragmentSize {
+		end := min(offset+fragmentSize, len(data))
+		fragment := []byte{EAP5GType5GNAS, 0}
+		if offset == 0 {
+			fragment[1] |= EAP5GFlagLengthIncluded
+			fragment = binary.BigEndian.AppendUint16(fragment, uint16(len(data)))
+		}
+		if end < len(data) {
+			fragment[1] |= EAP5GFlagMoreFragments
+		}
+		fragments = append(fragments, append(fragment, data[offset:end]...))
+	}
+	return fragments, nil
 }
 
 func (container *IKEPayloadContainer) BuildNotify5G_QOS_INFO(pduSessionID uint8,
@@ -317,3 +370,39 @@ func (container *IKEPayloadContainer) BuildNotifyNAS_TCP_PORT(port uint16) {
 	binary.BigEndian.PutUint16(portData, port)
 	container.BuildNotification(TypeNone, Vendor3GPPNotifyTypeNAS_TCP_PORT, nil, portData)
 }
+
+// BuildNotifySignatureHashAlgorithms builds a SIGNATURE_HASH_ALGORITHMS
+// notification (RFC 7427 section 4) listing the hash algorithms the sender
+// supports in digital signatures
+func (container *IKEPayloadContainer) BuildNotifySignatureHashAlgorithms(hashAlgorithms []uint16) {
+	notifyData := make([]byte, 0, 2*len(hashAlgorithms))
+	for _, hashAlgorithm := range hashAlgorithms {
+		notifyData = binary.BigEndian.AppendUint16(notifyData, hashAlgorithm)
+	}
+	container.BuildNotification(TypeNone, SIGNATURE_HASH_ALGORITHMS, nil, notifyData)
+}
+
+// BuildNotifyREDIRECT builds a REDIRECT notification (RFC 5685) pointing the
+// UE to the given gateway, identified by IP address or FQDN
+func (container *IKEPayloadContainer) BuildNotifyREDIRECT(gateway string, nonceData []byte) error {
+	var identType uint8
+	var identity []byte
+	if ip := net.ParseIP(gateway); ip != nil {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			identType, identity = GatewayIdentIPv4, ipv4
+		} else {
+			identType, identity = GatewayIdentIPv6, ip.To16()
+		}
+	} else {
+		identType, identity = GatewayIdentFQDN, []byte(gateway)
+	}
+	if len(identity) == 0 || len(identity) > math.MaxUint8 {
+		return fmt.Errorf("invalid redirect gateway identity length: %d", len(identity))
+	}
+
+	notifyData := []byte{identType, uint8(len(identity))}
+	notifyData = append(notifyData, identity...)
+	notifyData = append(notifyData, nonceData...)
+	container.BuildNotification(TypeNone, REDIRECT, nil, notifyData)
+	return nil
+}
@@ -6,12 +6,31 @@ package message
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 )
 
 const IKE_HEADER_LEN int = 28
 
+// IKE_MAX_MESSAGE_LEN is the largest IKE message decoded, that of the largest
+// UDP payload. RFC 7296 section 2 only requires messages up to 1280 bytes to
+// be accepted
+const IKE_MAX_MESSAGE_LEN int = 65535
+
+// NATTPort is the UDP port IKE floats to once a NAT is detected, shared with
+// the UDP encapsulated ESP packets (RFC 3948)
+const NATTPort = 4500
+
+// NonESPMarkerLen is the length of the zero non-ESP marker preceding the IKE
+// messages sent on NATTPort, which tells them from ESP packets, whose SPI is
+// never zero (RFC 7296 section 3.1)
+const NonESPMarkerLen = 4
+
+// ErrMessageTooLarge is returned when the length of an IKE message exceeds
+// IKE_MAX_MESSAGE_LEN or the configured maximum
+var ErrMessageTooLarge = errors.New("IKE message too large")
+
 // IKEHeader represents the header of an IKE message as defined in RFC 7296, Section 3.1
 // Fields are ordered as per the wire format for easier marshaling/unmarshaling.
 type IKEHeader struct {
@@ -85,16 +104,27 @@ func (h *IKEHeader) IsInitiator() bool {
 	return (h.Flags & InitiatorBitCheck) != 0
 }
 
-// ParseHeader parses a byte slice into an IKEHeader struct.
+// ParseHeader parses a byte slice into an IKEHeader struct. The length field
+// is checked against IKE_MAX_MESSAGE_LEN and the bytes received, and never used
+// to size a buffer.
 func ParseHeader(b []byte) (*IKEHeader, error) {
 	if len(b) < IKE_HEADER_LEN {
 		return nil, fmt.Errorf("received broken IKE header")
 	}
+	if len(b) > IKE_MAX_MESSAGE_LEN {
+		return nil, fmt.Errorf("%w: %d bytes received", ErrMessageTooLarge, len(b))
+	}
 
 	totalLen := binary.BigEndian.Uint32(b[24:IKE_HEADER_LEN])
 	if totalLen < uint32(IKE_HEADER_LEN) {
 		return nil, fmt.Errorf("illegal IKE message length %d < header length %d", totalLen, IKE_HEADER_LEN)
 	}
+	if totalLen > uint32(IKE_MAX_MESSAGE_LEN) {
+		return nil, fmt.Errorf("%w: length %d", ErrMessageTooLarge, totalLen)
+	}
+	if totalLen > uint32(len(b)) {
+		return nil, fmt.Errorf("truncated IKE message: length %d, %d bytes received", totalLen, len(b))
+	}
 
 	h := &IKEHeader{
 		InitiatorSPI: binary.BigEndian.Uint64(b[:8]),
@@ -109,3 +139,20 @@ func ParseHeader(b []byte) (*IKEHeader, error) {
 	}
 	return h, nil
 }
+
+// AddNonESPMarker returns msg preceded by the non-ESP marker, as sent on NATTPort
+func AddNonESPMarker(msg []byte) []byte {
+	marked := make([]byte, NonESPMarkerLen+len(msg))
+	copy(marked[NonESPMarkerLen:], msg)
+	return marked
+}
+
+// StripNonESPMarker returns the IKE message of a datagram received on
+// NATTPort. It reports false for a datagram without the non-ESP marker, an
+// ESP packet or a NAT-T keepalive
+func StripNonESPMarker(datagram []byte) ([]byte, bool) {
+	if len(datagram) < NonESPMarkerLen || binary.BigEndian.Uint32(datagram) != 0 {
+		return nil, false
+	}
+	return datagram[NonESPMarkerLen:], true
+}
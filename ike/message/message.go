@@ -182,18 +182,18 @@ func (container *IKEPayloadContainer) Decode(nextPayload IKEPayloadType, rawData
 		case TypeEAP:
 			payload = new(EAP)
 		default:
-			if criticalBit != 0 {
-				// TODO: Reject this IKE message
-				return fmt.Errorf("unknown payload type: %d", nextPayload)
+			if criticalBit == 0 {
+				// Skip this payload
+				nextPayload = IKEPayloadType(rawData[0])
+				rawData = rawData[payloadLength:]
+				continue
 			}
-			// Skip this payload
-			nextPayload = IKEPayloadType(rawData[0])
-			rawData = rawData[payloadLength:]
-			continue
+			// Kept so that the handler can reject the message (RFC 7296 section 2.5)
+			payload = &UnknownPayload{PayloadType: nextPayload, Critical: true}
 		}
 
 		if err := payload.unmarshal(rawData[4:payloadLength]); err != nil {
-			return fmt.Errorf("unmarshal payload failed: %+v", err)
+			return fmt.Errorf("unmarshal payload failed: %w", err)
 		}
 
 		*container = append(*container, payload)
@@ -384,10 +384,10 @@ func (securityAssociation *SecurityAssociation) unmarshal(rawData []byte) error
 		proposal.ProposalNumber = rawData[4]
 		proposal.ProtocolID = rawData[5]
 
-		spiSize := rawData[6]
+		spiSize := int(rawData[6])
 		if spiSize > 0 {
 			// bounds checking
-			if err := checkLen(rawData, int(8+spiSize), "no sufficient bytes for unmarshalling SPI of proposal"); err != nil {
+			if err := checkLen(rawData[:proposalLength], 8+spiSize, "no sufficient bytes for unmarshalling SPI of proposal"); err != nil {
 				return err
 			}
 			proposal.SPI = append(proposal.SPI, rawData[8:8+spiSize]...)
@@ -419,6 +419,9 @@ func (securityAssociation *SecurityAssociation) unmarshal(rawData []byte) error
 			transform.TransformType = transformData[4]
 			transform.TransformID = binary.BigEndian.Uint16(transformData[6:8])
 			if transformLength > 8 {
+				if transformLength < 12 {
+					return fmt.Errorf("illegal transform length %d, too short for an attribute", transformLength)
+				}
 				transform.AttributePresent = true
 				transform.AttributeFormat = ((transformData[8] & 0x80) >> 7)
 				transform.AttributeType = binary.BigEndian.Uint16(transformData[8:10]) & 0x7f
@@ -426,7 +429,7 @@ func (securityAssociation *SecurityAssociation) unmarshal(rawData []byte) error
 				if transform.AttributeFormat == 0 {
 					attributeLength := binary.BigEndian.Uint16(transformData[10:12])
 					// bounds checking
-					if (12 + attributeLength) != transformLength {
+					if 12+int(attributeLength) != int(transformLength) {
 						return fmt.Errorf("illegal attribute length %d not satisfies the transform length %d",
 							attributeLength, transformLength)
 					}
@@ -765,8 +768,8 @@ func (notification *Notification) unmarshal(rawData []byte) error {
 		if len(rawData) < 4 {
 			return errors.New("no sufficient bytes to decode next notification")
 		}
-		spiSize := rawData[1]
-		if len(rawData) < int(4+spiSize) {
+		spiSize := int(rawData[1])
+		if len(rawData) < 4+spiSize {
 			return errors.New("no sufficient bytes to get SPI according to the length specified in header")
 		}
 
@@ -828,6 +831,9 @@ func (del *Delete) unmarshal(rawData []byte) error {
 		}
 		spiSize := rawData[1]
 		numberOfSPI := binary.BigEndian.Uint16(rawData[2:4])
+		if numberOfSPI > 0 && spiSize != 4 {
+			return fmt.Errorf("unsupported SPI size %d for %d SPIs", spiSize, numberOfSPI)
+		}
 		if len(rawData) < (4 + (int(spiSize) * int(numberOfSPI))) {
 			return errors.New("no Sufficient bytes to get SPIs according to the length specified in header")
 		}
@@ -837,10 +843,8 @@ func (del *Delete) unmarshal(rawData []byte) error {
 		del.NumberOfSPI = numberOfSPI
 
 		rawData = rawData[4:]
-		var spi uint32
-		for i := 0; i < len(rawData); i += 4 {
-			spi = binary.BigEndian.Uint32(rawData[i : i+4])
-			del.SPIs = append(del.SPIs, spi)
+		for i := range int(numberOfSPI) {
+			del.SPIs = append(del.SPIs, binary.BigEndian.Uint32(rawData[4*i:4*i+4]))
 		}
 	}
 
@@ -1243,6 +1247,26 @@ func (encrypted *Encrypted) unmarshal(rawData []byte) error {
 // Definition of Configuration
 var _ IKEPayload = &Configuration{}
 
+// DefaultMaxConfigurationAttributes bounds the attributes decoded from a CP
+// payload unless SetMaxConfigurationAttributes says otherwise
+const DefaultMaxConfigurationAttributes = 32
+
+// ErrTooManyConfigurationAttributes is returned when decoding a CP payload
+// carrying more attributes than allowed
+var ErrTooManyConfigurationAttributes = errors.New("too many configuration attributes")
+
+var maxConfigurationAttributes = DefaultMaxConfigurationAttributes
+
+// SetMaxConfigurationAttributes sets the number of attributes accepted in a
+// CP payload, a non-positive value restores the default. It must be called
+// before any message is decoded
+func SetMaxConfigurationAttributes(maxAttributes int) {
+	if maxAttributes <= 0 {
+		maxAttributes = DefaultMaxConfigurationAttributes
+	}
+	maxConfigurationAttributes = maxAttributes
+}
+
 type Configuration struct {
 	ConfigurationType      uint8
 	ConfigurationAttribute ConfigurationAttributeContainer
@@ -1297,12 +1321,15 @@ func (configuration *Configuration) unmarshal(rawData []byte) error {
 
 		for len(configurationAttributeData) > 0 {
 			logger.IKELog.Debugln("unmarshal 1 configuration attribute")
+			if len(configuration.ConfigurationAttribute) >= maxConfigurationAttributes {
+				return fmt.Errorf("%w: more than %d", ErrTooManyConfigurationAttributes, maxConfigurationAttributes)
+			}
 			// bounds checking
 			if len(configurationAttributeData) < 4 {
 				return errors.New("no sufficient bytes to decode next configuration attribute")
 			}
 			length := binary.BigEndian.Uint16(configurationAttributeData[2:4])
-			if len(configurationAttributeData) < int(4+length) {
+			if len(configurationAttributeData) < 4+int(length) {
 				return errors.New("TLV attribute length error")
 			}
 
@@ -1320,6 +1347,31 @@ func (configuration *Configuration) unmarshal(rawData []byte) error {
 	return nil
 }
 
+// Definition of the payloads of a type the N3IWF does not recognize, only
+// decoded when the sender marked them critical
+var _ IKEPayload = &UnknownPayload{}
+
+type UnknownPayload struct {
+	PayloadType IKEPayloadType
+	Critical    bool
+	Data        []byte
+}
+
+func (unknownPayload *UnknownPayload) Type() IKEPayloadType { return unknownPayload.PayloadType }
+
+func (unknownPayload *UnknownPayload) marshal() ([]byte, error) {
+	logger.IKELog.Debugln("start marshalling")
+	return append([]byte{}, unknownPayload.Data...), nil
+}
+
+func (unknownPayload *UnknownPayload) unmarshal(rawData []byte) error {
+	logger.IKELog.Debugln("start unmarshalling received bytes")
+	logger.IKELog.Debugf("payload length %d bytes", len(rawData))
+
+	unknownPayload.Data = append(unknownPayload.Data, rawData...)
+	return nil
+}
+
 // Definition of IKE EAP
 var _ IKEPayload = &EAP{}
 
@@ -1395,8 +1447,8 @@ func (eap *EAP) unmarshal(rawData []byte) error {
 		case EAPTypeExpanded:
 			eapTypeData = new(EAPExpanded)
 		default:
-			// TODO: Create unsupprted type to handle it
-			return errors.New("not supported EAP type")
+			// Kept so that the handler can answer the unexpected method
+			eapTypeData = new(EAPUnsupported)
 		}
 
 		if err := eapTypeData.unmarshal(rawData[4:]); err != nil {
@@ -1519,6 +1571,38 @@ func (eapNak *EAPNak) unmarshal(rawData []byte) error {
 	return nil
 }
 
+// Definition of EAP types the N3IWF does not implement, e.g. an EAP-AKA'
+// response sent without the EAP-5G encapsulation
+var _ EAPTypeFormat = &EAPUnsupported{}
+
+type EAPUnsupported struct {
+	EAPType  EAPType
+	TypeData []byte
+}
+
+func (eapUnsupported *EAPUnsupported) Type() EAPType { return eapUnsupported.EAPType }
+
+func (eapUnsupported *EAPUnsupported) marshal() ([]byte, error) {
+	logger.IKELog.Debugln("start marshalling")
+
+	eapUnsupportedData := []byte{byte(eapUnsupported.EAPType)}
+	eapUnsupportedData = append(eapUnsupportedData, eapUnsupported.TypeData...)
+
+	return eapUnsupportedData, nil
+}
+
+func (eapUnsupported *EAPUnsupported) unmarshal(rawData []byte) error {
+	logger.IKELog.Debugln("start unmarshalling received bytes")
+	logger.IKELog.Debugf("payload length %d bytes", len(rawData))
+
+	eapUnsupported.EAPType = EAPType(rawData[0])
+	if len(rawData) > 1 {
+		eapUnsupported.TypeData = append(eapUnsupported.TypeData, rawData[1:]...)
+	}
+
+	return nil
+}
+
 // Definition of EAP expanded
 var _ EAPTypeFormat = &EAPExpanded{}
 
@@ -6,7 +6,10 @@ package message
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"reflect"
+	"runtime"
 	"testing"
 )
 
@@ -43,56 +46,59 @@ func compareEncodeResult(t *testing.T, result []byte, expByte []byte, expErr boo
 	}
 }
 
+// publicIKESAINITByte is an IKE_SA_INIT request captured from a UE
+var publicIKESAINITByte = []byte{
+	0x86, 0x43, 0x30, 0xac, 0x30, 0xe6, 0x56, 0x4d, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x21, 0x20, 0x22, 0x08, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xc9, 0x22, 0x00, 0x00,
+	0x30, 0x00, 0x00, 0x00, 0x2c, 0x01, 0x01, 0x00, 0x04, 0x03, 0x00,
+	0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x80, 0x0e, 0x00, 0x80,
+	0x03, 0x00, 0x00, 0x08, 0x02, 0x00, 0x00, 0x02, 0x03, 0x00, 0x00,
+	0x08, 0x03, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x08, 0x04,
+	0x00, 0x00, 0x02, 0x28, 0x00, 0x00, 0x88, 0x00, 0x02, 0x00, 0x00,
+	0x03, 0xdc, 0xf5, 0x9a, 0x29, 0x05, 0x7b, 0x5a, 0x49, 0xbd,
+	0x55, 0x8c, 0x9b, 0x14, 0x7a, 0x11, 0x0e, 0xed, 0xff, 0xe5, 0xea,
+	0x2d, 0x12, 0xc2, 0x1e, 0x5c, 0x7a, 0x5f, 0x5e, 0x9c, 0x99,
+	0xe3, 0xd1, 0xd3, 0x00, 0x24, 0x3c, 0x89, 0x73, 0x1e, 0x6c, 0x6d,
+	0x63, 0x41, 0x7b, 0x33, 0xfa, 0xaf, 0x5a, 0xc7, 0x26, 0xe8,
+	0xb6, 0xf8, 0xc3, 0xb5, 0x2a, 0x14, 0xeb, 0xec, 0xd5, 0x6f, 0x1b,
+	0xd9, 0x5b, 0x28, 0x32, 0x84, 0x9e, 0x26, 0xfc, 0x59, 0xee,
+	0xf1, 0x4e, 0x38, 0x5f, 0x55, 0xc2, 0x1b, 0xe8, 0xf6, 0xa3, 0xfb,
+	0xc5, 0x55, 0xd7, 0x35, 0x92, 0x86, 0x24, 0x00, 0x62, 0x8b,
+	0xea, 0xce, 0x23, 0xf0, 0x47, 0xaf, 0xaa, 0xf8, 0x61, 0xe4, 0x5c,
+	0x42, 0xba, 0x5c, 0xa1, 0x4a, 0x52, 0x6e, 0xd8, 0xe8, 0xf1,
+	0xb9, 0x74, 0xae, 0xe4, 0xd1, 0x9c, 0x9f, 0xa5, 0x9b, 0xf0, 0xd7,
+	0xdb, 0x55, 0x2b, 0x00, 0x00, 0x44, 0x4c, 0xa7, 0xf3, 0x9b,
+	0xcd, 0x1d, 0xc2, 0x01, 0x79, 0xfa, 0xa2, 0xe4, 0x72, 0xe0, 0x61,
+	0xc4, 0x45, 0x61, 0xe6, 0x49, 0x2d, 0xb3, 0x96, 0xae, 0xc9,
+	0x2c, 0xdb, 0x54, 0x21, 0xf4, 0x98, 0x4f, 0x72, 0xd2, 0x43, 0x78,
+	0xab, 0x80, 0xe4, 0x6c, 0x01, 0x78, 0x6a, 0xc4, 0x64, 0x45,
+	0xbc, 0xa8, 0x1f, 0x56, 0xbc, 0xed, 0xf9, 0xb5, 0xd8, 0x21, 0x95,
+	0x41, 0x71, 0xe9, 0x0e, 0xb4, 0x3c, 0x4e, 0x2b, 0x00, 0x00,
+	0x17, 0x43, 0x49, 0x53, 0x43, 0x4f, 0x2d, 0x44, 0x45, 0x4c, 0x45,
+	0x54, 0x45, 0x2d, 0x52, 0x45, 0x41, 0x53, 0x4f, 0x4e, 0x2b,
+	0x00, 0x00, 0x3b, 0x43, 0x49, 0x53, 0x43, 0x4f, 0x28, 0x43, 0x4f,
+	0x50, 0x59, 0x52, 0x49, 0x47, 0x48, 0x54, 0x29, 0x26, 0x43,
+	0x6f, 0x70, 0x79, 0x72, 0x69, 0x67, 0x68, 0x74, 0x20, 0x28, 0x63,
+	0x29, 0x20, 0x32, 0x30, 0x30, 0x39, 0x20, 0x43, 0x69, 0x73,
+	0x63, 0x6f, 0x20, 0x53, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x2c,
+	0x20, 0x49, 0x6e, 0x63, 0x2e, 0x29, 0x00, 0x00, 0x13, 0x43,
+	0x49, 0x53, 0x43, 0x4f, 0x2d, 0x47, 0x52, 0x45, 0x2d, 0x4d, 0x4f,
+	0x44, 0x45, 0x02, 0x29, 0x00, 0x00, 0x1c, 0x01, 0x00, 0x40,
+	0x04, 0x7e, 0x57, 0x6c, 0xc0, 0x13, 0xd4, 0x05, 0x43, 0xa2, 0xe8,
+	0x77, 0x7d, 0x00, 0x34, 0x68, 0xa5, 0xb1, 0x89, 0x0c, 0x58,
+	0x2b, 0x00, 0x00, 0x1c, 0x01, 0x00, 0x40, 0x05, 0x52, 0x64, 0x4d,
+	0x87, 0xd4, 0x7c, 0x2d, 0x44, 0x23, 0xbd, 0x37, 0xe4, 0x48,
+	0xa9, 0xf5, 0x17, 0x01, 0x81, 0xcb, 0x8a, 0x00, 0x00, 0x00, 0x14,
+	0x40, 0x48, 0xb7, 0xd5, 0x6e, 0xbc, 0xe8, 0x85, 0x25, 0xe7,
+	0xde, 0x7f, 0x00, 0xd6, 0xc2, 0xd3,
+}
+
 // TestEncodeDecodeUsingPublicData tests the Encode() and Decode() function using the public data.
 // Decode and encode the data, and compare the verifyData and the origin
 // data and return the result.
 func TestEncodeDecodeUsingPublicData(t *testing.T) {
-	data := []byte{
-		0x86, 0x43, 0x30, 0xac, 0x30, 0xe6, 0x56, 0x4d, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x21, 0x20, 0x22, 0x08, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xc9, 0x22, 0x00, 0x00,
-		0x30, 0x00, 0x00, 0x00, 0x2c, 0x01, 0x01, 0x00, 0x04, 0x03, 0x00,
-		0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x80, 0x0e, 0x00, 0x80,
-		0x03, 0x00, 0x00, 0x08, 0x02, 0x00, 0x00, 0x02, 0x03, 0x00, 0x00,
-		0x08, 0x03, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x08, 0x04,
-		0x00, 0x00, 0x02, 0x28, 0x00, 0x00, 0x88, 0x00, 0x02, 0x00, 0x00,
-		0x03, 0xdc, 0xf5, 0x9a, 0x29, 0x05, 0x7b, 0x5a, 0x49, 0xbd,
-		0x55, 0x8c, 0x9b, 0x14, 0x7a, 0x11, 0x0e, 0xed, 0xff, 0xe5, 0xea,
-		0x2d, 0x12, 0xc2, 0x1e, 0x5c, 0x7a, 0x5f, 0x5e, 0x9c, 0x99,
-		0xe3, 0xd1, 0xd3, 0x00, 0x24, 0x3c, 0x89, 0x73, 0x1e, 0x6c, 0x6d,
-		0x63, 0x41, 0x7b, 0x33, 0xfa, 0xaf, 0x5a, 0xc7, 0x26, 0xe8,
-		0xb6, 0xf8, 0xc3, 0xb5, 0x2a, 0x14, 0xeb, 0xec, 0xd5, 0x6f, 0x1b,
-		0xd9, 0x5b, 0x28, 0x32, 0x84, 0x9e, 0x26, 0xfc, 0x59, 0xee,
-		0xf1, 0x4e, 0x38, 0x5f, 0x55, 0xc2, 0x1b, 0xe8, 0xf6, 0xa3, 0xfb,
-		0xc5, 0x55, 0xd7, 0x35, 0x92, 0x86, 0x24, 0x00, 0x62, 0x8b,
-		0xea, 0xce, 0x23, 0xf0, 0x47, 0xaf, 0xaa, 0xf8, 0x61, 0xe4, 0x5c,
-		0x42, 0xba, 0x5c, 0xa1, 0x4a, 0x52, 0x6e, 0xd8, 0xe8, 0xf1,
-		0xb9, 0x74, 0xae, 0xe4, 0xd1, 0x9c, 0x9f, 0xa5, 0x9b, 0xf0, 0xd7,
-		0xdb, 0x55, 0x2b, 0x00, 0x00, 0x44, 0x4c, 0xa7, 0xf3, 0x9b,
-		0xcd, 0x1d, 0xc2, 0x01, 0x79, 0xfa, 0xa2, 0xe4, 0x72, 0xe0, 0x61,
-		0xc4, 0x45, 0x61, 0xe6, 0x49, 0x2d, 0xb3, 0x96, 0xae, 0xc9,
-		0x2c, 0xdb, 0x54, 0x21, 0xf4, 0x98, 0x4f, 0x72, 0xd2, 0x43, 0x78,
-		0xab, 0x80, 0xe4, 0x6c, 0x01, 0x78, 0x6a, 0xc4, 0x64, 0x45,
-		0xbc, 0xa8, 0x1f, 0x56, 0xbc, 0xed, 0xf9, 0xb5, 0xd8, 0x21, 0x95,
-		0x41, 0x71, 0xe9, 0x0e, 0xb4, 0x3c, 0x4e, 0x2b, 0x00, 0x00,
-		0x17, 0x43, 0x49, 0x53, 0x43, 0x4f, 0x2d, 0x44, 0x45, 0x4c, 0x45,
-		0x54, 0x45, 0x2d, 0x52, 0x45, 0x41, 0x53, 0x4f, 0x4e, 0x2b,
-		0x00, 0x00, 0x3b, 0x43, 0x49, 0x53, 0x43, 0x4f, 0x28, 0x43, 0x4f,
-		0x50, 0x59, 0x52, 0x49, 0x47, 0x48, 0x54, 0x29, 0x26, 0x43,
-		0x6f, 0x70, 0x79, 0x72, 0x69, 0x67, 0x68, 0x74, 0x20, 0x28, 0x63,
-		0x29, 0x20, 0x32, 0x30, 0x30, 0x39, 0x20, 0x43, 0x69, 0x73,
-		0x63, 0x6f, 0x20, 0x53, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x2c,
-		0x20, 0x49, 0x6e, 0x63, 0x2e, 0x29, 0x00, 0x00, 0x13, 0x43,
-		0x49, 0x53, 0x43, 0x4f, 0x2d, 0x47, 0x52, 0x45, 0x2d, 0x4d, 0x4f,
-		0x44, 0x45, 0x02, 0x29, 0x00, 0x00, 0x1c, 0x01, 0x00, 0x40,
-		0x04, 0x7e, 0x57, 0x6c, 0xc0, 0x13, 0xd4, 0x05, 0x43, 0xa2, 0xe8,
-		0x77, 0x7d, 0x00, 0x34, 0x68, 0xa5, 0xb1, 0x89, 0x0c, 0x58,
-		0x2b, 0x00, 0x00, 0x1c, 0x01, 0x00, 0x40, 0x05, 0x52, 0x64, 0x4d,
-		0x87, 0xd4, 0x7c, 0x2d, 0x44, 0x23, 0xbd, 0x37, 0xe4, 0x48,
-		0xa9, 0xf5, 0x17, 0x01, 0x81, 0xcb, 0x8a, 0x00, 0x00, 0x00, 0x14,
-		0x40, 0x48, 0xb7, 0xd5, 0x6e, 0xbc, 0xe8, 0x85, 0x25, 0xe7,
-		0xde, 0x7f, 0x00, 0xd6, 0xc2, 0xd3,
-	}
+	data := publicIKESAINITByte
 
 	ikeMsg := new(IKEMessage)
 	err := ikeMsg.Decode(data)
@@ -463,6 +469,21 @@ func TestDecode(t *testing.T) {
 			},
 			expErr: true,
 		},
+		{
+			description: "decode with length beyond the received bytes",
+			b:           withLength(validIKEINITByte, uint32(len(validIKEINITByte)+1)),
+			expErr:      true,
+		},
+		{
+			description: "decode with length beyond the maximum",
+			b:           withLength(validIKEINITByte, 0xffffffff),
+			expErr:      true,
+		},
+		{
+			description: "decode message larger than the maximum",
+			b:           withLength(make([]byte, IKE_MAX_MESSAGE_LEN+1), uint32(IKE_MAX_MESSAGE_LEN+1)),
+			expErr:      true,
+		},
 	}
 
 	for _, tc := range testcases {
@@ -474,6 +495,13 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+// withLength returns a copy of the IKE message b with length in its header
+func withLength(b []byte, length uint32) []byte {
+	b = bytes.Clone(b)
+	binary.BigEndian.PutUint32(b[24:IKE_HEADER_LEN], length)
+	return b
+}
+
 func TestEncode(t *testing.T) {
 	testcases := []struct {
 		description string
@@ -599,3 +627,342 @@ func TestNewAndEncodeIKEHeader(t *testing.T) {
 		t.Errorf("Encoded bytes mismatch. got = %v, want = %v", b, expectedBytes)
 	}
 }
+
+func TestBuildNotifyREDIRECT(t *testing.T) {
+	nonce := []byte{0xaa, 0xbb}
+	testcases := []struct {
+		description string
+		gateway     string
+		expErr      bool
+		expData     []byte
+	}{
+		{
+			description: "IPv4 gateway",
+			gateway:     "10.0.0.2",
+			expData:     []byte{GatewayIdentIPv4, 4, 10, 0, 0, 2, 0xaa, 0xbb},
+		},
+		{
+			description: "IPv6 gateway",
+			gateway:     "2001:db8::1",
+			expData: []byte{
+				GatewayIdentIPv6, 16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 1, 0xaa, 0xbb,
+			},
+		},
+		{
+			description: "FQDN gateway",
+			gateway:     "gw",
+			expData:     []byte{GatewayIdentFQDN, 2, 'g', 'w', 0xaa, 0xbb},
+		},
+		{
+			description: "empty gateway",
+			gateway:     "",
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var container IKEPayloadContainer
+			err := container.BuildNotifyREDIRECT(tc.gateway, nonce)
+			if tc.expErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			notification := container[0].(*Notification)
+			// RFC 5685 section 10: REDIRECT is notify message type 16407
+			if notification.NotifyMessageType != 16407 {
+				t.Errorf("notify type mismatch. got = %d, want = 16407", notification.NotifyMessageType)
+			}
+			if !bytes.Equal(notification.NotificationData, tc.expData) {
+				t.Errorf("notification data mismatch. got = %v, want = %v", notification.NotificationData, tc.expData)
+			}
+		})
+	}
+}
+
+func TestDecodeConfigurationAttributeLimit(t *testing.T) {
+	t.Cleanup(func() { SetMaxConfigurationAttributes(0) })
+	SetMaxConfigurationAttributes(4)
+
+	testcases := []struct {
+		description string
+		attributes  int
+		expErr      bool
+	}{
+		{
+			description: "at the limit",
+			attributes:  4,
+		},
+		{
+			description: "oversized configuration payload",
+			attributes:  5,
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var payloads IKEPayloadContainer
+			configuration := payloads.BuildConfiguration(CFG_REQUEST)
+			for range tc.attributes {
+				configuration.ConfigurationAttribute.BuildConfigurationAttribute(INTERNAL_IP4_ADDRESS, nil)
+			}
+			data, err := payloads.Encode()
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+
+			var decoded IKEPayloadContainer
+			err = decoded.Decode(TypeCP, data)
+			if tc.expErr {
+				if !errors.Is(err, ErrTooManyConfigurationAttributes) {
+					t.Errorf("error mismatch. got = %v, want = %v", err, ErrTooManyConfigurationAttributes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := len(decoded[0].(*Configuration).ConfigurationAttribute); got != tc.attributes {
+				t.Errorf("attribute count mismatch. got = %d, want = %d", got, tc.attributes)
+			}
+		})
+	}
+}
+
+func TestDecodeUnsupportedEAPType(t *testing.T) {
+	var payloads IKEPayloadContainer
+	eap := payloads.BuildEAP(EAPCodeResponse, 7)
+	eap.EAPTypeData = EAPTypeDataContainer{
+		&EAPUnsupported{EAPType: EAPTypeAKAPrime, TypeData: []byte{0x01, 0x00, 0x00}},
+	}
+	data, err := payloads.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	var decoded IKEPayloadContainer
+	if err = decoded.Decode(TypeEAP, data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	typeData, ok := decoded[0].(*EAP).EAPTypeData[0].(*EAPUnsupported)
+	if !ok {
+		t.Fatalf("EAP type data mismatch. got = %T, want = *EAPUnsupported", decoded[0].(*EAP).EAPTypeData[0])
+	}
+	if typeData.Type() != EAPTypeAKAPrime {
+		t.Errorf("EAP type mismatch. got = %d, want = %d", typeData.Type(), EAPTypeAKAPrime)
+	}
+	if !bytes.Equal(typeData.TypeData, []byte{0x01, 0x00, 0x00}) {
+		t.Errorf("EAP type data mismatch. got = %x, want = 010000", typeData.TypeData)
+	}
+}
+
+func TestDecodeUnknownPayload(t *testing.T) {
+	testcases := []struct {
+		description string
+		critical    bool
+	}{
+		{
+			description: "non critical payload skipped",
+		},
+		{
+			description: "critical payload kept",
+			critical:    true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var payloads IKEPayloadContainer
+			payloads.BuildNonce([]byte{0x01, 0x02, 0x03, 0x04})
+			payloads = append(payloads, &UnknownPayload{PayloadType: 200, Data: []byte{0xaa, 0xbb}})
+			data, err := payloads.Encode()
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			if tc.critical {
+				// Critical bit of the payload following the 8 octet Nonce payload
+				data[9] |= 0x80
+			}
+
+			var decoded IKEPayloadContainer
+			if err = decoded.Decode(TypeNiNr, data); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !tc.critical {
+				if len(decoded) != 1 {
+					t.Errorf("payload count mismatch. got = %d, want = 1", len(decoded))
+				}
+				return
+			}
+			if len(decoded) != 2 {
+				t.Fatalf("payload count mismatch. got = %d, want = 2", len(decoded))
+			}
+			unknown, ok := decoded[1].(*UnknownPayload)
+			if !ok {
+				t.Fatalf("payload mismatch. got = %T, want = *UnknownPayload", decoded[1])
+			}
+			if unknown.Type() != 200 || !unknown.Critical || !bytes.Equal(unknown.Data, []byte{0xaa, 0xbb}) {
+				t.Errorf("Unexpected unknown payload: %+v", unknown)
+			}
+		})
+	}
+}
+
+func TestFragmentEAP5GNAS(t *testing.T) {
+	nasPDU := bytes.Repeat([]byte{0x7e}, 10)
+	vendorData, err := EAP5GNASVendorData(nasPDU)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testcases := []struct {
+		description  string
+		fragmentSize int
+		expFragments [][]byte
+	}{
+		{
+			description:  "fragmentation disabled",
+			fragmentSize: 0,
+			expFragments: [][]byte{vendorData},
+		},
+		{
+			description:  "message fitting",
+			fragmentSize: 12,
+			expFragments: [][]byte{vendorData},
+		},
+		{
+			description:  "three fragments",
+			fragmentSize: 5,
+			expFragments: [][]byte{
+				append([]byte{EAP5GType5GNAS, EAP5GFlagLengthIncluded | EAP5GFlagMoreFragments, 0, 12}, vendorData[2:7]...),
+				append([]byte{EAP5GType5GNAS, EAP5GFlagMoreFragments}, vendorData[7:12]...),
+				append([]byte{EAP5GType5GNAS, 0}, vendorData[12:]...),
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			fragments, err := FragmentEAP5GNAS(vendorData, tc.fragmentSize)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(fragments) != len(tc.expFragments) {
+				t.Fatalf("fragment count mismatch. got = %d, want = %d", len(fragments), len(tc.expFragments))
+			}
+			for i := range fragments {
+				if !bytes.Equal(fragments[i], tc.expFragments[i]) {
+					t.Errorf("fragment %d mismatch. got = %x, want = %x", i, fragments[i], tc.expFragments[i])
+				}
+			}
+		})
+	}
+}
+
+// newFuzzIKEAUTHRequest returns a cleartext IKE_AUTH request carrying most
+// payload types, as decoded from the SK payload
+func newFuzzIKEAUTHRequest(f *testing.F) []byte {
+	f.Helper()
+	var payloads IKEPayloadContainer
+	payloads.BuildIdentificationInitiator(ID_FQDN, []byte("ue.example.org"))
+	payloads = append(payloads, &CertificateRequest{CertificateEncoding: 4, CertificationAuthority: bytes.Repeat([]byte{0x11}, 20)})
+	payloads.BuildCertificate(4, []byte{0x30, 0x82, 0x01, 0x0a})
+	payloads.BuildAuthentication(2, bytes.Repeat([]byte{0x22}, 20))
+	configuration := payloads.BuildConfiguration(CFG_REQUEST)
+	configuration.ConfigurationAttribute.BuildConfigurationAttribute(INTERNAL_IP4_ADDRESS, nil)
+	configuration.ConfigurationAttribute.BuildConfigurationAttribute(INTERNAL_IP4_DNS, nil)
+	securityAssociation := payloads.BuildSecurityAssociation()
+	proposal := securityAssociation.Proposals.BuildProposal(1, TypeESP, []byte{0x01, 0x02, 0x03, 0x04})
+	keyLength, attrType := uint16(256), uint16(AttributeTypeKeyLength)
+	proposal.EncryptionAlgorithm.BuildTransform(TypeEncryptionAlgorithm, ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(TypeIntegrityAlgorithm, AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(TypeExtendedSequenceNumbers, ESN_DISABLE, nil, nil, nil)
+	tsi := payloads.BuildTrafficSelectorInitiator()
+	tsi.TrafficSelectors.BuildIndividualTrafficSelector(TS_IPV4_ADDR_RANGE, IPProtocolAll, 0, 65535,
+		[]byte{10, 0, 0, 1}, []byte{10, 0, 0, 1})
+	tsr := payloads.BuildTrafficSelectorResponder()
+	tsr.TrafficSelectors.BuildIndividualTrafficSelector(TS_IPV4_ADDR_RANGE, IPProtocolAll, 0, 65535,
+		[]byte{0, 0, 0, 0}, []byte{255, 255, 255, 255})
+	payloads.BuildNotification(TypeNone, INITIAL_CONTACT, nil, nil)
+	payloads.BuildDeletePayload(TypeESP, 4, 1, []uint32{0x01020304})
+	payloads = append(payloads, &VendorID{VendorIDData: []byte("vendor")})
+	eap := payloads.BuildEAP(EAPCodeResponse, 1)
+	eap.EAPTypeData.BuildEAPExpanded(VendorID3GPP, VendorTypeEAP5G, []byte{EAP5GType5GNAS, EAP5GSpareValue, 0x00, 0x02, 0x7e, 0x00})
+
+	ikeMsg := NewMessage(0x1111, 0x2222, IKE_AUTH, false, true, 1, payloads)
+	data, err := ikeMsg.Encode()
+	if err != nil {
+		f.Fatalf("Encode failed: %v", err)
+	}
+	return data
+}
+
+// Bytes a decoding may allocate, per input byte and in total, before the
+// decoder is considered to amplify its input
+const (
+	fuzzAllocPerByte = 64
+	fuzzAllocBase    = 64 * 1024
+)
+
+func FuzzDecodeIKEMessage(f *testing.F) {
+	f.Add(publicIKESAINITByte)
+	f.Add(validIKEAUTHByte)
+	f.Add(newFuzzIKEAUTHRequest(f))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		ikeMsg := new(IKEMessage)
+		err := ikeMsg.Decode(data)
+		runtime.ReadMemStats(&after)
+
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(fuzzAllocPerByte*len(data)+fuzzAllocBase) {
+			t.Errorf("decoding %d bytes allocated %d bytes", len(data), allocated)
+		}
+		if err != nil {
+			return
+		}
+		// Whatever was decoded must encode without panicking
+		if _, err = ikeMsg.Encode(); err != nil {
+			t.Logf("Encode failed: %v", err)
+		}
+	})
+}
+
+func TestNonESPMarker(t *testing.T) {
+	msg := []byte{0x11, 0x22, 0x33, 0x44, 0x55}
+	marked := AddNonESPMarker(msg)
+	if !bytes.Equal(marked, append([]byte{0, 0, 0, 0}, msg...)) {
+		t.Errorf("marked message mismatch. got = %x", marked)
+	}
+
+	testcases := []struct {
+		description string
+		datagram    []byte
+		expIKE      bool
+		expMsg      []byte
+	}{
+		{description: "IKE message", datagram: marked, expIKE: true, expMsg: msg},
+		{description: "ESP packet", datagram: []byte{0x00, 0x00, 0x10, 0x01, 0x00, 0x00, 0x00, 0x01}},
+		{description: "NAT-T keepalive", datagram: []byte{0xff}},
+		{description: "marker only", datagram: []byte{0, 0, 0, 0}, expIKE: true, expMsg: []byte{}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			stripped, ok := StripNonESPMarker(tc.datagram)
+			if ok != tc.expIKE {
+				t.Fatalf("IKE mismatch. got = %v, want = %v", ok, tc.expIKE)
+			}
+			if ok && !bytes.Equal(stripped, tc.expMsg) {
+				t.Errorf("message mismatch. got = %x, want = %x", stripped, tc.expMsg)
+			}
+		})
+	}
+}
@@ -37,6 +37,7 @@ const (
 	EAPTypeIdentity EAPType = iota + 1
 	EAPTypeNotification
 	EAPTypeNak
+	EAPTypeAKAPrime EAPType = 50 // RFC 9048, carried in EAP-5G NAS messages toward the AUSF
 	EAPTypeExpanded EAPType = 254
 )
 
@@ -80,6 +81,13 @@ const (
 	ENCR_NULL     = 11
 	ENCR_AES_CBC  = 12
 	ENCR_AES_CTR  = 13
+	// AEAD transforms (RFC 4309, RFC 4106, RFC 5282)
+	ENCR_AES_CCM_8  = 14
+	ENCR_AES_CCM_12 = 15
+	ENCR_AES_CCM_16 = 16
+	ENCR_AES_GCM_8  = 18
+	ENCR_AES_GCM_12 = 19
+	ENCR_AES_GCM_16 = 20
 )
 
 // Pseudorandom Function Types
@@ -88,6 +96,8 @@ const (
 	PRF_HMAC_SHA1
 	PRF_HMAC_TIGER
 	PRF_HMAC_SHA2_256 = 5
+	PRF_HMAC_SHA2_384 = 6
+	PRF_HMAC_SHA2_512 = 7
 )
 
 // Authentication Algorithm Types
@@ -99,6 +109,8 @@ const (
 	AUTH_KPDK_MD5
 	AUTH_AES_XCBC_96
 	AUTH_HMAC_SHA2_256_128 = 12
+	AUTH_HMAC_SHA2_384_192 = 13
+	AUTH_HMAC_SHA2_512_256 = 14
 )
 
 // Diffie-Hellman Group Types
@@ -174,6 +186,18 @@ const (
 	UPDATE_SA_ADDRESSES           = 16400
 	COOKIE2                       = 16401
 	NO_NATS_ALLOWED               = 16402
+	REDIRECT_SUPPORTED            = 16406
+	REDIRECT                      = 16407
+	REDIRECTED_FROM               = 16408
+	CHILDLESS_IKEV2_SUPPORTED     = 16418
+	SIGNATURE_HASH_ALGORITHMS     = 16431
+)
+
+// Gateway Identity Types (used in REDIRECT notification)
+const (
+	GatewayIdentIPv4 = 1
+	GatewayIdentIPv6 = 2
+	GatewayIdentFQDN = 3
 )
 
 // Protocol IDs
@@ -222,6 +246,19 @@ const (
 	RSADigitalSignature = iota + 1
 	SharedKeyMesageIntegrityCode
 	DSSDigitalSignature
+	ECDSAWithSHA256OnP256 = 9
+	ECDSAWithSHA384OnP384 = 10
+	ECDSAWithSHA512OnP521 = 11
+	DigitalSignature      = 14
+)
+
+// Hash Algorithms of Digital Signature authentication (RFC 7427)
+const (
+	HASH_SHA1     = 1
+	HASH_SHA2_256 = 2
+	HASH_SHA2_384 = 3
+	HASH_SHA2_512 = 4
+	HASH_IDENTITY = 5
 )
 
 // Configuration Types
@@ -265,9 +302,10 @@ const (
 
 // EAP-5G Message IDs
 const (
-	EAP5GType5GStart = 1
-	EAP5GType5GNAS   = 2
-	EAP5GType5GStop  = 4
+	EAP5GType5GStart        = 1
+	EAP5GType5GNAS          = 2
+	EAP5GType5GNotification = 3
+	EAP5GType5GStop         = 4
 )
 
 // AN-Parameter IE Types
@@ -298,6 +336,18 @@ const (
 // EAP-5G Spare Value
 const EAP5GSpareValue = 0
 
+// Flags sent in the spare octet of fragmented EAP-5G 5G-NAS messages, after
+// the L and M flags of EAP-TLS (RFC 5216 section 2.1.5). TS 24.502 does not
+// fragment EAP-5G, so both peers must be configured for it. Each fragment is
+// acknowledged with a 5G-NAS message without data
+const (
+	EAP5GFlagLengthIncluded = 0x80 // First fragment, the 2 octet length of the reassembled data follows
+	EAP5GFlagMoreFragments  = 0x40 // Another fragment follows
+)
+
+// EAP5GHeaderLen is the length of the message ID and spare octets
+const EAP5GHeaderLen = 2
+
 // 3GPP-specified IKE Notify Message Types
 const (
 	Vendor3GPPNotifyType5G_QOS_INFO     uint16 = 55501
@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// ASN.1 AlgorithmIdentifier for Ed25519 (RFC 8420), prepended to the
+// signature when the generic Digital Signature method (RFC 7427) is used
+var ed25519AlgorithmIdentifier = []byte{0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70}
+
+// SignatureHashAlgorithms lists the hash algorithms of the Digital Signature
+// method (RFC 7427) the N3IWF supports, announced to the UEs in IKE_SA_INIT
+var SignatureHashAlgorithms = []uint16{
+	message.HASH_SHA2_256, message.HASH_SHA2_384, message.HASH_SHA2_512, message.HASH_IDENTITY,
+}
+
+// signatureAlgorithm is a signature scheme of the Digital Signature method,
+// identified in the AUTH payload by its ASN.1 AlgorithmIdentifier (RFC 7427
+// appendix A)
+type signatureAlgorithm struct {
+	hashAlgorithm uint16
+	hashFunc      crypto.Hash
+	identifier    []byte
+}
+
+// RSA and ECDSA signature schemes, most preferred first
+var (
+	rsaSignatureAlgorithms = []signatureAlgorithm{
+		{message.HASH_SHA2_256, crypto.SHA256, []byte{
+			0x30, 0x0d, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x01, 0x0b, 0x05, 0x00,
+		}},
+		{message.HASH_SHA2_384, crypto.SHA384, []byte{
+			0x30, 0x0d, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x01, 0x0c, 0x05, 0x00,
+		}},
+		{message.HASH_SHA2_512, crypto.SHA512, []byte{
+			0x30, 0x0d, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x01, 0x0d, 0x05, 0x00,
+		}},
+	}
+	ecdsaSignatureAlgorithms = []signatureAlgorithm{
+		{message.HASH_SHA2_256, crypto.SHA256, []byte{
+			0x30, 0x0a, 0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x04, 0x03, 0x02,
+		}},
+		{message.HASH_SHA2_384, crypto.SHA384, []byte{
+			0x30, 0x0a, 0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x04, 0x03, 0x03,
+		}},
+		{message.HASH_SHA2_512, crypto.SHA512, []byte{
+			0x30, 0x0a, 0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x04, 0x03, 0x04,
+		}},
+	}
+)
+
+// selectSignatureAlgorithm returns the first of algorithms whose hash the UE
+// accepts, preferred being tried before the others
+func selectSignatureAlgorithm(algorithms []signatureAlgorithm, preferred crypto.Hash,
+	hashAlgorithms []uint16,
+) (signatureAlgorithm, bool) {
+	index := slices.IndexFunc(algorithms, func(algorithm signatureAlgorithm) bool {
+		return algorithm.hashFunc == preferred && slices.Contains(hashAlgorithms, algorithm.hashAlgorithm)
+	})
+	if index < 0 {
+		index = slices.IndexFunc(algorithms, func(algorithm signatureAlgorithm) bool {
+			return slices.Contains(hashAlgorithms, algorithm.hashAlgorithm)
+		})
+	}
+	if index < 0 {
+		return signatureAlgorithm{}, false
+	}
+	return algorithms[index], true
+}
+
+// digitalSignatureAuthData prefixes signature with the length and the ASN.1
+// AlgorithmIdentifier of its scheme (RFC 7427 section 3)
+func digitalSignatureAuthData(identifier, signature []byte) []byte {
+	authData := make([]byte, 0, 1+len(identifier)+len(signature))
+	authData = append(authData, uint8(len(identifier))) // #nosec G115
+	authData = append(authData, identifier...)
+	return append(authData, signature...)
+}
+
+// SignAuthentication signs the given octets with the N3IWF private key and
+// returns the authentication method together with the AUTH payload data.
+// When the UE announced the hash algorithms it accepts (RFC 7427), RSA and
+// ECDSA keys sign with the Digital Signature method and one of them, falling
+// back to the methods of RFC 7296 if none is supported. Ed25519 keys require
+// the UE to accept the Identity hash (RFC 8420 section 2)
+func SignAuthentication(signer crypto.Signer, signedOctets []byte, hashAlgorithms []uint16) (uint8, []byte, error) {
+	if signer == nil {
+		return 0, nil, errors.New("SignAuthentication: private key is nil")
+	}
+
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		algorithm, ok := selectSignatureAlgorithm(rsaSignatureAlgorithms, crypto.SHA256, hashAlgorithms)
+		if !ok {
+			algorithm = signatureAlgorithm{hashFunc: crypto.SHA1}
+		}
+		digest, err := hashOctets(algorithm.hashFunc, signedOctets)
+		if err != nil {
+			return 0, nil, fmt.Errorf("SignAuthentication: %w", err)
+		}
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, algorithm.hashFunc, digest)
+		if err != nil {
+			return 0, nil, fmt.Errorf("SignAuthentication: %w", err)
+		}
+		if !ok {
+			return message.RSADigitalSignature, signature, nil
+		}
+		return message.DigitalSignature, digitalSignatureAuthData(algorithm.identifier, signature), nil
+	case *ecdsa.PrivateKey:
+		authMethod, hashFunc, err := ecdsaAuthMethod(key.Curve)
+		if err != nil {
+			return 0, nil, fmt.Errorf("SignAuthentication: %w", err)
+		}
+		if algorithm, ok := selectSignatureAlgorithm(ecdsaSignatureAlgorithms, hashFunc, hashAlgorithms); ok {
+			digest, err := hashOctets(algorithm.hashFunc, signedOctets)
+			if err != nil {
+				return 0, nil, fmt.Errorf("SignAuthentication: %w", err)
+			}
+			// RFC 7427 section 3: the ECDSA signature is DER encoded
+			signature, err := ecdsa.SignASN1(rand.Reader, key, digest)
+			if err != nil {
+				return 0, nil, fmt.Errorf("SignAuthentication: %w", err)
+			}
+			return message.DigitalSignature, digitalSignatureAuthData(algorithm.identifier, signature), nil
+		}
+		digest, err := hashOctets(hashFunc, signedOctets)
+		if err != nil {
+			return 0, nil, fmt.Errorf("SignAuthentication: %w", err)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return 0, nil, fmt.Errorf("SignAuthentication: %w", err)
+		}
+		// RFC 4754: the signature is the fixed-length concatenation r | s
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return authMethod, signature, nil
+	case ed25519.PrivateKey:
+		if !slices.Contains(hashAlgorithms, message.HASH_IDENTITY) {
+			return 0, nil, errors.New("SignAuthentication: Ed25519 requires the UE to support the Identity hash")
+		}
+		signature, err := key.Sign(rand.Reader, signedOctets, crypto.Hash(0))
+		if err != nil {
+			return 0, nil, fmt.Errorf("SignAuthentication: %w", err)
+		}
+		return message.DigitalSignature, digitalSignatureAuthData(ed25519AlgorithmIdentifier, signature), nil
+	default:
+		return 0, nil, fmt.Errorf("SignAuthentication: unsupported private key type %T", signer)
+	}
+}
+
+func ecdsaAuthMethod(curve elliptic.Curve) (uint8, crypto.Hash, error) {
+	switch curve {
+	case elliptic.P256():
+		return message.ECDSAWithSHA256OnP256, crypto.SHA256, nil
+	case elliptic.P384():
+		return message.ECDSAWithSHA384OnP384, crypto.SHA384, nil
+	case elliptic.P521():
+		return message.ECDSAWithSHA512OnP521, crypto.SHA512, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported ECDSA curve %s", curve.Params().Name)
+	}
+}
+
+func hashOctets(hashFunc crypto.Hash, octets []byte) ([]byte, error) {
+	h := hashFunc.New()
+	if _, err := h.Write(octets); err != nil {
+		return nil, fmt.Errorf("hash function write error: %w", err)
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,271 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package security
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestSignAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key failed: %v", err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate P-256 key failed: %v", err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate P-384 key failed: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate Ed25519 key failed: %v", err)
+	}
+
+	signedOctets := []byte("responder signed octets")
+
+	testcases := []struct {
+		description    string
+		signer         crypto.Signer
+		hashAlgorithms []uint16
+		expAuthMethod  uint8
+		expLen         int // Unchecked when 0, DER encoded ECDSA signatures vary in length
+		expErr         bool
+	}{
+		{
+			description:   "RSA key",
+			signer:        rsaKey,
+			expAuthMethod: message.RSADigitalSignature,
+			expLen:        256,
+		},
+		{
+			description:   "ECDSA P-256 key",
+			signer:        p256Key,
+			expAuthMethod: message.ECDSAWithSHA256OnP256,
+			expLen:        64,
+		},
+		{
+			description:   "ECDSA P-384 key",
+			signer:        p384Key,
+			expAuthMethod: message.ECDSAWithSHA384OnP384,
+			expLen:        96,
+		},
+		{
+			description:    "RSA key with RFC 7427 hash algorithms",
+			signer:         rsaKey,
+			hashAlgorithms: []uint16{message.HASH_SHA1, message.HASH_SHA2_512},
+			expAuthMethod:  message.DigitalSignature,
+			expLen:         1 + len(rsaSignatureAlgorithms[2].identifier) + 256,
+		},
+		{
+			description:    "RSA key with SHA-1 only",
+			signer:         rsaKey,
+			hashAlgorithms: []uint16{message.HASH_SHA1},
+			expAuthMethod:  message.RSADigitalSignature,
+			expLen:         256,
+		},
+		{
+			description:    "ECDSA P-256 key with RFC 7427 hash algorithms",
+			signer:         p256Key,
+			hashAlgorithms: []uint16{message.HASH_SHA2_384, message.HASH_SHA2_256},
+			expAuthMethod:  message.DigitalSignature,
+		},
+		{
+			description:    "ECDSA P-384 key without the hash of its curve",
+			signer:         p384Key,
+			hashAlgorithms: []uint16{message.HASH_SHA2_256},
+			expAuthMethod:  message.DigitalSignature,
+		},
+		{
+			description:    "ECDSA P-256 key with identity only",
+			signer:         p256Key,
+			hashAlgorithms: []uint16{message.HASH_IDENTITY},
+			expAuthMethod:  message.ECDSAWithSHA256OnP256,
+			expLen:         64,
+		},
+		{
+			description:    "Ed25519 key",
+			signer:         edKey,
+			hashAlgorithms: []uint16{message.HASH_SHA2_256, message.HASH_IDENTITY},
+			expAuthMethod:  message.DigitalSignature,
+			expLen:         1 + len(ed25519AlgorithmIdentifier) + ed25519.SignatureSize,
+		},
+		{
+			description:    "Ed25519 key without identity",
+			signer:         edKey,
+			hashAlgorithms: []uint16{message.HASH_SHA2_256},
+			expErr:         true,
+		},
+		{
+			description: "Ed25519 key without RFC 7427 hash algorithms",
+			signer:      edKey,
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			authMethod, authData, err := SignAuthentication(tc.signer, signedOctets, tc.hashAlgorithms)
+			if tc.expErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SignAuthentication failed: %v", err)
+			}
+			if authMethod != tc.expAuthMethod {
+				t.Errorf("auth method mismatch. got = %d, want = %d", authMethod, tc.expAuthMethod)
+			}
+			if tc.expLen != 0 && len(authData) != tc.expLen {
+				t.Errorf("auth data length mismatch. got = %d, want = %d", len(authData), tc.expLen)
+			}
+			if err := verifyAuthentication(tc.signer.Public(), authMethod, signedOctets, authData); err != nil {
+				t.Errorf("verifyAuthentication failed: %v", err)
+			}
+			if err := verifyAuthentication(tc.signer.Public(), authMethod, []byte("tampered"), authData); err == nil {
+				t.Error("Expected verification of tampered octets to fail")
+			}
+		})
+	}
+}
+
+func TestSignAuthenticationHashSelection(t *testing.T) {
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate P-256 key failed: %v", err)
+	}
+	signedOctets := []byte("responder signed octets")
+	_, authData, err := SignAuthentication(p256Key, signedOctets,
+		[]uint16{message.HASH_SHA2_512, message.HASH_SHA2_256})
+	if err != nil {
+		t.Fatalf("SignAuthentication failed: %v", err)
+	}
+	// The hash of the curve is preferred to the first one of the UE
+	algorithm, _, err := splitDigitalSignature(ecdsaSignatureAlgorithms, authData)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if algorithm.hashAlgorithm != message.HASH_SHA2_256 {
+		t.Errorf("hash algorithm mismatch. got = %d, want = %d", algorithm.hashAlgorithm, message.HASH_SHA2_256)
+	}
+}
+
+func TestSignAuthenticationNilKey(t *testing.T) {
+	if _, _, err := SignAuthentication(nil, []byte{0x01}, nil); err == nil {
+		t.Error("Expected error but got none")
+	}
+}
+
+// verifyAuthentication checks AUTH payload data produced by SignAuthentication
+// against the given public key
+func verifyAuthentication(pub crypto.PublicKey, authMethod uint8, signedOctets, authData []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		hashFunc, signature := crypto.SHA1, authData
+		switch authMethod {
+		case message.RSADigitalSignature:
+		case message.DigitalSignature:
+			algorithm, digitalSignature, err := splitDigitalSignature(rsaSignatureAlgorithms, authData)
+			if err != nil {
+				return fmt.Errorf("verifyAuthentication: %w", err)
+			}
+			hashFunc, signature = algorithm.hashFunc, digitalSignature
+		default:
+			return fmt.Errorf("verifyAuthentication: unexpected auth method %d for RSA key", authMethod)
+		}
+		digest, err := hashOctets(hashFunc, signedOctets)
+		if err != nil {
+			return fmt.Errorf("verifyAuthentication: %w", err)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hashFunc, digest, signature); err != nil {
+			return fmt.Errorf("verifyAuthentication: %w", err)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if authMethod == message.DigitalSignature {
+			algorithm, signature, err := splitDigitalSignature(ecdsaSignatureAlgorithms, authData)
+			if err != nil {
+				return fmt.Errorf("verifyAuthentication: %w", err)
+			}
+			digest, err := hashOctets(algorithm.hashFunc, signedOctets)
+			if err != nil {
+				return fmt.Errorf("verifyAuthentication: %w", err)
+			}
+			if !ecdsa.VerifyASN1(key, digest, signature) {
+				return errors.New("verifyAuthentication: ECDSA signature mismatch")
+			}
+			return nil
+		}
+		expected, hashFunc, err := ecdsaAuthMethod(key.Curve)
+		if err != nil {
+			return fmt.Errorf("verifyAuthentication: %w", err)
+		}
+		if authMethod != expected {
+			return fmt.Errorf("verifyAuthentication: unexpected auth method %d for ECDSA key", authMethod)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(authData) != 2*size {
+			return fmt.Errorf("verifyAuthentication: invalid ECDSA signature length %d", len(authData))
+		}
+		digest, err := hashOctets(hashFunc, signedOctets)
+		if err != nil {
+			return fmt.Errorf("verifyAuthentication: %w", err)
+		}
+		r := new(big.Int).SetBytes(authData[:size])
+		s := new(big.Int).SetBytes(authData[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("verifyAuthentication: ECDSA signature mismatch")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if authMethod != message.DigitalSignature {
+			return fmt.Errorf("verifyAuthentication: unexpected auth method %d for Ed25519 key", authMethod)
+		}
+		prefixLen := 1 + len(ed25519AlgorithmIdentifier)
+		if len(authData) != prefixLen+ed25519.SignatureSize ||
+			int(authData[0]) != len(ed25519AlgorithmIdentifier) {
+			return errors.New("verifyAuthentication: malformed Ed25519 authentication data")
+		}
+		if !ed25519.Verify(key, signedOctets, authData[prefixLen:]) {
+			return errors.New("verifyAuthentication: Ed25519 signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("verifyAuthentication: unsupported public key type %T", pub)
+	}
+}
+
+// splitDigitalSignature returns the scheme among algorithms and the signature
+// of Digital Signature AUTH data
+func splitDigitalSignature(algorithms []signatureAlgorithm, authData []byte) (signatureAlgorithm, []byte, error) {
+	if len(authData) == 0 || len(authData) <= 1+int(authData[0]) {
+		return signatureAlgorithm{}, nil, errors.New("malformed digital signature authentication data")
+	}
+	identifier := authData[1 : 1+authData[0]]
+	index := slices.IndexFunc(algorithms, func(algorithm signatureAlgorithm) bool {
+		return bytes.Equal(algorithm.identifier, identifier)
+	})
+	if index < 0 {
+		return signatureAlgorithm{}, nil, fmt.Errorf("unsupported signature algorithm identifier %x", identifier)
+	}
+	return algorithms[index], authData[1+len(identifier):], nil
+}
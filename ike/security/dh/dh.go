@@ -88,4 +88,5 @@ type DHType interface {
 	getAttribute() (bool, uint16, uint16, []byte)
 	GetSharedKey(secret, peerPublicValue *big.Int) []byte
 	GetPublicValue(secret *big.Int) []byte
+	PublicValueLength() int
 }
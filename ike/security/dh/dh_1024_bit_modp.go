@@ -56,6 +56,12 @@ func (d *Dh1024BitModp) GetSharedKey(secret, peerPublicValue *big.Int) []byte {
 	return sharedKey
 }
 
+// PublicValueLength returns the length of a Diffie-Hellman public value in the
+// KE payload, which RFC 7296 section 3.4 pads to the length of the prime
+func (d *Dh1024BitModp) PublicValueLength() int {
+	return d.primeBytesLength
+}
+
 // GetPublicValue computes the public value to send to the peer
 func (d *Dh1024BitModp) GetPublicValue(secret *big.Int) []byte {
 	publicValue := new(big.Int).Exp(d.generator, secret, d.prime).Bytes()
@@ -61,6 +61,12 @@ func (d *DH2048BitModp) GetSharedKey(secret, peerPublicValue *big.Int) []byte {
 	return shared
 }
 
+// PublicValueLength returns the length of a Diffie-Hellman public value in the
+// KE payload, which RFC 7296 section 3.4 pads to the length of the prime
+func (d *DH2048BitModp) PublicValueLength() int {
+	return d.primeBytesLength
+}
+
 // GetPublicValue computes our public value given our secret
 func (d *DH2048BitModp) GetPublicValue(secret *big.Int) []byte {
 	pub := new(big.Int).Exp(d.generator, secret, d.prime).Bytes()
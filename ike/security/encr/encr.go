@@ -13,12 +13,17 @@ import (
 
 var encrString map[uint16]func(uint16, uint16, []byte) string
 
-var encrTypes map[string]ENCRType
+var (
+	encrTypes  map[string]ENCRType
+	encrKTypes map[string]ENCRKType
+)
 
 func init() {
 	// ENCR String
 	encrString = map[uint16]func(uint16, uint16, []byte) string{
-		message.ENCR_AES_CBC: toString_ENCR_AES_CBC,
+		message.ENCR_AES_CBC:    toString_ENCR_AES_CBC,
+		message.ENCR_AES_CTR:    toString_ENCR_AES_CTR,
+		message.ENCR_AES_GCM_16: toString_ENCR_AES_GCM_16,
 	}
 
 	// ENCR Types
@@ -27,12 +32,27 @@ func init() {
 		ENCR_AES_CBC_192: &EncrAesCbc{keyLength: 24},
 		ENCR_AES_CBC_256: &EncrAesCbc{keyLength: 32},
 	}
+
+	// ENCR Kernel Types
+	encrKTypes = map[string]ENCRKType{
+		ENCR_AES_CBC_128:    &EncrAesCbc{keyLength: 16},
+		ENCR_AES_CBC_192:    &EncrAesCbc{keyLength: 24},
+		ENCR_AES_CBC_256:    &EncrAesCbc{keyLength: 32},
+		ENCR_AES_CTR_128:    &EncrAesCtr{keyLength: 16},
+		ENCR_AES_CTR_192:    &EncrAesCtr{keyLength: 24},
+		ENCR_AES_CTR_256:    &EncrAesCtr{keyLength: 32},
+		ENCR_AES_GCM_16_128: &EncrAesGcm16{keyLength: 16},
+		ENCR_AES_GCM_16_192: &EncrAesGcm16{keyLength: 24},
+		ENCR_AES_GCM_16_256: &EncrAesGcm16{keyLength: 32},
+	}
 }
 
 func DecodeTransform(transform *message.Transform) ENCRType {
 	if f, ok := encrString[transform.TransformID]; ok {
 		s := f(transform.AttributeType, transform.AttributeValue, transform.VariableLengthAttributeValue)
-		return encrTypes[s]
+		if encrType, ok := encrTypes[s]; ok {
+			return encrType
+		}
 	}
 	return nil
 }
@@ -53,9 +73,50 @@ func ToTransform(encrType ENCRType) (*message.Transform, error) {
 	return t, nil
 }
 
+// DecodeTransformChildSA returns the ESP encryption algorithm of transform
+func DecodeTransformChildSA(transform *message.Transform) ENCRKType {
+	if f, ok := encrString[transform.TransformID]; ok {
+		s := f(transform.AttributeType, transform.AttributeValue, transform.VariableLengthAttributeValue)
+		if encrKType, ok := encrKTypes[s]; ok {
+			return encrKType
+		}
+	}
+	return nil
+}
+
+func ToTransformChildSA(encrKType ENCRKType) (*message.Transform, error) {
+	t := &message.Transform{
+		TransformType: message.TypeEncryptionAlgorithm,
+		TransformID:   encrKType.TransformID(),
+	}
+	var err error
+	t.AttributePresent, t.AttributeType, t.AttributeValue, t.VariableLengthAttributeValue, err = encrKType.getAttribute()
+	if err != nil {
+		return nil, fmt.Errorf("ToTransformChildSA: %w", err)
+	}
+	if t.AttributePresent && t.VariableLengthAttributeValue == nil {
+		t.AttributeFormat = message.AttributeFormatUseTV
+	}
+	return t, nil
+}
+
+// IsAEAD reports whether the ESP encryption algorithm also provides integrity
+func IsAEAD(encrKType ENCRKType) bool {
+	_, ok := encrKType.(*EncrAesGcm16)
+	return ok
+}
+
 type ENCRType interface {
 	TransformID() uint16
 	getAttribute() (bool, uint16, uint16, []byte, error)
 	GetKeyLength() int
 	NewCrypto(key []byte) (ikeCrypto.IKECrypto, error)
 }
+
+// ENCRKType is an encryption algorithm of ESP child SAs, whose keys are
+// installed in the kernel. GetKeyLength includes any salt or nonce
+type ENCRKType interface {
+	TransformID() uint16
+	getAttribute() (bool, uint16, uint16, []byte, error)
+	GetKeyLength() int
+}
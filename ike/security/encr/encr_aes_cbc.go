@@ -79,20 +79,16 @@ type EncrAesCbcCrypto struct {
 	Padding []byte
 }
 
+// Encrypt pads plainText and encrypts it into a single buffer holding the IV
+// followed by the cipher text. The block cipher is safe for concurrent use,
+// and so is Encrypt as long as Iv and Padding are left unset
 func (encr *EncrAesCbcCrypto) Encrypt(plainText []byte) ([]byte, error) {
-	// Apply PKCS7 padding if not set
+	padLen := len(encr.Padding)
 	if encr.Padding == nil {
-		var err error
-		plainText, err = pkcs7Pad(plainText, aes.BlockSize)
-		if err != nil {
-			return nil, fmt.Errorf("Encrypt: %v", err)
-		}
-	} else {
-		plainText = append(plainText, encr.Padding...)
+		padLen = aes.BlockSize - len(plainText)%aes.BlockSize
 	}
-
-	cipherText := make([]byte, aes.BlockSize+len(plainText))
-	iv := cipherText[:aes.BlockSize]
+	cipherText := make([]byte, aes.BlockSize+len(plainText)+padLen)
+	iv, data := cipherText[:aes.BlockSize], cipherText[aes.BlockSize:]
 	if encr.Iv == nil {
 		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 			return nil, fmt.Errorf("Encrypt: failed to read IV: %v", err)
@@ -101,25 +97,28 @@ func (encr *EncrAesCbcCrypto) Encrypt(plainText []byte) ([]byte, error) {
 		copy(iv, encr.Iv)
 	}
 
+	copy(data, plainText)
+	if err := pad(data[len(plainText):], encr.Padding); err != nil {
+		return nil, fmt.Errorf("Encrypt: %v", err)
+	}
+
 	cbc := cipher.NewCBCEncrypter(encr.Block, iv)
-	cbc.CryptBlocks(cipherText[aes.BlockSize:], plainText)
+	cbc.CryptBlocks(data, data)
 	return cipherText, nil
 }
 
-func pkcs7Pad(data []byte, blockSize int) ([]byte, error) {
-	padLen := blockSize - (len(data) % blockSize)
-	if padLen == 0 {
-		padLen = blockSize
+// pad fills padding with the fixed padding if set, otherwise with random
+// octets ending with the pad length (RFC 7296 section 3.14)
+func pad(padding, fixed []byte) error {
+	if fixed != nil {
+		copy(padding, fixed)
+		return nil
 	}
-	padding := make([]byte, padLen)
 	if _, err := rand.Read(padding); err != nil {
-		return nil, fmt.Errorf("pkcs7Pad: %v", err)
-	}
-	for i := 0; i < padLen-1; i++ {
-		padding[i] = byte(int(padding[i]) % (math.MaxUint8 + 1))
+		return fmt.Errorf("pad: %v", err)
 	}
-	padding[padLen-1] = byte(padLen - 1)
-	return append(data, padding...), nil
+	padding[len(padding)-1] = byte(len(padding) - 1)
+	return nil
 }
 
 func (encr *EncrAesCbcCrypto) Decrypt(cipherText []byte) ([]byte, error) {
@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package encr
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+const (
+	ENCR_AES_CTR_128 string = "ENCR_AES_CTR_128"
+	ENCR_AES_CTR_192 string = "ENCR_AES_CTR_192"
+	ENCR_AES_CTR_256 string = "ENCR_AES_CTR_256"
+)
+
+// Octets of KEYMAT following the AES key: the nonce of AES-CTR (RFC 3686
+// section 5.1) and the salt of AES-GCM (RFC 4106 section 8.1)
+const saltLength = 4
+
+func toString_ENCR_AES_CTR(attrType uint16, intValue uint16, bytesValue []byte) string {
+	if attrType != message.AttributeTypeKeyLength {
+		return ""
+	}
+	switch intValue {
+	case 128:
+		return ENCR_AES_CTR_128
+	case 192:
+		return ENCR_AES_CTR_192
+	case 256:
+		return ENCR_AES_CTR_256
+	default:
+		return ""
+	}
+}
+
+var _ ENCRKType = &EncrAesCtr{}
+
+// EncrAesCtr is AES-CTR for ESP, only installed in the kernel
+type EncrAesCtr struct {
+	keyLength int
+}
+
+func (t *EncrAesCtr) TransformID() uint16 {
+	return message.ENCR_AES_CTR
+}
+
+func (t *EncrAesCtr) getAttribute() (bool, uint16, uint16, []byte, error) {
+	return keyLengthAttribute(t.keyLength)
+}
+
+// GetKeyLength returns the length of the AES key followed by the nonce
+func (t *EncrAesCtr) GetKeyLength() int {
+	return t.keyLength + saltLength
+}
+
+func keyLengthAttribute(keyLength int) (bool, uint16, uint16, []byte, error) {
+	keyLengthBits := keyLength * 8
+	if keyLengthBits <= 0 || keyLengthBits > math.MaxUint16 {
+		return false, 0, 0, nil, fmt.Errorf("key length exceeds uint16 maximum value: %v", keyLengthBits)
+	}
+	return true, message.AttributeTypeKeyLength, uint16(keyLengthBits), nil, nil
+}
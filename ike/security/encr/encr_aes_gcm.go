@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package encr
+
+import (
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+const (
+	ENCR_AES_GCM_16_128 string = "ENCR_AES_GCM_16_128"
+	ENCR_AES_GCM_16_192 string = "ENCR_AES_GCM_16_192"
+	ENCR_AES_GCM_16_256 string = "ENCR_AES_GCM_16_256"
+)
+
+func toString_ENCR_AES_GCM_16(attrType uint16, intValue uint16, bytesValue []byte) string {
+	if attrType != message.AttributeTypeKeyLength {
+		return ""
+	}
+	switch intValue {
+	case 128:
+		return ENCR_AES_GCM_16_128
+	case 192:
+		return ENCR_AES_GCM_16_192
+	case 256:
+		return ENCR_AES_GCM_16_256
+	default:
+		return ""
+	}
+}
+
+var _ ENCRKType = &EncrAesGcm16{}
+
+// EncrAesGcm16 is AES-GCM with a 16 octet ICV for ESP (RFC 4106), only
+// installed in the kernel. It provides integrity by itself
+type EncrAesGcm16 struct {
+	keyLength int
+}
+
+func (t *EncrAesGcm16) TransformID() uint16 {
+	return message.ENCR_AES_GCM_16
+}
+
+func (t *EncrAesGcm16) getAttribute() (bool, uint16, uint16, []byte, error) {
+	return keyLengthAttribute(t.keyLength)
+}
+
+// GetKeyLength returns the length of the AES key followed by the salt
+func (t *EncrAesGcm16) GetKeyLength() int {
+	return t.keyLength + saltLength
+}
@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package integ
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func toString_AUTH_HMAC_SHA2_384_192(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return AUTH_HMAC_SHA2_384_192
+}
+
+// AuthHmacSha2_384_192 implements HMAC-SHA2-384-192 integrity algorithm
+type AuthHmacSha2_384_192 struct {
+	KeyLen    int
+	OutputLen int
+}
+
+func (a *AuthHmacSha2_384_192) TransformID() uint16 {
+	return message.AUTH_HMAC_SHA2_384_192
+}
+
+func (a *AuthHmacSha2_384_192) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (a *AuthHmacSha2_384_192) GetKeyLength() int {
+	return a.KeyLen
+}
+
+func (a *AuthHmacSha2_384_192) GetOutputLength() int {
+	return a.OutputLen
+}
+
+func (a *AuthHmacSha2_384_192) Init(key []byte) hash.Hash {
+	if len(key) == 48 {
+		return hmac.New(sha512.New384, key)
+	}
+	return nil
+}
+
+var (
+	_ INTEGType  = &AuthHmacSha2_384_192{}
+	_ INTEGKType = &AuthHmacSha2_384_192{}
+)
@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package integ
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func toString_AUTH_HMAC_SHA2_512_256(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return AUTH_HMAC_SHA2_512_256
+}
+
+// AuthHmacSha2_512_256 implements HMAC-SHA2-512-256 integrity algorithm
+type AuthHmacSha2_512_256 struct {
+	KeyLen    int
+	OutputLen int
+}
+
+func (a *AuthHmacSha2_512_256) TransformID() uint16 {
+	return message.AUTH_HMAC_SHA2_512_256
+}
+
+func (a *AuthHmacSha2_512_256) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (a *AuthHmacSha2_512_256) GetKeyLength() int {
+	return a.KeyLen
+}
+
+func (a *AuthHmacSha2_512_256) GetOutputLength() int {
+	return a.OutputLen
+}
+
+func (a *AuthHmacSha2_512_256) Init(key []byte) hash.Hash {
+	if len(key) == 64 {
+		return hmac.New(sha512.New, key)
+	}
+	return nil
+}
+
+var (
+	_ INTEGType  = &AuthHmacSha2_512_256{}
+	_ INTEGKType = &AuthHmacSha2_512_256{}
+)
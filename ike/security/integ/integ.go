@@ -14,6 +14,8 @@ const (
 	AUTH_HMAC_MD5_96       string = "AUTH_HMAC_MD5_96"
 	AUTH_HMAC_SHA1_96      string = "AUTH_HMAC_SHA1_96"
 	AUTH_HMAC_SHA2_256_128 string = "AUTH_HMAC_SHA2_256_128"
+	AUTH_HMAC_SHA2_384_192 string = "AUTH_HMAC_SHA2_384_192"
+	AUTH_HMAC_SHA2_512_256 string = "AUTH_HMAC_SHA2_512_256"
 )
 
 var integString map[uint16]func(uint16, uint16, []byte) string
@@ -31,6 +33,8 @@ func init() {
 	integString[message.AUTH_HMAC_MD5_96] = toString_AUTH_HMAC_MD5_96
 	integString[message.AUTH_HMAC_SHA1_96] = toString_AUTH_HMAC_SHA1_96
 	integString[message.AUTH_HMAC_SHA2_256_128] = toString_AUTH_HMAC_SHA2_256_128
+	integString[message.AUTH_HMAC_SHA2_384_192] = toString_AUTH_HMAC_SHA2_384_192
+	integString[message.AUTH_HMAC_SHA2_512_256] = toString_AUTH_HMAC_SHA2_512_256
 
 	// INTEG Types
 	integTypes = make(map[string]INTEGType)
@@ -46,6 +50,14 @@ func init() {
 		KeyLen:    32,
 		OutputLen: 16,
 	}
+	integTypes[AUTH_HMAC_SHA2_384_192] = &AuthHmacSha2_384_192{
+		KeyLen:    48,
+		OutputLen: 24,
+	}
+	integTypes[AUTH_HMAC_SHA2_512_256] = &AuthHmacSha2_512_256{
+		KeyLen:    64,
+		OutputLen: 32,
+	}
 
 	// INTEG Kernel Types
 	integKTypes = make(map[string]INTEGKType)
@@ -61,6 +73,14 @@ func init() {
 		KeyLen:    32,
 		OutputLen: 16,
 	}
+	integKTypes[AUTH_HMAC_SHA2_384_192] = &AuthHmacSha2_384_192{
+		KeyLen:    48,
+		OutputLen: 24,
+	}
+	integKTypes[AUTH_HMAC_SHA2_512_256] = &AuthHmacSha2_512_256{
+		KeyLen:    64,
+		OutputLen: 32,
+	}
 }
 
 func DecodeTransform(transform *message.Transform) INTEGType {
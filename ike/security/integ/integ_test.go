@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package integ
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// RFC 4868 section 2.7.2.3, test cases AUTH512-1 and AUTH512-2
+func TestAuthHmacSha2_512_256(t *testing.T) {
+	testcases := []struct {
+		description string
+		key         []byte
+		data        []byte
+		expICV      string
+	}{
+		{
+			description: "AUTH512-1",
+			key:         bytes.Repeat([]byte{0x0b}, 64),
+			data:        []byte("Hi There"),
+			expICV:      "637edc6e01dce7e6742a99451aae82df23da3e92439e590e43e761b33e910fb8",
+		},
+		{
+			description: "AUTH512-2",
+			key:         bytes.Repeat([]byte("Jefe"), 16),
+			data:        []byte("what do ya want for nothing?"),
+			expICV:      "cb370917ae8a7ce28cfd1d8f4705d6141c173b2a9362c15df235dfb251b15454",
+		},
+	}
+
+	var transform message.TransformContainer
+	transform.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_512_256, nil, nil, nil)
+	integType := DecodeTransform(transform[0])
+	if integType == nil {
+		t.Fatalf("AUTH_HMAC_SHA2_512_256 not decoded")
+	}
+	if integType.GetKeyLength() != 64 || integType.GetOutputLength() != 32 {
+		t.Errorf("lengths mismatch. got = %d/%d, want = 64/32", integType.GetKeyLength(),
+			integType.GetOutputLength())
+	}
+	if integKType := DecodeTransformChildSA(transform[0]); integKType == nil {
+		t.Errorf("AUTH_HMAC_SHA2_512_256 not decoded for child SAs")
+	}
+	if integType.Init(bytes.Repeat([]byte{0x0b}, 32)) != nil {
+		t.Errorf("key of 32 bytes accepted")
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			mac := integType.Init(tc.key)
+			if mac == nil {
+				t.Fatalf("key of %d bytes refused", len(tc.key))
+			}
+			if _, err := mac.Write(tc.data); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			icv := hex.EncodeToString(mac.Sum(nil)[:integType.GetOutputLength()])
+			if icv != tc.expICV {
+				t.Errorf("ICV mismatch. got = %s, want = %s", icv, tc.expICV)
+			}
+		})
+	}
+}
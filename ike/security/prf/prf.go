@@ -14,6 +14,7 @@ const (
 	PRF_HMAC_MD5      string = "PRF_HMAC_MD5"
 	PRF_HMAC_SHA1     string = "PRF_HMAC_SHA1"
 	PRF_HMAC_SHA2_256 string = "PRF_HMAC_SHA2_256"
+	PRF_HMAC_SHA2_512 string = "PRF_HMAC_SHA2_512"
 )
 
 var (
@@ -26,12 +27,14 @@ func init() {
 		message.PRF_HMAC_MD5:      toString_PRF_HMAC_MD5,
 		message.PRF_HMAC_SHA1:     toString_PRF_HMAC_SHA1,
 		message.PRF_HMAC_SHA2_256: toString_PRF_HMAC_SHA2_256,
+		message.PRF_HMAC_SHA2_512: toString_PRF_HMAC_SHA2_512,
 	}
 
 	prfNameToType = map[string]PRFType{
 		PRF_HMAC_MD5:      &PrfHmacMd5{},
 		PRF_HMAC_SHA1:     &PrfHmacSha1{},
 		PRF_HMAC_SHA2_256: &PrfHmacSha2_256{},
+		PRF_HMAC_SHA2_512: &PrfHmacSha2_512{},
 	}
 }
 
@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package prf
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// PRF_HMAC_SHA2_512 implements the PRFType interface using HMAC-SHA2-512 (RFC 4868).
+const (
+	PrfHmacSha2_512KeyLength    = 64 // 512 bits
+	PrfHmacSha2_512OutputLength = 64 // 512 bits
+)
+
+var _ PRFType = &PrfHmacSha2_512{}
+
+// PrfHmacSha2_512 provides HMAC-SHA2-512 PRF functionality.
+type PrfHmacSha2_512 struct{}
+
+func toString_PRF_HMAC_SHA2_512(attrType, attrValue uint16, variableAttr []byte) string {
+	return PRF_HMAC_SHA2_512
+}
+
+func (t *PrfHmacSha2_512) TransformID() uint16 {
+	return message.PRF_HMAC_SHA2_512
+}
+
+func (t *PrfHmacSha2_512) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *PrfHmacSha2_512) GetKeyLength() int {
+	return PrfHmacSha2_512KeyLength
+}
+
+func (t *PrfHmacSha2_512) GetOutputLength() int {
+	return PrfHmacSha2_512OutputLength
+}
+
+func (t *PrfHmacSha2_512) Init(key []byte) hash.Hash {
+	return hmac.New(sha512.New, key)
+}
@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package prf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// RFC 4231 test cases 1 and 2, and RFC 4868 test case PRF-1 for SHA-512
+func TestPrfHmacSha2_512(t *testing.T) {
+	testcases := []struct {
+		description string
+		key         []byte
+		data        []byte
+		expOutput   string
+	}{
+		{
+			description: "RFC 4231 test case 1",
+			key:         bytes.Repeat([]byte{0x0b}, 20),
+			data:        []byte("Hi There"),
+			expOutput: "87aa7cdea5ef619d4ff0b4241a1d6cb02379f4e2ce4ec2787ad0b30545e17cde" +
+				"daa833b7d6b8a702038b274eaea3f4e4be9d914eeb61f1702e696c203a126854",
+		},
+		{
+			description: "RFC 4231 test case 2",
+			key:         []byte("Jefe"),
+			data:        []byte("what do ya want for nothing?"),
+			expOutput: "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea250554" +
+				"9758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737",
+		},
+		{
+			description: "RFC 4868 PRF-1, 512 bit key",
+			key:         bytes.Repeat([]byte{0x0b}, 64),
+			data:        []byte("Hi There"),
+			expOutput: "637edc6e01dce7e6742a99451aae82df23da3e92439e590e43e761b33e910fb8" +
+				"ac2878ebd5803f6f0b61dbce5e251ff8789a4722c1be65aea45fd464e89f8f5b",
+		},
+	}
+
+	var transform message.TransformContainer
+	transform.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_512, nil, nil, nil)
+	prfType := DecodeTransform(transform[0])
+	if prfType == nil {
+		t.Fatalf("PRF_HMAC_SHA2_512 not decoded")
+	}
+	if prfType.GetKeyLength() != 64 || prfType.GetOutputLength() != 64 {
+		t.Errorf("lengths mismatch. got = %d/%d, want = 64/64", prfType.GetKeyLength(), prfType.GetOutputLength())
+	}
+	if encoded := ToTransform(prfType); encoded.TransformID != message.PRF_HMAC_SHA2_512 ||
+		encoded.AttributePresent {
+		t.Errorf("Unexpected transform: %+v", encoded)
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			prf := prfType.Init(tc.key)
+			if _, err := prf.Write(tc.data); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if output := hex.EncodeToString(prf.Sum(nil)); output != tc.expOutput {
+				t.Errorf("output mismatch. got = %s, want = %s", output, tc.expOutput)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package security
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	// ErrCertificateRevoked is returned when a revocation source lists the certificate
+	ErrCertificateRevoked = errors.New("certificate revoked")
+	// ErrRevocationUnknown is returned when no revocation source could tell the certificate status
+	ErrRevocationUnknown = errors.New("certificate revocation status unknown")
+)
+
+// Upper bound of a downloaded CRL or OCSP response
+const maxRevocationResponseSize = 10 << 20
+
+// Time a source that failed to answer is not queried again, bounded by the
+// cache TTL, so that a dead responder does not delay every IKE_AUTH
+const revocationFailureTTL = time.Minute
+
+// errNotCached is returned by the lookups of CheckCached for a source whose
+// answer must be fetched
+var errNotCached = errors.New("revocation status not cached")
+
+// RevocationChecker checks UE certificates against the configured OCSP
+// responders and CRL distribution points. Responses are cached until their
+// next update time, bounded by the configured cache TTL, and the failures of
+// a source for revocationFailureTTL
+type RevocationChecker struct {
+	issuer    *x509.Certificate
+	crlURLs   []string
+	ocspURLs  []string
+	cacheTTL  time.Duration
+	softFail  bool
+	client    *http.Client
+	mu        sync.Mutex
+	crlCache  map[string]*cachedCRL
+	ocspCache map[string]*cachedOCSPStatus
+	failures  map[string]*cachedFailure // By CRL URL, or OCSP URL and serial
+	now       func() time.Time
+}
+
+type cachedCRL struct {
+	list    *x509.RevocationList
+	expires time.Time
+}
+
+type cachedOCSPStatus struct {
+	status  int
+	expires time.Time
+}
+
+type cachedFailure struct {
+	err     error
+	expires time.Time
+}
+
+// NewRevocationChecker returns a checker for certificates issued by issuer,
+// or nil if neither CRL nor OCSP sources are configured. With softFail set,
+// a certificate whose status cannot be determined is accepted
+func NewRevocationChecker(issuer *x509.Certificate, crlURLs, ocspURLs []string,
+	cacheTTL, timeout time.Duration, softFail bool,
+) *RevocationChecker {
+	if len(crlURLs) == 0 && len(ocspURLs) == 0 {
+		return nil
+	}
+	return &RevocationChecker{
+		issuer:    issuer,
+		crlURLs:   crlURLs,
+		ocspURLs:  ocspURLs,
+		cacheTTL:  cacheTTL,
+		softFail:  softFail,
+		client:    &http.Client{Timeout: timeout},
+		crlCache:  make(map[string]*cachedCRL),
+		ocspCache: make(map[string]*cachedOCSPStatus),
+		failures:  make(map[string]*cachedFailure),
+		now:       time.Now,
+	}
+}
+
+// Check returns nil if the certificate is not revoked. OCSP responders are
+// queried first, CRLs are used when no responder gives a definite answer.
+// The sources are fetched unless cached, so Check may block for the HTTP
+// timeout of each source. A nil checker accepts every certificate
+func (c *RevocationChecker) Check(cert *x509.Certificate) error {
+	if c == nil {
+		return nil
+	}
+	return c.check(cert, true)
+}
+
+// CheckCached answers as Check from the cached responses and failures only.
+// It returns false when a source must be fetched to tell the status of the
+// certificate, see Check
+func (c *RevocationChecker) CheckCached(cert *x509.Certificate) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	err := c.check(cert, false)
+	if errors.Is(err, errNotCached) {
+		return false, nil
+	}
+	return true, err
+}
+
+func (c *RevocationChecker) check(cert *x509.Certificate, fetch bool) error {
+	if err := cert.CheckSignatureFrom(c.issuer); err != nil {
+		return fmt.Errorf("Check: certificate not issued by the CA: %w", err)
+	}
+
+	var errs []error
+	for _, url := range c.ocspURLs {
+		status, err := c.ocspStatus(url, cert, fetch)
+		if errors.Is(err, errNotCached) {
+			return err
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		switch status {
+		case ocsp.Good:
+			return nil
+		case ocsp.Revoked:
+			return fmt.Errorf("Check: serial %s: %w", cert.SerialNumber, ErrCertificateRevoked)
+		}
+	}
+	for _, url := range c.crlURLs {
+		list, err := c.crl(url, fetch)
+		if errors.Is(err, errNotCached) {
+			return err
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("Check: serial %s: %w", cert.SerialNumber, ErrCertificateRevoked)
+			}
+		}
+		return nil
+	}
+
+	if c.softFail {
+		return nil
+	}
+	return fmt.Errorf("Check: %w: %w", ErrRevocationUnknown, errors.Join(errs...))
+}
+
+// expiry returns when a response published at nextUpdate must be fetched again
+func (c *RevocationChecker) expiry(now, nextUpdate time.Time) time.Time {
+	expires := now.Add(c.cacheTTL)
+	if !nextUpdate.IsZero() && nextUpdate.Before(expires) {
+		return nextUpdate
+	}
+	return expires
+}
+
+// failure returns the cached failure of the source key, nil if none
+func (c *RevocationChecker) failure(key string, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.failures[key]; ok && now.Before(cached.expires) {
+		return cached.err
+	}
+	return nil
+}
+
+// fail caches err as the answer of the source key and returns it
+func (c *RevocationChecker) fail(key string, now time.Time, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[key] = &cachedFailure{err: err, expires: now.Add(min(revocationFailureTTL, c.cacheTTL))}
+	return err
+}
+
+func (c *RevocationChecker) ocspStatus(url string, cert *x509.Certificate, fetch bool) (int, error) {
+	key := url + "|" + cert.SerialNumber.String()
+	now := c.now()
+	c.mu.Lock()
+	cached, ok := c.ocspCache[key]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.status, nil
+	}
+	if err := c.failure(key, now); err != nil {
+		return 0, err
+	}
+	if !fetch {
+		return 0, errNotCached
+	}
+
+	request, err := ocsp.CreateRequest(cert, c.issuer, nil)
+	if err != nil {
+		return 0, fmt.Errorf("ocspStatus: %w", err)
+	}
+	body, err := c.fetch(http.MethodPost, url, "application/ocsp-request", request)
+	if err != nil {
+		return 0, c.fail(key, now, fmt.Errorf("ocspStatus: %w", err))
+	}
+	response, err := ocsp.ParseResponseForCert(body, cert, c.issuer)
+	if err != nil {
+		return 0, c.fail(key, now, fmt.Errorf("ocspStatus: %s: %w", url, err))
+	}
+	if !response.NextUpdate.IsZero() && now.After(response.NextUpdate) {
+		return 0, c.fail(key, now, fmt.Errorf("ocspStatus: %s: stale response", url))
+	}
+	if response.Status == ocsp.Unknown {
+		return 0, c.fail(key, now, fmt.Errorf("ocspStatus: %s: status unknown", url))
+	}
+
+	c.mu.Lock()
+	c.ocspCache[key] = &cachedOCSPStatus{status: response.Status, expires: c.expiry(now, response.NextUpdate)}
+	c.mu.Unlock()
+	return response.Status, nil
+}
+
+func (c *RevocationChecker) crl(url string, fetch bool) (*x509.RevocationList, error) {
+	now := c.now()
+	c.mu.Lock()
+	cached, ok := c.crlCache[url]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.list, nil
+	}
+	if err := c.failure(url, now); err != nil {
+		return nil, err
+	}
+	if !fetch {
+		return nil, errNotCached
+	}
+
+	body, err := c.fetch(http.MethodGet, url, "", nil)
+	if err != nil {
+		return nil, c.fail(url, now, fmt.Errorf("crl: %w", err))
+	}
+	list, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return nil, c.fail(url, now, fmt.Errorf("crl: %s: %w", url, err))
+	}
+	if err = list.CheckSignatureFrom(c.issuer); err != nil {
+		return nil, c.fail(url, now, fmt.Errorf("crl: %s: %w", url, err))
+	}
+	if !list.NextUpdate.IsZero() && now.After(list.NextUpdate) {
+		return nil, c.fail(url, now, fmt.Errorf("crl: %s: stale list", url))
+	}
+
+	c.mu.Lock()
+	c.crlCache[url] = &cachedCRL{list: list, expires: c.expiry(now, list.NextUpdate)}
+	c.mu.Unlock()
+	return list, nil
+}
+
+func (c *RevocationChecker) fetch(method, url, contentType string, body []byte) ([]byte, error) {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", url, response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, maxRevocationResponseSize))
+}
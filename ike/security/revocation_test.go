@@ -0,0 +1,337 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testPKI struct {
+	ca        *x509.Certificate
+	caKey     crypto.Signer
+	valid     *x509.Certificate
+	revoked   *x509.Certificate
+	revokedAt time.Time
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	issue := func(serial int64) *x509.Certificate {
+		ueKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "ue"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &ueKey.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return cert
+	}
+
+	return &testPKI{
+		ca:        ca,
+		caKey:     caKey,
+		valid:     issue(100),
+		revoked:   issue(200),
+		revokedAt: time.Now().Add(-time.Minute),
+	}
+}
+
+// newOCSPResponder answers Good for every serial except the revoked one
+func (p *testPKI) newOCSPResponder(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if request.SerialNumber.Cmp(p.revoked.SerialNumber) == 0 {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = p.revokedAt
+		}
+		response, err := ocsp.CreateResponse(p.ca, p.ca, template, p.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err = w.Write(response); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}))
+}
+
+// newCRLServer serves a CRL listing the revoked certificate
+func (p *testPKI) newCRLServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: p.revoked.SerialNumber, RevocationTime: p.revokedAt},
+		},
+	}, p.ca, p.caKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if _, err := w.Write(crl); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}))
+}
+
+func TestRevocationChecker(t *testing.T) {
+	pki := newTestPKI(t)
+	var ocspRequests, crlRequests atomic.Int32
+	ocspServer := pki.newOCSPResponder(t, &ocspRequests)
+	defer ocspServer.Close()
+	crlServer := pki.newCRLServer(t, &crlRequests)
+	defer crlServer.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	defer unreachable.Close()
+
+	testcases := []struct {
+		description string
+		crlURLs     []string
+		ocspURLs    []string
+		softFail    bool
+		cert        *x509.Certificate
+		expErr      error
+	}{
+		{
+			description: "OCSP good",
+			ocspURLs:    []string{ocspServer.URL},
+			cert:        pki.valid,
+		},
+		{
+			description: "OCSP revoked",
+			ocspURLs:    []string{ocspServer.URL},
+			cert:        pki.revoked,
+			expErr:      ErrCertificateRevoked,
+		},
+		{
+			description: "CRL not listed",
+			crlURLs:     []string{crlServer.URL},
+			cert:        pki.valid,
+		},
+		{
+			description: "CRL revoked",
+			crlURLs:     []string{crlServer.URL},
+			cert:        pki.revoked,
+			expErr:      ErrCertificateRevoked,
+		},
+		{
+			description: "OCSP failure falls back to CRL",
+			ocspURLs:    []string{unreachable.URL},
+			crlURLs:     []string{crlServer.URL},
+			cert:        pki.revoked,
+			expErr:      ErrCertificateRevoked,
+		},
+		{
+			description: "no source answers",
+			ocspURLs:    []string{unreachable.URL},
+			crlURLs:     []string{unreachable.URL},
+			cert:        pki.valid,
+			expErr:      ErrRevocationUnknown,
+		},
+		{
+			description: "no source answers with soft fail",
+			ocspURLs:    []string{unreachable.URL},
+			softFail:    true,
+			cert:        pki.valid,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			checker := NewRevocationChecker(pki.ca, tc.crlURLs, tc.ocspURLs, time.Hour, time.Second, tc.softFail)
+			err := checker.Check(tc.cert)
+			if tc.expErr == nil {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			} else if !errors.Is(err, tc.expErr) {
+				t.Errorf("error mismatch. got = %v, want = %v", err, tc.expErr)
+			}
+		})
+	}
+}
+
+func TestRevocationCheckerCache(t *testing.T) {
+	pki := newTestPKI(t)
+	var ocspRequests, crlRequests atomic.Int32
+	ocspServer := pki.newOCSPResponder(t, &ocspRequests)
+	defer ocspServer.Close()
+	crlServer := pki.newCRLServer(t, &crlRequests)
+	defer crlServer.Close()
+
+	now := time.Now()
+	checker := NewRevocationChecker(pki.ca, []string{crlServer.URL}, nil, time.Minute, time.Second, false)
+	checker.now = func() time.Time { return now }
+	for range 3 {
+		if err := checker.Check(pki.valid); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if got := crlRequests.Load(); got != 1 {
+		t.Errorf("CRL requests mismatch. got = %d, want = 1", got)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := checker.Check(pki.valid); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := crlRequests.Load(); got != 2 {
+		t.Errorf("CRL requests after TTL mismatch. got = %d, want = 2", got)
+	}
+
+	checker = NewRevocationChecker(pki.ca, nil, []string{ocspServer.URL}, time.Minute, time.Second, false)
+	checker.now = func() time.Time { return now }
+	for range 3 {
+		if err := checker.Check(pki.revoked); !errors.Is(err, ErrCertificateRevoked) {
+			t.Fatalf("error mismatch. got = %v, want = %v", err, ErrCertificateRevoked)
+		}
+	}
+	if got := ocspRequests.Load(); got != 1 {
+		t.Errorf("OCSP requests mismatch. got = %d, want = 1", got)
+	}
+}
+
+func TestRevocationCheckerFailureCache(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests atomic.Int32
+	deadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer deadServer.Close()
+
+	now := time.Now()
+	checker := NewRevocationChecker(pki.ca, []string{deadServer.URL}, nil, time.Hour, time.Second, false)
+	checker.now = func() time.Time { return now }
+	for range 3 {
+		if err := checker.Check(pki.valid); !errors.Is(err, ErrRevocationUnknown) {
+			t.Fatalf("error mismatch. got = %v, want = %v", err, ErrRevocationUnknown)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("requests mismatch. got = %d, want = 1", got)
+	}
+	now = now.Add(revocationFailureTTL + time.Second)
+	if decided, _ := checker.CheckCached(pki.valid); decided {
+		t.Errorf("expected the expired failure to be fetched again")
+	}
+	if err := checker.Check(pki.valid); !errors.Is(err, ErrRevocationUnknown) {
+		t.Fatalf("error mismatch. got = %v, want = %v", err, ErrRevocationUnknown)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("requests after failure TTL mismatch. got = %d, want = 2", got)
+	}
+}
+
+func TestRevocationCheckerCheckCached(t *testing.T) {
+	pki := newTestPKI(t)
+	var ocspRequests atomic.Int32
+	ocspServer := pki.newOCSPResponder(t, &ocspRequests)
+	defer ocspServer.Close()
+
+	checker := NewRevocationChecker(pki.ca, nil, []string{ocspServer.URL}, time.Hour, time.Second, false)
+	if decided, err := checker.CheckCached(pki.revoked); decided || err != nil {
+		t.Fatalf("CheckCached = %v, %v, expected an undecided status", decided, err)
+	}
+	if got := ocspRequests.Load(); got != 0 {
+		t.Errorf("OCSP requests mismatch. got = %d, want = 0", got)
+	}
+	if err := checker.Check(pki.revoked); !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("error mismatch. got = %v, want = %v", err, ErrCertificateRevoked)
+	}
+	decided, err := checker.CheckCached(pki.revoked)
+	if !decided || !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("CheckCached = %v, %v, expected %v", decided, err, ErrCertificateRevoked)
+	}
+	if got := ocspRequests.Load(); got != 1 {
+		t.Errorf("OCSP requests mismatch. got = %d, want = 1", got)
+	}
+}
+
+func TestRevocationCheckerForeignIssuer(t *testing.T) {
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+	checker := NewRevocationChecker(pki.ca, []string{"http://127.0.0.1:1/crl"}, nil, time.Minute, time.Second, true)
+	if err := checker.Check(other.valid); err == nil {
+		t.Errorf("Expected error but got none")
+	}
+}
+
+func TestNilRevocationChecker(t *testing.T) {
+	if checker := NewRevocationChecker(nil, nil, nil, time.Minute, time.Second, false); checker != nil {
+		t.Fatalf("Expected nil checker without revocation sources")
+	}
+	var checker *RevocationChecker
+	if err := checker.Check(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
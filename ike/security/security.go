@@ -10,11 +10,14 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"math/big"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/omec-project/n3iwf/ike/message"
 	ikeCrypto "github.com/omec-project/n3iwf/ike/security/IKECrypto"
@@ -32,6 +35,46 @@ var (
 	randomNumberMinimum big.Int
 )
 
+// RFC 7296 section 2.10: nonces are at least 128 bits long
+const MinNonceLength = 16
+
+// ErrNonceTooShort reports a nonce shorter than RFC 7296 section 2.10 requires
+var ErrNonceTooShort = errors.New("nonce too short")
+
+// ErrInvalidKEPayload reports a Diffie-Hellman public value whose length does
+// not match the negotiated group
+var ErrInvalidKEPayload = errors.New("invalid key exchange data length")
+
+// MinNonceLengthForPRF returns the minimum length of a single nonce: 128 bits
+// and at least half the key size of the negotiated PRF
+func MinNonceLengthForPRF(prfInfo prf.PRFType) int {
+	return max(MinNonceLength, (prfInfo.GetKeyLength()+1)/2)
+}
+
+// randReader is the source of the nonces, Diffie-Hellman secrets and SPIs
+var randReader io.Reader = rand.Reader
+
+// SetRandReader replaces the source of the nonces, Diffie-Hellman secrets and
+// SPIs generated for the IKE exchanges, and returns the previous one. A nil
+// reader restores crypto/rand. Only meant for tests needing reproducible
+// values, it must not be called while exchanges are in progress
+func SetRandReader(r io.Reader) io.Reader {
+	previous := randReader
+	if r == nil {
+		r = rand.Reader
+	}
+	randReader = r
+	return previous
+}
+
+// ReadRandom fills b from the random source set by SetRandReader
+func ReadRandom(b []byte) error {
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return fmt.Errorf("ReadRandom: %w", err)
+	}
+	return nil
+}
+
 func init() {
 	randomNumberMaximum.SetString(strings.Repeat("F", 512), 16)
 	randomNumberMinimum.SetString(strings.Repeat("F", 32), 16)
@@ -40,7 +83,7 @@ func init() {
 // GenerateRandomNumber returns a random big.Int between randomNumberMinimum and randomNumberMaximum
 func GenerateRandomNumber() (*big.Int, error) {
 	for {
-		number, err := rand.Int(rand.Reader, &randomNumberMaximum)
+		number, err := rand.Int(randReader, &randomNumberMaximum)
 		if err != nil {
 			logger.IKELog.Errorf("error occurs when generate random number: %+v", err)
 			return nil, fmt.Errorf("error occurs when generate random number: %+v", err)
@@ -54,7 +97,7 @@ func GenerateRandomNumber() (*big.Int, error) {
 // GenerateRandomUint8 returns a random uint8 value
 func GenerateRandomUint8() (uint8, error) {
 	number := make([]byte, 1)
-	if _, err := io.ReadFull(rand.Reader, number); err != nil {
+	if _, err := io.ReadFull(randReader, number); err != nil {
 		logger.IKELog.Errorf("read random failed: %+v", err)
 		return 0, fmt.Errorf("read random failed: %+v", err)
 	}
@@ -78,7 +121,8 @@ type IKESAKey struct {
 	IntegInfo integ.INTEGType
 	PrfInfo   prf.PRFType
 
-	// Security objects
+	// Security objects, keyed once by GenerateKeyForIKESA and reused for
+	// every message of the SA
 	Prf_d   hash.Hash           // used to derive key for child sa
 	Integ_i hash.Hash           // used by initiator for integrity checking
 	Integ_r hash.Hash           // used by responder for integrity checking
@@ -95,6 +139,30 @@ type IKESAKey struct {
 	SK_er []byte // used by responder for encrypting
 	SK_pi []byte // used by initiator for IKE authentication
 	SK_pr []byte // used by responder for IKE authentication
+
+	// Serializes the integrity MACs, whose state is reset for each message.
+	// The receiver checks messages before the SA is locked, and the
+	// retransmission timer sends without holding it
+	integMu sync.Mutex
+}
+
+// Integrity returns the checksum of data computed with the integrity key of
+// role, truncated to the output length of the integrity algorithm
+func (ikesaKey *IKESAKey) Integrity(role message.Role, data []byte) ([]byte, error) {
+	mac := ikesaKey.Integ_r
+	if role == message.Role_Initiator {
+		mac = ikesaKey.Integ_i
+	}
+	if mac == nil || ikesaKey.IntegInfo == nil {
+		return nil, errors.New("integrity key is nil")
+	}
+	ikesaKey.integMu.Lock()
+	defer ikesaKey.integMu.Unlock()
+	mac.Reset()
+	if _, err := mac.Write(data); err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil)[:ikesaKey.IntegInfo.GetOutputLength()], nil
 }
 
 func (ikesaKey *IKESAKey) String() string {
@@ -149,7 +217,7 @@ func NewIKESAKey(
 		return nil, nil, fmt.Errorf("unsupported transform in proposal")
 	}
 
-	localPublicValue, sharedKeyData, err := CalculateDiffieHellmanMaterials(ikesaKey, keyExchangeData)
+	localPublicValue, sharedKeyData, err := CalculateDiffieHellmanMaterials(ikesaKey.DhInfo, keyExchangeData)
 	if err != nil {
 		return nil, nil, fmt.Errorf("NewIKESAKey: %w", err)
 	}
@@ -160,16 +228,24 @@ func NewIKESAKey(
 }
 
 // CalculateDiffieHellmanMaterials generates secret and calculates Diffie-Hellman public key exchange material
+// of group dhInfo, for an IKE SA or for the fresh exchange of a child SA with PFS
 func CalculateDiffieHellmanMaterials(
-	ikesaKey *IKESAKey,
+	dhInfo dh.DHType,
 	peerPublicValue []byte,
 ) ([]byte, []byte, error) {
+	if dhInfo == nil {
+		return nil, nil, errors.New("CalculateDiffieHellmanMaterials(): no Diffie-Hellman group")
+	}
+	if length := dhInfo.PublicValueLength(); len(peerPublicValue) != length {
+		return nil, nil, fmt.Errorf("CalculateDiffieHellmanMaterials(): got %d bytes, want %d: %w",
+			len(peerPublicValue), length, ErrInvalidKEPayload)
+	}
 	secret, err := GenerateRandomNumber()
 	if err != nil {
 		return nil, nil, fmt.Errorf("CalculateDiffieHellmanMaterials(): %w", err)
 	}
 	peerPublicValueBig := new(big.Int).SetBytes(peerPublicValue)
-	return ikesaKey.DhInfo.GetPublicValue(secret), ikesaKey.DhInfo.GetSharedKey(secret, peerPublicValueBig), nil
+	return dhInfo.GetPublicValue(secret), dhInfo.GetSharedKey(secret, peerPublicValueBig), nil
 }
 
 // GenerateKeyForIKESA derives all IKE SA keys as defined in RFC7296
@@ -201,9 +277,10 @@ func (ikesaKey *IKESAKey) GenerateKeyForIKESA(
 		return fmt.Errorf("no Diffie-hellman group algorithm specified")
 	}
 
-	if len(concatenatedNonce) == 0 {
-		logger.IKELog.Errorf("no concatenated nonce data")
-		return fmt.Errorf("no concatenated nonce data")
+	// Ni | Nr keys the PRF computing SKEYSEED, short nonces weaken every derived key
+	if minLength := 2 * MinNonceLengthForPRF(ikesaKey.PrfInfo); len(concatenatedNonce) < minLength {
+		return fmt.Errorf("concatenated nonce of %d bytes, need at least %d: %w",
+			len(concatenatedNonce), minLength, ErrNonceTooShort)
 	}
 	if len(diffieHellmanSharedKey) == 0 {
 		logger.IKELog.Errorf("no Diffie-Hellman shared key")
@@ -280,7 +357,7 @@ func (ikesaKey *IKESAKey) GenerateKeyForIKESA(
 // Child SA transform types
 type ChildSAKey struct {
 	DhInfo     dh.DHType
-	EncrKInfo  encr.ENCRType
+	EncrKInfo  encr.ENCRKType
 	IntegKInfo integ.INTEGKType
 	EsnInfo    esn.ESN
 
@@ -297,7 +374,7 @@ func (childsaKey *ChildSAKey) ToProposal() (*message.Proposal, error) {
 	if childsaKey.DhInfo != nil {
 		p.DiffieHellmanGroup = append(p.DiffieHellmanGroup, dh.ToTransform(childsaKey.DhInfo))
 	}
-	encrKTransform, err := encr.ToTransform(childsaKey.EncrKInfo)
+	encrKTransform, err := encr.ToTransformChildSA(childsaKey.EncrKInfo)
 	if err != nil {
 		return nil, fmt.Errorf("ChildSAKey ToProposal: %w", err)
 	}
@@ -314,21 +391,26 @@ func NewChildSAKeyByProposal(proposal *message.Proposal) (*ChildSAKey, error) {
 	if proposal == nil {
 		return nil, fmt.Errorf("proposal is nil")
 	}
-	if len(proposal.EncryptionAlgorithm) == 0 || len(proposal.IntegrityAlgorithm) == 0 || len(proposal.ExtendedSequenceNumbers) == 0 {
+	if len(proposal.EncryptionAlgorithm) == 0 || len(proposal.ExtendedSequenceNumbers) == 0 {
 		return nil, fmt.Errorf("proposal missing required transforms")
 	}
 
 	childsaKey := &ChildSAKey{}
-	if len(proposal.DiffieHellmanGroup) == 1 {
+	// NONE, as a UE may propose it, means no PFS
+	if len(proposal.DiffieHellmanGroup) == 1 && proposal.DiffieHellmanGroup[0].TransformID != message.DH_NONE {
 		childsaKey.DhInfo = dh.DecodeTransform(proposal.DiffieHellmanGroup[0])
 		if childsaKey.DhInfo == nil {
 			return nil, fmt.Errorf("unsupported DiffieHellmanGroup[%v]", proposal.DiffieHellmanGroup[0].TransformID)
 		}
 	}
-	childsaKey.EncrKInfo = encr.DecodeTransform(proposal.EncryptionAlgorithm[0])
+	childsaKey.EncrKInfo = encr.DecodeTransformChildSA(proposal.EncryptionAlgorithm[0])
 	if childsaKey.EncrKInfo == nil {
 		return nil, fmt.Errorf("unsupported encryption algorithm[%v]", proposal.EncryptionAlgorithm[0].TransformID)
 	}
+	// RFC 5282: an AEAD cipher is negotiated without integrity algorithm
+	if len(proposal.IntegrityAlgorithm) == 0 && !encr.IsAEAD(childsaKey.EncrKInfo) {
+		return nil, fmt.Errorf("proposal missing integrity algorithm")
+	}
 	if len(proposal.IntegrityAlgorithm) == 1 {
 		childsaKey.IntegKInfo = integ.DecodeTransformChildSA(proposal.IntegrityAlgorithm[0])
 		if childsaKey.IntegKInfo == nil {
@@ -343,10 +425,12 @@ func NewChildSAKeyByProposal(proposal *message.Proposal) (*ChildSAKey, error) {
 	return childsaKey, nil
 }
 
-// GenerateKeyForChildSA derives all Child SA keys as specified in RFC 7296
+// GenerateKeyForChildSA derives all Child SA keys as specified in RFC 7296,
+// with the shared secret of the fresh Diffie-Hellman exchange of a child SA
+// with PFS, nil without
 func (childsaKey *ChildSAKey) GenerateKeyForChildSA(
 	ikeSA *IKESAKey,
-	concatenatedNonce []byte,
+	diffieHellmanSharedKey, concatenatedNonce []byte,
 ) error {
 	// Check parameters
 	if ikeSA == nil {
@@ -382,7 +466,7 @@ func (childsaKey *ChildSAKey) GenerateKeyForChildSA(
 	totalKeyLength = (lengthEncryptionKeyIPSec + lengthIntegrityKeyIPSec) * 2
 
 	// Generate key for child security association as specified in RFC 7296 section 2.17
-	seed := concatenatedNonce
+	seed := slices.Concat(diffieHellmanSharedKey, concatenatedNonce)
 
 	keyStream := prfPlus(ikeSA.Prf_d, seed, totalKeyLength)
 	if keyStream == nil {
@@ -0,0 +1,375 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	mathRand "math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security/dh"
+)
+
+func TestNewIKESAKeyNonceLength(t *testing.T) {
+	newProposal := func(prfID uint16) *message.Proposal {
+		keyLength := uint16(256)
+		attrType := uint16(message.AttributeTypeKeyLength)
+		proposal := new(message.Proposal)
+		proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+		proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, prfID, nil, nil, nil)
+		proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+		proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+		return proposal
+	}
+
+	testcases := []struct {
+		description string
+		prfID       uint16
+		nonceLength int
+		expErr      error
+	}{
+		{
+			description: "two 128 bit nonces",
+			prfID:       message.PRF_HMAC_SHA1,
+			nonceLength: 32,
+		},
+		{
+			description: "undersized concatenated nonce",
+			prfID:       message.PRF_HMAC_SHA1,
+			nonceLength: 16,
+			expErr:      ErrNonceTooShort,
+		},
+		{
+			description: "empty concatenated nonce",
+			prfID:       message.PRF_HMAC_SHA2_256,
+			expErr:      ErrNonceTooShort,
+		},
+		{
+			description: "long enough for HMAC-SHA2-256",
+			prfID:       message.PRF_HMAC_SHA2_256,
+			nonceLength: 32,
+		},
+		{
+			description: "undersized for HMAC-SHA2-512",
+			prfID:       message.PRF_HMAC_SHA2_512,
+			nonceLength: 48,
+			expErr:      ErrNonceTooShort,
+		},
+		{
+			description: "long enough for HMAC-SHA2-512",
+			prfID:       message.PRF_HMAC_SHA2_512,
+			nonceLength: 64,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, _, err := NewIKESAKey(newProposal(tc.prfID), bytes.Repeat([]byte{0x5a}, 256),
+				bytes.Repeat([]byte{0x01}, tc.nonceLength), 0x1111, 0x2222)
+			if tc.expErr == nil {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			} else if !errors.Is(err, tc.expErr) {
+				t.Errorf("error mismatch. got = %v, want = %v", err, tc.expErr)
+			}
+		})
+	}
+}
+
+func TestNewIKESAKeyKeyExchangeLength(t *testing.T) {
+	newProposal := func(dhGroup uint16) *message.Proposal {
+		keyLength := uint16(256)
+		attrType := uint16(message.AttributeTypeKeyLength)
+		proposal := new(message.Proposal)
+		proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+		proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA1, nil, nil, nil)
+		proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+		proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, dhGroup, nil, nil, nil)
+		return proposal
+	}
+
+	testcases := []struct {
+		description string
+		dhGroup     uint16
+		keLength    int
+		expErr      error
+	}{
+		{
+			description: "2048 bit MODP",
+			dhGroup:     message.DH_2048_BIT_MODP,
+			keLength:    256,
+		},
+		{
+			description: "1024 bit MODP",
+			dhGroup:     message.DH_1024_BIT_MODP,
+			keLength:    128,
+		},
+		{
+			description: "truncated public value",
+			dhGroup:     message.DH_2048_BIT_MODP,
+			keLength:    8,
+			expErr:      ErrInvalidKEPayload,
+		},
+		{
+			description: "public value of another group",
+			dhGroup:     message.DH_2048_BIT_MODP,
+			keLength:    128,
+			expErr:      ErrInvalidKEPayload,
+		},
+		{
+			description: "empty public value",
+			dhGroup:     message.DH_1024_BIT_MODP,
+			expErr:      ErrInvalidKEPayload,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, _, err := NewIKESAKey(newProposal(tc.dhGroup), bytes.Repeat([]byte{0x5a}, tc.keLength),
+				bytes.Repeat([]byte{0x01}, 32), 0x1111, 0x2222)
+			if tc.expErr == nil {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			} else if !errors.Is(err, tc.expErr) {
+				t.Errorf("error mismatch. got = %v, want = %v", err, tc.expErr)
+			}
+		})
+	}
+}
+
+func TestGenerateKeyForChildSAIntegrityKeyLength(t *testing.T) {
+	var ikeProposal message.Proposal
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	ikeProposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	ikeProposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_256, nil, nil, nil)
+	ikeProposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	ikeProposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+	concatenatedNonce := bytes.Repeat([]byte{0x01}, 32)
+	ikeSAKey, _, err := NewIKESAKey(&ikeProposal, bytes.Repeat([]byte{0x5a}, 256), concatenatedNonce, 0x1111, 0x2222)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		description  string
+		integID      uint16
+		expKeyLength int
+	}{
+		{
+			description:  "HMAC-SHA1-96",
+			integID:      message.AUTH_HMAC_SHA1_96,
+			expKeyLength: 20,
+		},
+		{
+			description:  "HMAC-SHA2-256-128",
+			integID:      message.AUTH_HMAC_SHA2_256_128,
+			expKeyLength: 32,
+		},
+		{
+			description:  "HMAC-SHA2-384-192",
+			integID:      message.AUTH_HMAC_SHA2_384_192,
+			expKeyLength: 48,
+		},
+		{
+			description:  "HMAC-SHA2-512-256",
+			integID:      message.AUTH_HMAC_SHA2_512_256,
+			expKeyLength: 64,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			proposal := new(message.Proposal)
+			proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+			proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, tc.integID, nil, nil, nil)
+			proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+			childSAKey, err := NewChildSAKeyByProposal(proposal)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err = childSAKey.GenerateKeyForChildSA(ikeSAKey, nil, concatenatedNonce); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := len(childSAKey.InitiatorToResponderIntegrityKey); got != tc.expKeyLength {
+				t.Errorf("initiator integrity key length mismatch. got = %d, want = %d", got, tc.expKeyLength)
+			}
+			if got := len(childSAKey.ResponderToInitiatorIntegrityKey); got != tc.expKeyLength {
+				t.Errorf("responder integrity key length mismatch. got = %d, want = %d", got, tc.expKeyLength)
+			}
+		})
+	}
+}
+
+func TestCalculateDiffieHellmanMaterials(t *testing.T) {
+	var proposal message.Proposal
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+	dhInfo := dh.DecodeTransform(proposal.DiffieHellmanGroup[0])
+
+	// Both ends of a child SA rekey with PFS get the same shared secret
+	uePrivate := new(big.Int).SetBytes(bytes.Repeat([]byte{0x11}, 32))
+	uePublicValue := dhInfo.GetPublicValue(uePrivate)
+	n3iwfPublicValue, n3iwfSharedKey, err := CalculateDiffieHellmanMaterials(dhInfo, uePublicValue)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ueSharedKey := dhInfo.GetSharedKey(uePrivate, new(big.Int).SetBytes(n3iwfPublicValue))
+	if !bytes.Equal(ueSharedKey, n3iwfSharedKey) {
+		t.Error("shared secret mismatch between the UE and the N3IWF")
+	}
+
+	if _, _, err = CalculateDiffieHellmanMaterials(dhInfo, uePublicValue[1:]); !errors.Is(err, ErrInvalidKEPayload) {
+		t.Errorf("Expected ErrInvalidKEPayload, got %v", err)
+	}
+	if _, _, err = CalculateDiffieHellmanMaterials(nil, uePublicValue); err == nil {
+		t.Error("Expected error but got none")
+	}
+}
+
+func TestGenerateKeyForChildSAWithPFS(t *testing.T) {
+	var ikeProposal message.Proposal
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	ikeProposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	ikeProposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_256, nil, nil, nil)
+	ikeProposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	ikeProposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+	concatenatedNonce := bytes.Repeat([]byte{0x01}, 32)
+	ikeSAKey, _, err := NewIKESAKey(&ikeProposal, bytes.Repeat([]byte{0x5a}, 256), concatenatedNonce, 0x1111, 0x2222)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	proposal := new(message.Proposal)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_NONE, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+	childSAKey := func(sharedKey []byte) *ChildSAKey {
+		t.Helper()
+		key, err := NewChildSAKeyByProposal(proposal)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err = key.GenerateKeyForChildSA(ikeSAKey, sharedKey, concatenatedNonce); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return key
+	}
+
+	withoutPFS := childSAKey(nil)
+	if withoutPFS.DhInfo != nil {
+		t.Errorf("DH NONE decoded as group %d", withoutPFS.DhInfo.TransformID())
+	}
+	withPFS := childSAKey(bytes.Repeat([]byte{0x77}, 256))
+	if bytes.Equal(withoutPFS.InitiatorToResponderEncryptionKey, withPFS.InitiatorToResponderEncryptionKey) ||
+		bytes.Equal(withoutPFS.ResponderToInitiatorIntegrityKey, withPFS.ResponderToInitiatorIntegrityKey) {
+		t.Error("child SA keys do not derive from the Diffie-Hellman shared secret")
+	}
+}
+
+func TestSetRandReader(t *testing.T) {
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	proposal := new(message.Proposal)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_256, nil, nil, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+	peerPublicValue := bytes.Repeat([]byte{0x5a}, 256)
+
+	type generated struct {
+		nonce, spi, publicValue, skD []byte
+	}
+	generate := func(seed byte) generated {
+		var chachaSeed [32]byte
+		chachaSeed[0] = seed
+		previous := SetRandReader(mathRand.NewChaCha8(chachaSeed))
+		defer SetRandReader(previous)
+
+		nonce, err := GenerateRandomNumber()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		spi := make([]byte, 8)
+		if err = ReadRandom(spi); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		ikesaKey, publicValue, err := NewIKESAKey(proposal, peerPublicValue, append(nonce.Bytes(), nonce.Bytes()...), 0x1111, 0x2222)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return generated{nonce: nonce.Bytes(), spi: spi, publicValue: publicValue, skD: ikesaKey.SK_d}
+	}
+
+	first, again, other := generate(1), generate(1), generate(2)
+	if !bytes.Equal(first.nonce, again.nonce) || !bytes.Equal(first.spi, again.spi) ||
+		!bytes.Equal(first.publicValue, again.publicValue) || !bytes.Equal(first.skD, again.skD) {
+		t.Errorf("values generated from the same seed differ")
+	}
+	if bytes.Equal(first.nonce, other.nonce) || bytes.Equal(first.publicValue, other.publicValue) ||
+		bytes.Equal(first.skD, other.skD) {
+		t.Errorf("values generated from different seeds are equal")
+	}
+
+	SetRandReader(nil)
+	if randReader != rand.Reader {
+		t.Errorf("nil reader did not restore crypto/rand")
+	}
+}
+
+func TestIKESAKeyIntegrityConcurrent(t *testing.T) {
+	var ikeProposal message.Proposal
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	ikeProposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	ikeProposal.PseudorandomFunction.BuildTransform(message.TypePseudorandomFunction, message.PRF_HMAC_SHA2_256, nil, nil, nil)
+	ikeProposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA2_256_128, nil, nil, nil)
+	ikeProposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_2048_BIT_MODP, nil, nil, nil)
+	ikeSAKey, _, err := NewIKESAKey(&ikeProposal, bytes.Repeat([]byte{0x5a}, 256), bytes.Repeat([]byte{0x01}, 32), 0x1111, 0x2222)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data := [][]byte{bytes.Repeat([]byte{0x01}, 100), bytes.Repeat([]byte{0x02}, 300)}
+	want := make([][]byte, len(data))
+	for i := range data {
+		if want[i], err = ikeSAKey.Integrity(message.Role_Responder, data[i]); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(want[i]) != 16 {
+			t.Fatalf("checksum length mismatch. got = %d, want = 16", len(want[i]))
+		}
+	}
+
+	// The receiver and the senders share the keyed MACs of the SA
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				i := (g + n) % len(data)
+				got, err := ikeSAKey.Integrity(message.Role_Responder, data[i])
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				if !bytes.Equal(got, want[i]) {
+					t.Errorf("checksum mismatch. got = %x, want = %x", got, want[i])
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -6,18 +6,23 @@
 package service
 
 import (
-	"bytes"
+	ctx "context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/omec-project/n3iwf/context"
 	"github.com/omec-project/n3iwf/ike"
 	"github.com/omec-project/n3iwf/ike/handler"
 	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/xfrm"
 	"github.com/omec-project/n3iwf/logger"
 	"github.com/omec-project/n3iwf/util"
 )
@@ -26,7 +31,7 @@ const (
 	RECEIVE_IKEPACKET_CHANNEL_LEN = 512
 	RECEIVE_IKEEVENT_CHANNEL_LEN  = 512
 	DEFAULT_IKE_PORT              = 500
-	DEFAULT_NATT_PORT             = 4500
+	DEFAULT_NATT_PORT             = message.NATTPort
 )
 
 // EspHandler defines a function to handle ESP packets
@@ -37,22 +42,35 @@ func Run(n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) error {
 	ip := n3iwfCtx.IkeBindAddress
 	n3iwfCtx.IkeServer = &context.IkeServer{
 		Listener:    make(map[int]*net.UDPConn),
+		SendQueue:   make(map[int]*context.IKESendQueue),
 		RcvIkePktCh: make(chan context.IkeReceivePacket, RECEIVE_IKEPACKET_CHANNEL_LEN),
 		RcvEventCh:  make(chan context.IkeEvt, RECEIVE_IKEEVENT_CHANNEL_LEN),
 		StopServer:  make(chan struct{}),
+		Done:        make(chan struct{}),
+
+		MaxPendingInits: n3iwfCtx.MaxPendingIKESAInits,
 	}
 
-	ikeAddrPort, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip, DEFAULT_IKE_PORT))
+	// JoinHostPort brackets IPv6 bind addresses
+	ikeAddrPort, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(DEFAULT_IKE_PORT)))
 	if err != nil {
 		logger.IKELog.Errorf("resolve UDP address failed: %+v", err)
 		return fmt.Errorf("IKE service run failed")
 	}
-	nattAddrPort, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip, DEFAULT_NATT_PORT))
+	nattAddrPort, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(DEFAULT_NATT_PORT)))
 	if err != nil {
 		logger.IKELog.Errorf("resolve UDP address failed: %+v", err)
 		return fmt.Errorf("NAT-T service run failed")
 	}
 
+	// The child SAs left in the kernel by a previous run are matched to the
+	// IKE SAs of the context before any UE is served
+	if count, err := xfrm.ReconstructChildSAs(xfrm.NetlinkDumper, n3iwfCtx); err != nil {
+		logger.IKELog.Warnf("reconstruct child SAs from kernel XFRM state failed: %+v", err)
+	} else if count > 0 {
+		logger.IKELog.Infof("%d child SAs reconstructed from kernel XFRM state", count)
+	}
+
 	// Listen and serve
 	for _, addr := range []struct {
 		portName string
@@ -70,19 +88,37 @@ func Run(n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) error {
 		}
 	}
 
+	// The child SAs are rekeyed once the kernel reports their soft expiry
+	var expiries <-chan xfrm.ChildSAExpiry
+	expiryDone := make(chan struct{})
+	if n3iwfCtx.ChildSALifetime.Enabled() {
+		if expiries, err = xfrm.MonitorExpire(expiryDone); err != nil {
+			logger.IKELog.Errorf("monitor child SA expiries failed: %+v", err)
+			return fmt.Errorf("IKE service run failed")
+		}
+	}
+
 	wg.Add(1)
-	go runIkeEventHandler(n3iwfCtx, wg)
+	go runIkeEventHandler(n3iwfCtx, expiries, expiryDone, wg)
 
 	return nil
 }
 
-// runIkeEventHandler processes incoming IKE packets and events
-func runIkeEventHandler(n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) {
+// runIkeEventHandler processes incoming IKE packets and events, and the child
+// SA expiries reported by the kernel until expiryDone is closed on exit
+func runIkeEventHandler(n3iwfCtx *context.N3IWFContext, expiries <-chan xfrm.ChildSAExpiry,
+	expiryDone chan struct{}, wg *sync.WaitGroup,
+) {
 	defer util.RecoverWithLog(logger.IKELog)
+	n3iwfCtx.Health.Set(context.HealthIKEEventLoop, true)
 	defer func() {
 		logger.IKELog.Infoln("IKE server stopped")
+		n3iwfCtx.Health.Set(context.HealthIKEEventLoop, false)
+		close(expiryDone)
 		close(n3iwfCtx.IkeServer.RcvIkePktCh)
-		close(n3iwfCtx.IkeServer.RcvEventCh)
+		// RcvEventCh is left open, the timers and goroutines posting events
+		// may still send to it, see SendEvent
+		close(n3iwfCtx.IkeServer.Done)
 		close(n3iwfCtx.IkeServer.StopServer)
 		wg.Done()
 	}()
@@ -90,20 +126,51 @@ func runIkeEventHandler(n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) {
 	for {
 		select {
 		case rcvPkt := <-n3iwfCtx.IkeServer.RcvIkePktCh:
-			ikeMsg, ikeSA, err := checkIKEMessage(rcvPkt.Msg, rcvPkt.Listener, rcvPkt.LocalAddr, rcvPkt.RemoteAddr)
-			if err != nil {
-				logger.IKELog.Warnln(err)
-				continue
+			handlePacket(rcvPkt)
+			if rcvPkt.PendingInit {
+				n3iwfCtx.IkeServer.DoneIKESAInit()
 			}
-			ike.Dispatch(rcvPkt.Listener, rcvPkt.LocalAddr, rcvPkt.RemoteAddr, ikeMsg, rcvPkt.Msg, ikeSA)
 		case rcvIkeEvent := <-n3iwfCtx.IkeServer.RcvEventCh:
-			handler.HandleEvent(rcvIkeEvent)
+			handleEvent(rcvIkeEvent)
+		case expiry, ok := <-expiries:
+			if !ok {
+				expiries = nil
+				continue
+			}
+			handleChildSAExpiry(expiry)
 		case <-n3iwfCtx.IkeServer.StopServer:
 			return
 		}
 	}
 }
 
+// handlePacket decodes and dispatches one received IKE packet. A panic while
+// decoding must not stop the event loop, handler panics are recovered by Dispatch
+func handlePacket(rcvPkt context.IkeReceivePacket) {
+	defer util.RecoverWithLog(logger.IKELog)
+
+	ikeMsg, ikeSA, err := checkIKEMessage(rcvPkt.Msg, rcvPkt.Listener, rcvPkt.LocalAddr, rcvPkt.RemoteAddr)
+	if err != nil {
+		logger.IKELog.Warnln(err)
+		return
+	}
+	ike.Dispatch(rcvPkt.Listener, rcvPkt.LocalAddr, rcvPkt.RemoteAddr, ikeMsg, rcvPkt.Msg, ikeSA)
+}
+
+// handleEvent runs the handler of one IKE event without stopping the event
+// loop if it panics
+func handleEvent(ikeEvt context.IkeEvt) {
+	defer util.RecoverWithLog(logger.IKELog)
+	handler.HandleEvent(ikeEvt)
+}
+
+// handleChildSAExpiry handles the expiry of an XFRM state reported by the
+// kernel without stopping the event loop if it panics
+func handleChildSAExpiry(expiry xfrm.ChildSAExpiry) {
+	defer util.RecoverWithLog(logger.IKELog)
+	handler.HandleXfrmStateExpire(expiry.SPI, expiry.Dst, expiry.Hard)
+}
+
 // receiver listens for UDP packets and forwards valid IKE messages
 func receiver(localAddr *net.UDPAddr, errChan chan<- error, n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) {
 	defer util.RecoverWithLog(logger.IKELog)
@@ -118,9 +185,30 @@ func receiver(localAddr *net.UDPAddr, errChan chan<- error, n3iwfCtx *context.N3
 		errChan <- fmt.Errorf("listenAndServe failed")
 		return
 	}
+	// Also marks the IKE messages of the NAT-T port
+	if err = util.SetDSCP(listener, n3iwfCtx.ControlPlaneDSCP); err != nil {
+		logger.IKELog.Errorf("set DSCP failed: %+v", err)
+		_ = listener.Close()
+		errChan <- fmt.Errorf("listenAndServe failed")
+		return
+	}
+	// The maps are only written before errChan is closed: Run waits for it
+	// before starting the next receiver, so no other goroutine accesses them
+	n3iwfCtx.IkeServer.Listener[localAddr.Port] = listener
+	var sendConn context.IKEConn = listener
+	if sendQueue := context.NewIKESendQueue(listener, n3iwfCtx.IKESendRate, n3iwfCtx.IKESendBurst,
+		n3iwfCtx.IKESendQueueSize); sendQueue != nil {
+		n3iwfCtx.IkeServer.SendQueue[localAddr.Port] = sendQueue
+		sendConn = sendQueue
+	}
 	close(errChan)
+	healthComponent := context.HealthIKEListener(localAddr.Port)
+	n3iwfCtx.Health.Set(healthComponent, true)
+	defer n3iwfCtx.Health.Set(healthComponent, false)
 
-	n3iwfCtx.IkeServer.Listener[localAddr.Port] = listener
+	// Sized for the largest UDP payload, so that no datagram is truncated: the
+	// NAT-T port also receives ESP packets, and IKE messages larger than
+	// IKEMaxMessageSize are rejected by checkIKEMessage rather than cut short
 	data := make([]byte, context.MAX_BUF_MSG_LEN)
 
 	for {
@@ -136,6 +224,7 @@ func receiver(localAddr *net.UDPAddr, errChan chan<- error, n3iwfCtx *context.N3
 
 		// As specified in RFC 7296 section 3.1, the IKE message send from/to UDP port 4500
 		// should prepend a 4 bytes zero
+		datagram := forwardData
 		if localAddr.Port == DEFAULT_NATT_PORT {
 			forwardData, err = handleNattMsg(forwardData, remoteAddr, localAddr, handleESPPacket)
 			if err != nil {
@@ -147,21 +236,39 @@ func receiver(localAddr *net.UDPAddr, errChan chan<- error, n3iwfCtx *context.N3
 			}
 		}
 
+		// Keepalives and ESP packets are not captured, but malformed IKE datagrams are
+		n3iwfCtx.IKECapture.Capture(context.TraceInbound, localAddr, remoteAddr, datagram)
+
 		if len(forwardData) < message.IKE_HEADER_LEN {
 			logger.IKELog.Warnf("received IKE msg is too short from %s", remoteAddr.String())
 			continue
 		}
 
+		// Beyond the IKE_SA_INIT backlog, new UEs are shed before reaching the
+		// event loop, the established ones keep being served
+		pendingInit := isIKESAInitRequest(forwardData)
+		if pendingInit && !n3iwfCtx.IkeServer.AdmitIKESAInit() {
+			logger.IKELog.Debugf("IKE_SA_INIT backlog full, drop IKE_SA_INIT from %s", remoteAddr)
+			continue
+		}
+
 		ikePkt := context.IkeReceivePacket{
-			RemoteAddr: remoteAddr,
-			Listener:   listener,
-			LocalAddr:  localAddr,
-			Msg:        forwardData,
+			RemoteAddr:  remoteAddr,
+			Listener:    sendConn,
+			LocalAddr:   localAddr,
+			Msg:         forwardData,
+			PendingInit: pendingInit,
 		}
 		n3iwfCtx.IkeServer.RcvIkePktCh <- ikePkt
 	}
 }
 
+// isIKESAInitRequest reports whether msg, at least an IKE header long, is an
+// IKE_SA_INIT request
+func isIKESAInitRequest(msg []byte) bool {
+	return msg[18] == message.IKE_SA_INIT && msg[19]&message.ResponseBitCheck == 0
+}
+
 // handleNattMsg processes NAT-T messages and ESP packets
 func handleNattMsg(msgBuf []byte, rAddr, lAddr *net.UDPAddr, espHandler EspHandler) ([]byte, error) {
 	if len(msgBuf) == 1 && msgBuf[0] == 0xff {
@@ -169,12 +276,11 @@ func handleNattMsg(msgBuf []byte, rAddr, lAddr *net.UDPAddr, espHandler EspHandl
 		return nil, nil
 	}
 
-	nonEspMarker := []byte{0, 0, 0, 0} // Non-ESP Marker
-	nonEspMarkerLen := len(nonEspMarker)
-	if len(msgBuf) < nonEspMarkerLen {
+	if len(msgBuf) < message.NonESPMarkerLen {
 		return nil, fmt.Errorf("received msg is too short")
 	}
-	if !bytes.Equal(msgBuf[:nonEspMarkerLen], nonEspMarker) {
+	ikeMsg, ok := message.StripNonESPMarker(msgBuf)
+	if !ok {
 		// ESP packet
 		if espHandler != nil {
 			if err := espHandler(rAddr, lAddr, msgBuf); err != nil {
@@ -185,8 +291,24 @@ func handleNattMsg(msgBuf []byte, rAddr, lAddr *net.UDPAddr, espHandler EspHandl
 		return nil, nil
 	}
 
-	// IKE message: skip Non-ESP Marker
-	return msgBuf[nonEspMarkerLen:], nil
+	return ikeMsg, nil
+}
+
+// Shutdown asks the IKE event loop to delete every UE session and waits until
+// it is done or ctx expires. It must be called before Stop
+func Shutdown(shutdownCtx ctx.Context, n3iwfCtx *context.N3IWFContext) error {
+	evt := context.NewShutdownEvt()
+	select {
+	case n3iwfCtx.IkeServer.RcvEventCh <- evt:
+	case <-shutdownCtx.Done():
+		return fmt.Errorf("IKE shutdown: %w", shutdownCtx.Err())
+	}
+	select {
+	case <-evt.Done:
+		return nil
+	case <-shutdownCtx.Done():
+		return fmt.Errorf("IKE shutdown: %w", shutdownCtx.Err())
+	}
 }
 
 // Stop closes all listeners and signals the server to stop
@@ -197,17 +319,34 @@ func Stop(n3iwfCtx *context.N3IWFContext) {
 			logger.IKELog.Errorf("stop IKE server: %s error: %+v", ikeServerListener.LocalAddr().String(), err)
 		}
 	}
+	for _, sendQueue := range n3iwfCtx.IkeServer.SendQueue {
+		sendQueue.Close()
+	}
 	n3iwfCtx.IkeServer.StopServer <- struct{}{}
+	if err := n3iwfCtx.IKECapture.Close(); err != nil {
+		logger.IKELog.Errorf("close IKE capture: %+v", err)
+	}
+	if auditSink, ok := n3iwfCtx.AuditSink.(io.Closer); ok {
+		if err := auditSink.Close(); err != nil {
+			logger.IKELog.Errorf("close audit log: %+v", err)
+		}
+	}
 }
 
 // checkIKEMessage validates and parses IKE messages
-func checkIKEMessage(msg []byte, udpConn *net.UDPConn, localAddr, remoteAddr *net.UDPAddr) (*message.IKEMessage, *context.IKESecurityAssociation, error) {
+func checkIKEMessage(msg []byte, udpConn context.IKEConn, localAddr, remoteAddr *net.UDPAddr) (*message.IKEMessage, *context.IKESecurityAssociation, error) {
 	ikeHeader, err := message.ParseHeader(msg)
 	if err != nil {
 		logger.IKELog.Errorf("IKE msg decode header error: %v", err)
 		return nil, nil, fmt.Errorf("IKE msg decode header: %w", err)
 	}
 
+	if maxSize := context.N3IWFSelf().IKEMaxMessageSize; maxSize > 0 && len(msg) > maxSize {
+		rejectOversizedMessage(ikeHeader, udpConn, localAddr, remoteAddr)
+		return nil, nil, fmt.Errorf("%w: %d bytes from %s, at most %d accepted", message.ErrMessageTooLarge,
+			len(msg), remoteAddr, maxSize)
+	}
+
 	if ikeHeader.MajorVersion > 2 {
 		payload := new(message.IKEPayloadContainer)
 		payload.BuildNotification(message.TypeNone, message.INVALID_MAJOR_VERSION, nil, nil)
@@ -248,12 +387,34 @@ func checkIKEMessage(msg []byte, udpConn *net.UDPConn, localAddr, remoteAddr *ne
 		ikeMessage, err = handler.DecodeDecrypt(msg, ikeHeader, ikeSA.IKESAKey, message.Role_Responder)
 		if err != nil {
 			logger.IKELog.Errorf("decrypt Ike message error: %v", err)
+			if rsp := handler.BuildDecryptErrorResponse(ikeHeader, err); rsp != nil {
+				if sendErr := handler.SendIKEMessageToUE(udpConn, localAddr, remoteAddr, rsp, ikeSA.IKESAKey); sendErr != nil {
+					logger.IKELog.Errorf("check Ike message: %v", sendErr)
+				}
+			}
 			return nil, nil, fmt.Errorf("decrypt Ike message error: %w", err)
 		}
 	}
+	context.N3IWFSelf().TraceIKEMessage(context.TraceInbound, localAddr, remoteAddr, ikeMessage)
 	return ikeMessage, ikeSA, nil
 }
 
+// rejectOversizedMessage answers an oversized IKE_SA_INIT request with
+// INVALID_SYNTAX. Other messages are dropped silently as their integrity
+// cannot be checked without processing them (RFC 7296 section 2.21.2)
+func rejectOversizedMessage(ikeHeader *message.IKEHeader, udpConn context.IKEConn, localAddr, remoteAddr *net.UDPAddr) {
+	if ikeHeader.ExchangeType != message.IKE_SA_INIT || ikeHeader.IsResponse() {
+		return
+	}
+	var payload message.IKEPayloadContainer
+	payload.BuildNotification(message.TypeNone, message.INVALID_SYNTAX, nil, nil)
+	responseIKEMessage := message.NewMessage(ikeHeader.InitiatorSPI, ikeHeader.ResponderSPI,
+		message.IKE_SA_INIT, true, false, ikeHeader.MessageID, payload)
+	if err := handler.SendIKEMessageToUE(udpConn, localAddr, remoteAddr, responseIKEMessage, nil); err != nil {
+		logger.IKELog.Errorf("reject oversized IKE message: %v", err)
+	}
+}
+
 // constructPacketWithESP builds an IPv4 packet with ESP payload
 func constructPacketWithESP(srcIP, dstIP *net.UDPAddr, espPacket []byte) ([]byte, error) {
 	const (
@@ -322,6 +483,49 @@ func constructPacketWithESP(srcIP, dstIP *net.UDPAddr, espPacket []byte) ([]byte
 	return packet, nil
 }
 
+// constructIPv6PacketWithESP builds an IPv6 packet with ESP payload
+func constructIPv6PacketWithESP(srcIP, dstIP *net.UDPAddr, espPacket []byte) ([]byte, error) {
+	const (
+		ipHeaderLen = 40
+		ipVersion   = 6
+		ipHopLimit  = 64
+		ipProtoESP  = 50 // ESP protocol number
+	)
+
+	if srcIP.IP.To4() != nil || srcIP.IP.To16() == nil {
+		return nil, fmt.Errorf("source address %s is not a valid IPv6 address", srcIP.IP)
+	}
+	if dstIP.IP.To4() != nil || dstIP.IP.To16() == nil {
+		return nil, fmt.Errorf("destination address %s is not a valid IPv6 address", dstIP.IP)
+	}
+	if len(espPacket) > 65535 {
+		return nil, fmt.Errorf("packet too large: %d bytes", ipHeaderLen+len(espPacket))
+	}
+
+	packet := make([]byte, ipHeaderLen+len(espPacket))
+
+	// Version (4 bits) + Traffic Class (8 bits) + Flow Label (20 bits)
+	packet[0] = ipVersion << 4
+
+	// Payload Length, the IPv6 header is not included
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(espPacket))) // #nosec G115
+
+	// Next Header (ESP)
+	packet[6] = ipProtoESP
+
+	// Hop Limit
+	packet[7] = ipHopLimit
+
+	// Source and Destination IP
+	copy(packet[8:24], srcIP.IP.To16())
+	copy(packet[24:40], dstIP.IP.To16())
+
+	// Copy ESP payload
+	copy(packet[ipHeaderLen:], espPacket)
+
+	return packet, nil
+}
+
 // calculateIPChecksum computes the IPv4 header checksum
 func calculateIPChecksum(header []byte) uint16 {
 	var sum uint32
@@ -343,7 +547,24 @@ func calculateIPChecksum(header []byte) uint16 {
 // handleESPPacket sends ESP packet using raw socket
 func handleESPPacket(srcIP, dstIP *net.UDPAddr, espPacket []byte) error {
 	logger.IKELog.Debugln("handle ESPPacket")
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	family := syscall.AF_INET
+	var addr syscall.Sockaddr
+	var ipPacket []byte
+	var err error
+	if dstIPv4 := dstIP.IP.To4(); dstIPv4 != nil {
+		ipPacket, err = constructPacketWithESP(srcIP, dstIP, espPacket)
+		addr = &syscall.SockaddrInet4{Addr: [4]byte(dstIPv4)}
+	} else {
+		// An IPPROTO_RAW IPv6 socket also expects the IP header from the caller
+		family = syscall.AF_INET6
+		ipPacket, err = constructIPv6PacketWithESP(srcIP, dstIP, espPacket)
+		addr = &syscall.SockaddrInet6{Addr: [16]byte(dstIP.IP.To16())}
+	}
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
 	if err != nil {
 		return fmt.Errorf("socket error: %v", err)
 	}
@@ -352,16 +573,39 @@ func handleESPPacket(srcIP, dstIP *net.UDPAddr, espPacket []byte) error {
 			logger.IKELog.Errorf("close fd error: %v", err)
 		}
 	}()
-	ipPacket, err := constructPacketWithESP(srcIP, dstIP, espPacket)
-	if err != nil {
-		return err
-	}
-	addr := syscall.SockaddrInet4{
-		Addr: [4]byte(dstIP.IP),
-		Port: dstIP.Port,
-	}
-	if err := syscall.Sendto(fd, ipPacket, 0, &addr); err != nil {
+	if err := syscall.Sendto(fd, ipPacket, 0, addr); err != nil {
 		return fmt.Errorf("sendto error: %v", err)
 	}
 	return nil
 }
+
+// CheckLiveness sends a DPD request to the UE of the IKE SA localSPI, outside
+// of the periodic liveness check, and waits up to timeout for its answer. It
+// returns context.ErrDPDTimeout if the UE does not answer in time
+func CheckLiveness(checkCtx ctx.Context, n3iwfCtx *context.N3IWFContext, localSPI uint64,
+	timeout time.Duration,
+) error {
+	ikeServer := n3iwfCtx.IkeServer
+	if ikeServer == nil {
+		return errors.New("liveness check: IKE server not started")
+	}
+	checkCtx, cancel := ctx.WithTimeout(checkCtx, timeout)
+	defer cancel()
+	evt := context.NewLivenessCheckEvt(localSPI)
+	select {
+	case ikeServer.RcvEventCh <- evt:
+	case <-ikeServer.Done:
+		return errors.New("liveness check: IKE server stopped")
+	case <-checkCtx.Done():
+		return fmt.Errorf("liveness check: %w", checkCtx.Err())
+	}
+	select {
+	case err := <-evt.Result:
+		return err
+	case <-checkCtx.Done():
+		if errors.Is(checkCtx.Err(), ctx.DeadlineExceeded) {
+			return context.ErrDPDTimeout
+		}
+		return fmt.Errorf("liveness check: %w", checkCtx.Err())
+	}
+}
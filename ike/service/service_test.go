@@ -5,10 +5,16 @@ package service
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
 )
 
 func TestConstructPacketWithESP(t *testing.T) {
@@ -369,3 +375,238 @@ func hexDump(data []byte, offset int) string {
 	}
 	return result.String()
 }
+
+func TestConstructIPv6PacketWithESP(t *testing.T) {
+	srcIP := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4500}
+	dstIP := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 4500}
+	espPayload := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+	packet, err := constructIPv6PacketWithESP(srcIP, dstIP, espPayload)
+	if err != nil {
+		t.Fatalf("constructIPv6PacketWithESP failed: %v", err)
+	}
+
+	if len(packet) != 40+len(espPayload) {
+		t.Errorf("Expected packet length %d, got %d", 40+len(espPayload), len(packet))
+	}
+	if version := packet[0] >> 4; version != 6 {
+		t.Errorf("Expected IP version 6, got %d", version)
+	}
+	if payloadLen := binary.BigEndian.Uint16(packet[4:6]); int(payloadLen) != len(espPayload) {
+		t.Errorf("Expected payload length %d, got %d", len(espPayload), payloadLen)
+	}
+	if packet[6] != 50 {
+		t.Errorf("Expected next header 50 (ESP), got %d", packet[6])
+	}
+	if packet[7] != 64 {
+		t.Errorf("Expected hop limit 64, got %d", packet[7])
+	}
+	if !net.IP(packet[8:24]).Equal(srcIP.IP) {
+		t.Errorf("Expected source IP %v, got %v", srcIP.IP, net.IP(packet[8:24]))
+	}
+	if !net.IP(packet[24:40]).Equal(dstIP.IP) {
+		t.Errorf("Expected destination IP %v, got %v", dstIP.IP, net.IP(packet[24:40]))
+	}
+	if string(packet[40:]) != string(espPayload) {
+		t.Errorf("ESP payload mismatch. got = %x, want = %x", packet[40:], espPayload)
+	}
+
+	ipv4Addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.50"), Port: 4500}
+	if _, err := constructIPv6PacketWithESP(ipv4Addr, dstIP, espPayload); err == nil {
+		t.Error("Expected error for IPv4 source address, got nil")
+	}
+	if _, err := constructIPv6PacketWithESP(srcIP, ipv4Addr, espPayload); err == nil {
+		t.Error("Expected error for IPv4 destination address, got nil")
+	}
+}
+
+func TestCheckIKEMessageOversized(t *testing.T) {
+	n3iwfConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer n3iwfConn.Close()
+	ueConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+
+	n3iwfCtx := context.N3IWFSelf()
+	defer func(maxSize int) { n3iwfCtx.IKEMaxMessageSize = maxSize }(n3iwfCtx.IKEMaxMessageSize)
+	n3iwfCtx.IKEMaxMessageSize = 1280
+
+	testcases := []struct {
+		description  string
+		exchangeType uint8
+		expResponse  bool
+	}{
+		{
+			description:  "IKE_SA_INIT answered with INVALID_SYNTAX",
+			exchangeType: message.IKE_SA_INIT,
+			expResponse:  true,
+		},
+		{
+			description:  "IKE_AUTH dropped",
+			exchangeType: message.IKE_AUTH,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			header := message.NewHeader(0x1234, 0, tc.exchangeType, false, true, 0, message.NoNext,
+				make([]byte, 1300))
+			msg, err := header.Marshal()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			_, _, err = checkIKEMessage(msg, n3iwfConn, n3iwfConn.LocalAddr().(*net.UDPAddr),
+				ueConn.LocalAddr().(*net.UDPAddr))
+			if !errors.Is(err, message.ErrMessageTooLarge) {
+				t.Fatalf("error mismatch. got = %v, want = %v", err, message.ErrMessageTooLarge)
+			}
+
+			if err := ueConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			buf := make([]byte, 1500)
+			n, _, err := ueConn.ReadFromUDP(buf)
+			if !tc.expResponse {
+				if err == nil {
+					t.Errorf("Unexpected response: %x", buf[:n])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			response := new(message.IKEMessage)
+			if err := response.Decode(buf[:n]); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(response.Payloads) != 1 || response.Payloads[0].Type() != message.TypeN ||
+				response.Payloads[0].(*message.Notification).NotifyMessageType != message.INVALID_SYNTAX {
+				t.Errorf("Unexpected response payloads: %+v", response.Payloads)
+			}
+		})
+	}
+}
+
+func TestHandleNattMsg(t *testing.T) {
+	ikeMsg := message.NewMessage(0x1111, 0x2222, message.IKE_AUTH, false, true, 1, nil)
+	encoded, err := ikeMsg.Encode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	espPacket := []byte{0x00, 0x00, 0x10, 0x01, 0x00, 0x00, 0x00, 0x01, 0xaa, 0xbb}
+
+	testcases := []struct {
+		description string
+		datagram    []byte
+		expMsg      []byte
+		expESP      bool
+		expErr      bool
+	}{
+		{description: "IKE message", datagram: message.AddNonESPMarker(encoded), expMsg: encoded},
+		{description: "ESP packet", datagram: espPacket, expESP: true},
+		{description: "NAT-T keepalive", datagram: []byte{0xff}},
+		{description: "too short", datagram: []byte{0x00, 0x00}, expErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var espReceived []byte
+			espHandler := func(srcIP, dstIP *net.UDPAddr, espPkt []byte) error {
+				espReceived = espPkt
+				return nil
+			}
+			msg, err := handleNattMsg(tc.datagram, nil, nil, espHandler)
+			if tc.expErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(msg) != string(tc.expMsg) {
+				t.Errorf("IKE message mismatch. got = %x, want = %x", msg, tc.expMsg)
+			}
+			if (espReceived != nil) != tc.expESP {
+				t.Errorf("ESP handling mismatch. got = %v, want = %v", espReceived != nil, tc.expESP)
+			}
+			if tc.expMsg != nil {
+				if _, err = message.ParseHeader(msg); err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiverShedsIKESAInitBurst(t *testing.T) {
+	n3iwfCtx := &context.N3IWFContext{
+		IkeServer: &context.IkeServer{
+			Listener:        make(map[int]*net.UDPConn),
+			SendQueue:       make(map[int]*context.IKESendQueue),
+			RcvIkePktCh:     make(chan context.IkeReceivePacket, 16),
+			MaxPendingInits: 4,
+		},
+	}
+	errChan := make(chan error)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go receiver(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, errChan, n3iwfCtx, &wg)
+	if err, ok := <-errChan; ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	listener := n3iwfCtx.IkeServer.Listener[0]
+	defer func() {
+		listener.Close()
+		wg.Wait()
+	}()
+
+	ueConn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ueConn.Close()
+
+	// The event loop is not running: no pending IKE_SA_INIT request completes
+	const burst = 10
+	for i := range burst {
+		msg, err := message.NewHeader(uint64(i+1), 0, message.IKE_SA_INIT, false, true, 0,
+			message.NoNext, nil).Marshal()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err = ueConn.Write(msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for uint64(len(n3iwfCtx.IkeServer.RcvIkePktCh))+n3iwfCtx.IkeServer.IKESAInitShed() < burst {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the receiver")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := len(n3iwfCtx.IkeServer.RcvIkePktCh); got != 4 {
+		t.Errorf("pending IKE_SA_INIT mismatch. got = %d, want = 4", got)
+	}
+	if got := n3iwfCtx.IkeServer.IKESAInitShed(); got != burst-4 {
+		t.Errorf("shed IKE_SA_INIT mismatch. got = %d, want = %d", got, burst-4)
+	}
+
+	// Handling a pending request makes room for a retransmission
+	pkt := <-n3iwfCtx.IkeServer.RcvIkePktCh
+	if !pkt.PendingInit {
+		t.Error("IKE_SA_INIT request not marked as pending")
+	}
+	n3iwfCtx.IkeServer.DoneIKESAInit()
+	if !n3iwfCtx.IkeServer.AdmitIKESAInit() {
+		t.Error("IKE_SA_INIT request shed after DoneIKESAInit")
+	}
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package xfrm
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/vishvananda/netlink"
+)
+
+// PolicyConflict is an installed policy whose selectors overlap those of a
+// child SA about to be installed. The kernel refuses the new policy when the
+// selectors are the same, and otherwise sends the traffic of both SAs through
+// whichever policy it finds first
+type PolicyConflict struct {
+	Policy *netlink.XfrmPolicy
+	Owner  *context.ChildSecurityAssociation
+}
+
+func (c *PolicyConflict) String() string {
+	owner := fmt.Sprintf("child SA 0x%08x", c.Owner.InboundSPI)
+	if c.Owner.IkeUE != nil && c.Owner.IkeUE.N3IWFIKESecurityAssociation != nil {
+		if identity := c.Owner.IkeUE.N3IWFIKESecurityAssociation.UEIdentity(); identity != "" {
+			owner += " of UE " + identity
+		}
+	}
+	return fmt.Sprintf("XFRM policy %s of %s", c.Policy, owner)
+}
+
+// FindPolicyConflict returns the first policy of the installed child SAs that
+// collides with a policy of childSA bound to xfrmiId, nil if none does
+func FindPolicyConflict(n3iwfCtx *context.N3IWFContext, xfrmiId uint32,
+	childSA *context.ChildSecurityAssociation,
+) *PolicyConflict {
+	mark := xfrmMark(childSA)
+	candidates := []*netlink.XfrmPolicy{
+		buildXfrmPolicy(xfrmiId, mark, netlink.XfrmPolicyTmpl{},
+			&childSA.TrafficSelectorRemote, &childSA.TrafficSelectorLocal, childSA.SelectedIPProtocol,
+			childSA.SelectedRemotePort, childSA.SelectedLocalPort, netlink.XFRM_DIR_IN),
+		buildXfrmPolicy(xfrmiId, mark, netlink.XfrmPolicyTmpl{},
+			&childSA.TrafficSelectorLocal, &childSA.TrafficSelectorRemote, childSA.SelectedIPProtocol,
+			childSA.SelectedLocalPort, childSA.SelectedRemotePort, netlink.XFRM_DIR_OUT),
+	}
+
+	var conflict *PolicyConflict
+	n3iwfCtx.ChildSA.Range(func(key, value any) bool {
+		installed, ok := value.(*context.ChildSecurityAssociation)
+		if !ok || installed == childSA {
+			return true
+		}
+		for i := range installed.XfrmPolicyList {
+			for _, candidate := range candidates {
+				if policiesOverlap(&installed.XfrmPolicyList[i], candidate) {
+					conflict = &PolicyConflict{Policy: &installed.XfrmPolicyList[i], Owner: installed}
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return conflict
+}
+
+// policiesOverlap reports whether some packet matches the selectors of both
+// policies, in the same direction and on the same XFRM interface and mark
+func policiesOverlap(a, b *netlink.XfrmPolicy) bool {
+	if a.Dir != b.Dir || a.Ifid != b.Ifid || !sameMark(a.Mark, b.Mark) {
+		return false
+	}
+	if a.Proto != 0 && b.Proto != 0 && a.Proto != b.Proto {
+		return false
+	}
+	if a.SrcPort != 0 && b.SrcPort != 0 && a.SrcPort != b.SrcPort {
+		return false
+	}
+	if a.DstPort != 0 && b.DstPort != 0 && a.DstPort != b.DstPort {
+		return false
+	}
+	return netsOverlap(a.Src, b.Src) && netsOverlap(a.Dst, b.Dst)
+}
+
+func sameMark(a, b *netlink.XfrmMark) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Value&a.Mask == b.Value&b.Mask && a.Mask == b.Mask
+}
+
+func netsOverlap(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return true
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package xfrm
+
+import (
+	"net"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/vishvananda/netlink"
+)
+
+func newConflictTestChildSA(t *testing.T, spi uint32, ueCIDR string, proto uint8, localPort uint16,
+	xfrmMarkValue uint32,
+) *context.ChildSecurityAssociation {
+	t.Helper()
+	_, local, _ := net.ParseCIDR("10.0.0.1/32")
+	_, remote, err := net.ParseCIDR(ueCIDR)
+	if err != nil {
+		t.Fatalf("ParseCIDR failed: %v", err)
+	}
+	return &context.ChildSecurityAssociation{
+		InboundSPI:            spi,
+		TrafficSelectorLocal:  *local,
+		TrafficSelectorRemote: *remote,
+		SelectedIPProtocol:    proto,
+		SelectedLocalPort:     localPort,
+		XfrmMark:              xfrmMarkValue,
+	}
+}
+
+// installPolicies records the policies ApplyXFRMRule would install for childSA
+func installPolicies(n3iwfCtx *context.N3IWFContext, xfrmiId uint32, childSA *context.ChildSecurityAssociation) {
+	for _, dir := range []netlink.Dir{netlink.XFRM_DIR_IN, netlink.XFRM_DIR_OUT} {
+		src, dst := &childSA.TrafficSelectorRemote, &childSA.TrafficSelectorLocal
+		srcPort, dstPort := childSA.SelectedRemotePort, childSA.SelectedLocalPort
+		if dir == netlink.XFRM_DIR_OUT {
+			src, dst = dst, src
+			srcPort, dstPort = dstPort, srcPort
+		}
+		policy := buildXfrmPolicy(xfrmiId, xfrmMark(childSA), netlink.XfrmPolicyTmpl{}, src, dst,
+			childSA.SelectedIPProtocol, srcPort, dstPort, dir)
+		childSA.XfrmPolicyList = append(childSA.XfrmPolicyList, *policy)
+	}
+	n3iwfCtx.ChildSA.Store(childSA.InboundSPI, childSA)
+}
+
+func TestFindPolicyConflict(t *testing.T) {
+	testcases := []struct {
+		description string
+		ueCIDR      string
+		proto       uint8
+		localPort   uint16
+		xfrmiId     uint32
+		xfrmMark    uint32
+		policyMode  bool
+		expConflict bool
+	}{
+		{
+			description: "another UE",
+			ueCIDR:      "10.0.0.3/32",
+			proto:       message.IPProtocolGRE,
+			xfrmiId:     7,
+		},
+		{
+			description: "same UE and protocol",
+			ueCIDR:      "10.0.0.2/32",
+			proto:       message.IPProtocolGRE,
+			xfrmiId:     7,
+			expConflict: true,
+		},
+		{
+			description: "overlapping subnet, any protocol",
+			ueCIDR:      "10.0.0.0/24",
+			proto:       message.IPProtocolAll,
+			xfrmiId:     7,
+			expConflict: true,
+		},
+		{
+			description: "same UE, other protocol",
+			ueCIDR:      "10.0.0.2/32",
+			proto:       message.IPProtocolUDP,
+			xfrmiId:     7,
+		},
+		{
+			description: "same UE, other port of the NAS protocol",
+			ueCIDR:      "10.0.0.2/32",
+			proto:       message.IPProtocolTCP,
+			localPort:   8080,
+			xfrmiId:     7,
+		},
+		{
+			description: "dedicated XFRM interface",
+			ueCIDR:      "10.0.0.2/32",
+			proto:       message.IPProtocolGRE,
+			xfrmiId:     8,
+		},
+		{
+			description: "policy based, unmarked",
+			ueCIDR:      "10.0.0.2/32",
+			proto:       message.IPProtocolGRE,
+			policyMode:  true,
+			expConflict: true,
+		},
+		{
+			description: "policy based, dedicated firewall mark",
+			ueCIDR:      "10.0.0.2/32",
+			proto:       message.IPProtocolGRE,
+			xfrmMark:    15,
+			policyMode:  true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			n3iwfCtx := &context.N3IWFContext{}
+			cpChildSA := newConflictTestChildSA(t, 0x1001, "10.0.0.2/32", message.IPProtocolTCP, 20000, 0)
+			upChildSA := newConflictTestChildSA(t, 0x1002, "10.0.0.2/32", message.IPProtocolGRE, 0, 0)
+			installedId := uint32(7)
+			if tc.policyMode {
+				installedId = 0
+			}
+			installPolicies(n3iwfCtx, installedId, cpChildSA)
+			installPolicies(n3iwfCtx, installedId, upChildSA)
+
+			childSA := newConflictTestChildSA(t, 0x2001, tc.ueCIDR, tc.proto, tc.localPort, tc.xfrmMark)
+			// Not yet installed, but already known to the context
+			n3iwfCtx.ChildSA.Store(childSA.InboundSPI, childSA)
+			conflict := FindPolicyConflict(n3iwfCtx, tc.xfrmiId, childSA)
+			if (conflict != nil) != tc.expConflict {
+				t.Fatalf("conflict mismatch. got = %v, want = %v", conflict, tc.expConflict)
+			}
+			if conflict != nil && conflict.Owner == childSA {
+				t.Errorf("child SA conflicts with itself")
+			}
+		})
+	}
+}
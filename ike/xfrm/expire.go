@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package xfrm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/logger"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Subscribes to the XFRM messages of the kernel, replaced in tests
+var xfrmMonitor = netlink.XfrmMonitor
+
+const expireChannelLen = 64
+
+// ChildSAExpiry reports that the XFRM state with SPI to Dst reached a limit of
+// its lifetime. Past a hard limit the kernel already deleted the state. The
+// child SA owning it is resolved by the IKE event loop, see
+// handler.HandleXfrmStateExpire
+type ChildSAExpiry struct {
+	SPI  uint32
+	Dst  net.IP
+	Hard bool
+}
+
+// ValidateLifetime checks that the limits of a child SA lifetime are whole
+// seconds, as the kernel counts them, and that no soft limit exceeds its hard one
+func ValidateLifetime(lifetime context.ChildSALifetime) error {
+	if lifetime.SoftTime < 0 || lifetime.HardTime < 0 {
+		return errors.New("lifetime must not be negative")
+	}
+	if lifetime.SoftTime%time.Second != 0 || lifetime.HardTime%time.Second != 0 {
+		return errors.New("lifetime must be a whole number of seconds")
+	}
+	if lifetime.HardTime != 0 && lifetime.SoftTime > lifetime.HardTime {
+		return fmt.Errorf("soft lifetime %v exceeds hard lifetime %v", lifetime.SoftTime, lifetime.HardTime)
+	}
+	if lifetime.HardBytes != 0 && lifetime.SoftBytes > lifetime.HardBytes {
+		return fmt.Errorf("soft byte limit %d exceeds hard byte limit %d", lifetime.SoftBytes, lifetime.HardBytes)
+	}
+	return nil
+}
+
+// xfrmLimits returns the limits of the XFRM states of a child SA
+func xfrmLimits(lifetime context.ChildSALifetime) netlink.XfrmStateLimits {
+	return netlink.XfrmStateLimits{
+		ByteSoft: lifetime.SoftBytes,
+		ByteHard: lifetime.HardBytes,
+		TimeSoft: uint64(lifetime.SoftTime / time.Second), // #nosec G115
+		TimeHard: uint64(lifetime.HardTime / time.Second), // #nosec G115
+	}
+}
+
+// lifetimeFromLimits returns the lifetime of a child SA installed with limits,
+// the kernel reporting the byte limits left unset as infinite
+func lifetimeFromLimits(limits netlink.XfrmStateLimits) context.ChildSALifetime {
+	byteLimit := func(limit uint64) uint64 {
+		if limit == nl.XFRM_INF {
+			return 0
+		}
+		return limit
+	}
+	return context.ChildSALifetime{
+		SoftTime:  time.Duration(limits.TimeSoft) * time.Second, // #nosec G115
+		HardTime:  time.Duration(limits.TimeHard) * time.Second, // #nosec G115
+		SoftBytes: byteLimit(limits.ByteSoft),
+		HardBytes: byteLimit(limits.ByteHard),
+	}
+}
+
+// MonitorExpire subscribes to the XFRM expire messages of the kernel until done
+// is closed. The expiries of the states are sent to the returned channel, which
+// is closed once the subscription ends
+func MonitorExpire(done <-chan struct{}) (<-chan ChildSAExpiry, error) {
+	msgCh := make(chan netlink.XfrmMsg, expireChannelLen)
+	// The subscription reports the error ending it once done is closed
+	errCh := make(chan error, 1)
+	if err := xfrmMonitor(msgCh, done, errCh, nl.XFRM_MSG_EXPIRE); err != nil {
+		return nil, fmt.Errorf("MonitorExpire: %w", err)
+	}
+
+	expiries := make(chan ChildSAExpiry, expireChannelLen)
+	go func() {
+		defer close(expiries)
+		for {
+			select {
+			case msg, ok := <-msgCh:
+				if !ok {
+					return
+				}
+				expire, ok := msg.(*netlink.XfrmMsgExpire)
+				if !ok || expire.XfrmState == nil {
+					continue
+				}
+				expiry := ChildSAExpiry{
+					SPI:  uint32(expire.XfrmState.Spi), // #nosec G115
+					Dst:  expire.XfrmState.Dst,
+					Hard: expire.Hard,
+				}
+				select {
+				case expiries <- expiry:
+				case <-done:
+					return
+				}
+			case err := <-errCh:
+				select {
+				case <-done:
+				default:
+					logger.IKELog.Errorf("XFRM expire monitor: %+v", err)
+				}
+			}
+		}
+	}()
+	return expiries, nil
+}
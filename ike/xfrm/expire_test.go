@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package xfrm
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestValidateLifetime(t *testing.T) {
+	testcases := []struct {
+		description string
+		lifetime    context.ChildSALifetime
+		expErr      bool
+	}{
+		{"no limit", context.ChildSALifetime{}, false},
+		{"soft and hard time", context.ChildSALifetime{SoftTime: 50 * time.Minute, HardTime: time.Hour}, false},
+		{"soft time only", context.ChildSALifetime{SoftTime: time.Hour}, false},
+		{"soft and hard bytes", context.ChildSALifetime{SoftBytes: 1 << 20, HardBytes: 1 << 30}, false},
+		{"negative time", context.ChildSALifetime{HardTime: -time.Second}, true},
+		{"fractional time", context.ChildSALifetime{SoftTime: 1500 * time.Millisecond}, true},
+		{"soft time exceeds hard", context.ChildSALifetime{SoftTime: time.Hour, HardTime: time.Minute}, true},
+		{"soft bytes exceed hard", context.ChildSALifetime{SoftBytes: 2048, HardBytes: 1024}, true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := ValidateLifetime(tc.lifetime)
+			if (err != nil) != tc.expErr {
+				t.Errorf("ValidateLifetime(%+v) error = %v, expected error: %v", tc.lifetime, err, tc.expErr)
+			}
+		})
+	}
+}
+
+func TestXfrmLimits(t *testing.T) {
+	lifetime := context.ChildSALifetime{
+		SoftTime:  50 * time.Minute,
+		HardTime:  time.Hour,
+		SoftBytes: 1 << 20,
+		HardBytes: 1 << 30,
+	}
+	limits := xfrmLimits(lifetime)
+	expLimits := netlink.XfrmStateLimits{ByteSoft: 1 << 20, ByteHard: 1 << 30, TimeSoft: 3000, TimeHard: 3600}
+	if limits != expLimits {
+		t.Errorf("xfrmLimits = %+v, expected %+v", limits, expLimits)
+	}
+	if got := lifetimeFromLimits(limits); got != lifetime {
+		t.Errorf("lifetimeFromLimits = %+v, expected %+v", got, lifetime)
+	}
+
+	// The kernel reports the byte limits left unset as infinite
+	limits = netlink.XfrmStateLimits{ByteSoft: nl.XFRM_INF, ByteHard: nl.XFRM_INF, TimeHard: 3600}
+	expLifetime := context.ChildSALifetime{HardTime: time.Hour}
+	if got := lifetimeFromLimits(limits); got != expLifetime {
+		t.Errorf("lifetimeFromLimits = %+v, expected %+v", got, expLifetime)
+	}
+}
+
+func TestMonitorExpire(t *testing.T) {
+	origMonitor := xfrmMonitor
+	t.Cleanup(func() { xfrmMonitor = origMonitor })
+	xfrmMonitor = func(ch chan<- netlink.XfrmMsg, done <-chan struct{}, errorChan chan<- error,
+		types ...nl.XfrmMsgType,
+	) error {
+		if len(types) != 1 || types[0] != nl.XFRM_MSG_EXPIRE {
+			t.Errorf("subscribed to %v, expected XFRM_MSG_EXPIRE only", types)
+		}
+		go func() {
+			defer close(ch)
+			// A message without state is dropped
+			ch <- &netlink.XfrmMsgExpire{Hard: true}
+			ch <- &netlink.XfrmMsgExpire{
+				XfrmState: &netlink.XfrmState{Spi: 0x2002, Dst: net.ParseIP("198.51.100.7")},
+				Hard:      true,
+			}
+			<-done
+		}()
+		return nil
+	}
+
+	done := make(chan struct{})
+	expiries, err := MonitorExpire(done)
+	if err != nil {
+		t.Fatalf("MonitorExpire failed: %+v", err)
+	}
+	select {
+	case expiry := <-expiries:
+		if expiry.SPI != 0x2002 || !expiry.Dst.Equal(net.ParseIP("198.51.100.7")) || !expiry.Hard {
+			t.Errorf("expiry = %+v, expected hard expiry of XFRM state 0x00002002", expiry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no expiry reported")
+	}
+
+	close(done)
+	select {
+	case _, ok := <-expiries:
+		if ok {
+			t.Error("unexpected expiry after done")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expiries not closed after done")
+	}
+}
@@ -0,0 +1,304 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package xfrm
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/ike/security/encr"
+	"github.com/omec-project/n3iwf/ike/security/esn"
+	"github.com/omec-project/n3iwf/ike/security/integ"
+	"github.com/omec-project/n3iwf/logger"
+	"github.com/vishvananda/netlink"
+)
+
+// XfrmDumper lists the XFRM states and policies installed in the kernel
+type XfrmDumper interface {
+	XfrmStateList(family int) ([]netlink.XfrmState, error)
+	XfrmPolicyList(family int) ([]netlink.XfrmPolicy, error)
+}
+
+type netlinkDumper struct{}
+
+func (netlinkDumper) XfrmStateList(family int) ([]netlink.XfrmState, error) {
+	return netlink.XfrmStateList(family)
+}
+
+func (netlinkDumper) XfrmPolicyList(family int) ([]netlink.XfrmPolicy, error) {
+	return netlink.XfrmPolicyList(family)
+}
+
+// NetlinkDumper dumps XFRM states and policies from the running kernel
+var NetlinkDumper XfrmDumper = netlinkDumper{}
+
+// ReconstructChildSAs rebuilds the child SAs of the IKE SAs already present in
+// the context from the kernel XFRM states and policies, so the userspace view
+// matches the data plane after a restart. It returns the number of child SAs
+// reconstructed. It must run before the IKE event loop starts, the IKE SAs are
+// not locked
+func ReconstructChildSAs(dumper XfrmDumper, n3iwfCtx *context.N3IWFContext) (int, error) {
+	states, err := dumper.XfrmStateList(netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, fmt.Errorf("ReconstructChildSAs: dump XFRM states: %w", err)
+	}
+	policies, err := dumper.XfrmPolicyList(netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, fmt.Errorf("ReconstructChildSAs: dump XFRM policies: %w", err)
+	}
+
+	localIP := net.ParseIP(n3iwfCtx.IkeBindAddress)
+	if localIP == nil {
+		return 0, fmt.Errorf("ReconstructChildSAs: invalid IKE bind address %q", n3iwfCtx.IkeBindAddress)
+	}
+
+	count := 0
+	n3iwfCtx.IkeSA.Range(func(key, value any) bool {
+		ikeSA, ok := value.(*context.IKESecurityAssociation)
+		if !ok || ikeSA.IkeUE == nil || ikeSA.IKEConnection == nil || ikeSA.IKEConnection.UEAddr == nil {
+			return true
+		}
+		peerIP := ikeSA.IKEConnection.UEAddr.IP
+		for i := range states {
+			inState := &states[i]
+			if inState.Proto != netlink.XFRM_PROTO_ESP || !inState.Src.Equal(peerIP) || !inState.Dst.Equal(localIP) {
+				continue
+			}
+			inboundSPI := uint32(inState.Spi) // #nosec G115
+			if _, exist := ikeSA.IkeUE.N3IWFChildSecurityAssociation[inboundSPI]; exist {
+				continue
+			}
+			childSA, err := reconstructChildSA(inState, states, policies, localIP, peerIP)
+			if err != nil {
+				logger.IKELog.Warnf("skip XFRM state with SPI %08x: %v", inboundSPI, err)
+				continue
+			}
+			if link, ok := n3iwfCtx.XfrmIfaces.Load(uint32(inState.Ifid)); ok { // #nosec G115
+				childSA.XfrmIface = link.(netlink.Link)
+			}
+			n3iwfCtx.ReserveXfrmIfaceId(uint32(inState.Ifid)) // #nosec G115
+			if childSA.XfrmMark != 0 {
+				n3iwfCtx.ReserveXfrmIfaceId(childSA.XfrmMark)
+			}
+			childSA.IkeUE = ikeSA.IkeUE
+			ikeSA.IkeUE.N3IWFChildSecurityAssociation[inboundSPI] = childSA
+			n3iwfCtx.ChildSA.Store(inboundSPI, childSA)
+			n3iwfCtx.IndexOutboundSPI(childSA)
+			logger.IKELog.Infof("reconstructed child SA inbound SPI %08x outbound SPI %08x for IKE SA %016x",
+				childSA.InboundSPI, childSA.OutboundSPI, ikeSA.LocalSPI)
+			count++
+		}
+		return true
+	})
+	return count, nil
+}
+
+// reconstructChildSA matches an inbound XFRM state with its policies and the
+// outbound state of the same child SA
+func reconstructChildSA(inState *netlink.XfrmState, states []netlink.XfrmState,
+	policies []netlink.XfrmPolicy, localIP, peerIP net.IP,
+) (*context.ChildSecurityAssociation, error) {
+	inPolicy := findPolicy(policies, netlink.XFRM_DIR_IN, inState.Ifid, inState.Spi)
+	if inPolicy == nil || inPolicy.Src == nil || inPolicy.Dst == nil {
+		return nil, fmt.Errorf("no inbound policy")
+	}
+
+	// The outbound policy mirrors the inbound traffic selectors
+	var outPolicy *netlink.XfrmPolicy
+	for i := range policies {
+		p := &policies[i]
+		if p.Dir == netlink.XFRM_DIR_OUT && p.Ifid == inState.Ifid && p.Proto == inPolicy.Proto &&
+			markValue(p.Mark) == markValue(inPolicy.Mark) &&
+			ipNetEqual(p.Src, inPolicy.Dst) && ipNetEqual(p.Dst, inPolicy.Src) && len(p.Tmpls) > 0 {
+			outPolicy = p
+			break
+		}
+	}
+	if outPolicy == nil {
+		return nil, fmt.Errorf("no outbound policy")
+	}
+
+	var outState *netlink.XfrmState
+	for i := range states {
+		s := &states[i]
+		if s.Proto == netlink.XFRM_PROTO_ESP && s.Spi == outPolicy.Tmpls[0].Spi &&
+			s.Src.Equal(localIP) && s.Dst.Equal(peerIP) {
+			outState = s
+			break
+		}
+	}
+	if outState == nil {
+		return nil, fmt.Errorf("no outbound state")
+	}
+
+	childSAKey, err := childSAKeyFromXfrmState(inState)
+	if err != nil {
+		return nil, err
+	}
+
+	childSA := &context.ChildSecurityAssociation{
+		InboundSPI:            uint32(inState.Spi),  // #nosec G115
+		OutboundSPI:           uint32(outState.Spi), // #nosec G115
+		XfrmStateList:         []netlink.XfrmState{*inState, *outState},
+		XfrmPolicyList:        []netlink.XfrmPolicy{*inPolicy, *outPolicy},
+		PeerPublicIPAddr:      peerIP,
+		LocalPublicIPAddr:     localIP,
+		SelectedIPProtocol:    uint8(inPolicy.Proto),
+		SelectedLocalPort:     uint16(inPolicy.DstPort), // #nosec G115
+		SelectedRemotePort:    uint16(inPolicy.SrcPort), // #nosec G115
+		TrafficSelectorLocal:  *inPolicy.Dst,
+		TrafficSelectorRemote: *inPolicy.Src,
+		ChildSAKey:            childSAKey,
+		ReplayWindow:          uint32(inState.ReplayWindow), // #nosec G115
+		Lifetime:              lifetimeFromLimits(inState.Limits),
+		XfrmMark:              markValue(inPolicy.Mark),
+		TransportMode:         inState.Mode == netlink.XFRM_MODE_TRANSPORT,
+		// The signalling child SA (TCP) is initiated by the UE, the PDU session ones (GRE) by the N3IWF
+		LocalIsInitiator: inPolicy.Proto != netlink.Proto(message.IPProtocolTCP),
+	}
+	if outState.Encap != nil {
+		childSA.EnableEncapsulate = true
+		childSA.N3IWFPort = outState.Encap.SrcPort
+		childSA.NATPort = outState.Encap.DstPort
+	}
+
+	var inEncKey, inIntKey, outEncKey, outIntKey []byte
+	if inState.Crypt != nil {
+		inEncKey = inState.Crypt.Key
+	}
+	if inState.Auth != nil {
+		inIntKey = inState.Auth.Key
+	}
+	if outState.Crypt != nil {
+		outEncKey = outState.Crypt.Key
+	}
+	if outState.Auth != nil {
+		outIntKey = outState.Auth.Key
+	}
+	if childSA.LocalIsInitiator {
+		childSA.ResponderToInitiatorEncryptionKey, childSA.ResponderToInitiatorIntegrityKey = inEncKey, inIntKey
+		childSA.InitiatorToResponderEncryptionKey, childSA.InitiatorToResponderIntegrityKey = outEncKey, outIntKey
+	} else {
+		childSA.InitiatorToResponderEncryptionKey, childSA.InitiatorToResponderIntegrityKey = inEncKey, inIntKey
+		childSA.ResponderToInitiatorEncryptionKey, childSA.ResponderToInitiatorIntegrityKey = outEncKey, outIntKey
+	}
+	return childSA, nil
+}
+
+func findPolicy(policies []netlink.XfrmPolicy, dir netlink.Dir, ifid, spi int) *netlink.XfrmPolicy {
+	for i := range policies {
+		p := &policies[i]
+		if p.Dir != dir || p.Ifid != ifid {
+			continue
+		}
+		for _, tmpl := range p.Tmpls {
+			if tmpl.Spi == spi {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// markValue returns the value of a firewall mark, 0 for none
+func markValue(mark *netlink.XfrmMark) uint32 {
+	if mark == nil {
+		return 0
+	}
+	return mark.Value
+}
+
+func ipNetEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+// childSAKeyFromXfrmState maps the kernel algorithm names back to IKE transforms
+func childSAKeyFromXfrmState(state *netlink.XfrmState) (*security.ChildSAKey, error) {
+	crypt := state.Crypt
+	if crypt == nil {
+		crypt = state.Aead
+	}
+	if crypt == nil {
+		return nil, fmt.Errorf("XFRM state without encryption algorithm")
+	}
+
+	childSAKey := new(security.ChildSAKey)
+	encrID, ok := encryptionTransformID(crypt.Name)
+	if !ok {
+		return nil, fmt.Errorf("unsupported XFRM encryption algorithm %q", crypt.Name)
+	}
+	// The kernel key of AES-CTR and AES-GCM ends with a 4 octet nonce or salt
+	keyLength := len(crypt.Key)
+	if encrID == message.ENCR_AES_CTR || encrID == message.ENCR_AES_GCM_16 {
+		keyLength -= 4
+	}
+	childSAKey.EncrKInfo = encr.DecodeTransformChildSA(&message.Transform{
+		TransformType:    message.TypeEncryptionAlgorithm,
+		TransformID:      encrID,
+		AttributePresent: true,
+		AttributeFormat:  message.AttributeFormatUseTV,
+		AttributeType:    message.AttributeTypeKeyLength,
+		AttributeValue:   uint16(keyLength * 8), // #nosec G115
+	})
+	if childSAKey.EncrKInfo == nil {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q with key length %d", crypt.Name, keyLength*8)
+	}
+
+	if state.Auth != nil {
+		integID, ok := integrityTransformID(state.Auth.Name)
+		if !ok {
+			return nil, fmt.Errorf("unsupported XFRM integrity algorithm %q", state.Auth.Name)
+		}
+		childSAKey.IntegKInfo = integ.DecodeTransformChildSA(&message.Transform{
+			TransformType: message.TypeIntegrityAlgorithm,
+			TransformID:   integID,
+		})
+		if childSAKey.IntegKInfo == nil {
+			return nil, fmt.Errorf("unsupported integrity algorithm %q", state.Auth.Name)
+		}
+	}
+
+	esnString := esn.ESNDisableString
+	if state.ESN {
+		esnString = esn.ESNEnableString
+	}
+	esnInfo, err := esn.StrToType(esnString)
+	if err != nil {
+		return nil, err
+	}
+	childSAKey.EsnInfo = esnInfo
+	return childSAKey, nil
+}
+
+func encryptionTransformID(name string) (uint16, bool) {
+	for _, id := range []uint16{
+		message.ENCR_DES, message.ENCR_3DES, message.ENCR_CAST, message.ENCR_BLOWFISH,
+		message.ENCR_NULL, message.ENCR_AES_CBC, message.ENCR_AES_CTR, message.ENCR_AES_GCM_16,
+	} {
+		if XFRMEncryptionAlgorithmType(id).String() == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func integrityTransformID(name string) (uint16, bool) {
+	for _, id := range []uint16{
+		message.AUTH_HMAC_MD5_96, message.AUTH_HMAC_SHA1_96,
+		message.AUTH_AES_XCBC_96, message.AUTH_HMAC_SHA2_256_128,
+		message.AUTH_HMAC_SHA2_384_192, message.AUTH_HMAC_SHA2_512_256,
+	} {
+		if XFRMIntegrityAlgorithmType(id).String() == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
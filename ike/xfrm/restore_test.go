@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package xfrm
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/vishvananda/netlink"
+)
+
+type mockDumper struct {
+	states   []netlink.XfrmState
+	policies []netlink.XfrmPolicy
+}
+
+func (m *mockDumper) XfrmStateList(family int) ([]netlink.XfrmState, error) {
+	return m.states, nil
+}
+
+func (m *mockDumper) XfrmPolicyList(family int) ([]netlink.XfrmPolicy, error) {
+	return m.policies, nil
+}
+
+func TestReconstructChildSAs(t *testing.T) {
+	localIP := net.ParseIP("192.168.0.1").To4()
+	peerIP := net.ParseIP("192.168.0.100").To4()
+	otherPeerIP := net.ParseIP("192.168.0.200").To4()
+	_, tsLocal, _ := net.ParseCIDR("10.0.0.1/32")
+	_, tsRemote, _ := net.ParseCIDR("10.0.0.5/32")
+
+	inEncKey := bytes.Repeat([]byte{0x01}, 16)
+	outEncKey := bytes.Repeat([]byte{0x02}, 16)
+	inIntKey := bytes.Repeat([]byte{0x03}, 32)
+	outIntKey := bytes.Repeat([]byte{0x04}, 32)
+
+	newState := func(spi int, src, dst net.IP, encKey, intKey []byte, encap *netlink.XfrmStateEncap) netlink.XfrmState {
+		return netlink.XfrmState{
+			Src:   src,
+			Dst:   dst,
+			Proto: netlink.XFRM_PROTO_ESP,
+			Mode:  netlink.XFRM_MODE_TUNNEL,
+			Spi:   spi,
+			Ifid:  7,
+			Crypt: &netlink.XfrmStateAlgo{Name: "cbc(aes)", Key: encKey},
+			Auth:  &netlink.XfrmStateAlgo{Name: "hmac(sha256)", Key: intKey, TruncateLen: 128},
+			Encap: encap,
+		}
+	}
+	newPolicy := func(spi int, src, dst *net.IPNet, dir netlink.Dir) netlink.XfrmPolicy {
+		return netlink.XfrmPolicy{
+			Src:   src,
+			Dst:   dst,
+			Proto: netlink.Proto(message.IPProtocolTCP),
+			Dir:   dir,
+			Ifid:  7,
+			Tmpls: []netlink.XfrmPolicyTmpl{{Spi: spi}},
+		}
+	}
+
+	dumper := &mockDumper{
+		states: []netlink.XfrmState{
+			newState(0x1001, peerIP, localIP, inEncKey, inIntKey, nil),
+			newState(0x2002, localIP, peerIP, outEncKey, outIntKey,
+				&netlink.XfrmStateEncap{Type: netlink.XFRM_ENCAP_ESPINUDP, SrcPort: 4500, DstPort: 34567}),
+			// State of a UE without restored IKE SA
+			newState(0x3003, otherPeerIP, localIP, inEncKey, inIntKey, nil),
+		},
+		policies: []netlink.XfrmPolicy{
+			newPolicy(0x1001, tsRemote, tsLocal, netlink.XFRM_DIR_IN),
+			newPolicy(0x2002, tsLocal, tsRemote, netlink.XFRM_DIR_OUT),
+		},
+	}
+
+	n3iwfCtx := &context.N3IWFContext{IkeBindAddress: localIP.String()}
+	ikeUe := &context.N3IWFIkeUe{
+		N3iwfCtx:                      n3iwfCtx,
+		N3IWFChildSecurityAssociation: make(map[uint32]*context.ChildSecurityAssociation),
+	}
+	ikeSA := &context.IKESecurityAssociation{
+		LocalSPI: 0xabc,
+		IkeUE:    ikeUe,
+		IKEConnection: &context.UDPSocketInfo{
+			UEAddr: &net.UDPAddr{IP: peerIP, Port: 34567},
+		},
+	}
+	n3iwfCtx.IkeSA.Store(ikeSA.LocalSPI, ikeSA)
+
+	count, err := ReconstructChildSAs(dumper, n3iwfCtx)
+	if err != nil {
+		t.Fatalf("ReconstructChildSAs failed: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("reconstructed child SA count mismatch. got = %d, want = 1", count)
+	}
+
+	childSA, ok := ikeUe.N3IWFChildSecurityAssociation[0x1001]
+	if !ok {
+		t.Fatal("child SA with inbound SPI 0x1001 not found in IKE UE")
+	}
+	if _, ok := n3iwfCtx.ChildSA.Load(uint32(0x1001)); !ok {
+		t.Error("child SA with inbound SPI 0x1001 not found in context")
+	}
+	if got := n3iwfCtx.OutboundChildSA(peerIP, 0x2002); got != childSA {
+		t.Errorf("child SA with outbound SPI 0x2002 not indexed. got = %p, want = %p", got, childSA)
+	}
+	if childSA.OutboundSPI != 0x2002 {
+		t.Errorf("outbound SPI mismatch. got = %x, want = 2002", childSA.OutboundSPI)
+	}
+	if childSA.SelectedIPProtocol != message.IPProtocolTCP || childSA.LocalIsInitiator {
+		t.Errorf("unexpected protocol or role: %d, %v", childSA.SelectedIPProtocol, childSA.LocalIsInitiator)
+	}
+	if childSA.TrafficSelectorLocal.String() != tsLocal.String() ||
+		childSA.TrafficSelectorRemote.String() != tsRemote.String() {
+		t.Errorf("traffic selector mismatch: %s <-> %s", childSA.TrafficSelectorLocal.String(),
+			childSA.TrafficSelectorRemote.String())
+	}
+	if !childSA.EnableEncapsulate || childSA.N3IWFPort != 4500 || childSA.NATPort != 34567 {
+		t.Errorf("unexpected encapsulation: %v %d %d", childSA.EnableEncapsulate, childSA.N3IWFPort, childSA.NATPort)
+	}
+	if childSA.EncrKInfo == nil || childSA.EncrKInfo.TransformID() != message.ENCR_AES_CBC ||
+		childSA.EncrKInfo.GetKeyLength() != 16 {
+		t.Errorf("unexpected encryption algorithm: %+v", childSA.EncrKInfo)
+	}
+	if childSA.IntegKInfo == nil || childSA.IntegKInfo.TransformID() != message.AUTH_HMAC_SHA2_256_128 {
+		t.Errorf("unexpected integrity algorithm: %+v", childSA.IntegKInfo)
+	}
+	if !bytes.Equal(childSA.InitiatorToResponderEncryptionKey, inEncKey) ||
+		!bytes.Equal(childSA.ResponderToInitiatorEncryptionKey, outEncKey) ||
+		!bytes.Equal(childSA.InitiatorToResponderIntegrityKey, inIntKey) ||
+		!bytes.Equal(childSA.ResponderToInitiatorIntegrityKey, outIntKey) {
+		t.Error("child SA keys mismatch")
+	}
+
+	// A second pass must not duplicate the child SA
+	count, err = ReconstructChildSAs(dumper, n3iwfCtx)
+	if err != nil || count != 0 {
+		t.Errorf("second pass: count = %d, err = %v", count, err)
+	}
+}
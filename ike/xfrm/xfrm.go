@@ -6,11 +6,15 @@
 package xfrm
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"slices"
 
 	"github.com/omec-project/n3iwf/context"
 	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security/encr"
 	"github.com/omec-project/n3iwf/logger"
 	"github.com/vishvananda/netlink"
 )
@@ -33,11 +37,16 @@ func (xfrmEncryptionAlgorithmType XFRMEncryptionAlgorithmType) String() string {
 		return "cbc(aes)"
 	case message.ENCR_AES_CTR:
 		return "rfc3686(ctr(aes))"
+	case message.ENCR_AES_GCM_16:
+		return "rfc4106(gcm(aes))"
 	default:
 		return ""
 	}
 }
 
+// ICV length in bits of the supported AEAD cipher, AES-GCM with 16 octet ICV
+const aeadICVLength = 128
+
 type XFRMIntegrityAlgorithmType uint16
 
 func (xfrmIntegrityAlgorithmType XFRMIntegrityAlgorithmType) String() string {
@@ -50,51 +59,199 @@ func (xfrmIntegrityAlgorithmType XFRMIntegrityAlgorithmType) String() string {
 		return "xcbc(aes)"
 	case message.AUTH_HMAC_SHA2_256_128:
 		return "hmac(sha256)"
+	case message.AUTH_HMAC_SHA2_384_192:
+		return "hmac(sha384)"
+	case message.AUTH_HMAC_SHA2_512_256:
+		return "hmac(sha512)"
 	default:
 		return ""
 	}
 }
 
+// MaxReplayWindow is the largest ESP anti-replay window, in packets, accepted
+// by the kernel (XFRMA_REPLAY_ESN_MAX bits)
+const MaxReplayWindow = 4096
+
+// Largest anti-replay window of a child SA without ESN, whose window is the
+// 32 bit bitmap of the legacy replay state. The netlink message carries it in
+// 8 bits, so a larger window would be truncated rather than capped
+const maxLegacyReplayWindow = 32
+
+// ValidateReplayWindow checks that an ESP anti-replay window is a power of two
+// the kernel accepts, 0 disabling replay protection
+func ValidateReplayWindow(size uint32) error {
+	if size == 0 {
+		return nil
+	}
+	if size > MaxReplayWindow {
+		return fmt.Errorf("replay window %d exceeds %d packets", size, MaxReplayWindow)
+	}
+	if size&(size-1) != 0 {
+		return fmt.Errorf("replay window %d is not a power of two", size)
+	}
+	return nil
+}
+
+const (
+	// Worst case ESP overhead of a tunnel mode packet: SPI and sequence number,
+	// a 16 octet IV, 15 octets of padding, pad length and next header, and the
+	// 32 octet ICV of HMAC-SHA2-512-256
+	espMaxOverhead = 8 + 16 + 15 + 2 + 32
+	natTHeaderLen  = 8
+	ipv4HeaderLen  = 20
+	ipv6HeaderLen  = 40
+	// RFC 791: every IPv4 host accepts datagrams of 576 octets
+	minInterfaceMTU = 576
+)
+
+// InterfaceMTU returns the MTU of the XFRM interfaces for a path to the UEs
+// of baseMTU octets, leaving room for the outer IP header, the NAT-T UDP
+// header and the ESP overhead of any supported transform
+func InterfaceMTU(baseMTU int, ipv6Outer bool) (int, error) {
+	outerHeaderLen := ipv4HeaderLen
+	if ipv6Outer {
+		outerHeaderLen = ipv6HeaderLen
+	}
+	mtu := baseMTU - outerHeaderLen - natTHeaderLen - espMaxOverhead
+	if mtu < minInterfaceMTU {
+		return 0, fmt.Errorf("base MTU %d leaves %d octets to the XFRM interfaces, less than %d",
+			baseMTU, mtu, minInterfaceMTU)
+	}
+	return mtu, nil
+}
+
+func xfrmMode(childSecurityAssociation *context.ChildSecurityAssociation) netlink.Mode {
+	if childSecurityAssociation.TransportMode {
+		return netlink.XFRM_MODE_TRANSPORT
+	}
+	return netlink.XFRM_MODE_TUNNEL
+}
+
+// xfrmReplayWindow returns the anti-replay window of the XFRM states of the
+// child SA, capped to the legacy replay state without ESN
+func xfrmReplayWindow(childSecurityAssociation *context.ChildSecurityAssociation) int {
+	window := int(childSecurityAssociation.ReplayWindow)
+	if childSecurityAssociation.EsnInfo.GetNeedESN() {
+		return window
+	}
+	return min(window, maxLegacyReplayWindow)
+}
+
 func buildXfrmState(xfrmiId uint32, childSecurityAssociation *context.ChildSecurityAssociation, spi int, src, dst net.IP, encap *netlink.XfrmStateEncap, encryptionKey, integrityKey []byte) *netlink.XfrmState {
+	state := &netlink.XfrmState{
+		Src:   src,
+		Dst:   dst,
+		Proto: netlink.XFRM_PROTO_ESP,
+		Mode:  xfrmMode(childSecurityAssociation),
+		Spi:   spi,
+		Ifid:  int(xfrmiId),
+		ESN:   childSecurityAssociation.EsnInfo.GetNeedESN(),
+		Encap: encap,
+		// The outer header copies the DSCP of the packets sent through the
+		// sockets of the N3IWF, including with NAT-T encapsulation
+		DontEncapDSCP: false,
+
+		ReplayWindow: xfrmReplayWindow(childSecurityAssociation),
+		Limits:       xfrmLimits(childSecurityAssociation.Lifetime),
+	}
 	xfrmEncryptionAlgorithm := &netlink.XfrmStateAlgo{
 		Name: XFRMEncryptionAlgorithmType(childSecurityAssociation.EncrKInfo.TransformID()).String(),
 		Key:  encryptionKey,
 	}
-	var xfrmIntegrityAlgorithm *netlink.XfrmStateAlgo
+	// AEAD ciphers carry their ICV, without separate integrity algorithm
+	if encr.IsAEAD(childSecurityAssociation.EncrKInfo) {
+		xfrmEncryptionAlgorithm.ICVLen = aeadICVLength
+		state.Aead = xfrmEncryptionAlgorithm
+		return state
+	}
+	state.Crypt = xfrmEncryptionAlgorithm
 	if childSecurityAssociation.IntegKInfo != nil {
-		xfrmIntegrityAlgorithm = &netlink.XfrmStateAlgo{
+		state.Auth = &netlink.XfrmStateAlgo{
 			Name:        XFRMIntegrityAlgorithmType(childSecurityAssociation.IntegKInfo.TransformID()).String(),
 			Key:         integrityKey,
 			TruncateLen: getTruncateLength(childSecurityAssociation.IntegKInfo.TransformID()),
 		}
 	}
-	return &netlink.XfrmState{
-		Src:   src,
-		Dst:   dst,
-		Proto: netlink.XFRM_PROTO_ESP,
-		Mode:  netlink.XFRM_MODE_TUNNEL,
-		Spi:   spi,
-		Ifid:  int(xfrmiId),
-		Auth:  xfrmIntegrityAlgorithm,
-		Crypt: xfrmEncryptionAlgorithm,
-		ESN:   childSecurityAssociation.EsnInfo.GetNeedESN(),
-		Encap: encap,
+	return state
+}
+
+// interFamilySelector returns the selector of a tunnel mode state whose inner
+// traffic, from src to dst, is not of the family of its outer address. The
+// kernel would otherwise give the state a selector of the outer family
+func interFamilySelector(childSecurityAssociation *context.ChildSecurityAssociation,
+	src, dst *net.IPNet, outer net.IP,
+) *netlink.XfrmPolicy {
+	if childSecurityAssociation.TransportMode || (dst.IP.To4() == nil) == (outer.To4() == nil) {
+		return nil
 	}
+	return &netlink.XfrmPolicy{Src: src, Dst: dst}
 }
 
-func buildXfrmPolicy(xfrmiId uint32, tmpl netlink.XfrmPolicyTmpl, src, dst *net.IPNet, proto uint8, dir netlink.Dir) *netlink.XfrmPolicy {
-	return &netlink.XfrmPolicy{
-		Src:   src,
-		Dst:   dst,
-		Proto: netlink.Proto(proto),
-		Dir:   dir,
-		Ifid:  int(xfrmiId),
-		Tmpls: []netlink.XfrmPolicyTmpl{tmpl},
+// Priority of the policies of policy based child SAs matching any mark, behind
+// the marked policies of the additional PDU sessions sharing their selectors
+const unmarkedPolicyPriority = 1
+
+// xfrmMark returns the firewall mark of a policy based child SA, nil when it
+// matches any mark
+func xfrmMark(childSecurityAssociation *context.ChildSecurityAssociation) *netlink.XfrmMark {
+	if childSecurityAssociation.XfrmMark == 0 {
+		return nil
 	}
+	return &netlink.XfrmMark{Value: childSecurityAssociation.XfrmMark, Mask: math.MaxUint32}
 }
 
+// buildXfrmPolicy returns the policy of the traffic from src to dst, with the
+// given protocol and ports, any when 0. Without xfrmiId the policy is bound to
+// mark instead of an XFRM interface
+func buildXfrmPolicy(xfrmiId uint32, mark *netlink.XfrmMark, tmpl netlink.XfrmPolicyTmpl, src, dst *net.IPNet,
+	proto uint8, srcPort, dstPort uint16, dir netlink.Dir,
+) *netlink.XfrmPolicy {
+	policy := &netlink.XfrmPolicy{
+		Src:     src,
+		Dst:     dst,
+		Proto:   netlink.Proto(proto),
+		SrcPort: int(srcPort),
+		DstPort: int(dstPort),
+		Dir:     dir,
+		Ifid:    int(xfrmiId),
+		Mark:    mark,
+		Tmpls:   []netlink.XfrmPolicyTmpl{tmpl},
+	}
+	if xfrmiId == 0 && mark == nil {
+		policy.Priority = unmarkedPolicyPriority
+	}
+	return policy
+}
+
+// ApplyXFRMRule installs the states and policies of a child SA, bound to the
+// XFRM interface xfrmiId or, when 0, policy based with the XfrmMark of the SA
 func ApplyXFRMRule(n3iwf_is_initiator bool, xfrmiId uint32,
 	childSecurityAssociation *context.ChildSecurityAssociation,
+) error {
+	return applyXFRMRule(n3iwf_is_initiator, xfrmiId, childSecurityAssociation, netlink.XfrmStateAdd,
+		netlink.XfrmPolicyAdd)
+}
+
+// RekeyXFRMRule installs the states of newChildSA and repoints the policies
+// shared with oldChildSA to them, so traffic moves to the new SA without a gap.
+// The old SA keeps its states until it is deleted, but no longer owns the
+// policies, nor the XFRM interface and firewall mark inherited by the new SA
+func RekeyXFRMRule(n3iwf_is_initiator bool, xfrmiId uint32,
+	newChildSA, oldChildSA *context.ChildSecurityAssociation,
+) error {
+	if err := applyXFRMRule(n3iwf_is_initiator, xfrmiId, newChildSA, netlink.XfrmStateAdd,
+		netlink.XfrmPolicyUpdate); err != nil {
+		return fmt.Errorf("RekeyXFRMRule: %w", err)
+	}
+	oldChildSA.XfrmPolicyList = nil
+	oldChildSA.XfrmIface = nil
+	oldChildSA.XfrmMark = 0
+	return nil
+}
+
+func applyXFRMRule(n3iwf_is_initiator bool, xfrmiId uint32,
+	childSecurityAssociation *context.ChildSecurityAssociation,
+	installState func(*netlink.XfrmState) error, installPolicy func(*netlink.XfrmPolicy) error,
 ) error {
 	var err error
 	// Direction: {private_network} -> this_server
@@ -116,8 +273,13 @@ func ApplyXFRMRule(n3iwf_is_initiator bool, xfrmiId uint32,
 		childSecurityAssociation.PeerPublicIPAddr,
 		childSecurityAssociation.LocalPublicIPAddr,
 		nil, inEncKey, inIntKey)
+	inState.Selector = interFamilySelector(childSecurityAssociation,
+		&childSecurityAssociation.TrafficSelectorRemote, &childSecurityAssociation.TrafficSelectorLocal, inState.Dst)
+	// Decrypted packets carry the mark, matching the inbound policy and
+	// telling the PDU session apart
+	inState.OutputMark = xfrmMark(childSecurityAssociation)
 
-	if err = netlink.XfrmStateAdd(inState); err != nil {
+	if err = installState(inState); err != nil {
 		return fmt.Errorf("add XFRM state %+v", err)
 	}
 	childSecurityAssociation.XfrmStateList = append(childSecurityAssociation.XfrmStateList, *inState)
@@ -129,16 +291,20 @@ func ApplyXFRMRule(n3iwf_is_initiator bool, xfrmiId uint32,
 		Mode:  inState.Mode,
 		Spi:   inState.Spi,
 	}
-	inPolicy := buildXfrmPolicy(xfrmiId, inTmpl,
+	inPolicy := buildXfrmPolicy(xfrmiId, xfrmMark(childSecurityAssociation), inTmpl,
 		&childSecurityAssociation.TrafficSelectorRemote,
 		&childSecurityAssociation.TrafficSelectorLocal,
 		childSecurityAssociation.SelectedIPProtocol,
+		childSecurityAssociation.SelectedRemotePort,
+		childSecurityAssociation.SelectedLocalPort,
 		netlink.XFRM_DIR_IN)
 
-	if err = netlink.XfrmPolicyAdd(inPolicy); err != nil {
-		return fmt.Errorf("add XFRM policy %+v", err)
+	if installPolicy != nil {
+		if err = installPolicy(inPolicy); err != nil {
+			return fmt.Errorf("add XFRM policy %+v", err)
+		}
+		childSecurityAssociation.XfrmPolicyList = append(childSecurityAssociation.XfrmPolicyList, *inPolicy)
 	}
-	childSecurityAssociation.XfrmPolicyList = append(childSecurityAssociation.XfrmPolicyList, *inPolicy)
 
 	// Direction: this_server -> {private_network}
 	var encap *netlink.XfrmStateEncap
@@ -159,8 +325,11 @@ func ApplyXFRMRule(n3iwf_is_initiator bool, xfrmiId uint32,
 	if encap != nil {
 		outState.Encap.SrcPort, outState.Encap.DstPort = outState.Encap.DstPort, outState.Encap.SrcPort
 	}
+	outState.Selector = interFamilySelector(childSecurityAssociation,
+		&childSecurityAssociation.TrafficSelectorLocal, &childSecurityAssociation.TrafficSelectorRemote, outState.Dst)
+	outState.Mark = xfrmMark(childSecurityAssociation)
 
-	if err = netlink.XfrmStateAdd(outState); err != nil {
+	if err = installState(outState); err != nil {
 		return fmt.Errorf("add XFRM state %+v", err)
 	}
 	childSecurityAssociation.XfrmStateList = append(childSecurityAssociation.XfrmStateList, *outState)
@@ -172,20 +341,116 @@ func ApplyXFRMRule(n3iwf_is_initiator bool, xfrmiId uint32,
 		Mode:  outState.Mode,
 		Spi:   outState.Spi,
 	}
-	outPolicy := buildXfrmPolicy(xfrmiId, outTmpl,
+	outPolicy := buildXfrmPolicy(xfrmiId, xfrmMark(childSecurityAssociation), outTmpl,
 		&childSecurityAssociation.TrafficSelectorLocal,
 		&childSecurityAssociation.TrafficSelectorRemote,
 		childSecurityAssociation.SelectedIPProtocol,
+		childSecurityAssociation.SelectedLocalPort,
+		childSecurityAssociation.SelectedRemotePort,
 		netlink.XFRM_DIR_OUT)
 
-	if err = netlink.XfrmPolicyAdd(outPolicy); err != nil {
-		return fmt.Errorf("add XFRM policy %+v", err)
+	if installPolicy != nil {
+		if err = installPolicy(outPolicy); err != nil {
+			return fmt.Errorf("add XFRM policy %+v", err)
+		}
+		childSecurityAssociation.XfrmPolicyList = append(childSecurityAssociation.XfrmPolicyList, *outPolicy)
 	}
-	childSecurityAssociation.XfrmPolicyList = append(childSecurityAssociation.XfrmPolicyList, *outPolicy)
 	return nil
 }
 
-func SetupIPsecXfrmi(xfrmIfaceName, parentIfaceName string, xfrmIfaceId uint32, xfrmIfaceAddr net.IPNet,
+// UpdateXFRMPeerAddress moves a child SA to new outer addresses and NAT-T
+// ports. Its states are reinstalled with the same keys and SPIs, and the
+// policies it owns are repointed to them. A child SA that handed its policies
+// over to a rekeyed SA only gets its states moved.
+//
+// The new states are installed before the old ones are deleted, so that the
+// traffic of the child SA keeps flowing. A new state with the destination, SPI
+// and protocol of an old one replaces it in place. On failure, the child SA is
+// left on its old addresses
+func UpdateXFRMPeerAddress(childSecurityAssociation *context.ChildSecurityAssociation,
+	peerIP, localIP net.IP, enableEncapsulate bool, n3iwfPort, natPort int,
+) error {
+	if len(childSecurityAssociation.XfrmStateList) == 0 {
+		return fmt.Errorf("UpdateXFRMPeerAddress: child SA 0x%08x has no XFRM state",
+			childSecurityAssociation.InboundSPI)
+	}
+	xfrmiId := uint32(childSecurityAssociation.XfrmStateList[0].Ifid) // #nosec G115
+	oldStates, oldPolicies := childSecurityAssociation.XfrmStateList, childSecurityAssociation.XfrmPolicyList
+	oldPeerIP, oldLocalIP := childSecurityAssociation.PeerPublicIPAddr, childSecurityAssociation.LocalPublicIPAddr
+	oldEncapsulate := childSecurityAssociation.EnableEncapsulate
+	oldN3IWFPort, oldNATPort := childSecurityAssociation.N3IWFPort, childSecurityAssociation.NATPort
+	replacesOldState := func(state *netlink.XfrmState) bool {
+		return slices.ContainsFunc(oldStates, func(old netlink.XfrmState) bool {
+			return sameXfrmStateID(&old, state)
+		})
+	}
+
+	installPolicy := netlink.XfrmPolicyUpdate
+	if len(oldPolicies) == 0 {
+		installPolicy = nil
+	}
+	childSecurityAssociation.PeerPublicIPAddr = peerIP
+	childSecurityAssociation.LocalPublicIPAddr = localIP
+	childSecurityAssociation.EnableEncapsulate = enableEncapsulate
+	childSecurityAssociation.N3IWFPort = n3iwfPort
+	childSecurityAssociation.NATPort = natPort
+	childSecurityAssociation.XfrmStateList = nil
+	childSecurityAssociation.XfrmPolicyList = nil
+	err := applyXFRMRule(childSecurityAssociation.LocalIsInitiator, xfrmiId, childSecurityAssociation,
+		func(state *netlink.XfrmState) error {
+			if replacesOldState(state) {
+				return netlink.XfrmStateUpdate(state)
+			}
+			return netlink.XfrmStateAdd(state)
+		}, installPolicy)
+	if err != nil {
+		// Best effort: the old states and policies are put back
+		for i := range childSecurityAssociation.XfrmStateList {
+			if state := &childSecurityAssociation.XfrmStateList[i]; !replacesOldState(state) {
+				_ = netlink.XfrmStateDel(state)
+			}
+		}
+		for i := range oldStates {
+			_ = netlink.XfrmStateUpdate(&oldStates[i])
+		}
+		if len(childSecurityAssociation.XfrmPolicyList) > 0 {
+			for i := range oldPolicies {
+				_ = netlink.XfrmPolicyUpdate(&oldPolicies[i])
+			}
+		}
+		childSecurityAssociation.PeerPublicIPAddr, childSecurityAssociation.LocalPublicIPAddr = oldPeerIP, oldLocalIP
+		childSecurityAssociation.EnableEncapsulate = oldEncapsulate
+		childSecurityAssociation.N3IWFPort, childSecurityAssociation.NATPort = oldN3IWFPort, oldNATPort
+		childSecurityAssociation.XfrmStateList, childSecurityAssociation.XfrmPolicyList = oldStates, oldPolicies
+		return fmt.Errorf("UpdateXFRMPeerAddress: %w", err)
+	}
+
+	var errs []error
+	for i := range oldStates {
+		old := &oldStates[i]
+		if !slices.ContainsFunc(childSecurityAssociation.XfrmStateList, func(state netlink.XfrmState) bool {
+			return sameXfrmStateID(old, &state)
+		}) {
+			if err := netlink.XfrmStateDel(old); err != nil {
+				errs = append(errs, fmt.Errorf("delete XFRM state: %w", err))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("UpdateXFRMPeerAddress: %w", err)
+	}
+	return nil
+}
+
+// sameXfrmStateID reports whether the kernel identifies a and b as the same
+// state, by destination, SPI and protocol
+func sameXfrmStateID(a, b *netlink.XfrmState) bool {
+	return a.Dst.Equal(b.Dst) && a.Spi == b.Spi && a.Proto == b.Proto
+}
+
+// SetupIPsecXfrmi creates the XFRM interface xfrmIfaceName, with the kernel
+// default MTU when mtu is 0
+func SetupIPsecXfrmi(xfrmIfaceName, parentIfaceName string, xfrmIfaceId uint32, xfrmIfaceAddr net.IPNet, mtu int,
 ) (netlink.Link, error) {
 	var (
 		xfrmi, parent netlink.Link
@@ -201,6 +466,7 @@ func SetupIPsecXfrmi(xfrmIfaceName, parentIfaceName string, xfrmIfaceId uint32,
 		LinkAttrs: netlink.LinkAttrs{
 			Name:        xfrmIfaceName,
 			ParentIndex: parent.Attrs().Index,
+			MTU:         mtu,
 		},
 		Ifid: xfrmIfaceId,
 	}
@@ -240,6 +506,10 @@ func getTruncateLength(transformID uint16) int {
 		return 96
 	case message.AUTH_HMAC_SHA2_256_128:
 		return 128
+	case message.AUTH_HMAC_SHA2_384_192:
+		return 192
+	case message.AUTH_HMAC_SHA2_512_256:
+		return 256
 	default:
 		return 96
 	}
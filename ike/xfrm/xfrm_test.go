@@ -0,0 +1,417 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package xfrm
+
+import (
+	"net"
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/vishvananda/netlink"
+)
+
+func TestBuildXfrmStateMode(t *testing.T) {
+	var proposals message.ProposalContainer
+	proposal := proposals.BuildProposal(1, message.TypeESP, []byte{0x01, 0x02, 0x03, 0x04})
+	keyLength := uint16(128)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+	proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_HMAC_SHA1_96, nil, nil, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+	childSAKey, err := security.NewChildSAKeyByProposal(proposal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		description   string
+		transportMode bool
+		encap         *netlink.XfrmStateEncap
+		expMode       netlink.Mode
+	}{
+		{
+			description: "tunnel mode",
+			expMode:     netlink.XFRM_MODE_TUNNEL,
+		},
+		{
+			description: "tunnel mode with NAT-T",
+			encap:       &netlink.XfrmStateEncap{Type: netlink.XFRM_ENCAP_ESPINUDP, SrcPort: 4500, DstPort: 4500},
+			expMode:     netlink.XFRM_MODE_TUNNEL,
+		},
+		{
+			description:   "transport mode",
+			transportMode: true,
+			expMode:       netlink.XFRM_MODE_TRANSPORT,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			childSA := &context.ChildSecurityAssociation{
+				ChildSAKey:    childSAKey,
+				TransportMode: tc.transportMode,
+				ReplayWindow:  64,
+			}
+			state := buildXfrmState(7, childSA, 0x1001, net.ParseIP("192.168.0.100"),
+				net.ParseIP("192.168.0.1"), tc.encap, make([]byte, 16), make([]byte, 20))
+			if state.Mode != tc.expMode {
+				t.Errorf("XFRM mode mismatch. got = %v, want = %v", state.Mode, tc.expMode)
+			}
+			if state.Encap != tc.encap {
+				t.Errorf("encapsulation mismatch. got = %v, want = %v", state.Encap, tc.encap)
+			}
+			// The DSCP marked by the N3IWF sockets must reach the outer header
+			if state.DontEncapDSCP {
+				t.Errorf("DSCP of the protected packets not copied to the outer header")
+			}
+			// Capped to the legacy replay state without ESN
+			if state.ReplayWindow != maxLegacyReplayWindow {
+				t.Errorf("replay window mismatch. got = %d, want = %d", state.ReplayWindow, maxLegacyReplayWindow)
+			}
+		})
+	}
+}
+
+func TestBuildXfrmStateIntegrity(t *testing.T) {
+	testcases := []struct {
+		description    string
+		integID        uint16
+		expName        string
+		expTruncateLen int
+	}{
+		{
+			description:    "HMAC-SHA1-96",
+			integID:        message.AUTH_HMAC_SHA1_96,
+			expName:        "hmac(sha1)",
+			expTruncateLen: 96,
+		},
+		{
+			description:    "HMAC-SHA2-256-128",
+			integID:        message.AUTH_HMAC_SHA2_256_128,
+			expName:        "hmac(sha256)",
+			expTruncateLen: 128,
+		},
+		{
+			description:    "HMAC-SHA2-384-192",
+			integID:        message.AUTH_HMAC_SHA2_384_192,
+			expName:        "hmac(sha384)",
+			expTruncateLen: 192,
+		},
+		{
+			description:    "HMAC-SHA2-512-256",
+			integID:        message.AUTH_HMAC_SHA2_512_256,
+			expName:        "hmac(sha512)",
+			expTruncateLen: 256,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var proposals message.ProposalContainer
+			proposal := proposals.BuildProposal(1, message.TypeESP, []byte{0x01, 0x02, 0x03, 0x04})
+			keyLength := uint16(128)
+			attrType := uint16(message.AttributeTypeKeyLength)
+			proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_CBC, &attrType, &keyLength, nil)
+			proposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, tc.integID, nil, nil, nil)
+			proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+			childSAKey, err := security.NewChildSAKeyByProposal(proposal)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			childSA := &context.ChildSecurityAssociation{ChildSAKey: childSAKey}
+			integrityKey := make([]byte, childSAKey.IntegKInfo.GetKeyLength())
+			state := buildXfrmState(7, childSA, 0x1001, net.ParseIP("192.168.0.100"),
+				net.ParseIP("192.168.0.1"), nil, make([]byte, 16), integrityKey)
+			if state.Auth == nil {
+				t.Fatalf("XFRM state without integrity algorithm")
+			}
+			if state.Auth.Name != tc.expName {
+				t.Errorf("integrity algorithm mismatch. got = %s, want = %s", state.Auth.Name, tc.expName)
+			}
+			if state.Auth.TruncateLen != tc.expTruncateLen {
+				t.Errorf("truncate length mismatch. got = %d, want = %d", state.Auth.TruncateLen, tc.expTruncateLen)
+			}
+			if len(state.Auth.Key) != len(integrityKey) {
+				t.Errorf("integrity key length mismatch. got = %d, want = %d", len(state.Auth.Key), len(integrityKey))
+			}
+		})
+	}
+}
+
+func TestBuildXfrmStateAEAD(t *testing.T) {
+	var proposals message.ProposalContainer
+	proposal := proposals.BuildProposal(1, message.TypeESP, []byte{0x01, 0x02, 0x03, 0x04})
+	keyLength := uint16(256)
+	attrType := uint16(message.AttributeTypeKeyLength)
+	proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_GCM_16, &attrType, &keyLength, nil)
+	proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, message.ESN_DISABLE, nil, nil, nil)
+	childSAKey, err := security.NewChildSAKeyByProposal(proposal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// 256 bit AES key followed by the 4 octet salt
+	if keyLen := childSAKey.EncrKInfo.GetKeyLength(); keyLen != 36 {
+		t.Fatalf("key length mismatch. got = %d, want = %d", keyLen, 36)
+	}
+
+	childSA := &context.ChildSecurityAssociation{ChildSAKey: childSAKey}
+	state := buildXfrmState(7, childSA, 0x1001, net.ParseIP("192.168.0.100"),
+		net.ParseIP("192.168.0.1"), nil, make([]byte, 36), nil)
+	if state.Crypt != nil || state.Auth != nil {
+		t.Errorf("AEAD state with separate encryption or integrity algorithm")
+	}
+	if state.Aead == nil {
+		t.Fatalf("XFRM state without AEAD algorithm")
+	}
+	if state.Aead.Name != "rfc4106(gcm(aes))" || state.Aead.ICVLen != 128 || len(state.Aead.Key) != 36 {
+		t.Errorf("AEAD algorithm mismatch. got = %s/%d/%d", state.Aead.Name, state.Aead.ICVLen, len(state.Aead.Key))
+	}
+
+	restored, err := childSAKeyFromXfrmState(state)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if restored.EncrKInfo != childSAKey.EncrKInfo || restored.IntegKInfo != nil {
+		t.Errorf("restored child SA key mismatch. got = %v/%v", restored.EncrKInfo, restored.IntegKInfo)
+	}
+}
+
+func TestValidateReplayWindow(t *testing.T) {
+	testcases := []struct {
+		description string
+		size        uint32
+		expectErr   bool
+	}{
+		{description: "disabled", size: 0},
+		{description: "smallest window", size: 1},
+		{description: "legacy window", size: 32},
+		{description: "largest window", size: MaxReplayWindow},
+		{description: "not a power of two", size: 100, expectErr: true},
+		{description: "beyond the kernel limit", size: 2 * MaxReplayWindow, expectErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := ValidateReplayWindow(tc.size)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected error but got none")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestXfrmReplayWindow(t *testing.T) {
+	testcases := []struct {
+		description string
+		esn         uint16
+		window      uint32
+		expWindow   int
+	}{
+		{"legacy window", message.ESN_DISABLE, 16, 16},
+		{"legacy window capped", message.ESN_DISABLE, 256, maxLegacyReplayWindow},
+		{"ESN window", message.ESN_ENABLE, 256, 256},
+		{"replay protection disabled", message.ESN_DISABLE, 0, 0},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			proposal := new(message.Proposal)
+			keyLength := uint16(128)
+			attrType := uint16(message.AttributeTypeKeyLength)
+			proposal.EncryptionAlgorithm.BuildTransform(message.TypeEncryptionAlgorithm, message.ENCR_AES_GCM_16,
+				&attrType, &keyLength, nil)
+			proposal.ExtendedSequenceNumbers.BuildTransform(message.TypeExtendedSequenceNumbers, tc.esn, nil, nil, nil)
+			childSAKey, err := security.NewChildSAKeyByProposal(proposal)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			childSA := &context.ChildSecurityAssociation{ChildSAKey: childSAKey, ReplayWindow: tc.window}
+			if got := xfrmReplayWindow(childSA); got != tc.expWindow {
+				t.Errorf("replay window mismatch. got = %d, want = %d", got, tc.expWindow)
+			}
+		})
+	}
+}
+
+func TestInterfaceMTU(t *testing.T) {
+	testcases := []struct {
+		description string
+		baseMTU     int
+		ipv6Outer   bool
+		expMTU      int
+		expectErr   bool
+	}{
+		{description: "Ethernet over IPv4", baseMTU: 1500, expMTU: 1399},
+		{description: "Ethernet over IPv6", baseMTU: 1500, ipv6Outer: true, expMTU: 1379},
+		{description: "jumbo frames", baseMTU: 9000, expMTU: 8899},
+		{description: "too small", baseMTU: 576, expectErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			mtu, err := InterfaceMTU(tc.baseMTU, tc.ipv6Outer)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if mtu != tc.expMTU {
+				t.Errorf("MTU mismatch. got = %d, want = %d", mtu, tc.expMTU)
+			}
+		})
+	}
+}
+
+func TestInterFamilySelector(t *testing.T) {
+	_, ipv4Src, _ := net.ParseCIDR("10.0.0.5/32")
+	_, ipv4Dst, _ := net.ParseCIDR("10.0.0.1/32")
+	_, ipv6Src, _ := net.ParseCIDR("2001:db8:1::5/128")
+	_, ipv6Dst, _ := net.ParseCIDR("2001:db8:1::1/128")
+
+	testcases := []struct {
+		description   string
+		transportMode bool
+		src, dst      *net.IPNet
+		outer         net.IP
+		expSelector   bool
+	}{
+		{
+			description: "IPv4 inner, IPv4 outer",
+			src:         ipv4Src,
+			dst:         ipv4Dst,
+			outer:       net.ParseIP("192.168.0.1"),
+		},
+		{
+			description: "IPv6 inner, IPv6 outer",
+			src:         ipv6Src,
+			dst:         ipv6Dst,
+			outer:       net.ParseIP("2001:db8::1"),
+		},
+		{
+			description: "IPv4 inner, IPv6 outer",
+			src:         ipv4Src,
+			dst:         ipv4Dst,
+			outer:       net.ParseIP("2001:db8::1"),
+			expSelector: true,
+		},
+		{
+			description: "IPv6 inner, IPv4 outer",
+			src:         ipv6Src,
+			dst:         ipv6Dst,
+			outer:       net.ParseIP("192.168.0.1").To4(),
+			expSelector: true,
+		},
+		{
+			description:   "transport mode",
+			transportMode: true,
+			src:           ipv4Src,
+			dst:           ipv4Dst,
+			outer:         net.ParseIP("2001:db8::1"),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			childSA := &context.ChildSecurityAssociation{TransportMode: tc.transportMode}
+			selector := interFamilySelector(childSA, tc.src, tc.dst, tc.outer)
+			if (selector != nil) != tc.expSelector {
+				t.Fatalf("selector presence mismatch. got = %v, want = %v", selector != nil, tc.expSelector)
+			}
+			if selector != nil && (selector.Src != tc.src || selector.Dst != tc.dst) {
+				t.Errorf("selector mismatch. got = %v -> %v, want = %v -> %v", selector.Src, selector.Dst, tc.src, tc.dst)
+			}
+		})
+	}
+}
+
+func TestBuildXfrmPolicyMode(t *testing.T) {
+	_, src, _ := net.ParseCIDR("10.0.0.5/32")
+	_, dst, _ := net.ParseCIDR("10.0.0.1/32")
+
+	testcases := []struct {
+		description string
+		xfrmiId     uint32
+		xfrmMark    uint32
+		expIfid     int
+		expMark     bool
+		expPriority int
+	}{
+		{
+			description: "XFRM interface",
+			xfrmiId:     7,
+			expIfid:     7,
+		},
+		{
+			description: "policy based, first PDU session",
+			expPriority: unmarkedPolicyPriority,
+		},
+		{
+			description: "policy based, additional PDU session",
+			xfrmMark:    15,
+			expMark:     true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			childSA := &context.ChildSecurityAssociation{XfrmMark: tc.xfrmMark}
+			policy := buildXfrmPolicy(tc.xfrmiId, xfrmMark(childSA), netlink.XfrmPolicyTmpl{}, src, dst,
+				message.IPProtocolAll, 0, 0, netlink.XFRM_DIR_OUT)
+			if policy.Ifid != tc.expIfid {
+				t.Errorf("if_id mismatch. got = %d, want = %d", policy.Ifid, tc.expIfid)
+			}
+			if (policy.Mark != nil) != tc.expMark {
+				t.Fatalf("mark presence mismatch. got = %v, want = %v", policy.Mark != nil, tc.expMark)
+			}
+			if policy.Mark != nil && (policy.Mark.Value != tc.xfrmMark || policy.Mark.Mask != 0xffffffff) {
+				t.Errorf("mark mismatch. got = %+v, want = %d", policy.Mark, tc.xfrmMark)
+			}
+			if policy.Priority != tc.expPriority {
+				t.Errorf("priority mismatch. got = %d, want = %d", policy.Priority, tc.expPriority)
+			}
+		})
+	}
+}
+
+func TestSameXfrmStateID(t *testing.T) {
+	state := &netlink.XfrmState{Dst: net.ParseIP("192.0.2.1"), Spi: 0x1001, Proto: netlink.XFRM_PROTO_ESP}
+	testcases := []struct {
+		description string
+		other       netlink.XfrmState
+		expSame     bool
+	}{
+		{
+			description: "other source",
+			other: netlink.XfrmState{Src: net.ParseIP("198.51.100.7"), Dst: net.ParseIP("192.0.2.1"), Spi: 0x1001,
+				Proto: netlink.XFRM_PROTO_ESP},
+			expSame: true,
+		},
+		{
+			description: "other destination",
+			other:       netlink.XfrmState{Dst: net.ParseIP("192.0.2.2"), Spi: 0x1001, Proto: netlink.XFRM_PROTO_ESP},
+		},
+		{
+			description: "other SPI",
+			other:       netlink.XfrmState{Dst: net.ParseIP("192.0.2.1"), Spi: 0x1002, Proto: netlink.XFRM_PROTO_ESP},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			if same := sameXfrmStateID(state, &tc.other); same != tc.expSame {
+				t.Errorf("sameXfrmStateID = %v, expected %v", same, tc.expSame)
+			}
+		})
+	}
+}
@@ -23,6 +23,7 @@ var (
 	NWuUPLog    *zap.SugaredLogger
 	RelayLog    *zap.SugaredLogger
 	UtilLog     *zap.SugaredLogger
+	AdminLog    *zap.SugaredLogger
 	atomicLevel zap.AtomicLevel
 )
 
@@ -66,6 +67,7 @@ func init() {
 	NWuUPLog = log.Sugar().With("component", "N3IWF", "category", "NWuUP")
 	RelayLog = log.Sugar().With("component", "N3IWF", "category", "Relay")
 	UtilLog = log.Sugar().With("component", "N3IWF", "category", "Util")
+	AdminLog = log.Sugar().With("component", "N3IWF", "category", "Admin")
 }
 
 // SetLogLevel sets the log level (panic|fatal|error|warn|info|debug)
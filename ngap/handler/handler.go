@@ -625,6 +625,7 @@ func HandleInitialContextSetupRequest(amf *context.N3IWFAMF, pdu *ngapType.NGAPP
 		ranUeCtx.TemporaryPDUSessionSetupData.FailedListCxtRes = failedListCxtRes
 		ranUeCtx.TemporaryPDUSessionSetupData.Index = 0
 		ranUeCtx.TemporaryPDUSessionSetupData.UnactivatedPDUSession = nil
+		ranUeCtx.TemporaryPDUSessionSetupData.FailedErrStr = nil
 		ranUeCtx.TemporaryPDUSessionSetupData.NGAPProcedureCode.Value = ngapType.ProcedureCodeInitialContextSetup
 
 		for _, item := range pduSessionResourceSetupListCxtReq.List {
@@ -709,7 +710,7 @@ func HandleInitialContextSetupRequest(amf *context.N3IWFAMF, pdu *ngapType.NGAPP
 			return
 		}
 
-		n3iwfCtx.IkeServer.RcvEventCh <- context.NewSendEAPSuccessMsgEvt(spi, securityKey.Value.Bytes, len(ranUeCtx.PduSessionList))
+		n3iwfCtx.IkeServer.SendEvent(context.NewSendEAPSuccessMsgEvt(spi, securityKey.Value.Bytes, len(ranUeCtx.PduSessionList)))
 	default:
 		logger.NgapLog.Errorf("unknown UE type: %T", ue)
 	}
@@ -1038,7 +1039,7 @@ func HandleUEContextModificationRequest(amf *context.N3IWFAMF, pdu *ngapType.NGA
 		return
 	}
 
-	n3iwfCtx.IkeServer.RcvEventCh <- context.NewIKEContextUpdateEvt(spi, securityKey.Value.Bytes) // Kn3iwf
+	n3iwfCtx.IkeServer.SendEvent(context.NewIKEContextUpdateEvt(spi, securityKey.Value.Bytes)) // Kn3iwf
 }
 
 func HandleUEContextReleaseCommand(amf *context.N3IWFAMF, pdu *ngapType.NGAPPDU) {
@@ -1132,7 +1133,7 @@ func releaseIkeUeAndRanUe(ranUe context.RanUe) error {
 	ranUeNgapID := ranUe.GetSharedCtx().RanUeNgapId
 
 	if localSPI, ok := n3iwfCtx.IkeSpiLoad(ranUeNgapID); ok {
-		n3iwfCtx.IkeServer.RcvEventCh <- context.NewIKEDeleteRequestEvt(localSPI)
+		n3iwfCtx.IkeServer.SendEvent(context.NewIKEDeleteRequestEvt(localSPI))
 	}
 
 	if err := ranUe.Remove(); err != nil {
@@ -1286,7 +1287,7 @@ func HandleDownlinkNASTransport(amf *context.N3IWFAMF, pdu *ngapType.NGAPPDU) {
 			}
 
 			if !ue.IsNASTCPConnEstablished {
-				n3iwfCtx.IkeServer.RcvEventCh <- context.NewSendEAPNASMsgEvt(spi, []byte(nasPDU.Value))
+				n3iwfCtx.IkeServer.SendEvent(context.NewSendEAPNASMsgEvt(spi, []byte(nasPDU.Value)))
 			} else {
 				// Using a "NAS message envelope" to transport a NAS message
 				// over the non-3GPP access between the UE and the N3IWF
@@ -1437,6 +1438,7 @@ func HandlePDUSessionResourceSetupRequest(amf *context.N3IWFAMF, pdu *ngapType.N
 		tempPDUSessionSetupData.FailedListSURes = failedListSURes
 		tempPDUSessionSetupData.Index = 0
 		tempPDUSessionSetupData.UnactivatedPDUSession = nil
+		tempPDUSessionSetupData.FailedErrStr = nil
 		tempPDUSessionSetupData.NGAPProcedureCode.Value = ngapType.ProcedureCodePDUSessionResourceSetup
 
 		for _, item := range pduSessionResourceSetupListSUReq.List {
@@ -1485,7 +1487,7 @@ func HandlePDUSessionResourceSetupRequest(amf *context.N3IWFAMF, pdu *ngapType.N
 				logger.NgapLog.Errorf("cannot get SPI from ranNgapID: %+v", ranUeNgapID)
 				return
 			}
-			n3iwfCtx.IkeServer.RcvEventCh <- context.NewCreatePDUSessionEvt(spi, len(ue.PduSessionList), ue.TemporaryPDUSessionSetupData)
+			n3iwfCtx.IkeServer.SendEvent(context.NewCreatePDUSessionEvt(spi, len(ue.PduSessionList), ue.TemporaryPDUSessionSetupData))
 
 			// TS 23.501 4.12.5 Requested PDU Session Establishment via Untrusted non-3GPP Access
 			// After all IPsec Child SAs are established, the N3IWF shall forward to UE via the signalling IPsec SA
@@ -2044,7 +2046,7 @@ func HandlePDUSessionResourceReleaseCommand(amf *context.N3IWFAMF, pdu *ngapType
 	}
 	ranUe.GetSharedCtx().PduSessResRelState = context.PduSessResRelStateOngoing
 
-	n3iwfCtx.IkeServer.RcvEventCh <- context.NewSendChildSADeleteRequestEvt(localSPI, releaseIdList)
+	n3iwfCtx.IkeServer.SendEvent(context.NewSendChildSADeleteRequestEvt(localSPI, releaseIdList))
 
 	ranUeCtx.PduSessionReleaseList = releaseList
 	// if nASPDU != nil {
@@ -2716,7 +2718,7 @@ func HandleGetNGAPContext(ngapEvent context.NgapEvt) {
 		return
 	}
 
-	n3iwfCtx.IkeServer.RcvEventCh <- context.NewGetNGAPContextRepEvt(spi, ngapCxtReqNumlist, ngapCxt)
+	n3iwfCtx.IkeServer.SendEvent(context.NewGetNGAPContextRepEvt(spi, evt.Token, ngapCxtReqNumlist, ngapCxt))
 }
 
 func HandleUnmarshalEAP5GData(ngapEvent context.NgapEvt) {
@@ -2769,7 +2771,7 @@ func HandleUnmarshalEAP5GData(ngapEvent context.NgapEvt) {
 
 		selectedAMF := n3iwfCtx.AMFSelection(anParameters.GUAMI, anParameters.SelectedPLMNID)
 		if selectedAMF == nil {
-			n3iwfCtx.IkeServer.RcvEventCh <- context.NewSendEAP5GFailureMsgEvt(spi, context.ErrAMFSelection)
+			n3iwfCtx.IkeServer.SendEvent(context.NewSendEAP5GFailureMsgEvt(spi, context.ErrAMFSelection))
 		} else {
 			n3iwfUe := n3iwfCtx.NewN3iwfRanUe()
 			n3iwfUe.AMF = selectedAMF
@@ -2782,7 +2784,7 @@ func HandleUnmarshalEAP5GData(ngapEvent context.NgapEvt) {
 				n3iwfUe.RRCEstablishmentCause = int16(value)
 			}
 
-			n3iwfCtx.IkeServer.RcvEventCh <- context.NewUnmarshalEAP5GDataResponseEvt(spi, n3iwfUe.RanUeNgapId, nasPDU)
+			n3iwfCtx.IkeServer.SendEvent(context.NewUnmarshalEAP5GDataResponseEvt(spi, n3iwfUe.RanUeNgapId, nasPDU))
 		}
 	} else {
 		ranUeNgapId := evt.RanUeNgapId
@@ -2800,8 +2802,6 @@ func HandleSendInitialUEMessage(ngapEvent context.NgapEvt) {
 
 	evt := ngapEvent.(*context.SendInitialUEMessageEvt)
 	ranUeNgapId := evt.RanUeNgapId
-	ipv4Addr := evt.IPv4Addr
-	ipv4Port := evt.IPv4Port
 	nasPDU := evt.NasPDU
 
 	n3iwfCtx := context.N3IWFSelf()
@@ -2811,11 +2811,46 @@ func HandleSendInitialUEMessage(ngapEvent context.NgapEvt) {
 		return
 	}
 	ranUeCtx := ranUe.GetSharedCtx()
-	ranUeCtx.IPAddrv4 = ipv4Addr
-	ranUeCtx.PortNumber = int32(ipv4Port)
+	if ip := net.ParseIP(evt.IPAddr); ip != nil && ip.To4() == nil {
+		ranUeCtx.IPAddrv6 = evt.IPAddr
+	} else {
+		ranUeCtx.IPAddrv4 = evt.IPAddr
+	}
+	ranUeCtx.PortNumber = int32(evt.Port)
 	message.SendInitialUEMessage(ranUeCtx.AMF, ranUe, nasPDU)
 }
 
+// pduSessionSetupFailureCause maps the reason a PDU session child SA was not
+// set up to the cause reported to the AMF
+func pduSessionSetupFailureCause(errStr context.EvtError) ngapType.Cause {
+	switch errStr {
+	case context.ErrTransportResourceUnavailable:
+		return *message.BuildCause(ngapType.CausePresentTransport,
+			ngapType.CauseTransportPresentTransportResourceUnavailable)
+	case context.ErrNoAdditionalSAs:
+		return *message.BuildCause(ngapType.CausePresentRadioNetwork,
+			ngapType.CauseRadioNetworkPresentRadioResourcesNotAvailable)
+	case context.ErrNoProposalChosen:
+		return *message.BuildCause(ngapType.CausePresentRadioNetwork,
+			ngapType.CauseRadioNetworkPresentEncryptionAndOrIntegrityProtectionAlgorithmsNotSupported)
+	case context.ErrTemporaryFailure:
+		// The UE is busy with another exchange on the IKE SA, e.g. a rekey
+		return *message.BuildCause(ngapType.CausePresentRadioNetwork,
+			ngapType.CauseRadioNetworkPresentInteractionWithOtherProcedure)
+	case context.ErrTSUnacceptable, context.ErrChildSARejected:
+		return *message.BuildCause(ngapType.CausePresentRadioNetwork,
+			ngapType.CauseRadioNetworkPresentFailureInRadioInterfaceProcedure)
+	case context.ErrRadioConnWithUeLost:
+		// The UE never answered the CREATE_CHILD_SA request
+		return *message.BuildCause(ngapType.CausePresentRadioNetwork,
+			ngapType.CauseRadioNetworkPresentRadioConnectionWithUeLost)
+	default:
+		logger.NgapLog.Warnf("unmapped PDU session setup error: %s", errStr.Error())
+		return *message.BuildCause(ngapType.CausePresentRadioNetwork,
+			ngapType.CauseRadioNetworkPresentUnspecified)
+	}
+}
+
 func HandleSendPDUSessionResourceSetupResponse(ngapEvent context.NgapEvt) {
 	logger.NgapLog.Debugln("handle SendPDUSessionResourceSetupResponse Event")
 
@@ -2834,22 +2869,13 @@ func HandleSendPDUSessionResourceSetupResponse(ngapEvent context.NgapEvt) {
 
 	if len(temporaryPDUSessionSetupData.UnactivatedPDUSession) != 0 {
 		for index, pduSession := range temporaryPDUSessionSetupData.UnactivatedPDUSession {
-			errStr := temporaryPDUSessionSetupData.FailedErrStr[index]
+			// A PDU session whose child SA setup never completed has no outcome
+			errStr := context.ErrTransportResourceUnavailable
+			if index < len(temporaryPDUSessionSetupData.FailedErrStr) {
+				errStr = temporaryPDUSessionSetupData.FailedErrStr[index]
+			}
 			if errStr != context.ErrNil {
-				var cause ngapType.Cause
-				switch errStr {
-				case context.ErrTransportResourceUnavailable:
-					cause = ngapType.Cause{
-						Present: ngapType.CausePresentTransport,
-						Transport: &ngapType.CauseTransport{
-							Value: ngapType.CauseTransportPresentTransportResourceUnavailable,
-						},
-					}
-				default:
-					logger.NgapLog.Errorf("undefined event error string: %+s", errStr.Error())
-					return
-				}
-
+				cause := pduSessionSetupFailureCause(errStr)
 				transfer, err := message.BuildPDUSessionResourceSetupUnsuccessfulTransfer(cause, nil)
 				if err != nil {
 					logger.NgapLog.Errorf("build PDU Session Resource Setup Unsuccessful Transfer Failed: %+v", err)
@@ -2876,6 +2902,11 @@ func HandleSendPDUSessionResourceSetupResponse(ngapEvent context.NgapEvt) {
 					logger.NgapLog.Errorf("build PDU session resource setup response transfer failed: %+v", err)
 					return
 				}
+				// NGAP has no IE for the child SA, it is logged for correlation
+				if childSA := findChildSAInfo(evt.ChildSAs, pduSession.Id); childSA != nil {
+					logger.NgapLog.Infow("PDU session set up", append([]any{"ranUeNgapId", ranUeNgapId},
+						childSA.LogFields()...)...)
+				}
 				if temporaryPDUSessionSetupData.NGAPProcedureCode.Value == ngapType.ProcedureCodeInitialContextSetup {
 					message.AppendPDUSessionResourceSetupListCxtRes(
 						temporaryPDUSessionSetupData.SetupListCxtRes, pduSession.Id, transfer)
@@ -2900,6 +2931,17 @@ func HandleSendPDUSessionResourceSetupResponse(ngapEvent context.NgapEvt) {
 	}
 }
 
+// findChildSAInfo returns the child SA carrying the PDU session
+// pduSessionId, nil if unknown
+func findChildSAInfo(childSAs []context.ChildSAInfo, pduSessionId int64) *context.ChildSAInfo {
+	for i := range childSAs {
+		if childSAs[i].PDUSessionId == pduSessionId {
+			return &childSAs[i]
+		}
+	}
+	return nil
+}
+
 func HandleSendNASMsg(ngapEvent context.NgapEvt) {
 	logger.NgapLog.Debugln("handle SendNASMsg Event")
 
@@ -3007,6 +3049,15 @@ func HandleSendUEContextReleaseRequest(ngapEvent context.NgapEvt) {
 		return
 	}
 
+	// Before its first downlink message, the AMF has no UE context to release
+	if ranUe.GetSharedCtx().AmfUeNgapId == context.AmfUeNgapIdUnspecified {
+		logger.NgapLog.Infof("no AMF UE NGAP ID for ranUeNgapId %d, release the UE context locally", ranUeNgapId)
+		if err := ranUe.Remove(); err != nil {
+			logger.NgapLog.Warnf("HandleSendUEContextReleaseRequest(): %v", err)
+		}
+		return
+	}
+
 	message.SendUEContextReleaseRequest(ranUe, *cause)
 }
 
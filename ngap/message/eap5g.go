@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"errors"
 
+	"github.com/omec-project/n3iwf/context"
 	"github.com/omec-project/n3iwf/logger"
 	"github.com/omec-project/ngap/v2/aper"
 	"github.com/omec-project/ngap/v2/ngapType"
@@ -16,15 +17,7 @@ import (
 
 // 3GPP specified EAP-5G
 
-// Access Network Parameters
-type ANParameters struct {
-	GUAMI              *ngapType.GUAMI
-	SelectedPLMNID     *ngapType.PLMNIdentity
-	RequestedNSSAI     *ngapType.AllowedNSSAI
-	EstablishmentCause *ngapType.RRCEstablishmentCause
-}
-
-func UnmarshalEAP5GData(codedData []byte) (anParameters *ANParameters, nasPDU []byte, err error) {
+func UnmarshalEAP5GData(codedData []byte) (anParameters *context.ANParameters, nasPDU []byte, err error) {
 	if len(codedData) < 2 {
 		return nil, nil, errors.New("no data to decode")
 	}
@@ -47,7 +40,7 @@ func UnmarshalEAP5GData(codedData []byte) (anParameters *ANParameters, nasPDU []
 		}
 		anParameterField = anParameterField[:anParameterLength]
 		logger.NgapLog.Debugf("parsing AN-parameters: %+v", anParameterField)
-		anParameters = new(ANParameters)
+		anParameters = new(context.ANParameters)
 		for len(anParameterField) >= 2 {
 			parameterType := anParameterField[0]
 			parameterLength := anParameterField[1]
@@ -143,14 +136,15 @@ func UnmarshalEAP5GData(codedData []byte) (anParameters *ANParameters, nasPDU []
 
 						ngapSNSSAIItem := ngapType.AllowedNSSAIItem{}
 
+						// The mapped HPLMN S-NSSAI of a roaming UE is not forwarded
 						switch len(snssaiValue) {
-						case 1:
+						case 1, 2:
 							ngapSNSSAIItem.SNSSAI = ngapType.SNSSAI{
 								SST: ngapType.SST{
 									Value: []byte{snssaiValue[0]},
 								},
 							}
-						case 4:
+						case 4, 5, 8:
 							ngapSNSSAIItem.SNSSAI = ngapType.SNSSAI{
 								SST: ngapType.SST{
 									Value: []byte{snssaiValue[0]},
@@ -141,6 +141,9 @@ func listenAndServe(localAddr, remoteAddr *sctp.SCTPAddr, errChan chan<- error,
 	// Send NG setup request
 	message.SendNGSetupRequest(conn, n3iwfCtx)
 	close(errChan)
+	healthComponent := context.HealthNGAP(remoteAddr.String())
+	n3iwfCtx.Health.Set(healthComponent, true)
+	defer n3iwfCtx.Health.Set(healthComponent, false)
 
 	n3iwfCtx.NgapServer.Conn = append(n3iwfCtx.NgapServer.Conn, conn)
 	data := make([]byte, context.MAX_BUF_MSG_LEN)
@@ -63,6 +63,9 @@ func listenAndServe(wg *sync.WaitGroup) {
 		logger.NWuCPLog.Infof("accepted UE from %+v", conn.RemoteAddr())
 
 		n3iwfCtx := context.N3IWFSelf()
+		if err = util.SetDSCP(conn, n3iwfCtx.ControlPlaneDSCP); err != nil {
+			logger.NWuCPLog.Warnf("NAS of UE %+v left unmarked: %+v", conn.RemoteAddr(), err)
+		}
 		ueIP := strings.SplitN(conn.RemoteAddr().String(), ":", 2)[0]
 		ikeUe, ok := n3iwfCtx.AllocatedUEIPAddressLoad(ueIP)
 		if !ok {
@@ -88,7 +91,9 @@ func listenAndServe(wg *sync.WaitGroup) {
 		// Store connection
 		n3iwfUe.TCPConnection = conn
 
-		n3iwfCtx.NgapServer.RcvEventCh <- context.NewNASTCPConnEstablishedCompleteEvt(n3iwfUe.RanUeNgapId)
+		if err = n3iwfCtx.SendNgapEvent(context.NewNASTCPConnEstablishedCompleteEvt(n3iwfUe.RanUeNgapId)); err != nil {
+			logger.NWuCPLog.Errorf("send NASTCPConnEstablishedComplete event failed: %+v", err)
+		}
 
 		wg.Add(1)
 		go serveConn(n3iwfUe, conn, wg)
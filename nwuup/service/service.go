@@ -18,6 +18,7 @@ import (
 	"github.com/wmnsk/go-gtp/gtpv1"
 	"github.com/wmnsk/go-gtp/gtpv1/message"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
 )
 
 // Run initializes GRE and GTP-U connections and starts listeners for each.
@@ -48,6 +49,13 @@ func newGreConn(n3iwfCtx *context.N3IWFContext) error {
 		logger.NWuUPLog.Errorf("error opening GRE IPv4 packet connection socket on %s", listenAddr)
 		return fmt.Errorf("error opening GRE IPv4 packet connection socket on %s", listenAddr)
 	}
+	if n3iwfCtx.UserPlaneDSCP != 0 {
+		if err = greConn.SetTOS(util.DSCPToTOS(n3iwfCtx.UserPlaneDSCP)); err != nil {
+			_ = greConn.Close()
+			logger.NWuUPLog.Errorf("error setting the DSCP of the GRE socket: %+v", err)
+			return fmt.Errorf("error setting the DSCP of the GRE socket on %s", listenAddr)
+		}
+	}
 	n3iwfCtx.GreConn = greConn
 	return nil
 }
@@ -78,6 +86,10 @@ func greListenAndServe(n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) {
 	}()
 
 	buffer := make([]byte, context.MAX_BUF_MSG_LEN)
+	if n3iwfCtx.IPsecMode == context.IPsecModePolicy {
+		greReadPolicyBased(n3iwfCtx, buffer)
+		return
+	}
 	if err := n3iwfCtx.GreConn.SetControlMessage(ipv4.FlagInterface|ipv4.FlagTTL, true); err != nil {
 		logger.NWuUPLog.Errorf("set control message visibility for IPv4 packet connection fail: %+v", err)
 		return
@@ -93,11 +105,49 @@ func greListenAndServe(n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) {
 		// Avoid unnecessary allocation by slicing buffer
 		forwardData := buffer[:n]
 		go func(data []byte, srcAddr string, ifIndex int) {
-			handler.ForwardUL(n3iwfCtx, srcAddr, ifIndex, data)
+			handler.ForwardUL(n3iwfCtx, srcAddr, ifIndex, 0, data)
 		}(append([]byte(nil), forwardData...), src.String(), cm.IfIndex)
 	}
 }
 
+// greReadPolicyBased reads the GRE packets of policy based child SAs, whose
+// PDU session is told apart by the firewall mark set by their inbound XFRM state
+func greReadPolicyBased(n3iwfCtx *context.N3IWFContext, buffer []byte) {
+	ipConn, ok := n3iwfCtx.GreConn.PacketConn.(*net.IPConn)
+	if !ok {
+		logger.NWuUPLog.Errorf("GRE connection of type %T cannot read marks", n3iwfCtx.GreConn.PacketConn)
+		return
+	}
+	if err := util.SetReceiveMark(ipConn); err != nil {
+		logger.NWuUPLog.Errorf("receive the firewall marks of the GRE packets fail: %+v", err)
+		return
+	}
+
+	oob := make([]byte, unix.CmsgSpace(4))
+	for {
+		n, oobn, _, src, err := ipConn.ReadMsgIP(buffer, oob)
+		if err != nil {
+			logger.NWuUPLog.Errorf("error read from IPv4 packet connection: %+v", err)
+			return
+		}
+		mark, err := util.ParseMark(oob[:oobn])
+		if err != nil {
+			logger.NWuUPLog.Warnf("drop GRE packet from %s: %+v", src, err)
+			continue
+		}
+		// Raw IPv4 sockets read the IP header along with the GRE packet
+		headerLen := int(buffer[0]&0x0f) << 2
+		if n < ipv4.HeaderLen || headerLen < ipv4.HeaderLen || headerLen > n {
+			logger.NWuUPLog.Warnf("drop GRE packet from %s: invalid IPv4 header", src)
+			continue
+		}
+		logger.NWuUPLog.Debugf("read %d bytes, mark %d", n, mark)
+		go func(data []byte, srcAddr string) {
+			handler.ForwardUL(n3iwfCtx, srcAddr, 0, mark, data)
+		}(append([]byte(nil), buffer[headerLen:n]...), src.String())
+	}
+}
+
 // gtpuListenAndServe starts the GTP-U listener.
 func gtpuListenAndServe(n3iwfCtx *context.N3IWFContext, wg *sync.WaitGroup) {
 	defer util.RecoverWithLog(logger.NWuUPLog)
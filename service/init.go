@@ -15,6 +15,7 @@ import (
 	"syscall"
 	"time"
 
+	adminService "github.com/omec-project/n3iwf/admin/service"
 	n3iwfContext "github.com/omec-project/n3iwf/context"
 	"github.com/omec-project/n3iwf/factory"
 	ikeService "github.com/omec-project/n3iwf/ike/service"
@@ -30,6 +31,9 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+// Upper bound of the UE session teardown on SIGTERM
+const gracefulShutdownTimeout = 5 * time.Second
+
 // N3IWF main struct
 type N3IWF struct{}
 
@@ -93,7 +97,12 @@ func (n3iwf *N3IWF) Start() {
 		logger.InitLog.Errorln("initializing context failed")
 		return
 	}
-	if err := n3iwf.InitDefaultXfrmInterface(n3iwfCtx); err != nil {
+	if n3iwfCtx.IPsecMode == n3iwfContext.IPsecModePolicy {
+		if err := n3iwf.InitPolicyBasedIPsec(n3iwfCtx); err != nil {
+			logger.InitLog.Errorf("initiating policy based IPsec failed: %+v", err)
+			return
+		}
+	} else if err := n3iwf.InitDefaultXfrmInterface(n3iwfCtx); err != nil {
 		logger.InitLog.Errorf("initiating XFRM interface for control plane failed: %+v", err)
 		return
 	}
@@ -119,15 +128,32 @@ func (n3iwf *N3IWF) Start() {
 		return
 	}
 	logger.InitLog.Infoln("IKE service running")
+	if err := adminService.Run(n3iwfCtx, &n3iwfCtx.Wg); err != nil {
+		logger.InitLog.Errorf("start admin service failed: %+v", err)
+		return
+	}
 	logger.InitLog.Infoln("N3IWF running")
 
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
 	<-signalChannel
+	n3iwf.Shutdown(n3iwfCtx)
 	cancel()
 	n3iwf.WaitRoutineStopped(n3iwfCtx)
 }
 
+// Shutdown deletes the IKE SAs of all UEs and their XFRM states and policies
+// while the IKE server still runs, waiting at most gracefulShutdownTimeout.
+// The XFRM interfaces are removed once the services stopped
+func (n3iwf *N3IWF) Shutdown(n3iwfCtx *n3iwfContext.N3IWFContext) {
+	logger.InitLog.Infoln("deleting UE sessions")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout)
+	defer cancel()
+	if err := ikeService.Shutdown(shutdownCtx, n3iwfCtx); err != nil {
+		logger.InitLog.Warnf("graceful shutdown incomplete: %+v", err)
+	}
+}
+
 // ListenShutdownEvent waits for shutdown and stops services
 func (n3iwf *N3IWF) ListenShutdownEvent(n3iwfCtx *n3iwfContext.N3IWFContext) {
 	defer util.RecoverWithLog(logger.InitLog)
@@ -148,7 +174,8 @@ func (n3iwf *N3IWF) InitDefaultXfrmInterface(n3iwfCtx *n3iwfContext.N3IWFContext
 	ipAddr := net.ParseIP(n3iwfCtx.IpSecGatewayAddress).To4()
 	ipNet := net.IPNet{IP: ipAddr, Mask: n3iwfCtx.Subnet.Mask}
 	ifaceName := fmt.Sprintf("%s-default", n3iwfCtx.XfrmInterfaceName)
-	link, err := xfrm.SetupIPsecXfrmi(ifaceName, n3iwfCtx.XfrmParentIfaceName, n3iwfCtx.XfrmInterfaceId, ipNet)
+	link, err := xfrm.SetupIPsecXfrmi(ifaceName, n3iwfCtx.XfrmParentIfaceName, n3iwfCtx.XfrmInterfaceId, ipNet,
+		n3iwfCtx.XfrmIfaceMTU)
 	if err != nil {
 		logger.InitLog.Errorf("setup XFRM interface %s fail: %+v", ifaceName, err)
 		return err
@@ -159,13 +186,45 @@ func (n3iwf *N3IWF) InitDefaultXfrmInterface(n3iwfCtx *n3iwfContext.N3IWFContext
 	}
 	logger.InitLog.Infof("setup XFRM interface %s", ifaceName)
 	n3iwfCtx.XfrmIfaces.LoadOrStore(n3iwfCtx.XfrmInterfaceId, link)
-	n3iwfCtx.XfrmIfaceIdOffsetForUP = 1
+	n3iwfCtx.Health.Set(n3iwfContext.HealthXFRM, true)
 	return nil
 }
 
-// removeIPsecInterfaces deletes all IPsec interfaces
+// InitPolicyBasedIPsec assigns the IPsec gateway address to the parent
+// interface, in place of the default XFRM interface, so the inner traffic of
+// the UEs is routed through it and matched by the XFRM policies
+func (n3iwf *N3IWF) InitPolicyBasedIPsec(n3iwfCtx *n3iwfContext.N3IWFContext) error {
+	parent, err := netlink.LinkByName(n3iwfCtx.XfrmParentIfaceName)
+	if err != nil {
+		return fmt.Errorf("cannot find parent interface %s by name: %w", n3iwfCtx.XfrmParentIfaceName, err)
+	}
+	addr := &netlink.Addr{IPNet: policyBasedGatewayAddr(n3iwfCtx)}
+	if err = netlink.AddrAdd(parent, addr); err != nil {
+		return fmt.Errorf("add %s to interface %s: %w", addr.IPNet, n3iwfCtx.XfrmParentIfaceName, err)
+	}
+	logger.InitLog.Infof("policy based IPsec on interface %s", n3iwfCtx.XfrmParentIfaceName)
+	n3iwfCtx.Health.Set(n3iwfContext.HealthXFRM, true)
+	return nil
+}
+
+func policyBasedGatewayAddr(n3iwfCtx *n3iwfContext.N3IWFContext) *net.IPNet {
+	return &net.IPNet{IP: net.ParseIP(n3iwfCtx.IpSecGatewayAddress).To4(), Mask: n3iwfCtx.Subnet.Mask}
+}
+
+// removeIPsecInterfaces deletes all IPsec interfaces, or the IPsec gateway
+// address of the parent interface in policy mode
 func (n3iwf *N3IWF) removeIPsecInterfaces(n3iwfCtx *n3iwfContext.N3IWFContext) {
 	logger.InitLog.Infoln("deleting interfaces created by N3IWF")
+	n3iwfCtx.Health.Set(n3iwfContext.HealthXFRM, false)
+	if n3iwfCtx.IPsecMode == n3iwfContext.IPsecModePolicy {
+		parent, err := netlink.LinkByName(n3iwfCtx.XfrmParentIfaceName)
+		if err == nil {
+			err = netlink.AddrDel(parent, &netlink.Addr{IPNet: policyBasedGatewayAddr(n3iwfCtx)})
+		}
+		if err != nil {
+			logger.InitLog.Errorf("delete IPsec gateway address failed: %+v", err)
+		}
+	}
 	n3iwfCtx.XfrmIfaces.Range(func(key, value any) bool {
 		iface := value.(netlink.Link)
 		if err := netlink.LinkDel(iface); err != nil {
@@ -184,4 +243,5 @@ func (n3iwf *N3IWF) stopServiceConn(n3iwfCtx *n3iwfContext.N3IWFContext) {
 	nwucpService.Stop(n3iwfCtx)
 	nwuupService.Stop(n3iwfCtx)
 	ikeService.Stop(n3iwfCtx)
+	adminService.Stop(n3iwfCtx)
 }
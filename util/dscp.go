@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MaxDSCP is the largest Differentiated Services Code Point (RFC 2474)
+const MaxDSCP = 63
+
+// DSCPToTOS returns the IPv4 TOS octet, or IPv6 traffic class, carrying dscp
+// with the ECN bits left to 0
+func DSCPToTOS(dscp uint8) int {
+	return int(dscp) << 2
+}
+
+// SetDSCP marks the packets sent through conn with dscp, in the TOS octet of
+// IPv4 or the traffic class of IPv6. Nothing is changed when dscp is 0
+func SetDSCP(conn net.Conn, dscp uint8) error {
+	if dscp == 0 {
+		return nil
+	}
+	var localIP net.IP
+	switch addr := conn.LocalAddr().(type) {
+	case *net.UDPAddr:
+		localIP = addr.IP
+	case *net.TCPAddr:
+		localIP = addr.IP
+	}
+	var err error
+	if localIP != nil && localIP.To4() == nil {
+		err = ipv6.NewConn(conn).SetTrafficClass(DSCPToTOS(dscp))
+	} else {
+		err = ipv4.NewConn(conn).SetTOS(DSCPToTOS(dscp))
+	}
+	if err != nil {
+		return fmt.Errorf("SetDSCP: %w", err)
+	}
+	return nil
+}
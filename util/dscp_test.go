@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestSetDSCP(t *testing.T) {
+	testcases := []struct {
+		description string
+		network     string
+		address     string
+		dscp        uint8
+		expTOS      int
+	}{
+		{
+			description: "IPv4 UDP, expedited forwarding",
+			network:     "udp4",
+			address:     "127.0.0.1:0",
+			dscp:        46,
+			expTOS:      0xb8,
+		},
+		{
+			description: "IPv4 UDP, unmarked",
+			network:     "udp4",
+			address:     "127.0.0.1:0",
+		},
+		{
+			description: "IPv6 UDP, class selector 6",
+			network:     "udp6",
+			address:     "[::1]:0",
+			dscp:        48,
+			expTOS:      0xc0,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			addr, err := net.ResolveUDPAddr(tc.network, tc.address)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			conn, err := net.ListenUDP(tc.network, addr)
+			if err != nil {
+				t.Skipf("%s not available: %v", tc.network, err)
+			}
+			defer conn.Close()
+
+			if err = SetDSCP(conn, tc.dscp); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var tos int
+			if tc.network == "udp6" {
+				tos, err = ipv6.NewConn(conn).TrafficClass()
+			} else {
+				tos, err = ipv4.NewConn(conn).TOS()
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tos != tc.expTOS {
+				t.Errorf("TOS mismatch. got = %#x, want = %#x", tos, tc.expTOS)
+			}
+		})
+	}
+}
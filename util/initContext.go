@@ -6,28 +6,57 @@
 package util
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"math"
 	"net"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/ishidawataru/sctp"
 	"github.com/omec-project/n3iwf/context"
 	"github.com/omec-project/n3iwf/factory"
+	"github.com/omec-project/n3iwf/ike/message"
+	"github.com/omec-project/n3iwf/ike/security"
+	"github.com/omec-project/n3iwf/ike/security/dh"
+	"github.com/omec-project/n3iwf/ike/security/encr"
+	"github.com/omec-project/n3iwf/ike/xfrm"
 	"github.com/omec-project/n3iwf/logger"
 )
 
 const (
-	ngap_sctp_port           int    = 38412
-	requiredTacLength        int    = 6
-	requiredSdLength         int    = 6
-	defaultXfrmInterfaceId   uint32 = 7
-	defaultXfrmInterfaceName string = "ipsec"
+	ngap_sctp_port              int           = 38412
+	requiredTacLength           int           = 6
+	requiredSdLength            int           = 6
+	defaultXfrmInterfaceId      uint32        = 7
+	defaultXfrmInterfaceName    string        = "ipsec"
+	defaultXfrmInterfaceIdCount uint32        = 4096
+	defaultNgapEventTimeout     time.Duration = 5 * time.Second
+	defaultHalfOpenSATimeout    time.Duration = 60 * time.Second
+	defaultEAPRoundTimeout      time.Duration = 30 * time.Second
+	defaultRevocationCacheTTL   time.Duration = time.Hour
+	defaultRevocationTimeout    time.Duration = 5 * time.Second
+	defaultInitialUEQueueSize   int           = 1024
+	defaultIKESendQueueSize     int           = 1024
+	defaultCookieSecretRotation time.Duration = 5 * time.Minute
+	defaultCookieGracePeriod    time.Duration = 30 * time.Second
+	defaultChildSAKeyLength     uint16        = 256
+	defaultESPReplayWindow      uint32        = 32
+	minIKEMaxMessageSize        int           = 1280 // RFC 7296 section 2
+	minEAP5GFragmentSize        int           = 256
+	defaultBaseMTU              int           = 1500
+	defaultTrafficStatsPeriod   time.Duration = 10 * time.Second
+	defaultChildSARetransmit    time.Duration = time.Second
+	defaultChildSAMaxRetries    int           = 5
 )
 
 func InitN3IWFContext() bool {
@@ -81,43 +110,33 @@ func InitN3IWFContext() bool {
 	localSCTPAddr.Port = ngap_sctp_port
 	n.LocalSctpAddress = localSCTPAddr
 
-	// IKE bind address
-	if !checkEmpty(n3iwfCfg.IkeBindAddress, "IKE bind address is empty") {
+	// Bind addresses and ports, the handlers rely on them being valid
+	if err = validateNetworkConfig(n3iwfCfg); err != nil {
+		logger.CtxLog.Errorf("invalid configuration: %+v", err)
 		return false
 	}
 	n.IkeBindAddress = n3iwfCfg.IkeBindAddress
 
-	// IPSec gateway address
-	if !checkEmpty(n3iwfCfg.IpSecAddress, "IPSec interface address is empty") {
-		return false
-	}
-	n3iwfIpAddr, _, err := net.ParseCIDR(n3iwfCfg.IpSecAddress)
+	// IPSec gateway address and UE IP address range
+	n3iwfIpAddr, ueNetworkAddr, err := net.ParseCIDR(n3iwfCfg.IpSecAddress)
 	if err != nil {
 		logger.CtxLog.Errorf("parse IpSecAddress failed: %+v", err)
 		return false
 	}
 	n.IpSecGatewayAddress = n3iwfIpAddr.String()
-
-	// UE IP address range
-	_, ueNetworkAddr, err := net.ParseCIDR(n3iwfCfg.IpSecAddress)
-	if err != nil {
-		logger.CtxLog.Errorf("parse CIDR failed: %+v", err)
-		return false
-	}
 	n.Subnet = ueNetworkAddr
 
-	// GTP bind address
-	if !checkEmpty(n3iwfCfg.GtpBindAddress, "GTP bind address is empty") {
-		return false
-	}
 	n.GtpBindAddress = n3iwfCfg.GtpBindAddress
+	n.TcpPort = n3iwfCfg.TcpPort
 
-	// TCP port
-	if n3iwfCfg.TcpPort == 0 {
-		logger.CtxLog.Errorln("TCP port is not defined")
-		return false
+	// Admin endpoint
+	if n3iwfCfg.AdminAddress != "" {
+		if _, _, err := net.SplitHostPort(n3iwfCfg.AdminAddress); err != nil {
+			logger.CtxLog.Errorf("invalid admin address: %+v", err)
+			return false
+		}
+		n.AdminBindAddress = n3iwfCfg.AdminAddress
 	}
-	n.TcpPort = n3iwfCfg.TcpPort
 
 	// FQDN
 	if !checkEmpty(n3iwfCfg.Fqdn, "FQDN is empty") {
@@ -129,41 +148,21 @@ func InitN3IWFContext() bool {
 	if !checkEmpty(n3iwfCfg.PrivateKey, "no private key file path specified") {
 		return false
 	}
-	content, ok := readFile(n3iwfCfg.PrivateKey, "cannot read private key data from file")
-	if !ok {
-		return false
-	}
-	block, _ := pem.Decode(content)
-	if block == nil {
-		logger.CtxLog.Errorln("parse pem failed")
-		return false
-	}
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		logger.CtxLog.Warnf("parse PKCS8 private key failed: %+v", err)
-		logger.CtxLog.Infoln("parse using PKCS1")
-		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			logger.CtxLog.Errorf("parse PKCS1 private key failed: %+v", err)
-			return false
-		}
-	}
-	rsaKey, ok := key.(*rsa.PrivateKey)
+	signer, ok := loadPrivateKey(n3iwfCfg.PrivateKey)
 	if !ok {
-		logger.CtxLog.Errorln("private key is not an rsa private key")
 		return false
 	}
-	n.N3iwfPrivateKey = rsaKey
+	n.N3iwfPrivateKey = signer
 
 	// Certificate authority
 	if !checkEmpty(n3iwfCfg.CertificateAuthority, "no certificate authority file path specified") {
 		return false
 	}
-	content, ok = readFile(n3iwfCfg.CertificateAuthority, "cannot read certificate authority data from file")
+	content, ok := readFile(n3iwfCfg.CertificateAuthority, "cannot read certificate authority data from file")
 	if !ok {
 		return false
 	}
-	block, _ = pem.Decode(content)
+	block, _ := pem.Decode(content)
 	if block == nil {
 		logger.CtxLog.Errorln("parse pem failed")
 		return false
@@ -180,20 +179,90 @@ func InitN3IWFContext() bool {
 	}
 	n.CertificateAuthority = sha1Hash.Sum(nil)
 
+	// UE certificate revocation
+	revocationCfg := n3iwfCfg.RevocationCheck
+	if revocationCfg.CacheTtl < 0 || revocationCfg.Timeout < 0 {
+		logger.CtxLog.Errorln("revocationCheck cacheTtl and timeout must not be negative")
+		return false
+	}
+	for _, rawURL := range append(append([]string{}, revocationCfg.CrlDistributionPoints...), revocationCfg.OcspResponders...) {
+		if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			logger.CtxLog.Errorf("invalid revocation source URL: %s", rawURL)
+			return false
+		}
+	}
+	cacheTTL := revocationCfg.CacheTtl
+	if cacheTTL == 0 {
+		cacheTTL = defaultRevocationCacheTTL
+	}
+	timeout := revocationCfg.Timeout
+	if timeout == 0 {
+		timeout = defaultRevocationTimeout
+	}
+	n.RevocationChecker = security.NewRevocationChecker(cert, revocationCfg.CrlDistributionPoints,
+		revocationCfg.OcspResponders, cacheTTL, timeout, revocationCfg.SoftFail)
+
 	// Certificate
 	if !checkEmpty(n3iwfCfg.Certificate, "no certificate file path specified") {
 		return false
 	}
-	content, ok = readFile(n3iwfCfg.Certificate, "cannot read certificate data from file")
+	n.N3iwfCertificate, ok = loadCertificate(n3iwfCfg.Certificate)
 	if !ok {
 		return false
 	}
-	block, _ = pem.Decode(content)
-	if block == nil {
-		logger.CtxLog.Errorln("parse pem failed")
+
+	// Responder identity
+	n.ResponderIDType, n.ResponderIDData, err = context.ParseResponderID(n3iwfCfg.ResponderId.Type,
+		n3iwfCfg.ResponderId.Value, n.Fqdn, n.N3iwfCertificate)
+	if err != nil {
+		logger.CtxLog.Errorf("invalid responder identity: %+v", err)
+		return false
+	}
+	for _, identityCfg := range n3iwfCfg.ResponderIdentities {
+		identity, ok := loadResponderIdentity(identityCfg)
+		if !ok {
+			return false
+		}
+		n.ResponderIdentities = append(n.ResponderIdentities, identity)
+	}
+
+	// ESP cipher of PDU session child SAs
+	if n3iwfCfg.ChildSaEncryption.Algorithm != "" {
+		n.ChildSAEncryption, ok = parseChildSAEncryption(n3iwfCfg.ChildSaEncryption)
+		if !ok {
+			return false
+		}
+	}
+
+	// Transforms accepted from UEs
+	if n.IKETransformPolicy, err = parseTransformPolicy(n3iwfCfg.AlgorithmPolicy.Ike, nil); err != nil {
+		logger.CtxLog.Errorf("invalid IKE algorithm policy: %+v", err)
+		return false
+	}
+	if n.ESPTransformPolicy, err = parseTransformPolicy(n3iwfCfg.AlgorithmPolicy.Esp,
+		context.DefaultESPTransforms()); err != nil {
+		logger.CtxLog.Errorf("invalid ESP algorithm policy: %+v", err)
+		return false
+	}
+	if n.ChildSAEncryption != nil {
+		transform, err := encr.ToTransformChildSA(n.ChildSAEncryption)
+		if err != nil || !n.ESPSupported(transform) {
+			logger.CtxLog.Errorf("child SA encryption %s is not allowed by the ESP algorithm policy",
+				n3iwfCfg.ChildSaEncryption.Algorithm)
+			return false
+		}
+	}
+
+	// Transform selection in UE proposals
+	switch strings.ToLower(n3iwfCfg.ProposalSelection) {
+	case "", "strongest":
+		n.ProposalPeerOrder = false
+	case "peerorder":
+		n.ProposalPeerOrder = true
+	default:
+		logger.CtxLog.Errorf("unsupported proposal selection: %s", n3iwfCfg.ProposalSelection)
 		return false
 	}
-	n.N3iwfCertificate = block.Bytes
 
 	// XFRM related
 	ikeBindIfaceName, err := getInterfaceName(n3iwfCfg.IkeBindAddress)
@@ -215,9 +284,333 @@ func InitN3IWFContext() bool {
 		logger.CtxLog.Warnln("XFRM interface id is not defined, set to default value", n.XfrmInterfaceId)
 	}
 
+	firstXfrmIfaceId, lastXfrmIfaceId, err := xfrmInterfaceIds(n.XfrmInterfaceName, n.XfrmInterfaceId,
+		n3iwfCfg.XfrmInterfaceIdRange, defaultXfrmInterfaceIdCount)
+	if err != nil {
+		logger.CtxLog.Errorln(err)
+		return false
+	}
+	if n.XfrmIfaceIds, err = context.NewXfrmIfaceIds(firstXfrmIfaceId, lastXfrmIfaceId); err != nil {
+		logger.CtxLog.Errorln(err)
+		return false
+	}
+
+	switch strings.ToLower(n3iwfCfg.IpsecMode) {
+	case "", "xfrmi":
+		n.IPsecMode = context.IPsecModeInterface
+	case "policy":
+		n.IPsecMode = context.IPsecModePolicy
+	default:
+		logger.CtxLog.Errorf("unsupported IPsec mode: %s", n3iwfCfg.IpsecMode)
+		return false
+	}
+
+	baseMTU := n3iwfCfg.UserPlaneMtu.BaseMtu
+	if baseMTU == 0 {
+		baseMTU = defaultBaseMTU
+	}
+	ikeBindIP := net.ParseIP(n3iwfCfg.IkeBindAddress)
+	n.XfrmIfaceMTU, err = xfrm.InterfaceMTU(baseMTU, ikeBindIP != nil && ikeBindIP.To4() == nil)
+	if err != nil {
+		logger.CtxLog.Errorf("invalid userPlaneMtu: %+v", err)
+		return false
+	}
+	n.ClampTCPMSS = n3iwfCfg.UserPlaneMtu.ClampTcpMss
+
+	// NGAP event queue
+	n.NgapEventTimeout = n3iwfCfg.NgapEventTimeout
+	if n.NgapEventTimeout <= 0 {
+		n.NgapEventTimeout = defaultNgapEventTimeout
+	}
+
+	n.AllowTransportMode = n3iwfCfg.AllowTransportMode
+	n.ChildSAPFSRequired = n3iwfCfg.RequireChildSaPfs
+	n.CPChildSANASPortOnly = n3iwfCfg.CpSaNasPortOnly
+	n.ReturnRoutabilityCheck = n3iwfCfg.ReturnRoutability
+
+	// ESP anti-replay window
+	if !n3iwfCfg.EspReplayWindow.Disable {
+		n.ESPReplayWindow = n3iwfCfg.EspReplayWindow.Size
+		if n.ESPReplayWindow == 0 {
+			n.ESPReplayWindow = defaultESPReplayWindow
+		}
+		if err = xfrm.ValidateReplayWindow(n.ESPReplayWindow); err != nil {
+			logger.CtxLog.Errorf("invalid espReplayWindow: %+v", err)
+			return false
+		}
+	} else {
+		// The kernel refuses the ESN states without replay window
+		esnEnable := &message.Transform{
+			TransformType: message.TypeExtendedSequenceNumbers,
+			TransformID:   message.ESN_ENABLE,
+		}
+		if n.ESPSupported(esnEnable) {
+			logger.CtxLog.Errorln("espReplayWindow cannot be disabled while the ESP algorithm policy allows ESN")
+			return false
+		}
+		logger.CtxLog.Warnln("ESP replay protection is disabled")
+	}
+
+	// Child SA lifetime
+	n.ChildSALifetime = context.ChildSALifetime{
+		SoftTime:  n3iwfCfg.ChildSaLifetime.SoftTime,
+		HardTime:  n3iwfCfg.ChildSaLifetime.HardTime,
+		SoftBytes: n3iwfCfg.ChildSaLifetime.SoftBytes,
+		HardBytes: n3iwfCfg.ChildSaLifetime.HardBytes,
+	}
+	if err = xfrm.ValidateLifetime(n.ChildSALifetime); err != nil {
+		logger.CtxLog.Errorf("invalid childSaLifetime: %+v", err)
+		return false
+	}
+
+	n.EnableMOBIKE = n3iwfCfg.Mobike
+	if n3iwfCfg.VendorId != "" {
+		if n.VendorID, err = hex.DecodeString(n3iwfCfg.VendorId); err != nil || len(n.VendorID) == 0 {
+			logger.CtxLog.Errorf("invalid vendorId: %s", n3iwfCfg.VendorId)
+			return false
+		}
+	}
+	n.EmptyChildSADeleteResponse = n3iwfCfg.EmptyChildSaDelete
+	if n3iwfCfg.IkeTrace {
+		n.IKETracer = context.LogIKETracer{}
+	}
+	if n3iwfCfg.IkeCapture != "" {
+		if n.IKECapture, err = context.NewIKECapture(n3iwfCfg.IkeCapture); err != nil {
+			logger.CtxLog.Errorf("open IKE capture failed: %+v", err)
+			return false
+		}
+		logger.CtxLog.Infof("capturing IKE datagrams to %s", n3iwfCfg.IkeCapture)
+	}
+	if n3iwfCfg.IkeFailureTranscript < 0 {
+		logger.CtxLog.Errorln("ikeFailureTranscript must not be negative")
+		return false
+	}
+	n.IKETranscriptSize = n3iwfCfg.IkeFailureTranscript
+	if n3iwfCfg.AuditLog != "" {
+		auditSink, err := context.NewFileAuditSink(n3iwfCfg.AuditLog)
+		if err != nil {
+			logger.CtxLog.Errorf("open audit log failed: %+v", err)
+			return false
+		}
+		n.AuditSink = auditSink
+		logger.CtxLog.Infof("auditing SAs to %s", n3iwfCfg.AuditLog)
+	}
+
+	// Half-open IKE SA reaping
+	if n3iwfCfg.HalfOpenSaTimeout < 0 {
+		logger.CtxLog.Errorln("halfOpenSaTimeout must not be negative")
+		return false
+	}
+	n.HalfOpenSATimeout = n3iwfCfg.HalfOpenSaTimeout
+	if n.HalfOpenSATimeout == 0 {
+		n.HalfOpenSATimeout = defaultHalfOpenSATimeout
+	}
+
+	// Stalled EAP-5G rounds
+	if n3iwfCfg.EapRoundTimeout < 0 {
+		logger.CtxLog.Errorln("eapRoundTimeout must not be negative")
+		return false
+	}
+	n.EAPRoundTimeout = n3iwfCfg.EapRoundTimeout
+	if n.EAPRoundTimeout == 0 {
+		n.EAPRoundTimeout = defaultEAPRoundTimeout
+	}
+
+	// NAT-T keepalives
+	if n3iwfCfg.NatKeepalive < 0 {
+		logger.CtxLog.Errorln("natKeepalive must not be negative")
+		return false
+	}
+	n.NATKeepaliveInterval = n3iwfCfg.NatKeepalive
+
+	// IKE message size
+	if n3iwfCfg.IkeMaxMessageSize != 0 && (n3iwfCfg.IkeMaxMessageSize < minIKEMaxMessageSize ||
+		n3iwfCfg.IkeMaxMessageSize > message.IKE_MAX_MESSAGE_LEN) {
+		logger.CtxLog.Errorf("ikeMaxMessageSize must be between %d and %d", minIKEMaxMessageSize,
+			message.IKE_MAX_MESSAGE_LEN)
+		return false
+	}
+	n.IKEMaxMessageSize = n3iwfCfg.IkeMaxMessageSize
+	if n.IKEMaxMessageSize == 0 {
+		n.IKEMaxMessageSize = message.IKE_MAX_MESSAGE_LEN
+	}
+
+	// EAP-5G fragmentation
+	if n3iwfCfg.Eap5gFragmentSize != 0 && (n3iwfCfg.Eap5gFragmentSize < minEAP5GFragmentSize ||
+		n3iwfCfg.Eap5gFragmentSize > math.MaxUint16) {
+		logger.CtxLog.Errorf("eap5gFragmentSize must be between %d and %d", minEAP5GFragmentSize, math.MaxUint16)
+		return false
+	}
+	n.EAP5GFragmentSize = n3iwfCfg.Eap5gFragmentSize
+	if n.EAP5GFragmentSize > 0 {
+		logger.CtxLog.Warnf("5G-NAS messages of more than %d bytes are fragmented, UEs must support it",
+			n.EAP5GFragmentSize)
+	}
+
+	// DSCP marking
+	if n3iwfCfg.Dscp.ControlPlane > MaxDSCP || n3iwfCfg.Dscp.UserPlane > MaxDSCP {
+		logger.CtxLog.Errorf("dscp values must be between 0 and %d", MaxDSCP)
+		return false
+	}
+	n.ControlPlaneDSCP = n3iwfCfg.Dscp.ControlPlane
+	n.UserPlaneDSCP = n3iwfCfg.Dscp.UserPlane
+
+	// Child SA traffic counters
+	if n3iwfCfg.TrafficStatsInterval < 0 {
+		logger.CtxLog.Errorln("trafficStatsInterval must not be negative")
+		return false
+	}
+	n.TrafficStatsInterval = n3iwfCfg.TrafficStatsInterval
+	if n.TrafficStatsInterval == 0 {
+		n.TrafficStatsInterval = defaultTrafficStatsPeriod
+	}
+
+	// CREATE_CHILD_SA retransmission
+	if n3iwfCfg.ChildSaRetransmit.Interval < 0 || n3iwfCfg.ChildSaRetransmit.MaxRetries < 0 {
+		logger.CtxLog.Errorln("childSaRetransmit interval and maxRetries must not be negative")
+		return false
+	}
+	n.ChildSARetransmitInterval = n3iwfCfg.ChildSaRetransmit.Interval
+	if n.ChildSARetransmitInterval == 0 {
+		n.ChildSARetransmitInterval = defaultChildSARetransmit
+	}
+	n.ChildSAMaxRetransmissions = n3iwfCfg.ChildSaRetransmit.MaxRetries
+	if n.ChildSAMaxRetransmissions == 0 {
+		n.ChildSAMaxRetransmissions = defaultChildSAMaxRetries
+	}
+	n.DPDMaxRetryTimes = n3iwfCfg.LivenessCheck.MaxRetryTimes
+
+	// IKE SA redirection
+	if n3iwfCfg.Redirect.Enable {
+		if n3iwfCfg.Redirect.MaxIkeSa <= 0 || len(n3iwfCfg.Redirect.Gateways) == 0 {
+			logger.CtxLog.Errorln("redirect is enabled but maxIkeSa or gateways is not configured")
+			return false
+		}
+		n.RedirectThreshold = n3iwfCfg.Redirect.MaxIkeSa
+		n.RedirectSelector = &context.RoundRobinRedirectSelector{Gateways: n3iwfCfg.Redirect.Gateways}
+	}
+
+	// IKE SA cap
+	if n3iwfCfg.MaxIkeSa < 0 {
+		logger.CtxLog.Errorln("maxIkeSa must not be negative")
+		return false
+	}
+	n.MaxIKESAs = n3iwfCfg.MaxIkeSa
+
+	// IKE_SA_INIT backlog of the IKE event loop
+	if n3iwfCfg.MaxPendingIkeSaInit < 0 {
+		logger.CtxLog.Errorln("maxPendingIkeSaInit must not be negative")
+		return false
+	}
+	n.MaxPendingIKESAInits = n3iwfCfg.MaxPendingIkeSaInit
+
+	// IKE_SA_INIT Diffie-Hellman group preference
+	if group := n3iwfCfg.DhGroupPreference.Group; group != 0 {
+		transform := &message.Transform{TransformType: message.TypeDiffieHellmanGroup, TransformID: group}
+		if dh.DecodeTransform(transform) == nil || !n.IKETransformPolicy.Allows(transform) {
+			logger.CtxLog.Errorf("dhGroupPreference group %d is not supported or not allowed", group)
+			return false
+		}
+		n.PreferredDHGroup = group
+	}
+
+	// IKE_SA_INIT rate limit
+	if n3iwfCfg.IkeSaInitRateLimit.Rate < 0 || n3iwfCfg.IkeSaInitRateLimit.Burst < 0 {
+		logger.CtxLog.Errorln("ikeSaInitRateLimit rate and burst must not be negative")
+		return false
+	}
+	n.IKESAInitLimiter = context.NewInitRateLimiter(n3iwfCfg.IkeSaInitRateLimit.Rate, n3iwfCfg.IkeSaInitRateLimit.Burst)
+
+	// IKE_SA_INIT cookies
+	if n3iwfCfg.Cookie.Threshold < 0 || n3iwfCfg.Cookie.SecretRotation < 0 || n3iwfCfg.Cookie.GracePeriod < 0 {
+		logger.CtxLog.Errorln("cookie threshold, secretRotation and gracePeriod must not be negative")
+		return false
+	}
+	if n3iwfCfg.Cookie.Threshold > 0 {
+		secretRotation := n3iwfCfg.Cookie.SecretRotation
+		if secretRotation == 0 {
+			secretRotation = defaultCookieSecretRotation
+		}
+		gracePeriod := n3iwfCfg.Cookie.GracePeriod
+		if gracePeriod == 0 {
+			gracePeriod = defaultCookieGracePeriod
+		}
+		cookieSecrets, err := context.NewCookieSecrets(secretRotation, gracePeriod)
+		if err != nil {
+			logger.CtxLog.Errorf("cookie: %+v", err)
+			return false
+		}
+		n.CookieSecrets = cookieSecrets
+		n.CookieThreshold = int64(n3iwfCfg.Cookie.Threshold)
+	}
+
+	// InitialUEMessage pacing
+	if n3iwfCfg.InitialUeRateLimit.Rate < 0 || n3iwfCfg.InitialUeRateLimit.Burst < 0 || n3iwfCfg.InitialUeQueueSize < 0 {
+		logger.CtxLog.Errorln("initialUeRateLimit and initialUeQueueSize must not be negative")
+		return false
+	}
+	initialUeQueueSize := n3iwfCfg.InitialUeQueueSize
+	if initialUeQueueSize == 0 {
+		initialUeQueueSize = defaultInitialUEQueueSize
+	}
+	n.InitialUEPacer = context.NewInitialUEPacer(n3iwfCfg.InitialUeRateLimit.Rate,
+		n3iwfCfg.InitialUeRateLimit.Burst, initialUeQueueSize)
+
+	// IKE send pacing
+	if n3iwfCfg.IkeSendRateLimit.Rate < 0 || n3iwfCfg.IkeSendRateLimit.Burst < 0 || n3iwfCfg.IkeSendQueueSize < 0 {
+		logger.CtxLog.Errorln("ikeSendRateLimit and ikeSendQueueSize must not be negative")
+		return false
+	}
+	n.IKESendRate = n3iwfCfg.IkeSendRateLimit.Rate
+	n.IKESendBurst = n3iwfCfg.IkeSendRateLimit.Burst
+	n.IKESendQueueSize = n3iwfCfg.IkeSendQueueSize
+	if n.IKESendQueueSize == 0 {
+		n.IKESendQueueSize = defaultIKESendQueueSize
+	}
+
+	// Configuration payload attributes
+	if n3iwfCfg.MaxCfgAttributes < 0 {
+		logger.CtxLog.Errorln("maxConfigurationAttributes must not be negative")
+		return false
+	}
+	message.SetMaxConfigurationAttributes(n3iwfCfg.MaxCfgAttributes)
+	if n.DNSServers, ok = parseIPv4Servers(n3iwfCfg.ConfigurationReply.DnsServers, "DNS"); !ok {
+		return false
+	}
+	n.AlwaysSendDNS = n3iwfCfg.ConfigurationReply.AlwaysSendDns
+	for _, subnet := range n3iwfCfg.ConfigurationReply.Subnets {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil || ipNet.IP.To4() == nil {
+			logger.CtxLog.Errorf("invalid IPv4 split tunnel subnet: %s", subnet)
+			return false
+		}
+		n.SplitTunnelSubnets = append(n.SplitTunnelSubnets, ipNet)
+	}
+	if n.NBNSServers, ok = parseIPv4Servers(n3iwfCfg.ConfigurationReply.NbnsServers, "NBNS"); !ok {
+		return false
+	}
+	if n.DHCPServers, ok = parseIPv4Servers(n3iwfCfg.ConfigurationReply.DhcpServers, "DHCP"); !ok {
+		return false
+	}
+	n.ApplicationVersion = n3iwfCfg.ConfigurationReply.ApplicationVersion
+
 	return true
 }
 
+// Helper to parse the IPv4 addresses of the servers of a configuration reply attribute
+func parseIPv4Servers(servers []string, kind string) ([]net.IP, bool) {
+	var ips []net.IP
+	for _, server := range servers {
+		ip := net.ParseIP(server).To4()
+		if ip == nil {
+			logger.CtxLog.Errorf("invalid IPv4 %s server: %s", kind, server)
+			return nil, false
+		}
+		ips = append(ips, ip)
+	}
+	return ips, true
+}
+
 // Helper to check empty string config
 func checkEmpty(val, msg string) bool {
 	if val == "" {
@@ -237,6 +630,125 @@ func readFile(path, errMsg string) ([]byte, bool) {
 	return content, true
 }
 
+// Helper to load a PEM encoded private key
+func loadPrivateKey(path string) (crypto.Signer, bool) {
+	content, ok := readFile(path, "cannot read private key data from file")
+	if !ok {
+		return nil, false
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		logger.CtxLog.Errorln("parse pem failed")
+		return nil, false
+	}
+	signer, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		logger.CtxLog.Errorf("parse private key failed: %+v", err)
+		return nil, false
+	}
+	return signer, true
+}
+
+// Helper to load a PEM encoded certificate, returned in DER
+func loadCertificate(path string) ([]byte, bool) {
+	content, ok := readFile(path, "cannot read certificate data from file")
+	if !ok {
+		return nil, false
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		logger.CtxLog.Errorln("parse pem failed")
+		return nil, false
+	}
+	return block.Bytes, true
+}
+
+// Helper to load an additional responder identity with its certificate and key
+func loadResponderIdentity(identityCfg factory.ResponderIdentity) (*context.ResponderIdentity, bool) {
+	if !checkEmpty(identityCfg.PrivateKey, "no private key file path specified for responder identity") ||
+		!checkEmpty(identityCfg.Certificate, "no certificate file path specified for responder identity") {
+		return nil, false
+	}
+	signer, ok := loadPrivateKey(identityCfg.PrivateKey)
+	if !ok {
+		return nil, false
+	}
+	certificate, ok := loadCertificate(identityCfg.Certificate)
+	if !ok {
+		return nil, false
+	}
+	// No FQDN fallback: an extra identity must name what the UE asks for
+	idType, idData, err := context.ParseResponderID(identityCfg.Type, identityCfg.Value, "", certificate)
+	if err != nil {
+		logger.CtxLog.Errorf("invalid responder identity: %+v", err)
+		return nil, false
+	}
+	return &context.ResponderIdentity{
+		IDType:      idType,
+		IDData:      idData,
+		Certificate: certificate,
+		PrivateKey:  signer,
+	}, true
+}
+
+// ESP ciphers accepted in childSaEncryption
+var childSAEncryptionAlgorithms = map[string]uint16{
+	"aes-cbc":    message.ENCR_AES_CBC,
+	"aes-ctr":    message.ENCR_AES_CTR,
+	"aes-gcm-16": message.ENCR_AES_GCM_16,
+}
+
+// Helper to parse the ESP cipher proposed for PDU session child SAs
+func parseChildSAEncryption(encryptionCfg factory.ChildSaEncryption) (encr.ENCRKType, bool) {
+	transformID, ok := childSAEncryptionAlgorithms[strings.ToLower(encryptionCfg.Algorithm)]
+	if !ok {
+		logger.CtxLog.Errorf("unsupported child SA encryption algorithm: %s", encryptionCfg.Algorithm)
+		return nil, false
+	}
+	keyLength := encryptionCfg.KeyLength
+	if keyLength == 0 {
+		keyLength = defaultChildSAKeyLength
+	}
+	encrKType := encr.DecodeTransformChildSA(&message.Transform{
+		TransformType:    message.TypeEncryptionAlgorithm,
+		TransformID:      transformID,
+		AttributePresent: true,
+		AttributeFormat:  message.AttributeFormatUseTV,
+		AttributeType:    message.AttributeTypeKeyLength,
+		AttributeValue:   keyLength,
+	})
+	if encrKType == nil {
+		logger.CtxLog.Errorf("unsupported child SA encryption key length: %d", keyLength)
+		return nil, false
+	}
+	return encrKType, true
+}
+
+// Helper to parse a PKCS8, PKCS1 or SEC1 encoded private key usable for AUTH signing
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		logger.CtxLog.Warnf("parse PKCS8 private key failed: %+v", err)
+		logger.CtxLog.Infoln("parse using PKCS1")
+		if rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(der); rsaErr == nil {
+			return rsaKey, nil
+		}
+		logger.CtxLog.Infoln("parse using SEC1")
+		ecKey, ecErr := x509.ParseECPrivateKey(der)
+		if ecErr != nil {
+			return nil, fmt.Errorf("private key is neither PKCS8, PKCS1 nor SEC1 encoded: %w", ecErr)
+		}
+		return ecKey, nil
+	}
+
+	switch signer := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return signer.(crypto.Signer), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
 func formatSupportedTAList(info *context.N3iwfNfInfo) bool {
 	for taListIndex := range info.SupportedTaList {
 		supportedTAItem := &info.SupportedTaList[taListIndex]
@@ -304,11 +816,11 @@ func getInterfaceName(IPAddress string) (interfaceName string, err error) {
 		return "", err
 	}
 
-	res, err := net.ResolveIPAddr("ip4", IPAddress)
+	// The IKE bind address may be IPv4 or IPv6
+	res, err := net.ResolveIPAddr("ip", IPAddress)
 	if err != nil {
 		return "", fmt.Errorf("error resolving address '%s': %v", IPAddress, err)
 	}
-	IPAddress = res.String()
 
 	for _, inter := range interfaces {
 		addrs, err := inter.Addrs()
@@ -316,7 +828,7 @@ func getInterfaceName(IPAddress string) (interfaceName string, err error) {
 			return "", err
 		}
 		for _, addr := range addrs {
-			if IPAddress == addr.String()[0:strings.Index(addr.String(), "/")] {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(res.IP) {
 				return inter.Name, nil
 			}
 		}
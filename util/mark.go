@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// MarkControlMessage returns the control message giving a packet sent with
+// sendmsg the firewall mark mark, whatever the mark of the socket
+func MarkControlMessage(mark uint32) []byte {
+	oob := make([]byte, unix.CmsgSpace(4))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0])) // #nosec G103
+	header.Level = unix.SOL_SOCKET
+	header.Type = unix.SO_MARK
+	header.SetLen(unix.CmsgLen(4))
+	binary.NativeEndian.PutUint32(oob[unix.CmsgLen(0):], mark)
+	return oob
+}
+
+// ParseMark returns the firewall mark of a received packet from its control
+// messages, 0 when they carry none, see SetReceiveMark
+func ParseMark(oob []byte) (uint32, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, fmt.Errorf("ParseMark: %w", err)
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SO_MARK && len(msg.Data) >= 4 {
+			return binary.NativeEndian.Uint32(msg.Data), nil
+		}
+	}
+	return 0, nil
+}
+
+// SetReceiveMark passes the firewall mark of the packets received on conn in
+// their control messages. It needs Linux 5.19 or later
+func SetReceiveMark(conn syscall.Conn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("SetReceiveMark: %w", err)
+	}
+	var sockErr error
+	if err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVMARK, 1)
+	}); err != nil {
+		return fmt.Errorf("SetReceiveMark: %w", err)
+	}
+	if sockErr != nil {
+		return fmt.Errorf("SetReceiveMark: %w", sockErr)
+	}
+	return nil
+}
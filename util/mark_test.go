@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMark(t *testing.T) {
+	testcases := []struct {
+		description string
+		oob         []byte
+		expMark     uint32
+	}{
+		{
+			description: "no control message",
+		},
+		{
+			description: "marked packet",
+			oob:         MarkControlMessage(15),
+			expMark:     15,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			mark, err := ParseMark(tc.oob)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if mark != tc.expMark {
+				t.Errorf("mark mismatch. got = %d, want = %d", mark, tc.expMark)
+			}
+		})
+	}
+
+	// Truncated mark
+	if _, err := ParseMark(MarkControlMessage(15)[:unix.CmsgLen(2)]); err == nil {
+		t.Errorf("Expected error but got none")
+	}
+}
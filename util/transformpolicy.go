@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/factory"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+// Transform types accepted in algorithm policy rules
+var transformTypes = map[string]uint8{
+	"encr":  message.TypeEncryptionAlgorithm,
+	"prf":   message.TypePseudorandomFunction,
+	"integ": message.TypeIntegrityAlgorithm,
+	"dh":    message.TypeDiffieHellmanGroup,
+	"esn":   message.TypeExtendedSequenceNumbers,
+}
+
+// parseTransformPolicy builds the transform policy of rules. The allowlist
+// replaces defaultAllow, nil meaning any transform, when set
+func parseTransformPolicy(rules factory.AlgorithmRules, defaultAllow context.TransformSet) (context.TransformPolicy, error) {
+	policy := context.TransformPolicy{Allow: defaultAllow}
+	if len(rules.Allow) > 0 {
+		allow, err := parseTransformSet(rules.Allow)
+		if err != nil {
+			return policy, fmt.Errorf("allow: %w", err)
+		}
+		policy.Allow = allow
+	}
+	block, err := parseTransformSet(rules.Block)
+	if err != nil {
+		return policy, fmt.Errorf("block: %w", err)
+	}
+	policy.Block = block
+	return policy, nil
+}
+
+func parseTransformSet(rules []factory.AlgorithmRule) (context.TransformSet, error) {
+	set := make(context.TransformSet)
+	for _, rule := range rules {
+		transformType, ok := transformTypes[strings.ToLower(rule.Type)]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform type %q, expected encr, prf, integ, dh or esn", rule.Type)
+		}
+		for _, keyLength := range rule.KeyLengths {
+			if keyLength == 0 || keyLength%8 != 0 {
+				return nil, fmt.Errorf("%s transform %d: invalid key length %d", rule.Type, rule.Id, keyLength)
+			}
+		}
+		set.Add(transformType, rule.Id, rule.KeyLengths...)
+	}
+	return set, nil
+}
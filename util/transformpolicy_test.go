@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"testing"
+
+	"github.com/omec-project/n3iwf/context"
+	"github.com/omec-project/n3iwf/factory"
+	"github.com/omec-project/n3iwf/ike/message"
+)
+
+func TestParseTransformPolicy(t *testing.T) {
+	aesCBC128 := &message.Transform{
+		TransformType:    message.TypeEncryptionAlgorithm,
+		TransformID:      message.ENCR_AES_CBC,
+		AttributePresent: true,
+		AttributeType:    message.AttributeTypeKeyLength,
+		AttributeValue:   128,
+	}
+	dh1024 := &message.Transform{TransformType: message.TypeDiffieHellmanGroup, TransformID: message.DH_1024_BIT_MODP}
+
+	testcases := []struct {
+		description  string
+		rules        factory.AlgorithmRules
+		defaultAllow context.TransformSet
+		expAllowed   []*message.Transform
+		expRefused   []*message.Transform
+		expErr       bool
+	}{
+		{
+			description:  "default ESP transforms",
+			defaultAllow: context.DefaultESPTransforms(),
+			expAllowed:   []*message.Transform{aesCBC128},
+			expRefused:   []*message.Transform{dh1024},
+		},
+		{
+			description: "blocklist",
+			rules: factory.AlgorithmRules{
+				Block: []factory.AlgorithmRule{{Type: "dh", Id: message.DH_1024_BIT_MODP}},
+			},
+			expAllowed: []*message.Transform{aesCBC128},
+			expRefused: []*message.Transform{dh1024},
+		},
+		{
+			description: "allowlist replacing the default",
+			rules: factory.AlgorithmRules{
+				Allow: []factory.AlgorithmRule{{Type: "ENCR", Id: message.ENCR_AES_CBC, KeyLengths: []uint16{256}}},
+			},
+			defaultAllow: context.DefaultESPTransforms(),
+			expRefused:   []*message.Transform{aesCBC128, dh1024},
+		},
+		{
+			description: "unknown transform type",
+			rules: factory.AlgorithmRules{
+				Block: []factory.AlgorithmRule{{Type: "cipher", Id: message.ENCR_3DES}},
+			},
+			expErr: true,
+		},
+		{
+			description: "invalid key length",
+			rules: factory.AlgorithmRules{
+				Allow: []factory.AlgorithmRule{{Type: "encr", Id: message.ENCR_AES_CBC, KeyLengths: []uint16{100}}},
+			},
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			policy, err := parseTransformPolicy(tc.rules, tc.defaultAllow)
+			if tc.expErr {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for _, transform := range tc.expAllowed {
+				if !policy.Allows(transform) {
+					t.Errorf("transform %d/%d refused", transform.TransformType, transform.TransformID)
+				}
+			}
+			for _, transform := range tc.expRefused {
+				if policy.Allows(transform) {
+					t.Errorf("transform %d/%d allowed", transform.TransformType, transform.TransformID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/omec-project/n3iwf/factory"
+)
+
+// validateNetworkConfig checks the bind addresses and ports of the N3IWF, so
+// the services and handlers can use them without further checks
+func validateNetworkConfig(cfg *factory.Configuration) error {
+	if err := validateBindIP("ikeBindAddress", cfg.IkeBindAddress, false); err != nil {
+		return err
+	}
+	if err := validateBindIP("gtpBindAddress", cfg.GtpBindAddress, true); err != nil {
+		return err
+	}
+	if err := validateIPSecAddress(cfg.IpSecAddress); err != nil {
+		return err
+	}
+	if cfg.TcpPort == 0 {
+		return errors.New("nasTcpPort is not set, e.g. 20000")
+	}
+	return nil
+}
+
+// validateBindIP checks that address is a unicast IP address literal, IPv4
+// only if so required
+func validateBindIP(field, address string, ipv4Only bool) error {
+	if address == "" {
+		return fmt.Errorf("%s is not set", field)
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("%s %q is not an IP address, host names are not supported", field, address)
+	}
+	if ipv4Only && ip.To4() == nil {
+		return fmt.Errorf("%s %q is not an IPv4 address", field, address)
+	}
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("%s %q is not a unicast address of a local interface", field, address)
+	}
+	return nil
+}
+
+// validateIPSecAddress checks that the IPsec gateway address, e.g.
+// 10.0.0.1/24, is a host address of an IPv4 subnet leaving room for UEs
+func validateIPSecAddress(ipSecAddress string) error {
+	if ipSecAddress == "" {
+		return errors.New("ipSecAddress is not set, e.g. 10.0.0.1/24")
+	}
+	gatewayIP, subnet, err := net.ParseCIDR(ipSecAddress)
+	if err != nil {
+		return fmt.Errorf("ipSecAddress %q is not in CIDR notation, e.g. 10.0.0.1/24", ipSecAddress)
+	}
+	gatewayIP = gatewayIP.To4()
+	if gatewayIP == nil {
+		return fmt.Errorf("ipSecAddress %q is not an IPv4 address", ipSecAddress)
+	}
+	ones, bits := subnet.Mask.Size()
+	if ones == bits {
+		return fmt.Errorf("ipSecAddress %q leaves no address to the UEs, use a shorter prefix", ipSecAddress)
+	}
+	// RFC 3021 /31 subnets have no network and broadcast addresses
+	if bits-ones >= 2 {
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range broadcast {
+			broadcast[i] = subnet.IP[i] | ^subnet.Mask[i]
+		}
+		if gatewayIP.Equal(subnet.IP) || gatewayIP.Equal(broadcast) {
+			return fmt.Errorf("ipSecAddress %q is the network or broadcast address of %s, use a host address",
+				ipSecAddress, subnet)
+		}
+	}
+	return nil
+}
+
+// maxInterfaceNameLength is IFNAMSIZ without the terminating NUL
+const maxInterfaceNameLength = 15
+
+// xfrmInterfaceIds validates the name and ID of the default XFRM interface
+// and returns the range of the IDs of the additional PDU sessions, count IDs
+// from 2 * id + 1 unless configured. The interfaces are named <name>-default
+// and <name>-<ID>
+func xfrmInterfaceIds(name string, id uint32, idRange factory.XfrmInterfaceIdRange, count uint32,
+) (uint32, uint32, error) {
+	if strings.ContainsAny(name, "/: \t\n") {
+		return 0, 0, fmt.Errorf("xfrmInterfaceName %q is not a valid interface name", name)
+	}
+	first := uint64(idRange.First)
+	if first == 0 {
+		first = 2*uint64(id) + 1
+	}
+	last := uint64(idRange.Last)
+	if last == 0 {
+		last = first + uint64(count) - 1
+	}
+	if first > math.MaxUint32 || last > math.MaxUint32 {
+		return 0, 0, fmt.Errorf("xfrmInterfaceIdRange [%d, %d] exceeds the 32-bit XFRM interface IDs", first, last)
+	}
+	if first > last {
+		return 0, 0, fmt.Errorf("xfrmInterfaceIdRange [%d, %d] is empty", first, last)
+	}
+	if uint64(id) >= first && uint64(id) <= last {
+		return 0, 0, fmt.Errorf("xfrmInterfaceIdRange [%d, %d] includes xfrmInterfaceId %d", first, last, id)
+	}
+	for _, suffix := range []string{"default", strconv.FormatUint(last, 10)} {
+		if ifaceName := name + "-" + suffix; len(ifaceName) > maxInterfaceNameLength {
+			return 0, 0, fmt.Errorf("XFRM interface name %s is longer than %d characters, shorten xfrmInterfaceName",
+				ifaceName, maxInterfaceNameLength)
+		}
+	}
+	return uint32(first), uint32(last), nil // #nosec G115
+}
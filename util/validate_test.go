@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2026 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"testing"
+
+	"github.com/omec-project/n3iwf/factory"
+)
+
+func TestValidateNetworkConfig(t *testing.T) {
+	testcases := []struct {
+		description string
+		modify      func(cfg *factory.Configuration)
+		expErr      bool
+	}{
+		{
+			description: "valid",
+			modify:      func(cfg *factory.Configuration) {},
+		},
+		{
+			description: "IPv6 IKE bind address",
+			modify:      func(cfg *factory.Configuration) { cfg.IkeBindAddress = "2001:db8::1" },
+		},
+		{
+			description: "/31 IPsec subnet",
+			modify:      func(cfg *factory.Configuration) { cfg.IpSecAddress = "10.0.0.0/31" },
+		},
+		{
+			description: "missing IKE bind address",
+			modify:      func(cfg *factory.Configuration) { cfg.IkeBindAddress = "" },
+			expErr:      true,
+		},
+		{
+			description: "IKE bind host name",
+			modify:      func(cfg *factory.Configuration) { cfg.IkeBindAddress = "n3iwf.local" },
+			expErr:      true,
+		},
+		{
+			description: "unspecified IKE bind address",
+			modify:      func(cfg *factory.Configuration) { cfg.IkeBindAddress = "0.0.0.0" },
+			expErr:      true,
+		},
+		{
+			description: "IPv6 GTP bind address",
+			modify:      func(cfg *factory.Configuration) { cfg.GtpBindAddress = "2001:db8::1" },
+			expErr:      true,
+		},
+		{
+			description: "IPsec address without prefix",
+			modify:      func(cfg *factory.Configuration) { cfg.IpSecAddress = "10.0.0.1" },
+			expErr:      true,
+		},
+		{
+			description: "IPv6 IPsec address",
+			modify:      func(cfg *factory.Configuration) { cfg.IpSecAddress = "2001:db8::1/64" },
+			expErr:      true,
+		},
+		{
+			description: "IPsec gateway is the network address",
+			modify:      func(cfg *factory.Configuration) { cfg.IpSecAddress = "10.0.0.0/24" },
+			expErr:      true,
+		},
+		{
+			description: "IPsec gateway is the broadcast address",
+			modify:      func(cfg *factory.Configuration) { cfg.IpSecAddress = "10.0.0.255/24" },
+			expErr:      true,
+		},
+		{
+			description: "no UE address left",
+			modify:      func(cfg *factory.Configuration) { cfg.IpSecAddress = "10.0.0.1/32" },
+			expErr:      true,
+		},
+		{
+			description: "missing NAS TCP port",
+			modify:      func(cfg *factory.Configuration) { cfg.TcpPort = 0 },
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			cfg := &factory.Configuration{
+				IkeBindAddress: "192.168.1.10",
+				GtpBindAddress: "192.168.2.10",
+				IpSecAddress:   "10.0.0.1/24",
+				TcpPort:        20000,
+			}
+			tc.modify(cfg)
+			err := validateNetworkConfig(cfg)
+			if tc.expErr && err == nil {
+				t.Errorf("Expected error but got none")
+			}
+			if !tc.expErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestXfrmInterfaceIds(t *testing.T) {
+	testcases := []struct {
+		description string
+		name        string
+		idRange     factory.XfrmInterfaceIdRange
+		expFirst    uint32
+		expLast     uint32
+		expErr      bool
+	}{
+		{description: "default range", name: "ipsec", expFirst: 15, expLast: 4110},
+		{description: "configured range", name: "ipsec", idRange: factory.XfrmInterfaceIdRange{First: 100, Last: 199}, expFirst: 100, expLast: 199},
+		{description: "configured first ID", name: "ipsec", idRange: factory.XfrmInterfaceIdRange{First: 100}, expFirst: 100, expLast: 4195},
+		{description: "empty range", name: "ipsec", idRange: factory.XfrmInterfaceIdRange{First: 200, Last: 100}, expErr: true},
+		{description: "range includes the default ID", name: "ipsec", idRange: factory.XfrmInterfaceIdRange{First: 1, Last: 10}, expErr: true},
+		{description: "range beyond 32 bits", name: "ipsec", idRange: factory.XfrmInterfaceIdRange{First: 4294967295}, expErr: true},
+		{description: "name too long", name: "n3iwf-ipsec", expErr: true},
+		{description: "name too long for the last ID", name: "ipsec", idRange: factory.XfrmInterfaceIdRange{First: 100, Last: 4000000000}, expErr: true},
+		{description: "invalid name", name: "ip/sec", expErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			first, last, err := xfrmInterfaceIds(tc.name, 7, tc.idRange, 4096)
+			if tc.expErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if first != tc.expFirst || last != tc.expLast {
+				t.Errorf("range mismatch. got = [%d, %d], want = [%d, %d]", first, last, tc.expFirst, tc.expLast)
+			}
+		})
+	}
+}